@@ -0,0 +1,98 @@
+// Watchdog for the freshness of QRank data.
+//
+// Compares the dates of the latest Wikimedia database dumps with the
+// dumps from which the per-site files in object storage were built.
+// The result is a JSON report; if any of the largest wikis is stale,
+// the exit code is 1, which makes it suitable for a cron alert.
+//
+//	dumpwatch -dumps /public/dumps/public -top 20 -max-age 45
+//
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/objstore"
+)
+
+func main() {
+	dumps := flag.String("dumps", "/public/dumps/public", "path to Wikimedia dumps")
+	storagekey := flag.String("storage-key", "", "path to key with storage access credentials")
+	top := flag.Int("top", 20, "number of wikis, by size of their page table, that must not be stale")
+	maxAge := flag.Int("max-age", 45, "number of days after which a wiki counts as stale")
+	out := flag.String("o", "", "path to output file for the JSON report; standard output if empty")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Exits with status 1 if any of the top wikis is stale.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 0 || *top < 0 || *maxAge < 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	storage, err := NewStorageClient(*storagekey)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	opts := WatchOptions{Top: *top, MaxAgeDays: *maxAge, Now: time.Now()}
+	report, err := Watch(ctx, *dumps, storage, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := writeReport(report, *out); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(report.Stale) > 0 {
+		fmt.Fprintf(os.Stderr, "stale wikis: %v\n", report.Stale)
+		os.Exit(1)
+	}
+}
+
+// WriteReport writes a report as indented JSON to a file, or to
+// standard output if path is empty.
+func writeReport(report *Report, path string) error {
+	if path == "" {
+		return encodeReport(report, os.Stdout)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := encodeReport(report, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func encodeReport(report *Report, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// NewStorageClient sets up a client for accessing S3-compatible object storage.
+func NewStorageClient(keypath string) (*objstore.Router, error) {
+	config, err := objstore.ReadConfig(keypath)
+	if err != nil {
+		return nil, err
+	}
+	return objstore.NewRouter(config, "QRankDumpWatch")
+}
@@ -0,0 +1,211 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Storage is the subset of minio.Client used in this program.
+// For testing, struct fakeStorage provides a fake implementation.
+type Storage interface {
+	ListObjects(ctx context.Context, bucketName string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo
+}
+
+// WatchOptions controls which wikis count as stale.
+type WatchOptions struct {
+	// Top is the number of wikis, ranked by the size of their page
+	// table dump, that must not be stale.
+	Top int
+
+	// MaxAgeDays is the number of days after which a site is stale,
+	// counting from the dump date of its files in storage.
+	MaxAgeDays int
+
+	// Now is the time of the check.
+	Now time.Time
+}
+
+// Report is the machine-readable output of the watchdog.
+type Report struct {
+	Checked    string        `json:"checked"` // eg. "2024-05-20"
+	Top        int           `json:"top"`
+	MaxAgeDays int           `json:"max_age_days"`
+	Stale      []string      `json:"stale"` // keys of stale top wikis
+	Sites      []*SiteReport `json:"sites"` // ordered by rank
+}
+
+// SiteReport tells how fresh the data for one wiki is.
+type SiteReport struct {
+	Key  string `json:"key"`  // eg. "rmwiki"
+	Rank int    `json:"rank"` // 1 for the largest wiki
+
+	// Dumped is the date of the latest complete dump on disk.
+	Dumped string `json:"dumped"`
+
+	// Stored is the dump date of the site’s files in storage,
+	// or the empty string if storage has no files for the site.
+	Stored string `json:"stored,omitempty"`
+
+	// AgeDays is the number of days since the Stored date,
+	// or -1 if storage has no files for the site.
+	AgeDays int `json:"age_days"`
+
+	// Pending is true if a more recent dump is available on disk
+	// than the one in storage.
+	Pending bool `json:"pending"`
+
+	// Stale is true if the site is among the top wikis, and its data
+	// in storage is older than allowed, or missing entirely.
+	Stale bool `json:"stale"`
+}
+
+// Watch checks the freshness of the per-site files in storage.
+func Watch(ctx context.Context, dumps string, storage Storage, opts WatchOptions) (*Report, error) {
+	dumped, err := scanDumps(dumps)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := scanStorage(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return makeReport(dumped, stored, opts), nil
+}
+
+// SiteDump describes the latest dump of a wiki on disk.
+type siteDump struct {
+	key      string
+	dumped   time.Time
+	pageSize int64 // size of the page table dump, in bytes
+}
+
+// ScanDumps finds the latest complete dump of every wiki in a local
+// mirror of the Wikimedia dumps. Like qrank-builder, we follow the
+// "latest" symlinks of the tables we need; a dump is only complete
+// when all of them have been updated.
+func scanDumps(dumps string) (map[string]*siteDump, error) {
+	entries, err := os.ReadDir(dumps)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]*siteDump, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		key := e.Name()
+		var dumped time.Time
+		for _, f := range []string{"page.sql.gz", "pagelinks.sql.gz", "page_props.sql.gz"} {
+			latestFile := fmt.Sprintf("%s-latest-%s", key, f)
+			latestPath := filepath.Join(dumps, key, "latest", latestFile)
+			latest, err := filepath.EvalSymlinks(latestPath)
+			if err != nil {
+				continue
+			}
+			version := filepath.Base(filepath.Dir(latest))
+			if d, err := time.Parse("20060102", version); err == nil {
+				if dumped.IsZero() || d.Before(dumped) {
+					dumped = d
+				}
+			}
+		}
+		if dumped.IsZero() {
+			continue
+		}
+
+		site := &siteDump{key: key, dumped: dumped}
+		pagePath := filepath.Join(dumps, key, "latest", key+"-latest-page.sql.gz")
+		if stat, err := os.Stat(pagePath); err == nil {
+			site.pageSize = stat.Size()
+		}
+		result[key] = site
+	}
+
+	return result, nil
+}
+
+var pageSignalsRegexp = regexp.MustCompile(`^page_signals/([a-z0-9_]+)-(\d{8})-page_signals\.zst$`)
+
+// ScanStorage returns the dump date of the most recent page_signals
+// file in storage, keyed by site. The page_signals files are the last
+// per-site stage of qrank-builder, so their date tells which dump
+// went into the ranking.
+func scanStorage(ctx context.Context, storage Storage) (map[string]time.Time, error) {
+	result := make(map[string]time.Time, 1000)
+	opts := minio.ListObjectsOptions{Prefix: "page_signals/", Recursive: true}
+	for obj := range storage.ListObjects(ctx, "qrank", opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		m := pageSignalsRegexp.FindStringSubmatch(obj.Key)
+		if m == nil {
+			continue
+		}
+		date, err := time.Parse("20060102", m[2])
+		if err != nil {
+			continue
+		}
+		if date.After(result[m[1]]) {
+			result[m[1]] = date
+		}
+	}
+	return result, nil
+}
+
+// MakeReport ranks wikis by the size of their page table dump, and
+// compares their latest dump with the dump date of the files in storage.
+func makeReport(dumped map[string]*siteDump, stored map[string]time.Time, opts WatchOptions) *Report {
+	sites := make([]*siteDump, 0, len(dumped))
+	for _, d := range dumped {
+		sites = append(sites, d)
+	}
+	sort.Slice(sites, func(i, j int) bool {
+		if sites[i].pageSize != sites[j].pageSize {
+			return sites[i].pageSize > sites[j].pageSize
+		}
+		return sites[i].key < sites[j].key
+	})
+
+	report := &Report{
+		Checked:    opts.Now.Format(time.DateOnly),
+		Top:        opts.Top,
+		MaxAgeDays: opts.MaxAgeDays,
+		Stale:      []string{},
+		Sites:      make([]*SiteReport, 0, len(sites)),
+	}
+	for i, d := range sites {
+		r := &SiteReport{
+			Key:     d.key,
+			Rank:    i + 1,
+			Dumped:  d.dumped.Format(time.DateOnly),
+			AgeDays: -1,
+		}
+		if s, ok := stored[d.key]; ok {
+			r.Stored = s.Format(time.DateOnly)
+			r.AgeDays = int(opts.Now.Sub(s).Hours() / 24)
+			r.Pending = d.dumped.After(s)
+		} else {
+			r.Pending = true
+		}
+		if r.Rank <= opts.Top && (r.AgeDays < 0 || r.AgeDays > opts.MaxAgeDays) {
+			r.Stale = true
+			report.Stale = append(report.Stale, r.Key)
+		}
+		report.Sites = append(report.Sites, r)
+	}
+
+	return report
+}
@@ -0,0 +1,163 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestWatch(t *testing.T) {
+	dumps := t.TempDir()
+	makeTestDump(t, dumps, "enwiki", "20240501", 5000)
+	makeTestDump(t, dumps, "dewiki", "20240501", 3000)
+	makeTestDump(t, dumps, "rmwiki", "20240420", 10)
+	makeTestDump(t, dumps, "frwiki", "20240501", 4000)
+	if err := os.MkdirAll(filepath.Join(dumps, "other"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := &fakeStorage{keys: []string{
+		"page_signals/enwiki-20240501-page_signals.zst",
+		"page_signals/dewiki-20240301-page_signals.zst",
+		"page_signals/rmwiki-20240301-page_signals.zst",
+		"page_signals/rmwiki-20240420-page_signals.zst",
+		"page_signals/README.txt",
+	}}
+
+	now, _ := time.Parse(time.DateOnly, "2024-05-11")
+	opts := WatchOptions{Top: 3, MaxAgeDays: 45, Now: now}
+	report, err := Watch(context.Background(), dumps, storage, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := report.Stale, []string{"frwiki", "dewiki"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got Stale=%v, want %v", got, want)
+	}
+
+	got := make([]string, 0, len(report.Sites))
+	for _, s := range report.Sites {
+		got = append(got, fmt.Sprintf("%d:%s:%s:%s:%d:%v:%v", s.Rank, s.Key, s.Dumped, s.Stored, s.AgeDays, s.Pending, s.Stale))
+	}
+	want := []string{
+		"1:enwiki:2024-05-01:2024-05-01:10:false:false",
+		"2:frwiki:2024-05-01::-1:true:true",
+		"3:dewiki:2024-05-01:2024-03-01:71:true:true",
+		"4:rmwiki:2024-04-20:2024-04-20:21:false:false",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestScanDumps_Incomplete(t *testing.T) {
+	// When a dump is still in progress, some "latest" symlinks point
+	// to the new dump while others still point to the previous one.
+	dumps := t.TempDir()
+	makeTestDump(t, dumps, "rmwiki", "20240401", 10)
+	makeTestDump(t, dumps, "rmwiki", "20240501", 10)
+	link := filepath.Join(dumps, "rmwiki", "latest", "rmwiki-latest-pagelinks.sql.gz")
+	if err := os.Remove(link); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../20240401/rmwiki-20240401-pagelinks.sql.gz", link); err != nil {
+		t.Fatal(err)
+	}
+
+	sites, err := scanDumps(dumps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sites["rmwiki"].dumped.Format(time.DateOnly), "2024-04-01"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestScanStorage_Error(t *testing.T) {
+	storage := &fakeStorage{err: fmt.Errorf("test error")}
+	if _, err := scanStorage(context.Background(), storage); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	report := &Report{
+		Checked:    "2024-05-11",
+		Top:        1,
+		MaxAgeDays: 45,
+		Stale:      []string{},
+		Sites:      []*SiteReport{{Key: "rmwiki", Rank: 1, Dumped: "2024-05-01", AgeDays: -1, Pending: true}},
+	}
+	if err := writeReport(report, path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(strings.Fields(string(data)), "")
+	want := `{"checked":"2024-05-11","top":1,"max_age_days":45,"stale":[],"sites":[{"key":"rmwiki","rank":1,"dumped":"2024-05-01","age_days":-1,"pending":true,"stale":false}]}`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// MakeTestDump creates a fake dump of a wiki, with the same directory
+// structure and symlinks as the Wikimedia dumps on Toolforge.
+func makeTestDump(t *testing.T, dumps, key, ymd string, pageSize int) {
+	dir := filepath.Join(dumps, key, ymd)
+	latest := filepath.Join(dumps, key, "latest")
+	for _, d := range []string{dir, latest} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"page.sql.gz", "pagelinks.sql.gz", "page_props.sql.gz"} {
+		name := fmt.Sprintf("%s-%s-%s", key, ymd, f)
+		size := 1
+		if f == "page.sql.gz" {
+			size = pageSize
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		link := filepath.Join(latest, fmt.Sprintf("%s-latest-%s", key, f))
+		os.Remove(link)
+		if err := os.Symlink(filepath.Join("..", ymd, name), link); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type fakeStorage struct {
+	keys []string
+	err  error
+}
+
+func (s *fakeStorage) ListObjects(ctx context.Context, bucketName string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	ch := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(ch)
+		if s.err != nil {
+			ch <- minio.ObjectInfo{Err: s.err}
+			return
+		}
+		for _, key := range s.keys {
+			if bucketName == "qrank" && strings.HasPrefix(key, opts.Prefix) {
+				ch <- minio.ObjectInfo{Key: key}
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,267 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/cogtiff"
+	"github.com/brawer/wikidata-qrank/v2/pkg/osmviews"
+)
+
+// MaxChangeDrift is how far the date of the previous output may be
+// from exactly 52 weeks before the current one. Storage keeps one
+// output per month for a year, see Cleanup(), so there is always one
+// within this distance.
+const maxChangeDrift = 6 * 7 * 24 * time.Hour
+
+// ChangeDescription returns the ImageDescription of a change raster
+// that compares the output for date with the output for prevDate.
+// Both dates are in YYYYMMDD format.
+func changeDescription(date, prevDate string) string {
+	return fmt.Sprintf(
+		"OpenStreetMap view density change from %s to %s, as log2((1 + views) / (1 + previous views)), views in weekly user views per km2",
+		formatDate(prevDate), formatDate(date))
+}
+
+// FormatDate turns a date such as "20240602" into "2024-06-02".
+// Malformed dates get returned unchanged.
+func formatDate(date string) string {
+	if t, err := time.Parse("20060102", date); err == nil {
+		return t.Format(time.DateOnly)
+	}
+	return date
+}
+
+// FindPreviousYear returns the date, among the dates of earlier outputs,
+// which is closest to 52 weeks before date. All dates are in YYYYMMDD
+// format. If no output is close enough, the result is false.
+func findPreviousYear(dates []string, date string) (string, bool) {
+	cur, err := time.Parse("20060102", date)
+	if err != nil {
+		return "", false
+	}
+	target := cur.AddDate(0, 0, -364)
+	best, bestDrift := "", maxChangeDrift+1
+	for _, d := range dates {
+		t, err := time.Parse("20060102", d)
+		if err != nil || !t.Before(cur) {
+			continue
+		}
+		drift := t.Sub(target).Abs()
+		if drift < bestDrift || (drift == bestDrift && d > best) {
+			best, bestDrift = d, drift
+		}
+	}
+	return best, best != ""
+}
+
+// FetchPreviousYear finds the output from about one year before date,
+// and returns its date and the path to a local copy. Outputs get looked
+// up in the local cache directory, and for published builds in storage,
+// from where they get downloaded into the cache. The variant is the
+// part of the file name for regional or quantized builds, as in main().
+// If there is no such output, the returned path is empty.
+func fetchPreviousYear(ctx context.Context, storage Storage, cachedir, variant, date string) (string, string, error) {
+	localRe := regexp.MustCompile(`^osmviews` + regexp.QuoteMeta(variant) + `-(\d{8})\.tiff$`)
+	dates := make([]string, 0, 20)
+	entries, err := os.ReadDir(cachedir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", err
+	}
+	for _, e := range entries {
+		if m := localRe.FindStringSubmatch(e.Name()); m != nil {
+			dates = append(dates, m[1])
+		}
+	}
+
+	remoteRe := regexp.MustCompile(`^public/osmviews-(\d{8})\.tiff$`)
+	if storage != nil {
+		files, err := storage.List(ctx, "qrank", "public/osmviews-")
+		if err != nil {
+			return "", "", err
+		}
+		for _, f := range files {
+			if m := remoteRe.FindStringSubmatch(f.Key); m != nil {
+				dates = append(dates, m[1])
+			}
+		}
+	}
+
+	prevDate, found := findPreviousYear(dates, date)
+	if !found {
+		return "", "", nil
+	}
+
+	localpath := filepath.Join(cachedir, fmt.Sprintf("osmviews%s-%s.tiff", variant, prevDate))
+	if _, err := os.Stat(localpath); err == nil {
+		return prevDate, localpath, nil
+	}
+
+	remotepath := fmt.Sprintf("public/osmviews-%s.tiff", prevDate)
+	if err := download(ctx, storage, "qrank", remotepath, localpath); err != nil {
+		return "", "", err
+	}
+	return prevDate, localpath, nil
+}
+
+// Download copies a file from storage to local disk. The file only
+// appears under its final name once it has been completely written.
+func download(ctx context.Context, storage Storage, bucket, remotepath, localpath string) error {
+	r, err := storage.Get(ctx, bucket, remotepath)
+	if err != nil {
+		return err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	tmp := localpath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, localpath)
+}
+
+// BuildChange writes a GeoTIFF with the year-over-year change in views,
+// comparing the output at path with the previous year’s output
+// at prevPath. Each pixel is log2((1 + views) / (1 + previous views)),
+// so +1 means that views have doubled, -1 that they have halved,
+// and 0 that nothing has changed. The overviews compare the overviews
+// of both inputs. The inputs must cover the area of the root tile
+// at the same zoom level; they may be quantized, but the output
+// is always in 32-bit floats.
+func buildChange(ctx context.Context, path, prevPath, changePath string, root osmviews.TileKey, opts RasterOptions) error {
+	curFile, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer curFile.Close()
+
+	prevFile, err := os.Open(prevPath)
+	if err != nil {
+		return err
+	}
+	defer prevFile.Close()
+
+	cur, err := cogtiff.NewReader(curFile)
+	if err != nil {
+		return err
+	}
+	prev, err := cogtiff.NewReader(prevFile)
+	if err != nil {
+		return err
+	}
+
+	if len(cur.Images) != len(prev.Images) ||
+		cur.Images[0].Width != prev.Images[0].Width ||
+		cur.Images[0].Height != prev.Images[0].Height {
+		return fmt.Errorf("%s and %s differ in size, cannot compare", path, prevPath)
+	}
+	numImages := len(cur.Images)
+	if numImages-1 > maxRasterDepth {
+		return fmt.Errorf("%s has too many overviews", path)
+	}
+
+	opts.Signed, opts.Quantize = true, false
+	zoom := root.Zoom() + uint8(numImages-1)
+	writer, err := NewRasterWriter(changePath, root, zoom, opts)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < numImages; i++ {
+		if err := writeChange(ctx, writer, cur.Images[i], prev.Images[i], zoom-uint8(i)); err != nil {
+			writer.Abort()
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		writer.Abort()
+		return err
+	}
+	return nil
+}
+
+// WriteChange computes the change between two images at zoom level zoom,
+// and writes it to w. Many tiles share their data, such as the open sea,
+// so tiles whose inputs have already been seen are not decoded again
+// if they were uniform.
+func writeChange(ctx context.Context, w *RasterWriter, cur, prev *cogtiff.Image, zoom uint8) error {
+	curOffsets, err := cur.TileOffsets()
+	if err != nil {
+		return err
+	}
+	prevOffsets, err := prev.TileOffsets()
+	if err != nil {
+		return err
+	}
+	numTiles := int(w.numTiles(zoom))
+	if len(curOffsets) != numTiles || len(prevOffsets) != numTiles || cur.TileWidth != 256 || prev.TileWidth != 256 {
+		return fmt.Errorf("cannot compare images at zoom %d", zoom)
+	}
+
+	rootZoom, rootX, rootY := w.root.ZoomXY()
+	depth := zoom - rootZoom
+	across := w.tilesAcross(zoom)
+	curViews := make([]float32, 256*256)
+	prevViews := make([]float32, 256*256)
+	uniform := make(map[[2]uint64]float32, 1000)
+	raster := NewRaster(w.root, nil)
+	for index := range curOffsets {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		x, y := uint32(index)%across, uint32(index)/across
+		raster.reset(osmviews.MakeTileKey(zoom, rootX<<depth+x, rootY<<depth+y), nil)
+		key := [2]uint64{curOffsets[index], prevOffsets[index]}
+		if val, ok := uniform[key]; ok {
+			for i := range raster.pixels {
+				raster.pixels[i] = val
+			}
+		} else {
+			if err := readViews(cur, index, curViews); err != nil {
+				return err
+			}
+			if err := readViews(prev, index, prevViews); err != nil {
+				return err
+			}
+			isUniform := true
+			for i := range raster.pixels {
+				c := float64(max(curViews[i], 0))
+				p := float64(max(prevViews[i], 0))
+				raster.pixels[i] = float32(math.Log2((1 + c) / (1 + p)))
+				isUniform = isUniform && raster.pixels[i] == raster.pixels[0]
+			}
+			if isUniform {
+				uniform[key] = raster.pixels[0]
+			}
+		}
+
+		if err := w.Write(raster); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/cogtiff"
+	"github.com/brawer/wikidata-qrank/v2/pkg/osmviews"
+)
+
+func TestBuildChange(t *testing.T) {
+	prev := writeTestRasters(t, RasterOptions{})
+	cur := writeUniformTestRasters(t, RasterOptions{Quantize: true}, [4]uint32{3, 7, 15, 0})
+	path := filepath.Join(t.TempDir(), "change.tif")
+	opts := RasterOptions{Description: changeDescription("20240602", "20230604")}
+	if err := buildChange(context.Background(), cur, prev, path, osmviews.WorldTile, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := "OpenStreetMap view density change from 2023-06-04 to 2024-06-02"
+	if !bytes.Contains(data, []byte(desc)) {
+		t.Errorf("ImageDescription should contain %q", desc)
+	}
+
+	tiff, err := cogtiff.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(tiff.Images); n != 2 {
+		t.Fatalf("got %d images, want 2", n)
+	}
+	pixels := make([]float32, 256*256)
+	for tile, want := range []float32{1, 0, 1, -3} {
+		if err := tiff.Images[0].ReadTile(tile, pixels); err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(float64(pixels[0]-want)) > 0.001 {
+			t.Errorf("tile %d: got %v, want %v", tile, pixels[0], want)
+		}
+	}
+	if err := tiff.Images[0].ReadTile(0, pixels); err != nil {
+		t.Fatal(err)
+	}
+	if want := float32(math.Log2(4.0 / 43.0)); math.Abs(float64(pixels[257]-want)) > 0.001 {
+		t.Errorf("tile 0: got pixel %v, want %v", pixels[257], want)
+	}
+}
+
+func TestBuildChange_DifferentSize(t *testing.T) {
+	prev := writeTestRasters(t, RasterOptions{})
+	cur := filepath.Join(t.TempDir(), "cur.tif")
+	tile := osmviews.MakeTileKey(1, 0, 0)
+	w, err := NewRasterWriter(cur, tile, 1, RasterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteUniform(tile, 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "change.tif")
+	if err := buildChange(context.Background(), cur, prev, path, osmviews.WorldTile, RasterOptions{}); err == nil {
+		t.Error("expected error for inputs of different size")
+	}
+}
+
+func TestRasterWriter_SignedQuantized(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.tif")
+	opts := RasterOptions{Signed: true, Quantize: true}
+	if _, err := NewRasterWriter(path, osmviews.WorldTile, 1, opts); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestFindPreviousYear(t *testing.T) {
+	dates := []string{"20230521", "20230529", "20230611", "20240526", "bad"}
+	for _, tc := range []struct {
+		date, want string
+	}{
+		{"20240602", "20230529"},
+		{"20240609", "20230611"},
+		{"20240901", ""},
+		{"2024", ""},
+	} {
+		got, found := findPreviousYear(dates, tc.date)
+		if got != tc.want || found != (tc.want != "") {
+			t.Errorf("findPreviousYear(%q) = %q, %v; want %q", tc.date, got, found, tc.want)
+		}
+	}
+}
+
+func TestFetchPreviousYear(t *testing.T) {
+	ctx := context.Background()
+	cachedir := t.TempDir()
+	src := filepath.Join(t.TempDir(), "src.tiff")
+	if err := os.WriteFile(src, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewFakeStorage()
+	for _, path := range []string{
+		"public/osmviews-20230604.tiff",
+		"public/osmviews-stats-20230604.json",
+		"public/osmviews-20240526.tiff",
+	} {
+		if err := s.PutFile(ctx, "qrank", path, src, "image/tiff"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	date, path, err := fetchPreviousYear(ctx, s, cachedir, "", "20240602")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if date != "20230604" {
+		t.Errorf("got date %q, want 20230604", date)
+	}
+	if want := filepath.Join(cachedir, "osmviews-20230604.tiff"); path != want {
+		t.Errorf("got path %q, want %q", path, want)
+	}
+	if got, err := os.ReadFile(path); err != nil || string(got) != "old" {
+		t.Errorf("got %q, %v; want downloaded content", got, err)
+	}
+
+	// Without storage, only the local cache gets searched.
+	date, path, err = fetchPreviousYear(ctx, nil, t.TempDir(), "", "20240602")
+	if date != "" || path != "" || err != nil {
+		t.Errorf(`got %q, %q, %v; want "", "", nil`, date, path, err)
+	}
+}
+
+// WriteUniformTestRasters writes a GeoTIFF whose main image has four
+// uniformly colored tiles.
+func writeUniformTestRasters(t *testing.T, opts RasterOptions, colors [4]uint32) string {
+	path := filepath.Join(t.TempDir(), "uniform.tif")
+	w, err := NewRasterWriter(path, osmviews.WorldTile, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, col := range colors {
+		tile := osmviews.MakeTileKey(1, uint32(i%2), uint32(i/2))
+		if err := w.WriteUniform(tile, col); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteUniform(osmviews.WorldTile, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,349 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Fetcher downloads files over HTTP. Transient failures, such as
+// a 503 Service Unavailable or a connection that breaks in the middle
+// of a download, get retried with exponential backoff. When retrying,
+// the Fetcher asks the server for the missing part only, so a failure
+// near the end of a large download does not need to fetch everything
+// again. Without retries, one hiccup of the server would abort
+// a build that has been running for an hour.
+type Fetcher struct {
+	client      *http.Client
+	metrics     *FetchMetrics
+	maxAttempts int
+	backoff     time.Duration // wait time before the first retry
+	maxBackoff  time.Duration
+	sleep       func(ctx context.Context, d time.Duration) error
+}
+
+// NewFetcher returns a Fetcher that uses client for making requests.
+// If metrics is nil, no metrics are collected.
+func NewFetcher(client *http.Client, metrics *FetchMetrics) *Fetcher {
+	return &Fetcher{
+		client:      client,
+		metrics:     metrics,
+		maxAttempts: 8,
+		backoff:     5 * time.Second,
+		maxBackoff:  5 * time.Minute,
+		sleep:       sleepContext,
+	}
+}
+
+// Download is a file that has been fetched into a temporary file
+// on local disk. Closing a Download deletes the temporary file.
+type Download struct {
+	*os.File
+	Header http.Header
+}
+
+// Close closes and deletes the temporary file.
+func (d *Download) Close() error {
+	err := d.File.Close()
+	if rmErr := os.Remove(d.File.Name()); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// Fetch downloads a file. If publishedSize is not empty, the size
+// of the downloaded file gets verified against it. The published size
+// is in the format of Apache directory listings, such as "672"
+// or "1.0M", which is what planet.openstreetmap.org shows.
+func (f *Fetcher) Fetch(ctx context.Context, url string, publishedSize string) (*Download, error) {
+	start := time.Now()
+	file, err := os.CreateTemp("", "osmviews-builder-fetch-*")
+	if err != nil {
+		return nil, err
+	}
+	d := &Download{File: file}
+
+	var attempt int
+	for attempt = 1; ; attempt++ {
+		f.metrics.attempt()
+		err = f.fetchOnce(ctx, url, d)
+		if err == nil && publishedSize != "" {
+			err = d.verifySize(publishedSize)
+		}
+		if err == nil {
+			break
+		}
+
+		var retryable *retryableError
+		if !errors.As(err, &retryable) {
+			break
+		}
+		if attempt >= f.maxAttempts {
+			err = fmt.Errorf("failed to fetch %s after %d attempts: %w", url, attempt, retryable.err)
+			break
+		}
+		if logger != nil {
+			logger.Printf("attempt %d to fetch %s failed, will retry: %v", attempt, url, err)
+		}
+		if err = f.sleep(ctx, f.backoffFor(attempt)); err != nil {
+			break
+		}
+	}
+
+	size, _ := d.Seek(0, io.SeekEnd)
+	if err != nil {
+		d.Close()
+		f.metrics.done("failed", size, time.Since(start))
+		return nil, err
+	}
+
+	if _, err := d.Seek(0, io.SeekStart); err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	f.metrics.done("ok", size, time.Since(start))
+	if logger != nil {
+		logger.Printf("fetched %s, %d bytes in %d attempts, %.1fs",
+			url, size, attempt, time.Since(start).Seconds())
+	}
+	return d, nil
+}
+
+// FetchOnce makes one attempt to fetch a file into d. If d already
+// contains the beginning of the file from an earlier attempt, we ask
+// the server for the remaining bytes only.
+func (f *Fetcher) fetchOnce(ctx context.Context, url string, d *Download) error {
+	offset, err := d.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &retryableError{err}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		// Either this is our first attempt, or the server ignored
+		// our Range header. Either way, we start from scratch.
+		if err := d.restart(); err != nil {
+			return err
+		}
+
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			if err := d.restart(); err != nil {
+				return err
+			}
+			return &retryableError{fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))}
+		}
+
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The file has probably changed on the server since our
+		// last attempt, so we need to start over again.
+		if err := d.restart(); err != nil {
+			return err
+		}
+		return &retryableError{fmt.Errorf("StatusCode=%d", resp.StatusCode)}
+
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return &retryableError{fmt.Errorf("StatusCode=%d", resp.StatusCode)}
+
+	default:
+		return fmt.Errorf("failed to fetch %s, StatusCode=%d", url, resp.StatusCode)
+	}
+
+	if d.Header == nil || resp.StatusCode == http.StatusOK {
+		d.Header = resp.Header
+	}
+	// If the connection breaks before we have received Content-Length
+	// bytes, net/http reports io.ErrUnexpectedEOF. We keep what we got,
+	// and ask for the remainder in our next attempt.
+	if _, err := io.Copy(d.File, resp.Body); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &retryableError{err}
+	}
+	return nil
+}
+
+// Restart discards any previously downloaded data.
+func (d *Download) restart() error {
+	if err := d.Truncate(0); err != nil {
+		return err
+	}
+	_, err := d.Seek(0, io.SeekStart)
+	return err
+}
+
+// VerifySize checks the size of the downloaded file against
+// the size published in an Apache directory listing. If they
+// do not match, the downloaded data gets discarded, and we retry;
+// the file might have been replaced while we were fetching it.
+func (d *Download) verifySize(published string) error {
+	size, err := d.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if got := apacheSize(size); got != published {
+		if err := d.restart(); err != nil {
+			return err
+		}
+		return &retryableError{fmt.Errorf("got %d bytes (%s), but published size is %s", size, got, published)}
+	}
+	return nil
+}
+
+func (f *Fetcher) backoffFor(attempt int) time.Duration {
+	d := f.backoff
+	for i := 1; i < attempt && d < f.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > f.maxBackoff {
+		d = f.maxBackoff
+	}
+	return d
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+var contentRangeRegexp = regexp.MustCompile(`^bytes (\d+)-\d+/(\d+|\*)$`)
+
+// ContentRangeStart returns the first byte position of a Content-Range
+// header, such as 500 for "bytes 500-999/1000".
+func contentRangeStart(s string) (int64, bool) {
+	m := contentRangeRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(m[1], 10, 64)
+	return start, err == nil
+}
+
+// ApacheSize formats a file size like the Apache web server does
+// in its directory listings, for example "672" or "1.0M". This is
+// a port of apr_strfsize() from the Apache Portable Runtime.
+func apacheSize(size int64) string {
+	if size < 0 {
+		return "-"
+	}
+	if size < 973 {
+		return strconv.FormatInt(size, 10)
+	}
+	const units = "KMGTPE"
+	for i := 0; ; i++ {
+		remain := size & 1023
+		size >>= 10
+		if size >= 973 {
+			continue
+		}
+		unit := units[i]
+		if size < 9 || (size == 9 && remain < 973) {
+			if remain = (remain*5 + 256) / 512; remain >= 10 {
+				size, remain = size+1, 0
+			}
+			return fmt.Sprintf("%d.%d%c", size, remain, unit)
+		}
+		if remain >= 512 {
+			size++
+		}
+		return strings.TrimSpace(fmt.Sprintf("%3d%c", size, unit))
+	}
+}
+
+// FetchMetrics are Prometheus metrics about downloads.
+type FetchMetrics struct {
+	downloads *prometheus.CounterVec
+	attempts  prometheus.Counter
+	bytes     prometheus.Counter
+	duration  prometheus.Histogram
+}
+
+// NewFetchMetrics creates download metrics and registers them.
+func NewFetchMetrics(reg prometheus.Registerer) *FetchMetrics {
+	m := &FetchMetrics{
+		downloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "osmviews_builder_downloads_total",
+			Help: "Number of completed downloads, by result.",
+		}, []string{"result"}),
+		attempts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "osmviews_builder_download_attempts_total",
+			Help: "Number of HTTP requests for downloads, including retries.",
+		}),
+		bytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "osmviews_builder_download_bytes_total",
+			Help: "Number of bytes in downloaded files.",
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "osmviews_builder_download_duration_seconds",
+			Help:    "Time for fetching a file, including retries.",
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+		}),
+	}
+	reg.MustRegister(m.downloads, m.attempts, m.bytes, m.duration)
+	return m
+}
+
+func (m *FetchMetrics) attempt() {
+	if m != nil {
+		m.attempts.Inc()
+	}
+}
+
+func (m *FetchMetrics) done(result string, size int64, duration time.Duration) {
+	if m != nil {
+		m.downloads.WithLabelValues(result).Inc()
+		if result == "ok" {
+			m.bytes.Add(float64(size))
+		}
+		m.duration.Observe(duration.Seconds())
+	}
+}
@@ -0,0 +1,180 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// NewTestFetcher returns a Fetcher that does not wait between retries.
+func newTestFetcher(client *http.Client) *Fetcher {
+	f := NewFetcher(client, nil)
+	f.sleep = func(ctx context.Context, d time.Duration) error { return ctx.Err() }
+	return f
+}
+
+// FlakyServer serves a file, but fails in various ways for
+// the first few requests.
+type flakyServer struct {
+	content  string
+	failures []string // "503", "truncate"
+	ranges   []string // Range headers of received requests
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	failure := ""
+	if len(s.failures) > 0 {
+		failure, s.failures = s.failures[0], s.failures[1:]
+	}
+
+	switch failure {
+	case "503":
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+
+	case "truncate":
+		// Announce the full length, but close the connection
+		// after sending half of the content.
+		w.Header().Set("Content-Length", fmt.Sprint(len(s.content)))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(s.content[:len(s.content)/2]))
+		panic(http.ErrAbortHandler)
+
+	default:
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(s.content))
+	}
+}
+
+func TestFetcher(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	for _, tc := range []struct {
+		failures   []string
+		wantRanges string
+	}{
+		{nil, `[""]`},
+		{[]string{"503", "503"}, `["" "" ""]`},
+		{[]string{"truncate"}, `["" "bytes=5000-"]`},
+		{[]string{"truncate", "503"}, `["" "bytes=5000-" "bytes=5000-"]`},
+	} {
+		handler := &flakyServer{content: content, failures: tc.failures}
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		reg := prometheus.NewRegistry()
+		f := newTestFetcher(server.Client())
+		f.metrics = NewFetchMetrics(reg)
+		d, err := f.Fetch(context.Background(), server.URL+"/f.txt", "9.8K")
+		if err != nil {
+			t.Errorf("failures %v: %v", tc.failures, err)
+			continue
+		}
+		if got := readStream(d); got != content {
+			t.Errorf("failures %v: got %d bytes, want %d", tc.failures, len(got), len(content))
+		}
+		d.Close()
+
+		if got := fmt.Sprintf("%q", handler.ranges); got != tc.wantRanges {
+			t.Errorf("failures %v: got Range headers %s, want %s", tc.failures, got, tc.wantRanges)
+		}
+		if got, want := testutil.ToFloat64(f.metrics.attempts), float64(len(tc.failures)+1); got != want {
+			t.Errorf("failures %v: got %v attempts, want %v", tc.failures, got, want)
+		}
+		if got := testutil.ToFloat64(f.metrics.downloads.WithLabelValues("ok")); got != 1 {
+			t.Errorf("failures %v: got %v ok downloads, want 1", tc.failures, got)
+		}
+	}
+}
+
+func TestFetcher_GiveUp(t *testing.T) {
+	handler := &flakyServer{content: "x", failures: []string{"503", "503", "503", "503"}}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	f := newTestFetcher(server.Client())
+	f.maxAttempts = 3
+	_, err := f.Fetch(context.Background(), server.URL+"/f.txt", "")
+	if err == nil || !strings.HasPrefix(err.Error(), "failed to fetch") {
+		t.Errorf("expected failure, got %v", err)
+	}
+	if len(handler.ranges) != 3 {
+		t.Errorf("got %d requests, want 3", len(handler.ranges))
+	}
+}
+
+func TestFetcher_NotFound(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	_, err := newTestFetcher(server.Client()).Fetch(context.Background(), server.URL, "")
+	if err == nil || !strings.Contains(err.Error(), "StatusCode=404") {
+		t.Errorf("expected StatusCode=404, got %v", err)
+	}
+}
+
+func TestFetcher_SizeMismatch(t *testing.T) {
+	handler := &flakyServer{content: strings.Repeat("x", 1500)}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	f := newTestFetcher(server.Client())
+	f.maxAttempts = 2
+	_, err := f.Fetch(context.Background(), server.URL, "2.0K")
+	if err == nil || !strings.Contains(err.Error(), "published size is 2.0K") {
+		t.Errorf("expected size mismatch, got %v", err)
+	}
+
+	// After a mismatch, the retry must fetch the entire file again.
+	if got, want := fmt.Sprintf("%q", handler.ranges), `["" ""]`; got != want {
+		t.Errorf("got Range headers %s, want %s", got, want)
+	}
+}
+
+func TestApacheSize(t *testing.T) {
+	for _, tc := range []struct {
+		size int64
+		want string
+	}{
+		{0, "0"},
+		{672, "672"},
+		{972, "972"},
+		{973, "1.0K"},
+		{1500, "1.5K"},
+		{10000, "9.8K"},
+		{10240, "10K"},
+		{1048576, "1.0M"},
+		{10 << 20, "10M"},
+		{500 << 20, "500M"},
+		{3 << 30, "3.0G"},
+	} {
+		if got := apacheSize(tc.size); got != tc.want {
+			t.Errorf("apacheSize(%d) = %q, want %q", tc.size, got, tc.want)
+		}
+	}
+}
+
+func TestContentRangeStart(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   int64
+		ok     bool
+	}{
+		{"bytes 500-999/1000", 500, true},
+		{"bytes 0-0/*", 0, true},
+		{"bytes */1000", 0, false},
+		{"", 0, false},
+	} {
+		got, ok := contentRangeStart(tc.header)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("contentRangeStart(%q) = %d, %v; want %d, %v", tc.header, got, ok, tc.want, tc.ok)
+		}
+	}
+}
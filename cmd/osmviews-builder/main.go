@@ -9,26 +9,90 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/chart"
+	"github.com/brawer/wikidata-qrank/v2/internal/httpclient"
+	"github.com/brawer/wikidata-qrank/v2/internal/profiling"
+	"github.com/brawer/wikidata-qrank/v2/pkg/osmviews"
 )
 
 var logger *log.Logger
 
 func main() {
-	ctx := context.Background()
+	// On Ctrl-C or SIGTERM, cancel the context so that a running
+	// build stops promptly and cleans up its temporary files.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	cachedir := flag.String("cache", "cache/osmviews-builder", "path to cache directory")
 	storagekey := flag.String("storage-key", "", "path to key with storage access credentials")
+	zoom := flag.Int("zoom", 18, "zoom level of tiles that become one pixel in the output")
+	bboxFlag := flag.String("bbox", "", "restrict output to minLng,minLat,maxLng,maxLat, eg. 5.96,45.82,10.49,47.81")
+	tilelogs := flag.String("tilelogs", "", "path or URL template for daily tile logs, eg. /var/log/tiles/{date}.txt.gz; default: planet.openstreetmap.org")
+	verifySizes := flag.Bool("verify-sizes", true, "check downloads from planet.openstreetmap.org against the sizes in its directory listing")
+	metricsPath := flag.String("metrics", "", "path for writing download metrics in Prometheus text format, eg. for node_exporter")
+	compression := flag.String("compression", "deflate", "compression of GeoTIFF tiles, deflate or none")
+	compressionLevel := flag.Int("compression-level", 9, "deflate compression level, from 1 (fastest) to 9 (smallest)")
+	quantize := flag.Bool("quantize", false, "store pixels as 16-bit integers on a logarithmic scale, for a smaller but less precise output")
+	yoyChange := flag.Bool("yoy-change", false, "also write a GeoTIFF with the change in views since the output of one year earlier")
+	plotFormat := flag.String("format", "png", "format of the statistics plot in the cache directory, png or svg")
+	pprofPort := flag.Int("pprof-port", 0, "if non-zero, serve net/http/pprof endpoints on this port of localhost, for inspecting a running build")
+	memStatsInterval := flag.Duration("mem-stats-interval", 0, "how often to log memory statistics, such as 10m; 0 for never")
+	heapDumpRSS := flag.Uint64("heap-dump-rss", 0, "write a heap profile into the logs directory when the resident set size exceeds this many MiB; 0 for never")
 	flag.Parse()
 
+	if *zoom < 8 || *zoom > 24 {
+		log.Fatalf("-zoom must be between 8 and 24, got %d", *zoom)
+	}
+	root := osmviews.WorldTile
+	if *bboxFlag != "" {
+		bbox, err := osmviews.ParseBBox(*bboxFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		root = bbox.Tile(uint8(*zoom - 8))
+	}
+	if depth := *zoom - 8 - int(root.Zoom()); depth > maxRasterDepth {
+		log.Fatalf("-zoom %d is too deep for the area of tile %s; try a smaller -bbox", *zoom, root)
+	}
+	statsPlotFormat, err := chart.ParseFormat(*plotFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rasterOpts := RasterOptions{Compression: *compression, Level: *compressionLevel, Quantize: *quantize}
+	if _, err := rasterOpts.tiffCompression(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Only the global output at zoom 18 from OpenStreetMap logs gets published.
+	isDefault := root == osmviews.WorldTile && *zoom == 18
+	if *storagekey != "" && (!isDefault || *tilelogs != "" || *quantize) {
+		log.Fatal("-zoom, -bbox, -tilelogs and -quantize are for local builds, and cannot be combined with -storage-key")
+	}
+
 	logfile, err := createLogFile()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer logfile.Close()
 	logger = log.New(logfile, "", log.Ldate|log.Ltime|log.LUTC|log.Lshortfile)
+	err = profiling.Start(ctx, profiling.Options{
+		Name:             "osmviews-builder",
+		Port:             *pprofPort,
+		MemStatsInterval: *memStatsInterval,
+		HeapDumpRSS:      *heapDumpRSS << 20,
+		HeapDumpDir:      "logs",
+		Logger:           logger,
+	})
+	if err != nil {
+		logger.Fatal(err)
+	}
 
 	var storage Storage
 	if *storagekey != "" {
@@ -45,8 +109,30 @@ func main() {
 		}
 	}
 
+	registry := prometheus.NewRegistry()
+	registerStorageMetrics(registry, storage)
+	fetcher := NewFetcher(httpclient.New(httpclient.Options{
+		Agent: "OSMViewsBuilderBot",
+		// planet.openstreetmap.org only seems to accept 1-2 connections
+		// from the same IP address.
+		MaxRequestsPerHost: 1,
+	}), NewFetchMetrics(registry))
+	source, err := NewTileLogSource(*tilelogs, fetcher)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if osm, ok := source.(*OSMPlanetSource); ok {
+		osm.VerifySizes = *verifySizes
+	}
+
 	maxWeeks := 52 // 1 year
-	tilecounts, lastWeek, err := fetchWeeklyLogs(*cachedir, storage, maxWeeks)
+	tilecounts, lastWeek, err := fetchWeeklyLogs(ctx, source, *cachedir, storage, maxWeeks)
+	if *metricsPath != "" {
+		// Written even if fetching failed, so monitoring can see why.
+		if err := prometheus.WriteToTextfile(*metricsPath, registry); err != nil {
+			logger.Fatal(err)
+		}
+	}
 	if err != nil {
 		logger.Fatal(err)
 	}
@@ -62,11 +148,21 @@ func main() {
 	lastDay := weekStart(year, week).AddDate(0, 0, 6)
 	date := lastDay.Format("20060102")
 	bucket := "qrank"
-	localpath := filepath.Join(*cachedir, fmt.Sprintf("osmviews-%s.tiff", date))
-	localStatsPath := filepath.Join(*cachedir, fmt.Sprintf("osmviews-stats-%s.json", date))
-	localStatsPlotPath := filepath.Join(*cachedir, fmt.Sprintf("osmviews-statsplot-%s.png", date))
+	variant := ""
+	if !isDefault {
+		rootZoom, rootX, rootY := root.ZoomXY()
+		variant = fmt.Sprintf("-z%d-%d-%d-%d", *zoom, rootZoom, rootX, rootY)
+	}
+	if *quantize {
+		variant += "-u16"
+	}
+	localpath := filepath.Join(*cachedir, fmt.Sprintf("osmviews%s-%s.tiff", variant, date))
+	localStatsPath := filepath.Join(*cachedir, fmt.Sprintf("osmviews-stats%s-%s.json", variant, date))
+	localStatsPlotPath := filepath.Join(*cachedir, fmt.Sprintf("osmviews-statsplot%s-%s.%s", variant, date, statsPlotFormat))
+	localChangePath := filepath.Join(*cachedir, fmt.Sprintf("osmviews-change%s-%s.tiff", variant, date))
 	remotepath := fmt.Sprintf("public/osmviews-%s.tiff", date)
 	remoteStatsPath := fmt.Sprintf("public/osmviews-stats-%s.json", date)
+	remoteChangePath := fmt.Sprintf("public/osmviews-change-%s.tiff", date)
 
 	// Check if the output file already exists in storage.
 	// If we can retrieve object stats without an error, we don’t need
@@ -87,14 +183,37 @@ func main() {
 	}
 
 	// Paint the output GeoTIFF file.
-	if err := paint(localpath, 18, tilecounts, ctx); err != nil {
+	if err := paint(localpath, root, uint8(*zoom), rasterOpts, tilecounts, ctx); err != nil {
 		logger.Fatal(err)
 	}
 
-	if err := BuildStats(localpath, localStatsPath, localStatsPlotPath); err != nil {
+	if err := BuildStats(localpath, root, localStatsPath, localStatsPlotPath); err != nil {
 		logger.Fatal(err)
 	}
 
+	// Compare against the output from one year earlier. If there is none,
+	// for example because storage has not been keeping enough history yet,
+	// the change raster is skipped without failing the build.
+	hasChange := false
+	if *yoyChange {
+		prevDate, prevPath, err := fetchPreviousYear(ctx, storage, *cachedir, variant, date)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if prevPath != "" {
+			opts := rasterOpts
+			opts.Description = changeDescription(date, prevDate)
+			if err := buildChange(ctx, localpath, prevPath, localChangePath, root, opts); err != nil {
+				logger.Fatal(err)
+			}
+			hasChange = true
+		} else {
+			msg := fmt.Sprintf("No output from one year before %s, skipping year-over-year change", date)
+			fmt.Println(msg)
+			logger.Println(msg)
+		}
+	}
+
 	// Upload the output file to storage, and garbage-collect old files.
 	if storage != nil {
 		err := storage.PutFile(ctx, bucket, remotepath, localpath, "image/tiff")
@@ -107,6 +226,13 @@ func main() {
 			logger.Fatal(err)
 		}
 
+		if hasChange {
+			err = storage.PutFile(ctx, bucket, remoteChangePath, localChangePath, "image/tiff")
+			if err != nil {
+				logger.Fatal(err)
+			}
+		}
+
 		msg := fmt.Sprintf("Uploaded to storage: %s/%s and %s/%s\n", bucket, remotepath, bucket, remoteStatsPath)
 		fmt.Println(msg)
 		logger.Println(msg)
@@ -115,6 +241,12 @@ func main() {
 			logger.Fatal(err)
 		}
 	}
+
+	if *metricsPath != "" {
+		if err := prometheus.WriteToTextfile(*metricsPath, registry); err != nil {
+			logger.Fatal(err)
+		}
+	}
 }
 
 // Create a file for keeping logs. If the file already exists, its
@@ -134,20 +266,23 @@ func createLogFile() (*os.File, error) {
 	return logfile, nil
 }
 
-// Fetch log data for up to `maxWeeks` weeks from planet.openstreetmap.org.
-// For each week, the seven daily log files are fetched from OpenStreetMap,
-// and combined into a one single compressed file, stored on local disk.
+// Fetch log data for up to `maxWeeks` weeks from a tile log source,
+// usually planet.openstreetmap.org. For each week, the seven daily log
+// files are fetched from the source, and combined into a one single
+// compressed file, stored on local disk.
 // If this weekly file already exists on disk, we return its content directly
 // without re-fetching that week from the server. Therefore, if this tool
 // is run periodically, it will only fetch the content that has not been
 // downloaded before. The result is an array of readers (one for each week),
 // and the ISO week string (like "2021-W28") for the last available week.
-func fetchWeeklyLogs(cachedir string, storage Storage, maxWeeks int) ([]io.Reader, string, error) {
-	client := &http.Client{}
-	weeks, err := GetAvailableWeeks(client)
+func fetchWeeklyLogs(ctx context.Context, source TileLogSource, cachedir string, storage Storage, maxWeeks int) ([]io.Reader, string, error) {
+	weeks, err := source.ListWeeks(ctx)
 	if err != nil {
 		return nil, "", err
 	}
+	if len(weeks) == 0 {
+		return nil, "", fmt.Errorf("no complete weeks of tile logs in %s", source.Name())
+	}
 
 	if len(weeks) > maxWeeks {
 		weeks = weeks[len(weeks)-maxWeeks:]
@@ -155,13 +290,13 @@ func fetchWeeklyLogs(cachedir string, storage Storage, maxWeeks int) ([]io.Reade
 
 	if logger != nil {
 		logger.Printf(
-			"found %d weeks with OpenStreetMap tile logs, from %s to %s",
-			len(weeks), weeks[0], weeks[len(weeks)-1])
+			"found %d weeks with tile logs in %s, from %s to %s",
+			len(weeks), source.Name(), weeks[0], weeks[len(weeks)-1])
 	}
 
 	readers := make([]io.Reader, 0, len(weeks))
 	for _, week := range weeks {
-		if r, err := GetTileLogs(week, client, cachedir, storage); err == nil {
+		if r, err := GetTileLogs(week, source, cachedir, storage); err == nil {
 			readers = append(readers, r)
 		} else {
 			return nil, "", err
@@ -8,9 +8,11 @@ import (
 	"container/heap"
 	"context"
 	"io"
+
+	"github.com/brawer/wikidata-qrank/v2/pkg/osmviews"
 )
 
-func mergeTileCounts(r []io.Reader, out chan<- TileCount, ctx context.Context) error {
+func mergeTileCounts(r []io.Reader, out chan<- osmviews.TileCount, ctx context.Context) error {
 	defer close(out)
 	if len(r) == 0 {
 		return nil
@@ -19,14 +21,13 @@ func mergeTileCounts(r []io.Reader, out chan<- TileCount, ctx context.Context) e
 	merger := NewTileCountMerger(r)
 	for merger.Advance() {
 		// Check if our task has been canceled. Typically this can happen
-		// because of an error in another goroutine in the same x.sync.errroup.
+		// because of an error in another goroutine in the same x.sync.errroup,
+		// which then has stopped receiving from our output channel.
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		default:
+		case out <- merger.TileCount():
 		}
-
-		out <- merger.TileCount()
 	}
 
 	if err := merger.Err(); err != nil {
@@ -48,7 +49,7 @@ func NewTileCountMerger(r []io.Reader) *TileCountMerger {
 	for _, rr := range r {
 		stream := &tileCountStream{scanner: bufio.NewScanner(rr)}
 		if stream.scanner.Scan() {
-			stream.tc = ParseTileCount(stream.scanner.Text())
+			stream.tc = osmviews.ParseTileCount(stream.scanner.Text())
 			m.heap = append(m.heap, stream)
 		}
 		if err := stream.scanner.Err(); err != nil {
@@ -73,7 +74,7 @@ func (m *TileCountMerger) Advance() bool {
 	}
 	stream := m.heap[0]
 	if stream.scanner.Scan() {
-		stream.tc = ParseTileCount(stream.scanner.Text())
+		stream.tc = osmviews.ParseTileCount(stream.scanner.Text())
 		heap.Fix(&m.heap, 0)
 	} else {
 		heap.Remove(&m.heap, 0)
@@ -89,17 +90,17 @@ func (m *TileCountMerger) Err() error {
 	return m.err
 }
 
-func (m *TileCountMerger) TileCount() TileCount {
+func (m *TileCountMerger) TileCount() osmviews.TileCount {
 	n := len(m.heap)
 	if n > 0 {
 		return m.heap[0].tc
 	} else {
-		return TileCount{NoTile, 0}
+		return osmviews.TileCount{Key: osmviews.NoTile}
 	}
 }
 
 type tileCountStream struct {
-	tc      TileCount
+	tc      osmviews.TileCount
 	scanner *bufio.Scanner
 	index   int
 }
@@ -109,7 +110,7 @@ type tileCountHeap []*tileCountStream
 func (h tileCountHeap) Len() int { return len(h) }
 
 func (h tileCountHeap) Less(i, j int) bool {
-	return TileCountLess(h[i].tc, h[j].tc)
+	return osmviews.TileCountLess(h[i].tc, h[j].tc)
 }
 
 func (h tileCountHeap) Swap(i, j int) {
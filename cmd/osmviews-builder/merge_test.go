@@ -5,25 +5,29 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/sync/errgroup"
+
+	"github.com/brawer/wikidata-qrank/v2/pkg/osmviews"
 )
 
 func TestMergeTileCounts(t *testing.T) {
 	// Helper for sorting a []TileCount array.
-	sortCounts := func(counts []TileCount) {
+	sortCounts := func(counts []osmviews.TileCount) {
 		sort.Slice(counts, func(i, j int) bool {
-			return TileCountLess(counts[i], counts[j])
+			return osmviews.TileCountLess(counts[i], counts[j])
 		})
 	}
 
-	want := make([]TileCount, 0, 10000) // Expected output.
+	want := make([]osmviews.TileCount, 0, 10000) // Expected output.
 
 	// Prepare the input for running the merge function under test.
 	// We pass 100 input readers, each with 0..99 random TileCounts
@@ -32,9 +36,9 @@ func TestMergeTileCounts(t *testing.T) {
 	readers := make([]io.Reader, 0, 100)
 	for i := 0; i < 100; i++ {
 		var buf strings.Builder
-		counts := make([]TileCount, 0, 100)
+		counts := make([]osmviews.TileCount, 0, 100)
 		for _, tileKey := range makeTestTileKeys(rand.Intn(100)) {
-			counts = append(counts, TileCount{Key: tileKey, Count: uint64(i)})
+			counts = append(counts, osmviews.TileCount{Key: tileKey, Count: uint64(i)})
 		}
 		sortCounts(counts) // Input to mergeTileCounts() is in sorted order.
 		for _, c := range counts {
@@ -56,16 +60,16 @@ func TestMergeTileCounts(t *testing.T) {
 
 	for i := 0; i < len(got); i++ {
 		if got[i] != want[i] {
-			t.Fatalf("got TileCount[%d]=%v, want %v", i, got[i], want[i])
+			t.Fatalf("got osmviews.TileCount[%d]=%v, want %v", i, got[i], want[i])
 		}
 	}
 }
 
 // Helper for testing mergeTileCounts().
-func readMerged(readers []io.Reader) ([]TileCount, error) {
-	result := make([]TileCount, 0, 10000)
+func readMerged(readers []io.Reader) ([]osmviews.TileCount, error) {
+	result := make([]osmviews.TileCount, 0, 10000)
 	// To test channel overflow, pass a channel that buffers just one item.
-	ch := make(chan TileCount, 1)
+	ch := make(chan osmviews.TileCount, 1)
 	g, ctx := errgroup.WithContext(context.Background())
 	g.Go(func() error {
 		return mergeTileCounts(readers, ch, ctx)
@@ -81,3 +85,33 @@ func readMerged(readers []io.Reader) ([]TileCount, error) {
 	}
 	return result, nil
 }
+
+// If the painter stops receiving because it has failed, the merger
+// must not block forever on sending to its output channel.
+func TestMergeTileCounts_Canceled(t *testing.T) {
+	readers := []io.Reader{strings.NewReader("1/0/0 1\n1/0/1 2\n1/1/1 3\n")}
+	ch := make(chan osmviews.TileCount) // nobody receives
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- mergeTileCounts(readers, ch, ctx) }()
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("mergeTileCounts did not return after cancellation")
+	}
+}
+
+func makeTestTileKeys(n int) []osmviews.TileKey {
+	keys := make([]osmviews.TileKey, n)
+	for i := 0; i < n; i++ {
+		zoom := uint8(rand.Intn(24))
+		x := uint32(rand.Intn(1 << zoom))
+		y := uint32(rand.Intn(1 << zoom))
+		keys[i] = osmviews.MakeTileKey(zoom, x, y)
+	}
+	return keys
+}
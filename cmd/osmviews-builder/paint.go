@@ -9,22 +9,45 @@ import (
 	"io"
 
 	"golang.org/x/sync/errgroup"
+
+	"github.com/brawer/wikidata-qrank/v2/pkg/osmviews"
 )
 
+// Painter turns a stream of tile view counts into a GeoTIFF raster pyramid.
+//
+// Tiles must arrive in the order of TileCountLess, which is a depth-first
+// pre-order (z-order) traversal of the tile tree. Because of this order,
+// the Painter only needs to keep the currently active branch of the raster
+// pyramid in memory: the raster being painted, plus its ancestors up to
+// the world tile. As soon as the traversal leaves a raster, that raster
+// is subsampled into its parent, compressed, written to a temporary file,
+// and its memory is recycled for the next raster.
+//
+// Peak memory is therefore bounded by (zoom-7) rasters of 256 KiB each,
+// plus 8 bytes per tile for the TileOffsets and TileByteCounts arrays
+// in RasterWriter. For the full planet at zoom 18, this is 11 rasters
+// (2.75 MiB) and 1.4M tiles (11 MiB), independent of the input size.
+// In addition, RasterWriter keeps up to two copies of 256 KiB for each
+// of its compression workers.
+//
+// For a regional output, the pyramid is rooted at a tile other than
+// the WorldTile. Tiles outside the root are skipped, and the views
+// of tiles containing the root get added to the root’s base value.
 type Painter struct {
 	numWeeks int
+	root     osmviews.TileKey
 	zoom     uint8
-	last     TileKey
+	last     osmviews.TileKey
+	base     float32 // views per km² from tiles that contain root
 	raster   *Raster
 	writer   *RasterWriter
+	spare    []*Raster // recycled rasters, at most one per zoom level
 }
 
-func (p *Painter) Paint(tile TileKey, counts []uint64) error {
-	raster, err := p.setupRaster(tile)
-	if err != nil {
-		return err
-	}
-
+// Paint paints the views of a tile. If the tile is far away from the
+// previously painted one, the rasters in between get filled with
+// uniform color; this stops early when ctx gets canceled.
+func (p *Painter) Paint(ctx context.Context, tile osmviews.TileKey, counts []uint64) error {
 	// Compute the median weekly views per km² for this tile.
 	numWeeksWithoutData := p.numWeeks - len(counts)
 	medianPos := p.numWeeks/2 - numWeeksWithoutData
@@ -33,12 +56,26 @@ func (p *Painter) Paint(tile TileKey, counts []uint64) error {
 		median = float32(counts[medianPos])
 	}
 	zoom, _, y := tile.ZoomXY()
-	viewsPerKm2 := median / float32(TileArea(zoom, y))
+	viewsPerKm2 := median / float32(osmviews.TileArea(zoom, y))
+
+	if tile != p.root && !p.root.Contains(tile) {
+		if tile.Contains(p.root) {
+			p.base += viewsPerKm2
+		}
+		return nil
+	}
+
+	raster, err := p.setupRaster(ctx, tile)
+	if err != nil {
+		return err
+	}
 
 	if tile == raster.tile {
 		raster.viewsPerKm2 = viewsPerKm2
 		if raster.parent != nil {
 			raster.viewsPerKm2 += raster.parent.viewsPerKm2
+		} else {
+			raster.viewsPerKm2 += p.base
 		}
 	}
 
@@ -48,7 +85,7 @@ func (p *Painter) Paint(tile TileKey, counts []uint64) error {
 	return nil
 }
 
-func (p *Painter) setupRaster(tile TileKey) (*Raster, error) {
+func (p *Painter) setupRaster(ctx context.Context, tile osmviews.TileKey) (*Raster, error) {
 	rasterTile := tile
 	if tile.Zoom() >= p.zoom-8 {
 		rasterTile = tile.ToZoom(p.zoom - 8)
@@ -70,15 +107,18 @@ func (p *Painter) setupRaster(tile TileKey) (*Raster, error) {
 	}
 
 	if p.raster == nil {
-		p.raster = NewRaster(WorldTile, nil)
-		if rasterTile == WorldTile {
+		p.setupRoot()
+		if rasterTile == p.root {
 			return p.raster, nil
 		}
 	}
 
 	for t := p.last.Next(p.zoom - 8); t < rasterTile; t = t.Next(p.zoom - 8) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		if t.Contains(rasterTile) {
-			p.raster = NewRaster(t, p.raster)
+			p.raster = p.newRaster(t, p.raster)
 		} else {
 			err := p.writer.WriteUniform(t, uint32(p.raster.viewsPerKm2+0.5))
 			if err != nil {
@@ -87,15 +127,31 @@ func (p *Painter) setupRaster(tile TileKey) (*Raster, error) {
 		}
 	}
 
-	p.raster = NewRaster(rasterTile, p.raster)
-	//fmt.Printf("final rasterTile=%s tile=%s\n", rasterTile, tile)
+	p.raster = p.newRaster(rasterTile, p.raster)
 	return p.raster, nil
 }
 
-func (p *Painter) Close() error {
+// SetupRoot creates the raster for the root tile.
+func (p *Painter) setupRoot() {
+	p.raster = p.newRaster(p.root, nil)
+	p.raster.viewsPerKm2 = p.base
+}
+
+// Close finishes painting and writes the output GeoTIFF. For a global
+// output, this may have to fill about a million rasters with uniform
+// color, so the loop stops early when ctx gets canceled. In that case,
+// the caller should call Abort to release the resources of the Painter.
+func (p *Painter) Close(ctx context.Context) error {
+	if p.raster == nil && p.last == p.root {
+		p.setupRoot()
+	}
+
 	// For the part of the world we haven't covered yet, emit uniform rasters.
 	zoom := p.zoom - 8
-	for t := p.last.Next(zoom); t != NoTile; t = t.Next(zoom) {
+	for t := p.last.Next(zoom); t != osmviews.NoTile && p.root.Contains(t); t = t.Next(zoom) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		for p.raster != nil && !p.raster.tile.Contains(t) {
 			if err := p.emitRaster(); err != nil {
 				return err
@@ -115,6 +171,12 @@ func (p *Painter) Close() error {
 	return p.writer.Close()
 }
 
+// Abort stops painting without writing any output, and releases
+// the resources of the Painter. It is safe to call after Close.
+func (p *Painter) Abort() {
+	p.writer.Abort()
+}
+
 // Function emitRaster is called when the Painter has finished painting
 // pixels into the current Raster. The raster gets removed from the tree,
 // compressed, and stored into a temporary file.
@@ -126,28 +188,57 @@ func (p *Painter) emitRaster() error {
 	}
 	p.raster = raster.parent
 	raster.parent = nil
-	return p.writer.Write(raster)
+	if err := p.writer.Write(raster); err != nil {
+		return err
+	}
+	p.spare = append(p.spare, raster)
+	return nil
 }
 
-func NewPainter(path string, numWeeks int, zoom uint8) (*Painter, error) {
-	writer, err := NewRasterWriter(path, zoom-8)
+// NewRaster returns a blank raster, recycling the memory of a previously
+// emitted raster if there is one. Without recycling, painting the planet
+// would allocate (and garbage-collect) 256 KiB for each of the million
+// rasters in the output.
+func (p *Painter) newRaster(tile osmviews.TileKey, parent *Raster) *Raster {
+	n := len(p.spare)
+	if n == 0 {
+		return NewRaster(tile, parent)
+	}
+	r := p.spare[n-1]
+	p.spare = p.spare[:n-1]
+	r.reset(tile, parent)
+	return r
+}
+
+// NewPainter returns a Painter for the area of the root tile, which is
+// WorldTile for a global output. Tile views at zoom level `zoom` become
+// one pixel in the output GeoTIFF.
+func NewPainter(path string, numWeeks int, root osmviews.TileKey, zoom uint8, opts RasterOptions) (*Painter, error) {
+	if zoom < 8 {
+		return nil, fmt.Errorf("zoom %d too small, must be at least 8", zoom)
+	}
+	writer, err := NewRasterWriter(path, root, zoom-8, opts)
 	if err != nil {
 		return nil, err
 	}
 	return &Painter{
 		numWeeks: numWeeks,
+		root:     root,
 		zoom:     zoom,
+		last:     root,
 		writer:   writer,
 	}, nil
 }
 
 // Paint produces a GeoTIFF file from a set of weekly tile view counts.
-// Tile views at zoom level `zoom` become one pixel in the output GeoTIFF.
-func paint(path string, zoom uint8, tilecounts []io.Reader, ctx context.Context) error {
+// The output covers the area of the root tile, which is WorldTile for
+// a global output. Tile views at zoom level `zoom` become one pixel
+// in the output GeoTIFF. The options tell how to compress the output.
+func paint(path string, root osmviews.TileKey, zoom uint8, opts RasterOptions, tilecounts []io.Reader, ctx context.Context) error {
 	// One goroutine is decompressing, parsing and merging the weekly counts;
 	// another is painting the image from data that gets sent over a channel.
-	ch := make(chan TileCount, 100000)
-	painter, err := NewPainter(path, len(tilecounts), zoom)
+	ch := make(chan osmviews.TileCount, 100000)
+	painter, err := NewPainter(path, len(tilecounts), root, zoom, opts)
 	if err != nil {
 		return err
 	}
@@ -156,7 +247,7 @@ func paint(path string, zoom uint8, tilecounts []io.Reader, ctx context.Context)
 		return mergeTileCounts(tilecounts, ch, subCtx)
 	})
 	g.Go(func() error {
-		tile := WorldTile
+		tile := osmviews.WorldTile
 		counts := make([]uint64, len(tilecounts))
 		numCounts := 0 // number of counts for the same tile
 		for {
@@ -166,7 +257,7 @@ func paint(path string, zoom uint8, tilecounts []io.Reader, ctx context.Context)
 			case c, more := <-ch:
 				if c.Key != tile {
 					if numCounts > 0 {
-						if err := painter.Paint(tile, counts[:numCounts]); err != nil {
+						if err := painter.Paint(subCtx, tile, counts[:numCounts]); err != nil {
 							return err
 						}
 					}
@@ -184,7 +275,7 @@ func paint(path string, zoom uint8, tilecounts []io.Reader, ctx context.Context)
 
 				if !more {
 					if numCounts > 0 {
-						if err := painter.Paint(tile, counts[:numCounts]); err != nil {
+						if err := painter.Paint(subCtx, tile, counts[:numCounts]); err != nil {
 							return err
 						}
 					}
@@ -194,9 +285,11 @@ func paint(path string, zoom uint8, tilecounts []io.Reader, ctx context.Context)
 		}
 	})
 	if err := g.Wait(); err != nil {
+		painter.Abort()
 		return err
 	}
-	if err := painter.Close(); err != nil {
+	if err := painter.Close(ctx); err != nil {
+		painter.Abort()
 		return err
 	}
 	return nil
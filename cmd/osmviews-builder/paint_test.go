@@ -4,14 +4,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 
 	"github.com/andybalholm/brotli"
+	"github.com/brawer/wikidata-qrank/v2/internal/cogtiff"
+	"github.com/brawer/wikidata-qrank/v2/pkg/osmviews"
 )
 
 func TestPaint(t *testing.T) {
@@ -22,17 +29,164 @@ func TestPaint(t *testing.T) {
 	defer file.Close()
 	readers := []io.Reader{brotli.NewReader(file)}
 	path := filepath.Join(t.TempDir(), "zurich.tif")
-	if err := paint(path, 9, readers, context.Background()); err != nil {
+	if err := paint(path, osmviews.WorldTile, 9, RasterOptions{}, readers, context.Background()); err != nil {
 		t.Fatal(err)
 	}
 }
 
+func TestPaint_Regional(t *testing.T) {
+	file, err := os.Open(filepath.Join("testdata", "zurich-2021-W47.br"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	readers := []io.Reader{brotli.NewReader(file)}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "switzerland.tif")
+	switzerland := osmviews.MakeTileKey(6, 33, 22)
+	if err := paint(path, switzerland, 16, RasterOptions{}, readers, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tiff, err := cogtiff.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var widths []uint32
+	for _, img := range tiff.Images {
+		widths = append(widths, img.Width)
+	}
+	if got, want := fmt.Sprint(widths), "[1024 512 256]"; got != want {
+		t.Errorf("got image widths %s, want %s", got, want)
+	}
+
+	// Zürich is in tile 8/134/89, which is at x=2, y=1 among
+	// the 4×4 tiles of the regional output.
+	pixels := make([]float32, 256*256)
+	if err := tiff.Images[0].ReadTile(1*4+2, pixels); err != nil {
+		t.Fatal(err)
+	}
+	var max float32
+	for _, p := range pixels {
+		if p > max {
+			max = p
+		}
+	}
+	if max <= 0 {
+		t.Errorf("expected views around Zürich, got max=%v", max)
+	}
+
+	statsPath := filepath.Join(dir, "stats.json")
+	plotPath := filepath.Join(dir, "plot.png")
+	if err := BuildStats(path, switzerland, statsPath, plotPath); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(statsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats struct {
+		Samples     [][]any
+		Percentiles []float32
+		HotTiles    []HotTile
+	}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Percentiles) != 101 || stats.Percentiles[100] != max {
+		t.Errorf("got percentiles %v, want 101 entries up to %v", stats.Percentiles, max)
+	}
+	if len(stats.HotTiles) == 0 || stats.HotTiles[0].Views != max {
+		t.Errorf("hottest tile should have %v views/km², got %v", max, stats.HotTiles)
+	}
+	for _, ht := range stats.HotTiles {
+		if !strings.HasPrefix(ht.Tile, "16/") {
+			t.Errorf("hot tile %v not at zoom 16", ht)
+		}
+		if ht.Lat < 45.0 || ht.Lat > 48.93 || ht.Lng < 5.62 || ht.Lng > 11.25 {
+			t.Errorf("hot tile %v outside of tile %s", ht, switzerland)
+		}
+	}
+	for _, s := range stats.Samples {
+		latLng := s[0].([]any)
+		lat, lng := latLng[0].(float64), latLng[1].(float64)
+		if lat < 45.0 || lat > 48.93 || lng < 5.62 || lng > 11.25 {
+			t.Errorf("sample %v outside of tile %s", s, switzerland)
+		}
+	}
+}
+
+func TestPaint_Quantized(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "zurich-2021-W47.br"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	var sizes []int64
+	for _, opts := range []RasterOptions{{}, {Quantize: true}} {
+		path := filepath.Join(dir, fmt.Sprintf("zurich-%v.tif", opts.Quantize))
+		readers := []io.Reader{brotli.NewReader(bytes.NewReader(data))}
+		if err := paint(path, osmviews.WorldTile, 16, opts, readers, context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		size, err := tileDataSize(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, size)
+
+		statsPath := filepath.Join(dir, "stats.json")
+		plotPath := filepath.Join(dir, "plot.png")
+		if err := BuildStats(path, osmviews.WorldTile, statsPath, plotPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sizes[1] >= sizes[0]*2/3 {
+		t.Errorf("quantized tiles have %d bytes, float tiles %d", sizes[1], sizes[0])
+	}
+}
+
+// TileDataSize returns the total size of the tile data in a GeoTIFF,
+// counting shared tiles only once. In our small test data, most tiles
+// are uniform, so the file size is dominated by the tile offsets.
+func tileDataSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	tiff, err := cogtiff.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, img := range tiff.Images {
+		seen := make(map[uint64]bool, 16)
+		for i := 0; i < img.NumTiles(); i++ {
+			offset, size, err := img.TileLocation(i)
+			if err != nil {
+				return 0, err
+			}
+			if !seen[offset] {
+				seen[offset] = true
+				total += int64(size)
+			}
+		}
+	}
+	return total, nil
+}
+
 // Make sure we can handle view counts at deep zoom levels even if not all
 // parent tiles have been viewed.
 func TestPaint_ParentNotLogged(t *testing.T) {
 	readers := []io.Reader{strings.NewReader("3/1/1 3\n18/137341/91897 1\n")}
 	path := filepath.Join(t.TempDir(), "notlogged.tif")
-	if err := paint(path, 11, readers, context.Background()); err != nil {
+	if err := paint(path, osmviews.WorldTile, 11, RasterOptions{}, readers, context.Background()); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -45,7 +199,7 @@ func TestPaint_TooManyCountsForSameTile(t *testing.T) {
 	}
 	path := filepath.Join(t.TempDir(), "toomanycounts.tif")
 	var got string
-	if err := paint(path, 16, readers, context.Background()); err != nil {
+	if err := paint(path, osmviews.WorldTile, 16, RasterOptions{}, readers, context.Background()); err != nil {
 		got = err.Error()
 	}
 	want := "tile 7/39/87 appears more than 1 times in input"
@@ -53,3 +207,101 @@ func TestPaint_TooManyCountsForSameTile(t *testing.T) {
 		t.Fatalf("got %v, want %v", got, want)
 	}
 }
+
+// Make sure that the Painter only keeps the active branch of the raster
+// pyramid in memory, recycling the rasters it has finished painting.
+func TestPainter_RecyclesRasters(t *testing.T) {
+	const zoom = 12
+	path := filepath.Join(t.TempDir(), "recycle.tif")
+	painter, err := NewPainter(path, 1, osmviews.WorldTile, zoom, RasterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiles := []osmviews.TileKey{
+		osmviews.MakeTileKey(4, 8, 5),
+		osmviews.MakeTileKey(12, 2142, 1432),
+		osmviews.MakeTileKey(12, 2200, 1500),
+		osmviews.MakeTileKey(12, 3000, 1000),
+	}
+	sort.Slice(tiles, func(i, j int) bool { return tiles[i] < tiles[j] })
+	for _, tile := range tiles {
+		if err := painter.Paint(context.Background(), tile, []uint64{7}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := painter.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n, max := len(painter.spare), zoom-7; n == 0 || n > max {
+		t.Errorf("got %d recycled rasters, want 1..%d", n, max)
+	}
+}
+
+func TestPaint_Canceled(t *testing.T) {
+	// Our temporary files should get cleaned up.
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	readers := []io.Reader{strings.NewReader("3/1/1 3\n18/137341/91897 1\n")}
+	path := filepath.Join(t.TempDir(), "canceled.tif")
+	if err := paint(path, osmviews.WorldTile, 16, RasterOptions{}, readers, ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("output should not exist after cancellation, got %v", err)
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Errorf("temporary files were left behind: %v", entries)
+	}
+}
+
+// Filling the gap before a far-away tile, or filling the rest of
+// the world when closing, should stop once the context is canceled.
+func TestPainter_Canceled(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	painter, err := NewPainter(filepath.Join(dir, "gap.tif"), 1, osmviews.WorldTile, 18, RasterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := painter.Paint(ctx, osmviews.MakeTileKey(18, 200000, 200000), []uint64{7}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Paint() got %v, want context.Canceled", err)
+	}
+	painter.Abort()
+
+	path := filepath.Join(dir, "close.tif")
+	painter, err = NewPainter(path, 1, osmviews.WorldTile, 18, RasterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := painter.Paint(context.Background(), osmviews.MakeTileKey(4, 0, 0), []uint64{7}); err != nil {
+		t.Fatal(err)
+	}
+	if err := painter.Close(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Close() got %v, want context.Canceled", err)
+	}
+	painter.Abort()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("output should not exist after cancellation, got %v", err)
+	}
+}
+
+func BenchmarkPaint(b *testing.B) {
+	data, err := os.ReadFile(filepath.Join("testdata", "zurich-2021-W47.br"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	path := filepath.Join(b.TempDir(), "zurich.tif")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		readers := []io.Reader{brotli.NewReader(bytes.NewReader(data))}
+		if err := paint(path, osmviews.WorldTile, 16, RasterOptions{}, readers, context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -7,22 +7,27 @@ import (
 	"bytes"
 	"compress/zlib"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"os"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
+
+	"github.com/brawer/wikidata-qrank/v2/pkg/osmviews"
 )
 
 type Raster struct {
-	tile        TileKey
+	tile        osmviews.TileKey
 	parent      *Raster
 	viewsPerKm2 float32
 	pixels      [256 * 256]float32
 }
 
-func (r *Raster) Paint(tile TileKey, viewsPerKm2 float32) {
+func (r *Raster) Paint(tile osmviews.TileKey, viewsPerKm2 float32) {
 	rZoom, rX, rY := r.tile.ZoomXY()
 
 	// If the to-be-painted tile is smaller than 1 pixel, we scale it
@@ -81,21 +86,101 @@ func (r *Raster) PaintChild(child *Raster) {
 	}
 }
 
-func NewRaster(tile TileKey, parent *Raster) *Raster {
-	zoom := tile.Zoom()
+func NewRaster(tile osmviews.TileKey, parent *Raster) *Raster {
+	checkRasterParent(tile, parent)
+	return &Raster{tile: tile, parent: parent}
+}
 
-	// Check that NewRaster() is called for the right parent. This check
-	// should never fail, no matter what the input data is. If it does fail,
-	// something must be wrong with our logic to construct parent rasters.
-	if parent != nil {
-		if zoom != parent.tile.Zoom()+1 {
-			panic(fmt.Sprintf("NewRaster(%s) with parent.tile=%s", tile, parent.tile))
-		}
-	} else if zoom != 0 {
-		panic(fmt.Sprintf("NewRaster(%s) with parent=<nil>", tile))
+// Reset makes a previously used raster blank, so it can be used
+// for painting another tile.
+func (r *Raster) reset(tile osmviews.TileKey, parent *Raster) {
+	checkRasterParent(tile, parent)
+	r.tile, r.parent, r.viewsPerKm2 = tile, parent, 0
+	clear(r.pixels[:])
+}
+
+// Check that a raster gets created for the right parent. This check
+// should never fail, no matter what the input data is. If it does fail,
+// something must be wrong with our logic to construct parent rasters.
+// A raster without parent is the root of the pyramid; for a global
+// output, this is the WorldTile, but regional outputs have deeper roots.
+func checkRasterParent(tile osmviews.TileKey, parent *Raster) {
+	if parent != nil && tile.Zoom() != parent.tile.Zoom()+1 {
+		panic(fmt.Sprintf("NewRaster(%s) with parent.tile=%s", tile, parent.tile))
 	}
+}
 
-	return &Raster{tile: tile, parent: parent}
+// RasterOptions controls how a RasterWriter encodes the tiles of its
+// output. The zero value gives the smallest output at full precision.
+type RasterOptions struct {
+	// Compression is either "deflate", which is the default,
+	// or "none" for uncompressed tiles.
+	Compression string
+
+	// Level is the deflate compression level, from zlib.BestSpeed
+	// to zlib.BestCompression. Zero means zlib.BestCompression.
+	Level int
+
+	// Workers is the number of goroutines that compress tiles
+	// in parallel. Zero means one per CPU.
+	Workers int
+
+	// If Quantize is set, pixels are stored as 16-bit unsigned integers
+	// on a logarithmic scale, see QuantizeViews(), instead of 32-bit
+	// floats. This makes the output considerably smaller, at the cost
+	// of precision.
+	Quantize bool
+
+	// If Signed is set, pixels may be negative or fractional, as in
+	// the year-over-year change raster. Only tiles whose pixels are
+	// exactly equal get shared, and the minimum value gets tracked
+	// for the SMinSampleValue tag. Signed output cannot be quantized.
+	Signed bool
+
+	// Description replaces the ImageDescription tag of the output,
+	// which otherwise describes a raster of view density.
+	Description string
+}
+
+// QuantizationScale is the number of quantization steps for every
+// doubling of views in quantized output. With 2048 steps, values
+// are precise to 0.034%, and the largest value that can be stored
+// is about 4.3 billion views per km².
+const quantizationScale = 2048
+
+// QuantizeViews maps views per km² to a 16-bit integer, computing
+// round(2048 × log2(1 + views)). Values that are too large to be
+// represented get clamped to the maximum.
+func quantizeViews(viewsPerKm2 float32) uint16 {
+	if viewsPerKm2 <= 0 {
+		return 0
+	}
+	q := math.Round(quantizationScale * math.Log2(1+float64(viewsPerKm2)))
+	if q >= math.MaxUint16 {
+		return math.MaxUint16
+	}
+	return uint16(q)
+}
+
+// DequantizeViews is the inverse of quantizeViews().
+func dequantizeViews(q uint16) float32 {
+	return float32(math.Exp2(float64(q)/quantizationScale) - 1)
+}
+
+// TiffCompression returns the value of the TIFF Compression tag
+// for the compression in the options, after checking the options.
+func (o RasterOptions) tiffCompression() (uint16, error) {
+	switch o.Compression {
+	case "", "deflate":
+		if o.Level != 0 && (o.Level < zlib.BestSpeed || o.Level > zlib.BestCompression) {
+			return 0, fmt.Errorf("compression level %d out of range %d..%d", o.Level, zlib.BestSpeed, zlib.BestCompression)
+		}
+		return 8, nil // zlib/flate, TIFF supplement 2
+	case "none":
+		return 1, nil
+	default:
+		return 0, fmt.Errorf("unknown compression %q", o.Compression)
+	}
 }
 
 type RasterWriter struct {
@@ -103,16 +188,37 @@ type RasterWriter struct {
 	tempFile     *os.File
 	tempFileSize uint64
 	dataSize     uint64
+	root         osmviews.TileKey // area covered by the output; osmviews.WorldTile for the planet
 	zoom         uint8
+	minValue     float32 // stays 0 unless opts.Signed
 	maxValue     float32
+	opts         RasterOptions
+	compression  uint16 // value of TIFF Compression tag
 
 	// For each zoom level, tileOffsets is the position of the TileOffset
 	// relative to the start of the temporary file. In the final output,
 	// we need to group together the tiles from the same zoom level.
+	// The arrays are indexed by absolute zoom level, but levels coarser
+	// than the root tile are left empty.
 	tileOffsets    [][]uint32
 	tileByteCounts [][]uint32
 	uniformTiles   []map[uint32]int
 
+	// Tiles that share the data of a uniform tile whose compression
+	// may still be in progress. Resolved in Close().
+	sharedTiles []sharedTile
+
+	// Tiles get compressed by a pool of worker goroutines, which append
+	// the compressed data to tempFile in whatever order they finish.
+	// While the workers are running, mu guards tempFile, tempFileSize,
+	// tileOffsets, tileByteCounts and err.
+	jobs    chan compressJob
+	workers sync.WaitGroup
+	pixels  sync.Pool // of *[256 * 256]float32
+	mu      sync.Mutex
+	err     error
+	closed  bool // whether jobs has been closed
+
 	// For each zoom level, tileOffsetsPos is the position of the pointer
 	// to the tileOffsets array within the Image File Directory,
 	// relative to the start of the final output TIFF file.
@@ -122,7 +228,46 @@ type RasterWriter struct {
 	tileByteCountsPos []int64
 }
 
-func NewRasterWriter(path string, zoom uint8) (*RasterWriter, error) {
+// CompressJob is a tile whose pixels are waiting to be compressed.
+type compressJob struct {
+	zoom   uint8
+	index  uint32
+	pixels *[256 * 256]float32
+}
+
+// SharedTile is a uniform tile whose data is shared with the tile
+// at index same in the same zoom level.
+type sharedTile struct {
+	zoom        uint8
+	index, same uint32
+}
+
+// NewRasterWriter returns a writer for a GeoTIFF that covers the area
+// of the root tile, with its most detailed image at zoom level zoom.
+// Every image in the file has 256×256 pixel tiles that are exactly
+// aligned with web map tiles; for example, the most detailed image
+// in a global GeoTIFF at zoom 10 has 1024×1024 tiles.
+func NewRasterWriter(path string, root osmviews.TileKey, zoom uint8, opts RasterOptions) (*RasterWriter, error) {
+	if root.Zoom() > zoom {
+		return nil, fmt.Errorf("root tile %s is deeper than zoom %d", root, zoom)
+	}
+	if zoom-root.Zoom() > maxRasterDepth {
+		return nil, fmt.Errorf("area of tile %s too large for zoom %d", root, zoom)
+	}
+	compression, err := opts.tiffCompression()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Signed && opts.Quantize {
+		return nil, fmt.Errorf("signed rasters cannot be quantized")
+	}
+	if opts.Level == 0 {
+		opts.Level = zlib.BestCompression
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+
 	tempFile, err := os.CreateTemp("", "*.tmp")
 	if err != nil {
 		return nil, err
@@ -131,7 +276,11 @@ func NewRasterWriter(path string, zoom uint8) (*RasterWriter, error) {
 	r := &RasterWriter{
 		path:              path,
 		tempFile:          tempFile,
+		root:              root,
 		zoom:              zoom,
+		opts:              opts,
+		compression:       compression,
+		jobs:              make(chan compressJob, opts.Workers),
 		tileOffsets:       make([][]uint32, zoom+1),
 		tileByteCounts:    make([][]uint32, zoom+1),
 		uniformTiles:      make([]map[uint32]int, zoom+1),
@@ -140,15 +289,52 @@ func NewRasterWriter(path string, zoom uint8) (*RasterWriter, error) {
 		tileOffsetsPos:    make([]int64, zoom+1),
 		tileByteCountsPos: make([]int64, zoom+1),
 	}
-	for z := uint8(0); z <= zoom; z++ {
-		r.tileOffsets[z] = make([]uint32, 1<<(2*z))
-		r.tileByteCounts[z] = make([]uint32, 1<<(2*z))
+	for z := root.Zoom(); z <= zoom; z++ {
+		numTiles := r.numTiles(z)
+		r.tileOffsets[z] = make([]uint32, numTiles)
+		r.tileByteCounts[z] = make([]uint32, numTiles)
 		r.uniformTiles[z] = make(map[uint32]int, 16)
 	}
+	r.pixels.New = func() any { return new([256 * 256]float32) }
+	for i := 0; i < opts.Workers; i++ {
+		r.workers.Add(1)
+		go r.compressTiles()
+	}
 	return r, nil
 }
 
+// MaxRasterDepth limits how many zoom levels deeper than its root tile
+// a RasterWriter can go. For deeper pyramids, the output would not fit
+// into a classic TIFF file, whose offsets are limited to 4 GiB.
+// A global GeoTIFF at zoom 18 has depth 10.
+const maxRasterDepth = 11
+
+// TilesAcross returns the number of tiles in horizontal (and vertical)
+// direction for the image of a zoom level.
+func (w *RasterWriter) tilesAcross(zoom uint8) uint32 {
+	return uint32(1) << (zoom - w.root.Zoom())
+}
+
+// NumTiles returns the number of tiles in the image for a zoom level.
+func (w *RasterWriter) numTiles(zoom uint8) uint32 {
+	return w.tilesAcross(zoom) * w.tilesAcross(zoom)
+}
+
+// TileIndex returns the zoom level and the index of a tile within
+// the TileOffsets and TileByteCounts arrays of that zoom level.
+func (w *RasterWriter) tileIndex(tile osmviews.TileKey) (zoom uint8, index uint32) {
+	zoom, x, y := tile.ZoomXY()
+	rootZoom, rootX, rootY := w.root.ZoomXY()
+	depth := zoom - rootZoom
+	x, y = x-rootX<<depth, y-rootY<<depth
+	return zoom, w.tilesAcross(zoom)*y + x
+}
+
 func (w *RasterWriter) Write(r *Raster) error {
+	if w.opts.Signed {
+		return w.writeSigned(r)
+	}
+
 	// About 124K rasters are not strictly uniform, but they have only
 	// marginal differences in color. For those, we can save the effort
 	// of compression.
@@ -168,74 +354,169 @@ func (w *RasterWriter) Write(r *Raster) error {
 		return w.WriteUniform(r.tile, color)
 	}
 
-	offset, size, err := w.compress(r.tile, r.pixels[:])
-	if err != nil {
-		return err
-	}
-
-	zoom, x, y := r.tile.ZoomXY()
-	tileIndex := (1<<zoom)*y + x
-	w.tileOffsets[zoom][tileIndex] = uint32(offset)
-	w.tileByteCounts[zoom][tileIndex] = size
-
-	return nil
+	pixels := w.pixels.Get().(*[256 * 256]float32)
+	*pixels = r.pixels
+	zoom, tileIndex := w.tileIndex(r.tile)
+	return w.submit(compressJob{zoom, tileIndex, pixels})
 }
 
 // WriteUniform produces a raster whose pixels all have the same color.
 // In a typical output, about 55% of all rasters are uniformly colored,
 // so we treat them specially as an optimization.
-func (w *RasterWriter) WriteUniform(tile TileKey, color uint32) error {
-	zoom, x, y := tile.ZoomXY()
-	tileIndex := (1<<zoom)*y + x
+func (w *RasterWriter) WriteUniform(tile osmviews.TileKey, color uint32) error {
+	zoom, tileIndex := w.tileIndex(tile)
 	if same, exists := w.uniformTiles[zoom][color]; exists {
-		w.tileOffsets[zoom][tileIndex] = w.tileOffsets[zoom][same]
-		w.tileByteCounts[zoom][tileIndex] = w.tileByteCounts[zoom][same]
+		w.sharedTiles = append(w.sharedTiles, sharedTile{zoom, tileIndex, uint32(same)})
 		return nil
 	}
 	col := float32(color)
 	if col > w.maxValue {
 		w.maxValue = col
 	}
-	var pixels [256 * 256]float32
+	pixels := w.pixels.Get().(*[256 * 256]float32)
 	for i := 0; i < len(pixels); i++ {
 		pixels[i] = col
 	}
-	offset, size, err := w.compress(tile, pixels[:])
+	w.uniformTiles[zoom][color] = int(tileIndex)
+	return w.submit(compressJob{zoom, tileIndex, pixels})
+}
+
+// WriteSigned writes a raster whose pixels may be negative or fractional.
+// Rounding to integers, as done for views, would lose most of the
+// information, so only exactly uniform rasters get shared.
+func (w *RasterWriter) writeSigned(r *Raster) error {
+	uniform := true
+	color := r.pixels[0]
+	for _, col := range r.pixels {
+		if col != color {
+			uniform = false
+		}
+		w.minValue = min(w.minValue, col)
+		w.maxValue = max(w.maxValue, col)
+	}
+
+	zoom, tileIndex := w.tileIndex(r.tile)
+	key := math.Float32bits(color)
+	if uniform {
+		if same, exists := w.uniformTiles[zoom][key]; exists {
+			w.sharedTiles = append(w.sharedTiles, sharedTile{zoom, tileIndex, uint32(same)})
+			return nil
+		}
+		w.uniformTiles[zoom][key] = int(tileIndex)
+	}
+
+	pixels := w.pixels.Get().(*[256 * 256]float32)
+	*pixels = r.pixels
+	return w.submit(compressJob{zoom, tileIndex, pixels})
+}
+
+// Submit hands a tile to the compression workers. If a worker has
+// failed, the error is returned and the tile is dropped.
+func (w *RasterWriter) submit(job compressJob) error {
+	w.mu.Lock()
+	err := w.err
+	w.mu.Unlock()
 	if err != nil {
+		w.pixels.Put(job.pixels)
 		return err
 	}
-	w.tileOffsets[zoom][tileIndex] = uint32(offset)
-	w.tileByteCounts[zoom][tileIndex] = size
-	w.uniformTiles[zoom][color] = int(tileIndex)
+	w.jobs <- job
 	return nil
 }
 
-func (w *RasterWriter) compress(tile TileKey, pixels []float32) (offset uint64, size uint32, err error) {
+// CompressTiles is the body of a worker goroutine. It compresses tiles
+// until the jobs channel gets closed, and appends them to the temporary
+// file. Allocating a fresh zlib compressor is surprisingly expensive,
+// so every worker keeps its own.
+func (w *RasterWriter) compressTiles() {
+	defer w.workers.Done()
+	var compressor *zlib.Writer
 	var compressed bytes.Buffer
-	writer, err := zlib.NewWriterLevel(&compressed, zlib.BestCompression)
-	if err != nil {
-		return 0, 0, err
-	}
+	bytesPerSample := w.bitsPerSample() / 8
+	encoded := make([]byte, 256*256*bytesPerSample)
+	for job := range w.jobs {
+		// After a failure or Abort, drain the queue without compressing.
+		w.mu.Lock()
+		failed := w.err != nil
+		w.mu.Unlock()
+		if failed {
+			w.pixels.Put(job.pixels)
+			continue
+		}
 
-	if err := binary.Write(writer, binary.LittleEndian, pixels); err != nil {
-		return 0, 0, err
+		if w.opts.Quantize {
+			for i, p := range job.pixels {
+				binary.LittleEndian.PutUint16(encoded[i*2:], quantizeViews(p))
+			}
+		} else {
+			for i, p := range job.pixels {
+				binary.LittleEndian.PutUint32(encoded[i*4:], math.Float32bits(p))
+			}
+		}
+		w.pixels.Put(job.pixels)
+
+		var err error
+		data := encoded
+		if w.compression != 1 {
+			compressed.Reset()
+			if compressor == nil {
+				compressor, err = zlib.NewWriterLevel(&compressed, w.opts.Level)
+			} else {
+				compressor.Reset(&compressed)
+			}
+			if err == nil {
+				_, err = compressor.Write(encoded)
+			}
+			if err == nil {
+				err = compressor.Close()
+			}
+			data = compressed.Bytes()
+		}
+
+		w.mu.Lock()
+		if err == nil && w.err == nil {
+			err = w.store(job.zoom, job.index, data)
+		}
+		if err != nil && w.err == nil {
+			w.err = err
+		}
+		w.mu.Unlock()
 	}
+}
 
-	if err := writer.Close(); err != nil {
-		return 0, 0, err
+// BitsPerSample returns the number of bits per pixel in the output.
+func (w *RasterWriter) bitsPerSample() int {
+	if w.opts.Quantize {
+		return 16
 	}
+	return 32
+}
 
-	n, err := compressed.WriteTo(w.tempFile)
+// Store appends the data of a compressed tile to the temporary file.
+// The caller must hold w.mu.
+func (w *RasterWriter) store(zoom uint8, tileIndex uint32, data []byte) error {
+	n, err := w.tempFile.Write(data)
 	if err != nil {
-		return 0, 0, err
+		return err
 	}
-
-	offset = w.tempFileSize
+	w.tileOffsets[zoom][tileIndex] = uint32(w.tempFileSize)
+	w.tileByteCounts[zoom][tileIndex] = uint32(n)
 	w.tempFileSize += uint64(n)
-	return offset, uint32(n), nil
+	return nil
 }
 
 func (w *RasterWriter) Close() error {
+	w.closed = true
+	close(w.jobs)
+	w.workers.Wait()
+	if w.err != nil {
+		return w.err
+	}
+	for _, t := range w.sharedTiles {
+		w.tileOffsets[t.zoom][t.index] = w.tileOffsets[t.zoom][t.same]
+		w.tileByteCounts[t.zoom][t.index] = w.tileByteCounts[t.zoom][t.same]
+	}
+
 	out, err := os.Create(w.path + ".tmp")
 	if err != nil {
 		return err
@@ -265,6 +546,30 @@ func (w *RasterWriter) Close() error {
 	return nil
 }
 
+// Abort stops writing without producing any output. The compression
+// workers skip the tiles that are still queued, and the temporary
+// files get deleted. It is safe to call Abort after Close, for example
+// when Close has failed.
+func (w *RasterWriter) Abort() {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = errRasterWriterAborted
+	}
+	w.mu.Unlock()
+
+	if !w.closed {
+		w.closed = true
+		close(w.jobs)
+		w.workers.Wait()
+	}
+
+	w.tempFile.Close()
+	os.Remove(w.tempFile.Name())
+	os.Remove(w.path + ".tmp")
+}
+
+var errRasterWriterAborted = errors.New("RasterWriter aborted")
+
 func (w *RasterWriter) writeTiff(out *os.File) error {
 	// Magic header for a little-endian TIFF file that is smaller than 4GiB.
 	// Our output is “only” a few hundred megabytes, so we do not need to
@@ -309,7 +614,7 @@ KNOWN_INCOMPATIBLE_EDITION=NO
 		return err
 	}
 
-	for zoom := int(w.zoom); zoom >= 0; zoom-- {
+	for zoom := int(w.zoom); zoom >= int(w.root.Zoom()); zoom-- {
 		if err := w.writeIFD(uint8(zoom), out); err != nil {
 			return err
 		}
@@ -319,7 +624,7 @@ KNOWN_INCOMPATIBLE_EDITION=NO
 		return err
 	}
 
-	for zoom := uint8(0); zoom <= w.zoom; zoom++ {
+	for zoom := w.root.Zoom(); zoom <= w.zoom; zoom++ {
 		if err := w.writeTiles(zoom, out); err != nil {
 			return err
 		}
@@ -327,7 +632,7 @@ KNOWN_INCOMPATIBLE_EDITION=NO
 
 	// TileByteCounts at the end, as per Cloud-Optimized GeoTIFF discussion:
 	// https://github.com/cogeotiff/cog-spec/issues/5#issuecomment-996511137
-	for zoom := uint8(0); zoom <= w.zoom; zoom++ {
+	for zoom := w.root.Zoom(); zoom <= w.zoom; zoom++ {
 		if err := w.writeTileByteCounts(zoom, out); err != nil {
 			return err
 		}
@@ -397,18 +702,29 @@ func (w *RasterWriter) writeIFD(zoom uint8, f *os.File) error {
 	const earthCircumference = 40075017.0
 	metersPerPixel := earthCircumference / float64(uint64(1<<(w.zoom+8))) // at equator
 	geoModelPixelScale := []float64{metersPerPixel, metersPerPixel, 0}
-	geoModelTiepoints := []float64{0, 0, 0, -20037508.34, 20037508.34, 0}
 
-	numTiles := uint32(1 << (zoom * 2))
+	// The tiepoint maps the top left corner of the image, which is
+	// the top left corner of the root tile, to web mercator meters.
+	const worldEdge = 20037508.34
+	rootZoom, rootX, rootY := w.root.ZoomXY()
+	rootSize := 2 * worldEdge / float64(uint32(1)<<rootZoom)
+	geoModelTiepoints := []float64{
+		0, 0, 0,
+		-worldEdge + float64(rootX)*rootSize, worldEdge - float64(rootY)*rootSize, 0,
+	}
+
+	numTiles := w.numTiles(zoom)
+	imageSize := w.tilesAcross(zoom) * 256
 	type ifdEntry struct {
 		tag uint16
 		val uint32
 	}
 	ifd := []ifdEntry{
-		{imageWidth, 1 << (zoom + 8)},
-		{imageHeight, 1 << (zoom + 8)},
-		{bitsPerSample, 32},
-		{compression, 8}, // 1 = no compression; 8 = zlib/flate
+		{imageWidth, imageSize},
+		{imageHeight, imageSize},
+		{bitsPerSample, uint32(w.bitsPerSample())},
+		// 1 = no compression; 8 = zlib/flate
+		{compression, uint32(w.compression)},
 		{photometric, 0}, // 0 = WhiteIsZero
 		{samplesPerPixel, 1},
 		{planarConfig, 1},
@@ -418,6 +734,9 @@ func (w *RasterWriter) writeIFD(zoom uint8, f *os.File) error {
 		{tileByteCounts, 0},
 		{sampleFormat, 3}, // 3 = IEEE floating point, TIFF spec page 80
 	}
+	if w.opts.Quantize {
+		ifd[len(ifd)-1].val = 1 // 1 = unsigned integer
+	}
 
 	// Some TIFF tags are only used on the main (highest resolution) image.
 	if zoom == w.zoom {
@@ -469,7 +788,13 @@ func (w *RasterWriter) writeIFD(zoom uint8, f *os.File) error {
 			typ, count, value = longFormat, 1, e.val
 
 		case imageDescription:
-			s := []byte("OpenStreetMap view density, in weekly user views per km2\u0000")
+			desc := "OpenStreetMap view density, in weekly user views per km2"
+			if w.opts.Description != "" {
+				desc = w.opts.Description
+			} else if w.opts.Quantize {
+				desc += fmt.Sprintf(", quantized as round(%d * log2(1 + views))", quantizationScale)
+			}
+			s := []byte(desc + "\u0000")
 			typ, count, value = asciiFormat, uint32(len(s)), uint32(extraPos)+uint32(extraBuf.Len())
 			if _, err := extraBuf.Write(s); err != nil {
 				return err
@@ -481,10 +806,16 @@ func (w *RasterWriter) writeIFD(zoom uint8, f *os.File) error {
 			extraBuf.Write(s)
 
 		case sMinSampleValue:
-			typ, count, value = floatFormat, 1, math.Float32bits(0)
+			typ, count, value = floatFormat, 1, math.Float32bits(w.minValue)
+			if w.opts.Quantize {
+				typ, value = shortFormat, 0
+			}
 
 		case sMaxSampleValue:
 			typ, count, value = floatFormat, 1, math.Float32bits(w.maxValue)
+			if w.opts.Quantize {
+				typ, value = shortFormat, uint32(quantizeViews(w.maxValue))
+			}
 
 		case geoKeyDirectory:
 			typ, count, value = shortFormat, uint32(len(geoKeys)), uint32(extraPos)+uint32(extraBuf.Len())
@@ -606,12 +937,12 @@ func (w *RasterWriter) writeTiles(zoom uint8, f *os.File) error {
 		}
 	}
 
-	numTiles := uint32(1 << (zoom * 2))
+	numTiles := w.numTiles(zoom)
 
 	// Reserve space for tileOffsets. We will overwrite tileOffsets below,
 	// once we know the actual offset of each tile.
 	tileOffsetsPos := fileSize
-	numRows := 1 << zoom
+	numRows := int(w.tilesAcross(zoom))
 	emptyRow := make([]byte, numRows*4)
 	for y := 0; y < numRows; y++ {
 		if _, err := f.Write(emptyRow); err != nil {
@@ -9,15 +9,19 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/brawer/wikidata-qrank/v2/internal/cogtiff"
+	"github.com/brawer/wikidata-qrank/v2/pkg/osmviews"
 	"github.com/orcaman/writerseeker"
 )
 
 func TestRaster_Paint(t *testing.T) {
-	r := NewRaster(MakeTileKey(1, 1, 1), NewRaster(WorldTile, nil))
-	r.Paint(MakeTileKey(2, 3, 3), 23)
-	r.Paint(MakeTileKey(3, 6, 7), 42)
+	r := NewRaster(osmviews.MakeTileKey(1, 1, 1), NewRaster(osmviews.WorldTile, nil))
+	r.Paint(osmviews.MakeTileKey(2, 3, 3), 23)
+	r.Paint(osmviews.MakeTileKey(3, 6, 7), 42)
 	wantPixels(t, r.pixels, [4][4]float32{
 		{0, 0, 0, 0},
 		{0, 0, 0, 0},
@@ -27,9 +31,9 @@ func TestRaster_Paint(t *testing.T) {
 }
 
 func TestRaster_Paint_SubPixel(t *testing.T) {
-	tile := MakeTileKey(1, 0, 0)
-	r := NewRaster(tile, NewRaster(WorldTile, nil))
-	r.Paint(MakeTileKey(10, 256, 256), 100) // covers 1/4th of a pixel
+	tile := osmviews.MakeTileKey(1, 0, 0)
+	r := NewRaster(tile, NewRaster(osmviews.WorldTile, nil))
+	r.Paint(osmviews.MakeTileKey(10, 256, 256), 100) // covers 1/4th of a pixel
 	wantPixels(t, r.pixels, [4][4]float32{
 		{0, 0, 0, 0},
 		{0, 0, 0, 0},
@@ -39,7 +43,7 @@ func TestRaster_Paint_SubPixel(t *testing.T) {
 }
 
 func TestRaster_PaintChild(t *testing.T) {
-	r := NewRaster(MakeTileKey(1, 1, 1), NewRaster(WorldTile, nil))
+	r := NewRaster(osmviews.MakeTileKey(1, 1, 1), NewRaster(osmviews.WorldTile, nil))
 	r.pixels[1] = 123456
 	r.pixels[256] = 789123
 	r.parent.PaintChild(r)
@@ -64,6 +68,159 @@ func wantPixels(t *testing.T, got [256 * 256]float32, want [4][4]float32) {
 	}
 }
 
+func TestRasterWriter_Options(t *testing.T) {
+	var first []byte
+	for _, opts := range []RasterOptions{
+		{Workers: 1},
+		{Workers: 8},
+		{Level: 1},
+		{Compression: "none"},
+		{Quantize: true},
+	} {
+		path := writeTestRasters(t, opts)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The number of workers must not change the output.
+		if opts.Workers != 0 {
+			if first == nil {
+				first = data
+			} else if !bytes.Equal(data, first) {
+				t.Errorf("%+v: output differs from single worker", opts)
+			}
+		}
+
+		tiff, err := cogtiff.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantCompression := uint16(8)
+		if opts.Compression == "none" {
+			wantCompression = 1
+		}
+		wantBits := uint16(32)
+		if opts.Quantize {
+			wantBits = 16
+		}
+		for _, img := range tiff.Images {
+			if img.Compression != wantCompression {
+				t.Errorf("%+v: got compression %d, want %d", opts, img.Compression, wantCompression)
+			}
+			if img.BitsPerSample != wantBits {
+				t.Errorf("%+v: got %d bits per sample, want %d", opts, img.BitsPerSample, wantBits)
+			}
+		}
+
+		pixels := make([]float32, 256*256)
+		for tile, want := range []float32{1, 7, 7, 7} {
+			if err := readViews(tiff.Images[0], tile, pixels); err != nil {
+				t.Fatal(err)
+			}
+			if tile == 0 && math.Abs(float64(pixels[257]-42)) > 0.02 {
+				t.Errorf("%+v: tile 0: got pixel %v, want 42", opts, pixels[257])
+			}
+			if pixels[0] != want {
+				t.Errorf("%+v: tile %d: got pixel %v, want %v", opts, tile, pixels[0], want)
+			}
+		}
+	}
+}
+
+func TestQuantizeViews(t *testing.T) {
+	for _, v := range []float32{0, 0.001, 0.5, 1, 7, 42, 1234.5, 9e6, 1e9} {
+		q := quantizeViews(v)
+		got := dequantizeViews(q)
+		if diff := math.Abs(float64(got - v)); diff > 0.0004*float64(v)+0.0004 {
+			t.Errorf("quantizeViews(%v) = %d, dequantizes to %v", v, q, got)
+		}
+	}
+	for _, tc := range []struct {
+		v    float32
+		want uint16
+	}{
+		{-5, 0},
+		{0, 0},
+		{1, 2048},
+		{7, 6144},
+		{1e10, 65535},
+		{float32(math.Inf(1)), 65535},
+	} {
+		if got := quantizeViews(tc.v); got != tc.want {
+			t.Errorf("quantizeViews(%v) = %d, want %d", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestRasterWriter_BadOptions(t *testing.T) {
+	for _, opts := range []RasterOptions{
+		{Compression: "lzw"},
+		{Level: -1},
+		{Level: 10},
+	} {
+		path := filepath.Join(t.TempDir(), "bad.tif")
+		if _, err := NewRasterWriter(path, osmviews.WorldTile, 1, opts); err == nil {
+			t.Errorf("%+v: expected error", opts)
+		}
+	}
+}
+
+func TestRasterWriter_Abort(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aborted.tif")
+	w, err := NewRasterWriter(path, osmviews.WorldTile, 1, RasterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteUniform(osmviews.MakeTileKey(1, 0, 0), 7); err != nil {
+		t.Fatal(err)
+	}
+	tempFile := w.tempFile.Name()
+	w.Abort()
+	w.Abort() // should be safe to call twice
+
+	if _, err := os.Stat(tempFile); !os.IsNotExist(err) {
+		t.Errorf("temporary file should have been deleted, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("output should not exist, got %v", err)
+	}
+	if err := w.WriteUniform(osmviews.MakeTileKey(1, 1, 0), 8); err == nil {
+		t.Error("expected error when writing after Abort")
+	}
+}
+
+// WriteTestRasters writes a GeoTIFF whose main image has four tiles,
+// one of them with some detail and three with uniform color.
+func writeTestRasters(t *testing.T, opts RasterOptions) string {
+	path := filepath.Join(t.TempDir(), "test.tif")
+	w, err := NewRasterWriter(path, osmviews.WorldTile, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	world := NewRaster(osmviews.WorldTile, nil)
+	r := NewRaster(osmviews.MakeTileKey(1, 0, 0), world)
+	for i := range r.pixels {
+		r.pixels[i] = 1
+	}
+	r.pixels[257] = 42
+	if err := w.Write(r); err != nil {
+		t.Fatal(err)
+	}
+	for _, tile := range []osmviews.TileKey{osmviews.MakeTileKey(1, 1, 0), osmviews.MakeTileKey(1, 0, 1), osmviews.MakeTileKey(1, 1, 1)} {
+		if err := w.WriteUniform(tile, 7); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Write(world); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
 func TestRasterWriter_writeIFDList(t *testing.T) {
 	f := &writerseeker.WriterSeeker{}
 	f.Write([]byte{
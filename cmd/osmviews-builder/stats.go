@@ -4,33 +4,37 @@
 package main
 
 import (
-	"bytes"
-	"compress/zlib"
-	"encoding/binary"
+	"container/heap"
 	"encoding/json"
 	"fmt"
-	"io"
 	"math"
 	"math/rand"
 	"os"
 	"sort"
 
+	"github.com/brawer/wikidata-qrank/v2/internal/chart"
+	"github.com/brawer/wikidata-qrank/v2/internal/cogtiff"
+	"github.com/brawer/wikidata-qrank/v2/pkg/osmviews"
 	"github.com/fogleman/gg"
 )
 
-func BuildStats(tiffPath, statsPath, plotPath string) error {
+// BuildStats computes statistics for a GeoTIFF produced by paint().
+// The root tile tells which area is covered by the GeoTIFF;
+// for a global output, it is WorldTile. The extension of plotPath,
+// .png or .svg, determines the format of the plot.
+func BuildStats(tiffPath string, root osmviews.TileKey, statsPath, plotPath string) error {
 	f, err := os.Open(tiffPath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	t, err := NewTiffReader(f)
+	tiff, err := cogtiff.NewReader(f)
 	if err != nil {
 		return err
 	}
 
-	hist, err := buildHistogram(t)
+	hist, hotTiles, err := buildHistogram(tiff.Images[0], root)
 	if err != nil {
 		return err
 	}
@@ -39,6 +43,7 @@ func BuildStats(tiffPath, statsPath, plotPath string) error {
 	if err != nil {
 		return err
 	}
+	stats.HotTiles = hotTiles
 
 	if err := stats.Plot(plotPath); err != nil {
 		return err
@@ -77,153 +82,40 @@ type Sample []interface{} // [[Lat, Lng], Rank, Value]
 type Stats struct {
 	Median  int
 	Samples []Sample
-}
 
-type TiffReader struct {
-	r                                              io.ReadSeeker
-	order                                          binary.ByteOrder
-	imageWidth, imageHeight, tileWidth, tileHeight uint32
-	tileOffsets, tileByteCounts                    []uint32
-}
+	// Percentiles has 101 entries. Percentiles[p] is the smallest
+	// value in views per km² so that p percent of all pixels have
+	// that value or less. Percentiles[0] is the minimum value,
+	// Percentiles[100] the maximum.
+	Percentiles []float32
 
-func NewTiffReader(r io.ReadSeeker) (*TiffReader, error) {
-	tr := &TiffReader{r: r}
-	if err := tr.readFirstIFD(); err != nil {
-		return nil, err
-	}
-	return tr, nil
+	// HotTiles are the pixels with the most views per km²,
+	// sorted by decreasing views.
+	HotTiles []HotTile
 }
 
-func (t *TiffReader) readFirstIFD() error {
-	var header [4]byte
-	if _, err := t.r.Read(header[:]); err != nil {
-		return err
-	}
-
-	// We only need to decode our own files, which are never big-endian.
-	if bytes.Equal(header[:], []byte{'I', 'I', 42, 0}) {
-		t.order = binary.LittleEndian
-	} else if bytes.Equal(header[:], []byte{'M', 'M', 0, 42}) {
-		t.order = binary.BigEndian
-	} else {
-		return fmt.Errorf("unsupported format")
-	}
-
-	var ifdOffset uint32
-	if err := binary.Read(t.r, t.order, &ifdOffset); err != nil {
-		return err
-	}
-	if _, err := t.r.Seek(int64(ifdOffset), os.SEEK_SET); err != nil {
-		return err
-	}
-
-	var numDirEntries uint16
-	if err := binary.Read(t.r, t.order, &numDirEntries); err != nil {
-		return err
-	}
-
-	var ifd bytes.Buffer
-	if _, err := io.CopyN(&ifd, t.r, int64(numDirEntries)*12); err != nil {
-		return err
-	}
-
-	for i := uint16(0); i < numDirEntries; i++ {
-		var tag, typ uint16
-		var count, value uint32
-		if err := binary.Read(&ifd, t.order, &tag); err != nil {
-			return err
-		}
-		if err := binary.Read(&ifd, t.order, &typ); err != nil {
-			return err
-		}
-		if err := binary.Read(&ifd, t.order, &count); err != nil {
-			return err
-		}
-		switch typ {
-		case 3: // SHORT
-			var sval1, sval2 uint16
-			if err := binary.Read(&ifd, t.order, &sval1); err != nil {
-				return err
-			}
-			binary.Read(&ifd, t.order, &sval2)
-			value = uint32(sval1)
-
-		default: // LONG
-			if err := binary.Read(&ifd, t.order, &value); err != nil {
-				return err
-			}
-		}
-
-		switch tag {
-		case 256: // ImageWidth
-			t.imageWidth = value
-
-		case 257: // ImageLength
-			t.imageHeight = value
-
-		case 322: // TileWidth
-			t.tileWidth = value
-
-		case 323: // TileLength
-			t.tileHeight = value
-
-		case 324: // TileOffsets
-			if a, err := t.readIntArray(typ, count, value); err == nil {
-				t.tileOffsets = a
-			} else {
-				return err
-			}
-
-		case 325: // TileByteCounts
-			if a, err := t.readIntArray(typ, count, value); err == nil {
-				t.tileByteCounts = a
-			} else {
-				return err
-			}
-		}
-	}
-
-	return nil
-}
-
-func (t *TiffReader) readIntArray(typ uint16, count, value uint32) ([]uint32, error) {
-	if typ != 4 {
-		return nil, fmt.Errorf("got type=%d, want 4", typ)
-	}
-
-	if _, err := t.r.Seek(int64(value), os.SEEK_SET); err != nil {
-		return nil, err
-	}
-
-	result := make([]uint32, count)
-	if err := binary.Read(t.r, t.order, &result); err != nil {
-		return nil, err
-	}
-
-	return result, nil
+// HotTile is one of the pixels with the most views per km².
+// Lat and Lng are at the center of the tile.
+type HotTile struct {
+	Tile  string  // such as "18/137341/91897"
+	Views float32 // views per km²
+	Lat   float32
+	Lng   float32
 }
 
-func (t *TiffReader) readTile(index TileIndex, data []float32) error {
-	if _, err := t.r.Seek(int64(t.tileOffsets[index]), os.SEEK_SET); err != nil {
-		return err
-	}
-
-	n := int64(t.tileByteCounts[index])
-	var buf bytes.Buffer
-	if _, err := io.CopyN(&buf, t.r, n); err != nil {
-		return err
-	}
+// MaxHotTiles is the number of hottest tiles that get listed in the stats.
+const maxHotTiles = 1000
 
-	reader, err := zlib.NewReader(&buf)
-	if err != nil {
-		return err
-	}
-
-	if err := binary.Read(reader, t.order, &data); err != nil {
-		return err
+// Percentile returns the percentage of pixels whose value is at most
+// value, to the precision of the percentile table.
+func (s *Stats) Percentile(value float32) int {
+	p := sort.Search(len(s.Percentiles), func(i int) bool {
+		return s.Percentiles[i] > value
+	})
+	if p == 0 {
+		return 0
 	}
-
-	return nil
+	return p - 1
 }
 
 type TileIndex int
@@ -237,11 +129,11 @@ type SharedTile struct {
 	SampleTiles []TileIndex // A random sample of tiles that share this data.
 }
 
-type SharedTiles map[uint32]*SharedTile
+type SharedTiles map[uint64]*SharedTile
 
-func findSharedTiles(tileOffsets []uint32) SharedTiles {
+func findSharedTiles(tileOffsets []uint64) SharedTiles {
 	shared := make(SharedTiles, 20)     // 16 for GeoTIFF of 2022-01-24
-	uses := make(map[uint32]int, 80000) // 72138 for TIFF of 2022-01-24
+	uses := make(map[uint64]int, 80000) // 72138 for TIFF of 2022-01-24
 	for _, off := range tileOffsets {
 		uses[off] += 1
 	}
@@ -285,7 +177,7 @@ func findSharedTiles(tileOffsets []uint32) SharedTiles {
 	return shared
 }
 
-func (s SharedTiles) Plot(dc *gg.Context, tileOffsets []uint32) {
+func (s SharedTiles) Plot(dc *gg.Context, tileOffsets []uint64) {
 	dc.SetRGB(1, 1, 1)
 	dc.Clear()
 	dc.SetRGB(0.8, 0.8, 1)
@@ -311,7 +203,33 @@ type histogram struct {
 	tileWidth, tileHeight   int
 	stride, zoom            int
 	tileWidthBits           int
+	originX, originY        uint32 // pixel position of image origin at zoom
 	buckets                 map[uint64]Bucket
+	hot                     hotPixels
+	maxHot                  int
+	hotThreshold            float32 // pixels must exceed this to get into hot
+}
+
+type hotPixel struct {
+	value float32
+	tile  TileIndex
+	x, y  int
+}
+
+// HotPixels is a min-heap, so the least hot pixel can quickly
+// be replaced when a hotter one gets found.
+type hotPixels []hotPixel
+
+func (h hotPixels) Len() int           { return len(h) }
+func (h hotPixels) Less(i, j int) bool { return h[i].value < h[j].value }
+func (h hotPixels) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *hotPixels) Push(x any)        { *h = append(*h, x.(hotPixel)) }
+func (h *hotPixels) Pop() any {
+	old := *h
+	n := len(old)
+	p := old[n-1]
+	*h = old[0 : n-1]
+	return p
 }
 
 type BucketSample struct{ value, lat, lng float32 }
@@ -321,12 +239,16 @@ type Bucket struct {
 	Sample BucketSample
 }
 
-func newHistogram(imageWidth, imageHeight, tileWidth, tileHeight int) *histogram {
+func newHistogram(root osmviews.TileKey, imageWidth, imageHeight, tileWidth, tileHeight int) *histogram {
 	h := &histogram{imageWidth: imageWidth, imageHeight: imageHeight, tileWidth: tileWidth, tileHeight: tileHeight}
 	h.stride = (imageWidth + tileWidth - 1) / tileWidth
-	h.zoom = math.Ilogb(float64(imageWidth))
+	rootZoom, rootX, rootY := root.ZoomXY()
+	depth := math.Ilogb(float64(imageWidth))
+	h.zoom = depth + int(rootZoom)
+	h.originX, h.originY = rootX<<depth, rootY<<depth
 	h.tileWidthBits = math.Ilogb(float64(tileWidth))
 	h.buckets = make(map[uint64]Bucket, 250000) // 210037 for 2022-01-24 data
+	h.maxHot = maxHotTiles
 	return h
 }
 
@@ -337,6 +259,9 @@ func (h *histogram) Add(data []float32, uses int, samples []TileIndex) {
 		for x := 0; x < h.tileWidth; x++ {
 			val := data[pos]
 			pos++
+			if val > h.hotThreshold {
+				h.addHotPixel(val, samples[0], x, y)
+			}
 			key := uint64(val + 0.5)
 			if b, ok := h.buckets[key]; ok && numSamplesTaken >= numSamples {
 				// Frequent code path, taken 4.72 billion times.
@@ -353,15 +278,57 @@ func (h *histogram) Add(data []float32, uses int, samples []TileIndex) {
 }
 
 func (h *histogram) makeBucket(val float32, count int64, tile TileIndex, x, y int) Bucket {
-	tileX := int(tile) % h.stride
-	pixelX := uint32(tileX<<h.tileWidthBits + x)
-	lng := float32(pixelX)/float32(h.imageWidth)*360.0 - 180.0
+	pixelX, pixelY := h.pixelXY(tile, x, y)
+	lng := float32(pixelX)/float32(uint64(1)<<h.zoom)*360.0 - 180.0
+	lat := float32(osmviews.TileLatitude(uint8(h.zoom), pixelY) * (180 / math.Pi))
+	return Bucket{count, BucketSample{val, lat, lng}}
+}
 
-	tileY := int(tile) / h.stride
-	pixelY := uint32(tileY<<h.tileWidthBits + y)
-	lat := float32(TileLatitude(uint8(h.zoom), pixelY) * (180 / math.Pi))
+// PixelXY returns the tile coordinates, at the zoom level of the
+// histogram, for pixel x/y inside an image tile.
+func (h *histogram) pixelXY(tile TileIndex, x, y int) (uint32, uint32) {
+	tileX, tileY := int(tile)%h.stride, int(tile)/h.stride
+	pixelX := h.originX + uint32(tileX<<h.tileWidthBits+x)
+	pixelY := h.originY + uint32(tileY<<h.tileWidthBits+y)
+	return pixelX, pixelY
+}
 
-	return Bucket{count, BucketSample{val, lat, lng}}
+// AddHotPixel remembers a pixel as one of the hottest, evicting
+// the least hot pixel once there are more than maxHot.
+func (h *histogram) addHotPixel(val float32, tile TileIndex, x, y int) {
+	heap.Push(&h.hot, hotPixel{val, tile, x, y})
+	if len(h.hot) > h.maxHot {
+		heap.Pop(&h.hot)
+	}
+	if len(h.hot) == h.maxHot {
+		h.hotThreshold = h.hot[0].value
+	}
+}
+
+// HotTiles returns the hottest pixels, sorted by decreasing views.
+// Ties are sorted by tile, so the output does not depend on the
+// random order in which buildHistogram visits the image tiles.
+func (h *histogram) HotTiles() []HotTile {
+	zoom := uint8(h.zoom)
+	tiles := make([]HotTile, 0, len(h.hot))
+	for _, p := range h.hot {
+		x, y := h.pixelXY(p.tile, p.x, p.y)
+		lat := osmviews.TileLatitude(zoom+1, 2*y+1) * (180 / math.Pi)
+		lng := (float64(x)+0.5)/float64(uint64(1)<<zoom)*360.0 - 180.0
+		tiles = append(tiles, HotTile{
+			Tile:  osmviews.MakeTileKey(zoom, x, y).String(),
+			Views: p.value,
+			Lat:   float32(lat),
+			Lng:   float32(lng),
+		})
+	}
+	sort.Slice(tiles, func(i, j int) bool {
+		if tiles[i].Views != tiles[j].Views {
+			return tiles[i].Views > tiles[j].Views
+		}
+		return tiles[i].Tile < tiles[j].Tile
+	})
+	return tiles
 }
 
 func (h *histogram) Plot(dc *gg.Context, buckets []Bucket) {
@@ -370,7 +337,7 @@ func (h *histogram) Plot(dc *gg.Context, buckets []Bucket) {
 	z := uint8(h.zoom - h.tileWidthBits)
 	var total int64
 	for _, b := range buckets {
-		x, y := TileFromLatLng(float64(b.Sample.lat), float64(b.Sample.lng), z)
+		x, y := osmviews.TileFromLatLng(float64(b.Sample.lat), float64(b.Sample.lng), z)
 		dc.DrawCircle(float64(x), float64(y), 3.0)
 		dc.Fill()
 		ctr[uint64(y)*1024+uint64(x)] += 1
@@ -379,23 +346,31 @@ func (h *histogram) Plot(dc *gg.Context, buckets []Bucket) {
 	fmt.Println("**** Number of unique lat/lng samples:", len(ctr))
 }
 
-func buildHistogram(t *TiffReader) ([]Bucket, error) {
-	sharedTiles := findSharedTiles(t.tileOffsets)
-	stride := 1 << (math.Ilogb(float64(len(t.tileOffsets))) / 2)
-	hist := newHistogram(int(t.imageWidth), int(t.imageHeight), int(t.tileWidth), int(t.tileHeight))
+// BuildHistogram counts how many pixels have which value, and finds
+// the hottest pixels. Shared tiles are not considered for the hottest
+// pixels; they are patches of ocean or desert, far from the top.
+func buildHistogram(img *cogtiff.Image, root osmviews.TileKey) ([]Bucket, []HotTile, error) {
+	tileOffsets, err := img.TileOffsets()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sharedTiles := findSharedTiles(tileOffsets)
+	stride := 1 << (math.Ilogb(float64(len(tileOffsets))) / 2)
+	hist := newHistogram(root, int(img.Width), int(img.Height), int(img.TileWidth), int(img.TileHeight))
 
-	data := make([]float32, t.tileWidth*t.tileHeight)
+	data := make([]float32, img.TileWidth*img.TileHeight)
 	nn := 0
 	for _, y := range rand.Perm(stride) {
 		for _, x := range rand.Perm(stride) {
 			ti := TileIndex(y*stride + x)
-			off := t.tileOffsets[ti]
+			off := tileOffsets[ti]
 			if _, isShared := sharedTiles[off]; isShared {
 				continue
 			}
 			// if nn > 8 { break }
-			if err := t.readTile(ti, data); err != nil {
-				return nil, err
+			if err := readViews(img, int(ti), data); err != nil {
+				return nil, nil, err
 			}
 			hist.Add(data, 1, []TileIndex{ti})
 			nn++
@@ -408,8 +383,8 @@ func buildHistogram(t *TiffReader) ([]Bucket, error) {
 	}
 
 	for _, st := range sharedTiles {
-		if err := t.readTile(st.SampleTiles[0], data); err != nil {
-			return nil, err
+		if err := readViews(img, int(st.SampleTiles[0]), data); err != nil {
+			return nil, nil, err
 		}
 		tileUses := int64(st.UseCount) * int64(len(data))
 		for i, tile := range st.SampleTiles {
@@ -425,7 +400,21 @@ func buildHistogram(t *TiffReader) ([]Bucket, error) {
 		return buckets[i].Sample.value > buckets[j].Sample.value
 	})
 
-	return buckets, nil
+	return buckets, hist.HotTiles(), nil
+}
+
+// ReadViews reads the pixels of a tile in views per km². For quantized
+// output with 16-bit samples, the quantization gets undone.
+func readViews(img *cogtiff.Image, index int, data []float32) error {
+	if err := img.ReadTile(index, data); err != nil {
+		return err
+	}
+	if img.BitsPerSample == 16 {
+		for i, q := range data {
+			data[i] = dequantizeViews(uint16(q))
+		}
+	}
+	return nil
 }
 
 func calcStats(hist []Bucket) (*Stats, error) {
@@ -461,16 +450,41 @@ func calcStats(hist []Bucket) (*Stats, error) {
 		rank += b.Count
 	}
 
+	stats.Percentiles = calcPercentiles(hist, totalCount)
 	return stats, nil
 }
 
+// CalcPercentiles computes the percentile table for a histogram
+// whose buckets are sorted by decreasing value.
+func calcPercentiles(hist []Bucket, totalCount int64) []float32 {
+	percentiles := make([]float32, 101)
+	var count int64
+	p := 0
+	for i := len(hist) - 1; i >= 0 && p <= 100; i-- {
+		count += hist[i].Count
+		for p <= 100 && count*100 >= int64(p)*totalCount {
+			percentiles[p] = hist[i].Sample.value
+			p++
+		}
+	}
+	return percentiles
+}
+
 func (s *Stats) Plot(path string) error {
+	format, err := chart.FormatFromPath(path)
+	if err != nil {
+		return err
+	}
+
 	firstValue := float64(s.Samples[0][2].(float32))
 	lastRank := float64(s.Samples[len(s.Samples)-1][1].(int64))
 	scaleX := 1000.0 / math.Log10(lastRank)
 	scaleY := 1000.0 / math.Log10(firstValue)
 
-	dc := gg.NewContext(1010, 1010)
+	dc, err := chart.NewCanvas(format, 1010, 1010)
+	if err != nil {
+		return err
+	}
 	dc.SetRGB(1, 1, 1)
 	dc.Clear()
 
@@ -493,12 +507,12 @@ func (s *Stats) Plot(path string) error {
 	dc.SetRGB(1, 0.4, 0.4)
 	for _, p := range s.Samples {
 		lat, lng := p[0].([]float32)[0], p[0].([]float32)[1]
-		x, y := TileFromLatLng(float64(lat), float64(lng), 9)
+		x, y := osmviews.TileFromLatLng(float64(lat), float64(lng), 9)
 		dc.DrawCircle(float64(x)+5.0, float64(y)+5+1000-512, 3.0)
 		dc.Fill()
 	}
 
-	if err := dc.SavePNG(path); err != nil {
+	if err := dc.Save(path); err != nil {
 		return err
 	}
 
@@ -4,11 +4,17 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/brawer/wikidata-qrank/v2/pkg/osmviews"
 )
 
 func TestFindSharedTiles(t *testing.T) {
-	shared := findSharedTiles([]uint32{12, 72, 88, 72, 32, 18})
+	shared := findSharedTiles([]uint64{12, 72, 88, 72, 32, 18})
 	if len(shared) != 1 {
 		t.Fatalf("want len(shared) == 1, got %d", len(shared))
 	}
@@ -26,3 +32,93 @@ func TestFindSharedTiles(t *testing.T) {
 		}
 	}
 }
+
+func TestStatsPlot(t *testing.T) {
+	stats := &Stats{Samples: []Sample{
+		{[]float32{47.37, 8.54}, int64(1), float32(5000)},
+		{[]float32{46.95, 7.45}, int64(20), float32(300)},
+		{[]float32{0, 0}, int64(4000), float32(1)},
+	}}
+	dir := t.TempDir()
+	for _, name := range []string{"plot.png", "plot.svg"} {
+		if err := stats.Plot(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	svg, err := os.ReadFile(filepath.Join(dir, "plot.svg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(svg), "<svg ") {
+		t.Errorf("plot.svg is not an SVG file: %q", svg)
+	}
+
+	if err := stats.Plot(filepath.Join(dir, "plot.gif")); err == nil {
+		t.Error("expected error for unsupported format")
+	}
+}
+
+func TestHistogramHotTiles(t *testing.T) {
+	// A 4×4 image at zoom 2, made of 2×2 tiles of 2×2 pixels each.
+	h := newHistogram(osmviews.WorldTile, 4, 4, 2, 2)
+	h.maxHot = 3
+	h.Add([]float32{0, 7, 3, 0}, 1, []TileIndex{0})
+	h.Add([]float32{5, 0, 9, 7}, 1, []TileIndex{3})
+	h.Add([]float32{1, 1, 1, 2}, 1, []TileIndex{1})
+
+	got := h.HotTiles()
+	if len(got) != 3 {
+		t.Fatalf("got %d hot tiles, want 3: %v", len(got), got)
+	}
+	want := "[{2/2/3 9} {2/1/0 7} {2/3/3 7}]"
+	var tiles []string
+	for _, ht := range got {
+		tiles = append(tiles, fmt.Sprintf("{%s %v}", ht.Tile, ht.Views))
+	}
+	if s := "[" + strings.Join(tiles, " ") + "]"; s != want {
+		t.Errorf("got %s, want %s", s, want)
+	}
+
+	// Tile 2/2/3 spans longitudes 0..90 and latitudes -66.51..-85.05.
+	if lat, lng := got[0].Lat, got[0].Lng; lat > -66.51 || lat < -85.06 || lng != 45 {
+		t.Errorf("got lat=%v lng=%v for %s", lat, lng, got[0].Tile)
+	}
+}
+
+func TestCalcPercentiles(t *testing.T) {
+	hist := []Bucket{
+		{Count: 1, Sample: BucketSample{value: 1000}},
+		{Count: 9, Sample: BucketSample{value: 10}},
+		{Count: 90, Sample: BucketSample{value: 0}},
+	}
+	p := calcPercentiles(hist, 100)
+	if len(p) != 101 {
+		t.Fatalf("got %d percentiles, want 101", len(p))
+	}
+	for _, tc := range []struct {
+		p    int
+		want float32
+	}{{0, 0}, {50, 0}, {90, 0}, {91, 10}, {99, 10}, {100, 1000}} {
+		if p[tc.p] != tc.want {
+			t.Errorf("percentile %d: got %v, want %v", tc.p, p[tc.p], tc.want)
+		}
+	}
+}
+
+func TestStatsPercentile(t *testing.T) {
+	hist := []Bucket{
+		{Count: 1, Sample: BucketSample{value: 1000}},
+		{Count: 9, Sample: BucketSample{value: 10}},
+		{Count: 90, Sample: BucketSample{value: 0}},
+	}
+	stats := &Stats{Percentiles: calcPercentiles(hist, 100)}
+	for _, tc := range []struct {
+		value float32
+		want  int
+	}{{-1, 0}, {0, 90}, {5, 90}, {10, 99}, {999, 99}, {1000, 100}, {5000, 100}} {
+		if got := stats.Percentile(tc.value); got != tc.want {
+			t.Errorf("Percentile(%v) = %d, want %d", tc.value, got, tc.want)
+		}
+	}
+}
@@ -5,21 +5,24 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
-	"os"
 	"regexp"
 	"sort"
+	"time"
 
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/objstore"
 )
 
 type ObjectInfo struct {
-	Key         string
-	ContentType string
-	ETag        string
+	Key          string
+	ContentType  string
+	ETag         string
+	Size         int64
+	LastModified time.Time
 }
 
 type Storage interface {
@@ -35,7 +38,7 @@ type Storage interface {
 // to a remote S3-compatible server. The other implementation is FakeStorage,
 // which is used for testing.
 type remoteStorage struct {
-	client *minio.Client
+	client *objstore.Router
 }
 
 func (s *remoteStorage) BucketExists(ctx context.Context, bucket string) (bool, error) {
@@ -46,7 +49,16 @@ func (s *remoteStorage) List(ctx context.Context, bucket, prefix string) ([]Obje
 	opts := minio.ListObjectsOptions{Prefix: prefix, Recursive: true}
 	result := make([]ObjectInfo, 0)
 	for f := range s.client.ListObjects(ctx, bucket, opts) {
-		o := ObjectInfo{Key: f.Key, ContentType: f.ContentType, ETag: f.ETag}
+		if f.Err != nil {
+			return nil, f.Err
+		}
+		o := ObjectInfo{
+			Key:          f.Key,
+			ContentType:  f.ContentType,
+			ETag:         f.ETag,
+			Size:         f.Size,
+			LastModified: f.LastModified,
+		}
 		result = append(result, o)
 	}
 	return result, nil
@@ -57,7 +69,13 @@ func (s *remoteStorage) Stat(ctx context.Context, bucket, path string) (ObjectIn
 	if err != nil {
 		return ObjectInfo{}, err
 	}
-	info := ObjectInfo{Key: st.Key, ContentType: st.ContentType, ETag: st.ETag}
+	info := ObjectInfo{
+		Key:          st.Key,
+		ContentType:  st.ContentType,
+		ETag:         st.ETag,
+		Size:         st.Size,
+		LastModified: st.LastModified,
+	}
 	return info, nil
 }
 
@@ -76,46 +94,66 @@ func (s *remoteStorage) Remove(ctx context.Context, bucket, path string) error {
 }
 
 // NewStorage sets up a client for accessing S3-compatible object storage.
+// See package objstore for the format of the key file.
 func NewStorage(keypath string) (Storage, error) {
-	data, err := os.ReadFile(keypath)
+	config, err := objstore.ReadConfig(keypath)
 	if err != nil {
 		return nil, err
 	}
-
-	var config struct{ Endpoint, Key, Secret string }
-	if err := json.Unmarshal(data, &config); err != nil {
-		return nil, err
-	}
-
-	client, err := minio.New(config.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(config.Key, config.Secret, ""),
-		Secure: true,
-	})
+	client, err := objstore.NewRouter(config, "QRankOSMViewsBuilder")
 	if err != nil {
 		return nil, err
 	}
-
-	client.SetAppInfo("QRankOSMViewsBuilder", "0.1")
+	client.SetLogger(logger)
 	return &remoteStorage{client: client}, nil
 }
 
+// RegisterStorageMetrics exports the statistics about calls to remote
+// storage, so monitoring can see when they start to fail or slow down.
+func registerStorageMetrics(reg prometheus.Registerer, s Storage) {
+	rs, ok := s.(*remoteStorage)
+	if !ok {
+		return
+	}
+	for _, m := range []struct {
+		name, help string
+		value      func(objstore.Stats) int64
+	}{
+		{"osmviews_builder_storage_calls_total", "Number of calls to storage, not counting retries.", func(s objstore.Stats) int64 { return s.Calls }},
+		{"osmviews_builder_storage_retries_total", "Number of retried storage calls.", func(s objstore.Stats) int64 { return s.Retries }},
+		{"osmviews_builder_storage_failures_total", "Number of storage calls that failed after all retries.", func(s objstore.Stats) int64 { return s.Failures }},
+		{"osmviews_builder_storage_slow_calls_total", "Number of storage calls that took unusually long.", func(s objstore.Stats) int64 { return s.SlowCalls }},
+	} {
+		value := m.value
+		reg.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{Name: m.name, Help: m.help}, func() float64 {
+			return float64(value(rs.client.Stats()))
+		}))
+	}
+}
+
 func Cleanup(s Storage) error {
 	for _, p := range []struct {
 		prefix, pattern string
-		keep            int
+		keep, monthly   int
 	}{
-		{"internal/osmviews-builder/tilelogs-", `internal/osmviews-builder/tilelogs-\d{4}-W\d{2}\.br`, 60},
-		{"public/osmviews-", `public/osmviews-\d{8}\.tiff`, 3},
-		{"public/osmviews-stats-", `public/osmviews-stats-\d{8}\.json`, 3},
+		{"internal/osmviews-builder/tilelogs-", `internal/osmviews-builder/tilelogs-\d{4}-W\d{2}\.(br|zst)`, 60, 0},
+		// For the year-over-year change, keep one GeoTIFF per month.
+		{"public/osmviews-", `public/osmviews-(\d{6})\d{2}\.tiff`, 3, 13},
+		{"public/osmviews-stats-", `public/osmviews-stats-\d{8}\.json`, 3, 0},
+		{"public/osmviews-change-", `public/osmviews-change-\d{8}\.tiff`, 3, 0},
 	} {
-		if err := cleanupPath("qrank", p.prefix, p.pattern, p.keep, s); err != nil {
+		if err := cleanupPath("qrank", p.prefix, p.pattern, p.keep, p.monthly, s); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func cleanupPath(bucket, prefix, pattern string, keep int, s Storage) error {
+// CleanupPath deletes old files whose path matches a pattern, keeping
+// the `keep` most recent ones. If monthly is positive, the pattern
+// must capture the month of the file as its first group, and also
+// the oldest file of each of the `monthly` most recent months is kept.
+func cleanupPath(bucket, prefix, pattern string, keep, monthly int, s Storage) error {
 	ctx := context.Background()
 	re := regexp.MustCompile(pattern)
 
@@ -132,7 +170,11 @@ func cleanupPath(bucket, prefix, pattern string, keep int, s Storage) error {
 
 	if len(found) > keep {
 		sort.Strings(found)
+		anchors := monthlyAnchors(found, re, monthly)
 		for _, path := range found[0 : len(found)-keep] {
+			if anchors[path] {
+				continue
+			}
 			msg := fmt.Sprintf("Deleting from storage: %s/%s", bucket, path)
 			fmt.Println(msg)
 			if logger != nil {
@@ -146,3 +188,29 @@ func cleanupPath(bucket, prefix, pattern string, keep int, s Storage) error {
 
 	return nil
 }
+
+// MonthlyAnchors returns the first of the sorted paths in each of the
+// last `monthly` months, where the month is the first group captured
+// by re.
+func monthlyAnchors(paths []string, re *regexp.Regexp, monthly int) map[string]bool {
+	anchors := make(map[string]bool, monthly)
+	if monthly <= 0 {
+		return anchors
+	}
+	months := make([]string, 0, monthly)
+	first := make(map[string]string, monthly)
+	for _, path := range paths {
+		m := re.FindStringSubmatch(path)
+		if len(m) < 2 {
+			continue
+		}
+		if _, seen := first[m[1]]; !seen {
+			first[m[1]] = path
+			months = append(months, m[1])
+		}
+	}
+	for _, month := range months[max(0, len(months)-monthly):] {
+		anchors[first[month]] = true
+	}
+	return anchors
+}
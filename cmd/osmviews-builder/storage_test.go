@@ -8,13 +8,17 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestCleanup(t *testing.T) {
@@ -39,6 +43,7 @@ func TestCleanup(t *testing.T) {
 		for _, p := range []struct{ pattern, contentType string }{
 			{"public/osmviews-%s.tiff", "image/tiff"},
 			{"public/osmviews-stats-%s.json", "application/json"},
+			{"public/osmviews-change-%s.tiff", "image/tiff"},
 		} {
 			path := fmt.Sprintf(p.pattern, date)
 			if err := s.PutFile(ctx, "qrank", path, localpath, p.contentType); err != nil {
@@ -62,7 +67,7 @@ func TestCleanup(t *testing.T) {
 	}
 
 	got := make([]string, 0)
-	files, err := s.List(ctx, "qrank", "public/")
+	files, err := s.List(ctx, "qrank", "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -133,9 +138,13 @@ func TestCleanup(t *testing.T) {
 		"internal/osmviews-builder/tilelogs-2022-W39.br",
 		"internal/osmviews-builder/tilelogs-2022-W40.br",
 		"internal/otherproject’s_data_should/not/be/touched.txt",
+		"public/osmviews-20211205.tiff", // kept for year-over-year change
 		"public/osmviews-20211226.tiff",
 		"public/osmviews-20220102.tiff",
 		"public/osmviews-20220109.tiff",
+		"public/osmviews-change-20211226.tiff",
+		"public/osmviews-change-20220102.tiff",
+		"public/osmviews-change-20220109.tiff",
 		"public/osmviews-not-matching-pattern.txt",
 		"public/osmviews-stats-20211226.json",
 		"public/osmviews-stats-20220102.json",
@@ -147,13 +156,65 @@ func TestCleanup(t *testing.T) {
 	}
 }
 
+func TestMonthlyAnchors(t *testing.T) {
+	re := regexp.MustCompile(`osmviews-(\d{6})\d{2}\.tiff`)
+	paths := []string{
+		"osmviews-20230108.tiff",
+		"osmviews-20230115.tiff",
+		"osmviews-20230205.tiff",
+		"osmviews-20230212.tiff",
+		"osmviews-20230305.tiff",
+	}
+	got := monthlyAnchors(paths, re, 2)
+	want := map[string]bool{"osmviews-20230205.tiff": true, "osmviews-20230305.tiff": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := monthlyAnchors(paths, re, 0); len(got) != 0 {
+		t.Errorf("monthly=0: got %v, want no anchors", got)
+	}
+}
+
 type FakeStorageObject struct {
 	Content []byte
 	Info    ObjectInfo
 }
 
+// FakeStorage is an in-memory implementation of interface Storage,
+// for testing. It can simulate transient failures and slow reads.
 type FakeStorage struct {
 	Files map[string]*FakeStorageObject
+
+	// ReadDelay, if set, slows down every call to Get.
+	ReadDelay time.Duration
+
+	failures map[string]int
+	clock    time.Time
+}
+
+func NewFakeStorage() *FakeStorage {
+	return &FakeStorage{
+		Files:    make(map[string]*FakeStorageObject),
+		failures: make(map[string]int),
+		clock:    time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+// FailNext makes the next n calls of an operation on a path fail
+// with a transient error. The operation is the name of a Storage
+// method such as "Get"; for "List", the path is the listing prefix.
+func (s *FakeStorage) FailNext(op string, path string, n int) {
+	s.failures[op+" "+path] += n
+}
+
+// Fail returns an error if an operation on a path should fail.
+func (s *FakeStorage) fail(op string, path string) error {
+	k := op + " " + path
+	if s.failures[k] <= 0 {
+		return nil
+	}
+	s.failures[k] -= 1
+	return fmt.Errorf("%s %s: 503 Service Unavailable", op, path)
 }
 
 func (s *FakeStorage) BucketExists(ctx context.Context, bucket string) (bool, error) {
@@ -161,17 +222,26 @@ func (s *FakeStorage) BucketExists(ctx context.Context, bucket string) (bool, er
 }
 
 func (s *FakeStorage) PutFile(ctx context.Context, bucket string, remotepath string, localpath string, contentType string) error {
+	if err := s.fail("PutFile", remotepath); err != nil {
+		return err
+	}
+
 	content, err := os.ReadFile(localpath)
 	if err != nil {
 		return err
 	}
 
+	// Each write advances a fake clock by one second, so that
+	// modification times are distinct and deterministic.
+	s.clock = s.clock.Add(time.Second)
 	digest := md5.Sum(content)
 	etag := base64.RawStdEncoding.EncodeToString(digest[0:len(digest)])
 	info := ObjectInfo{
-		Key:         remotepath,
-		ContentType: contentType,
-		ETag:        etag,
+		Key:          remotepath,
+		ContentType:  contentType,
+		ETag:         etag,
+		Size:         int64(len(content)),
+		LastModified: s.clock,
 	}
 
 	s.Files[remotepath] = &FakeStorageObject{content, info}
@@ -179,6 +249,18 @@ func (s *FakeStorage) PutFile(ctx context.Context, bucket string, remotepath str
 }
 
 func (s *FakeStorage) Get(ctx context.Context, bucket, path string) (io.Reader, error) {
+	if err := s.fail("Get", path); err != nil {
+		return nil, err
+	}
+
+	if s.ReadDelay > 0 {
+		select {
+		case <-time.After(s.ReadDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
 	f, present := s.Files[path]
 	if !present {
 		return nil, fmt.Errorf("file not found: %s", path)
@@ -186,20 +268,39 @@ func (s *FakeStorage) Get(ctx context.Context, bucket, path string) (io.Reader,
 	return bytes.NewReader(f.Content), nil
 }
 
+// List returns the objects whose path starts with a prefix,
+// sorted by path.
 func (s *FakeStorage) List(ctx context.Context, bucket, prefix string) ([]ObjectInfo, error) {
+	if err := s.fail("List", prefix); err != nil {
+		return nil, err
+	}
+
 	result := make([]ObjectInfo, 0, len(s.Files))
-	for _, f := range s.Files {
-		result = append(result, f.Info)
+	for path, f := range s.Files {
+		if strings.HasPrefix(path, prefix) {
+			result = append(result, f.Info)
+		}
 	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
 	return result, nil
 }
 
 func (s *FakeStorage) Remove(ctx context.Context, bucketName, path string) error {
+	if err := s.fail("Remove", path); err != nil {
+		return err
+	}
+
 	delete(s.Files, path)
 	return nil
 }
 
 func (s *FakeStorage) Stat(ctx context.Context, bucket string, path string) (ObjectInfo, error) {
+	if err := s.fail("Stat", path); err != nil {
+		return ObjectInfo{}, err
+	}
+
 	if f, present := s.Files[path]; present {
 		return f.Info, nil
 	} else {
@@ -207,6 +308,47 @@ func (s *FakeStorage) Stat(ctx context.Context, bucket string, path string) (Obj
 	}
 }
 
-func NewFakeStorage() *FakeStorage {
-	return &FakeStorage{Files: make(map[string]*FakeStorageObject)}
+func TestFakeStorage(t *testing.T) {
+	ctx := context.Background()
+	localpath := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(localpath, []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewFakeStorage()
+	for _, path := range []string{"b/2", "a/1", "b/1"} {
+		if err := s.PutFile(ctx, "qrank", path, localpath, "text/plain"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := s.List(ctx, "qrank", "b/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Key != "b/1" || files[1].Key != "b/2" {
+		t.Fatalf("got %v, want b/1 and b/2", files)
+	}
+	if files[0].Size != 3 {
+		t.Errorf("got size %d, want 3", files[0].Size)
+	}
+	if !files[1].LastModified.Before(files[0].LastModified) {
+		t.Errorf("b/2 was written before b/1, but got LastModified %v and %v",
+			files[1].LastModified, files[0].LastModified)
+	}
+
+	s.FailNext("Get", "a/1", 1)
+	if _, err := s.Get(ctx, "qrank", "a/1"); err == nil {
+		t.Error("first Get should have failed")
+	}
+	if _, err := s.Get(ctx, "qrank", "a/1"); err != nil {
+		t.Errorf("second Get should have succeeded, got %v", err)
+	}
+
+	s.ReadDelay = time.Hour
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.Get(timeoutCtx, "qrank", "a/1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
 }
@@ -4,105 +4,54 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
-	"runtime"
-	"sort"
 	"strconv"
-	"strings"
 	"time"
 
-	"github.com/andybalholm/brotli"
 	"github.com/lanrat/extsort"
-	"github.com/ulikunitz/xz"
-	"golang.org/x/sync/errgroup"
-)
 
-// Return a list of weeks for which OpenStreetMap has tile logs.
-// Weeks are returned in ISO 8601 format such as "2021-W07".
-// The result is sorted from least to most recent week.
-// We return only those weeks where OpenStreetMap has tile logs
-// for all seven days.
-func GetAvailableWeeks(client *http.Client) ([]string, error) {
-	url := "https://planet.openstreetmap.org/tile_logs/"
-	r, err := client.Get(url)
-	if err != nil {
-		return nil, err
-	}
-
-	// Only accept HTTP responses with status code 200 OK
-	// and when the Content-Type header is HTML.
-	contentType := r.Header.Get("Content-Type")
-	if strings.ContainsRune(contentType, ';') { // text/html;charset=UTF-8
-		contentType = strings.Split(contentType, ";")[0]
-	}
-	if r.StatusCode != 200 || contentType != "text/html" {
-		return nil, fmt.Errorf("failed to fetch %s, StatusCode=%d Content-Type=%s", url, r.StatusCode, contentType)
-	}
-
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	// Find out what weeks are available. For each week, we keep a bitmask
-	// that tells for which days of that week the OSM Planet server
-	// has log files available. For example, if this map contains
-	// the entry 202107 → 5 (in binary: 0000101), the server has log files
-	// for Tuesday (0000100) and Sunday (0000001) for the 7th week of 2021.
-	// That is, Tuesday, February 16, and Sunday, February 21.
-	re := regexp.MustCompile(`<a href="tiles-(\d{4}-\d\d-\d\d)\.txt\.xz">`)
-	available := make(map[int]int8) // (year*100+isoweek) → 7 bits
-	for _, m := range re.FindAllSubmatch(body, -1) {
-		if t, err := time.Parse("2006-01-02", string(m[1])); err == nil {
-			year, week := t.ISOWeek()
-			available[year*100+week] |= 1 << int8(t.Weekday())
-		}
-	}
-
-	// To our callers, we return weeks in ISO 8601 format, eg. "2021-W07".
-	result := make([]string, 0, len(available))
-	for week, days := range available {
-		if days == 127 { // server has logs for all seven days of this week
-			isoWeekString := fmt.Sprintf("%04d-W%02d", week/100, week%100)
-			result = append(result, isoWeekString)
-		}
-	}
-	sort.Strings(result)
-	return result, nil
-}
-
-var tileLogRegexp = regexp.MustCompile(`^(\d+)/(\d+)/(\d+)\s+(\d+)$`)
+	"github.com/brawer/wikidata-qrank/v2/internal/compress"
+	"github.com/brawer/wikidata-qrank/v2/pkg/osmviews"
+)
 
 // GetTileLogs returns an io.Reader for the sorted log records of a week.
 // If cachedir contains already contains cached records for the requested week,
 // the data will be read from local disk. Otherwise, the seven daily log files
-// for the requested week are fetched from the OpenStreetMap planet server,
-// uncompressed, sorted by TileKey, and stored as a compressed file into
-// cachedir.
-func GetTileLogs(week string, client *http.Client, workdir string, storage Storage) (io.Reader, error) {
+// for the requested week are fetched from the source, uncompressed, sorted
+// by TileKey, and stored as a compressed file into cachedir.
+//
+// New caches get compressed with zstd. Older versions of this tool
+// used brotli, which is much slower to compress; such caches still
+// get read if there is no zstd cache for the week.
+func GetTileLogs(week string, source TileLogSource, workdir string, storage Storage) (io.Reader, error) {
 	ctx := context.Background()
 
-	remotePath := fmt.Sprintf("internal/osmviews-builder/tilelogs-%s.br", week)
-	if storage != nil {
-		if _, err := storage.Stat(ctx, "qrank", remotePath); err == nil {
-			if r, err := storage.Get(ctx, "qrank", remotePath); err == nil {
-				return brotli.NewReader(r), nil
+	for _, codec := range []compress.Codec{cacheCodec, compress.Brotli} {
+		fileName := tileLogsFileName(source, week, codec)
+		remotePath := "internal/osmviews-builder/" + fileName
+		if storage != nil {
+			if _, err := storage.Stat(ctx, "qrank", remotePath); err == nil {
+				if r, err := storage.Get(ctx, "qrank", remotePath); err == nil {
+					return compress.NewReaderForName(fileName, r)
+				}
 			}
 		}
-	}
 
-	path := filepath.Join(workdir, fmt.Sprintf("tilelogs-%s.br", week))
-	if f, err := os.Open(path); err == nil {
-		return brotli.NewReader(f), nil
+		path := filepath.Join(workdir, fileName)
+		if f, err := os.Open(path); err == nil {
+			return compress.NewReaderForName(fileName, f)
+		}
 	}
 
+	fileName := tileLogsFileName(source, week, cacheCodec)
+	remotePath := "internal/osmviews-builder/" + fileName
+	path := filepath.Join(workdir, fileName)
+
 	if logger != nil {
 		logger.Printf("building %s", path)
 	}
@@ -111,22 +60,6 @@ func GetTileLogs(week string, client *http.Client, workdir string, storage Stora
 		return nil, err
 	}
 
-	ch := make(chan extsort.SortType, 100000)
-	g, subCtx := errgroup.WithContext(ctx)
-	config := extsort.DefaultConfig()
-	config.NumWorkers = runtime.NumCPU()
-	sorter, outChan, errChan := extsort.New(ch, TileCountFromBytes, TileCountLess, config)
-	g.Go(func() error {
-		return fetchWeeklyTileLogs(week, client, ch, subCtx)
-	})
-	g.Go(func() error {
-		sorter.Sort(ctx) // not subCtx, as per extsort docs
-		return nil
-	})
-	if err := g.Wait(); err != nil {
-		return nil, err
-	}
-
 	// We write to a temporary file first, and rename it atomically
 	// once it is finished in usable state. This prevents hiccups
 	// in case the process crashes (or the machine dies) while the
@@ -137,29 +70,16 @@ func GetTileLogs(week string, client *http.Client, workdir string, storage Stora
 		return nil, err
 	}
 	defer tmpfile.Close()
-	writer := brotli.NewWriterLevel(tmpfile, 9)
+	writer, err := compress.NewWriter(tmpfile, cacheCodec, compress.BestLevel)
+	if err != nil {
+		return nil, err
+	}
 	defer writer.Close()
 
-	var last TileCount
-	for data := range outChan {
-		cur := data.(TileCount)
-		if cur.Key != last.Key {
-			if last.Count > 0 {
-				zoom, x, y := last.Key.ZoomXY()
-				fmt.Fprintf(writer, "%d/%d/%d %d\n", zoom, x, y, last.Count)
-			}
-			last = cur
-		} else {
-			last.Count += cur.Count
-		}
-	}
-	if last.Count > 0 {
-		zoom, x, y := last.Key.ZoomXY()
-		fmt.Fprintf(writer, "%d/%d/%d %d\n", zoom, x, y, last.Count)
+	feed := func(ctx context.Context, ch chan<- extsort.SortType) error {
+		return fetchWeeklyTileLogs(week, source, ch, ctx)
 	}
-
-	// Check for errors from the external sorting library.
-	if err := <-errChan; err != nil {
+	if err := osmviews.AggregateTileCounts(ctx, feed, writer); err != nil {
 		return nil, err
 	}
 
@@ -181,7 +101,7 @@ func GetTileLogs(week string, client *http.Client, workdir string, storage Stora
 
 	// Upload the file to object storage and return a reader for it.
 	if storage != nil {
-		contentType := "application/x-brotli"
+		contentType := cacheCodec.ContentType()
 		if err := storage.PutFile(ctx, "qrank", remotePath, path, contentType); err != nil {
 			return nil, err
 		}
@@ -191,21 +111,33 @@ func GetTileLogs(week string, client *http.Client, workdir string, storage Stora
 		}
 
 		if r, err := storage.Get(ctx, "qrank", remotePath); err == nil {
-			return brotli.NewReader(r), nil
+			return compress.NewReaderForName(fileName, r)
 		}
 	}
 
 	// Open the file for reading and return a reader for it.
 	if f, err := os.Open(path); err == nil {
-		return brotli.NewReader(f), nil
+		return compress.NewReaderForName(fileName, f)
 	} else {
 		return nil, err
 	}
 }
 
-func fetchWeeklyTileLogs(week string, client *http.Client, ch chan<- extsort.SortType, ctx context.Context) error {
-	defer close(ch)
+// CacheCodec is the compression format for newly built caches.
+const cacheCodec = compress.Zstd
+
+// TileLogsFileName returns the name of the file for caching the sorted
+// tile logs of a week, compressed with codec. For planet.openstreetmap.org,
+// the name does not contain the source name, so that our existing caches
+// stay valid.
+func tileLogsFileName(source TileLogSource, week string, codec compress.Codec) string {
+	if name := source.Name(); name != "osm" {
+		return fmt.Sprintf("tilelogs-%s-%s%s", name, week, codec.Ext())
+	}
+	return fmt.Sprintf("tilelogs-%s%s", week, codec.Ext())
+}
 
+func fetchWeeklyTileLogs(week string, source TileLogSource, ch chan<- extsort.SortType, ctx context.Context) error {
 	// Fetch the tile logs for the seven days in this week, in parallel.
 	parsedYear, parsedWeek, err := ParseWeek(week)
 	if err != nil {
@@ -217,7 +149,7 @@ func fetchWeeklyTileLogs(week string, client *http.Client, ch chan<- extsort.Sor
 	firstDay := weekStart(parsedYear, parsedWeek)
 	for i := 0; i < 7; i++ {
 		day := firstDay.AddDate(0, 0, i)
-		if err := fetchTileLogs(day, client, ch, ctx); err != nil {
+		if err := fetchTileLogs(day, source, ch, ctx); err != nil {
 			return err
 		}
 	}
@@ -225,39 +157,14 @@ func fetchWeeklyTileLogs(week string, client *http.Client, ch chan<- extsort.Sor
 	return nil
 }
 
-func fetchTileLogs(day time.Time, client *http.Client, ch chan<- extsort.SortType, ctx context.Context) error {
-	url := fmt.Sprintf(
-		"https://planet.openstreetmap.org/tile_logs/tiles-%04d-%02d-%02d.txt.xz",
-		day.Year(), day.Month(), day.Day())
-	r, err := client.Get(url)
+func fetchTileLogs(day time.Time, source TileLogSource, ch chan<- extsort.SortType, ctx context.Context) error {
+	reader, err := source.FetchDay(ctx, day)
 	if err != nil {
 		return err
 	}
+	defer reader.Close()
 
-	reader, err := xz.NewReader(r.Body)
-	if err != nil {
-		return err
-	}
-
-	scanner := bufio.NewScanner(reader)
-	for scanner.Scan() {
-		// Check if our task has been canceled. Typically this can happen
-		// because of an error in another goroutine in the same x.sync.errroup.
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
-
-		if tc := ParseTileCount(scanner.Text()); tc.Count > 0 {
-			ch <- tc
-		}
-	}
-	if err := scanner.Err(); err != nil {
-		return err
-	}
-
-	return nil
+	return osmviews.ReadTileCounts(ctx, reader, ch)
 }
 
 // Reverse of Go’s time.ISOWeek() function.
@@ -11,8 +11,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/compress"
 )
 
 // A fake HTTP transport that answers the same requests as planet.osm.org.
@@ -56,7 +59,8 @@ func (f *FakeOSMPlanet) RoundTrip(req *http.Request) (*http.Response, error) {
 
 func TestGetAvailableWeeks(t *testing.T) {
 	client := &http.Client{Transport: &FakeOSMPlanet{}}
-	weeks, err := GetAvailableWeeks(client)
+	source := NewOSMPlanetSource(newTestFetcher(client))
+	weeks, err := source.ListWeeks(context.Background())
 	if err != nil {
 		t.Error(err)
 		return
@@ -66,11 +70,18 @@ func TestGetAvailableWeeks(t *testing.T) {
 	if got != "[2021-W52 2022-W01]" {
 		t.Errorf("expected [2021-W52 2022-W01], got %s", got)
 	}
+
+	// Published sizes, for verifying downloads.
+	for day, want := range map[string]string{"2022-01-15": "672", "2022-01-13": "1.0M"} {
+		if got := source.sizes[day]; got != want {
+			t.Errorf("got size %q for %s, want %q", got, day, want)
+		}
+	}
 }
 
 func TestGetAvailableWeeksServerError(t *testing.T) {
 	client := &http.Client{Transport: &FakeOSMPlanet{Broken: true}}
-	_, err := GetAvailableWeeks(client)
+	_, err := NewOSMPlanetSource(newTestFetcher(client)).ListWeeks(context.Background())
 	if !strings.HasPrefix(err.Error(), "failed to fetch") {
 		t.Errorf("expected fetch failure, got %v", err)
 	}
@@ -84,7 +95,7 @@ func TestGetTileLogs(t *testing.T) {
 		return
 	}
 	s := NewFakeStorage()
-	reader, err := GetTileLogs("2567-W12", client, cachedir, s)
+	reader, err := GetTileLogs("2567-W12", NewOSMPlanetSource(newTestFetcher(client)), cachedir, s)
 	if err != nil {
 		t.Error(err)
 		return
@@ -193,13 +204,13 @@ func TestGetTileLogs(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	remotePath := "internal/osmviews-builder/tilelogs-2567-W12.br"
+	remotePath := "internal/osmviews-builder/tilelogs-2567-W12.zst"
 	stat, err := s.Stat(ctx, "qrank", remotePath)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if want := "application/x-brotli"; stat.ContentType != want {
+	if want := "application/zstd"; stat.ContentType != want {
 		t.Errorf(`got "%s", want "%s"`, stat.ContentType, want)
 	}
 }
@@ -210,7 +221,7 @@ func TestGetTileLogsCached(t *testing.T) {
 	if err := s.PutFile(ctx, "qrank", "internal/osmviews-builder/tilelogs-2042-W08.br", "testdata/tilelogs-2042-W08.br", "application/x-brotli"); err != nil {
 		t.Fatal(err)
 	}
-	reader, err := GetTileLogs("2042-W08", nil, "", s)
+	reader, err := GetTileLogs("2042-W08", NewOSMPlanetSource(nil), "", s)
 	if err != nil {
 		t.Error(err)
 		return
@@ -222,6 +233,42 @@ func TestGetTileLogsCached(t *testing.T) {
 	}
 }
 
+// If storage has caches in both formats, the zstd one wins.
+func TestGetTileLogsCached_Zstd(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tilelogs-2042-W08.zst")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := compress.NewWriter(file, compress.Zstd, compress.FastestLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("Hello zstd"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewFakeStorage()
+	if err := s.PutFile(ctx, "qrank", "internal/osmviews-builder/tilelogs-2042-W08.br", "testdata/tilelogs-2042-W08.br", "application/x-brotli"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutFile(ctx, "qrank", "internal/osmviews-builder/tilelogs-2042-W08.zst", path, "application/zstd"); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := GetTileLogs("2042-W08", NewOSMPlanetSource(nil), "", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readStream(reader); got != "Hello zstd" {
+		t.Errorf(`expected "Hello zstd", got "%s"`, got)
+	}
+}
+
 // Read an io.Stream into a string. Helper for testing.
 func readStream(r io.Reader) string {
 	buf, err := io.ReadAll(r)
@@ -0,0 +1,284 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/compress"
+)
+
+// TileLogSource is a place from where we can fetch tile logs.
+//
+// A daily tile log has one line per map tile, in the format of
+// planet.openstreetmap.org, for example "18/137341/91897 42"
+// when the tile 18/137341/91897 was viewed 42 times that day.
+// Organizations that run their own tile servers can produce
+// such logs, and then build OSMViews-style rasters for their users.
+type TileLogSource interface {
+	// Name identifies the source in the names of cached files,
+	// so data from different sources does not get mixed up.
+	Name() string
+
+	// ListWeeks returns the weeks for which the source has tile logs
+	// for all seven days. Weeks are returned in ISO 8601 format,
+	// such as "2021-W07", sorted from least to most recent week.
+	ListWeeks(ctx context.Context) ([]string, error)
+
+	// FetchDay returns the uncompressed tile log for one day.
+	// The caller must close the returned reader.
+	FetchDay(ctx context.Context, day time.Time) (io.ReadCloser, error)
+}
+
+// NewTileLogSource returns a TileLogSource for a specification given
+// on the command line. The empty string stands for the tile logs
+// of OpenStreetMap. Anything else is a template for the location of
+// daily log files, either a local path or a http(s) URL, where {date}
+// stands for the day in YYYY-MM-DD format. For example, the template
+// "/var/log/tiles/{date}.txt.gz" would find /var/log/tiles/2024-05-01.txt.gz
+// for May 1, 2024.
+func NewTileLogSource(spec string, fetcher *Fetcher) (TileLogSource, error) {
+	if spec == "" {
+		return NewOSMPlanetSource(fetcher), nil
+	}
+	return NewTemplateSource(spec, fetcher)
+}
+
+// OSMPlanetSource fetches tile logs from planet.openstreetmap.org.
+type OSMPlanetSource struct {
+	fetcher *Fetcher
+	baseURL string
+
+	// If true, downloaded files get checked against the sizes
+	// in the directory listing of planet.openstreetmap.org.
+	VerifySizes bool
+	sizes       map[string]string // "2022-01-15" → "1.0M"
+}
+
+// NewOSMPlanetSource returns a TileLogSource for the tile logs
+// of the OpenStreetMap Foundation’s tile servers.
+func NewOSMPlanetSource(fetcher *Fetcher) *OSMPlanetSource {
+	return &OSMPlanetSource{
+		fetcher:     fetcher,
+		baseURL:     "https://planet.openstreetmap.org/tile_logs/",
+		VerifySizes: true,
+	}
+}
+
+// Name returns "osm". Cached files for this source have no name in them,
+// because they were created before we supported other sources.
+func (s *OSMPlanetSource) Name() string {
+	return "osm"
+}
+
+func (s *OSMPlanetSource) ListWeeks(ctx context.Context) ([]string, error) {
+	body, err := fetchHTML(ctx, s.fetcher, s.baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// <a href="tiles-2022-01-15.txt.xz">tiles-2022-01-15.txt.xz</a> 2022-01-16 21:17  1.0M
+	re := regexp.MustCompile(`<a href="tiles-(\d{4}-\d\d-\d\d)\.txt\.xz">[^<]*</a>(?:\s+\S+\s+\S+\s+(\d+(?:\.\d)?[KMGT]?)\b)?`)
+	days := make([]time.Time, 0, 1000)
+	s.sizes = make(map[string]string, 1000)
+	for _, m := range re.FindAllSubmatch(body, -1) {
+		if t, err := time.Parse("2006-01-02", string(m[1])); err == nil {
+			days = append(days, t)
+			if len(m[2]) > 0 {
+				s.sizes[string(m[1])] = string(m[2])
+			}
+		}
+	}
+	return completeWeeks(days), nil
+}
+
+func (s *OSMPlanetSource) FetchDay(ctx context.Context, day time.Time) (io.ReadCloser, error) {
+	date := day.Format("2006-01-02")
+	u := fmt.Sprintf("%stiles-%s.txt.xz", s.baseURL, date)
+	var size string
+	if s.VerifySizes {
+		size = s.sizes[date]
+	}
+	return fetchURL(ctx, s.fetcher, u, size)
+}
+
+// TemplateSource fetches tile logs from a local directory or web server,
+// given a template for the path or URL of the daily log files.
+// Log files may be uncompressed, or compressed with xz, gzip, brotli
+// or zstd, as indicated by their file extension.
+type TemplateSource struct {
+	fetcher  *Fetcher
+	template string
+	pattern  *regexp.Regexp // matches file names in directory listing
+}
+
+// NewTemplateSource returns a TileLogSource for daily log files
+// at a path or URL, where {date} stands for the day in YYYY-MM-DD format.
+func NewTemplateSource(template string, fetcher *Fetcher) (*TemplateSource, error) {
+	dir, file := splitTemplate(template)
+	if strings.Count(template, "{date}") != 1 || !strings.Contains(file, "{date}") || strings.Contains(dir, "{date}") {
+		return nil, fmt.Errorf("tile log template %q must contain {date} exactly once, in its file name", template)
+	}
+
+	parts := strings.Split(file, "{date}")
+	pattern := regexp.MustCompile(fmt.Sprintf(
+		"^%s(\\d{4}-\\d\\d-\\d\\d)%s$",
+		regexp.QuoteMeta(parts[0]), regexp.QuoteMeta(parts[1])))
+	return &TemplateSource{fetcher: fetcher, template: template, pattern: pattern}, nil
+}
+
+// Name returns a short name that is derived from the template,
+// such as "tiles.example.org" for a template on that web server.
+func (s *TemplateSource) Name() string {
+	if s.isURL() {
+		if u, err := url.Parse(s.template); err == nil && u.Host != "" {
+			return u.Host
+		}
+	}
+	dir, _ := splitTemplate(s.template)
+	return filepath.Base(dir)
+}
+
+func (s *TemplateSource) ListWeeks(ctx context.Context) ([]string, error) {
+	dir, _ := splitTemplate(s.template)
+	var names []string
+	if s.isURL() {
+		body, err := fetchHTML(ctx, s.fetcher, dir+"/")
+		if err != nil {
+			return nil, err
+		}
+		re := regexp.MustCompile(`href="([^"/]+)"`)
+		for _, m := range re.FindAllSubmatch(body, -1) {
+			names = append(names, string(m[1]))
+		}
+	} else {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+	}
+
+	days := make([]time.Time, 0, len(names))
+	for _, name := range names {
+		if m := s.pattern.FindStringSubmatch(name); m != nil {
+			if t, err := time.Parse("2006-01-02", m[1]); err == nil {
+				days = append(days, t)
+			}
+		}
+	}
+	return completeWeeks(days), nil
+}
+
+func (s *TemplateSource) FetchDay(ctx context.Context, day time.Time) (io.ReadCloser, error) {
+	loc := strings.Replace(s.template, "{date}", day.Format("2006-01-02"), 1)
+	if s.isURL() {
+		return fetchURL(ctx, s.fetcher, loc, "")
+	}
+
+	f, err := os.Open(loc)
+	if err != nil {
+		return nil, err
+	}
+	r, err := decompress(loc, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (s *TemplateSource) isURL() bool {
+	return strings.HasPrefix(s.template, "http://") || strings.HasPrefix(s.template, "https://")
+}
+
+// SplitTemplate splits a template into its directory and file name.
+func splitTemplate(template string) (dir, file string) {
+	if strings.HasPrefix(template, "http://") || strings.HasPrefix(template, "https://") {
+		i := strings.LastIndexByte(template, '/')
+		return template[:i], template[i+1:]
+	}
+	return filepath.Dir(template), filepath.Base(template)
+}
+
+// CompleteWeeks returns the ISO weeks for which all seven days
+// are in the given list of days, such as "2021-W07".
+func completeWeeks(days []time.Time) []string {
+	// For each week, we keep a bitmask that tells for which days
+	// of that week we have log files. For example, if this map contains
+	// the entry 202107 → 5 (in binary: 0000101), we have log files
+	// for Tuesday (0000100) and Sunday (0000001) for the 7th week of 2021.
+	// That is, Tuesday, February 16, and Sunday, February 21.
+	available := make(map[int]int8) // (year*100+isoweek) → 7 bits
+	for _, t := range days {
+		year, week := t.ISOWeek()
+		available[year*100+week] |= 1 << int8(t.Weekday())
+	}
+
+	result := make([]string, 0, len(available))
+	for week, days := range available {
+		if days == 127 { // logs available for all seven days of this week
+			isoWeekString := fmt.Sprintf("%04d-W%02d", week/100, week%100)
+			result = append(result, isoWeekString)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// FetchHTML fetches a directory listing from a web server.
+// We only accept HTTP responses with status code 200 OK
+// and when the Content-Type header is HTML.
+func fetchHTML(ctx context.Context, fetcher *Fetcher, u string) ([]byte, error) {
+	d, err := fetcher.Fetch(ctx, u, "")
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	contentType := d.Header.Get("Content-Type")
+	if strings.ContainsRune(contentType, ';') { // text/html;charset=UTF-8
+		contentType = strings.Split(contentType, ";")[0]
+	}
+	if contentType != "text/html" {
+		return nil, fmt.Errorf("failed to fetch %s, Content-Type=%s", u, contentType)
+	}
+
+	return io.ReadAll(d)
+}
+
+// FetchURL fetches a log file from a web server, and returns
+// a reader for its decompressed content. If publishedSize is not
+// empty, the download gets verified against it; see Fetcher.Fetch.
+func fetchURL(ctx context.Context, fetcher *Fetcher, u string, publishedSize string) (io.ReadCloser, error) {
+	d, err := fetcher.Fetch(ctx, u, publishedSize)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := decompress(u, d)
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// Decompress wraps a reader for decompressing its content,
+// depending on the file extension of name. Closing the returned
+// reader also closes the underlying one.
+func decompress(name string, r io.ReadCloser) (io.ReadCloser, error) {
+	return compress.NewReaderForName(name, r)
+}
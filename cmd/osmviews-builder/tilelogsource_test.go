@@ -0,0 +1,183 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/compress"
+)
+
+func TestTemplateSource_Dir(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// Complete week 2024-W18 (April 29 to May 5) in gzip format,
+	// plus an incomplete week 2024-W19 and some unrelated file.
+	day := time.Date(2024, 4, 29, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 8; i++ {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		fmt.Fprintf(w, "18/137341/91897 %d\n", i+1)
+		w.Close()
+		name := fmt.Sprintf("tiles-%s.txt.gz", day.AddDate(0, 0, i).Format("2006-01-02"))
+		if err := os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := NewTileLogSource(filepath.Join(dir, "tiles-{date}.txt.gz"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := source.Name(), filepath.Base(dir); got != want {
+		t.Errorf("got Name() %q, want %q", got, want)
+	}
+
+	weeks, err := source.ListWeeks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(weeks), "[2024-W18]"; got != want {
+		t.Errorf("got weeks %s, want %s", got, want)
+	}
+
+	r, err := source.FetchDay(ctx, day.AddDate(0, 0, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got, want := readStream(r), "18/137341/91897 3\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, err := source.FetchDay(ctx, day.AddDate(0, 0, 20)); err == nil {
+		t.Error("expected error for missing day")
+	}
+}
+
+func TestTemplateSource_URL(t *testing.T) {
+	ctx := context.Background()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/logs/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/logs/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		for i := 1; i <= 7; i++ {
+			fmt.Fprintf(w, `<a href="2024-01-%02d.log">2024-01-%02d.log</a>`, i, i)
+		}
+		fmt.Fprint(w, `<a href="../">..</a><a href="2024-01-08.log.bak">x</a>`)
+	})
+	mux.HandleFunc("/logs/2024-01-03.log", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "0/0/0 7\n")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	source, err := NewTileLogSource(server.URL+"/logs/{date}.log", newTestFetcher(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	weeks, err := source.ListWeeks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(weeks), "[2024-W01]"; got != want {
+		t.Errorf("got weeks %s, want %s", got, want)
+	}
+
+	r, err := source.FetchDay(ctx, time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got, want := readStream(r), "0/0/0 7\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, err := source.FetchDay(ctx, time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("expected error for HTTP status 404")
+	}
+}
+
+func TestNewTemplateSource_BadTemplate(t *testing.T) {
+	for _, s := range []string{"/var/log/tiles.txt", "/var/{date}/tiles.txt", "/var/{date}-{date}.txt"} {
+		if _, err := NewTemplateSource(s, nil); err == nil {
+			t.Errorf("NewTemplateSource(%q) should fail", s)
+		}
+	}
+}
+
+func TestTemplateSource_Name(t *testing.T) {
+	for _, tc := range []struct{ template, want string }{
+		{"https://tiles.example.org/logs/{date}.txt.xz", "tiles.example.org"},
+		{"/var/log/mytiles/{date}.txt", "mytiles"},
+	} {
+		s, err := NewTemplateSource(tc.template, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Name(); got != tc.want {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestTileLogsFileName(t *testing.T) {
+	osm := NewOSMPlanetSource(nil)
+	if got, want := tileLogsFileName(osm, "2024-W18", compress.Zstd), "tilelogs-2024-W18.zst"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	other, _ := NewTemplateSource("https://tiles.example.org/{date}.txt", nil)
+	if got, want := tileLogsFileName(other, "2024-W18", compress.Brotli), "tilelogs-tiles.example.org-2024-W18.br"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("Hello"))
+	w.Close()
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"foo.txt", []byte("Hello")},
+		{"foo.txt.gz", gz.Bytes()},
+	} {
+		r, err := decompress(tc.name, io.NopCloser(bytes.NewReader(tc.data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readStream(r); got != "Hello" {
+			t.Errorf("%s: got %q, want %q", tc.name, got, "Hello")
+		}
+		if err := r.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err := decompress("foo.gz", io.NopCloser(bytes.NewReader([]byte("junk")))); err == nil {
+		t.Error("expected error for bad gzip data")
+	}
+}
@@ -16,10 +16,13 @@ import (
 	"log"
 	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/fogleman/gg"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/chart"
 )
 
 type Sample []interface{} // [ID, Rank, Value]
@@ -30,107 +33,289 @@ type Stats struct {
 	Samples []Sample
 }
 
+// PlotOptions controls the axes and the output format of the plot.
+type PlotOptions struct {
+	LogX   bool // if true, the rank axis is logarithmic
+	LogY   bool // if true, the views axis is logarithmic
+	Format chart.Format
+}
+
+// Curve is one QRank file to be plotted.
+type Curve struct {
+	Label    string
+	Path     string
+	NumRanks int64
+	MaxValue int64
+}
+
+// Colors of the curves, in the order of the -qrank flags.
+var curveColors = [][3]float64{
+	{0, 0.4, 1},
+	{0.9, 0.3, 0},
+	{0.1, 0.6, 0.2},
+	{0.6, 0.2, 0.7},
+	{0.5, 0.5, 0.5},
+}
+
+// StringList is a flag that can be given multiple times.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
 func main() {
-	font := flag.String("font", "./RobotoSlab-Light.ttf", "path to label font")
-	qrank := flag.String("qrank", "qrank.csv.gz", "path to QRank file")
-	out := flag.String("out", "qrank-distribution.png", "path to output file being written")
-	outStats := flag.String("outStats", "qrank-stats.json", "path to output stats file")
+	var qranks, labels stringList
+	font := flag.String("font", "", "path to TrueType label font, such as RobotoSlab-Light.ttf; empty for the built-in Go font")
+	flag.Var(&qranks, "qrank", "path to QRank file; repeat for comparing several releases (default qrank.csv.gz)")
+	flag.Var(&labels, "label", "legend label for the QRank file at the same position; defaults to the file name")
+	logX := flag.Bool("log-x", false, "if true, the rank axis is logarithmic")
+	logY := flag.Bool("log-y", true, "if true, the views axis is logarithmic")
+	format := flag.String("format", "png", "format of the output file, png or svg")
+	out := flag.String("out", "", "path to output file being written (default qrank-distribution.png or .svg)")
+	outStats := flag.String("outStats", "qrank-stats.json", "path to output stats file, computed for the first QRank file")
 	flag.Parse()
-	if err := PlotDistribution(*font, *qrank, *out, *outStats); err != nil {
+	if len(qranks) == 0 {
+		qranks = stringList{"qrank.csv.gz"}
+	}
+	if len(labels) > len(qranks) {
+		log.Fatalf("got %d -label flags for %d -qrank files", len(labels), len(qranks))
+	}
+
+	chartFormat, err := chart.ParseFormat(*format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *out == "" {
+		*out = "qrank-distribution." + string(chartFormat)
+	}
+
+	opts := PlotOptions{LogX: *logX, LogY: *logY, Format: chartFormat}
+	if err := PlotDistribution(*font, qranks, labels, opts, *out, *outStats); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func PlotDistribution(fontPath, qrankPath, outPath, outStatsPath string) error {
+// PlotDistribution plots the distribution of one or more QRank files
+// into the same chart, and writes statistics about the first file.
+func PlotDistribution(fontPath string, qrankPaths []string, labels []string, opts PlotOptions, outPath, outStatsPath string) error {
 	axisWidth := 35.0
 	plotWidth := 1000.0
-	logX, logY := false, true
-	dc := gg.NewContext(int(plotWidth+axisWidth), int(plotWidth+axisWidth))
-	dc.SetRGB(1, 1, 1)
-	dc.Clear()
-	dc.SetRGB(0, 0, 0)
-
-	font, err := gg.LoadFontFace(fontPath, 18.0)
+	dc, err := chart.NewCanvas(opts.Format, int(plotWidth+axisWidth), int(plotWidth+axisWidth))
 	if err != nil {
 		return err
 	}
+	dc.SetRGB(1, 1, 1)
+	dc.Clear()
+	dc.SetRGB(0, 0, 0)
 
-	smallFont, err := gg.LoadFontFace(fontPath, 11.0)
+	font, err := chart.LoadFont(fontPath, 18.0)
 	if err != nil {
 		return err
 	}
 
-	qrankFile, err := os.Open(qrankPath)
+	smallFont, err := chart.LoadFont(fontPath, 11.0)
 	if err != nil {
 		return err
 	}
-	defer qrankFile.Close()
 
-	qrankReader, err := gzip.NewReader(qrankFile)
-	if err != nil {
-		return err
+	// All curves share the same axes, so we need to know the largest
+	// number of ranks and views before drawing anything.
+	curves := make([]*Curve, 0, len(qrankPaths))
+	var numRanks, maxValue int64
+	for i, path := range qrankPaths {
+		label := filepath.Base(path)
+		if i < len(labels) && labels[i] != "" {
+			label = labels[i]
+		}
+		c, err := ReadCurve(path, label)
+		if err != nil {
+			return err
+		}
+		curves = append(curves, c)
+		numRanks = max(numRanks, c.NumRanks)
+		maxValue = max(maxValue, c.MaxValue)
 	}
 
-	numRanks, err := CountLines(qrankReader)
-	if err != nil {
-		return err
+	scaleX := plotWidth / axisEnd(float64(numRanks))
+	if opts.LogX {
+		scaleX = plotWidth / math.Max(1, math.Ceil(math.Log(float64(numRanks))))
 	}
-	numRanks -= 1 // Don’t count CSV header.
-	numRanksInMillions := int(numRanks / 1000000)
-	medianRank := numRanks / 2
 
-	scaleX := plotWidth / math.Ceil(math.Log(float64(numRanks)))
-	if !logX {
-		scaleX = plotWidth / (float64(numRanksInMillions+1) * 1e6)
+	scaleY := plotWidth / axisEnd(float64(maxValue))
+	if opts.LogY {
+		scaleY = plotWidth / math.Max(1, math.Ceil(math.Log10(float64(maxValue))))
 	}
 
-	if logX {
+	if opts.LogX {
 		for i := 0; i <= int(math.Log(float64(numRanks))); i++ {
 			x := axisWidth + float64(i)*scaleX
 			dc.MoveTo(x, plotWidth)
 			dc.LineTo(x, plotWidth+5)
 			dc.Stroke()
-			dc.SetFontFace(font)
+			dc.SetFont(font)
 			eWidth, eHeight := dc.MeasureString("e")
 			dc.DrawString("e", x-3, plotWidth+23)
-			dc.SetFontFace(smallFont)
+			dc.SetFont(smallFont)
 			dc.DrawString(strconv.Itoa(i), x-3+eWidth, plotWidth+23-eHeight/2)
 		}
 	} else {
-		for i := 0; i <= numRanksInMillions; i += 2 {
-			x := axisWidth + float64(i)*1e6*scaleX
+		step := niceStep(float64(numRanks))
+		for v := 0.0; v <= float64(numRanks); v += step {
+			x := axisWidth + v*scaleX
 			dc.MoveTo(x, plotWidth)
 			dc.LineTo(x, plotWidth+5)
 			dc.Stroke()
-			dc.SetFontFace(font)
-			dc.DrawString(strconv.Itoa(i)+"M", x-3, plotWidth+23)
+			dc.SetFont(font)
+			dc.DrawString(formatCount(v), x-3, plotWidth+23)
 		}
 	}
 
-	if _, err := qrankFile.Seek(0, os.SEEK_SET); err != nil {
+	dc.SetFont(font)
+	w, _ := dc.MeasureString("Rank")
+	dc.DrawString("Rank", axisWidth+(plotWidth-w)/2, plotWidth-12)
+
+	var stats *Stats
+	for i, c := range curves {
+		color := curveColors[i%len(curveColors)]
+		dc.SetRGB(color[0], color[1], color[2])
+		s, err := plotCurve(dc, c, opts, axisWidth, plotWidth, scaleX, scaleY)
+		if err != nil {
+			return err
+		}
+		if stats == nil {
+			stats = s
+		}
+	}
+
+	dc.SetRGB(0, 0, 0)
+	dc.Push()
+	dc.RotateAbout(-math.Pi/2, plotWidth/2, plotWidth/2)
+	dc.DrawString("Views", plotWidth/2, axisWidth+24)
+	dc.Pop()
+
+	dc.MoveTo(axisWidth, 0)
+	dc.LineTo(axisWidth, plotWidth)
+	if opts.LogX {
+		dc.LineTo(axisWidth+math.Log(float64(numRanks))*scaleX, plotWidth)
+	} else {
+		dc.LineTo(axisWidth+float64(numRanks)*scaleX, plotWidth)
+	}
+	dc.Stroke()
+
+	if opts.LogY {
+		for i := 0; i <= int(math.Log10(float64(maxValue))); i++ {
+			y := plotWidth - float64(i)*scaleY
+			dc.MoveTo(axisWidth-5, y)
+			dc.LineTo(axisWidth, y)
+			dc.Stroke()
+			dc.SetFont(font)
+			eWidth, eHeight := dc.MeasureString("10")
+			dc.DrawString("10", 5, y)
+			dc.SetFont(smallFont)
+			dc.DrawString(strconv.Itoa(i), 5+eWidth, y-eHeight/2)
+		}
+	} else {
+		step := niceStep(float64(maxValue))
+		for v := step; v <= float64(maxValue); v += step {
+			y := plotWidth - v*scaleY
+			dc.MoveTo(axisWidth-5, y)
+			dc.LineTo(axisWidth, y)
+			dc.Stroke()
+			dc.SetFont(smallFont)
+			dc.DrawString(formatCount(v), 2, y+4)
+		}
+	}
+
+	if len(curves) > 1 {
+		dc.SetFont(font)
+		drawLegend(dc, curves, axisWidth+plotWidth-20, 30)
+	}
+
+	if err := dc.Save(outPath); err != nil {
 		return err
 	}
 
-	dc.SetFontFace(font)
-	w, _ := dc.MeasureString("Rank")
-	dc.DrawString("Rank", axisWidth+(plotWidth-w)/2, plotWidth-12)
+	fmt.Printf("Median = %d %v\n", stats.Median, stats.Samples[stats.Median])
 
-	qrankReader, err = gzip.NewReader(qrankFile)
+	jsonData, err := json.Marshal(stats)
 	if err != nil {
 		return err
 	}
+	if err := os.WriteFile(outStatsPath, jsonData, os.ModePerm); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReadCurve reads a QRank file to find its number of ranks
+// and its highest value, which is in the first row.
+func ReadCurve(path string, label string) (*Curve, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(gz)
+
+	// Skip CSV header, then parse the first row.
+	if _, err := reader.ReadString('\n'); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	first, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("%s: no ranks, %w", path, err)
+	}
+	cols := strings.Split(strings.TrimSpace(first), ",")
+	if len(cols) < 2 {
+		return nil, fmt.Errorf("%s:2: less than 2 columns", path)
+	}
+	maxValue, err := strconv.ParseInt(cols[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s:2: %w", path, err)
+	}
+
+	rest, err := CountLines(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Curve{Label: label, Path: path, NumRanks: rest + 1, MaxValue: maxValue}, nil
+}
+
+// PlotCurve draws the distribution of a QRank file in the current color,
+// and returns statistics about the file.
+func plotCurve(dc chart.Canvas, c *Curve, opts PlotOptions, axisWidth, plotWidth, scaleX, scaleY float64) (*Stats, error) {
+	qrankFile, err := os.Open(c.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer qrankFile.Close()
+
+	qrankReader, err := gzip.NewReader(qrankFile)
+	if err != nil {
+		return nil, err
+	}
 
 	var line int64 = 1
 	scanner := bufio.NewScanner(qrankReader)
 	scanner.Scan() // Skip CSV header.
 
-	dc.SetRGB(0, 0.4, 1)
-	var scaleY float64
-	var maxValue float64
+	medianRank := c.NumRanks / 2
 	var lastX, lastY float64
 
 	var stats Stats
-	stats.Count = numRanks
+	stats.Count = c.NumRanks
 	stats.Samples = make([]Sample, 0, 200)
 	type point struct{ x, y float64 }
 	graph := make([]point, 0, int(plotWidth))
@@ -143,30 +328,21 @@ func PlotDistribution(fontPath, qrankPath, outPath, outStatsPath string) error {
 		line += 1
 		cols := strings.Split(scanner.Text(), ",")
 		if len(cols) < 2 {
-			return fmt.Errorf("%s:%d: less than 2 columns", qrankPath, line)
+			return nil, fmt.Errorf("%s:%d: less than 2 columns", c.Path, line)
 		}
 
 		id, rank = cols[0], line-1
 		val, err = strconv.ParseInt(cols[1], 10, 64)
 		if err != nil {
-			return err
-		}
-
-		if rank == 1 { // first item in file
-			maxValue = float64(val)
-			if logY {
-				scaleY = plotWidth / math.Ceil(math.Log10(maxValue))
-			} else {
-				scaleY = plotWidth / maxValue
-			}
+			return nil, err
 		}
 
 		x := math.Log(float64(line-1))*scaleX + axisWidth
-		if !logX {
+		if !opts.LogX {
 			x = float64(line-1)*scaleX + axisWidth
 		}
 		y := plotWidth - math.Log10(float64(val))*scaleY
-		if !logY {
+		if !opts.LogY {
 			y = plotWidth - float64(val)*scaleY
 		}
 
@@ -191,7 +367,10 @@ func PlotDistribution(fontPath, qrankPath, outPath, outStatsPath string) error {
 		}
 	}
 	if err := scanner.Err(); err != nil {
-		return err
+		return nil, err
+	}
+	if len(stats.Samples) == 0 {
+		return nil, fmt.Errorf("%s: no ranks", c.Path)
 	}
 	stats.Samples[len(stats.Samples)-1] = Sample{id, rank, val}
 
@@ -209,50 +388,59 @@ func PlotDistribution(fontPath, qrankPath, outPath, outStatsPath string) error {
 		dc.Fill()
 	}
 
-	dc.SetRGB(0, 0, 0)
-	dc.Push()
-	dc.RotateAbout(-math.Pi/2, plotWidth/2, plotWidth/2)
-	dc.DrawString("Views", plotWidth/2, axisWidth+24)
-	dc.Pop()
-
-	dc.MoveTo(axisWidth, plotWidth-math.Log10(maxValue)*scaleY)
-	dc.LineTo(axisWidth, plotWidth)
-	if logX {
-		dc.LineTo(axisWidth+math.Log(float64(numRanks))*scaleX, plotWidth)
-	} else {
-		dc.LineTo(axisWidth+float64(numRanks)*scaleX, plotWidth)
-	}
-	dc.Stroke()
-
-	if logY {
-		for i := 0; i <= int(math.Log10(float64(maxValue))); i++ {
-			y := plotWidth - float64(i)*scaleY
-			dc.MoveTo(axisWidth-5, y)
-			dc.LineTo(axisWidth, y)
-			dc.Stroke()
-			dc.SetFontFace(font)
-			eWidth, eHeight := dc.MeasureString("10")
-			dc.DrawString("10", 5, y)
-			dc.SetFontFace(smallFont)
-			dc.DrawString(strconv.Itoa(i), 5+eWidth, y-eHeight/2)
-		}
-	}
+	return &stats, nil
+}
 
-	if err := dc.SavePNG(outPath); err != nil {
-		return err
+// DrawLegend draws the labels of the curves in the current font,
+// right-aligned at x, each next to a line in the color of its curve.
+func drawLegend(dc chart.Canvas, curves []*Curve, right, top float64) {
+	const lineLength, gap = 30.0, 8.0
+	for i, c := range curves {
+		w, h := dc.MeasureString(c.Label)
+		y := top + float64(i)*(h+gap)
+		color := curveColors[i%len(curveColors)]
+		dc.SetRGB(color[0], color[1], color[2])
+		dc.SetLineWidth(3)
+		dc.DrawLine(right-w-gap-lineLength, y-h/3, right-w-gap, y-h/3)
+		dc.Stroke()
+		dc.SetLineWidth(1)
+		dc.SetRGB(0, 0, 0)
+		dc.DrawString(c.Label, right-w, y)
 	}
+}
 
-	fmt.Printf("Median = %d %v\n", stats.Median, stats.Samples[stats.Median])
+// AxisEnd returns the value at the end of a linear axis
+// for values up to max, which is a multiple of niceStep(max).
+func axisEnd(max float64) float64 {
+	step := niceStep(max)
+	return math.Max(1, math.Ceil(max/step)) * step
+}
 
-	jsonData, err := json.Marshal(stats)
-	if err != nil {
-		return err
+// NiceStep returns a step of 1, 2 or 5 times a power of ten for
+// placing about five to ten ticks on an axis that goes up to max.
+func niceStep(max float64) float64 {
+	if max <= 0 {
+		return 1
 	}
-	if err := os.WriteFile(outStatsPath, jsonData, os.ModePerm); err != nil {
-		return err
+	step := math.Pow(10, math.Floor(math.Log10(max)))
+	for _, f := range []float64{0.1, 0.2, 0.5, 1} {
+		if max/(step*f) <= 10 {
+			return step * f
+		}
 	}
+	return step
+}
 
-	return nil
+// FormatCount formats a number for an axis label, such as "2M" or "500K".
+func formatCount(v float64) string {
+	switch {
+	case v >= 1e6:
+		return strconv.FormatFloat(v/1e6, 'f', -1, 64) + "M"
+	case v >= 1e3:
+		return strconv.FormatFloat(v/1e3, 'f', -1, 64) + "K"
+	default:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
 }
 
 func CountLines(r io.Reader) (int64, error) {
@@ -263,15 +451,7 @@ func CountLines(r io.Reader) (int64, error) {
 		if err != nil && err != io.EOF {
 			return 0, err
 		}
-		var pos int
-		for {
-			i := bytes.IndexByte(buf[pos:], '\n')
-			if i == -1 || pos == bufSize {
-				break
-			}
-			pos += i + 1
-			count += 1
-		}
+		count += int64(bytes.Count(buf[:bufSize], []byte{'\n'}))
 		if err == io.EOF {
 			break
 		}
@@ -0,0 +1,160 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/chart"
+)
+
+func TestPlotDistribution(t *testing.T) {
+	var older, newer strings.Builder
+	older.WriteString("Entity,QRank\n")
+	newer.WriteString("Entity,QRank\n")
+	for i := 1; i <= 500; i++ {
+		fmt.Fprintf(&older, "Q%d,%d\n", i, 100000/i)
+		fmt.Fprintf(&newer, "Q%d,%d\n", i, 200000/i)
+	}
+	paths := []string{writeTestQRank(t, older.String()), writeTestQRank(t, newer.String())}
+	labels := []string{"2024-01-01", "2024-02-01"}
+
+	dir := t.TempDir()
+	for _, format := range []chart.Format{chart.PNG, chart.SVG} {
+		opts := PlotOptions{LogX: true, LogY: true, Format: format}
+		out := filepath.Join(dir, "plot."+string(format))
+		outStats := filepath.Join(dir, "stats.json")
+		if err := PlotDistribution("", paths, labels, opts, out, outStats); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := os.ReadFile(outStats)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stats Stats
+		if err := json.Unmarshal(data, &stats); err != nil {
+			t.Fatal(err)
+		}
+		if stats.Count != 500 {
+			t.Errorf("got stats.Count=%d, want 500", stats.Count)
+		}
+	}
+
+	svg, err := os.ReadFile(filepath.Join(dir, "plot.svg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, label := range labels {
+		if !bytes.Contains(svg, []byte(">"+label+"</text>")) {
+			t.Errorf("legend should contain %q", label)
+		}
+	}
+}
+
+func TestReadCurve(t *testing.T) {
+	path := writeTestQRank(t, "Entity,QRank\nQ1,900\nQ2,50\nQ3,7\n")
+	c, err := ReadCurve(path, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Curve{Label: "test", Path: path, NumRanks: 3, MaxValue: 900}
+	if *c != want {
+		t.Errorf("got %+v, want %+v", *c, want)
+	}
+}
+
+func TestReadCurve_BadInput(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"Entity,QRank\n",
+		"Entity,QRank\nQ1\n",
+		"Entity,QRank\nQ1,x\n",
+	} {
+		if _, err := ReadCurve(writeTestQRank(t, data), "test"); err == nil {
+			t.Errorf("expected error for %q", data)
+		}
+	}
+}
+
+func TestCountLines(t *testing.T) {
+	text := strings.Repeat("Q1,23\n", 70000)
+	for _, tc := range []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"one", "foo\n"},
+		{"many", text},
+	} {
+		want := int64(strings.Count(tc.data, "\n"))
+		got, err := CountLines(strings.NewReader(tc.data))
+		if err != nil || got != want {
+			t.Errorf("%s: got %d, %v; want %d", tc.name, got, err, want)
+		}
+
+		// With short reads, the buffer still holds bytes from
+		// earlier reads, which must not get counted again.
+		got, err = CountLines(iotest.HalfReader(strings.NewReader(tc.data)))
+		if err != nil || got != want {
+			t.Errorf("%s, short reads: got %d, %v; want %d", tc.name, got, err, want)
+		}
+	}
+}
+
+func TestNiceStep(t *testing.T) {
+	for _, tc := range []struct{ max, want float64 }{
+		{0, 1},
+		{7, 1},
+		{10, 1},
+		{11, 2},
+		{35, 5},
+		{100, 10},
+		{30500000, 5000000},
+	} {
+		if got := niceStep(tc.max); got != tc.want {
+			t.Errorf("niceStep(%v): got %v, want %v", tc.max, got, tc.want)
+		}
+	}
+
+	if got := axisEnd(30500000); got != 35000000 {
+		t.Errorf("axisEnd(30500000): got %v, want 35000000", got)
+	}
+}
+
+func TestFormatCount(t *testing.T) {
+	for _, tc := range []struct {
+		v    float64
+		want string
+	}{
+		{0, "0"},
+		{500, "500"},
+		{2500, "2.5K"},
+		{5000000, "5M"},
+	} {
+		if got := formatCount(tc.v); got != tc.want {
+			t.Errorf("formatCount(%v): got %q, want %q", tc.v, got, tc.want)
+		}
+	}
+}
+
+func writeTestQRank(t *testing.T, data string) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(data))
+	gz.Close()
+	path := filepath.Join(t.TempDir(), "qrank.csv.gz")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,191 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Thresholds for detecting anomalies between two releases.
+const (
+	// A release is suspicious if its total pageviews dropped
+	// by more than this fraction, compared to the previous release.
+	maxPageviewsDrop = 0.3
+
+	// A release is suspicious if any of this many largest wikis
+	// of the previous release did not contribute any rows.
+	numTopSites = 100
+
+	// A release is suspicious if its number of items shrank by more
+	// than this fraction. Deletions and merges make Wikidata lose
+	// a few items every week, which is nothing to worry about.
+	maxItemsShrink = 0.01
+)
+
+// Anomaly is a suspicious difference between two releases.
+type Anomaly struct {
+	Kind    string `json:"kind"` // "pageviews-dropped", "site-missing", "items-shrank"
+	Message string `json:"message"`
+}
+
+// AnomalyReport is the machine-readable result of comparing the stats
+// of a new release to those of the previous one. It gets stored in the
+// internal/ directory of our storage bucket, which is not served
+// to the public.
+type AnomalyReport struct {
+	Version         string    `json:"version"`
+	PreviousVersion string    `json:"previous_version,omitempty"`
+	Anomalies       []Anomaly `json:"anomalies"`
+}
+
+// FindAnomalies compares the stats of a new release to the previous one.
+func FindAnomalies(prev, cur *SignalStats) []Anomaly {
+	anomalies := make([]Anomaly, 0, 4)
+
+	prevViews := prev.Totals["pageviews_52w"]
+	curViews := cur.Totals["pageviews_52w"]
+	if prevViews > 0 && float64(curViews) < float64(prevViews)*(1.0-maxPageviewsDrop) {
+		drop := 100.0 * float64(prevViews-curViews) / float64(prevViews)
+		anomalies = append(anomalies, Anomaly{
+			Kind:    "pageviews-dropped",
+			Message: fmt.Sprintf("total pageviews dropped by %.1f%% from %d to %d", drop, prevViews, curViews),
+		})
+	}
+
+	for _, domain := range topSites(prev, numTopSites) {
+		if site, ok := cur.Sites[domain]; !ok || site.Rows == 0 {
+			anomalies = append(anomalies, Anomaly{
+				Kind:    "site-missing",
+				Message: fmt.Sprintf("%s had %d rows, now missing", domain, prev.Sites[domain].Rows),
+			})
+		}
+	}
+
+	if prev.Items > 0 && float64(cur.Items) < float64(prev.Items)*(1.0-maxItemsShrink) {
+		shrink := 100.0 * float64(prev.Items-cur.Items) / float64(prev.Items)
+		anomalies = append(anomalies, Anomaly{
+			Kind:    "items-shrank",
+			Message: fmt.Sprintf("number of items shrank by %.1f%% from %d to %d", shrink, prev.Items, cur.Items),
+		})
+	}
+
+	return anomalies
+}
+
+// TopSites returns the domains of the n sites with the most rows,
+// ordered by decreasing number of rows.
+func topSites(stats *SignalStats, n int) []string {
+	domains := make([]string, 0, len(stats.Sites))
+	for domain, site := range stats.Sites {
+		if site.Rows > 0 {
+			domains = append(domains, domain)
+		}
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		a, b := stats.Sites[domains[i]].Rows, stats.Sites[domains[j]].Rows
+		if a != b {
+			return a > b
+		}
+		return domains[i] < domains[j]
+	})
+	if len(domains) > n {
+		domains = domains[:n]
+	}
+	return domains
+}
+
+// StoragePath returns the path of the report in S3 storage.
+func (r *AnomalyReport) StoragePath() string {
+	t, _ := time.Parse(time.DateOnly, r.Version)
+	return InternalPath("qrank-anomalies", t, "json")
+}
+
+// CheckAnomalies compares new stats to those of the most recent
+// previous release in storage, and stores a report about anomalies.
+// If there is no previous release, the report has no anomalies.
+func CheckAnomalies(ctx context.Context, cur *SignalStats, s3 S3) (*AnomalyReport, error) {
+	report := &AnomalyReport{Version: cur.Version, Anomalies: []Anomaly{}}
+	prev, err := ReadPreviousSignalStats(ctx, cur.Version, s3)
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil {
+		report.PreviousVersion = prev.Version
+		report.Anomalies = FindAnomalies(prev, cur)
+	}
+
+	for _, a := range report.Anomalies {
+		logger.Printf("anomaly in release %s: %s", report.Version, a.Message)
+	}
+
+	if err := PutJSON(ctx, report, s3, "qrank", report.StoragePath()); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// ReadPreviousSignalStats returns the stats of the most recent release
+// before version, or nil if storage has no such stats. Stats files
+// in the old format, which had no format version, are ignored.
+func ReadPreviousSignalStats(ctx context.Context, version string, s3 S3) (*SignalStats, error) {
+	re := regexp.MustCompile(`^public/qrank-stats-(\d{8}).json$`)
+	cur, err := time.Parse(time.DateOnly, version)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, 10)
+	opts := minio.ListObjectsOptions{Prefix: "public/qrank-stats-"}
+	for obj := range s3.ListObjects(ctx, "qrank", opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if match := re.FindStringSubmatch(obj.Key); match != nil {
+			if t, err := time.Parse("20060102", match[1]); err == nil && t.Before(cur) {
+				paths = append(paths, obj.Key)
+			}
+		}
+	}
+
+	// Newest first.
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	for _, path := range paths {
+		stats, err := readSignalStats(ctx, path, s3)
+		if err != nil {
+			return nil, err
+		}
+		if stats.FormatVersion >= 2 {
+			return stats, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func readSignalStats(ctx context.Context, path string, s3 S3) (*SignalStats, error) {
+	r, err := NewS3Reader(ctx, "qrank", path, s3)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var stats SignalStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &stats, nil
+}
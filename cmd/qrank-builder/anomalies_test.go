@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"slices"
+	"testing"
+)
+
+func TestFindAnomalies(t *testing.T) {
+	prev := &SignalStats{
+		Version: "2024-04-01",
+		Items:   1000,
+		Totals:  map[string]int64{"pageviews_52w": 10000},
+		Sites: map[string]*SiteStats{
+			"en.wikipedia": {Rows: 500},
+			"rm.wikipedia": {Rows: 20},
+			"xx.wikipedia": {Rows: 0},
+		},
+	}
+
+	for _, tc := range []struct {
+		name  string
+		cur   *SignalStats
+		kinds []string
+	}{
+		{
+			"ok",
+			&SignalStats{
+				Items:  995,
+				Totals: map[string]int64{"pageviews_52w": 7001},
+				Sites: map[string]*SiteStats{
+					"en.wikipedia": {Rows: 400},
+					"rm.wikipedia": {Rows: 1},
+				},
+			},
+			[]string{},
+		},
+		{
+			"everything-wrong",
+			&SignalStats{
+				Items:  989,
+				Totals: map[string]int64{"pageviews_52w": 6999},
+				Sites: map[string]*SiteStats{
+					"en.wikipedia": {Rows: 0},
+				},
+			},
+			[]string{"pageviews-dropped", "site-missing", "site-missing", "items-shrank"},
+		},
+	} {
+		anomalies := FindAnomalies(prev, tc.cur)
+		kinds := make([]string, 0, len(anomalies))
+		for _, a := range anomalies {
+			kinds = append(kinds, a.Kind)
+		}
+		if !slices.Equal(kinds, tc.kinds) {
+			t.Errorf("%s: got %v, want %v", tc.name, anomalies, tc.kinds)
+		}
+	}
+}
+
+func TestTopSites(t *testing.T) {
+	stats := &SignalStats{
+		Sites: map[string]*SiteStats{
+			"a": {Rows: 7},
+			"b": {Rows: 9},
+			"c": {Rows: 7},
+			"d": {Rows: 0},
+			"e": {Rows: 1},
+		},
+	}
+	got := topSites(stats, 3)
+	want := []string{"b", "a", "c"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCheckAnomalies(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+
+	// Old-format stats, which should be ignored.
+	s3.data["public/qrank-stats-20240401.json"] = []byte(`{"Median":2,"Samples":[]}`)
+
+	// Stats of the previous release.
+	s3.data["public/qrank-stats-20240301.json"] = []byte(`{"format_version":2,"version":"2024-03-01","items":50}`)
+
+	// Stats of a future release, which should also be ignored.
+	s3.data["public/qrank-stats-20240601.json"] = []byte(`{"format_version":2,"version":"2024-06-01","items":1}`)
+
+	cur := &SignalStats{FormatVersion: 2, Version: "2024-05-01", Items: 40}
+	report, err := CheckAnomalies(ctx, cur, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.PreviousVersion != "2024-03-01" || len(report.Anomalies) != 1 || report.Anomalies[0].Kind != "items-shrank" {
+		t.Errorf("got %+v, want one items-shrank anomaly compared to 2024-03-01", report)
+	}
+
+	var stored AnomalyReport
+	if err := json.Unmarshal(s3.data["internal/qrank-anomalies-20240501.json"], &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Version != "2024-05-01" || len(stored.Anomalies) != 1 {
+		t.Errorf("got stored report %+v", stored)
+	}
+}
+
+func TestCheckAnomalies_NoPrevious(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	s3 := NewFakeS3()
+	cur := &SignalStats{FormatVersion: 2, Version: "2024-05-01", Items: 40}
+	report, err := CheckAnomalies(context.Background(), cur, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.PreviousVersion != "" || len(report.Anomalies) != 0 {
+		t.Errorf("got %+v, want empty report", report)
+	}
+	if _, ok := s3.data["internal/qrank-anomalies-20240501.json"]; !ok {
+		t.Error("report not in storage")
+	}
+}
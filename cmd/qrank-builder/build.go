@@ -4,67 +4,681 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
-	"runtime"
 	"slices"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/minio/minio-go/v7"
 	"golang.org/x/sync/errgroup"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/minisign"
+	"github.com/brawer/wikidata-qrank/v2/pkg/qrank"
 )
 
+// BuildStages lists the stages of the QRank pipeline in order of execution.
+// Each stage can also be run separately, for example as separate Toolforge
+// jobs with different memory limits. Because every stage puts its outputs
+// into storage and skips work whose output is already stored, a failed
+// stage can be retried without redoing the stages before it.
+var BuildStages = []string{
+	"pageviews",
+	"page-signals",
+	"page-signals-incr",
+	"interwiki-links",
+	"titles",
+	"page-items",
+	"links",
+	"inlinks",
+	"classes",
+	"sitelinks",
+	"merged-items",
+	"labels",
+	"item-signals",
+	"property-rank",
+	"coordinates",
+	"churn",
+	"sqlite",
+	"signatures",
+}
+
+// PreviewStage builds a preview of the item signals with the
+// freshest pageviews, see buildPreview(). It is not part of the
+// full pipeline, but gets run on its own, for example nightly.
+const PreviewStage = "preview"
+
+// BuildOptions controls optional aspects of the pipeline.
+// The zero value gives the default behavior.
+type BuildOptions struct {
+	// Weights scales the pageviews of each project when computing
+	// item signals. If nil, all projects have the same weight.
+	Weights ProjectWeights
+
+	// Disambiguation tells how to rank items that have
+	// a disambiguation page. By default, they are kept as-is.
+	Disambiguation DisambiguationPolicy
+
+	// EnterpriseDumps is the path to a local mirror of the Wikimedia
+	// Enterprise HTML dumps, or empty for not using them. If set,
+	// page signals include outlinks and infoboxes.
+	EnterpriseDumps string
+
+	// If QualitySignals is true, page signals include the number of
+	// external links and templates of each page, counted in the dumps
+	// of the externallinks and templatelinks tables. Item signals
+	// have them as columns from schema version 7 on.
+	QualitySignals bool
+
+	// ItemSignalsSchema is the schema version of the item_signals
+	// file, see qrank.ItemSignalsSchemas. Zero for the current version.
+	ItemSignalsSchema int
+
+	// If MinPageviews is positive, items with fewer pageviews get
+	// left out from the published item_signals file, which shrinks it
+	// considerably because most items are hardly ever viewed. The full
+	// file then gets published as item_signals_full-YYYYMMDD.csv.zst.
+	MinPageviews int64
+
+	// If MaxWeekMultiple is positive, the pageviews of an item in any
+	// single week count at most this many times its median week, to
+	// reduce the effect of view-bombing campaigns and bot spikes.
+	// The stats tell how many items were affected.
+	MaxWeekMultiple float64
+
+	// If Parquet is set, the item signals also get published in
+	// Parquet format, partitioned by ranges of item IDs, so analysts
+	// can query them without decompressing the entire CSV file.
+	Parquet bool
+
+	// If SQLite is set, the sqlite stage publishes the item signals
+	// as a SQLite database, with an index on item, rank and class,
+	// for scripts that would rather run SQL queries than parse CSV.
+	SQLite bool
+
+	// ClassRanks lists classes, such as 5 for Q5 (human), for which
+	// the item-signals stage publishes the top-ranked items. The
+	// number of items per class is ClassRankSize.
+	ClassRanks    []int64
+	ClassRankSize int
+
+	// IncrementalSites lists sites, such as "enwiki", whose page
+	// signals get updated from the daily adds-changes dumps between
+	// full dumps, see applyIncrements(). If empty, they only get
+	// updated when a new full dump is available.
+	IncrementalSites []string
+
+	// If LabelsSize is positive, the item-signals stage publishes
+	// the English labels of that many top-ranked items, so humans
+	// can eyeball the ranking without looking up every item.
+	LabelsSize int
+
+	// If WikiSharesSize is positive, the item-signals stage publishes
+	// a report telling, for that many top-ranked items, which three
+	// wikis contributed most of their pageviews. This helps to debug
+	// surprising ranks.
+	WikiSharesSize int
+
+	// If SitelinksFromDump is set, the sitelinks of items get counted
+	// in the wb_items_per_site table of the Wikidata dump, instead of
+	// taking them from the wb-sitelinks page property, which is
+	// sometimes stale. The stats then tell how often the two differ.
+	SitelinksFromDump bool
+
+	// If ExcludeStubs is set, items that look like stubs get left out
+	// from the item signals, see ItemSignals.IsStub(). Either way,
+	// schema version 6 and later flag them in the is_stub column.
+	ExcludeStubs bool
+
+	// If ZstdDicts is set, small per-site files get compressed with
+	// the dictionaries in storage, see TrainZstdDicts().
+	ZstdDicts bool
+
+	// If SigningKey is set, the signatures stage puts a detached
+	// minisign signature next to every public file in storage.
+	SigningKey *minisign.PrivateKey
+
+	// If MaxQuarantineShare is positive, per-site stages carry on
+	// when building the files of some sites fails, as long as all
+	// sites that failed during the run have at most this share of
+	// the pageviews, such as 0.001 for 0.1%. See quarantineSites().
+	// If zero, which is the default, any failure is fatal.
+	MaxQuarantineShare float64
+
+	// If Strict is set, the pipeline fails instead of publishing
+	// a release that looks anomalous compared to the previous one.
+	Strict bool
+
+	// If Sample is set, the pipeline only processes a sample of
+	// the wikis and items, see BuildSample. This is for test runs.
+	Sample *BuildSample
+
+	// If Deadline is set, the pipeline does not start any new work
+	// after that time, and BuildStage returns ErrMaxRuntime.
+	Deadline time.Time
+
+	// PageviewsSource tells where to read daily pageviews from.
+	// If nil, they come from the pageview_complete dumps.
+	PageviewsSource PageviewsSource
+
+	// If MonthlyPageviewsHorizon is positive, weeks that lie this many
+	// weeks or more in the past get built from the monthly pageview
+	// dumps, which are much smaller than seven daily dumps. Weeks whose
+	// monthly dumps are missing, or do not match the daily dumps, still
+	// get built from the daily dumps.
+	MonthlyPageviewsHorizon int
+
+	// If preview is set, buildItemSignals builds a preview with
+	// pageviews up to that day, see buildPreview().
+	preview time.Time
+}
+
+// NeedsClasses returns true if the item-signals stage needs the
+// classes of items, as built by the classes stage.
+func (opts *BuildOptions) needsClasses() bool {
+	if len(opts.ClassRanks) > 0 {
+		return true
+	}
+	version := opts.ItemSignalsSchema
+	if version == 0 {
+		version = qrank.CurrentItemSignalsSchema
+	}
+	schema, err := qrank.LookupItemSignalsSchema(version)
+	return err == nil && slices.Contains(schema.Columns, "class")
+}
+
+// NeedsMergedItems returns true if the item-signals stage needs the
+// merged items, as built by the merged-items stage.
+func (opts *BuildOptions) needsMergedItems() bool {
+	version := opts.ItemSignalsSchema
+	if version == 0 {
+		version = qrank.CurrentItemSignalsSchema
+	}
+	schema, err := qrank.LookupItemSignalsSchema(version)
+	return err == nil && slices.Contains(schema.Columns, "merged_into")
+}
+
+// NeedsInlinks returns true if the item-signals stage needs the
+// incoming links of items, as built by the links and inlinks stages.
+func (opts *BuildOptions) needsInlinks() bool {
+	version := opts.ItemSignalsSchema
+	if version == 0 {
+		version = qrank.CurrentItemSignalsSchema
+	}
+	schema, err := qrank.LookupItemSignalsSchema(version)
+	return err == nil && slices.Contains(schema.Columns, "inlinks")
+}
+
+// PageviewsSource returns where to read daily pageviews from.
+// If the dump date is pinned, later pageviews get ignored.
+func (opts *BuildOptions) pageviewsSource(dumps string) PageviewsSource {
+	var source PageviewsSource = PageviewCompleteSource{Dumps: dumps}
+	if opts.PageviewsSource != nil {
+		source = opts.PageviewsSource
+	}
+	if !pinnedDumpDate.IsZero() {
+		source = pinnedPageviewsSource{source, pinnedDumpDate}
+	}
+	return source
+}
+
+// ErrMaxRuntime tells that the pipeline has stopped before finishing
+// because BuildOptions.Deadline has passed. Toolforge kills jobs that
+// run for too long, so we rather stop after finishing the artifact
+// that is currently being built. Because all finished artifacts are
+// in storage, the next run continues where this one has stopped;
+// the work that was left over is listed in the build report.
+var ErrMaxRuntime = errors.New("maximum runtime exceeded")
+
+type buildDeadlineKey struct{}
+
+// WithBuildDeadline returns a context for running stages that should
+// not start any new work after the deadline.
+func withBuildDeadline(ctx context.Context, deadline time.Time) context.Context {
+	if deadline.IsZero() {
+		return ctx
+	}
+	return context.WithValue(ctx, buildDeadlineKey{}, deadline)
+}
+
+// PastBuildDeadline returns true if the deadline in ctx has passed.
+func pastBuildDeadline(ctx context.Context) bool {
+	deadline, ok := ctx.Value(buildDeadlineKey{}).(time.Time)
+	return ok && time.Now().After(deadline)
+}
+
 // Build runs the entire QRank pipeline.
 func Build(client *http.Client, dumps string, numWeeks int, s3 S3) error {
+	return BuildStage(client, dumps, numWeeks, s3, BuildOptions{}, BuildStages...)
+}
+
+// BuildStage runs one or more stages of the QRank pipeline.
+func BuildStage(client *http.Client, dumps string, numWeeks int, s3 S3, opts BuildOptions, stages ...string) error {
 	ctx := context.Background()
+	b := &builder{client: client, dumps: dumps, numWeeks: numWeeks, s3: s3, opts: opts}
+	if opts.MaxQuarantineShare > 0 {
+		b.quarantine = newSiteQuarantine(opts.MaxQuarantineShare)
+	}
+	for _, stage := range stages {
+		if !slices.Contains(BuildStages, stage) && stage != PreviewStage {
+			return fmt.Errorf("unknown stage %q", stage)
+		}
+	}
 
-	pageviews, err := buildPageviews(ctx, dumps, numWeeks, s3)
-	if err != nil {
-		return err
+	report := NewBuildReport(time.Now())
+	ctx = withBuildReport(ctx, report)
+	ctx = withBuildDeadline(ctx, opts.Deadline)
+	ctx = withBuildSample(ctx, opts.Sample)
+	defer func() {
+		if err := report.Put(context.Background(), s3); err != nil {
+			logger.Printf("cannot store build report: %v", err)
+		}
+	}()
+
+	// If a stage finds a corrupt intermediate file, the file gets removed
+	// from storage, and we run the stages again from the beginning.
+	// Since stages skip work whose output is already stored, this only
+	// rebuilds what was removed. Each file gets recovered only once,
+	// so a bug in a builder cannot send us into an endless loop.
+	recovered := make(map[string]bool, 4)
+	for i := 0; i < len(stages); i++ {
+		stage := stages[i]
+		if pastBuildDeadline(ctx) {
+			logger.Printf("maximum runtime exceeded, not starting stage %s", stage)
+			return ErrMaxRuntime
+		}
+		logger.Printf("stage %s starting", stage)
+		start := time.Now()
+		startIO := GetDumpIOStats()
+		startStorageIO := GetStorageIOStats()
+		startStorageCalls := GetStorageCallStats(s3)
+		startSort := GetSortStats()
+		stageCtx, step := startReportStep(ctx, stage)
+		err := b.run(stageCtx, stage)
+		if errors.Is(err, ErrMaxRuntime) {
+			step.finish(nil)
+			logger.Printf("stage %s stopped after %.1fs because the maximum runtime was exceeded",
+				stage, time.Since(start).Seconds())
+			return err
+		}
+		step.finish(err)
+		var corrupt *corruptObjectError
+		if errors.As(err, &corrupt) && corrupt.Removed && !recovered[corrupt.Path] {
+			recovered[corrupt.Path] = true
+			logger.Printf("stage %s found corrupt %s, running stages again from %s to rebuild it",
+				stage, corrupt.Path, stages[0])
+			i = -1
+			continue
+		}
+		if err != nil {
+			logger.Printf("stage %s failed: %v", stage, err)
+			return err
+		}
+		io := GetDumpIOStats().Sub(startIO)
+		storageIO := GetStorageIOStats().Sub(startStorageIO)
+		logger.Printf("stage %s finished in %.1fs; read %.1f MiB from dumps at %.1f MiB/s per reader, waited %.1fs for I/O; downloaded %.1f MiB from storage at %.1f MiB/s",
+			stage, time.Since(start).Seconds(), float64(io.Bytes)/(1024*1024), io.MiBPerSecond(), io.Waiting.Seconds(),
+			float64(storageIO.Bytes)/(1024*1024), storageIO.MiBPerSecond())
+		if calls := GetStorageCallStats(s3).Sub(startStorageCalls); calls.Retries > 0 || calls.SlowCalls > 0 {
+			logger.Printf("stage %s made %d storage calls, of which %d were slow; retried %d times",
+				stage, calls.Calls, calls.SlowCalls, calls.Retries)
+		}
+		if sorted := GetSortStats().Sub(startSort); sorted.Records > 0 {
+			logger.Printf("stage %s sorted %d records in %d chunks with %d merge passes; producers were blocked for %.1fs",
+				stage, sorted.Records, sorted.Chunks, sorted.Merges, sorted.Blocked.Seconds())
+		}
 	}
+	return nil
+}
 
-	sites, err := ReadWikiSites(client, dumps)
-	if err != nil {
+// Builder keeps state that is shared between the stages of the pipeline.
+type builder struct {
+	client     *http.Client
+	dumps      string
+	numWeeks   int
+	s3         S3
+	opts       BuildOptions
+	sites      *WikiSites
+	pageviews  []string
+	quarantine *siteQuarantine
+	dicts      *ZstdDicts
+}
+
+func (b *builder) run(ctx context.Context, stage string) error {
+	switch stage {
+	case "pageviews":
+		sites, err := b.wikiSites(ctx)
+		if err != nil {
+			return err
+		}
+		domains := NewPageviewDomains(sites)
+		pageviews, err := buildPageviews(ctx, b.opts.pageviewsSource(b.dumps), b.numWeeks, b.opts.MonthlyPageviewsHorizon, domains, b.s3)
+		if err != nil {
+			return err
+		}
+		b.pageviews = pageviews
+		return nil
+
+	case "item-signals":
+		pageviews, err := b.findPageviews(ctx)
+		if err != nil {
+			return err
+		}
+		sites, err := b.wikiSites(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = buildItemSignals(ctx, pageviews, sites, b.opts, b.s3)
 		return err
-	}
-	logger.Printf("found wikimedia dumps for %d sites", len(sites.Sites))
 
-	if err := buildSiteFiles(ctx, "page_signals", buildPageSignals, dumps, sites, s3); err != nil {
+	case "property-rank":
+		pageviews, err := b.findPageviews(ctx)
+		if err != nil {
+			return err
+		}
+		sites, err := b.wikiSites(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = buildPropertyRank(ctx, b.dumps, pageviews, sites, b.opts.needsMergedItems(), b.s3)
 		return err
-	}
 
-	if err := buildSiteFiles(ctx, "interwiki_links", buildInterwikiLinks, dumps, sites, s3); err != nil {
+	case "classes":
+		if !b.opts.needsClasses() {
+			logger.Printf("item classes are not needed for this build, skipping")
+			return nil
+		}
+		_, err := buildClasses(ctx, b.dumps, b.s3)
+		return err
+
+	case "sitelinks":
+		if !b.opts.SitelinksFromDump {
+			logger.Printf("sitelink counts are not needed for this build, skipping")
+			return nil
+		}
+		sites, err := b.wikiSites(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = buildSitelinks(ctx, b.dumps, sites, b.s3)
 		return err
-	}
 
-	if err := buildSiteFiles(ctx, "titles", buildTitles, dumps, sites, s3); err != nil {
+	case "merged-items":
+		if !b.opts.needsMergedItems() {
+			logger.Printf("merged items are not needed for this build, skipping")
+			return nil
+		}
+		sites, err := b.wikiSites(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = buildMergedItems(ctx, b.dumps, sites, b.s3)
+		return err
+
+	case "page-signals-incr":
+		if len(b.opts.IncrementalSites) == 0 {
+			logger.Printf("no sites with incremental page signals, skipping")
+			return nil
+		}
+		sites, err := b.wikiSites(ctx)
+		if err != nil {
+			return err
+		}
+		keys := b.opts.Sample.FilterKeys(b.opts.IncrementalSites)
+		return buildIncrementalPageSignals(ctx, b.dumps, sites, keys, b.s3)
+
+	case "labels":
+		if b.opts.LabelsSize <= 0 {
+			logger.Printf("item labels are not needed for this build, skipping")
+			return nil
+		}
+		_, err := buildLabels(ctx, b.dumps, b.s3)
 		return err
-	}
 
-	if err := buildSiteFiles(ctx, "page_items", buildSite, dumps, sites, s3); err != nil {
+	case "coordinates":
+		_, err := buildCoordinates(ctx, b.dumps, b.s3)
 		return err
+
+	case "churn":
+		_, err := buildChurnReport(ctx, b.s3)
+		return err
+
+	case "sqlite":
+		if !b.opts.SQLite {
+			logger.Printf("SQLite database is not needed for this build, skipping")
+			return nil
+		}
+		_, err := buildSQLite(ctx, b.s3)
+		return err
+
+	case PreviewStage:
+		sites, err := b.wikiSites(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = buildPreview(ctx, b.dumps, b.numWeeks, sites, b.opts, b.s3)
+		return err
+
+	case "signatures":
+		if b.opts.SigningKey == nil {
+			logger.Printf("no signing key given, skipping")
+			return nil
+		}
+		_, err := buildSignatures(ctx, b.opts.SigningKey, b.s3)
+		return err
+	}
+
+	if (stage == "links" || stage == "inlinks") && !b.opts.needsInlinks() {
+		logger.Printf("item inlinks are not needed for this build, skipping")
+		return nil
+	}
+
+	// Schemas with a merged_into column handle merged items apart,
+	// so their redirect pages must not count as pages of an item.
+	skipRedirects := b.opts.needsMergedItems()
+
+	var filename, code string
+	var siteBuilder SiteFileBuilder
+	switch stage {
+	case "page-signals":
+		filename = "page_signals"
+		siteBuilder = func(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
+			return buildPageSignals(site, ctx, dumps, b.opts.EnterpriseDumps, b.opts.QualitySignals, skipRedirects, s3)
+		}
+		// Enterprise HTML dumps are not part of the input key.
+		if b.opts.EnterpriseDumps == "" {
+			var variants []string
+			if b.opts.QualitySignals {
+				variants = append(variants, "quality")
+			}
+			if skipRedirects {
+				variants = append(variants, "no-redirects")
+			}
+			code = siteFileCode(filename, strings.Join(variants, "+"))
+		}
+	// Interwiki links and titles are built from the stored page_signals
+	// of the site, and titles also depend on our zstd dictionaries;
+	// none of these are dump files, so they cannot be part of the
+	// input key. Both stages therefore leave the manifest alone.
+	case "interwiki-links":
+		filename, siteBuilder = "interwiki_links", buildInterwikiLinks
+	case "titles":
+		dicts, err := b.zstdDicts(ctx)
+		if err != nil {
+			return err
+		}
+		filename = "titles"
+		siteBuilder = func(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
+			return buildTitles(site, ctx, dumps, dicts, s3)
+		}
+	case "page-items":
+		filename = "page_items"
+		siteBuilder = func(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
+			return buildSite(site, ctx, dumps, skipRedirects, s3)
+		}
+		code = siteFileCode(filename, "")
+		if skipRedirects {
+			code = siteFileCode(filename, "no-redirects")
+		}
+	case "links":
+		dicts, err := b.zstdDicts(ctx)
+		if err != nil {
+			return err
+		}
+		filename = "links"
+		siteBuilder = func(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
+			return buildLinks(site, ctx, dumps, dicts, s3)
+		}
+	case "inlinks":
+		filename, siteBuilder = "inlinks", buildInlinks
+	default:
+		return fmt.Errorf("unknown stage %q", stage)
+	}
+
+	// Per-site files of a test run only cover the sampled items.
+	if code != "" && b.opts.Sample != nil {
+		code += "+sample=" + b.opts.Sample.ID()
 	}
 
-	_, err = buildItemSignals(ctx, pageviews, sites, s3)
+	sites, err := b.wikiSites(ctx)
 	if err != nil {
 		return err
 	}
+	return buildSiteFiles(ctx, filename, code, siteBuilder, b.dumps, sites, b.quarantine, b.s3)
+}
 
-	return nil
+// FindPageviews returns the paths of the weekly pageview files in storage.
+// If the pageviews stage has run before, its result is used.
+func (b *builder) findPageviews(ctx context.Context) ([]string, error) {
+	if b.pageviews != nil {
+		return b.pageviews, nil
+	}
+
+	pageviews, err := findPageviews(ctx, b.opts.pageviewsSource(b.dumps), b.numWeeks, b.s3)
+	if err != nil {
+		return nil, err
+	}
+	b.pageviews = pageviews
+	return pageviews, nil
+}
+
+// WikiSites returns the Wikimedia sites, reading them on first call.
+// Sites that have been quarantined earlier in the run appear with
+// their fallback, see siteQuarantine.apply().
+func (b *builder) wikiSites(ctx context.Context) (*WikiSites, error) {
+	if b.sites != nil {
+		return b.quarantine.apply(b.sites), nil
+	}
+
+	sites, err := ReadWikiSitesWithFallback(ctx, b.client, b.dumps, b.s3, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("found wikimedia dumps for %d sites", len(sites.Sites))
+	if b.opts.Sample != nil {
+		sites = b.opts.Sample.FilterSites(sites)
+		logger.Printf("test run: sampling %d sites and one in %d items", len(sites.Sites), max(b.opts.Sample.ItemRate, 1))
+	}
+	b.sites = sites
+	return b.quarantine.apply(sites), nil
+}
+
+// ZstdDicts returns the zstd dictionaries for compressing small
+// per-site files, or nil if the build does not use dictionaries.
+func (b *builder) zstdDicts(ctx context.Context) (*ZstdDicts, error) {
+	if !b.opts.ZstdDicts || b.dicts != nil {
+		return b.dicts, nil
+	}
+
+	dicts, err := LoadZstdDicts(ctx, b.s3)
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("found %d zstd dictionaries in storage", len(dicts.all))
+	b.dicts = dicts
+	return dicts, nil
 }
 
 type SiteFileBuilder func(site *WikiSite, ctx context.Context, dumps string, s3 S3) error
 
-func buildSiteFiles(ctx context.Context, filename string, builder SiteFileBuilder, dumps string, sites *WikiSites, s3 S3) error {
+// BuildSiteFiles runs a builder for every site whose file for its
+// last dump is not in storage yet. If q is enabled, sites whose
+// builder fails may get quarantined, see quarantineSites().
+//
+// Unless code is empty, files are also keyed by the content of their
+// inputs, see siteInputKey(). If another stored file of the site has
+// been built from the same inputs, it gets copied instead of built;
+// if a stored file has been built by other code, it gets rebuilt.
+// Pass an empty code for builders that read anything else than the
+// database dumps of their site.
+func buildSiteFiles(ctx context.Context, filename string, code string, builder SiteFileBuilder, dumps string, sites *WikiSites, q *siteQuarantine, s3 S3) error {
 	stored, err := ListStoredFiles(ctx, filename, s3)
 	if err != nil {
 		return err
 	}
-	tasks := make(chan WikiSite, len(sites.Sites))
+	manifest := &siteFileManifest{Inputs: map[string]string{}}
+	if code != "" {
+		if manifest, err = readSiteFileManifest(ctx, filename, s3); err != nil {
+			return err
+		}
+	}
+
+	built := make(map[string]string, len(sites.Sites))
+	inputKeys := make(map[string]string, len(sites.Sites))
+	queue := make([]*WikiSite, 0, len(sites.Sites))
+	for _, site := range sites.Sites {
+		ymd := site.LastDumped.Format("20060102")
+		var key string
+		if code != "" {
+			if key, err = siteInputKey(dumps, site, code); err != nil {
+				return err
+			}
+		}
+
+		path := sitePath(filename, site.Key, ymd)
+		if slices.Contains(stored[site.Key], ymd) {
+			recorded, ok := manifest.Inputs[path]
+			if !ok || key == "" || recorded == key {
+				continue
+			}
+			logger.Printf("%s was built from other inputs or code, rebuilding", path)
+		} else if key != "" {
+			if src := manifest.find(filename, site.Key, key, stored[site.Key]); src != "" {
+				dst := minio.CopyDestOptions{Bucket: "qrank", Object: path}
+				src := minio.CopySrcOptions{Bucket: "qrank", Object: src}
+				if _, err := s3.CopyObject(ctx, dst, src); err != nil {
+					return err
+				}
+				logger.Printf("reusing %s for %s, built from identical inputs", src.Object, path)
+				built[site.Key] = ymd
+				inputKeys[site.Key] = key
+				continue
+			}
+		}
+
+		queue = append(queue, site)
+		built[site.Key] = ymd
+		inputKeys[site.Key] = key
+	}
+
+	// Start with the largest sites. If a large site came last, the
+	// stage would keep running on a single CPU long after the others
+	// have finished.
+	sortSitesBySize(queue)
+	progress := newSiteProgress(filename, queue)
+
+	tasks := make(chan WikiSite, len(queue))
+	var pending []string
+	var failures []siteFailure
+	var pendingMutex sync.Mutex // guards pending and failures
 	group, groupCtx := errgroup.WithContext(ctx)
-	for i := 0; i < runtime.NumCPU(); i++ {
+	for i := 0; i < max(resources.MaxSites, 1); i++ {
 		group.Go(func() error {
 			for {
 				select {
@@ -76,21 +690,32 @@ func buildSiteFiles(ctx context.Context, filename string, builder SiteFileBuilde
 					if !more {
 						return nil
 					}
-					if err := builder(&t, ctx, dumps, s3); err != nil {
-						return err
+					if pastBuildDeadline(ctx) {
+						pendingMutex.Lock()
+						pending = append(pending, t.Key)
+						pendingMutex.Unlock()
+						continue
+					}
+					siteCtx, step := startSiteReportStep(ctx, t.Key)
+					err := builder(&t, siteCtx, dumps, s3)
+					step.finish(err)
+					progress.finish(&t)
+					if err != nil {
+						if !q.enabled() || groupCtx.Err() != nil {
+							return err
+						}
+						logger.Printf("building %s for %s failed: %v", filename, t.Key, err)
+						pendingMutex.Lock()
+						failures = append(failures, siteFailure{t.Key, err})
+						pendingMutex.Unlock()
 					}
 				}
 			}
 		})
 	}
 
-	built := make(map[string]string, len(sites.Sites))
-	for _, site := range sites.Sites {
-		ymd := site.LastDumped.Format("20060102")
-		if arr, ok := stored[site.Key]; !ok || !slices.Contains(arr, ymd) {
-			tasks <- *site
-			built[site.Key] = ymd
-		}
+	for _, site := range queue {
+		tasks <- *site
 	}
 	close(tasks)
 
@@ -98,28 +723,64 @@ func buildSiteFiles(ctx context.Context, filename string, builder SiteFileBuilde
 		return err
 	}
 
+	for _, site := range pending {
+		delete(built, site)
+	}
+
+	if err := quarantineSites(ctx, filename, failures, stored, sites, q, s3); err != nil {
+		return err
+	}
+	for _, f := range failures {
+		delete(built, f.site)
+	}
+
 	// Clean up old files. We only touch those wikis for which we built a new file.
 	for site, ymd := range built {
 		versions := append(stored[site], ymd)
 		sort.Strings(versions)
+		versions = slices.Compact(versions)
 		pos := slices.Index(versions, ymd)
 		for i := 0; i < pos-2; i += 1 {
-			path := fmt.Sprintf("%s/%s-%s-%s.zst", filename, site, versions[i], filename)
+			path := sitePath(filename, site, versions[i])
 			opts := minio.RemoveObjectOptions{}
 			if err := s3.RemoveObject(ctx, "qrank", path, opts); err != nil {
 				return err
 			}
+			delete(manifest.Inputs, path)
+		}
+	}
+
+	// Remember the inputs of the new files. If a file got rebuilt
+	// from unknown inputs, its old entry does not apply anymore.
+	if len(built) > 0 && code != "" {
+		for site, ymd := range built {
+			path := sitePath(filename, site, ymd)
+			if key := inputKeys[site]; key != "" {
+				manifest.Inputs[path] = key
+			} else {
+				delete(manifest.Inputs, path)
+			}
+		}
+		if err := manifest.write(ctx, filename, s3); err != nil {
+			return err
 		}
 	}
 
+	if len(pending) > 0 {
+		slices.Sort(pending)
+		reportStepFrom(ctx).addPending(pending...)
+		logger.Printf("maximum runtime exceeded, leaving %s for %d sites to the next run", filename, len(pending))
+		return ErrMaxRuntime
+	}
+
 	return nil
 }
 
-func buildSite(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
+func buildSite(site *WikiSite, ctx context.Context, dumps string, skipRedirects bool, s3 S3) error {
 	dest := site.S3Path("page_items") // TODO: change to "links" once implemented
 	logger.Printf("building %s", dest)
 
-	pageItems, err := buildPageItems(ctx, site, dumps)
+	pageItems, err := buildPageItems(ctx, site, dumps, skipRedirects)
 	if err != nil {
 		return err
 	}
@@ -136,3 +797,55 @@ func buildSite(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
 
 	return nil
 }
+
+// SortSitesBySize sorts sites by decreasing dump size. Sites of equal
+// size, such as those whose size is unknown, are sorted by key.
+func sortSitesBySize(sites []*WikiSite) {
+	slices.SortFunc(sites, func(a, b *WikiSite) int {
+		if c := cmp.Compare(b.DumpSize, a.DumpSize); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+}
+
+// SiteProgress estimates how far a per-site stage has come, by the
+// dump size of the sites it has finished. It logs every ten percent.
+type siteProgress struct {
+	filename string
+	mutex    sync.Mutex
+	sizes    map[string]int64 // site key → dump size, for queued sites
+	total    int64            // sum of sizes, at least 1
+	done     int64            // sum of sizes of finished sites
+	numDone  int
+	logged   int64 // percentage that was last logged
+}
+
+func newSiteProgress(filename string, sites []*WikiSite) *siteProgress {
+	p := &siteProgress{filename: filename, sizes: make(map[string]int64, len(sites))}
+	for _, site := range sites {
+		// Sites of unknown size still count for something.
+		size := max(site.DumpSize, 1)
+		p.sizes[site.Key] = size
+		p.total += size
+	}
+	p.total = max(p.total, 1)
+	return p
+}
+
+// Finish accounts for a site whose file has been built, or whose
+// build has failed, and returns the estimated percentage of work done.
+func (p *siteProgress) finish(site *WikiSite) int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.done += p.sizes[site.Key]
+	p.numDone += 1
+	percent := p.done * 100 / p.total
+	if percent >= p.logged+10 || p.numDone == len(p.sizes) {
+		p.logged = percent - percent%10
+		logger.Printf("building %s: finished %d of %d sites, about %d%% of the work",
+			p.filename, p.numDone, len(p.sizes), percent)
+	}
+	return percent
+}
@@ -6,14 +6,20 @@ package main
 import (
 	"bytes"
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"path/filepath"
 	"reflect"
 	"slices"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 // TestBuild is a large integration test that runs the entire pipeline.
@@ -34,18 +40,22 @@ func TestBuild(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	for len(got) > 0 && strings.HasPrefix(got[0], "#") {
+		got = got[1:]
+	}
 
 	want := []string{
-		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks",
-		"Q72,0,3142,550,85,186",
-		"Q5296,0,2872,0,0,0",
-		"Q54321,0,23,0,0,0",
-		"Q54322,0,24,0,0,0",
-		"Q662541,3,4973,32,9,15",
-		"Q4847311,0,0,0,0,0",
-		"Q5649951,0,0,1,0,20",
-		"Q8681970,0,5678,0,0,0",
-		"Q107661323,0,3470,0,0,0",
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes",
+		"Q72,0,3142,550,85,186,0,0,0",
+		"Q5296,0,2872,0,0,0,0,0,0",
+		"Q54321,0,23,0,0,0,0,0,0",
+		"Q54322,0,24,0,0,0,0,0,0",
+		"Q662541,3,4973,32,9,15,0,0,0",
+		"Q4115189,0,0,0,0,0,0,0,0",
+		"Q4847311,0,0,0,0,0,0,0,0",
+		"Q5649951,0,0,1,0,20,0,0,0",
+		"Q8681970,0,5678,0,0,0,0,0,0",
+		"Q107661323,0,3470,0,0,0,0,0,0",
 	}
 
 	if !slices.Equal(got, want) {
@@ -53,6 +63,122 @@ func TestBuild(t *testing.T) {
 	}
 }
 
+// Building twice from the same inputs must produce byte-identical
+// outputs, so that diffs between releases only show actual changes.
+func TestBuild_Reproducible(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	dumps := filepath.Join("testdata", "dumps")
+	var runs [2]*FakeS3
+	for i := range runs {
+		client := &http.Client{Transport: &FakeWikiSite{}}
+		runs[i] = NewFakeS3()
+		if err := Build(client, dumps /*numWeeks*/, 1, runs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(runs[0].data) != len(runs[1].data) {
+		t.Fatalf("got %d vs. %d files in storage", len(runs[0].data), len(runs[1].data))
+	}
+	for path, first := range runs[0].data {
+		// Build reports record timings, which differ between runs,
+		// and the cached interwiki map records when it was fetched.
+		if strings.HasPrefix(path, "internal/qrank-builder/") || interwikiMapPathRegexp.MatchString(path) {
+			continue
+		}
+		if second, ok := runs[1].data[path]; !ok {
+			t.Errorf("%s: missing in second run", path)
+		} else if !bytes.Equal(first, second) {
+			t.Errorf("%s: content differs between runs", path)
+		}
+	}
+}
+
+func TestBuildStage_Unknown(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	dumps := filepath.Join("testdata", "dumps")
+	s3 := NewFakeS3()
+	if err := BuildStage(nil, dumps, 1, s3, BuildOptions{}, "titles", "foo"); err == nil {
+		t.Error("expected error for unknown stage")
+	}
+	if len(s3.data) != 0 {
+		t.Errorf("unknown stage should not build anything, got %d objects in storage", len(s3.data))
+	}
+}
+
+// Running item-signals as a separate stage should fail cleanly
+// when the pageviews stage has not been run yet.
+func TestBuildStage_MissingPageviews(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	dumps := filepath.Join("testdata", "dumps")
+	s3 := NewFakeS3()
+	err := BuildStage(nil, dumps, 1, s3, BuildOptions{}, "item-signals")
+	if err == nil || !strings.Contains(err.Error(), "run stage pageviews first") {
+		t.Errorf("want error about missing pageviews, got %v", err)
+	}
+}
+
+// The item-signals stage reports the distribution of pageviews in the
+// stats, and the sqlite stage gives each item its percentile and bucket.
+func TestBuildStage_Distribution(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	dumps := filepath.Join("testdata", "dumps")
+	client := &http.Client{Transport: &FakeWikiSite{}}
+	s3 := NewFakeS3()
+	stages := []string{"pageviews", "page-signals", "item-signals", "sqlite"}
+	if err := BuildStage(client, dumps, 1, s3, BuildOptions{SQLite: true}, stages...); err != nil {
+		t.Fatal(err)
+	}
+
+	var stats SignalStats
+	if err := json.Unmarshal(s3.data["public/qrank-stats-20240501.json"], &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Distribution) != len(distributionPercents) {
+		t.Fatalf("got distribution %v, want %d points", stats.Distribution, len(distributionPercents))
+	}
+	if last := stats.Distribution[len(stats.Distribution)-1]; last.Percent != 100 || last.Rank != stats.Items {
+		t.Errorf("got last distribution point %+v, want 100%% at rank %d", last, stats.Items)
+	}
+	var bucketed int64
+	for _, n := range stats.Buckets {
+		bucketed += n
+	}
+	if bucketed != stats.Items || stats.Buckets[9] == 0 {
+		t.Errorf("got buckets %v for %d items", stats.Buckets, stats.Items)
+	}
+
+	path := filepath.Join(t.TempDir(), "qrank.sqlite")
+	if err := os.WriteFile(path, s3.data["public/qrank-20240501.sqlite"], 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var percentile, bucket, missing int64
+	row := db.QueryRow("SELECT percentile, bucket FROM item_signals WHERE rank = 1")
+	if err := row.Scan(&percentile, &bucket); err != nil {
+		t.Fatal(err)
+	}
+	if want := 100 * (stats.Items - 1) / stats.Items; percentile != want || bucket != 10 {
+		t.Errorf("top item: got percentile %d, bucket %d; want %d, 10", percentile, bucket, want)
+	}
+	row = db.QueryRow("SELECT COUNT(*) FROM item_signals WHERE percentile IS NULL OR bucket IS NULL")
+	if err := row.Scan(&missing); err != nil || missing != 0 {
+		t.Errorf("got %d items without percentile or bucket, err=%v", missing, err)
+	}
+}
+
 func TestBuildSiteFiles(t *testing.T) {
 	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
 	ctx := context.Background()
@@ -76,7 +202,7 @@ func TestBuildSiteFiles(t *testing.T) {
 		return nil
 	}
 
-	if err := buildSiteFiles(ctx, "foobar", buildFunc, dumps, sites, s3); err != nil {
+	if err := buildSiteFiles(ctx, "foobar", "", buildFunc, dumps, sites, nil, s3); err != nil {
 		t.Fatal(err)
 	}
 
@@ -101,3 +227,99 @@ func TestBuildSiteFiles(t *testing.T) {
 		t.Errorf("got %q, want %q", got, want)
 	}
 }
+
+func TestSortSitesBySize(t *testing.T) {
+	sites := []*WikiSite{
+		{Key: "rmwiki", DumpSize: 1864},
+		{Key: "loginwiki"},
+		{Key: "enwiki", DumpSize: 50_000_000_000},
+		{Key: "aawiki"},
+		{Key: "wikidatawiki", DumpSize: 120_000_000_000},
+	}
+	sortSitesBySize(sites)
+	got := make([]string, len(sites))
+	for i, site := range sites {
+		got[i] = site.Key
+	}
+	want := []string{"wikidatawiki", "enwiki", "rmwiki", "aawiki", "loginwiki"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSiteProgress(t *testing.T) {
+	var buf bytes.Buffer
+	logger = log.New(&buf, "", 0)
+	sites := []*WikiSite{
+		{Key: "wikidatawiki", DumpSize: 600},
+		{Key: "enwiki", DumpSize: 300},
+		{Key: "rmwiki", DumpSize: 99},
+		{Key: "loginwiki"},
+	}
+	p := newSiteProgress("titles", sites)
+	var got []int64
+	for _, site := range sites {
+		got = append(got, p.finish(site))
+	}
+	if want := []int64{60, 90, 99, 100}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	wantLog := "building titles: finished 1 of 4 sites, about 60% of the work\n" +
+		"building titles: finished 2 of 4 sites, about 90% of the work\n" +
+		"building titles: finished 4 of 4 sites, about 100% of the work\n"
+	if buf.String() != wantLog {
+		t.Errorf("got log %q, want %q", buf.String(), wantLog)
+	}
+}
+
+func TestBuildSiteFiles_Deadline(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := withBuildReport(context.Background(), NewBuildReport(time.Now()))
+	ctx, step := startReportStep(ctx, "titles")
+	ctx = withBuildDeadline(ctx, time.Now().Add(-time.Minute))
+	s3 := NewFakeS3()
+	s3.data["foobar/rmwiki-20010203-foobar.zst"] = []byte("old-2001")
+	s3.data["foobar/rmwiki-20020203-foobar.zst"] = []byte("old-2002")
+	s3.data["foobar/rmwiki-20030203-foobar.zst"] = []byte("old-2003")
+	s3.data["foobar/wikidatawiki-20240401-foobar.zst"] = []byte("done")
+
+	dumps := filepath.Join("testdata", "dumps")
+	sites, err := ReadWikiSites(nil, dumps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buildFunc := func(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
+		t.Errorf("should not build %s after the deadline", site.Key)
+		return nil
+	}
+	err = buildSiteFiles(ctx, "foobar", "", buildFunc, dumps, sites, nil, s3)
+	if !errors.Is(err, ErrMaxRuntime) {
+		t.Errorf("got %v, want ErrMaxRuntime", err)
+	}
+
+	// Old files of sites that have not been built must be kept.
+	if len(s3.data) != 4 {
+		t.Errorf("storage should be unchanged, got %d objects", len(s3.data))
+	}
+	want := []string{"itwikibooks", "loginwiki", "rmwiki", "rmwikibooks"}
+	if !slices.Equal(step.Pending, want) {
+		t.Errorf("got pending %q, want %q", step.Pending, want)
+	}
+}
+
+func TestBuildStage_Deadline(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	dumps := filepath.Join("testdata", "dumps")
+	s3 := NewFakeS3()
+	opts := BuildOptions{Deadline: time.Now().Add(-time.Minute)}
+	err := BuildStage(nil, dumps, 1, s3, opts, "pageviews", "page-signals")
+	if !errors.Is(err, ErrMaxRuntime) {
+		t.Errorf("got %v, want ErrMaxRuntime", err)
+	}
+	for key := range s3.data {
+		if !strings.HasPrefix(key, "internal/qrank-builder/") {
+			t.Errorf("should not build anything after the deadline, got %s", key)
+		}
+	}
+}
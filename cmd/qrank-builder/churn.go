@@ -0,0 +1,318 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/brawer/wikidata-qrank/v2/pkg/qrank"
+)
+
+// Parameters of the churn report.
+const (
+	// The churn report compares the ranks of this many top-ranked
+	// items in two releases. The long tail of hardly viewed items
+	// shuffles around randomly, so we would only measure noise there.
+	churnTopItems = 1000000
+
+	// An item counts as moved if its rank changed by more than
+	// this many places between two releases.
+	churnMoveThreshold = 1000
+
+	// The churn report lists this many items that rose most,
+	// and this many that fell most.
+	numTopMovers = 25
+)
+
+// ChurnReport tells how stable the ranking has been between two
+// consecutive releases. It gets published as qrank-churn-YYYYMMDD.json.
+type ChurnReport struct {
+	Version         string `json:"version"`
+	PreviousVersion string `json:"previous_version"`
+
+	// The number of top-ranked items that were compared in each release,
+	// and how many of them were among the top items of both releases.
+	TopItems int64 `json:"top_items"`
+	Common   int64 `json:"common"`
+
+	// Rank correlation of the items that are among the top items of
+	// both releases. Both are 1.0 if the order has not changed at all,
+	// and -1.0 if it has been reversed.
+	KendallTau float64 `json:"kendall_tau"`
+	Spearman   float64 `json:"spearman"`
+
+	// The number of common items whose rank changed by more than
+	// MoveThreshold places.
+	MoveThreshold int64 `json:"move_threshold"`
+	Moved         int64 `json:"moved"`
+
+	// The common items that rose and fell the most places.
+	TopRisers  []RankMove `json:"top_risers"`
+	TopFallers []RankMove `json:"top_fallers"`
+}
+
+// RankMove is the change of rank of an item between two releases.
+// Rank 1 is the most viewed item.
+type RankMove struct {
+	Item         string `json:"item"`
+	Rank         int64  `json:"rank"`
+	PreviousRank int64  `json:"previous_rank"`
+}
+
+// StoragePath returns the path of the report in S3 storage.
+func (r *ChurnReport) StoragePath() string {
+	t, _ := time.Parse(time.DateOnly, r.Version)
+	return PublicPath("qrank-churn", t, "json")
+}
+
+// BuildChurnReport compares the two most recent releases of item signals
+// in storage, and publishes a report about how much the ranking has
+// changed. If storage has fewer than two releases, or the report has
+// been built before, nothing gets done.
+func buildChurnReport(ctx context.Context, s3 S3) (*ChurnReport, error) {
+	releases, err := listItemSignalsReleases(ctx, s3)
+	if err != nil {
+		return nil, err
+	}
+	if len(releases) < 2 {
+		logger.Printf("need two releases of item signals for a churn report, found %d", len(releases))
+		return nil, nil
+	}
+
+	prev, cur := releases[len(releases)-2], releases[len(releases)-1]
+	report := &ChurnReport{
+		Version:         cur.Format(time.DateOnly),
+		PreviousVersion: prev.Format(time.DateOnly),
+	}
+	dest := report.StoragePath()
+	if found, err := objectExists(ctx, dest, s3); err != nil {
+		return nil, err
+	} else if found {
+		return report, nil
+	}
+
+	logger.Printf("building %s", dest)
+	start := time.Now()
+	prevTop, err := readTopRanked(ctx, PublicPath("item_signals", prev, "csv.zst"), churnTopItems, s3)
+	if err != nil {
+		return nil, err
+	}
+	curTop, err := readTopRanked(ctx, PublicPath("item_signals", cur, "csv.zst"), churnTopItems, s3)
+	if err != nil {
+		return nil, err
+	}
+	compareRankings(report, prevTop, curTop, churnMoveThreshold, numTopMovers)
+	report.TopItems = churnTopItems
+
+	if err := PutJSON(ctx, report, s3, "qrank", dest); err != nil {
+		return nil, err
+	}
+	logger.Printf("built %s in %.1fs; kendall_tau=%.4f, spearman=%.4f, moved=%d",
+		dest, time.Since(start).Seconds(), report.KendallTau, report.Spearman, report.Moved)
+	return report, nil
+}
+
+// ListItemSignalsReleases returns the versions of the item_signals
+// files in storage, sorted from oldest to newest.
+func listItemSignalsReleases(ctx context.Context, s3 S3) ([]time.Time, error) {
+	re := regexp.MustCompile(`^public/item_signals-(\d{8}).csv.zst$`)
+	releases := make([]time.Time, 0, 8)
+	opts := minio.ListObjectsOptions{Prefix: "public/item_signals-"}
+	for obj := range s3.ListObjects(ctx, "qrank", opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if match := re.FindStringSubmatch(obj.Key); match != nil {
+			if t, err := time.Parse("20060102", match[1]); err == nil {
+				releases = append(releases, t)
+			}
+		}
+	}
+	slices.SortFunc(releases, func(a, b time.Time) int { return a.Compare(b) })
+	return releases, nil
+}
+
+// ObjectExists tells whether storage has an object at path.
+func objectExists(ctx context.Context, path string, s3 S3) (bool, error) {
+	for obj := range s3.ListObjects(ctx, "qrank", minio.ListObjectsOptions{Prefix: path}) {
+		if obj.Err != nil {
+			return false, obj.Err
+		}
+		if obj.Key == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ReadTopRanked reads an item_signals file, and returns its n most viewed
+// items in order of rank. Rows for merged items are skipped, since they
+// are copies of the item they have been merged into.
+func readTopRanked(ctx context.Context, path string, n int, s3 S3) ([]int64, error) {
+	opts := S3ReaderOptions{Compression: ZstdCompressed}
+	r, err := NewS3ReaderWithOptions(ctx, "qrank", path, s3, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	reader, err := qrank.NewItemSignalsReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	top := NewClassRanks([]int64{0}, n)
+	for {
+		sig, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if sig.MergedInto != "" {
+			continue
+		}
+		item := ParseItem(sig.Item)
+		if item == NoItem {
+			return nil, fmt.Errorf("%s: bad item %q", path, sig.Item)
+		}
+		top.Add(int64(item), 0, sig.Pageviews)
+	}
+
+	ranked := top.Top(0)
+	items := make([]int64, len(ranked))
+	for i, r := range ranked {
+		items[i] = r.Item
+	}
+	return items, nil
+}
+
+// CompareRankings fills out a churn report for two rankings, which
+// list items in order of rank.
+func compareRankings(report *ChurnReport, prev, cur []int64, moveThreshold int64, numMovers int) {
+	prevRanks := make(map[int64]int64, len(prev))
+	for i, item := range prev {
+		prevRanks[item] = int64(i + 1)
+	}
+
+	moves := make([]RankMove, 0, len(cur))
+	for i, item := range cur {
+		if prevRank, ok := prevRanks[item]; ok {
+			moves = append(moves, RankMove{
+				Item:         fmt.Sprintf("Q%d", item),
+				Rank:         int64(i + 1),
+				PreviousRank: prevRank,
+			})
+		}
+	}
+
+	report.Common = int64(len(moves))
+	report.MoveThreshold = moveThreshold
+	report.Moved = 0
+	for _, m := range moves {
+		if diff := m.Rank - m.PreviousRank; diff > moveThreshold || -diff > moveThreshold {
+			report.Moved += 1
+		}
+	}
+
+	// Moves are sorted by current rank. For the correlations, we need
+	// the current positions of the common items, in previous order.
+	perm := make([]int64, len(moves))
+	for i := range perm {
+		perm[i] = int64(i)
+	}
+	slices.SortFunc(perm, func(a, b int64) int {
+		return cmp.Compare(moves[a].PreviousRank, moves[b].PreviousRank)
+	})
+	report.KendallTau = kendallTau(perm)
+	report.Spearman = spearman(perm)
+
+	risers := slices.Clone(moves)
+	slices.SortStableFunc(risers, func(a, b RankMove) int {
+		return cmp.Compare(b.PreviousRank-b.Rank, a.PreviousRank-a.Rank)
+	})
+	report.TopRisers = topMoves(risers, numMovers, func(m RankMove) bool { return m.Rank < m.PreviousRank })
+
+	fallers := slices.Clone(moves)
+	slices.SortStableFunc(fallers, func(a, b RankMove) int {
+		return cmp.Compare(b.Rank-b.PreviousRank, a.Rank-a.PreviousRank)
+	})
+	report.TopFallers = topMoves(fallers, numMovers, func(m RankMove) bool { return m.Rank > m.PreviousRank })
+}
+
+func topMoves(moves []RankMove, n int, keep func(RankMove) bool) []RankMove {
+	result := make([]RankMove, 0, n)
+	for _, m := range moves {
+		if len(result) >= n || !keep(m) {
+			break
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+// KendallTau returns the Kendall rank correlation between the identity
+// permutation and perm, which must be a permutation of 0..len(perm)-1.
+// The inversions get counted by merge sort, which takes O(n log n) time
+// instead of comparing all O(n²) pairs.
+func kendallTau(perm []int64) float64 {
+	n := len(perm)
+	if n < 2 {
+		return 1.0
+	}
+	buf := slices.Clone(perm)
+	inversions := countInversions(buf, make([]int64, n))
+	pairs := float64(n) * float64(n-1) / 2.0
+	return 1.0 - 2.0*float64(inversions)/pairs
+}
+
+// CountInversions sorts a, and returns the number of pairs that were
+// out of order. Tmp is scratch space of the same length as a.
+func countInversions(a, tmp []int64) int64 {
+	n := len(a)
+	if n < 2 {
+		return 0
+	}
+	mid := n / 2
+	count := countInversions(a[:mid], tmp[:mid]) + countInversions(a[mid:], tmp[mid:])
+	i, j, k := 0, mid, 0
+	for i < mid && j < n {
+		if a[i] <= a[j] {
+			tmp[k] = a[i]
+			i += 1
+		} else {
+			tmp[k] = a[j]
+			count += int64(mid - i)
+			j += 1
+		}
+		k += 1
+	}
+	k += copy(tmp[k:], a[i:mid])
+	copy(tmp[k:], a[j:])
+	copy(a, tmp[:n])
+	return count
+}
+
+// Spearman returns the Spearman rank correlation between the identity
+// permutation and perm, which must be a permutation of 0..len(perm)-1.
+func spearman(perm []int64) float64 {
+	n := float64(len(perm))
+	if n < 2 {
+		return 1.0
+	}
+	var sumSquares float64
+	for i, p := range perm {
+		d := float64(int64(i) - p)
+		sumSquares += d * d
+	}
+	return 1.0 - 6.0*sumSquares/(n*(n*n-1.0))
+}
@@ -0,0 +1,125 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestBuildChurnReport(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+
+	// With a single release, there is nothing to compare.
+	header := "item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks"
+	err := s3.WriteLines([]string{
+		header,
+		"Q1,500,0,0,0,0",
+		"Q2,400,0,0,0,0",
+		"Q3,300,0,0,0,0",
+		"Q4,200,0,0,0,0",
+	}, "public/item_signals-20240421.csv.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report, err := buildChurnReport(ctx, s3); err != nil || report != nil {
+		t.Fatalf("got %v, %v; want nil, nil", report, err)
+	}
+
+	err = s3.WriteLines([]string{
+		"# schema: 5",
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes,pageviews_52w_max_wiki,class,merged_into",
+		"Q1,500,0,0,0,0,0,0,0,0,,",
+		"Q2,100,0,0,0,0,0,0,0,0,,",
+		"Q3,300,0,0,0,0,0,0,0,0,,",
+		"Q5,900,0,0,0,0,0,0,0,0,,",
+		"Q6,500,0,0,0,0,0,0,0,0,,Q1",
+	}, "public/item_signals-20240428.csv.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := buildChurnReport(ctx, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got ChurnReport
+	if err := json.Unmarshal(s3.data["public/qrank-churn-20240428.json"], &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != "2024-04-28" || got.PreviousVersion != "2024-04-21" {
+		t.Errorf("got versions %q, %q", got.Version, got.PreviousVersion)
+	}
+	if got.Common != 3 || report.Common != 3 {
+		t.Errorf("got %d common items, want 3", got.Common)
+	}
+	if len(got.TopRisers) != 0 {
+		t.Errorf("got risers %v, want none", got.TopRisers)
+	}
+	want := []RankMove{
+		{Item: "Q2", Rank: 4, PreviousRank: 2},
+		{Item: "Q1", Rank: 2, PreviousRank: 1},
+	}
+	if !slices.Equal(got.TopFallers, want) {
+		t.Errorf("got fallers %v, want %v", got.TopFallers, want)
+	}
+}
+
+func TestCompareRankings(t *testing.T) {
+	var report ChurnReport
+	compareRankings(&report, []int64{1, 2, 3, 4, 5}, []int64{1, 2, 3, 4, 5}, 1, 3)
+	if report.KendallTau != 1.0 || report.Spearman != 1.0 || report.Moved != 0 {
+		t.Errorf("unchanged ranking: got %+v", report)
+	}
+
+	compareRankings(&report, []int64{1, 2, 3, 4, 5}, []int64{5, 4, 3, 2, 1}, 1, 3)
+	if report.KendallTau != -1.0 || report.Spearman != -1.0 || report.Moved != 4 {
+		t.Errorf("reversed ranking: got %+v", report)
+	}
+	wantRisers := []RankMove{
+		{Item: "Q5", Rank: 1, PreviousRank: 5},
+		{Item: "Q4", Rank: 2, PreviousRank: 4},
+	}
+	if !slices.Equal(report.TopRisers, wantRisers) {
+		t.Errorf("got risers %v, want %v", report.TopRisers, wantRisers)
+	}
+
+	// Item 9 is new, and item 3 has dropped out of the ranking.
+	compareRankings(&report, []int64{1, 2, 3, 4}, []int64{2, 1, 9, 4}, 0, 3)
+	if report.Common != 3 || report.Moved != 2 {
+		t.Errorf("got common=%d moved=%d, want 3, 2", report.Common, report.Moved)
+	}
+	if want := 1.0 / 3.0; math.Abs(report.KendallTau-want) > 1e-9 {
+		t.Errorf("got kendall_tau=%f, want %f", report.KendallTau, want)
+	}
+	if want := 0.5; math.Abs(report.Spearman-want) > 1e-9 {
+		t.Errorf("got spearman=%f, want %f", report.Spearman, want)
+	}
+}
+
+func TestKendallTau(t *testing.T) {
+	for _, tc := range []struct {
+		perm []int64
+		want float64
+	}{
+		{[]int64{}, 1.0},
+		{[]int64{0}, 1.0},
+		{[]int64{0, 1, 2, 3}, 1.0},
+		{[]int64{3, 2, 1, 0}, -1.0},
+		{[]int64{1, 0, 2, 3}, 1.0 - 2.0/6.0},
+		{[]int64{0, 3, 1, 2}, 1.0 - 4.0/6.0},
+	} {
+		if got := kendallTau(tc.perm); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("got %f for %v, want %f", got, tc.perm, tc.want)
+		}
+	}
+}
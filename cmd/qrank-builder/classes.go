@@ -0,0 +1,132 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lanrat/extsort"
+)
+
+// BuildClasses extracts the class (P31, “instance of”) of Wikidata items
+// from the truthy dump, and puts it into storage. The output has lines
+// such as "Q72,Q515", sorted by item. Many items are instances of several
+// classes, such as Q72 (Zürich) being a city, a big city, and a capital;
+// we only keep the first class that is listed for the item.
+func buildClasses(ctx context.Context, dumps string, s3 S3) (string, error) {
+	return buildFromTruthyDump(ctx, dumps, "classes", readClasses, s3)
+}
+
+// ReadClasses reads a Wikidata dump in N-Triples format, and emits
+// lines such as "Q72,Q515" for the first P31 statement of every item.
+// In the truthy dumps, all statements of an entity are next to each
+// other, so we can drop the later classes while streaming.
+func readClasses(ctx context.Context, r io.Reader, out chan<- string) error {
+	scanner := bufio.NewScanner(r)
+	maxLineSize := 1024 * 1024
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	lastItem := ""
+	for scanner.Scan() {
+		item, class, ok := parseClassTriple(scanner.Bytes())
+		if !ok || item == lastItem {
+			continue
+		}
+		lastItem = item
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- item + "," + class:
+		}
+	}
+	return scanner.Err()
+}
+
+var truthyP31 = []byte("> <http://www.wikidata.org/prop/direct/P31> ")
+
+// ParseClassTriple parses a line of the truthy dump, returning
+// the item and its class if the line is a P31 statement whose
+// value is an item. A typical line looks like this:
+//
+//	<http://www.wikidata.org/entity/Q72> <http://www.wikidata.org/prop/direct/P31>
+//	<http://www.wikidata.org/entity/Q515> .
+func parseClassTriple(line []byte) (item string, class string, ok bool) {
+	if !bytes.HasPrefix(line, truthyEntityPrefix) {
+		return "", "", false
+	}
+	pos := bytes.Index(line, truthyP31)
+	if pos < 0 {
+		return "", "", false
+	}
+
+	// The entity prefix ends with "Q", which is part of the item ID.
+	id := line[len(truthyEntityPrefix)-1 : pos]
+	if len(id) < 2 || bytes.IndexFunc(id[1:], isNotDigit) >= 0 {
+		return "", "", false
+	}
+
+	value := line[pos+len(truthyP31):]
+	if !bytes.HasPrefix(value, truthyEntityPrefix) {
+		return "", "", false
+	}
+	end := bytes.IndexByte(value, '>')
+	if end < 0 {
+		return "", "", false
+	}
+	cls := value[len(truthyEntityPrefix)-1 : end]
+	if len(cls) < 2 || bytes.IndexFunc(cls[1:], isNotDigit) >= 0 {
+		return "", "", false
+	}
+
+	return string(id), string(cls), true
+}
+
+// FindClasses returns the storage path of the most recent classes file.
+func findClasses(ctx context.Context, s3 S3) (string, error) {
+	stored, err := ListStoredFiles(ctx, "classes", s3)
+	if err != nil {
+		return "", err
+	}
+	versions := stored["wikidatawiki"]
+	if len(versions) == 0 {
+		return "", fmt.Errorf("no item classes in storage; run the classes stage first")
+	}
+	return sitePath("classes", "wikidatawiki", versions[len(versions)-1]), nil
+}
+
+// SendClasses reads a classes file with lines such as "Q72,Q515",
+// and emits ItemSignals that only carry the item and its class.
+func sendClasses(ctx context.Context, r io.Reader, out chan<- extsort.SortType) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		item, class, ok := parseClassLine(line)
+		if !ok {
+			return fmt.Errorf(`bad line in classes: "%s"`, line)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- ItemSignals{item: item, class: class}:
+		}
+	}
+	return scanner.Err()
+}
+
+// ParseClassLine parses a line such as "Q72,Q515" into 72 and 515.
+func parseClassLine(line string) (item int64, class int64, ok bool) {
+	itemStr, classStr, found := strings.Cut(line, ",")
+	if !found || !strings.HasPrefix(itemStr, "Q") || !strings.HasPrefix(classStr, "Q") {
+		return 0, 0, false
+	}
+	i, c := ParseItem(itemStr), ParseItem(classStr)
+	if i == NoItem || c == NoItem {
+		return 0, 0, false
+	}
+	return int64(i), int64(c), true
+}
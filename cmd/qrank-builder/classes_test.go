@@ -0,0 +1,136 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/lanrat/extsort"
+)
+
+func TestBuildClasses(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	dumps := filepath.Join("testdata", "dumps")
+	s3 := NewFakeS3()
+	s3.data["classes/wikidatawiki-20240301-classes.zst"] = []byte("old")
+	s3.data["classes/wikidatawiki-20240315-classes.zst"] = []byte("previous")
+
+	path, err := buildClasses(ctx, dumps, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "classes/wikidatawiki-20240401-classes.zst"; path != want {
+		t.Errorf("got %q, want %q", path, want)
+	}
+
+	got, err := s3.ReadLines(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Q662541,Q532", "Q72,Q515"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, ok := s3.data["classes/wikidatawiki-20240301-classes.zst"]; ok {
+		t.Error("old version should have been deleted")
+	}
+	if _, ok := s3.data["classes/wikidatawiki-20240315-classes.zst"]; !ok {
+		t.Error("previous version should have been kept")
+	}
+
+	found, err := findClasses(ctx, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != path {
+		t.Errorf("findClasses() returned %q, want %q", found, path)
+	}
+}
+
+func TestFindClasses_Missing(t *testing.T) {
+	if _, err := findClasses(context.Background(), NewFakeS3()); err == nil {
+		t.Error("expected error when no classes are in storage")
+	}
+}
+
+func TestReadClasses(t *testing.T) {
+	input := strings.Join([]string{
+		`<http://www.wikidata.org/entity/Q72> <http://www.wikidata.org/prop/direct/P31> <http://www.wikidata.org/entity/Q515> .`,
+		`<http://www.wikidata.org/entity/Q72> <http://www.wikidata.org/prop/direct/P31> <http://www.wikidata.org/entity/Q1549591> .`,
+		`<http://www.wikidata.org/entity/Q72> <http://www.wikidata.org/prop/direct/P625> "Point(8.541111 47.374444)"^^<http://www.opengis.net/ont/geosparql#wktLiteral> .`,
+		`<http://www.wikidata.org/entity/Q1> <http://www.wikidata.org/prop/direct/P31> <http://www.wikidata.org/entity/Q5> .`,
+	}, "\n")
+	ch := make(chan string, 10)
+	if err := readClasses(context.Background(), strings.NewReader(input), ch); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	got := make([]string, 0, 2)
+	for line := range ch {
+		got = append(got, line)
+	}
+	want := []string{"Q72,Q515", "Q1,Q5"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParseClassTriple(t *testing.T) {
+	const prefix = `<http://www.wikidata.org/entity/`
+	const p31 = `> <http://www.wikidata.org/prop/direct/P31> `
+	for _, tc := range []struct {
+		line  string
+		item  string
+		class string
+		ok    bool
+	}{
+		{prefix + "Q72" + p31 + prefix + "Q515> .", "Q72", "Q515", true},
+		{prefix + "Q72" + p31 + prefix + "Q> .", "", "", false},
+		{prefix + "Q72" + p31 + prefix + "Q5x> .", "", "", false},
+		{prefix + "Q72" + p31 + prefix + "Q515", "", "", false},
+		{prefix + "Q72" + p31 + `"Q515" .`, "", "", false},
+		{prefix + "Q" + p31 + prefix + "Q515> .", "", "", false},
+		{prefix + "P31" + p31 + prefix + "Q515> .", "", "", false},
+		{prefix + "Q72> <http://www.wikidata.org/prop/direct/P17> " + prefix + "Q39> .", "", "", false},
+		{"", "", "", false},
+	} {
+		item, class, ok := parseClassTriple([]byte(tc.line))
+		if item != tc.item || class != tc.class || ok != tc.ok {
+			t.Errorf("got (%q, %q, %v) for %q, want (%q, %q, %v)",
+				item, class, ok, tc.line, tc.item, tc.class, tc.ok)
+		}
+	}
+}
+
+func TestSendClasses(t *testing.T) {
+	ch := make(chan extsort.SortType, 10)
+	if err := sendClasses(context.Background(), strings.NewReader("Q72,Q515\nQ1,Q5\n"), ch); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	got := make([]ItemSignals, 0, 2)
+	for s := range ch {
+		got = append(got, s.(ItemSignals))
+	}
+	want := []ItemSignals{{item: 72, class: 515}, {item: 1, class: 5}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{"Q72", "Q72,515", "L72,Q5", "Q72,Q-5"} {
+		ch := make(chan extsort.SortType, 10)
+		if err := sendClasses(context.Background(), strings.NewReader(bad), ch); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ClassRanks collects the top-ranked items for a list of classes,
+// such as the 1000 most viewed humans (Q5) or cities (Q515). Some
+// users only need a ranking for one kind of entity, and they would
+// otherwise need to join the entire QRank file with a Wikidata dump.
+type ClassRanks struct {
+	size    int
+	classes map[int64]*classRankHeap
+}
+
+// ClassRank is the rank of an item within its class.
+type ClassRank struct {
+	Item int64
+	Rank int64
+}
+
+// NewClassRanks returns an empty collector for the top size items
+// in each of the given classes.
+func NewClassRanks(classes []int64, size int) *ClassRanks {
+	r := &ClassRanks{size: size, classes: make(map[int64]*classRankHeap, len(classes))}
+	for _, c := range classes {
+		r.classes[c] = &classRankHeap{}
+	}
+	return r
+}
+
+// Add accounts for the rank of an item. Items whose class is not
+// among the collected classes get ignored.
+func (r *ClassRanks) Add(item, class, rank int64) {
+	if r == nil || r.size <= 0 {
+		return
+	}
+	h, ok := r.classes[class]
+	if !ok {
+		return
+	}
+	cr := ClassRank{Item: item, Rank: rank}
+	if h.Len() < r.size {
+		heap.Push(h, cr)
+	} else if classRankLess((*h)[0], cr) {
+		(*h)[0] = cr
+		heap.Fix(h, 0)
+	}
+}
+
+// Top returns the collected items of a class, sorted by decreasing
+// rank. Items of equal rank are sorted by ascending item ID.
+func (r *ClassRanks) Top(class int64) []ClassRank {
+	if r == nil {
+		return nil
+	}
+	h, ok := r.classes[class]
+	if !ok {
+		return nil
+	}
+	result := slices.Clone(*h)
+	slices.SortFunc(result, func(a, b ClassRank) int {
+		if c := cmp.Compare(b.Rank, a.Rank); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Item, b.Item)
+	})
+	return result
+}
+
+// ParseClassList parses a comma-separated list of classes,
+// such as "Q5,Q515", into their numeric IDs.
+func ParseClassList(s string) ([]int64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	classes := make([]int64, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		item := ParseItem(p)
+		if item == NoItem || !strings.HasPrefix(p, "Q") {
+			return nil, fmt.Errorf("bad class %q, expected a Wikidata item such as Q5", p)
+		}
+		if !slices.Contains(classes, int64(item)) {
+			classes = append(classes, int64(item))
+		}
+	}
+	return classes, nil
+}
+
+// ClassRankPath returns the storage path of the ranking for a class,
+// such as public/qrank-class-q5-20240428.csv.zst for Q5.
+func classRankPath(class int64, version time.Time) string {
+	return PublicPath(fmt.Sprintf("qrank-class-q%d", class), version, "csv.zst")
+}
+
+// Put stores the ranking of each class in storage. The comments,
+// such as a summary of the provenance, go before the CSV header.
+func (r *ClassRanks) Put(ctx context.Context, version time.Time, comments []string, s3 S3) error {
+	if r == nil {
+		return nil
+	}
+
+	classes := make([]int64, 0, len(r.classes))
+	for c := range r.classes {
+		classes = append(classes, c)
+	}
+	slices.Sort(classes)
+	for _, c := range classes {
+		if err := r.put(ctx, c, version, comments, s3); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ClassRanks) put(ctx context.Context, class int64, version time.Time, comments []string, s3 S3) error {
+	outFile, err := os.CreateTemp("", "qrank-class-*.csv.zst")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(outFile.Name())
+	defer outFile.Close()
+
+	writer, err := zstd.NewWriter(outFile, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	if err := writeClassRanks(r.Top(class), comments, writer); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := outFile.Close(); err != nil {
+		return err
+	}
+
+	dest := classRankPath(class, version)
+	return PutInStorage(ctx, outFile.Name(), s3, "qrank", dest, "application/zstd")
+}
+
+// WriteClassRanks writes a ranking in the same CSV format as the
+// main QRank file, with lines such as "Q72,5719". The comments
+// go before the header.
+func writeClassRanks(ranks []ClassRank, comments []string, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if err := writeCSVComments(bw, comments); err != nil {
+		return err
+	}
+	if _, err := bw.WriteString("Entity,QRank\n"); err != nil {
+		return err
+	}
+	for _, r := range ranks {
+		bw.WriteByte('Q')
+		bw.WriteString(strconv.FormatInt(r.Item, 10))
+		bw.WriteByte(',')
+		bw.WriteString(strconv.FormatInt(r.Rank, 10))
+		if err := bw.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ClassRankLess tells whether a is ranked lower than b. Among items
+// of equal rank, the one with the higher item ID counts as lower,
+// so the output does not depend on the order of insertion.
+func classRankLess(a, b ClassRank) bool {
+	if a.Rank != b.Rank {
+		return a.Rank < b.Rank
+	}
+	return a.Item > b.Item
+}
+
+// ClassRankHeap is a min-heap whose root is the lowest-ranked item.
+type classRankHeap []ClassRank
+
+func (h classRankHeap) Len() int           { return len(h) }
+func (h classRankHeap) Less(i, j int) bool { return classRankLess(h[i], h[j]) }
+func (h classRankHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *classRankHeap) Push(x any) {
+	*h = append(*h, x.(ClassRank))
+}
+
+func (h *classRankHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,104 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestClassRanks(t *testing.T) {
+	r := NewClassRanks([]int64{5, 515}, 3)
+	for _, tc := range []ClassRank{{1, 10}, {2, 50}, {3, 20}, {4, 50}, {5, 5}, {6, 30}} {
+		r.Add(tc.Item, 5, tc.Rank)
+	}
+	r.Add(72, 515, 7)
+	r.Add(99, 6, 1000) // not a collected class
+
+	if got, want := fmt.Sprint(r.Top(5)), "[{2 50} {4 50} {6 30}]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got, want := fmt.Sprint(r.Top(515)), "[{72 7}]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got := r.Top(6); got != nil {
+		t.Errorf("got %v for class that is not collected, want nil", got)
+	}
+}
+
+// Among items of equal rank, the lowest item IDs should win,
+// no matter in what order the items get added.
+func TestClassRanks_Ties(t *testing.T) {
+	r := NewClassRanks([]int64{5}, 2)
+	for _, item := range []int64{9, 3, 7, 1} {
+		r.Add(item, 5, 42)
+	}
+	if got, want := fmt.Sprint(r.Top(5)), "[{1 42} {3 42}]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestClassRanks_Nil(t *testing.T) {
+	var r *ClassRanks
+	r.Add(72, 515, 7) // should not crash
+	if got := r.Top(515); got != nil {
+		t.Errorf("got %v, want nil", got)
+	}
+	if err := r.Put(context.Background(), time.Now(), nil, NewFakeS3()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClassRanks_Put(t *testing.T) {
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	r := NewClassRanks([]int64{515}, 10)
+	r.Add(72, 515, 7)
+	r.Add(662541, 515, 9)
+	version, _ := time.Parse(time.DateOnly, "2024-04-28")
+	if err := r.Put(ctx, version, []string{"# version: 2024-04-28"}, s3); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s3.ReadLines("public/qrank-class-q515-20240428.csv.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"# version: 2024-04-28", "Entity,QRank", "Q662541,9", "Q72,7"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWriteClassRanks(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeClassRanks([]ClassRank{{72, 7}, {5, 3}}, nil, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "Entity,QRank\nQ72,7\nQ5,3\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseClassList(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  []int64
+		ok    bool
+	}{
+		{"", nil, true},
+		{"Q5", []int64{5}, true},
+		{"Q5, Q515,Q5", []int64{5, 515}, true},
+		{"5", nil, false},
+		{"Q5,L7", nil, false},
+		{"Q5,", nil, false},
+	} {
+		got, err := ParseClassList(tc.input)
+		if (err == nil) != tc.ok || !slices.Equal(got, tc.want) {
+			t.Errorf("got (%v, %v) for %q, want %v", got, err, tc.input, tc.want)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/lanrat/extsort"
+	"github.com/minio/minio-go/v7"
+	"golang.org/x/sync/errgroup"
+)
+
+// FindTruthyDump returns the date and path of the most recent Wikidata
+// dump in N-Triples format that contains only the truthy statements.
+// These dumps are much smaller than the full JSON dumps, and they are
+// far quicker to parse because every statement is on its own line.
+func findTruthyDump(dumps string) (time.Time, string, error) {
+	if !pinnedDumpDate.IsZero() {
+		return findPinnedEntityDump(dumps, "truthy-BETA.nt.gz")
+	}
+	path := filepath.Join(dumps, "wikidatawiki", "entities", "latest-truthy.nt.gz")
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+
+	parts := strings.Split(resolved, string(os.PathSeparator))
+	date, err := time.Parse("20060102", parts[len(parts)-2])
+	if err != nil {
+		return time.Time{}, "", err
+	}
+
+	// Like in findEntitiesDump(), we return the resolved path
+	// because the symlink may change while we are reading.
+	return date, resolved, nil
+}
+
+// BuildCoordinates extracts the geographic coordinates (P625) of Wikidata
+// items from the truthy dump, and puts them into storage. The output
+// has lines such as "Q72,47.374444,8.541111" with the latitude and
+// longitude of the item, sorted by item. Items with several truthy
+// coordinates only appear once. Coordinates on other globes than Earth,
+// such as craters on the Moon, are left out.
+func buildCoordinates(ctx context.Context, dumps string, s3 S3) (string, error) {
+	return buildFromTruthyDump(ctx, dumps, "coordinates", readCoordinates, s3)
+}
+
+// TruthyReader reads a truthy dump in N-Triples format, and emits
+// one line for every statement that is of interest to its caller.
+// Lines must start with the item ID, as in "Q72,...".
+type truthyReader func(ctx context.Context, r io.Reader, out chan<- string) error
+
+// BuildFromTruthyDump extracts per-item data from the most recent
+// truthy dump, and puts it into storage as a file of the given kind.
+// The lines emitted by the reader get sorted, and only the first line
+// of each item gets stored. If the file is already in storage, it does
+// not get re-built. The result is the storage path of the file.
+func buildFromTruthyDump(ctx context.Context, dumps string, kind string, read truthyReader, s3 S3) (string, error) {
+	date, path, err := findTruthyDump(dumps)
+	if err != nil {
+		return "", err
+	}
+
+	ymd := date.Format("20060102")
+	dest := SitePath(kind, "wikidatawiki", date)
+	stored, err := ListStoredFiles(ctx, kind, s3)
+	if err != nil {
+		return "", err
+	}
+	versions := stored["wikidatawiki"]
+	if slices.Contains(versions, ymd) {
+		return dest, nil
+	}
+
+	logger.Printf("building %s", dest)
+	start := time.Now()
+
+	outFile, err := os.CreateTemp("", kind+"-*.zst")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(outFile.Name())
+	defer outFile.Close()
+
+	writer, err := zstd.NewWriter(outFile, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		return "", err
+	}
+	defer writer.Close()
+
+	numItems := 0
+	ch := make(chan string, 10000)
+	config := newSortConfig(32)
+	g, subCtx := errgroup.WithContext(ctx)
+	sorter, outChan, errChan := extsort.Strings(sortInput(subCtx, kind, ch, config), config)
+	g.Go(func() error {
+		defer close(ch)
+		file, err := openDump(ctx, path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+
+		return read(subCtx, gz, ch)
+	})
+	g.Go(func() error {
+		sorter.Sort(subCtx)
+		n, err := writeItemLines(subCtx, outChan, writer)
+		numItems = n
+		return err
+	})
+	if err := g.Wait(); err != nil {
+		return "", err
+	}
+	if err := <-errChan; err != nil {
+		return "", err
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	if err := outFile.Close(); err != nil {
+		return "", err
+	}
+
+	if err := PutInStorage(ctx, outFile.Name(), s3, "qrank", dest, "application/zstd"); err != nil {
+		return "", err
+	}
+	logger.Printf("built %s with %s for %d items in %.1fs",
+		dest, kind, numItems, time.Since(start).Seconds())
+
+	// Clean up old versions, keeping the previous one for readers
+	// that are still working on it.
+	for i := 0; i < len(versions)-1; i++ {
+		path := sitePath(kind, "wikidatawiki", versions[i])
+		opts := minio.RemoveObjectOptions{}
+		if err := s3.RemoveObject(ctx, "qrank", path, opts); err != nil {
+			return "", err
+		}
+	}
+
+	return dest, nil
+}
+
+// ReadCoordinates reads a Wikidata dump in N-Triples format, and emits
+// lines such as "Q72,47.374444,8.541111" for every coordinate statement.
+func readCoordinates(ctx context.Context, r io.Reader, out chan<- string) error {
+	scanner := bufio.NewScanner(r)
+	maxLineSize := 1024 * 1024
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		item, lat, lng, ok := parseCoordinateTriple(scanner.Bytes())
+		if !ok {
+			continue
+		}
+		line := item + "," + formatCoordinate(lat) + "," + formatCoordinate(lng)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- line:
+		}
+	}
+	return scanner.Err()
+}
+
+var (
+	truthyEntityPrefix = []byte("<http://www.wikidata.org/entity/Q")
+	truthyP625         = []byte("> <http://www.wikidata.org/prop/direct/P625> \"")
+	wktPointPrefix     = []byte("Point(")
+)
+
+// ParseCoordinateTriple parses a line of the truthy dump, returning
+// the item, latitude and longitude if the line is a P625 statement
+// with a coordinate on Earth. A typical line looks like this:
+//
+//	<http://www.wikidata.org/entity/Q72> <http://www.wikidata.org/prop/direct/P625>
+//	"Point(8.541111 47.374444)"^^<http://www.opengis.net/ont/geosparql#wktLiteral> .
+//
+// In Well-Known Text, points are given as longitude followed by latitude.
+// Coordinates on other globes have the globe as prefix to the point,
+// as in "<http://www.wikidata.org/entity/Q405> Point(-10 20)".
+func parseCoordinateTriple(line []byte) (item string, lat float64, lng float64, ok bool) {
+	if !bytes.HasPrefix(line, truthyEntityPrefix) {
+		return "", 0, 0, false
+	}
+	pos := bytes.Index(line, truthyP625)
+	if pos < 0 {
+		return "", 0, 0, false
+	}
+
+	// The entity prefix ends with "Q", which is part of the item ID.
+	id := line[len(truthyEntityPrefix)-1 : pos]
+	if len(id) < 2 || bytes.IndexFunc(id[1:], isNotDigit) >= 0 {
+		return "", 0, 0, false
+	}
+
+	literal := line[pos+len(truthyP625):]
+	if !bytes.HasPrefix(literal, wktPointPrefix) {
+		return "", 0, 0, false
+	}
+	literal = literal[len(wktPointPrefix):]
+	end := bytes.IndexByte(literal, ')')
+	if end < 0 {
+		return "", 0, 0, false
+	}
+	lngStr, latStr, found := strings.Cut(string(literal[:end]), " ")
+	if !found {
+		return "", 0, 0, false
+	}
+
+	lng, err := strconv.ParseFloat(lngStr, 64)
+	if err != nil || lng < -180 || lng > 180 {
+		return "", 0, 0, false
+	}
+	lat, err = strconv.ParseFloat(latStr, 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return "", 0, 0, false
+	}
+
+	return string(id), lat, lng, true
+}
+
+func isNotDigit(r rune) bool {
+	return r < '0' || r > '9'
+}
+
+// FormatCoordinate formats a latitude or longitude with six decimal
+// places, which is about 10 cm on the ground. Trailing zeroes are
+// removed to keep the output small.
+func formatCoordinate(deg float64) string {
+	s := strconv.FormatFloat(deg, 'f', 6, 64)
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		s = "0"
+	}
+	return s
+}
+
+// WriteItemLines writes sorted lines such as "Q72,47.374444,8.541111"
+// to w, keeping only the first line for each item. It returns the number
+// of items written.
+func writeItemLines(ctx context.Context, lines <-chan string, w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	sample := buildSampleFrom(ctx)
+	lastItem := ""
+	numItems := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return numItems, ctx.Err()
+
+		case line, more := <-lines:
+			if !more {
+				return numItems, bw.Flush()
+			}
+			item, _, _ := strings.Cut(line, ",")
+			if item == lastItem || !sample.KeepItemID(item) {
+				continue
+			}
+			lastItem = item
+			numItems += 1
+			if _, err := bw.WriteString(line); err != nil {
+				return numItems, err
+			}
+			if err := bw.WriteByte('\n'); err != nil {
+				return numItems, err
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBuildCoordinates(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	dumps := filepath.Join("testdata", "dumps")
+	s3 := NewFakeS3()
+	s3.data["coordinates/wikidatawiki-20240301-coordinates.zst"] = []byte("old")
+	s3.data["coordinates/wikidatawiki-20240315-coordinates.zst"] = []byte("previous")
+
+	path, err := buildCoordinates(ctx, dumps, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "coordinates/wikidatawiki-20240401-coordinates.zst"; path != want {
+		t.Errorf("got %q, want %q", path, want)
+	}
+
+	got, err := s3.ReadLines(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Q662541,46.5,9.8",
+		"Q72,47.374444,8.541111",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The oldest version should have been deleted; the previous one is kept.
+	if _, ok := s3.data["coordinates/wikidatawiki-20240301-coordinates.zst"]; ok {
+		t.Error("old version should have been deleted")
+	}
+	if _, ok := s3.data["coordinates/wikidatawiki-20240315-coordinates.zst"]; !ok {
+		t.Error("previous version should have been kept")
+	}
+}
+
+func TestReadCoordinates(t *testing.T) {
+	input := strings.Join([]string{
+		`<http://www.wikidata.org/entity/Q72> <http://www.wikidata.org/prop/direct/P625> "Point(8.541111 47.374444)"^^<http://www.opengis.net/ont/geosparql#wktLiteral> .`,
+		`<http://www.wikidata.org/entity/Q1> <http://www.wikidata.org/prop/direct/P31> <http://www.wikidata.org/entity/Q5> .`,
+		`<http://www.wikidata.org/entity/Q7> <http://www.wikidata.org/prop/direct/P625> "Point(-0.0000001 -33.5)"^^<http://www.opengis.net/ont/geosparql#wktLiteral> .`,
+	}, "\n")
+	ch := make(chan string, 10)
+	if err := readCoordinates(context.Background(), strings.NewReader(input), ch); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	got := make([]string, 0, 2)
+	for line := range ch {
+		got = append(got, line)
+	}
+	want := []string{"Q72,47.374444,8.541111", "Q7,-33.5,0"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParseCoordinateTriple(t *testing.T) {
+	const prefix = `<http://www.wikidata.org/entity/`
+	const p625 = `> <http://www.wikidata.org/prop/direct/P625> "`
+	const wkt = `"^^<http://www.opengis.net/ont/geosparql#wktLiteral> .`
+	for _, tc := range []struct {
+		line     string
+		item     string
+		lat, lng float64
+		ok       bool
+	}{
+		{prefix + "Q72" + p625 + "Point(8.5 47.3)" + wkt, "Q72", 47.3, 8.5, true},
+		{prefix + "Q1" + p625 + "Point(-180 -90)" + wkt, "Q1", -90, -180, true},
+		{prefix + "Q1" + p625 + "<http://www.wikidata.org/entity/Q405> Point(8 47)" + wkt, "", 0, 0, false},
+		{prefix + "Q1" + p625 + "Point(181 47)" + wkt, "", 0, 0, false},
+		{prefix + "Q1" + p625 + "Point(8 91)" + wkt, "", 0, 0, false},
+		{prefix + "Q1" + p625 + "Point(8)" + wkt, "", 0, 0, false},
+		{prefix + "Q1" + p625 + "Point(8 x)" + wkt, "", 0, 0, false},
+		{prefix + "Q" + p625 + "Point(8 47)" + wkt, "", 0, 0, false},
+		{prefix + "Q1-S" + p625 + "Point(8 47)" + wkt, "", 0, 0, false},
+		{prefix + "P625" + p625 + "Point(8 47)" + wkt, "", 0, 0, false},
+		{prefix + "Q1> <http://www.wikidata.org/prop/direct/P17> <http://www.wikidata.org/entity/Q39> .", "", 0, 0, false},
+		{"", "", 0, 0, false},
+	} {
+		item, lat, lng, ok := parseCoordinateTriple([]byte(tc.line))
+		if item != tc.item || lat != tc.lat || lng != tc.lng || ok != tc.ok {
+			t.Errorf("got (%q, %v, %v, %v) for %q, want (%q, %v, %v, %v)",
+				item, lat, lng, ok, tc.line, tc.item, tc.lat, tc.lng, tc.ok)
+		}
+	}
+}
+
+func TestWriteItemLines(t *testing.T) {
+	ch := make(chan string, 5)
+	for _, line := range []string{"Q1,1,2", "Q1,3,4", "Q10,5,6", "Q2,7,8"} {
+		ch <- line
+	}
+	close(ch)
+	var buf bytes.Buffer
+	n, err := writeItemLines(context.Background(), ch, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("got %d items, want 3", n)
+	}
+	if got, want := buf.String(), "Q1,1,2\nQ10,5,6\nQ2,7,8\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,138 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"strings"
+)
+
+// The files that get passed between stages are comma- or tab-separated,
+// with one record per line. They get sorted line by line, and joined
+// by comparing fields. Fields from the dumps, such as page titles
+// or labels, may contain the separator or double quotes, so they get
+// quoted as in RFC 4180: enclosed in double quotes, with any double
+// quote inside doubled. The quoting is canonical; a field is quoted
+// if and only if it needs to be. Therefore, two fields are equal
+// exactly if their quoted forms are equal, and joins can compare
+// quoted fields without unquoting them.
+//
+// Line breaks cannot be represented in a line-oriented file, even
+// when quoted, because the sorter would tear the record apart.
+// MediaWiki does not allow them in titles, so records with line
+// breaks can only come from broken dumps; formatRecord() rejects them.
+
+// QuoteField returns a field in the form for a line with the given
+// separator, quoting it if it contains the separator or a double quote.
+func quoteField(field string, sep byte) string {
+	if strings.IndexByte(field, sep) < 0 && strings.IndexByte(field, '"') < 0 {
+		return field
+	}
+	var buf strings.Builder
+	buf.Grow(len(field) + 4)
+	buf.WriteByte('"')
+	for i := 0; i < len(field); i++ {
+		if field[i] == '"' {
+			buf.WriteByte('"')
+		}
+		buf.WriteByte(field[i])
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// FormatRecord joins fields into a line, without the final newline,
+// quoting them where needed. The result is false if a field contains
+// a line break; such records cannot be stored.
+func formatRecord(sep byte, fields ...string) (string, bool) {
+	var buf strings.Builder
+	for i, f := range fields {
+		if strings.ContainsAny(f, "\r\n") {
+			return "", false
+		}
+		if i > 0 {
+			buf.WriteByte(sep)
+		}
+		buf.WriteString(quoteField(f, sep))
+	}
+	return buf.String(), true
+}
+
+// SplitRecord splits a line at the separators that are not inside
+// quotes. The fields stay quoted, so they can be compared with other
+// quoted fields, or be written out again unchanged; use unquoteField()
+// for the actual text. Lines without quotes get split like by
+// strings.Split(). To stay compatible with files written before we
+// quoted fields, a field that starts with a double quote but is not
+// properly quoted ends at the next separator.
+func splitRecord(line string, sep byte) []string {
+	if strings.IndexByte(line, '"') < 0 {
+		return strings.Split(line, string(sep))
+	}
+	fields := make([]string, 0, 4)
+	for {
+		n := fieldLength(line, sep)
+		fields = append(fields, line[:n])
+		if n == len(line) {
+			return fields
+		}
+		line = line[n+1:]
+	}
+}
+
+// CutRecord is like strings.Cut() at the first separator that is
+// not inside quotes. The first field stays quoted.
+func cutRecord(line string, sep byte) (first, rest string, found bool) {
+	n := fieldLength(line, sep)
+	if n == len(line) {
+		return line, "", false
+	}
+	return line[:n], line[n+1:], true
+}
+
+// FieldLength returns the length of the first field of a line,
+// which is either the position of its separator or the length
+// of the whole line.
+func fieldLength(line string, sep byte) int {
+	if len(line) > 0 && line[0] == '"' {
+		for i := 1; i < len(line); i++ {
+			if line[i] != '"' {
+				continue
+			}
+			if i+1 < len(line) && line[i+1] == '"' {
+				i++ // doubled quote
+				continue
+			}
+			if i+1 == len(line) || line[i+1] == sep {
+				return i + 1
+			}
+			break // not properly quoted
+		}
+	}
+	if n := strings.IndexByte(line, sep); n >= 0 {
+		return n
+	}
+	return len(line)
+}
+
+// UnquoteField returns the text of a field that may be quoted.
+// Fields that are not properly quoted are returned unchanged,
+// which is what files written before we quoted fields need.
+func unquoteField(field string) string {
+	if len(field) < 2 || field[0] != '"' || field[len(field)-1] != '"' {
+		return field
+	}
+	inner := field[1 : len(field)-1]
+	var buf strings.Builder
+	buf.Grow(len(inner))
+	for i := 0; i < len(inner); i++ {
+		if inner[i] == '"' {
+			if i+1 >= len(inner) || inner[i+1] != '"' {
+				return field
+			}
+			i++
+		}
+		buf.WriteByte(inner[i])
+	}
+	return buf.String()
+}
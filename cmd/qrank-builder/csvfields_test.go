@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// Page titles and labels that have broken naive CSV handling.
+var hostileTitles = []string{
+	"Zürich",
+	"Washington,_D.C.",
+	`"Heroes"_(song)`,
+	`"`,
+	`""`,
+	`,`,
+	"Tab\there",
+	`a"b,c"d`,
+	"",
+}
+
+func TestQuoteField(t *testing.T) {
+	for _, tc := range []struct {
+		field string
+		sep   byte
+		want  string
+	}{
+		{"Zürich", ',', "Zürich"},
+		{"Washington,_D.C.", ',', `"Washington,_D.C."`},
+		{"Washington,_D.C.", '\t', "Washington,_D.C."},
+		{"Tab\there", '\t', "\"Tab\there\""},
+		{`"Heroes"_(song)`, '\t', `"""Heroes""_(song)"`},
+		{"", ',', ""},
+	} {
+		if got := quoteField(tc.field, tc.sep); got != tc.want {
+			t.Errorf("quoteField(%q, %q) = %q, want %q", tc.field, tc.sep, got, tc.want)
+		}
+	}
+}
+
+func TestFormatRecord(t *testing.T) {
+	got, ok := formatRecord('\t', "799", "B", "Tab\there")
+	if want := "799\tB\t\"Tab\there\""; got != want || !ok {
+		t.Errorf("got %q, %v; want %q, true", got, ok, want)
+	}
+	for _, title := range []string{"Line\nbreak", "Carriage\rreturn"} {
+		if got, ok := formatRecord('\t', "799", "B", title); ok {
+			t.Errorf("title %q should be rejected, got %q", title, got)
+		}
+	}
+}
+
+func TestSplitRecord_HostileTitles(t *testing.T) {
+	for _, sep := range []byte{',', '\t'} {
+		for _, title := range hostileTitles {
+			line, ok := formatRecord(sep, "799", title, "Q72")
+			if !ok {
+				t.Fatalf("formatRecord rejected %q", title)
+			}
+			cols := splitRecord(line, sep)
+			if len(cols) != 3 || cols[0] != "799" || cols[2] != "Q72" {
+				t.Errorf("splitRecord(%q) = %q, want 3 columns", line, cols)
+				continue
+			}
+			if got := unquoteField(cols[1]); got != title {
+				t.Errorf("title %q came back as %q", title, got)
+			}
+			if cols[1] != quoteField(title, sep) {
+				t.Errorf("field %q should stay quoted as %q", cols[1], quoteField(title, sep))
+			}
+
+			first, rest, found := cutRecord(line, sep)
+			if first != "799" || !found {
+				t.Errorf("cutRecord(%q) = %q, %q, %v", line, first, rest, found)
+			}
+			first, _, _ = cutRecord(rest, sep)
+			if unquoteField(first) != title {
+				t.Errorf("cutRecord(%q) = %q, want title %q", rest, first, title)
+			}
+		}
+	}
+}
+
+func TestSplitRecord_Legacy(t *testing.T) {
+	// Before we quoted fields, quotes got written as they were.
+	for _, tc := range []struct {
+		line string
+		want []string
+	}{
+		{"Foo\tQ1", []string{"Foo", "Q1"}},
+		{"\"Heroes\"_(song)\tQ1", []string{`"Heroes"_(song)`, "Q1"}},
+		{"\"unbalanced\tQ1", []string{`"unbalanced`, "Q1"}},
+		{"a\"b\tQ1", []string{`a"b`, "Q1"}},
+		{"\"\"\t\"\"", []string{`""`, `""`}},
+		{"", []string{""}},
+	} {
+		if got := splitRecord(tc.line, '\t'); !slices.Equal(got, tc.want) {
+			t.Errorf("splitRecord(%q) = %q, want %q", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestUnquoteField(t *testing.T) {
+	for _, tc := range []struct{ field, want string }{
+		{"Zürich", "Zürich"},
+		{`"a,b"`, "a,b"},
+		{`"a""b"`, `a"b`},
+		{`""`, ""},
+		{`"a"b"`, `"a"b"`},
+		{`"Heroes"_(song)`, `"Heroes"_(song)`},
+		{`"`, `"`},
+	} {
+		if got := unquoteField(tc.field); got != tc.want {
+			t.Errorf("unquoteField(%q) = %q, want %q", tc.field, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// ErrBuildRunning is returned by acquireRunLock if another build
+// is currently running on the same working directory.
+var ErrBuildRunning = errors.New("another build is running")
+
+// DaemonOptions controls how qrank-builder runs with -daemon.
+type DaemonOptions struct {
+	// Interval between two scans of the dumps tree.
+	Interval time.Duration
+
+	// Maximal random delay that gets added to every interval, so
+	// that several tools on Toolforge do not all hit the shared
+	// NFS server at the same time.
+	Jitter time.Duration
+
+	// Sites whose daily adds-changes dumps trigger a build,
+	// see BuildOptions.IncrementalSites.
+	IncrementalSites []string
+
+	// Path to the lock file that protects against overlapping runs.
+	LockPath string
+
+	// Where to look for new pageviews, see BuildOptions.PageviewsSource.
+	// If nil, the daemon looks at the pageview_complete dumps.
+	PageviewsSource PageviewsSource
+}
+
+func (opts *DaemonOptions) pageviewsSource(dumps string) PageviewsSource {
+	if opts.PageviewsSource != nil {
+		return opts.PageviewsSource
+	}
+	return PageviewCompleteSource{Dumps: dumps}
+}
+
+// DaemonInputs summarizes the inputs of a build, so the daemon can
+// tell whether anything new has appeared since the last build.
+type daemonInputs struct {
+	Pageviews  string            `json:"pageviews"`            // latest day with pageviews, YYYY-MM-DD
+	Dumps      map[string]string `json:"dumps"`                // site key → date of latest complete dump
+	Increments map[string]string `json:"increments,omitempty"` // site key → date of latest adds-changes dump
+}
+
+// DaemonState is stored after every successful build of the daemon.
+type daemonState struct {
+	Inputs   *daemonInputs `json:"inputs"`
+	Finished time.Time     `json:"finished"`
+}
+
+// RunDaemon keeps running until ctx gets cancelled. Periodically,
+// it scans the dumps tree for new dumps or pageview days, and calls
+// build when it finds any. The inputs of the last successful build
+// are kept in storage, so a restarted daemon does not build again.
+func RunDaemon(ctx context.Context, build func(ctx context.Context) error, dumps string, s3 S3, opts DaemonOptions) error {
+	logger.Printf("daemon starting, interval=%v jitter=%v", opts.Interval, opts.Jitter)
+	for {
+		if err := runDaemonOnce(ctx, build, dumps, s3, opts); err != nil {
+			logger.Printf("daemon build failed: %v", err)
+		}
+
+		delay := opts.Interval
+		if opts.Jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(opts.Jitter)))
+		}
+		select {
+		case <-ctx.Done():
+			logger.Printf("daemon stopping")
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// RunDaemonOnce calls build if the inputs have changed since the last
+// successful build. If another build is still running, or if the build
+// has stopped after -max-runtime, the next round takes it up again.
+func runDaemonOnce(ctx context.Context, build func(ctx context.Context) error, dumps string, s3 S3, opts DaemonOptions) error {
+	state, err := readDaemonState(ctx, s3)
+	if err != nil {
+		return err
+	}
+	var last *daemonInputs
+	if state != nil {
+		last = state.Inputs
+	}
+
+	inputs, err := scanDaemonInputs(dumps, opts.pageviewsSource(dumps), opts.IncrementalSites, last)
+	if err != nil {
+		return err
+	}
+	if last != nil && inputs.Equal(last) {
+		logger.Printf("no new dumps or pageviews since %s", state.Finished.Format(time.RFC3339))
+		return nil
+	}
+
+	lock, err := acquireRunLock(opts.LockPath)
+	if errors.Is(err, ErrBuildRunning) {
+		logger.Printf("not starting a build because %v", err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	logger.Printf("daemon starting a build for pageviews up to %s and dumps of %d sites", inputs.Pageviews, len(inputs.Dumps))
+	err = build(ctx)
+	if errors.Is(err, ErrMaxRuntime) {
+		logger.Printf("build stopped after -max-runtime; the next round continues from here")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	state = &daemonState{Inputs: inputs, Finished: time.Now().UTC()}
+	return PutJSON(ctx, state, s3, "qrank", DaemonStatePath())
+}
+
+// Equal returns whether two sets of inputs are the same.
+func (in *daemonInputs) Equal(other *daemonInputs) bool {
+	return in.Pageviews == other.Pageviews &&
+		maps.Equal(in.Dumps, other.Dumps) &&
+		maps.Equal(in.Increments, other.Increments)
+}
+
+// ScanDaemonInputs finds the latest inputs in the dumps tree. Checking
+// whether a dump is complete can be slow, so it only gets done for sites
+// whose dump has changed since the last build. If a new dump is still
+// being written, we keep the date of the last build for its site, so the
+// build gets triggered once the dump is complete.
+func scanDaemonInputs(dumps string, pageviewsSource PageviewsSource, incrementalSites []string, last *daemonInputs) (*daemonInputs, error) {
+	inputs := &daemonInputs{
+		Dumps:      make(map[string]string, 1000),
+		Increments: make(map[string]string, len(incrementalSites)),
+	}
+
+	pageviews, err := pageviewsSource.Latest()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		inputs.Pageviews = pageviews.Format(time.DateOnly)
+	}
+
+	entries, err := os.ReadDir(dumps)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		site := e.Name()
+		dumped, _ := siteDumpDate(dumps, site, false)
+		if dumped.IsZero() {
+			continue
+		}
+		ymd := dumped.Format("20060102")
+		if last != nil && last.Dumps[site] == ymd {
+			inputs.Dumps[site] = ymd
+			continue
+		}
+		if _, err := siteDumpDate(dumps, site, true); err != nil {
+			logger.Printf("dump %s of %s is not complete yet: %v", ymd, site, err)
+			if last != nil {
+				if prev, ok := last.Dumps[site]; ok {
+					inputs.Dumps[site] = prev
+				}
+			}
+			continue
+		}
+		inputs.Dumps[site] = ymd
+	}
+
+	for _, site := range incrementalSites {
+		days, err := findIncrements(dumps, site, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		if n := len(days); n > 0 {
+			inputs.Increments[site] = days[n-1].Format("20060102")
+		}
+	}
+
+	return inputs, nil
+}
+
+func readDaemonState(ctx context.Context, s3 S3) (*daemonState, error) {
+	path := DaemonStatePath()
+	found := false
+	for obj := range s3.ListObjects(ctx, "qrank", minio.ListObjectsOptions{Prefix: path}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if obj.Key == path {
+			found = true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+
+	reader, err := NewS3Reader(ctx, "qrank", path, s3)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var state daemonState
+	if err := json.NewDecoder(reader).Decode(&state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// RunLock protects against overlapping runs of qrank-builder, such as
+// a daemon and a manually started job, in the same working directory.
+// While a lock is held, its file gets touched every minute. A lock
+// file that has not been touched for maxRunLockAge is left over from
+// a crashed process, and gets taken over.
+type runLock struct {
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+const maxRunLockAge = 10 * time.Minute
+
+// AcquireRunLock takes the lock at path, or returns ErrBuildRunning
+// if another process is holding it.
+func acquireRunLock(path string) (*runLock, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if errors.Is(err, fs.ErrExist) {
+		stat, statErr := os.Stat(path)
+		if statErr != nil {
+			return nil, statErr
+		}
+		age := time.Since(stat.ModTime())
+		if age < maxRunLockAge {
+			holder, _ := os.ReadFile(path)
+			return nil, fmt.Errorf("%w: %s held by %s", ErrBuildRunning, path, strings.TrimSpace(string(holder)))
+		}
+		logger.Printf("taking over stale lock %s, last touched %v ago", path, age.Round(time.Second))
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("%w: %s", ErrBuildRunning, path)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	holder := "pid " + strconv.Itoa(os.Getpid()) + " since " + time.Now().UTC().Format(time.RFC3339)
+	if _, err := f.WriteString(holder + "\n"); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	lock := &runLock{path: path, stop: make(chan struct{}), done: make(chan struct{})}
+	go lock.heartbeat()
+	return lock, nil
+}
+
+func (lock *runLock) heartbeat() {
+	defer close(lock.done)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lock.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			if err := os.Chtimes(lock.path, now, now); err != nil {
+				logger.Printf("cannot touch lock %s: %v", lock.path, err)
+			}
+		}
+	}
+}
+
+// Release gives up the lock.
+func (lock *runLock) Release() error {
+	close(lock.stop)
+	<-lock.done
+	return os.Remove(lock.path)
+}
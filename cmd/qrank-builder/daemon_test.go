@@ -0,0 +1,181 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunDaemonOnce(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	dumps := filepath.Join("testdata", "dumps")
+	opts := DaemonOptions{
+		IncrementalSites: []string{"wikidatawiki"},
+		LockPath:         filepath.Join(t.TempDir(), "qrank-builder.lock"),
+	}
+
+	builds := 0
+	build := func(ctx context.Context) error {
+		builds += 1
+		if _, err := os.Stat(opts.LockPath); err != nil {
+			t.Errorf("lock not held during build: %v", err)
+		}
+		return nil
+	}
+
+	if err := runDaemonOnce(ctx, build, dumps, s3, opts); err != nil {
+		t.Fatal(err)
+	}
+	if builds != 1 {
+		t.Errorf("got %d builds, want 1", builds)
+	}
+	if _, err := os.Stat(opts.LockPath); !os.IsNotExist(err) {
+		t.Errorf("lock not released after build, err=%v", err)
+	}
+
+	var state daemonState
+	if err := json.Unmarshal(s3.data[DaemonStatePath()], &state); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := state.Inputs.Dumps["rmwiki"], "20240301"; got != want {
+		t.Errorf(`got %q for rmwiki, want %q`, got, want)
+	}
+	if got, want := state.Inputs.Increments["wikidatawiki"], "20240403"; got != want {
+		t.Errorf(`got %q for wikidatawiki increments, want %q`, got, want)
+	}
+	if state.Inputs.Pageviews == "" {
+		t.Error("pageviews missing from daemon state")
+	}
+
+	// Nothing has changed, so there should be no second build.
+	if err := runDaemonOnce(ctx, build, dumps, s3, opts); err != nil {
+		t.Fatal(err)
+	}
+	if builds != 1 {
+		t.Errorf("got %d builds, want 1", builds)
+	}
+
+	// A new dump should trigger another build.
+	state.Inputs.Dumps["rmwiki"] = "20240201"
+	if err := PutJSON(ctx, state, s3, "qrank", DaemonStatePath()); err != nil {
+		t.Fatal(err)
+	}
+	if err := runDaemonOnce(ctx, build, dumps, s3, opts); err != nil {
+		t.Fatal(err)
+	}
+	if builds != 2 {
+		t.Errorf("got %d builds, want 2", builds)
+	}
+}
+
+func TestRunDaemonOnce_Interrupted(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	dumps := filepath.Join("testdata", "dumps")
+	opts := DaemonOptions{LockPath: filepath.Join(t.TempDir(), "qrank-builder.lock")}
+
+	// A build that stops after -max-runtime gets continued next time.
+	build := func(ctx context.Context) error { return ErrMaxRuntime }
+	if err := runDaemonOnce(ctx, build, dumps, s3, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := s3.data[DaemonStatePath()]; found {
+		t.Error("daemon state should not be stored after an interrupted build")
+	}
+
+	// A failed build gets retried next time.
+	build = func(ctx context.Context) error { return errors.New("test error") }
+	if err := runDaemonOnce(ctx, build, dumps, s3, opts); err == nil {
+		t.Error("expected error")
+	}
+	if _, found := s3.data[DaemonStatePath()]; found {
+		t.Error("daemon state should not be stored after a failed build")
+	}
+}
+
+func TestRunDaemonOnce_Locked(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	dumps := filepath.Join("testdata", "dumps")
+	opts := DaemonOptions{LockPath: filepath.Join(t.TempDir(), "qrank-builder.lock")}
+
+	lock, err := acquireRunLock(opts.LockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+
+	build := func(ctx context.Context) error {
+		t.Error("build should not have been started while another one is running")
+		return nil
+	}
+	if err := runDaemonOnce(ctx, build, dumps, s3, opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunDaemon_Cancel(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := DaemonOptions{
+		Interval: time.Hour,
+		Jitter:   time.Minute,
+		LockPath: filepath.Join(t.TempDir(), "qrank-builder.lock"),
+	}
+	build := func(ctx context.Context) error {
+		cancel()
+		return nil
+	}
+	err := RunDaemon(ctx, build, filepath.Join("testdata", "dumps"), NewFakeS3(), opts)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestAcquireRunLock(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	path := filepath.Join(t.TempDir(), "qrank-builder.lock")
+	lock, err := acquireRunLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquireRunLock(path); !errors.Is(err, ErrBuildRunning) {
+		t.Errorf("got %v, want ErrBuildRunning", err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("lock file not removed, err=%v", err)
+	}
+
+	// A lock that has not been touched for a long time is left over
+	// from a crashed process, and should get taken over.
+	if err := os.WriteFile(path, []byte("pid 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	lock, err = acquireRunLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// PinnedDumpDate is the date of the dump run that the build reads,
+// set by the -dump-date flag, or the zero time for reading whatever
+// the "latest" symlinks of the dumps point to. Wikimedia moves the
+// symlinks while a new run gets published, so a long build could
+// otherwise mix the dumps of two runs; with a pinned date, builds
+// are reproducible.
+var pinnedDumpDate time.Time
+
+// ParseDumpDate parses the -dump-date flag, such as "20240601".
+// The empty string means that the dump date is not pinned.
+func ParseDumpDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	date, err := time.Parse("20060102", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad dump date %q, expected YYYYMMDD", s)
+	}
+	return date, nil
+}
+
+// SiteDumpPath returns the path to a dump file of a site, such as
+// rmwiki/20240601/rmwiki-20240601-page.sql.gz when the dump date
+// is pinned, or rmwiki/latest/rmwiki-latest-page.sql.gz otherwise.
+func siteDumpPath(dumps string, siteKey string, file string) string {
+	run := "latest"
+	if !pinnedDumpDate.IsZero() {
+		run = pinnedDumpDate.Format("20060102")
+	}
+	return filepath.Join(dumps, siteKey, run, fmt.Sprintf("%s-%s-%s", siteKey, run, file))
+}
+
+// FindPinnedEntityDump returns the date and path of the newest Wikidata
+// entity dump of a kind, such as "truthy-BETA.nt.gz", that is not newer
+// than the pinned dump date. The entity dumps run weekly, on another
+// schedule than the database dumps, so they hardly ever have the same
+// date as the run we are pinned to.
+func findPinnedEntityDump(dumps string, kind string) (time.Time, string, error) {
+	dir := filepath.Join(dumps, "wikidatawiki", "entities")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+
+	var dates []time.Time
+	for _, e := range entries {
+		if date, err := time.Parse("20060102", e.Name()); err == nil && e.IsDir() && !date.After(pinnedDumpDate) {
+			dates = append(dates, date)
+		}
+	}
+	slices.SortFunc(dates, func(a, b time.Time) int { return b.Compare(a) })
+	for _, date := range dates {
+		ymd := date.Format("20060102")
+		path := filepath.Join(dir, ymd, fmt.Sprintf("wikidata-%s-%s", ymd, kind))
+		if _, err := os.Stat(path); err == nil {
+			return date, path, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return time.Time{}, "", err
+		}
+	}
+	return time.Time{}, "", fmt.Errorf("no Wikidata %s dump on or before %s: %w", kind, pinnedDumpDate.Format(time.DateOnly), fs.ErrNotExist)
+}
+
+// PinnedPageviewsSource caps the pageviews at the pinned dump date, so
+// that a build does not take more recent pageviews when it runs later.
+type pinnedPageviewsSource struct {
+	PageviewsSource
+	date time.Time
+}
+
+func (s pinnedPageviewsSource) Latest() (time.Time, error) {
+	latest, err := s.PageviewsSource.Latest()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if latest.Before(s.date) {
+		return time.Time{}, fmt.Errorf("pageviews of %s are not available yet, latest are of %s", s.date.Format(time.DateOnly), latest.Format(time.DateOnly))
+	}
+	return s.date, nil
+}
@@ -0,0 +1,125 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseDumpDate(t *testing.T) {
+	got, err := ParseDumpDate("20240601")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got, err := ParseDumpDate(""); err != nil || !got.IsZero() {
+		t.Errorf("got (%v, %v), want zero time for empty flag", got, err)
+	}
+
+	for _, bad := range []string{"2024-06-01", "latest", "20241301"} {
+		if _, err := ParseDumpDate(bad); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
+
+func TestSiteDumpPath(t *testing.T) {
+	defer func(saved time.Time) { pinnedDumpDate = saved }(pinnedDumpDate)
+
+	pinnedDumpDate = time.Time{}
+	got := siteDumpPath("dumps", "rmwiki", "page.sql.gz")
+	if want := filepath.Join("dumps", "rmwiki", "latest", "rmwiki-latest-page.sql.gz"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	pinnedDumpDate = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	got = siteDumpPath("dumps", "rmwiki", "page.sql.gz")
+	if want := filepath.Join("dumps", "rmwiki", "20240601", "rmwiki-20240601-page.sql.gz"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadWikiSites_PinnedDumpDate(t *testing.T) {
+	defer func(saved time.Time) { pinnedDumpDate = saved }(pinnedDumpDate)
+	pinnedDumpDate = time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	// In testdata, only metawiki and wikidatawiki have been dumped
+	// in the run of April 1.
+	sites, err := ReadWikiSites(nil, filepath.Join("testdata", "dumps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for key, site := range sites.Sites {
+		keys = append(keys, key)
+		if !site.LastDumped.Equal(pinnedDumpDate) {
+			t.Errorf("%s: got LastDumped=%v, want %v", key, site.LastDumped, pinnedDumpDate)
+		}
+	}
+	slices.Sort(keys)
+	if want := []string{"metawiki", "wikidatawiki"}; !slices.Equal(keys, want) {
+		t.Errorf("got sites %q, want %q", keys, want)
+	}
+}
+
+func TestFindTruthyDump_Pinned(t *testing.T) {
+	defer func(saved time.Time) { pinnedDumpDate = saved }(pinnedDumpDate)
+
+	dumps := t.TempDir()
+	for _, ymd := range []string{"20240318", "20240325", "20240408"} {
+		dir := filepath.Join(dumps, "wikidatawiki", "entities", ymd)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "wikidata-"+ymd+"-truthy-BETA.nt.gz")
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pinnedDumpDate = time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	date, path, err := findTruthyDump(dumps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := date.Format("20060102"); got != "20240325" {
+		t.Errorf("got date %s, want 20240325", got)
+	}
+	if want := filepath.Join(dumps, "wikidatawiki", "entities", "20240325", "wikidata-20240325-truthy-BETA.nt.gz"); path != want {
+		t.Errorf("got path %q, want %q", path, want)
+	}
+
+	pinnedDumpDate = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	if _, _, err := findTruthyDump(dumps); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestPinnedPageviewsSource(t *testing.T) {
+	// The latest pageviews in testdata are of 2023-03-26.
+	source := PageviewCompleteSource{Dumps: filepath.Join("testdata", "dumps")}
+
+	pinned := pinnedPageviewsSource{source, time.Date(2023, 3, 22, 0, 0, 0, 0, time.UTC)}
+	got, err := pinned.Latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(pinned.date) {
+		t.Errorf("got %v, want %v", got, pinned.date)
+	}
+
+	pinned.date = time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := pinned.Latest(); err == nil {
+		t.Error("expected error for pageviews that are not available yet")
+	}
+}
@@ -0,0 +1,118 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// On Toolforge, the Wikimedia dumps are mounted from a shared NFS server.
+// When all stages read their dumps with NumCPU workers at the same time,
+// they saturate that server, and Toolforge throttles our jobs. Therefore,
+// all reads from dumps go through a global limiter, which allows only
+// a fixed number of reads to be in flight at any time. Slots are taken
+// for each call to Read, not for the lifetime of a file, so code that
+// merges several dump files can never deadlock on the limiter.
+var dumpIO dumpLimiter
+
+type dumpLimiter struct {
+	sem     atomic.Pointer[semaphore.Weighted] // nil for no limit
+	bytes   atomic.Int64                       // bytes read from dumps
+	reading atomic.Int64                       // nanoseconds spent in Read
+	waiting atomic.Int64                       // nanoseconds spent waiting for a slot
+}
+
+// DumpIOStats tells how much data was read from dumps, and how long
+// it took. Reading is the time spent in the file system, summed over
+// all concurrent readers; Waiting is the time spent waiting for the
+// limiter to allow a read.
+type DumpIOStats struct {
+	Bytes   int64
+	Reading time.Duration
+	Waiting time.Duration
+}
+
+// Sub returns the difference between two snapshots of the statistics.
+func (s DumpIOStats) Sub(other DumpIOStats) DumpIOStats {
+	return DumpIOStats{
+		Bytes:   s.Bytes - other.Bytes,
+		Reading: s.Reading - other.Reading,
+		Waiting: s.Waiting - other.Waiting,
+	}
+}
+
+// MiBPerSecond returns the read throughput per reader in MiB/s.
+func (s DumpIOStats) MiBPerSecond() float64 {
+	if s.Reading <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / (1024 * 1024) / s.Reading.Seconds()
+}
+
+// SetMaxDumpReaders limits how many reads from dumps can be in flight
+// at the same time. A limit of zero or less removes the limit.
+func SetMaxDumpReaders(n int) {
+	if n <= 0 {
+		dumpIO.sem.Store(nil)
+	} else {
+		dumpIO.sem.Store(semaphore.NewWeighted(int64(n)))
+	}
+}
+
+// GetDumpIOStats returns a snapshot of the statistics about dump reads.
+func GetDumpIOStats() DumpIOStats {
+	return DumpIOStats{
+		Bytes:   dumpIO.bytes.Load(),
+		Reading: time.Duration(dumpIO.reading.Load()),
+		Waiting: time.Duration(dumpIO.waiting.Load()),
+	}
+}
+
+// OpenDump opens a file in the Wikimedia dumps for reading.
+// Reads from the returned file are throttled by the global limiter.
+// When the file gets closed, it is recorded as an input of the
+// build report step in ctx, if any.
+func openDump(ctx context.Context, path string) (*dumpFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &dumpFile{file: file, step: reportStepFrom(ctx)}, nil
+}
+
+type dumpFile struct {
+	file *os.File
+	step *ReportStep
+	read int64
+}
+
+func (f *dumpFile) Read(p []byte) (int, error) {
+	sem := dumpIO.sem.Load()
+	if sem != nil {
+		start := time.Now()
+		if err := sem.Acquire(context.Background(), 1); err != nil {
+			return 0, err
+		}
+		defer sem.Release(1)
+		dumpIO.waiting.Add(int64(time.Since(start)))
+	}
+
+	start := time.Now()
+	n, err := f.file.Read(p)
+	dumpIO.reading.Add(int64(time.Since(start)))
+	dumpIO.bytes.Add(int64(n))
+	f.read += int64(n)
+	return n, err
+}
+
+func (f *dumpFile) Close() error {
+	f.step.addInput(ReportObject{Path: f.file.Name(), Size: f.read})
+	f.step = nil
+	return f.file.Close()
+}
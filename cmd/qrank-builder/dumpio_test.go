@@ -0,0 +1,126 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpenDump(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.txt")
+	content := bytes.Repeat([]byte("Hello, world!\n"), 10000)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	SetMaxDumpReaders(2)
+	defer SetMaxDumpReaders(0)
+	before := GetDumpIOStats()
+
+	file, err := openDump(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("content differs")
+	}
+
+	stats := GetDumpIOStats().Sub(before)
+	if stats.Bytes != int64(len(content)) {
+		t.Errorf("got %d bytes in stats, want %d", stats.Bytes, len(content))
+	}
+}
+
+func TestOpenDump_NotFound(t *testing.T) {
+	if _, err := openDump(context.Background(), "no-such-file"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestOpenDump_Throttled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.txt")
+	if err := os.WriteFile(path, []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := openDump(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	SetMaxDumpReaders(1)
+	defer SetMaxDumpReaders(0)
+	before := GetDumpIOStats()
+
+	// Take the only slot, so the read has to wait until it gets released.
+	sem := dumpIO.sem.Load()
+	if err := sem.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := io.ReadAll(file)
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("read should have been blocked by the limiter")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	sem.Release(1)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if stats := GetDumpIOStats().Sub(before); stats.Waiting < 20*time.Millisecond {
+		t.Errorf("got Waiting=%v, want at least 20ms", stats.Waiting)
+	}
+}
+
+// With a single slot for reading dumps, stages that merge
+// several dump files must still be able to make progress.
+func TestBuild_MaxDumpReaders(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	SetMaxDumpReaders(1)
+	defer SetMaxDumpReaders(0)
+	dumps := filepath.Join("testdata", "dumps")
+	client := &http.Client{Transport: &FakeWikiSite{}}
+	s3 := NewFakeS3()
+	if err := Build(client, dumps /*numWeeks*/, 1, s3); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s3.data["public/item_signals-20240501.csv.zst"]; !ok {
+		t.Error("item signals have not been built")
+	}
+}
+
+func TestDumpIOStats_MiBPerSecond(t *testing.T) {
+	s := DumpIOStats{Bytes: 3 * 1024 * 1024, Reading: 2 * time.Second}
+	if got := s.MiBPerSecond(); got != 1.5 {
+		t.Errorf("got %v, want 1.5", got)
+	}
+	if got := (DumpIOStats{}).MiBPerSecond(); got != 0 {
+		t.Errorf("got %v, want 0", got)
+	}
+}
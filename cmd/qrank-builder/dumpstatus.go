@@ -0,0 +1,202 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Wikimedia creates the directory for a dump, and the "latest" symlinks
+// to its files, while the dump is still running. If we started building
+// from such a dump, we would fail hours later with an unexpected EOF
+// from gzip. Therefore, ReadWikiSites() checks whether the dump files
+// of a site are complete. For sites whose latest dump is still being
+// written, it falls back to their previous complete dump.
+//
+// Dumps on the Wikimedia servers have a dumpstatus.json file with the
+// status of each job, which is the most reliable source. Mirrors often
+// only copy the checksum files, which list the files of finished jobs.
+// In addition, we decompress small files to check their gzip trailer;
+// for large files, this would take too long.
+const maxValidatedDumpSize = 32 * 1024 * 1024
+
+// GzipChecks caches the results of checkGzipComplete(), because
+// ReadWikiSites() gets called by every stage, and decompressing the
+// small dump files of hundreds of sites each time adds up. A file that
+// is still being written changes its size and modification time, which
+// invalidates the cached result.
+var gzipChecks = struct {
+	sync.Mutex
+	results map[string]gzipCheck
+}{results: make(map[string]gzipCheck, 1000)}
+
+type gzipCheck struct {
+	size    int64
+	modTime time.Time
+	err     error
+}
+
+// CheckDumpComplete returns an error if a file in the Wikimedia dumps
+// has not been completely written.
+func checkDumpComplete(path string) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	dir, name := filepath.Split(path)
+	checked, err := checkDumpStatus(filepath.Join(dir, "dumpstatus.json"), name, stat.Size())
+	if err != nil {
+		return err
+	}
+	if !checked {
+		if err := checkDumpChecksums(dir, name); err != nil {
+			return err
+		}
+	}
+
+	if strings.HasSuffix(name, ".gz") && stat.Size() <= maxValidatedDumpSize {
+		if err := checkGzipCompleteCached(path, stat); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// CheckGzipCompleteCached is like checkGzipComplete(), but only
+// decompresses a file if it has changed since the last check.
+func checkGzipCompleteCached(path string, stat fs.FileInfo) error {
+	gzipChecks.Lock()
+	c, ok := gzipChecks.results[path]
+	gzipChecks.Unlock()
+	if ok && c.size == stat.Size() && c.modTime.Equal(stat.ModTime()) {
+		return c.err
+	}
+
+	err := checkGzipComplete(path)
+	gzipChecks.Lock()
+	gzipChecks.results[path] = gzipCheck{size: stat.Size(), modTime: stat.ModTime(), err: err}
+	gzipChecks.Unlock()
+	return err
+}
+
+type dumpStatus struct {
+	Jobs map[string]struct {
+		Status string `json:"status"`
+		Files  map[string]struct {
+			Size int64 `json:"size"`
+		} `json:"files"`
+	} `json:"jobs"`
+}
+
+// CheckDumpStatus checks a file against the dumpstatus.json of its dump.
+// If there is no such status file, the result is false and no error.
+func checkDumpStatus(statusPath string, name string, size int64) (bool, error) {
+	data, err := os.ReadFile(statusPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	var status dumpStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return false, fmt.Errorf("%s: %w", statusPath, err)
+	}
+	for jobName, job := range status.Jobs {
+		file, ok := job.Files[name]
+		if !ok {
+			continue
+		}
+		if job.Status != "done" {
+			return true, fmt.Errorf("%s: job %s has status %q", name, jobName, job.Status)
+		}
+		if file.Size != 0 && file.Size != size {
+			return true, fmt.Errorf("%s: has %d bytes, dumpstatus.json says %d", name, size, file.Size)
+		}
+		return true, nil
+	}
+	return true, fmt.Errorf("%s: not listed in dumpstatus.json", name)
+}
+
+// CheckDumpChecksums checks that a file is listed in the md5sums or
+// sha1sums files of its dump, which only list the outputs of finished
+// jobs. If the dump has no checksum files, we cannot tell.
+func checkDumpChecksums(dir string, name string) error {
+	var checksumFiles []string
+	for _, pattern := range []string{"*-md5sums.txt", "*-sha1sums.txt"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return err
+		}
+		checksumFiles = append(checksumFiles, matches...)
+	}
+	if len(checksumFiles) == 0 {
+		return nil
+	}
+
+	for _, path := range checksumFiles {
+		listed, err := isListedInChecksums(path, name)
+		if err != nil {
+			return err
+		}
+		if listed {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: not listed in checksum files", name)
+}
+
+func isListedInChecksums(path string, name string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	// Lines look like "7d7b0f1c0b5e8f4d  rmwiki-20240301-page.sql.gz".
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[1] == name {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// CheckGzipComplete decompresses a file, which makes the gzip reader
+// verify the trailer at the end of the stream. For a truncated file,
+// the result is io.ErrUnexpectedEOF.
+func checkGzipComplete(path string) error {
+	f, err := openDump(context.Background(), path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	defer gz.Close()
+
+	_, err = io.Copy(io.Discard, gz)
+	return err
+}
@@ -0,0 +1,267 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCheckDumpComplete_Gzip(t *testing.T) {
+	dir := t.TempDir()
+	data := gzipForTest(t, "INSERT INTO `page` VALUES (1,0,'Foo');\n")
+	complete := filepath.Join(dir, "rmwiki-20240301-page.sql.gz")
+	if err := os.WriteFile(complete, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDumpComplete(complete); err != nil {
+		t.Errorf("complete file: got %v, want nil", err)
+	}
+
+	truncated := filepath.Join(dir, "rmwiki-20240301-pagelinks.sql.gz")
+	if err := os.WriteFile(truncated, data[:len(data)-5], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDumpComplete(truncated); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated file: got %v, want io.ErrUnexpectedEOF", err)
+	}
+
+	empty := filepath.Join(dir, "rmwiki-20240301-page_props.sql.gz")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDumpComplete(empty); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("empty file: got %v, want io.ErrUnexpectedEOF", err)
+	}
+
+	if err := checkDumpComplete(filepath.Join(dir, "missing.sql.gz")); !os.IsNotExist(err) {
+		t.Errorf("missing file: got %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestCheckDumpComplete_DumpStatus(t *testing.T) {
+	data := gzipForTest(t, "-- test\n")
+	for _, tc := range []struct {
+		name   string
+		status string
+		ok     bool
+	}{
+		{"done", `{"jobs": {"pagetable": {"status": "done", "files": {"rmwiki-20240301-page.sql.gz": {"size": SIZE}}}}}`, true},
+		{"done without size", `{"jobs": {"pagetable": {"status": "done", "files": {"rmwiki-20240301-page.sql.gz": {}}}}}`, true},
+		{"in progress", `{"jobs": {"pagetable": {"status": "in-progress", "files": {"rmwiki-20240301-page.sql.gz": {}}}}}`, false},
+		{"wrong size", `{"jobs": {"pagetable": {"status": "done", "files": {"rmwiki-20240301-page.sql.gz": {"size": 1}}}}}`, false},
+		{"not listed", `{"jobs": {"pagetable": {"status": "waiting", "files": {}}}}`, false},
+		{"bad json", `{"jobs": `, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "rmwiki-20240301-page.sql.gz")
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			status := bytes.ReplaceAll([]byte(tc.status), []byte("SIZE"), []byte(strconv.Itoa(len(data))))
+			if err := os.WriteFile(filepath.Join(dir, "dumpstatus.json"), status, 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := checkDumpComplete(path)
+			if tc.ok && err != nil {
+				t.Errorf("got %v, want nil", err)
+			} else if !tc.ok && err == nil {
+				t.Error("got nil, want error")
+			}
+		})
+	}
+}
+
+func TestCheckDumpComplete_Checksums(t *testing.T) {
+	dir := t.TempDir()
+	data := gzipForTest(t, "-- test\n")
+	for _, name := range []string{"rmwiki-20240301-page.sql.gz", "rmwiki-20240301-pagelinks.sql.gz"} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sums := "d41d8cd98f00b204e9800998ecf8427e  rmwiki-20240301-page.sql.gz\n"
+	if err := os.WriteFile(filepath.Join(dir, "rmwiki-20240301-md5sums.txt"), []byte(sums), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkDumpComplete(filepath.Join(dir, "rmwiki-20240301-page.sql.gz")); err != nil {
+		t.Errorf("listed file: got %v, want nil", err)
+	}
+	if err := checkDumpComplete(filepath.Join(dir, "rmwiki-20240301-pagelinks.sql.gz")); err == nil {
+		t.Error("unlisted file: got nil, want error")
+	}
+}
+
+func TestReadWikiSites_IncompleteDump(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	testdata, err := filepath.Abs(filepath.Join("testdata", "dumps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build a dumps directory where rmwikibooks is complete, but where
+	// the page table of rmwiki has been cut off in the middle.
+	dumps := t.TempDir()
+	mkdirs(t, filepath.Join(dumps, "metawiki", "latest"), filepath.Join(dumps, "rmwikibooks"),
+		filepath.Join(dumps, "rmwiki", "latest"), filepath.Join(dumps, "rmwiki", "20240301"))
+	symlink(t, filepath.Join(testdata, "metawiki", "latest", "metawiki-latest-sites.sql.gz"),
+		filepath.Join(dumps, "metawiki", "latest", "metawiki-latest-sites.sql.gz"))
+	for _, d := range []string{"latest", "20240301"} {
+		symlink(t, filepath.Join(testdata, "rmwikibooks", d), filepath.Join(dumps, "rmwikibooks", d))
+	}
+	for _, f := range []string{"page", "page_props", "siteinfo-namespaces"} {
+		ext := ".sql.gz"
+		if f == "siteinfo-namespaces" {
+			ext = ".json.gz"
+		}
+		name := "rmwiki-20240301-" + f + ext
+		symlink(t, filepath.Join(testdata, "rmwiki", "20240301", name), filepath.Join(dumps, "rmwiki", "20240301", name))
+		symlink(t, filepath.Join("..", "20240301", name), filepath.Join(dumps, "rmwiki", "latest", "rmwiki-latest-"+f+ext))
+	}
+	page := filepath.Join(dumps, "rmwiki", "20240301", "rmwiki-20240301-page.sql.gz")
+	data, err := os.ReadFile(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(page); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(page, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sites, err := ReadWikiSites(nil, dumps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sites.Sites["rmwikibooks"]; !ok {
+		t.Error("rmwikibooks should have been read")
+	}
+	if _, ok := sites.Sites["rmwiki"]; ok {
+		t.Error("rmwiki should have been skipped")
+	}
+	if _, ok := sites.Domains["rm.wikipedia.org"]; ok {
+		t.Error("rm.wikipedia.org should have been skipped")
+	}
+}
+
+func TestCheckDumpComplete_Cached(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rmwiki-20240301-page.sql.gz")
+	data := gzipForTest(t, "INSERT INTO `page` VALUES (1,0,'Foo');\n")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDumpComplete(path); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Garble the trailer without changing size or modification time.
+	// The result of the first check should get re-used.
+	garbled := bytes.Clone(data)
+	garbled[len(garbled)-1] ^= 0xff
+	if err := os.WriteFile(path, garbled, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, stat.ModTime(), stat.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDumpComplete(path); err != nil {
+		t.Errorf("unchanged file: got %v, want cached nil", err)
+	}
+
+	// Once the modification time changes, the file gets checked again.
+	later := stat.ModTime().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDumpComplete(path); err == nil {
+		t.Error("changed file: got nil, want error")
+	}
+}
+
+func TestReadWikiSites_PreviousDump(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	testdata, err := filepath.Abs(filepath.Join("testdata", "dumps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The latest dump of rmwiki, from 2024-03-01, is still being
+	// written, but the one of 2024-02-01 is complete.
+	dumps := t.TempDir()
+	mkdirs(t, filepath.Join(dumps, "metawiki", "latest"), filepath.Join(dumps, "rmwiki", "latest"),
+		filepath.Join(dumps, "rmwiki", "20240201"), filepath.Join(dumps, "rmwiki", "20240301"))
+	symlink(t, filepath.Join(testdata, "metawiki", "latest", "metawiki-latest-sites.sql.gz"),
+		filepath.Join(dumps, "metawiki", "latest", "metawiki-latest-sites.sql.gz"))
+	for _, f := range []string{"page.sql.gz", "page_props.sql.gz", "siteinfo-namespaces.json.gz"} {
+		src := filepath.Join(testdata, "rmwiki", "20240301", "rmwiki-20240301-"+f)
+		for _, d := range []string{"20240201", "20240301"} {
+			symlink(t, src, filepath.Join(dumps, "rmwiki", d, "rmwiki-"+d+"-"+f))
+		}
+		symlink(t, filepath.Join("..", "20240301", "rmwiki-20240301-"+f), filepath.Join(dumps, "rmwiki", "latest", "rmwiki-latest-"+f))
+	}
+	page := filepath.Join(dumps, "rmwiki", "20240301", "rmwiki-20240301-page.sql.gz")
+	data, err := os.ReadFile(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(page); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(page, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sites, err := ReadWikiSites(nil, dumps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	site, ok := sites.Sites["rmwiki"]
+	if !ok {
+		t.Fatal("rmwiki should have fallen back to its previous dump")
+	}
+	if got := site.LastDumped.Format(time.DateOnly); got != "2024-02-01" {
+		t.Errorf("got LastDumped %s, want 2024-02-01", got)
+	}
+}
+
+func gzipForTest(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func mkdirs(t *testing.T, dirs ...string) {
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func symlink(t *testing.T, target string, link string) {
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,144 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata/e2e/golden")
+
+// TestEndToEnd runs the entire pipeline on a miniature dumps tree, with
+// three wikis and two weeks of pageviews, and compares every file that
+// ends up in storage to a golden file. After an intentional change
+// to the output, regenerate the golden files with
+//
+//	go test ./cmd/qrank-builder -run TestEndToEnd -update
+//
+// and review the diff before committing.
+func TestEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	golden := filepath.Join("testdata", "e2e", "golden")
+	got := buildEndToEnd(t)
+	if *updateGolden {
+		if err := os.RemoveAll(golden); err != nil {
+			t.Fatal(err)
+		}
+		for path, content := range got {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return
+	}
+	checkGolden(t, got, golden)
+}
+
+// TestEndToEnd_LowMem checks that the low-mem resource profile builds
+// the same files as the default one. To make external sorting spill
+// to disk even for the miniature dumps, chunks are tiny.
+func TestEndToEnd_LowMem(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	defer func(saved Resources) { resources = saved }(resources)
+	resources = LowMemResources()
+	resources.SortChunkBytes = 256
+	checkGolden(t, buildEndToEnd(t), filepath.Join("testdata", "e2e", "golden"))
+}
+
+// BuildEndToEnd runs the pipeline on the miniature dumps tree,
+// and returns the content of the built files by golden path.
+func buildEndToEnd(t *testing.T) map[string]string {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	dumps := filepath.Join("testdata", "e2e", "dumps")
+	golden := filepath.Join("testdata", "e2e", "golden")
+	client := &http.Client{Transport: &FakeWikiSite{}}
+	s3 := NewFakeS3()
+	if err := Build(client, dumps /*numWeeks*/, 2, s3); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string, len(s3.data))
+	for key := range s3.data {
+		// Build reports record timings, which differ between runs;
+		// they are checked by TestBuildStage_Report. The cached
+		// interwiki map is named after the day of the test run.
+		if strings.HasPrefix(key, "internal/qrank-builder/") || interwikiMapPathRegexp.MatchString(key) {
+			continue
+		}
+		lines, err := s3.ReadLines(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[goldenPath(golden, key)] = strings.Join(lines, "\n") + "\n"
+	}
+	return got
+}
+
+// CheckGolden compares built files to the golden files.
+func checkGolden(t *testing.T, got map[string]string, golden string) {
+	t.Helper()
+	want := make(map[string]string, len(got))
+	err := filepath.WalkDir(golden, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		want[path] = string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := make([]string, 0, len(got)+len(want))
+	for path := range got {
+		paths = append(paths, path)
+	}
+	for path := range want {
+		if _, ok := got[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		g, inGot := got[path]
+		w, inWant := want[path]
+		if !inWant {
+			t.Errorf("%s: not in golden files", path)
+		} else if !inGot {
+			t.Errorf("%s: not built", path)
+		} else if g != w {
+			t.Errorf("%s: got %q, want %q", path, g, w)
+		}
+	}
+}
+
+// GoldenPath returns the path of the golden file for a storage key.
+// Golden files hold the decompressed content, so they can be reviewed
+// in diffs; the ".zst" suffix of the key is therefore dropped.
+func goldenPath(golden string, key string) string {
+	return filepath.Join(golden, filepath.FromSlash(strings.TrimSuffix(key, ".zst")))
+}
@@ -0,0 +1,147 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The Wikimedia Enterprise HTML dumps contain the rendered HTML
+// of every article, which tells things about a page that are hard
+// to find out from wikitext, such as the number of outgoing links
+// after template expansion, or whether the page has an infobox.
+// On Toolforge, the dumps get mirrored to the directory
+// /public/dumps/public/other/enterprise_html/runs, with one
+// subdirectory for each run, such as "20240501".
+// https://dumps.wikimedia.org/other/enterprise_html/
+
+// FindEnterpriseDump returns the path to the most recent Enterprise
+// HTML dump for a site, such as "runs/20240501/rmwiki-NS0-20240501-
+// ENTERPRISE-HTML.json.tar.gz". If there is no dump for the site,
+// the result is the empty string without error.
+func findEnterpriseDump(dir string, siteKey string) (string, error) {
+	runs, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	dates := make([]string, 0, len(runs))
+	for _, r := range runs {
+		if r.IsDir() && enterpriseRunRegexp.MatchString(r.Name()) {
+			dates = append(dates, r.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dates)))
+
+	for _, date := range dates {
+		name := fmt.Sprintf("%s-NS0-%s-ENTERPRISE-HTML.json.tar.gz", siteKey, date)
+		path := filepath.Join(dir, date, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+var enterpriseRunRegexp = regexp.MustCompile(`^\d{8}$`)
+
+// EnterpriseArticle is the subset of an Enterprise HTML dump record
+// that we need for computing signals.
+type enterpriseArticle struct {
+	Identifier  int64 `json:"identifier"` // page id
+	ArticleBody struct {
+		HTML string `json:"html"`
+	} `json:"article_body"`
+}
+
+// ProcessEnterpriseDump processes an Enterprise HTML dump, which is
+// a tar.gz archive of newline-delimited JSON files. For each page,
+// it emits lines of the form "200,o=17" for the number of outgoing
+// links to other articles, and "200,b=1" if the page has an infobox.
+// Called by function buildPageSignals().
+func processEnterpriseDump(ctx context.Context, path string, out chan<- string) error {
+	file, err := openDump(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(header.Name, ".ndjson") {
+			continue
+		}
+
+		decoder := json.NewDecoder(archive)
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			var article enterpriseArticle
+			if err := decoder.Decode(&article); err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("%s: %s: %w", path, header.Name, err)
+			}
+
+			if article.Identifier <= 0 {
+				continue
+			}
+			html := []byte(article.ArticleBody.HTML)
+			if n := countOutlinks(html); n > 0 {
+				out <- fmt.Sprintf("%d,o=%d", article.Identifier, n)
+			}
+			if hasInfobox(html) {
+				out <- fmt.Sprintf("%d,b=1", article.Identifier)
+			}
+		}
+	}
+}
+
+var wikiLinkMarker = []byte(`rel="mw:WikiLink"`)
+
+// CountOutlinks returns the number of links to other wiki pages
+// in a page rendered by Parsoid, which marks them as mw:WikiLink.
+func countOutlinks(html []byte) int {
+	return bytes.Count(html, wikiLinkMarker)
+}
+
+var infoboxRegexp = regexp.MustCompile(`class="([^"]* )?infobox[" ]`)
+
+// HasInfobox returns true if the HTML of a page contains an infobox.
+// Most Wikipedia editions mark their infoboxes with the CSS class
+// "infobox", sometimes together with other classes such as "vcard".
+func hasInfobox(html []byte) bool {
+	return infoboxRegexp.Match(html)
+}
@@ -0,0 +1,144 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestFindEnterpriseDump(t *testing.T) {
+	dir := t.TempDir()
+	for _, path := range []string{
+		"20240401/rmwiki-NS0-20240401-ENTERPRISE-HTML.json.tar.gz",
+		"20240401/dewiki-NS0-20240401-ENTERPRISE-HTML.json.tar.gz",
+		"20240501/dewiki-NS0-20240501-ENTERPRISE-HTML.json.tar.gz",
+		"latest/rmwiki-NS0-latest-ENTERPRISE-HTML.json.tar.gz",
+	} {
+		p := filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct{ site, want string }{
+		{"rmwiki", "20240401/rmwiki-NS0-20240401-ENTERPRISE-HTML.json.tar.gz"},
+		{"dewiki", "20240501/dewiki-NS0-20240501-ENTERPRISE-HTML.json.tar.gz"},
+		{"frwiki", ""},
+	} {
+		got, err := findEnterpriseDump(dir, tc.site)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := tc.want
+		if want != "" {
+			want = filepath.Join(dir, want)
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", tc.site, got, want)
+		}
+	}
+
+	if _, err := findEnterpriseDump(filepath.Join(dir, "missing"), "rmwiki"); err == nil {
+		t.Error("expected error for missing directory")
+	}
+}
+
+func TestProcessEnterpriseDump(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rmwiki-NS0-20240501-ENTERPRISE-HTML.json.tar.gz")
+	writeEnterpriseDump(t, path, map[string]string{
+		"rmwiki_namespace_0_0.ndjson": `{"name":"Zürich","identifier":7,"article_body":{"html":"<a rel=\"mw:WikiLink\" href=\"./Svizra\">Svizra</a> <a rel=\"mw:WikiLink\" href=\"./Limmat\">Limmat</a>"}}
+{"name":"Berna","identifier":8,"article_body":{"html":"<table class=\"infobox vcard\"></table>"}}
+{"name":"Vid","identifier":9,"article_body":{"html":"<p>Vid</p>"}}
+`,
+		"README.txt": "ignored",
+	})
+
+	ch := make(chan string, 10)
+	if err := processEnterpriseDump(context.Background(), path, ch); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	got := make([]string, 0, 10)
+	for line := range ch {
+		got = append(got, line)
+	}
+	want := []string{"7,o=2", "8,b=1"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCountOutlinks(t *testing.T) {
+	for _, tc := range []struct {
+		html string
+		want int
+	}{
+		{``, 0},
+		{`<a rel="mw:ExtLink" href="https://example.org/">x</a>`, 0},
+		{`<a rel="mw:WikiLink" href="./Q">Q</a><a rel="mw:WikiLink" href="./R">R</a>`, 2},
+	} {
+		if got := countOutlinks([]byte(tc.html)); got != tc.want {
+			t.Errorf("countOutlinks(%q) = %d, want %d", tc.html, got, tc.want)
+		}
+	}
+}
+
+func TestHasInfobox(t *testing.T) {
+	for _, tc := range []struct {
+		html string
+		want bool
+	}{
+		{``, false},
+		{`<table class="infobox">`, true},
+		{`<table class="infobox vcard">`, true},
+		{`<table class="wikitable infobox">`, true},
+		{`<table class="infoboxes">`, false},
+		{`<div class="noinfobox">`, false},
+	} {
+		if got := hasInfobox([]byte(tc.html)); got != tc.want {
+			t.Errorf("hasInfobox(%q) = %v, want %v", tc.html, got, tc.want)
+		}
+	}
+}
+
+func writeEnterpriseDump(t *testing.T, path string, files map[string]string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	archive := tar.NewWriter(gz)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		content := files[name]
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}
+		if err := archive.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -12,7 +12,6 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"time"
 
@@ -24,6 +23,9 @@ import (
 )
 
 func findEntitiesDump(dumpsPath string) (time.Time, string, error) {
+	if !pinnedDumpDate.IsZero() {
+		return findPinnedEntityDump(dumpsPath, "all.json.bz2")
+	}
 	path := filepath.Join(dumpsPath, "wikidatawiki", "entities", "latest-all.json.bz2")
 	resolved, err := filepath.EvalSymlinks(path)
 	if err != nil {
@@ -179,11 +181,9 @@ func processEntities(testRun bool, path string, date time.Time, outDir string, c
 	defer sitelinksWriter.Close()
 
 	ch := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 16 // 8 MiB, 16 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
-	sorter, outChan, errChan := extsort.Strings(ch, config)
+	config := newSortConfig(16)
 	g, subCtx := errgroup.WithContext(ctx)
+	sorter, outChan, errChan := extsort.Strings(sortInput(subCtx, "entities", ch, config), config)
 	g.Go(func() error {
 		return readEntities(testRun, path, ch, subCtx)
 	})
@@ -236,7 +236,7 @@ func readEntities(testRun bool, path string, sitelinks chan<- string, ctx contex
 
 	// To keep CPU cores busy while tasks are blocked waiting for input,
 	// we use more worker tasks than we have CPUs.
-	numSplits := runtime.NumCPU() * 4
+	numSplits := resources.Workers * 4
 	if testRun {
 		numSplits = 2
 	}
@@ -0,0 +1,375 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/minio/minio-go/v7"
+)
+
+// The full dumps of the page and page_props tables come out twice
+// a month, and for the largest wikis they often take a week or two
+// to finish. To keep page signals fresh in between, we apply the
+// daily “adds-changes” dumps on top of the page_signals file that
+// was built from the last full dump. These increments contain the
+// latest revisions of all pages that were created or edited that day,
+// but neither page properties nor deletions. Therefore, we can update
+// the size of edited pages, and for Wikidata we learn about newly
+// created items; but new pages of other wikis only get an entity
+// once the next full dump has been processed.
+// https://dumps.wikimedia.org/other/incr/
+
+// IncrementState records which adds-changes dumps have been applied
+// to the page_signals file of a site. It is kept in storage next to
+// the other build state, see IncrementStatePath().
+type IncrementState struct {
+	Site    string   `json:"site"`
+	Dumped  string   `json:"dumped"`  // date of the full dump, YYYY-MM-DD
+	Applied []string `json:"applied"` // dates of applied increments, YYYY-MM-DD
+}
+
+var incrementStateRegexp = regexp.MustCompile(`^\d{8}\.json$`)
+
+var siteKeyRegexp = regexp.MustCompile(`^[a-z0-9_\-]+$`)
+
+// ParseSiteList parses a comma-separated list of site keys,
+// such as "enwiki,wikidatawiki", for the -incremental-sites flag.
+func ParseSiteList(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	sites := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if !siteKeyRegexp.MatchString(p) {
+			return nil, fmt.Errorf("bad site %q, expected a Wikimedia site key such as enwiki", p)
+		}
+		if !slices.Contains(sites, p) {
+			sites = append(sites, p)
+		}
+	}
+	return sites, nil
+}
+
+// BuildIncrementalPageSignals applies the adds-changes dumps that have
+// appeared since the last run to the page_signals files of the given
+// sites, such as "enwiki" and "wikidatawiki".
+func buildIncrementalPageSignals(ctx context.Context, dumps string, sites *WikiSites, keys []string, s3 S3) error {
+	for _, key := range keys {
+		site, ok := sites.Sites[key]
+		if !ok {
+			return fmt.Errorf("unknown site %q for incremental page signals", key)
+		}
+		if pastBuildDeadline(ctx) {
+			return ErrMaxRuntime
+		}
+		siteCtx, step := startSiteReportStep(ctx, key)
+		err := applyIncrements(siteCtx, dumps, site, s3)
+		step.finish(err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyIncrements updates the page_signals file of a site in storage
+// with the adds-changes dumps that have not been applied yet.
+func applyIncrements(ctx context.Context, dumps string, site *WikiSite, s3 S3) error {
+	statePath := IncrementStatePath(site.Key, site.LastDumped)
+	state := &IncrementState{Site: site.Key, Dumped: site.LastDumped.Format(time.DateOnly)}
+	var outdated []string
+	prefix := fmt.Sprintf("increments/%s-", site.Key)
+	opts := minio.ListObjectsOptions{Prefix: prefix}
+	for obj := range s3.ListObjects(ctx, "qrank", opts) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if !incrementStateRegexp.MatchString(strings.TrimPrefix(obj.Key, prefix)) {
+			continue // state of another site, such as "be-taraskwiki" for "be"
+		}
+		if obj.Key != statePath {
+			outdated = append(outdated, obj.Key)
+			continue
+		}
+		stored, err := readIncrementState(ctx, statePath, s3)
+		if err != nil {
+			return err
+		}
+		state = stored
+	}
+
+	after := site.LastDumped
+	if n := len(state.Applied); n > 0 {
+		last, err := time.Parse(time.DateOnly, state.Applied[n-1])
+		if err != nil {
+			return err
+		}
+		after = last
+	}
+	days, err := findIncrements(dumps, site.Key, after)
+	if err != nil {
+		return err
+	}
+	if len(days) == 0 {
+		logger.Printf("no new adds-changes dumps for %s", site.Key)
+		return nil
+	}
+
+	updates := make(map[string]*pageUpdate, 10000)
+	isWikidata := site.Key == "wikidatawiki"
+	for _, day := range days {
+		if err := readIncrement(ctx, incrementPath(dumps, site.Key, day), isWikidata, updates); err != nil {
+			return err
+		}
+		state.Applied = append(state.Applied, day.Format(time.DateOnly))
+	}
+
+	destPath := site.S3Path("page_signals")
+	logger.Printf("applying %d adds-changes dumps with %d changed pages to %s", len(days), len(updates), destPath)
+	outFile, err := os.CreateTemp("", "*-page_signals.zst")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(outFile.Name())
+
+	reader, err := NewS3ReaderWithOptions(ctx, "qrank", destPath, s3, S3ReaderOptions{Compression: ZstdCompressed})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	zstdLevel := zstd.WithEncoderLevel(zstd.SpeedBestCompression)
+	writer, err := zstd.NewWriter(outFile, zstdLevel)
+	if err != nil {
+		return err
+	}
+	if err := updatePageSignals(reader, updates, writer); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := outFile.Close(); err != nil {
+		return err
+	}
+
+	// Applying the same increment twice gives the same result,
+	// so it does not matter if we crash before storing the state.
+	if err := PutInStorage(ctx, outFile.Name(), s3, "qrank", destPath, "application/zstd"); err != nil {
+		return err
+	}
+	if err := PutJSON(ctx, state, s3, "qrank", statePath); err != nil {
+		return err
+	}
+	for _, key := range outdated {
+		logger.Printf("deleting outdated increment state %s", key)
+		if err := s3.RemoveObject(ctx, "qrank", key, minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readIncrementState(ctx context.Context, path string, s3 S3) (*IncrementState, error) {
+	reader, err := NewS3Reader(ctx, "qrank", path, s3)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var state IncrementState
+	if err := json.NewDecoder(reader).Decode(&state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// FindIncrements returns the dates of the finished adds-changes dumps
+// for a site that are more recent than a given date, in ascending order.
+func findIncrements(dumps string, siteKey string, after time.Time) ([]time.Time, error) {
+	dir := filepath.Join(dumps, "other", "incr", siteKey)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var result []time.Time
+	for _, e := range entries {
+		day, err := time.Parse("20060102", e.Name())
+		if err != nil || !e.IsDir() || !day.After(after) {
+			continue
+		}
+
+		// Wikimedia writes status.txt once the dump is complete.
+		status, err := os.ReadFile(filepath.Join(dir, e.Name(), "status.txt"))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(string(status)) != "done" {
+			continue
+		}
+		result = append(result, day)
+	}
+	slices.SortFunc(result, func(a, b time.Time) int { return a.Compare(b) })
+	return result, nil
+}
+
+// IncrementPath returns the local path of an adds-changes dump, such as
+// dumps/other/incr/rmwiki/20240302/rmwiki-20240302-pages-meta-hist-incr.xml.bz2.
+func incrementPath(dumps string, siteKey string, day time.Time) string {
+	ymd := day.Format("20060102")
+	filename := fmt.Sprintf("%s-%s-pages-meta-hist-incr.xml.bz2", siteKey, ymd)
+	return filepath.Join(dumps, "other", "incr", siteKey, ymd, filename)
+}
+
+// PageUpdate tells how a page has changed in adds-changes dumps.
+type pageUpdate struct {
+	entity   string // only for new items on Wikidata, empty otherwise
+	pageSize int64  // negative if the page is not in wikitext format
+}
+
+// ReadIncrement reads an adds-changes dump and records the latest state
+// of every page into updates, replacing what was recorded for earlier
+// dumps.
+func readIncrement(ctx context.Context, path string, isWikidata bool, updates map[string]*pageUpdate) error {
+	file, err := openDump(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	bz, err := bzip2.NewReader(file, nil)
+	if err != nil {
+		return err
+	}
+	defer bz.Close()
+
+	type revision struct {
+		Model string `xml:"model"`
+		Text  struct {
+			Bytes int64 `xml:"bytes,attr"`
+		} `xml:"text"`
+	}
+	type page struct {
+		Title     string     `xml:"title"`
+		NS        int        `xml:"ns"`
+		ID        int64      `xml:"id"`
+		Revisions []revision `xml:"revision"`
+	}
+
+	decoder := xml.NewDecoder(bufio.NewReader(bz))
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "page" {
+			continue
+		}
+
+		var p page
+		if err := decoder.DecodeElement(&p, &start); err != nil {
+			return err
+		}
+		if len(p.Revisions) == 0 {
+			continue
+		}
+
+		// Revisions are listed in chronological order.
+		rev := p.Revisions[len(p.Revisions)-1]
+		u := &pageUpdate{pageSize: -1}
+		if rev.Model == "wikitext" {
+			u.pageSize = rev.Text.Bytes
+		}
+		if isWikidata && p.NS == 0 && wikidataTitleRe.MatchString(p.Title) {
+			u.entity = p.Title
+		}
+		updates[strconv.FormatInt(p.ID, 10)] = u
+	}
+}
+
+// UpdatePageSignals copies a page_signals file from r to w, updating
+// the page size of changed pages. New pages get inserted if we know
+// their entity. Page signals are sorted by the string "<page>,".
+func updatePageSignals(r io.Reader, updates map[string]*pageUpdate, w io.Writer) error {
+	var added []string
+	for page, u := range updates {
+		if u.entity != "" {
+			added = append(added, page+",")
+		}
+	}
+	slices.Sort(added)
+
+	out := bufio.NewWriter(w)
+	writeAdded := func(page string) error {
+		u := updates[page]
+		cols := []string{page, u.entity, formatPositive(u.pageSize)}
+		_, err := out.WriteString(strings.Join(cols, ",") + "\n")
+		return err
+	}
+
+	scanner := NewLineScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		cols := strings.Split(line, ",")
+		key := cols[0] + ","
+		for len(added) > 0 && added[0] < key {
+			if err := writeAdded(strings.TrimSuffix(added[0], ",")); err != nil {
+				return err
+			}
+			added = added[1:]
+		}
+		if len(added) > 0 && added[0] == key {
+			added = added[1:] // already known from the full dump
+		}
+		if u, ok := updates[cols[0]]; ok && u.pageSize >= 0 && len(cols) >= 3 {
+			cols[2] = formatPositive(u.pageSize)
+			line = strings.Join(cols, ",")
+		}
+		if _, err := out.WriteString(line + "\n"); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, key := range added {
+		if err := writeAdded(strings.TrimSuffix(key, ",")); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestApplyIncrements(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	dumps := filepath.Join("testdata", "dumps")
+	dumped, _ := time.Parse(time.DateOnly, "2024-04-01")
+	site := &WikiSite{Key: "wikidatawiki", Domain: "www.wikidata.org", LastDumped: dumped}
+	s3 := NewFakeS3()
+	s3.WriteLines([]string{"1000001,Q99,,3", "7,Q5296,90"}, "page_signals/wikidatawiki-20240401-page_signals.zst")
+	s3.data["increments/wikidatawiki-20240301.json"] = []byte(`{"site":"wikidatawiki"}`)
+
+	if err := applyIncrements(ctx, dumps, site, s3); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s3.ReadLines("page_signals/wikidatawiki-20240401-page_signals.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"1000001,Q99,,3",
+		"1000002,Q1000002,",
+		"7,Q5296,131",
+		"900001,Q1000001,",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	var state IncrementState
+	if err := json.Unmarshal(s3.data["increments/wikidatawiki-20240401.json"], &state); err != nil {
+		t.Fatal(err)
+	}
+	// The dump of 2024-04-04 is not finished yet.
+	if wantApplied := []string{"2024-04-02", "2024-04-03"}; !slices.Equal(state.Applied, wantApplied) {
+		t.Errorf("got applied %v, want %v", state.Applied, wantApplied)
+	}
+	if _, found := s3.data["increments/wikidatawiki-20240301.json"]; found {
+		t.Error("outdated increment state should have been deleted")
+	}
+
+	// Running again should not change anything.
+	s3.WriteLines([]string{"7,Q5296,1"}, "page_signals/wikidatawiki-20240401-page_signals.zst")
+	if err := applyIncrements(ctx, dumps, site, s3); err != nil {
+		t.Fatal(err)
+	}
+	got, err = s3.ReadLines("page_signals/wikidatawiki-20240401-page_signals.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"7,Q5296,1"}; !slices.Equal(got, want) {
+		t.Errorf("second run: got %v, want %v", got, want)
+	}
+}
+
+func TestParseSiteList(t *testing.T) {
+	got, err := ParseSiteList(" enwiki,wikidatawiki,enwiki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"enwiki", "wikidatawiki"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got, err := ParseSiteList(""); got != nil || err != nil {
+		t.Errorf("got %v, %v, want nil, nil", got, err)
+	}
+
+	if _, err := ParseSiteList("enwiki,en.wikipedia.org"); err == nil {
+		t.Error("expected error for bad site key")
+	}
+}
@@ -0,0 +1,154 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/lanrat/extsort"
+)
+
+// BuildInlinks counts the incoming links of items in the `links` file
+// of a WikiSite, and puts the result into storage. The output has lines
+// such as "Q72,188", telling that pages of 188 distinct items link to
+// a page of Q72 on the site. Because the `links` file has each pair of
+// items only once, links from several pages of the same item, or from
+// a page to several redirects of the target, are counted just once.
+//
+// The in-degree is a much cheaper signal than PageRank, since it only
+// needs a single sort of the link targets, and it is easy to explain
+// to users of the rankings.
+func buildInlinks(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
+	dest := site.S3Path("inlinks")
+	logger.Printf("building %s", dest)
+	start := time.Now()
+
+	opts := S3ReaderOptions{Compression: ZstdCompressed}
+	links, err := NewS3ReaderWithOptions(ctx, "qrank", site.S3Path("links"), s3, opts)
+	if err != nil {
+		return err
+	}
+	defer links.Close()
+
+	outFile, err := os.CreateTemp("", "inlinks-*.zst")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(outFile.Name())
+	defer outFile.Close()
+
+	writer, err := zstd.NewWriter(outFile, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	numItems := 0
+	ch := make(chan string, 10000)
+	config := newSortConfig(16)
+	g, subCtx := errgroup.WithContext(ctx)
+	sorter, outChan, errChan := extsort.Strings(sortInput(subCtx, "inlinks", ch, config), config)
+	g.Go(func() error {
+		defer close(ch)
+		return readInlinkTargets(subCtx, links, ch)
+	})
+	g.Go(func() error {
+		sorter.Sort(subCtx)
+		n, err := countItemLines(subCtx, outChan, writer)
+		numItems = n
+		return err
+	})
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if err := <-errChan; err != nil {
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := outFile.Close(); err != nil {
+		return err
+	}
+
+	if err := PutInStorage(ctx, outFile.Name(), s3, "qrank", dest, "application/zstd"); err != nil {
+		return err
+	}
+	logger.Printf("built %s with inlinks for %d items in %.1fs",
+		dest, numItems, time.Since(start).Seconds())
+	return nil
+}
+
+// ReadInlinkTargets reads a `links` file with lines such as "Q72,Q4022",
+// and emits the target of every link, such as "Q4022".
+func readInlinkTargets(ctx context.Context, r io.Reader, out chan<- string) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		link, ok := parseLinkLine(line)
+		if !ok {
+			return fmt.Errorf(`bad line in links: "%s"`, line)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- fmt.Sprintf("Q%d", link.Target):
+		}
+	}
+	return scanner.Err()
+}
+
+// SendInlinks reads the inlinks files of all sites, and emits ItemSignals
+// that only carry the item and its number of inlinks on one site.
+// The signals of the same item get summed up when they are written.
+func sendInlinks(ctx context.Context, sites *WikiSites, s3 S3, out chan<- extsort.SortType) error {
+	keys := make([]string, 0, len(sites.Sites))
+	for key := range sites.Sites {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		path := sites.Sites[key].S3Path("inlinks")
+		opts := S3ReaderOptions{Compression: ZstdCompressed}
+		reader, err := NewS3ReaderWithOptions(ctx, "qrank", path, s3, opts)
+		if err != nil {
+			return err
+		}
+		err = sendInlinksFrom(ctx, reader, out)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func sendInlinksFrom(ctx context.Context, r io.Reader, out chan<- extsort.SortType) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Same format as sitelinks, such as "Q72,188".
+		item, count, ok := parseSitelinksLine(line)
+		if !ok {
+			return fmt.Errorf(`bad line in inlinks: "%s"`, line)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- ItemSignals{item: item, inlinks: count}:
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,142 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lanrat/extsort"
+)
+
+func TestBuildInlinks(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	dumped, _ := time.Parse(time.DateOnly, "2024-05-01")
+	site := &WikiSite{Key: "rmwiki", Domain: "rm.wikipedia.org", LastDumped: dumped}
+	s3.WriteLines([]string{
+		"Q72,Q4022",
+		"Q72,Q11943",
+		"Q4022,Q72",
+		"Q11943,Q72",
+		"Q11943,Q4022",
+	}, site.S3Path("links"))
+
+	if err := buildInlinks(site, ctx, "", s3); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s3.ReadLines(site.S3Path("inlinks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Q11943,1", "Q4022,2", "Q72,2"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestBuildInlinks_BadLine(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	s3 := NewFakeS3()
+	dumped, _ := time.Parse(time.DateOnly, "2024-05-01")
+	site := &WikiSite{Key: "rmwiki", Domain: "rm.wikipedia.org", LastDumped: dumped}
+	s3.WriteLines([]string{"Q72,Q4022", "junk"}, site.S3Path("links"))
+	err := buildInlinks(site, context.Background(), "", s3)
+	if err == nil || !strings.Contains(err.Error(), "junk") {
+		t.Errorf("got %v, want error about bad line", err)
+	}
+}
+
+func TestSendInlinks(t *testing.T) {
+	s3 := NewFakeS3()
+	rmDumped, _ := time.Parse(time.DateOnly, "2024-05-01")
+	deDumped, _ := time.Parse(time.DateOnly, "2024-05-20")
+	sites := &WikiSites{Sites: map[string]*WikiSite{
+		"dewiki": {Key: "dewiki", Domain: "de.wikipedia.org", LastDumped: deDumped},
+		"rmwiki": {Key: "rmwiki", Domain: "rm.wikipedia.org", LastDumped: rmDumped},
+	}}
+	s3.WriteLines([]string{"Q4022,2", "Q72,17"}, "inlinks/dewiki-20240520-inlinks.zst")
+	s3.WriteLines([]string{"Q72,3"}, "inlinks/rmwiki-20240501-inlinks.zst")
+
+	ch := make(chan extsort.SortType, 10)
+	if err := sendInlinks(context.Background(), sites, s3, ch); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	var got []ItemSignals
+	for s := range ch {
+		got = append(got, s.(ItemSignals))
+	}
+	want := []ItemSignals{{item: 4022, inlinks: 2}, {item: 72, inlinks: 17}, {item: 72, inlinks: 3}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Without the output of the inlinks stage, we should fail.
+	delete(s3.data, "inlinks/rmwiki-20240501-inlinks.zst")
+	if err := sendInlinks(context.Background(), sites, s3, make(chan extsort.SortType, 10)); err == nil {
+		t.Error("expected error when inlinks are missing from storage")
+	}
+}
+
+func TestBuildItemSignals_Inlinks(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	s3.WriteLines([]string{"rm.wikipedia,1,5", "rm.wikipedia,3824,7", "rm.wikipedia,799,7"}, "pageviews/pageviews-2011-W07.zst")
+	s3.WriteLines([]string{"1,Q5296,2500", "3824,Q662541,4973", "799,Q72,3142"}, "page_signals/rmwiki-20111209-page_signals.zst")
+	s3.WriteLines([]string{"Q72,Q515"}, "classes/wikidatawiki-20111201-classes.zst")
+	s3.WriteLines([]string{"Q8,Q9"}, "merged_items/wikidatawiki-20111201-merged_items.zst")
+	rmDumped, _ := time.Parse(time.DateOnly, "2011-12-09")
+	rmwikiSite := &WikiSite{Key: "rmwiki", Domain: "rm.wikipedia.org", LastDumped: rmDumped}
+	sites := &WikiSites{
+		Sites:   map[string]*WikiSite{"rmwiki": rmwikiSite},
+		Domains: map[string]*WikiSite{"rm.wikipedia.org": rmwikiSite},
+	}
+	pageviews := []string{"pageviews/pageviews-2011-W07.zst"}
+	opts := BuildOptions{ItemSignalsSchema: 8}
+
+	// Q4 is a link target without any page, so it has no row.
+	s3.WriteLines([]string{"Q4,1", "Q72,2", "Q5296,1"}, "inlinks/rmwiki-20111209-inlinks.zst")
+	if _, err := buildItemSignals(ctx, pageviews, sites, opts, s3); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s3.ReadLines("public/item_signals-20111209.csv.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes,pageviews_52w_max_wiki,class,merged_into,is_stub,external_links,templates,inlinks",
+		"Q72,7,3142,0,0,0,0,0,0,7,Q515,,0,0,0,2",
+		"Q5296,5,2500,0,0,0,0,0,0,5,,,0,0,0,1",
+		"Q662541,7,4973,0,0,0,0,0,0,7,,,0,0,0,0",
+	}
+	if len(got) < len(want) || !slices.Equal(got[len(got)-len(want):], want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestBuildOptions_NeedsInlinks(t *testing.T) {
+	for _, tc := range []struct {
+		schema int
+		want   bool
+	}{
+		{0, false},
+		{7, false},
+		{8, true},
+	} {
+		opts := BuildOptions{ItemSignalsSchema: tc.schema}
+		if got := opts.needsInlinks(); got != tc.want {
+			t.Errorf("schema %d: got %v, want %v", tc.schema, got, tc.want)
+		}
+	}
+}
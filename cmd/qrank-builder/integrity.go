@@ -0,0 +1,459 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Before we used multipart uploads, a builder that crashed in the middle
+// of an upload could leave a truncated object in storage. Later stages
+// would then only notice when zstd failed deep into a merge, and every
+// retry would fail in the same way. Therefore, every .zst object gets
+// stored with its size and SHA-256 digest in the object metadata, and
+// downloads get validated before anyone reads them. Objects that were
+// stored before we recorded digests get checked for a complete last
+// zstd frame, which catches truncation without knowing the digest.
+// On machines that stream objects from storage instead of downloading
+// them, the same checks happen while the stream is being read; see
+// validatingReader.
+//
+// If an intermediate file fails validation, we remove it from storage,
+// so that the stage that produces it builds it again; see BuildStage().
+// Published files are left alone, since downstream users may already
+// have fetched them, and an operator should take a look.
+
+// Keys of the user metadata for validating stored objects. S3 returns
+// them in canonical header form, which is why they are capitalized.
+const (
+	integritySizeKey   = "Qrank-Size"
+	integritySHA256Key = "Qrank-Sha256"
+)
+
+// CorruptObjectError tells that a stored object has failed validation.
+type corruptObjectError struct {
+	Path    string // eg. "links/rmwiki-20240501-links.zst"
+	Reason  string
+	Removed bool // whether the object has been removed from storage
+}
+
+func (e *corruptObjectError) Error() string {
+	msg := fmt.Sprintf("%s is corrupt: %s", e.Path, e.Reason)
+	if e.Removed {
+		msg += "; removed from storage for rebuilding"
+	}
+	return msg
+}
+
+// ObjectStatter is implemented by stores that can return the metadata
+// of an object, such as minio.Client and objstore.Router.
+type objectStatter interface {
+	StatObject(ctx context.Context, bucketName, objectName string, opts minio.StatObjectOptions) (minio.ObjectInfo, error)
+}
+
+// IntegrityMetadata returns the user metadata for storing a file,
+// telling its size and SHA-256 digest.
+func integrityMetadata(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		integritySizeKey:   strconv.FormatInt(size, 10),
+		integritySHA256Key: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// ValidateDownload checks a downloaded .zst object against the size
+// and digest in its metadata, if storage can tell them, and makes
+// sure that its last zstd frame is complete. If the object is corrupt,
+// the error is a *corruptObjectError; intermediate files get removed
+// from storage, so they will be built again.
+func validateDownload(ctx context.Context, bucket string, path string, file *os.File, s3 S3) error {
+	reason, err := checkDownload(ctx, bucket, path, file, s3)
+	if err != nil || reason == "" {
+		return err
+	}
+	return handleCorruptObject(ctx, bucket, path, reason, s3)
+}
+
+// HandleCorruptObject returns a *corruptObjectError for an object that
+// has failed validation, after removing intermediate files from storage.
+func handleCorruptObject(ctx context.Context, bucket string, path string, reason string, s3 S3) error {
+	corrupt := &corruptObjectError{Path: path, Reason: reason}
+	if !strings.HasPrefix(path, "public/") {
+		if err := s3.RemoveObject(ctx, bucket, path, minio.RemoveObjectOptions{}); err != nil {
+			return errors.Join(corrupt, err)
+		}
+		corrupt.Removed = true
+	}
+	logger.Print(corrupt.Error())
+	return corrupt
+}
+
+// CheckDownload returns why a downloaded object is corrupt, or the
+// empty string if it looks fine.
+func checkDownload(ctx context.Context, bucket string, path string, file *os.File, s3 S3) (string, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	if statter, ok := s3.(objectStatter); ok {
+		info, err := statter.StatObject(ctx, bucket, path, minio.StatObjectOptions{})
+		if err != nil {
+			return "", err
+		}
+		if want, ok := info.UserMetadata[integritySizeKey]; ok {
+			if got := strconv.FormatInt(stat.Size(), 10); got != want {
+				return fmt.Sprintf("got %s bytes, want %s", got, want), nil
+			}
+		}
+		if want, ok := info.UserMetadata[integritySHA256Key]; ok {
+			hash := sha256.New()
+			if _, err := io.Copy(hash, io.NewSectionReader(file, 0, stat.Size())); err != nil {
+				return "", err
+			}
+			if got := hex.EncodeToString(hash.Sum(nil)); got != want {
+				return fmt.Sprintf("got SHA-256 %s, want %s", got, want), nil
+			}
+		}
+	}
+
+	if err := checkZstdFrames(file, stat.Size()); err != nil {
+		return err.Error(), nil
+	}
+	return "", nil
+}
+
+// ValidatingReader checks a .zst object while it is being streamed from
+// storage. A stream cannot be checked before it gets read, so the checks
+// of checkDownload() happen at its end: if the object does not match its
+// metadata, or if its last zstd frame is incomplete, reading fails with
+// a *corruptObjectError instead of io.EOF.
+type validatingReader struct {
+	ctx        context.Context
+	bucket     string
+	path       string
+	s3         S3
+	stream     io.ReadCloser
+	size       int64
+	hash       hash.Hash // nil if storage does not know the digest
+	frames     zstdFrameWalker
+	wantSize   string // empty if storage does not know the size
+	wantSHA256 string
+	streamErr  error // from reading the stream, other than io.EOF
+	err        error // sticky, once the object has been found corrupt
+}
+
+// NewValidatingReader returns a reader that validates a stream at its
+// end. If the object metadata cannot be read, the stream gets closed.
+func newValidatingReader(ctx context.Context, bucket string, path string, stream io.ReadCloser, s3 S3) (*validatingReader, error) {
+	v := &validatingReader{ctx: ctx, bucket: bucket, path: path, s3: s3, stream: stream}
+	if statter, ok := s3.(objectStatter); ok {
+		info, err := statter.StatObject(ctx, bucket, path, minio.StatObjectOptions{})
+		if err != nil {
+			stream.Close()
+			return nil, err
+		}
+		v.wantSize = info.UserMetadata[integritySizeKey]
+		v.wantSHA256 = info.UserMetadata[integritySHA256Key]
+		if v.wantSHA256 != "" {
+			v.hash = sha256.New()
+		}
+	}
+	return v, nil
+}
+
+func (v *validatingReader) Read(buf []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n, err := v.stream.Read(buf)
+	if err != nil && err != io.EOF {
+		v.streamErr = err
+	}
+	v.size += int64(n)
+	if v.hash != nil {
+		v.hash.Write(buf[:n])
+	}
+	v.frames.Write(buf[:n])
+	if err == io.EOF {
+		if reason := v.check(); reason != "" {
+			v.err = handleCorruptObject(v.ctx, v.bucket, v.path, reason, v.s3)
+			return n, v.err
+		}
+	}
+	return n, err
+}
+
+// DecodingFailed tells that decompressing the stream has failed before
+// its end, which can happen for a corrupt stream, for example because
+// of a checksum mismatch. Unless reading the stream itself has failed,
+// the object is corrupt.
+func (v *validatingReader) decodingFailed(err error) error {
+	if v.err != nil || v.streamErr != nil {
+		return err
+	}
+	v.err = handleCorruptObject(v.ctx, v.bucket, v.path, err.Error(), v.s3)
+	return v.err
+}
+
+func (v *validatingReader) Close() error {
+	return v.stream.Close()
+}
+
+// Check returns why a completely read stream is corrupt, or the empty
+// string if it looks fine.
+func (v *validatingReader) check() string {
+	if v.wantSize != "" {
+		if got := strconv.FormatInt(v.size, 10); got != v.wantSize {
+			return fmt.Sprintf("got %s bytes, want %s", got, v.wantSize)
+		}
+	}
+	if v.hash != nil {
+		if got := hex.EncodeToString(v.hash.Sum(nil)); got != v.wantSHA256 {
+			return fmt.Sprintf("got SHA-256 %s, want %s", got, v.wantSHA256)
+		}
+	}
+	if err := v.frames.Finish(); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// ZstdFrameWalker follows the frames of zstd-compressed data that gets
+// written into it, like checkZstdFrames() does for data that can be
+// read at any position. Only the headers are parsed; block content
+// just gets counted.
+type zstdFrameWalker struct {
+	pos         int64  // offset of the next byte
+	skip        int64  // bytes to skip before the next header
+	header      []byte // bytes of the current header, so far
+	need        int    // length of the current header
+	state       zstdWalkerState
+	hasChecksum bool
+	err         error
+}
+
+type zstdWalkerState int
+
+const (
+	zstdWalkerMagic      zstdWalkerState = iota // before a frame, or at the start
+	zstdWalkerSkippable                         // size of a skippable frame
+	zstdWalkerDescriptor                        // frame header descriptor
+	zstdWalkerBlock                             // block header
+)
+
+// Write never fails; errors get reported by Finish().
+func (w *zstdFrameWalker) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && w.err == nil {
+		if w.skip > 0 {
+			k := min(w.skip, int64(len(p)))
+			w.skip -= k
+			w.pos += k
+			p = p[k:]
+			continue
+		}
+		if w.need == 0 {
+			w.need = 4
+		}
+		k := min(w.need-len(w.header), len(p))
+		w.header = append(w.header, p[:k]...)
+		w.pos += int64(k)
+		p = p[k:]
+		if len(w.header) == w.need {
+			w.parseHeader()
+		}
+	}
+	return n, nil
+}
+
+// ParseHeader interprets a complete header, and tells what comes next.
+func (w *zstdFrameWalker) parseHeader() {
+	h := w.header
+	start := w.pos - int64(len(h))
+	w.header = w.header[:0]
+	switch w.state {
+	case zstdWalkerMagic:
+		magic := binary.LittleEndian.Uint32(h)
+		if magic&0xFFFFFFF0 == 0x184D2A50 {
+			w.state, w.need = zstdWalkerSkippable, 4
+		} else if magic == 0xFD2FB528 {
+			w.state, w.need = zstdWalkerDescriptor, 1
+		} else {
+			w.err = fmt.Errorf("no zstd frame at offset %d", start)
+		}
+
+	case zstdWalkerSkippable:
+		w.skip = int64(binary.LittleEndian.Uint32(h))
+		w.state, w.need = zstdWalkerMagic, 4
+
+	case zstdWalkerDescriptor:
+		var headerSize int64
+		headerSize, w.hasChecksum = zstdFrameHeaderSize(h[0])
+		w.skip = headerSize - 1 // the descriptor has been read
+		w.state, w.need = zstdWalkerBlock, 3
+
+	case zstdWalkerBlock:
+		blockSize, last, err := zstdBlockSize(h, start)
+		if err != nil {
+			w.err = err
+			return
+		}
+		w.skip = blockSize
+		if last {
+			if w.hasChecksum {
+				w.skip += 4
+			}
+			w.state, w.need = zstdWalkerMagic, 4
+		}
+	}
+}
+
+// Finish returns an error unless the data written so far ended exactly
+// after a complete frame. Empty data is fine, like for checkZstdFrames().
+func (w *zstdFrameWalker) Finish() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.state != zstdWalkerMagic || len(w.header) > 0 || w.skip > 0 {
+		return fmt.Errorf("truncated zstd frame, stream ends at offset %d", w.pos)
+	}
+	return nil
+}
+
+// ZstdFrameHeaderSize returns the size of a frame header without the
+// magic number, given its first byte, the frame header descriptor.
+// See RFC 8878, section 3.1.1.1.
+func zstdFrameHeaderSize(descriptor byte) (size int64, hasChecksum bool) {
+	singleSegment := descriptor&0x20 != 0
+	hasChecksum = descriptor&0x04 != 0
+	size = 1
+	if !singleSegment {
+		size += 1 // window descriptor
+	}
+	size += [4]int64{0, 1, 2, 4}[descriptor&0x03] // dictionary ID
+
+	// Frame content size.
+	switch descriptor >> 6 {
+	case 0:
+		if singleSegment {
+			size += 1
+		}
+	case 1:
+		size += 2
+	case 2:
+		size += 4
+	case 3:
+		size += 8
+	}
+	return size, hasChecksum
+}
+
+// ZstdBlockSize returns the size of the content of a block, given its
+// three-byte header at offset pos, and whether it is the last block
+// of its frame. See RFC 8878, section 3.1.1.2.
+func zstdBlockSize(b []byte, pos int64) (size int64, last bool, err error) {
+	header := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+	last = header&1 != 0
+	size = int64(header >> 3)
+	switch (header >> 1) & 3 {
+	case 1: // RLE block, with a single byte
+		size = 1
+	case 3:
+		return 0, false, fmt.Errorf("reserved zstd block type at offset %d", pos)
+	}
+	return size, last, nil
+}
+
+// CheckZstdFrames walks over the frames of zstd-compressed data,
+// skipping the content of their blocks, and returns an error unless
+// the data ends exactly after a complete frame. This only reads the
+// headers, so it is much cheaper than decompressing the data. See
+// RFC 8878, section 3.1 for the format. Empty data is fine, since
+// our builders write empty files for sites without any output.
+func checkZstdFrames(r io.ReaderAt, size int64) error {
+	var buf [14]byte
+	read := func(pos int64, n int) ([]byte, error) {
+		if pos+int64(n) > size {
+			return nil, fmt.Errorf("truncated zstd frame at offset %d of %d", pos, size)
+		}
+		if _, err := r.ReadAt(buf[:n], pos); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	var pos int64
+	for pos < size {
+		b, err := read(pos, 4)
+		if err != nil {
+			return err
+		}
+		magic := binary.LittleEndian.Uint32(b)
+		if magic&0xFFFFFFF0 == 0x184D2A50 {
+			// Skippable frame, followed by its size.
+			b, err := read(pos+4, 4)
+			if err != nil {
+				return err
+			}
+			pos += 8 + int64(binary.LittleEndian.Uint32(b))
+			continue
+		}
+		if magic != 0xFD2FB528 {
+			return fmt.Errorf("no zstd frame at offset %d", pos)
+		}
+
+		b, err = read(pos+4, 1)
+		if err != nil {
+			return err
+		}
+		headerSize, hasChecksum := zstdFrameHeaderSize(b[0])
+		pos += 4 + headerSize
+
+		for last := false; !last; {
+			b, err := read(pos, 3)
+			if err != nil {
+				return err
+			}
+			var blockSize int64
+			blockSize, last, err = zstdBlockSize(b, pos)
+			if err != nil {
+				return err
+			}
+			pos += 3 + blockSize
+		}
+		if hasChecksum {
+			pos += 4
+		}
+		if pos > size {
+			return fmt.Errorf("truncated zstd frame, ends at offset %d of %d", pos, size)
+		}
+	}
+	if pos != size {
+		return fmt.Errorf("truncated zstd frame, ends at offset %d of %d", pos, size)
+	}
+	return nil
+}
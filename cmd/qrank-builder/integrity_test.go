@@ -0,0 +1,290 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCheckZstdFrames(t *testing.T) {
+	var frames [2][]byte
+	for i := range frames {
+		var buf bytes.Buffer
+		w, err := zstd.NewWriter(&buf, zstd.WithEncoderCRC(i == 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(bytes.Repeat([]byte("Hello, world! "), 10000))
+		w.Write([]byte(strings.Repeat("x", 300000)))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		frames[i] = buf.Bytes()
+	}
+
+	// Several frames, followed by a skippable frame with four bytes
+	// of user data.
+	all := append(slices.Clone(frames[0]), frames[1]...)
+	all = append(all, 0x50, 0x2A, 0x4D, 0x18, 4, 0, 0, 0, 1, 2, 3, 4)
+	if err := checkZstdFrames(bytes.NewReader(all), int64(len(all))); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkZstdFrames(bytes.NewReader(nil), 0); err != nil {
+		t.Errorf("empty data: got %v, want nil", err)
+	}
+
+	// Truncation at a frame boundary cannot be detected without
+	// knowing the size, but anywhere within a frame it can.
+	data := frames[0]
+	for n := 1; n < len(data); n++ {
+		if err := checkZstdFrames(bytes.NewReader(data[:n]), int64(n)); err == nil {
+			t.Fatalf("data truncated to %d of %d bytes: expected error", n, len(data))
+		}
+	}
+	if err := checkZstdFrames(bytes.NewReader([]byte("junk")), 4); err == nil {
+		t.Error("junk: expected error")
+	}
+}
+
+// The frame walker for streams must agree with checkZstdFrames()
+// on where data is cut off, no matter how the data gets chunked.
+func TestZstdFrameWalker(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := zstd.NewWriter(&buf, zstd.WithEncoderCRC(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(bytes.Repeat([]byte("Hello, world! "), 10000))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := append(slices.Clone(buf.Bytes()), 0x50, 0x2A, 0x4D, 0x18, 4, 0, 0, 0, 1, 2, 3, 4)
+
+	for _, chunk := range []int{1, 7, 4096, len(data)} {
+		for n := 0; n <= len(data); n++ {
+			var walker zstdFrameWalker
+			for i := 0; i < n; i += chunk {
+				walker.Write(data[i:min(i+chunk, n)])
+			}
+			got := walker.Finish()
+			want := checkZstdFrames(bytes.NewReader(data[:n]), int64(n))
+			if (got == nil) != (want == nil) {
+				t.Fatalf("chunk %d, data truncated to %d of %d bytes: got %v, want %v", chunk, n, len(data), got, want)
+			}
+		}
+	}
+
+	var walker zstdFrameWalker
+	walker.Write([]byte("junk"))
+	if err := walker.Finish(); err == nil {
+		t.Error("junk: expected error")
+	}
+}
+
+func TestValidatingReader(t *testing.T) {
+	saved := logger
+	t.Cleanup(func() { logger = saved })
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+
+	var buf bytes.Buffer
+	w, _ := zstd.NewWriter(&buf)
+	w.Write([]byte("Q72,Q4022\n"))
+	w.Close()
+	path := filepath.Join(t.TempDir(), "links.zst")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const dest = "links/rmwiki-20240501-links.zst"
+	if err := PutInStorage(ctx, path, s3, "qrank", dest, "application/zstd"); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(data []byte) ([]byte, error) {
+		r, err := newValidatingReader(ctx, "qrank", dest, io.NopCloser(bytes.NewReader(data)), s3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+
+	// Intact streams can be read.
+	if got, err := read(buf.Bytes()); err != nil || !bytes.Equal(got, buf.Bytes()) {
+		t.Errorf("intact stream: got %q, %v", got, err)
+	}
+
+	// Flipping a bit keeps the frames intact, but changes the digest.
+	flipped := slices.Clone(buf.Bytes())
+	flipped[len(flipped)-1] ^= 1
+	_, err := read(flipped)
+	var corrupt *corruptObjectError
+	if !errors.As(err, &corrupt) || !corrupt.Removed || !strings.Contains(corrupt.Reason, "SHA-256") {
+		t.Errorf("got %v, want removed corruptObjectError about SHA-256", err)
+	}
+	if _, found := s3.data[dest]; found {
+		t.Error("corrupt intermediate file should have been removed")
+	}
+
+	// The zstd decoder passes the error on, so BuildStage() can
+	// recover from it.
+	if err := PutInStorage(ctx, path, s3, "qrank", dest, "application/zstd"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := newValidatingReader(ctx, "qrank", dest, io.NopCloser(bytes.NewReader(flipped)), s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressor := &decompressingReader{decoder.IOReadCloser(), r}
+	defer decompressor.Close()
+	if _, err := io.ReadAll(decompressor); !errors.As(err, &corrupt) {
+		t.Errorf("decompressing: got %v, want corruptObjectError", err)
+	}
+
+	// Without metadata, streams get checked for a complete last frame.
+	s3.data[dest] = buf.Bytes()
+	delete(s3.metadata, dest)
+	_, err = read(buf.Bytes()[:buf.Len()-3])
+	if !errors.As(err, &corrupt) || !strings.Contains(corrupt.Reason, "truncated") {
+		t.Errorf("got %v, want corruptObjectError about truncation", err)
+	}
+}
+
+func TestValidateDownload(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+
+	var buf bytes.Buffer
+	w, _ := zstd.NewWriter(&buf)
+	w.Write([]byte("Q72,Q4022\n"))
+	w.Close()
+	path := filepath.Join(t.TempDir(), "links.zst")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, dest := range []string{"links/rmwiki-20240501-links.zst", "public/item_signals-20240501.csv.zst"} {
+		if err := PutInStorage(ctx, path, s3, "qrank", dest, "application/zstd"); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := s3.metadata[dest][integritySizeKey], strconv.Itoa(buf.Len()); got != want {
+			t.Errorf("%s: got size metadata %q, want %q", dest, got, want)
+		}
+	}
+
+	// Intact objects can be read.
+	r, err := NewS3Reader(ctx, "qrank", "links/rmwiki-20240501-links.zst", s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	// Flipping a bit keeps the frames intact, but changes the digest.
+	for key := range s3.data {
+		s3.data[key] = slices.Clone(s3.data[key])
+		s3.data[key][len(s3.data[key])-1] ^= 1
+	}
+
+	// Corrupt intermediate files get removed, so they can be rebuilt.
+	_, err = NewS3Reader(ctx, "qrank", "links/rmwiki-20240501-links.zst", s3)
+	var corrupt *corruptObjectError
+	if !errors.As(err, &corrupt) || !corrupt.Removed || !strings.Contains(corrupt.Reason, "SHA-256") {
+		t.Errorf("got %v, want removed corruptObjectError about SHA-256", err)
+	}
+	if _, found := s3.data["links/rmwiki-20240501-links.zst"]; found {
+		t.Error("corrupt intermediate file should have been removed")
+	}
+
+	// Published files are left alone.
+	_, err = NewS3Reader(ctx, "qrank", "public/item_signals-20240501.csv.zst", s3)
+	if !errors.As(err, &corrupt) || corrupt.Removed {
+		t.Errorf("got %v, want corruptObjectError without removal", err)
+	}
+	if _, found := s3.data["public/item_signals-20240501.csv.zst"]; !found {
+		t.Error("corrupt public file should not have been removed")
+	}
+}
+
+func TestValidateDownload_Truncated(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+
+	// Objects stored before we kept digests have no metadata,
+	// so they only get checked for a complete last frame.
+	s3.WriteLines([]string{"Q72,Q4022", "Q4022,Q72"}, "links/rmwiki-20240501-links.zst")
+	data := s3.data["links/rmwiki-20240501-links.zst"]
+	s3.data["links/rmwiki-20240501-links.zst"] = data[:len(data)-3]
+
+	_, err := NewS3Reader(ctx, "qrank", "links/rmwiki-20240501-links.zst", s3)
+	var corrupt *corruptObjectError
+	if !errors.As(err, &corrupt) || !strings.Contains(corrupt.Reason, "truncated") {
+		t.Errorf("got %v, want corruptObjectError about truncation", err)
+	}
+}
+
+func TestBuildStage_RecoversCorruptObject(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	var logBuf bytes.Buffer
+	logger = log.New(&logBuf, "", log.Lshortfile)
+	dumps := filepath.Join("testdata", "dumps")
+	s3 := NewFakeS3()
+	if err := Build(&http.Client{Transport: &FakeWikiSite{}}, dumps /*numWeeks*/, 1, s3); err != nil {
+		t.Fatal(err)
+	}
+	want, err := s3.ReadLines("public/item_signals-20240501.csv.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncate a per-site intermediate file, as if a builder had
+	// crashed while uploading it, and build the item signals again.
+	const truncated = "page_signals/rmwiki-20240301-page_signals.zst"
+	data, found := s3.data[truncated]
+	if !found {
+		t.Fatalf("%s not in storage", truncated)
+	}
+	s3.data[truncated] = data[:len(data)/2]
+	delete(s3.data, "public/item_signals-20240501.csv.zst")
+
+	client := &http.Client{Transport: &FakeWikiSite{}}
+	err = BuildStage(client, dumps /*numWeeks*/, 1, s3, BuildOptions{}, "page-signals", "item-signals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logBuf.String(), "running stages again from page-signals") {
+		t.Error("expected log about running stages again")
+	}
+	if !bytes.Equal(s3.data[truncated], data) {
+		t.Errorf("%s should have been rebuilt", truncated)
+	}
+	got, err := s3.ReadLines("public/item_signals-20240501.csv.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,136 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// MaxInterwikiMapAge is how old a cached interwiki map can get before
+// we fetch a fresh one. Wikimedia rarely changes its interwiki map,
+// so there is no need to hit noc.wikimedia.org on every run.
+const maxInterwikiMapAge = 7 * 24 * time.Hour
+
+// InterwikiMapCache is a parsed interwiki map, as returned by
+// fetchInterwikiMap(), that has been cached in storage.
+type interwikiMapCache struct {
+	Fetched time.Time         `json:"fetched"`
+	Map     map[string]string `json:"map"`
+}
+
+var interwikiMapPathRegexp = regexp.MustCompile(`^internal/interwiki-\d{8}\.json$`)
+
+// LoadInterwikiMap finds the global interwiki map for Wikimedia sites.
+// If storage has a copy that is younger than maxInterwikiMapAge, we use
+// it; otherwise, we fetch the map from the live site and cache it in
+// storage. If the live site cannot be reached, we fall back to the
+// cached copy, however old it is. The age of the map gets logged and
+// recorded in the build report. If client is nil, the result is nil,
+// just like ReadWikiSites() does without a client.
+func loadInterwikiMap(ctx context.Context, client *http.Client, s3 S3, now time.Time) (map[string]string, error) {
+	if client == nil {
+		return nil, nil
+	}
+
+	cached, err := readCachedInterwikiMap(ctx, s3)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil && now.Sub(cached.Fetched) <= maxInterwikiMapAge {
+		logger.Printf("using cached interwiki map, fetched %.1f days ago", cached.age(now))
+		reportStepFrom(ctx).setInterwikiMap(ReportCache{"cache", cached.Fetched, cached.age(now)})
+		return cached.Map, nil
+	}
+
+	iwmap, fetchErr := fetchInterwikiMap(client)
+	if fetchErr == nil {
+		fetched := &interwikiMapCache{Fetched: now.UTC(), Map: iwmap}
+		if err := cacheInterwikiMap(ctx, fetched, s3); err != nil {
+			return nil, err
+		}
+		reportStepFrom(ctx).setInterwikiMap(ReportCache{"network", fetched.Fetched, 0})
+		return iwmap, nil
+	}
+
+	if cached == nil {
+		return nil, fetchErr
+	}
+	logger.Printf("cannot fetch interwiki map, using stale copy fetched %.1f days ago: %v", cached.age(now), fetchErr)
+	reportStepFrom(ctx).setInterwikiMap(ReportCache{"stale-cache", cached.Fetched, cached.age(now)})
+	return cached.Map, nil
+}
+
+// Age returns how many days ago the cached map has been fetched.
+func (c *interwikiMapCache) age(now time.Time) float64 {
+	return max(now.Sub(c.Fetched).Hours()/24, 0)
+}
+
+// ReadCachedInterwikiMap returns the newest interwiki map that has been
+// cached in storage, or nil if there is none.
+func readCachedInterwikiMap(ctx context.Context, s3 S3) (*interwikiMapCache, error) {
+	keys, err := listCachedInterwikiMaps(ctx, s3)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	reader, err := NewS3Reader(ctx, "qrank", keys[len(keys)-1], s3)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var cached interwikiMapCache
+	if err := json.NewDecoder(reader).Decode(&cached); err != nil {
+		return nil, err
+	}
+	return &cached, nil
+}
+
+// CacheInterwikiMap stores an interwiki map in storage, and deletes
+// any older maps.
+func cacheInterwikiMap(ctx context.Context, c *interwikiMapCache, s3 S3) error {
+	keys, err := listCachedInterwikiMaps(ctx, s3)
+	if err != nil {
+		return err
+	}
+
+	path := InternalPath("interwiki", c.Fetched, "json")
+	if err := PutJSON(ctx, c, s3, "qrank", path); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key == path {
+			continue
+		}
+		logger.Printf("deleting outdated interwiki map %s", key)
+		if err := s3.RemoveObject(ctx, "qrank", key, minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListCachedInterwikiMaps returns the storage paths of the cached
+// interwiki maps, sorted from oldest to newest.
+func listCachedInterwikiMaps(ctx context.Context, s3 S3) ([]string, error) {
+	var keys []string
+	opts := minio.ListObjectsOptions{Prefix: "internal/interwiki-"}
+	for obj := range s3.ListObjects(ctx, "qrank", opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if interwikiMapPathRegexp.MatchString(obj.Key) {
+			keys = append(keys, obj.Key)
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
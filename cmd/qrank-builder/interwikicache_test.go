@@ -0,0 +1,102 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadInterwikiMap(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	s3 := NewFakeS3()
+	s3.data["internal/interwiki-20240301.json"] = []byte(`{"fetched":"2024-03-01T00:00:00Z","map":{"d":"www.wikidata.org"}}`)
+	client := &http.Client{Transport: &FakeWikiSite{}}
+	now := time.Date(2024, 4, 10, 6, 0, 0, 0, time.UTC)
+	report := NewBuildReport(now)
+	ctx, step := startReportStep(withBuildReport(context.Background(), report), "titles")
+
+	// The cached map is stale, so we fetch a fresh one.
+	iwmap, err := loadInterwikiMap(ctx, client, s3, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := iwmap["__global:d"]; got != "www.wikidata.org" {
+		t.Errorf(`got %q for __global:d, want "www.wikidata.org"`, got)
+	}
+	if got, want := storedInterwikiMaps(s3), []string{"internal/interwiki-20240410.json"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := step.InterwikiMap; got == nil || got.Source != "network" || got.AgeDays != 0 {
+		t.Errorf("got %+v, want network with age 0", got)
+	}
+
+	// A few days later, the cached map is still fresh enough.
+	later := now.Add(3 * 24 * time.Hour)
+	broken := &http.Client{Transport: &FakeWikiSite{Broken: true}}
+	cached, err := loadInterwikiMap(ctx, broken, s3, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != len(iwmap) {
+		t.Errorf("got %d cached entries, want %d", len(cached), len(iwmap))
+	}
+	if got := step.InterwikiMap; got == nil || got.Source != "cache" || got.AgeDays != 3 {
+		t.Errorf("got %+v, want cache with age 3", got)
+	}
+}
+
+func TestLoadInterwikiMap_Offline(t *testing.T) {
+	var buf bytes.Buffer
+	logger = log.New(&buf, "", log.Lshortfile)
+	s3 := NewFakeS3()
+	s3.data["internal/interwiki-20240301.json"] = []byte(`{"fetched":"2024-03-01T00:00:00Z","map":{"d":"www.wikidata.org"}}`)
+	client := &http.Client{Transport: &FakeWikiSite{Broken: true}}
+	now := time.Date(2024, 4, 10, 12, 0, 0, 0, time.UTC)
+	report := NewBuildReport(now)
+	ctx, step := startReportStep(withBuildReport(context.Background(), report), "titles")
+
+	iwmap, err := loadInterwikiMap(ctx, client, s3, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := iwmap["d"]; got != "www.wikidata.org" {
+		t.Errorf(`got %q for d, want "www.wikidata.org"`, got)
+	}
+	if got := step.InterwikiMap; got == nil || got.Source != "stale-cache" || got.AgeDays != 40.5 {
+		t.Errorf("got %+v, want stale-cache with age 40.5", got)
+	}
+	if got := buf.String(); !strings.Contains(got, "fetched 40.5 days ago") {
+		t.Errorf("log should tell age of stale interwiki map, got %q", got)
+	}
+
+	// Without any cached map, being offline is an error.
+	if _, err := loadInterwikiMap(ctx, client, NewFakeS3(), now); err == nil {
+		t.Error("expected error if there is no interwiki map at all")
+	}
+}
+
+func TestLoadInterwikiMap_NilClient(t *testing.T) {
+	iwmap, err := loadInterwikiMap(context.Background(), nil, NewFakeS3(), time.Now())
+	if iwmap != nil || err != nil {
+		t.Errorf("got %v, %v; want nil, nil", iwmap, err)
+	}
+}
+
+func storedInterwikiMaps(s3 *FakeS3) []string {
+	var keys []string
+	for key := range s3.data {
+		if interwikiMapPathRegexp.MatchString(key) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
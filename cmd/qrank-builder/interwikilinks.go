@@ -4,14 +4,12 @@
 package main
 
 import (
-	"bytes"
 	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"runtime"
 	"slices"
 	"strconv"
 	"strings"
@@ -33,12 +31,10 @@ func buildInterwikiLinks(site *WikiSite, ctx context.Context, dumps string, s3 S
 	defer os.Remove(outFile.Name())
 
 	linesChan := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
-	sorter, outChan, errChan := extsort.Strings(linesChan, config)
-
+	config := newSortConfig(64)
 	group, groupCtx := errgroup.WithContext(ctx)
+	sorter, outChan, errChan := extsort.Strings(sortInput(groupCtx, "interwiki_links", linesChan, config), config)
+
 	group.Go(func() error {
 		defer close(linesChan)
 		if err := ReadPageItemsOld(groupCtx, site, "A", s3, linesChan); err != nil {
@@ -94,7 +90,7 @@ func processInterwikiLinks(ctx context.Context, site *WikiSite, property string,
 	ymd := site.LastDumped.Format("20060102")
 	propsFileName := fmt.Sprintf("%s-%s-iwlinks.sql.gz", site.Key, ymd)
 	propsPath := filepath.Join(dumps, site.Key, ymd, propsFileName)
-	propsFile, err := os.Open(propsPath)
+	propsFile, err := openDump(ctx, propsPath)
 	if err != nil {
 		return err
 	}
@@ -129,18 +125,8 @@ func processInterwikiLinks(ctx context.Context, site *WikiSite, property string,
 				return nil
 			}
 
-			title := row[titleCol]
-			var buf strings.Builder
-			buf.WriteString(row[fromCol])
-			buf.WriteRune('\t')
-			buf.WriteString(property)
-			buf.WriteRune('\t')
-			buf.WriteString(row[prefixCol])
-			buf.WriteRune('\t')
-			buf.WriteString(title)
-
-			if !strings.ContainsRune(title, '\t') {
-				out <- buf.String()
+			if line, ok := formatRecord('\t', row[fromCol], property, row[prefixCol], row[titleCol]); ok {
+				out <- line
 			}
 		}
 	}
@@ -161,7 +147,7 @@ func NewInterwikiLinksJoiner(site *WikiSite, w io.WriteCloser) *interwikiLinksJo
 
 func (j *interwikiLinksJoiner) Process(line string) error {
 	j.inLines += 1
-	cols := strings.Split(line, "\t")
+	cols := splitRecord(line, '\t')
 	stream := cols[1]
 
 	page, err := strconv.ParseInt(cols[0], 10, 64)
@@ -176,8 +162,8 @@ func (j *interwikiLinksJoiner) Process(line string) error {
 	}
 
 	if stream == "B" && page == j.page {
-		if site := j.site.ResolveInterwikiPrefix(cols[2]); site != nil {
-			title := cols[3]
+		if site := j.site.ResolveInterwikiPrefix(unquoteField(cols[2])); site != nil {
+			title := unquoteField(cols[3])
 
 			// Resolve interwiki prefixes in titles such as "it:m:Foobar".
 			for {
@@ -193,14 +179,8 @@ func (j *interwikiLinksJoiner) Process(line string) error {
 				title = title[pos+1 : len(title)]
 			}
 
-			var buf bytes.Buffer
-			buf.WriteString(site.Domain)
-			buf.WriteRune('\t')
-			buf.WriteString(title)
-			buf.WriteRune('\t')
-			buf.WriteString(j.item)
-			buf.WriteRune('\n')
-			_, err := j.writer.Write(buf.Bytes())
+			line, _ := formatRecord('\t', site.Domain, title, j.item)
+			_, err := io.WriteString(j.writer, line+"\n")
 			return err
 		}
 	}
@@ -29,7 +29,7 @@ func TestBuildInterwikiLinks(t *testing.T) {
 
 	site := sites.Sites["rmwiki"]
 	s3 := NewFakeS3()
-	if err := buildPageSignals(site, ctx, dumps, s3); err != nil {
+	if err := buildPageSignals(site, ctx, dumps, "", false, false, s3); err != nil {
 		t.Fatal(err)
 	}
 	if err := buildInterwikiLinks(site, ctx, dumps, s3); err != nil {
@@ -0,0 +1,228 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/parquet-go/parquet-go"
+
+	"github.com/brawer/wikidata-qrank/v2/pkg/qrank"
+)
+
+// ParquetPartitionSize is the number of item IDs in each Parquet file.
+// Wikidata has about 120 million items, so there are only a dozen or
+// so files, but analysts who only care about a range of items can
+// skip most of them.
+const parquetPartitionSize = 10_000_000
+
+// ParquetRowGroupSize is the number of rows in a row group, which get
+// buffered in memory before they are written.
+const parquetRowGroupSize = 512 * 1024
+
+// ParquetProvenanceKey is the key under which the provenance of
+// a release is stored in the key-value metadata of Parquet files.
+const parquetProvenanceKey = "qrank.provenance"
+
+// ItemSignalsParquet writes item signals in Parquet format, which
+// analysts can query with DuckDB without decompressing the entire
+// CSV file. The output is partitioned by ranges of item IDs; part N
+// contains the items from Q(N*10M) to Q((N+1)*10M-1). The files get
+// written to a local directory, and uploaded by Put().
+//
+// The encoding is left to the parquet-go library. All columns are
+// required, either INT64 or UTF-8 strings, compressed with zstd.
+type ItemSignalsParquet struct {
+	dir     string
+	schema  *qrank.ItemSignalsSchema
+	pschema *parquet.Schema
+	part    int64
+	file    *os.File
+	writer  *parquet.Writer
+	row     parquet.Row
+	parts   []int64
+
+	// Provenance of the release as JSON, stored in the key-value
+	// metadata of each file, or empty if not set.
+	provenance string
+}
+
+// NewItemSignalsParquet returns a writer that puts its partitions
+// into a local directory.
+func NewItemSignalsParquet(dir string, schema *qrank.ItemSignalsSchema) *ItemSignalsParquet {
+	return &ItemSignalsParquet{
+		dir:     dir,
+		schema:  schema,
+		pschema: itemSignalsParquetSchema(schema),
+		part:    -1,
+		row:     make(parquet.Row, len(schema.Columns)),
+	}
+}
+
+// ItemSignalsParquetSchema returns the Parquet schema for item signals.
+// Parquet-go sorts the fields of a group by name, but analysts expect
+// the columns in the same order as in the CSV file, so the schema gets
+// derived from a struct type whose fields are in that order.
+func itemSignalsParquetSchema(schema *qrank.ItemSignalsSchema) *parquet.Schema {
+	fields := make([]reflect.StructField, 0, len(schema.Columns))
+	for i, col := range schema.Columns {
+		typ := reflect.TypeOf(int64(0))
+		if isStringParquetColumn(col) {
+			typ = reflect.TypeOf("")
+		}
+		fields = append(fields, reflect.StructField{
+			Name: fmt.Sprintf("Col%d", i),
+			Type: typ,
+			Tag:  reflect.StructTag(fmt.Sprintf(`parquet:"%s,zstd"`, col)),
+		})
+	}
+	model := reflect.New(reflect.StructOf(fields)).Elem().Interface()
+	return parquet.NewSchema("item_signals", parquet.SchemaOf(model))
+}
+
+// IsStringParquetColumn tells whether a column holds item IDs such
+// as "Q72", which are stored as strings like in the CSV file.
+func isStringParquetColumn(col string) bool {
+	return col == "item" || itemValuedColumns[col]
+}
+
+// SetProvenance records the provenance of the release in the metadata
+// of the Parquet files. Must be called before Write().
+func (p *ItemSignalsParquet) SetProvenance(provenance *Provenance) error {
+	buf, err := json.Marshal(provenance)
+	if err != nil {
+		return err
+	}
+	p.provenance = string(buf)
+	return nil
+}
+
+// Write adds the signals of an item, which must come in order
+// of increasing item ID.
+func (p *ItemSignalsParquet) Write(s *ItemSignals) error {
+	part := s.item / parquetPartitionSize
+	if part != p.part {
+		if err := p.closePart(); err != nil {
+			return err
+		}
+		if err := p.openPart(part); err != nil {
+			return err
+		}
+	}
+
+	p.row[0] = parquet.ByteArrayValue([]byte("Q"+strconv.FormatInt(s.item, 10))).Level(0, 0, 0)
+	for i, col := range p.schema.Columns[1:] {
+		value := itemSignalsColumns[col](s)
+		if itemValuedColumns[col] {
+			str := ""
+			if value != 0 {
+				str = "Q" + strconv.FormatInt(value, 10)
+			}
+			p.row[i+1] = parquet.ByteArrayValue([]byte(str)).Level(0, 0, i+1)
+		} else {
+			p.row[i+1] = parquet.Int64Value(value).Level(0, 0, i+1)
+		}
+	}
+	_, err := p.writer.WriteRows([]parquet.Row{p.row})
+	return err
+}
+
+// Close finishes the last partition.
+func (p *ItemSignalsParquet) Close() error {
+	return p.closePart()
+}
+
+// Put uploads all partitions to storage, see ItemSignalsParquetPath().
+// Afterwards, the partitions of older versions get removed, except
+// for the previous version, which readers might still be working on.
+func (p *ItemSignalsParquet) Put(ctx context.Context, version time.Time, s3 S3) error {
+	for _, part := range p.parts {
+		path := filepath.Join(p.dir, fmt.Sprintf("part-%04d.parquet", part))
+		dest := ItemSignalsParquetPath(version, part)
+		if err := PutInStorage(ctx, path, s3, "qrank", dest, "application/vnd.apache.parquet"); err != nil {
+			return err
+		}
+	}
+	logger.Printf("published %d Parquet partitions of item signals", len(p.parts))
+	return cleanupItemSignalsParquet(ctx, version, s3)
+}
+
+// CleanupItemSignalsParquet removes the Parquet partitions of all
+// versions before the one preceding version.
+func cleanupItemSignalsParquet(ctx context.Context, version time.Time, s3 S3) error {
+	ymd := version.Format("20060102")
+	prefix := strings.TrimSuffix(path.Dir(ItemSignalsParquetPath(version, 0)), ymd)
+	opts := minio.ListObjectsOptions{Prefix: prefix, Recursive: true}
+	byVersion := make(map[string][]string, 4)
+	var versions []string
+	for obj := range s3.ListObjects(ctx, "qrank", opts) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		v, _, ok := strings.Cut(strings.TrimPrefix(obj.Key, prefix), "/")
+		if !ok || v > ymd {
+			continue
+		}
+		if _, found := byVersion[v]; !found {
+			versions = append(versions, v)
+		}
+		byVersion[v] = append(byVersion[v], obj.Key)
+	}
+	slices.Sort(versions)
+	for i := 0; i < len(versions)-2; i++ {
+		for _, key := range byVersion[versions[i]] {
+			if err := s3.RemoveObject(ctx, "qrank", key, minio.RemoveObjectOptions{}); err != nil {
+				return err
+			}
+		}
+		logger.Printf("deleted %d Parquet partitions of item signals from %s", len(byVersion[versions[i]]), versions[i])
+	}
+	return nil
+}
+
+func (p *ItemSignalsParquet) openPart(part int64) error {
+	path := filepath.Join(p.dir, fmt.Sprintf("part-%04d.parquet", part))
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	options := []parquet.WriterOption{
+		p.pschema,
+		parquet.CreatedBy("qrank-builder", BuilderCommit(), ""),
+		parquet.MaxRowsPerRowGroup(parquetRowGroupSize),
+	}
+	if p.provenance != "" {
+		options = append(options, parquet.KeyValueMetadata(parquetProvenanceKey, p.provenance))
+	}
+	writer := parquet.NewWriter(file, options...)
+	p.part, p.file, p.writer = part, file, writer
+	p.parts = append(p.parts, part)
+	return nil
+}
+
+func (p *ItemSignalsParquet) closePart() error {
+	if p.writer == nil {
+		return nil
+	}
+	if err := p.writer.Close(); err != nil {
+		return err
+	}
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+	p.file, p.writer = nil, nil
+	return nil
+}
@@ -0,0 +1,163 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+
+	"github.com/brawer/wikidata-qrank/v2/pkg/qrank"
+)
+
+func TestItemSignalsParquet(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	schema := qrank.ItemSignalsSchemas[qrank.CurrentItemSignalsSchema]
+	p := NewItemSignalsParquet(t.TempDir(), schema)
+	if err := p.SetProvenance(&Provenance{Version: "2024-05-01", Commit: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []ItemSignals{
+		{item: 72, pageviews: 3142, class: 515},
+		{item: 5296, pageviews: 2500},
+		{item: 12345678, pageviews: 7},
+	} {
+		if err := p.Write(&s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s3 := NewFakeS3()
+	version, _ := time.Parse(time.DateOnly, "2024-05-01")
+	if err := p.Put(ctx, version, s3); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for key := range s3.data {
+		got = append(got, key)
+	}
+	sort.Strings(got)
+	want := []string{
+		"public/item_signals_parquet-20240501/part-0000.parquet",
+		"public/item_signals_parquet-20240501/part-0001.parquet",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Read the first partition back, to check that other readers
+	// see the same columns, in the same order as in the CSV file.
+	data := s3.data[want[0]]
+	file, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var columns []string
+	for _, f := range file.Schema().Fields() {
+		columns = append(columns, f.Name())
+	}
+	if !slices.Equal(columns, schema.Columns) {
+		t.Errorf("got columns %q, want %q", columns, schema.Columns)
+	}
+	if n := len(file.Metadata().ColumnOrders); n != len(schema.Columns) {
+		t.Errorf("got %d column orders, want %d", n, len(schema.Columns))
+	}
+	provenance, _ := file.Lookup("qrank.provenance")
+	if !strings.Contains(provenance, `"version":"2024-05-01","commit":"abc"`) {
+		t.Errorf("got provenance %q", provenance)
+	}
+	stats := file.Metadata().RowGroups[0].Columns[0].MetaData.Statistics
+	if string(stats.MinValue) != "Q5296" || string(stats.MaxValue) != "Q72" {
+		t.Errorf("got item statistics %q..%q, want Q5296..Q72", stats.MinValue, stats.MaxValue)
+	}
+
+	rows := make([]parquet.Row, 10)
+	n, err := file.RowGroups()[0].Rows().ReadRows(rows)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("got %d rows, want 2", n)
+	}
+	pageviews := slices.Index(schema.Columns, "pageviews_52w")
+	if got := rows[0][0].String(); got != "Q72" {
+		t.Errorf("got item %q, want Q72", got)
+	}
+	if got := rows[0][pageviews].Int64(); got != 3142 {
+		t.Errorf("got pageviews %d, want 3142", got)
+	}
+	if got := rows[1][pageviews].Int64(); got != 2500 {
+		t.Errorf("got pageviews %d, want 2500", got)
+	}
+}
+
+func TestCleanupItemSignalsParquet(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	s3 := NewFakeS3()
+	for _, ymd := range []string{"20240417", "20240424", "20240501", "20240508"} {
+		version, _ := time.Parse("20060102", ymd)
+		s3.data[ItemSignalsParquetPath(version, 0)] = []byte("PAR1")
+		s3.data[ItemSignalsParquetPath(version, 1)] = []byte("PAR1")
+	}
+	version, _ := time.Parse("20060102", "20240501")
+	if err := cleanupItemSignalsParquet(context.Background(), version, s3); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for key := range s3.data {
+		got = append(got, key)
+	}
+	sort.Strings(got)
+	want := []string{
+		"public/item_signals_parquet-20240424/part-0000.parquet",
+		"public/item_signals_parquet-20240424/part-0001.parquet",
+		"public/item_signals_parquet-20240501/part-0000.parquet",
+		"public/item_signals_parquet-20240501/part-0001.parquet",
+		"public/item_signals_parquet-20240508/part-0000.parquet",
+		"public/item_signals_parquet-20240508/part-0001.parquet",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestBuildItemSignals_Parquet(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	s3.WriteLines([]string{"rm.wikipedia,1,5", "rm.wikipedia,799,7"}, "pageviews/pageviews-2011-W07.zst")
+	s3.WriteLines([]string{"1,Q5296,2500", "799,Q72,3142"}, "page_signals/rmwiki-20111209-page_signals.zst")
+	rmDumped, _ := time.Parse(time.DateOnly, "2011-12-09")
+	rmwikiSite := &WikiSite{Key: "rmwiki", Domain: "rm.wikipedia.org", LastDumped: rmDumped}
+	sites := &WikiSites{
+		Sites:   map[string]*WikiSite{"rmwiki": rmwikiSite},
+		Domains: map[string]*WikiSite{"rm.wikipedia.org": rmwikiSite},
+	}
+	pageviews := []string{"pageviews/pageviews-2011-W07.zst"}
+	if _, err := buildItemSignals(ctx, pageviews, sites, BuildOptions{Parquet: true}, s3); err != nil {
+		t.Fatal(err)
+	}
+
+	var parts []string
+	for key := range s3.data {
+		if strings.HasSuffix(key, ".parquet") {
+			parts = append(parts, key)
+		}
+	}
+	if want := []string{"public/item_signals_parquet-20111209/part-0000.parquet"}; !slices.Equal(parts, want) {
+		t.Errorf("got %v, want %v", parts, want)
+	}
+}
@@ -7,20 +7,206 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"strings"
+
+	"github.com/lanrat/extsort"
+
+	"github.com/brawer/wikidata-qrank/v2/pkg/qrank"
 )
 
 type ItemSignalsWriter struct {
 	signals     ItemSignals
 	out         io.WriteCloser
+	comments    []string
+	stats       *SignalStats
+	policy      DisambiguationPolicy
+	schema      *qrank.ItemSignalsSchema
+	classRanks  *ClassRanks
+	topItems    *ClassRanks
+	parquet     *ItemSignalsParquet
+	hasPage     bool // whether the current item has any page signals
 	wroteHeader bool
+
+	// Whether to write the sitelinks counted in the wb_items_per_site
+	// dump, instead of those from the wb-sitelinks page property.
+	sitelinksFromDump bool
+
+	// If positive, the weekly pageviews of each item get capped at
+	// this multiple of its median week; see SetMaxWeekMultiple().
+	maxWeekMultiple float64
+
+	// Whether to leave out items that look like stubs, and how many
+	// were left out; see SetExcludeStubs().
+	excludeStubs  bool
+	excludedStubs int64
+
+	// Optional second output that only receives items with at least
+	// minPageviews, see SetTruncatedOutput().
+	truncatedOut io.WriteCloser
+	minPageviews int64
+	truncated    int64 // number of items left out from truncatedOut
+
+	// Items that have been merged into the current item, and the
+	// output for re-sorting the signals with the merged items;
+	// see SetMergedItems().
+	mergedFrom []int64
+	sorted     chan<- extsort.SortType
+	pending    *ItemSignals // held back by WriteSorted(), not yet emitted
+	merged     int64        // number of written rows for merged items
 }
 
+// ItemSignalsColumns tells how to compute the value of each column
+// in the schemas of qrank.ItemSignalsSchemas, except for the item.
+var itemSignalsColumns = map[string]func(s *ItemSignals) int64{
+	"pageviews_52w":  func(s *ItemSignals) int64 { return s.pageviews },
+	"wikitext_bytes": func(s *ItemSignals) int64 { return s.wikitextBytes },
+	"claims":         func(s *ItemSignals) int64 { return s.claims },
+	"identifiers":    func(s *ItemSignals) int64 { return s.identifiers },
+	"sitelinks":      func(s *ItemSignals) int64 { return s.sitelinks },
+	"disambiguation": func(s *ItemSignals) int64 {
+		if s.disambiguation {
+			return 1
+		}
+		return 0
+	},
+	"outlinks":               func(s *ItemSignals) int64 { return s.outlinks },
+	"infoboxes":              func(s *ItemSignals) int64 { return s.infoboxes },
+	"pageviews_52w_max_wiki": func(s *ItemSignals) int64 { return s.maxPageviews },
+	"class":                  func(s *ItemSignals) int64 { return s.class },
+	"merged_into":            func(s *ItemSignals) int64 { return s.mergedInto },
+	"external_links":         func(s *ItemSignals) int64 { return s.externalLinks },
+	"templates":              func(s *ItemSignals) int64 { return s.templates },
+	"inlinks":                func(s *ItemSignals) int64 { return s.inlinks },
+	"is_stub": func(s *ItemSignals) int64 {
+		if s.IsStub() {
+			return 1
+		}
+		return 0
+	},
+}
+
+// ItemValuedColumns are the columns whose values are Wikidata items.
+// They get written as "Q515", or as an empty string for zero.
+var itemValuedColumns = map[string]bool{"class": true, "merged_into": true}
+
 func NewItemSignalsWriter(w io.WriteCloser) *ItemSignalsWriter {
-	return &ItemSignalsWriter{out: w, wroteHeader: false}
+	schema := qrank.ItemSignalsSchemas[qrank.CurrentItemSignalsSchema]
+	return &ItemSignalsWriter{out: w, schema: schema, wroteHeader: false}
+}
+
+// SetSchema sets the schema version of the output, which determines
+// its columns. Must be called before Write().
+func (w *ItemSignalsWriter) SetSchema(version int) error {
+	schema, err := qrank.LookupItemSignalsSchema(version)
+	if err != nil {
+		return err
+	}
+	w.schema = schema
+	return nil
+}
+
+// SetComments sets lines that get written before the CSV header,
+// such as provenance information. Must be called before Write().
+func (w *ItemSignalsWriter) SetComments(comments []string) {
+	w.comments = comments
+}
+
+// SetStats sets a collector for statistics about the written signals.
+// Must be called before Write().
+func (w *ItemSignalsWriter) SetStats(stats *SignalStats) {
+	w.stats = stats
+}
+
+// SetDisambiguationPolicy sets how items with a disambiguation page
+// get written. Must be called before Write().
+func (w *ItemSignalsWriter) SetDisambiguationPolicy(policy DisambiguationPolicy) {
+	w.policy = policy
+}
+
+// SetExcludeStubs tells whether to leave out items that look like
+// stubs, see ItemSignals.IsStub(). Must be called before Write().
+func (w *ItemSignalsWriter) SetExcludeStubs(exclude bool) {
+	w.excludeStubs = exclude
+}
+
+// ExcludedStubs returns the number of items that were left out
+// because they looked like stubs.
+func (w *ItemSignalsWriter) ExcludedStubs() int64 {
+	return w.excludedStubs
 }
 
+// SetTruncatedOutput sets a second output, which receives the same
+// signals as the main output except for items with fewer than
+// minPageviews. Must be called before Write().
+func (w *ItemSignalsWriter) SetTruncatedOutput(out io.WriteCloser, minPageviews int64) {
+	w.truncatedOut = out
+	w.minPageviews = minPageviews
+}
+
+// Truncated returns the number of items that were left out
+// from the truncated output.
+func (w *ItemSignalsWriter) Truncated() int64 {
+	return w.truncated
+}
+
+// SetSitelinksFromDump tells whether to write the sitelink counts
+// from the wb_items_per_site dump, instead of those from the page
+// property. Must be called before Write().
+func (w *ItemSignalsWriter) SetSitelinksFromDump(fromDump bool) {
+	w.sitelinksFromDump = fromDump
+}
+
+// SetMaxWeekMultiple makes the writer cap the pageviews of an item
+// in any single week at maxMultiple times its median week, summed
+// over all its pages. This needs the weekly pageviews that get
+// recorded by itemSignalsJoiner. Must be called before Write().
+func (w *ItemSignalsWriter) SetMaxWeekMultiple(maxMultiple float64) {
+	w.maxWeekMultiple = maxMultiple
+}
+
+// SetClassRanks sets a collector for the top-ranked items of classes.
+// Must be called before Write().
+func (w *ItemSignalsWriter) SetClassRanks(ranks *ClassRanks) {
+	w.classRanks = ranks
+}
+
+// SetTopItems sets a collector for the top-ranked items of all classes,
+// which get collected under class 0. Must be called before Write().
+func (w *ItemSignalsWriter) SetTopItems(top *ClassRanks) {
+	w.topItems = top
+}
+
+// SetParquetOutput sets a second output in Parquet format, which
+// receives the same signals as the main output. Must be called
+// before Write().
+func (w *ItemSignalsWriter) SetParquetOutput(out *ItemSignalsParquet) {
+	w.parquet = out
+}
+
+// SetMergedItems makes the writer emit rows for items that have been
+// merged into another item, with a copy of the signals of that other
+// item. The merged items come in as ItemSignals for their target, as
+// emitted by sendMergedItems(). Because a merged item has a different
+// ID than its target, its row goes elsewhere in the output; therefore,
+// the writer does not write any rows when Close() gets called for the
+// first time, but sends the final signals to out. The caller needs to
+// sort them by item, pass them to WriteSorted(), and call Close()
+// again. Must be called before Write().
+func (w *ItemSignalsWriter) SetMergedItems(out chan<- extsort.SortType) {
+	w.sorted = out
+}
+
+// Merged returns the number of written rows for merged items.
+func (w *ItemSignalsWriter) Merged() int64 {
+	return w.merged
+}
+
+// Write adds signals for an item. Signals must be written in order
+// of increasing item ID; consecutive signals for the same item get
+// summed up. Items whose signals only carry their class, but which
+// do not have any pages, are left out from the output.
 func (w *ItemSignalsWriter) Write(s ItemSignals) error {
 	if s.item == 0 {
 		return fmt.Errorf("cannot write ItemSignals for item 0: %v", s)
@@ -33,14 +219,70 @@ func (w *ItemSignalsWriter) Write(s ItemSignals) error {
 	}
 
 	w.signals.item = s.item
+	if s.mergedFrom != 0 {
+		w.mergedFrom = append(w.mergedFrom, s.mergedFrom)
+		return nil
+	}
 	w.signals.Add(s)
+	if !s.IsItemOnly() {
+		w.hasPage = true
+	}
+	return nil
+}
+
+// WriteSorted writes the final signals that were sent to the output
+// of SetMergedItems(), after they have been sorted by item. If an item
+// has been merged but still has signals of its own, which happens when
+// some wiki has not caught up with the merge, it keeps its own row.
+// Of several rows for the same item, the one with its own signals
+// wins over the ones that only tell where the item was merged into,
+// no matter in which order they arrive.
+func (w *ItemSignalsWriter) WriteSorted(s ItemSignals) error {
+	if w.pending != nil && w.pending.item == s.item {
+		if w.pending.mergedInto != 0 && s.mergedInto == 0 {
+			*w.pending = s
+		}
+		return nil
+	}
+	if err := w.flushSorted(); err != nil {
+		return err
+	}
+	w.pending = &s
 	return nil
 }
 
+// FlushSorted emits the row that is held back by WriteSorted(), if any.
+func (w *ItemSignalsWriter) flushSorted() error {
+	if w.pending == nil {
+		return nil
+	}
+	s := w.pending
+	w.pending = nil
+	return w.emit(s)
+}
+
 func (w *ItemSignalsWriter) Close() error {
 	if err := w.flush(); err != nil {
 		return err
 	}
+	if w.sorted != nil {
+		close(w.sorted)
+		w.sorted = nil
+		return nil
+	}
+	if err := w.flushSorted(); err != nil {
+		return err
+	}
+	if w.truncatedOut != nil {
+		if err := w.truncatedOut.Close(); err != nil {
+			return err
+		}
+	}
+	if w.parquet != nil {
+		if err := w.parquet.Close(); err != nil {
+			return err
+		}
+	}
 	return w.out.Close()
 }
 
@@ -48,19 +290,89 @@ func (w *ItemSignalsWriter) flush() error {
 	if w.signals.item == 0 {
 		return nil
 	}
+	if !w.hasPage {
+		w.signals.Clear()
+		w.mergedFrom = w.mergedFrom[:0]
+		return nil
+	}
+	w.hasPage = false
 
+	if len(w.signals.weeklyPageviews) > 0 {
+		views, capped := capWeeklyPageviews(w.signals.weeklyPageviews, w.maxWeekMultiple)
+		if capped > 0 {
+			w.signals.pageviews = int64(math.Round(views))
+			w.signals.maxPageviews = min(w.signals.maxPageviews, w.signals.pageviews)
+			w.signals.cappedWeeks = capped
+		}
+		w.signals.weeklyPageviews = nil
+	}
+
+	if w.sitelinksFromDump {
+		if w.stats != nil {
+			w.stats.AddSitelinkSources(w.signals.sitelinks, w.signals.dumpSitelinks)
+		}
+		w.signals.sitelinks = w.signals.dumpSitelinks
+	}
+
+	if w.signals.disambiguation {
+		switch w.policy {
+		case ExcludeDisambiguation:
+			w.signals.Clear()
+			w.mergedFrom = w.mergedFrom[:0]
+			return nil
+		case DemoteDisambiguation:
+			demoted := float64(w.signals.pageviews) * disambiguationDemotion
+			w.signals.pageviews = int64(math.Round(demoted))
+			demotedMax := float64(w.signals.maxPageviews) * disambiguationDemotion
+			w.signals.maxPageviews = int64(math.Round(demotedMax))
+		}
+	}
+
+	if w.excludeStubs && w.signals.IsStub() {
+		w.excludedStubs += 1
+		w.signals.Clear()
+		w.mergedFrom = w.mergedFrom[:0]
+		return nil
+	}
+
+	if w.sorted != nil {
+		w.sorted <- w.signals
+		for _, from := range w.mergedFrom {
+			merged := w.signals
+			merged.item = from
+			merged.mergedInto = w.signals.item
+			w.sorted <- merged
+		}
+		w.signals.Clear()
+		w.mergedFrom = w.mergedFrom[:0]
+		return nil
+	}
+
+	err := w.emit(&w.signals)
+	w.signals.Clear()
+	w.mergedFrom = w.mergedFrom[:0]
+	return err
+}
+
+// Emit writes the final signals of an item to the outputs.
+func (w *ItemSignalsWriter) emit(s *ItemSignals) error {
 	if !w.wroteHeader {
-		header := strings.Join([]string{
-			"item",
-			"pageviews_52w",
-			"wikitext_bytes",
-			"claims",
-			"identifiers",
-			"sitelinks",
-		}, ",")
 		var hbuf bytes.Buffer
+		for _, c := range w.comments {
+			hbuf.WriteString(c)
+			hbuf.WriteByte('\n')
+		}
+		header := fmt.Sprintf("# schema: %d\n%s\n", w.schema.Version, strings.Join(w.schema.Columns, ","))
+		if w.truncatedOut != nil {
+			var tbuf bytes.Buffer
+			tbuf.Write(hbuf.Bytes())
+			fmt.Fprintf(&tbuf, "# min-pageviews: %d\n", w.minPageviews)
+			tbuf.WriteString(header)
+			if _, err := w.truncatedOut.Write(tbuf.Bytes()); err != nil {
+				return err
+			}
+		}
 		hbuf.WriteString(header)
-		hbuf.WriteByte('\n')
 		if _, err := w.out.Write(hbuf.Bytes()); err != nil {
 			return err
 		}
@@ -69,20 +381,46 @@ func (w *ItemSignalsWriter) flush() error {
 
 	var buf bytes.Buffer
 	buf.WriteByte('Q')
-	buf.WriteString(strconv.FormatInt(w.signals.item, 10))
-	buf.WriteByte(',')
-	buf.WriteString(strconv.FormatInt(w.signals.pageviews, 10))
-	buf.WriteByte(',')
-	buf.WriteString(strconv.FormatInt(w.signals.wikitextBytes, 10))
-	buf.WriteByte(',')
-	buf.WriteString(strconv.FormatInt(w.signals.claims, 10))
-	buf.WriteByte(',')
-	buf.WriteString(strconv.FormatInt(w.signals.identifiers, 10))
-	buf.WriteByte(',')
-	buf.WriteString(strconv.FormatInt(w.signals.sitelinks, 10))
+	buf.WriteString(strconv.FormatInt(s.item, 10))
+	for _, col := range w.schema.Columns[1:] {
+		buf.WriteByte(',')
+		value := itemSignalsColumns[col](s)
+		if itemValuedColumns[col] {
+			if value != 0 {
+				buf.WriteByte('Q')
+				buf.WriteString(strconv.FormatInt(value, 10))
+			}
+			continue
+		}
+		buf.WriteString(strconv.FormatInt(value, 10))
+	}
 	buf.WriteByte('\n')
 
-	w.signals.Clear()
+	if s.mergedInto != 0 {
+		w.merged += 1
+	} else {
+		if w.stats != nil {
+			w.stats.AddItem(*s)
+		}
+		w.classRanks.Add(s.item, s.class, s.pageviews)
+		w.topItems.Add(s.item, 0, s.pageviews)
+	}
+	if w.parquet != nil {
+		if err := w.parquet.Write(s); err != nil {
+			return err
+		}
+	}
+
+	if w.truncatedOut != nil {
+		if s.pageviews >= w.minPageviews {
+			if _, err := w.truncatedOut.Write(buf.Bytes()); err != nil {
+				return err
+			}
+		} else {
+			w.truncated += 1
+		}
+	}
+
 	_, err := w.out.Write(buf.Bytes())
 	return err
 }
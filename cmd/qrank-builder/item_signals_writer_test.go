@@ -5,9 +5,14 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"reflect"
 	"slices"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/brawer/wikidata-qrank/v2/pkg/qrank"
 )
 
 func TestItemSignalsWriter(t *testing.T) {
@@ -15,9 +20,9 @@ func TestItemSignalsWriter(t *testing.T) {
 	writer := TestingWriteCloser(&buf)
 	w := NewItemSignalsWriter(writer)
 	for _, s := range []ItemSignals{
-		ItemSignals{72, 1, 2, 3, 4, 5},
-		ItemSignals{72, 3, 3, 3, 3, 3},
-		ItemSignals{99, 9, 8, 7, 6, 5},
+		ItemSignals{72, 1, 2, 3, 4, 5, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{72, 3, 3, 3, 3, 3, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{99, 9, 8, 7, 6, 5, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil},
 	} {
 		if err := w.Write(s); err != nil {
 			t.Error(err)
@@ -35,9 +40,10 @@ func TestItemSignalsWriter(t *testing.T) {
 
 	got := strings.Split(strings.TrimSuffix(string(buf.Bytes()), "\n"), "\n")
 	want := []string{
-		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks",
-		"Q72,4,5,6,7,8",
-		"Q99,9,8,7,6,5",
+		"# schema: 2",
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes",
+		"Q72,4,5,6,7,8,0,0,0",
+		"Q99,9,8,7,6,5,0,0,0",
 	}
 	if !slices.Equal(got, want) {
 		t.Errorf("got %v, want %v", got, want)
@@ -59,7 +65,435 @@ func TestItemSignalsWriter_Empty(t *testing.T) {
 func TestItemSignalsWriter_ZeroItem(t *testing.T) {
 	var buf bytes.Buffer
 	w := NewItemSignalsWriter(NopWriteCloser(&buf))
-	if err := w.Write(ItemSignals{0, 1, 2, 3, 4, 5}); err == nil {
+	if err := w.Write(ItemSignals{0, 1, 2, 3, 4, 5, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil}); err == nil {
 		t.Error("expected error, got nil")
 	}
 }
+
+func TestItemSignalsWriter_Comments(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewItemSignalsWriter(NopWriteCloser(&buf))
+	w.SetComments([]string{"# version: 2024-05-01", "# commit: abc"})
+	if err := w.Write(ItemSignals{72, 1, 2, 3, 4, 5, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil}); err != nil {
+		t.Error(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	want := []string{
+		"# version: 2024-05-01",
+		"# commit: abc",
+		"# schema: 2",
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes",
+		"Q72,1,2,3,4,5,0,0,0",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestItemSignalsWriter_Disambiguation(t *testing.T) {
+	for _, tc := range []struct {
+		policy DisambiguationPolicy
+		want   []string
+	}{
+		{KeepDisambiguation, []string{"Q5,1000,1,0,0,0,1,0,0", "Q72,2000,2,0,0,0,0,0,0"}},
+		{DemoteDisambiguation, []string{"Q5,10,1,0,0,0,1,0,0", "Q72,2000,2,0,0,0,0,0,0"}},
+		{ExcludeDisambiguation, []string{"Q72,2000,2,0,0,0,0,0,0"}},
+	} {
+		var buf bytes.Buffer
+		w := NewItemSignalsWriter(NopWriteCloser(&buf))
+		w.SetDisambiguationPolicy(tc.policy)
+		for _, s := range []ItemSignals{
+			ItemSignals{5, 600, 1, 0, 0, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+			ItemSignals{5, 400, 0, 0, 0, 0, true, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+			ItemSignals{72, 2000, 2, 0, 0, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		} {
+			if err := w.Write(s); err != nil {
+				t.Error(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Error(err)
+		}
+		got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")[2:]
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("policy %q: got %v, want %v", tc.policy, got, tc.want)
+		}
+	}
+}
+
+func TestItemSignalsWriter_Stubs(t *testing.T) {
+	for _, tc := range []struct {
+		exclude bool
+		want    []string
+	}{
+		{false, []string{"Q5,0,0,4,3,0,0,0,0,0,,,1", "Q72,2000,2,4,3,1,0,0,0,0,,,0"}},
+		{true, []string{"Q72,2000,2,4,3,1,0,0,0,0,,,0"}},
+	} {
+		var buf bytes.Buffer
+		w := NewItemSignalsWriter(NopWriteCloser(&buf))
+		if err := w.SetSchema(6); err != nil {
+			t.Fatal(err)
+		}
+		w.SetExcludeStubs(tc.exclude)
+		for _, s := range []ItemSignals{
+			ItemSignals{5, 0, 0, 4, 3, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+			ItemSignals{72, 2000, 2, 4, 3, 1, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		} {
+			if err := w.Write(s); err != nil {
+				t.Error(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Error(err)
+		}
+		got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")[2:]
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("exclude=%v: got %v, want %v", tc.exclude, got, tc.want)
+		}
+		wantExcluded := int64(0)
+		if tc.exclude {
+			wantExcluded = 1
+		}
+		if got := w.ExcludedStubs(); got != wantExcluded {
+			t.Errorf("exclude=%v: got ExcludedStubs()=%d, want %d", tc.exclude, got, wantExcluded)
+		}
+	}
+}
+
+func TestItemSignalsWriter_Schema(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewItemSignalsWriter(NopWriteCloser(&buf))
+	if err := w.SetSchema(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(ItemSignals{72, 1, 2, 3, 4, 5, true, 6, 7, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil}); err != nil {
+		t.Error(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	want := []string{
+		"# schema: 1",
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks",
+		"Q72,1,2,3,4,5",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if err := w.SetSchema(999); err == nil {
+		t.Error("expected error for unknown schema version")
+	}
+}
+
+// If an item has been merged, but some wiki has not caught up with
+// the merge, the item keeps the row with its own signals, no matter
+// in which order the rows arrive.
+func TestItemSignalsWriter_WriteSorted(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewItemSignalsWriter(NopWriteCloser(&buf))
+	if err := w.SetSchema(5); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []ItemSignals{
+		{item: 6, pageviews: 500, mergedInto: 1},
+		{item: 6, pageviews: 7},
+		{item: 8, pageviews: 3},
+		{item: 8, pageviews: 500, mergedInto: 1},
+		{item: 9, pageviews: 500, mergedInto: 1},
+	} {
+		if err := w.WriteSorted(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")[2:]
+	want := []string{
+		"Q6,7,0,0,0,0,0,0,0,0,,",
+		"Q8,3,0,0,0,0,0,0,0,0,,",
+		"Q9,500,0,0,0,0,0,0,0,0,,Q1",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if w.Merged() != 1 {
+		t.Errorf("got Merged()=%d, want 1", w.Merged())
+	}
+}
+
+func TestItemSignalsWriter_MaxWikiPageviews(t *testing.T) {
+	for _, tc := range []struct {
+		policy DisambiguationPolicy
+		want   string
+	}{
+		{KeepDisambiguation, "Q5,1000,0,0,0,0,1,0,0,600"},
+		{DemoteDisambiguation, "Q5,10,0,0,0,0,1,0,0,6"},
+	} {
+		var buf bytes.Buffer
+		w := NewItemSignalsWriter(NopWriteCloser(&buf))
+		w.SetDisambiguationPolicy(tc.policy)
+		if err := w.SetSchema(3); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []ItemSignals{
+			ItemSignals{5, 600, 0, 0, 0, 0, false, 0, 0, 600, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+			ItemSignals{5, 400, 0, 0, 0, 0, true, 0, 0, 400, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		} {
+			if err := w.Write(s); err != nil {
+				t.Error(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Error(err)
+		}
+		got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		want := []string{
+			"# schema: 3",
+			"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes,pageviews_52w_max_wiki",
+			tc.want,
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("policy %q: got %v, want %v", tc.policy, got, want)
+		}
+	}
+}
+
+// Weekly pageviews get capped for the item as a whole, not for every
+// single page. Q5 is popular on one wiki and newly popular on another,
+// which would have been capped if each page had been looked at alone.
+func TestItemSignalsWriter_MaxWeekMultiple(t *testing.T) {
+	var buf bytes.Buffer
+	stats := NewSignalStats(time.Time{}, &WikiSites{})
+	w := NewItemSignalsWriter(NopWriteCloser(&buf))
+	w.SetMaxWeekMultiple(10)
+	w.SetStats(stats)
+	if err := w.SetSchema(3); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []ItemSignals{
+		ItemSignals{5, 400, 0, 0, 0, 0, false, 0, 0, 400, 0, 0, 0, 0, 0, 0, 0, 0, []float64{100, 100, 100, 100}},
+		ItemSignals{5, 900, 0, 0, 0, 0, false, 0, 0, 900, 0, 0, 0, 0, 0, 0, 0, 0, []float64{0, 0, 0, 900}},
+		ItemSignals{7, 30, 0, 0, 0, 0, false, 0, 0, 30, 0, 0, 0, 0, 0, 0, 0, 0, []float64{10, 10, 10, 0}},
+		ItemSignals{7, 5000, 0, 0, 0, 0, false, 0, 0, 5000, 0, 0, 0, 0, 0, 0, 0, 0, []float64{0, 0, 0, 5000}},
+	} {
+		if err := w.Write(s); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	want := []string{
+		"# schema: 3",
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes,pageviews_52w_max_wiki",
+		"Q5,1300,0,0,0,0,0,0,0,900",
+		"Q7,130,0,0,0,0,0,0,0,130",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := stats.CappedItems, int64(1); got != want {
+		t.Errorf("got CappedItems=%d, want %d", got, want)
+	}
+}
+
+func TestItemSignalsWriter_QualitySignals(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewItemSignalsWriter(NopWriteCloser(&buf))
+	if err := w.SetSchema(7); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []ItemSignals{
+		ItemSignals{72, 600, 0, 0, 0, 0, false, 0, 0, 600, 0, 0, 0, 0, 0, 31, 45, 0, nil},
+		ItemSignals{72, 400, 0, 0, 0, 0, false, 0, 0, 400, 0, 0, 0, 0, 0, 2, 0, 0, nil},
+	} {
+		if err := w.Write(s); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	want := []string{
+		"# schema: 7",
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes,pageviews_52w_max_wiki,class,merged_into,is_stub,external_links,templates",
+		"Q72,1000,0,0,0,0,0,0,0,600,,,0,33,45",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestItemSignalsWriter_Class(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewItemSignalsWriter(NopWriteCloser(&buf))
+	if err := w.SetSchema(4); err != nil {
+		t.Fatal(err)
+	}
+	ranks := NewClassRanks([]int64{515}, 10)
+	w.SetClassRanks(ranks)
+	for _, s := range []ItemSignals{
+		ItemSignals{5, 0, 0, 0, 0, 0, false, 0, 0, 0, 5, 0, 0, 0, 0, 0, 0, 0, nil}, // no pages
+		ItemSignals{72, 0, 0, 0, 0, 0, false, 0, 0, 0, 515, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{72, 600, 0, 0, 0, 0, false, 0, 0, 600, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{99, 3, 0, 0, 0, 0, false, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, nil}, // no class
+	} {
+		if err := w.Write(s); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	want := []string{
+		"# schema: 4",
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes,pageviews_52w_max_wiki,class",
+		"Q72,600,0,0,0,0,0,0,0,600,Q515",
+		"Q99,3,0,0,0,0,0,0,0,3,",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := fmt.Sprint(ranks.Top(515)), "[{72 600}]"; got != want {
+		t.Errorf("got class ranks %s, want %s", got, want)
+	}
+}
+
+func TestItemSignalsWriter_Truncated(t *testing.T) {
+	var full, truncated bytes.Buffer
+	w := NewItemSignalsWriter(NopWriteCloser(&full))
+	w.SetComments([]string{"# version: 2024-05-01"})
+	w.SetTruncatedOutput(NopWriteCloser(&truncated), 10)
+	for _, s := range []ItemSignals{
+		ItemSignals{5, 9, 0, 0, 0, 0, false, 0, 0, 9, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{72, 10, 0, 0, 0, 0, false, 0, 0, 10, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{99, 3, 0, 0, 0, 0, false, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+	} {
+		if err := w.Write(s); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+
+	const header = "item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes"
+	wantFull := []string{"# version: 2024-05-01", "# schema: 2", header, "Q5,9,0,0,0,0,0,0,0", "Q72,10,0,0,0,0,0,0,0", "Q99,3,0,0,0,0,0,0,0"}
+	if got := strings.Split(strings.TrimSuffix(full.String(), "\n"), "\n"); !slices.Equal(got, wantFull) {
+		t.Errorf("got full %v, want %v", got, wantFull)
+	}
+	wantTruncated := []string{"# version: 2024-05-01", "# min-pageviews: 10", "# schema: 2", header, "Q72,10,0,0,0,0,0,0,0"}
+	if got := strings.Split(strings.TrimSuffix(truncated.String(), "\n"), "\n"); !slices.Equal(got, wantTruncated) {
+		t.Errorf("got truncated %v, want %v", got, wantTruncated)
+	}
+	if got := w.Truncated(); got != 2 {
+		t.Errorf("got Truncated()=%d, want 2", got)
+	}
+
+	// The truncated output must be readable by our users.
+	if _, err := qrank.NewItemSignalsReader(&truncated); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestItemSignalsWriter_SitelinksFromDump(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewItemSignalsWriter(NopWriteCloser(&buf))
+	stats := NewSignalStats(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), &WikiSites{})
+	w.SetStats(stats)
+	w.SetSitelinksFromDump(true)
+	for _, s := range []ItemSignals{
+		ItemSignals{5, 0, 0, 0, 0, 0, false, 0, 0, 0, 0, 7, 0, 0, 0, 0, 0, 0, nil}, // no pages
+		ItemSignals{72, 10, 0, 0, 0, 186, false, 0, 0, 10, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{72, 0, 0, 0, 0, 0, false, 0, 0, 0, 0, 188, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{80, 3, 0, 0, 0, 15, false, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{80, 0, 0, 0, 0, 0, false, 0, 0, 0, 0, 15, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{99, 3, 0, 0, 0, 2, false, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, nil}, // not in dump
+	} {
+		if err := w.Write(s); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	want := []string{
+		"# schema: 2",
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes",
+		"Q72,10,0,0,0,188,0,0,0",
+		"Q80,3,0,0,0,15,0,0,0",
+		"Q99,3,0,0,0,0,0,0,0",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	wantStats := SitelinkSourceStats{Differing: 2, PagePropHigher: 1, DumpHigher: 1, AbsDifference: 4}
+	if stats.SitelinkSources == nil || *stats.SitelinkSources != wantStats {
+		t.Errorf("got %v, want %v", stats.SitelinkSources, wantStats)
+	}
+}
+
+// Make sure the writer knows how to produce every column
+// of every schema that is defined in the qrank package.
+func TestItemSignalsWriter_AllSchemaColumns(t *testing.T) {
+	for version, schema := range qrank.ItemSignalsSchemas {
+		if schema.Version != version || schema.Columns[0] != "item" {
+			t.Errorf("schema %d: bad definition %v", version, schema)
+		}
+		for _, col := range schema.Columns[1:] {
+			if _, ok := itemSignalsColumns[col]; !ok {
+				t.Errorf("schema %d: no value for column %q", version, col)
+			}
+		}
+	}
+}
+
+// Make sure that the output of the writer can be parsed by the reader
+// that we provide to our users.
+func TestItemSignalsWriter_Readable(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewItemSignalsWriter(NopWriteCloser(&buf))
+	w.SetComments([]string{"# version: 2024-05-01"})
+	if err := w.Write(ItemSignals{72, 1, 2, 3, 4, 5, true, 6, 7, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil}); err != nil {
+		t.Error(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+
+	r, err := qrank.NewItemSignalsReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.Schema().Version, qrank.CurrentItemSignalsSchema; got != want {
+		t.Errorf("got schema %d, want %d", got, want)
+	}
+	got, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &qrank.ItemSignals{
+		Item:           "Q72",
+		Pageviews:      1,
+		WikitextBytes:  2,
+		Claims:         3,
+		Identifiers:    4,
+		Sitelinks:      5,
+		Disambiguation: true,
+		Outlinks:       6,
+		Infoboxes:      7,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
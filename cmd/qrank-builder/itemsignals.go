@@ -4,15 +4,15 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
-	"path/filepath"
 	"regexp"
-	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -22,6 +22,8 @@ import (
 	"github.com/klauspost/compress/zstd"
 	"github.com/lanrat/extsort"
 	"github.com/minio/minio-go/v7"
+
+	"github.com/brawer/wikidata-qrank/v2/pkg/qrank"
 )
 
 // ItemSignals contains ranking signals for Wikidata items.
@@ -32,6 +34,63 @@ type ItemSignals struct {
 	claims        int64
 	identifiers   int64
 	sitelinks     int64
+
+	// Whether the item has a disambiguation page on any wiki.
+	// https://www.mediawiki.org/wiki/Extension:Disambiguator
+	disambiguation bool
+
+	// Signals from Wikimedia Enterprise HTML dumps, if available:
+	// the number of outgoing wikilinks, summed over all pages
+	// for the item, and the number of pages with an infobox.
+	outlinks  int64
+	infoboxes int64
+
+	// Pageviews of the single most viewed page of the item. Because
+	// Wikidata allows at most one sitelink per wiki, this is the number
+	// of pageviews on the wiki where the item is most popular. Unlike
+	// the sum over all wikis, it does not grow with the number of
+	// languages into which a topic has been translated.
+	maxPageviews int64
+
+	// The first class (P31, “instance of”) of the item, such as
+	// 515 for Q515 (city), or zero if unknown. See buildClasses().
+	class int64
+
+	// The number of sitelinks of the item, as counted in the
+	// wb_items_per_site table of Wikidata. Only set if the build
+	// uses BuildOptions.SitelinksFromDump; see buildSitelinks().
+	dumpSitelinks int64
+
+	// The number of weeks in which the pageviews of the item got capped
+	// because of a spike; see ItemSignalsWriter.SetMaxWeekMultiple().
+	// Not part of the output, only counted in the stats.
+	cappedWeeks int64
+
+	// If the item has been merged into another item, the ID of that
+	// other item, whose signals get copied; see buildMergedItems().
+	mergedInto int64
+
+	// Only set in the ItemSignals that get emitted by sendMergedItems():
+	// the ID of an item that has been merged into this one.
+	mergedFrom int64
+
+	// Signals from the externallinks and templatelinks tables, if
+	// the build uses BuildOptions.QualitySignals: the number of
+	// external links and of transcluded templates, summed over
+	// all pages for the item.
+	externalLinks int64
+	templates     int64
+
+	// The number of items whose pages link to a page of this item,
+	// summed over all wikis, if the item signals schema needs them;
+	// see buildInlinks().
+	inlinks int64
+
+	// The weighted pageviews of the item in each week of the pageview
+	// history, if pageviews get capped; see itemSignalsJoiner. Only
+	// needed until the ItemSignalsWriter has capped the item's views,
+	// so it is nil in the final signals.
+	weeklyPageviews []float64
 }
 
 // If we ever want to rank signals for Wikidata lexemes, it would
@@ -48,6 +107,19 @@ func (sig *ItemSignals) Clear() {
 	sig.claims = 0
 	sig.identifiers = 0
 	sig.sitelinks = 0
+	sig.disambiguation = false
+	sig.outlinks = 0
+	sig.infoboxes = 0
+	sig.maxPageviews = 0
+	sig.class = 0
+	sig.dumpSitelinks = 0
+	sig.cappedWeeks = 0
+	sig.mergedInto = 0
+	sig.mergedFrom = 0
+	sig.externalLinks = 0
+	sig.templates = 0
+	sig.inlinks = 0
+	sig.weeklyPageviews = nil
 }
 
 func (sig *ItemSignals) Add(other ItemSignals) {
@@ -59,38 +131,186 @@ func (sig *ItemSignals) Add(other ItemSignals) {
 	sig.claims += other.claims
 	sig.identifiers += other.identifiers
 	sig.sitelinks += other.sitelinks
+	sig.disambiguation = sig.disambiguation || other.disambiguation
+	sig.outlinks += other.outlinks
+	sig.infoboxes += other.infoboxes
+	sig.maxPageviews = max(sig.maxPageviews, other.maxPageviews)
+	if sig.class == 0 {
+		sig.class = other.class
+	}
+	sig.dumpSitelinks += other.dumpSitelinks
+	sig.cappedWeeks += other.cappedWeeks
+	sig.externalLinks += other.externalLinks
+	sig.templates += other.templates
+	sig.inlinks += other.inlinks
+	if len(other.weeklyPageviews) > 0 {
+		if sig.weeklyPageviews == nil {
+			sig.weeklyPageviews = make([]float64, 0, len(other.weeklyPageviews))
+		}
+		for len(sig.weeklyPageviews) < len(other.weeklyPageviews) {
+			sig.weeklyPageviews = append(sig.weeklyPageviews, 0)
+		}
+		for i, v := range other.weeklyPageviews {
+			sig.weeklyPageviews[i] += v
+		}
+	}
+}
+
+// IsItemOnly returns true if the signals only carry data about
+// an item itself, as emitted by sendClasses(), sendSitelinks() and
+// sendInlinks(), without any page signals.
+func (sig *ItemSignals) IsItemOnly() bool {
+	if sig.class == 0 && sig.dumpSitelinks == 0 && sig.inlinks == 0 {
+		return false
+	}
+	return sig.pageviews == 0 && sig.wikitextBytes == 0 && sig.claims == 0 &&
+		sig.identifiers == 0 && sig.sitelinks == 0 && !sig.disambiguation &&
+		sig.outlinks == 0 && sig.infoboxes == 0 && sig.maxPageviews == 0 &&
+		sig.cappedWeeks == 0 && sig.mergedInto == 0 && sig.mergedFrom == 0 &&
+		sig.externalLinks == 0 && sig.templates == 0 &&
+		len(sig.weeklyPageviews) == 0
+}
+
+// StubMaxOtherClaims is the number of claims other than identifiers,
+// such as P31 “instance of”, that an item may have to count as stub.
+const stubMaxOtherClaims = 2
+
+// IsStub returns true if the item looks like a stub that only exists
+// to hold identifiers of some external database: nearly all its claims
+// are identifiers, and it has no sitelinks, no wikitext and no views.
+// There are millions of such items, which add noise to the bottom
+// of the ranking.
+func (sig *ItemSignals) IsStub() bool {
+	return sig.identifiers > 0 &&
+		sig.claims-sig.identifiers <= stubMaxOtherClaims &&
+		sig.sitelinks == 0 &&
+		sig.wikitextBytes == 0 &&
+		sig.pageviews == 0
 }
 
 func (s ItemSignals) ToBytes() []byte {
-	buf := make([]byte, binary.MaxVarintLen64*6)
+	buf := make([]byte, binary.MaxVarintLen64*19+8*len(s.weeklyPageviews))
 	p := binary.PutVarint(buf, s.item)
 	p += binary.PutVarint(buf[p:], s.pageviews)
 	p += binary.PutVarint(buf[p:], s.wikitextBytes)
 	p += binary.PutVarint(buf[p:], s.claims)
 	p += binary.PutVarint(buf[p:], s.identifiers)
 	p += binary.PutVarint(buf[p:], s.sitelinks)
+	var disambiguation int64
+	if s.disambiguation {
+		disambiguation = 1
+	}
+	p += binary.PutVarint(buf[p:], disambiguation)
+	p += binary.PutVarint(buf[p:], s.outlinks)
+	p += binary.PutVarint(buf[p:], s.infoboxes)
+	p += binary.PutVarint(buf[p:], s.maxPageviews)
+	p += binary.PutVarint(buf[p:], s.class)
+	p += binary.PutVarint(buf[p:], s.dumpSitelinks)
+	p += binary.PutVarint(buf[p:], s.cappedWeeks)
+	p += binary.PutVarint(buf[p:], s.mergedInto)
+	p += binary.PutVarint(buf[p:], s.mergedFrom)
+	p += binary.PutVarint(buf[p:], s.externalLinks)
+	p += binary.PutVarint(buf[p:], s.templates)
+	p += binary.PutVarint(buf[p:], s.inlinks)
+	p += binary.PutUvarint(buf[p:], uint64(len(s.weeklyPageviews)))
+	for _, v := range s.weeklyPageviews {
+		binary.LittleEndian.PutUint64(buf[p:], math.Float64bits(v))
+		p += 8
+	}
 	return buf[0:p]
 }
 
-func ItemSignalsFromBytes(b []byte) extsort.SortType {
-	item, pos := binary.Varint(b)
-	pageviews, n := binary.Varint(b[pos:])
-	pos += n
-	wikitextBytes, n := binary.Varint(b[pos:])
-	pos += n
-	claims, n := binary.Varint(b[pos:])
-	pos += n
-	identifiers, n := binary.Varint(b[pos:])
+// ErrCorruptItemSignals tells that the binary encoding of ItemSignals,
+// as produced by ItemSignals.ToBytes(), could not be decoded. During
+// external sorting, this happens when a temporary spill file has been
+// corrupted, for example because the disk has filled up.
+var errCorruptItemSignals = errors.New("corrupt ItemSignals")
+
+// CorruptItem is the item ID of the ItemSignals that get returned by
+// ItemSignalsFromBytes() for corrupt data. Because it is smaller than
+// any real item ID, such signals come first out of the sorter, which
+// lets us fail the sort instead of producing garbage.
+const corruptItem = -1
+
+// DecodeItemSignals decodes the output of ItemSignals.ToBytes().
+func decodeItemSignals(b []byte) (ItemSignals, error) {
+	var v [18]int64
+	pos := 0
+	for i := 0; i < len(v); i++ {
+		val, n := binary.Varint(b[pos:])
+		if n <= 0 {
+			return ItemSignals{}, fmt.Errorf("%w: cannot decode field %d of %x", errCorruptItemSignals, i, b)
+		}
+		if val < 0 {
+			return ItemSignals{}, fmt.Errorf("%w: negative field %d in %x", errCorruptItemSignals, i, b)
+		}
+		v[i] = val
+		pos += n
+	}
+	numWeeks, n := binary.Uvarint(b[pos:])
+	if n <= 0 || numWeeks > uint64(len(b)-pos-n)/8 {
+		return ItemSignals{}, fmt.Errorf("%w: cannot decode weekly pageviews of %x", errCorruptItemSignals, b)
+	}
 	pos += n
-	sitelinks, n := binary.Varint(b[pos:])
+	var weekly []float64
+	if numWeeks > 0 {
+		weekly = make([]float64, numWeeks)
+		for i := range weekly {
+			weekly[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[pos:]))
+			pos += 8
+		}
+	}
+	if pos != len(b) {
+		return ItemSignals{}, fmt.Errorf("%w: %d trailing bytes in %x", errCorruptItemSignals, len(b)-pos, b)
+	}
+	if v[0] == 0 || v[6] > 1 {
+		return ItemSignals{}, fmt.Errorf("%w: bad values in %x", errCorruptItemSignals, b)
+	}
 	return ItemSignals{
-		item:          item,
-		pageviews:     pageviews,
-		wikitextBytes: wikitextBytes,
-		claims:        claims,
-		identifiers:   identifiers,
-		sitelinks:     sitelinks,
+		item:            v[0],
+		pageviews:       v[1],
+		wikitextBytes:   v[2],
+		claims:          v[3],
+		identifiers:     v[4],
+		sitelinks:       v[5],
+		disambiguation:  v[6] != 0,
+		outlinks:        v[7],
+		infoboxes:       v[8],
+		maxPageviews:    v[9],
+		class:           v[10],
+		dumpSitelinks:   v[11],
+		cappedWeeks:     v[12],
+		mergedInto:      v[13],
+		mergedFrom:      v[14],
+		externalLinks:   v[15],
+		templates:       v[16],
+		inlinks:         v[17],
+		weeklyPageviews: weekly,
+	}, nil
+}
+
+// ItemSignalsFromBytes decodes ItemSignals for extsort. Because extsort
+// does not let us return an error, corrupt data gets decoded to
+// ItemSignals whose item is corruptItem; see checkItemSignals().
+func ItemSignalsFromBytes(b []byte) extsort.SortType {
+	sig, err := decodeItemSignals(b)
+	if err != nil {
+		if logger != nil {
+			logger.Printf("ItemSignalsFromBytes(): %v", err)
+		}
+		return ItemSignals{item: corruptItem}
 	}
+	return sig
+}
+
+// CheckItemSignals returns an error if the sorter has given us
+// signals that ItemSignalsFromBytes() could not decode.
+func checkItemSignals(s extsort.SortType) (ItemSignals, error) {
+	sig, ok := s.(ItemSignals)
+	if !ok || sig.item == corruptItem {
+		return ItemSignals{}, fmt.Errorf("%w in temporary sort file", errCorruptItemSignals)
+	}
+	return sig, nil
 }
 
 func ItemSignalsLess(a, b extsort.SortType) bool {
@@ -132,34 +352,123 @@ func ItemSignalsLess(a, b extsort.SortType) bool {
 		return false
 	}
 
-	return false
+	if aa.disambiguation != bb.disambiguation {
+		return !aa.disambiguation
+	}
+
+	if aa.outlinks < bb.outlinks {
+		return true
+	} else if aa.outlinks > bb.outlinks {
+		return false
+	}
+
+	if aa.infoboxes < bb.infoboxes {
+		return true
+	} else if aa.infoboxes > bb.infoboxes {
+		return false
+	}
+
+	if aa.maxPageviews < bb.maxPageviews {
+		return true
+	} else if aa.maxPageviews > bb.maxPageviews {
+		return false
+	}
+
+	if aa.class < bb.class {
+		return true
+	} else if aa.class > bb.class {
+		return false
+	}
+
+	if aa.dumpSitelinks < bb.dumpSitelinks {
+		return true
+	} else if aa.dumpSitelinks > bb.dumpSitelinks {
+		return false
+	}
+
+	if aa.cappedWeeks < bb.cappedWeeks {
+		return true
+	} else if aa.cappedWeeks > bb.cappedWeeks {
+		return false
+	}
+
+	if aa.mergedInto < bb.mergedInto {
+		return true
+	} else if aa.mergedInto > bb.mergedInto {
+		return false
+	}
+
+	if aa.mergedFrom < bb.mergedFrom {
+		return true
+	} else if aa.mergedFrom > bb.mergedFrom {
+		return false
+	}
+
+	if aa.externalLinks < bb.externalLinks {
+		return true
+	} else if aa.externalLinks > bb.externalLinks {
+		return false
+	}
+
+	if aa.templates < bb.templates {
+		return true
+	} else if aa.templates > bb.templates {
+		return false
+	}
+
+	if aa.inlinks < bb.inlinks {
+		return true
+	} else if aa.inlinks > bb.inlinks {
+		return false
+	}
+
+	return slices.Compare(aa.weeklyPageviews, bb.weeklyPageviews) < 0
 }
 
 // BuildItemSignals builds per-item signals and puts them in storage.
 // If the signals file is already in storage, it does not get re-built.
-func buildItemSignals(ctx context.Context, pageviews []string, sites *WikiSites, s3 S3) (time.Time, error) {
-	stored, err := StoredItemSignalsVersion(ctx, s3)
-	if err != nil {
-		return time.Time{}, err
-	}
+// Pageviews are scaled by the weight of their project, see ProjectWeights.
+// Before uploading, we compare the new release to the previous one;
+// in strict mode, anomalies block the upload.
+//
+// For previews, as built by buildPreview(), the output goes to
+// item_signals_preview, and its header is marked as a preview.
+// Previews are not official releases, so we do not publish
+// truncated files, stats, provenance, class rankings, labels or
+// Parquet files for them.
+func buildItemSignals(ctx context.Context, pageviews []string, sites *WikiSites, opts BuildOptions, s3 S3) (time.Time, error) {
+	preview := !opts.preview.IsZero()
+	name, newest := "item_signals", opts.preview
+	if preview {
+		name = "item_signals_preview"
+		opts.MinPageviews = 0
+		opts.ClassRanks = nil
+		opts.LabelsSize = 0
+		opts.WikiSharesSize = 0
+		opts.Parquet = false
+	} else {
+		stored, err := StoredItemSignalsVersion(ctx, s3)
+		if err != nil {
+			return time.Time{}, err
+		}
 
-	newest := ItemSignalsVersion(pageviews, sites)
-	if !newest.After(stored) {
-		s := stored.Format(time.DateOnly)
-		n := newest.Format(time.DateOnly)
-		logger.Printf("signals in storage are still fresh: stored=%s, newest=%s", s, n)
-		return stored, nil
+		newest = ItemSignalsVersion(pageviews, sites)
+		if !newest.After(stored) {
+			s := stored.Format(time.DateOnly)
+			n := newest.Format(time.DateOnly)
+			logger.Printf("signals in storage are still fresh: stored=%s, newest=%s", s, n)
+			return stored, nil
+		}
 	}
 
-	newestYMD := newest.Format("20060102")
-	destPath := fmt.Sprintf("public/item_signals-%s.csv.zst", newestYMD)
+	destPath := PublicPath(name, newest, "csv.zst")
 	logger.Printf("building %s", destPath)
 	outFile, err := os.CreateTemp("", "*-item_signals.csv.zst")
 	if err != nil {
 		return time.Time{}, err
 	}
-	defer outFile.Close()
 	defer os.Remove(outFile.Name())
+	defer outFile.Close()
 
 	zstdLevel := zstd.WithEncoderLevel(zstd.SpeedBestCompression)
 	compressor, err := zstd.NewWriter(outFile, zstdLevel)
@@ -168,69 +477,252 @@ func buildItemSignals(ctx context.Context, pageviews []string, sites *WikiSites,
 	}
 	defer compressor.Close()
 	writer := NewItemSignalsWriter(compressor)
+	writer.SetDisambiguationPolicy(opts.Disambiguation)
+	writer.SetExcludeStubs(opts.ExcludeStubs)
+	if opts.ItemSignalsSchema != 0 {
+		if err := writer.SetSchema(opts.ItemSignalsSchema); err != nil {
+			return time.Time{}, err
+		}
+	}
+	var parquetOut *ItemSignalsParquet
+	if opts.Parquet {
+		version := opts.ItemSignalsSchema
+		if version == 0 {
+			version = qrank.CurrentItemSignalsSchema
+		}
+		schema, err := qrank.LookupItemSignalsSchema(version)
+		if err != nil {
+			return time.Time{}, err
+		}
+		dir, err := os.MkdirTemp("", "item_signals_parquet-*")
+		if err != nil {
+			return time.Time{}, err
+		}
+		defer os.RemoveAll(dir)
+		parquetOut = NewItemSignalsParquet(dir, schema)
+		writer.SetParquetOutput(parquetOut)
+	}
+	var truncatedFile *os.File
+	if opts.MinPageviews > 0 {
+		truncatedFile, err = os.CreateTemp("", "*-item_signals_truncated.csv.zst")
+		if err != nil {
+			return time.Time{}, err
+		}
+		defer os.Remove(truncatedFile.Name())
+		defer truncatedFile.Close()
 
-	// Download all pageview files from S3 storage to local disk, to work
-	// around an apparent flakiness in Wikimedia's storage infrastructure.
-	// https://github.com/brawer/wikidata-qrank/issues/40
-	tempDir, err := os.MkdirTemp("", "itemsignals-*")
-	if err != nil {
-		return time.Time{}, err
+		truncatedCompressor, err := zstd.NewWriter(truncatedFile, zstdLevel)
+		if err != nil {
+			return time.Time{}, err
+		}
+		defer truncatedCompressor.Close()
+		writer.SetTruncatedOutput(truncatedCompressor, opts.MinPageviews)
+	}
+	provenance := NewProvenance(newest, pageviews, sites)
+	provenance.Weights = opts.Weights
+	provenance.MinPageviews = opts.MinPageviews
+	provenance.MaxWeekMultiple = opts.MaxWeekMultiple
+	provenance.SitelinksFromDump = opts.SitelinksFromDump
+	provenance.ExcludeStubs = opts.ExcludeStubs
+	provenance.Sample = buildSampleFrom(ctx)
+	if opts.Disambiguation != KeepDisambiguation {
+		provenance.Disambiguation = string(opts.Disambiguation)
+	}
+	if opts.Disambiguation == DemoteDisambiguation {
+		provenance.DisambiguationDemotion = disambiguationDemotion
+	}
+	comments := provenance.CSVComment()
+	if preview {
+		comments = append(comments, "# preview: not an official release; the last week may be partial")
+	}
+	writer.SetComments(comments)
+	if parquetOut != nil {
+		if err := parquetOut.SetProvenance(provenance); err != nil {
+			return time.Time{}, err
+		}
+	}
+	stats := NewSignalStats(newest, sites)
+	writer.SetStats(stats)
+	writer.SetSitelinksFromDump(opts.SitelinksFromDump)
+	writer.SetMaxWeekMultiple(opts.MaxWeekMultiple)
+	var classRanks *ClassRanks
+	if len(opts.ClassRanks) > 0 {
+		classRanks = NewClassRanks(opts.ClassRanks, opts.ClassRankSize)
+		writer.SetClassRanks(classRanks)
 	}
-	defer os.RemoveAll(tempDir)
 
-	// logger.Printf("BuildItemSignals(): download %d pageview files to %s", len(pageviews), tempDir)
-	localPageViews := make([]string, 0, len(pageviews))
-	for _, pv := range pageviews {
-		path := filepath.Join(tempDir, filepath.Base(pv))
-		localPageViews = append(localPageViews, path)
-		opts := minio.GetObjectOptions{}
-		if err := s3.FGetObject(ctx, "qrank", pv, path, opts); err != nil {
+	// The labels of the top-ranked items come from a separate stage.
+	// We look for them now, so a missing stage does not make us fail
+	// at the very end.
+	var topItems *ClassRanks
+	var labels string
+	if opts.LabelsSize > 0 {
+		path, err := findLabels(ctx, s3)
+		if err != nil {
+			return time.Time{}, err
+		}
+		labels = path
+	}
+	if n := max(opts.LabelsSize, opts.WikiSharesSize); n > 0 {
+		topItems = NewClassRanks([]int64{0}, n)
+		writer.SetTopItems(topItems)
+	}
+
+	// For the wiki share report, the joiner records the pageviews
+	// of every page before they get summed up per item.
+	var views *wikiViews
+	if opts.WikiSharesSize > 0 {
+		views, err = newWikiViews()
+		if err != nil {
+			return time.Time{}, err
+		}
+		defer views.Remove()
+	}
+
+	// The classes of items come from a separate stage, and get
+	// sorted together with the signals from pages.
+	var classes io.ReadCloser
+	if opts.needsClasses() {
+		path, err := findClasses(ctx, s3)
+		if err != nil {
+			return time.Time{}, err
+		}
+		opts := S3ReaderOptions{Compression: ZstdCompressed}
+		classes, err = NewS3ReaderWithOptions(ctx, "qrank", path, s3, opts)
+		if err != nil {
+			return time.Time{}, err
+		}
+		defer classes.Close()
+	}
+
+	// Likewise for the sitelink counts from the wb_items_per_site dump.
+	var sitelinks io.ReadCloser
+	if opts.SitelinksFromDump {
+		path, err := findSitelinks(ctx, s3)
+		if err != nil {
+			return time.Time{}, err
+		}
+		opts := S3ReaderOptions{Compression: ZstdCompressed}
+		sitelinks, err = NewS3ReaderWithOptions(ctx, "qrank", path, s3, opts)
+		if err != nil {
 			return time.Time{}, err
 		}
+		defer sitelinks.Close()
 	}
-	// logger.Printf("BuildItemSignals(): finished downloading pageview files")
 
 	scanners := make([]LineScanner, 0, len(pageviews)+1)
 	scannerNames := make([]string, 0, len(pageviews)+1)
-	scanners = append(scanners, NewPageSignalsScanner(sites, s3))
+	scanners = append(scanners, NewPageSignalsScanner(ctx, sites, s3))
 	scannerNames = append(scannerNames, "page_signals")
 
-	for _, pv := range localPageViews {
-		reader, err := os.Open(pv)
+	// On success, the scanners get closed explicitly, so we can tell
+	// if closing fails; this is for the paths that return early, such
+	// as when anomalies block the upload in strict mode.
+	defer closeScanners(scanners)
+
+	// NewS3Reader downloads the pageview files from S3 storage to local
+	// disk, to work around an apparent flakiness in Wikimedia's storage
+	// infrastructure. https://github.com/brawer/wikidata-qrank/issues/40
+	for _, pv := range pageviews {
+		opts := S3ReaderOptions{Compression: ZstdCompressed}
+		reader, err := NewS3ReaderWithOptions(ctx, "qrank", pv, s3, opts)
+		if err != nil {
+			return time.Time{}, err
+		}
+		defer reader.Close()
+		scanners = append(scanners, NewLineScanner(reader))
+		scannerNames = append(scannerNames, pv)
+	}
+
+	// Likewise for the items that have been merged into other items.
+	var mergedItems io.ReadCloser
+	if opts.needsMergedItems() {
+		path, err := findMergedItems(ctx, s3)
 		if err != nil {
 			return time.Time{}, err
 		}
-		decompressor, err := zstd.NewReader(reader)
+		opts := S3ReaderOptions{Compression: ZstdCompressed}
+		mergedItems, err = NewS3ReaderWithOptions(ctx, "qrank", path, s3, opts)
 		if err != nil {
 			return time.Time{}, err
 		}
-		scanners = append(scanners, bufio.NewScanner(decompressor))
-		scannerNames = append(scannerNames, pv)
+		defer mergedItems.Close()
 	}
 
 	// Produce a stream of ItemSignals, sorted by Wikidata item ID.
 	sigChan := make(chan extsort.SortType, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
-	sorter, outChan, errChan := extsort.New(sigChan, ItemSignalsFromBytes, ItemSignalsLess, config)
-	merger := NewLineMerger(scanners, scannerNames)
+	config := newSortConfig(64)
 	group, groupCtx := errgroup.WithContext(ctx)
+	sorter, outChan, errChan := extsort.New(sortInput(groupCtx, "item_signals", sigChan, config), ItemSignalsFromBytes, ItemSignalsLess, config)
+	merger := NewLineMerger(scanners, scannerNames)
+
+	// Rows for merged items go elsewhere in the output than the rows
+	// of their targets, so the final signals need to get sorted again.
+	var finalSorter *extsort.SortTypeSorter
+	var finalOutChan <-chan extsort.SortType
+	var finalErrChan <-chan error
+	if mergedItems != nil {
+		finalChan := make(chan extsort.SortType, 10000)
+		writer.SetMergedItems(finalChan)
+		finalSorter, finalOutChan, finalErrChan = extsort.New(sortInput(groupCtx, "item_signals_final", finalChan, config), ItemSignalsFromBytes, ItemSignalsLess, config)
+	}
+
+	joiner := itemSignalsJoiner{
+		out:             sigChan,
+		weights:         opts.Weights,
+		maxWeekMultiple: opts.MaxWeekMultiple,
+		numWeeks:        len(pageviews),
+		wikiViews:       views,
+		sample:          buildSampleFrom(ctx),
+	}
+	weekIndex := make(map[string]int, len(pageviews))
+	for i, pv := range pageviews {
+		weekIndex[pv] = i
+	}
 	group.Go(func() error {
-		joiner := itemSignalsJoiner{out: sigChan}
 		for merger.Advance() {
 			line := merger.Line()
+			joiner.week = weekIndex[merger.Name()]
 			if err := joiner.Process(line); err != nil {
 				joiner.Close()
 				logger.Printf(`ItemSignalsJoiner.Process("%s") failed: %v`, line, err)
 				return err
 			}
 		}
-		joiner.Close()
 		if err := merger.Err(); err != nil {
+			joiner.Close()
 			logger.Printf("LineMerger failed: %v", err)
 			return err
 		}
+		if classes != nil {
+			if err := sendClasses(groupCtx, classes, sigChan); err != nil {
+				joiner.Close()
+				logger.Printf("sendClasses() failed: %v", err)
+				return err
+			}
+		}
+		if sitelinks != nil {
+			if err := sendSitelinks(groupCtx, sitelinks, sigChan); err != nil {
+				joiner.Close()
+				logger.Printf("sendSitelinks() failed: %v", err)
+				return err
+			}
+		}
+		if opts.needsInlinks() {
+			if err := sendInlinks(groupCtx, sites, s3, sigChan); err != nil {
+				joiner.Close()
+				logger.Printf("sendInlinks() failed: %v", err)
+				return err
+			}
+		}
+		if mergedItems != nil {
+			if err := sendMergedItems(groupCtx, mergedItems, sigChan); err != nil {
+				joiner.Close()
+				logger.Printf("sendMergedItems() failed: %v", err)
+				return err
+			}
+		}
+		joiner.Close()
 		return nil
 	})
 	group.Go(func() error {
@@ -250,7 +742,12 @@ func buildItemSignals(ctx context.Context, pageviews []string, sites *WikiSites,
 					}
 					return err
 				}
-				if err := writer.Write(s.(ItemSignals)); err != nil {
+				sig, err := checkItemSignals(s)
+				if err != nil {
+					logger.Printf("BuildItemSignals(): %v", err)
+					return err
+				}
+				if err := writer.Write(sig); err != nil {
 					logger.Printf("ItemSignalsWriter.Write() failed: %v", err)
 					return err
 				}
@@ -258,6 +755,32 @@ func buildItemSignals(ctx context.Context, pageviews []string, sites *WikiSites,
 		}
 	})
 
+	if finalSorter != nil {
+		group.Go(func() error {
+			finalSorter.Sort(groupCtx)
+			for {
+				select {
+				case <-groupCtx.Done():
+					return groupCtx.Err()
+
+				case s, more := <-finalOutChan:
+					if !more {
+						return writer.Close()
+					}
+					sig, err := checkItemSignals(s)
+					if err != nil {
+						logger.Printf("BuildItemSignals(): %v", err)
+						return err
+					}
+					if err := writer.WriteSorted(sig); err != nil {
+						logger.Printf("ItemSignalsWriter.WriteSorted() failed: %v", err)
+						return err
+					}
+				}
+			}
+		})
+	}
+
 	if err := group.Wait(); err != nil {
 		logger.Printf("BuildItemSignals(): group.Wait() failed, err==%v", err)
 		return time.Time{}, err
@@ -267,19 +790,110 @@ func buildItemSignals(ctx context.Context, pageviews []string, sites *WikiSites,
 		logger.Printf("BuildItemSignals(): sorting failed, err=%v", err)
 		return time.Time{}, err
 	}
+	if finalSorter != nil {
+		if err := <-finalErrChan; err != nil {
+			logger.Printf("BuildItemSignals(): sorting merged items failed, err=%v", err)
+			return time.Time{}, err
+		}
+		logger.Printf("BuildItemSignals(): wrote %d rows for merged items", writer.Merged())
+	}
 
-	for _, s := range scanners {
-		if closer, ok := s.(io.Closer); ok {
-			if err := closer.Close(); err != nil {
-				return time.Time{}, err
-			}
+	for domain, rows := range joiner.rows {
+		stats.AddRows(domain, rows)
+	}
+	stats.TruncatedItems = writer.Truncated()
+	stats.ComputeDistribution()
+	stats.ExcludedStubs = writer.ExcludedStubs()
+	if stats.CappedItems > 0 {
+		logger.Printf("BuildItemSignals(): capped weekly pageviews of %d items at %g times their median week",
+			stats.CappedItems, opts.MaxWeekMultiple)
+	}
+	if joiner.duplicates > 0 {
+		logger.Printf("BuildItemSignals(): ignored %d duplicate page_signals lines", joiner.duplicates)
+	}
+
+	if preview {
+		if err := closeScanners(scanners); err != nil {
+			return time.Time{}, err
+		}
+		if err := PutInStorage(ctx, outFile.Name(), s3, "qrank", destPath, "application/zstd"); err != nil {
+			return time.Time{}, err
+		}
+		logger.Printf("published preview %s", destPath)
+		return newest, nil
+	}
+
+	report, err := CheckAnomalies(ctx, stats, s3)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if opts.Strict && len(report.Anomalies) > 0 {
+		return time.Time{}, fmt.Errorf("not uploading %s because of %d anomalies, see %s", destPath, len(report.Anomalies), report.StoragePath())
+	}
+
+	if err := closeScanners(scanners); err != nil {
+		return time.Time{}, err
+	}
+
+	if truncatedFile != nil {
+		fullPath := PublicPath("item_signals_full", newest, "csv.zst")
+		if err := PutInStorage(ctx, outFile.Name(), s3, "qrank", fullPath, "application/zstd"); err != nil {
+			return time.Time{}, err
+		}
+		if err := PutInStorage(ctx, truncatedFile.Name(), s3, "qrank", destPath, "application/zstd"); err != nil {
+			return time.Time{}, err
+		}
+		if err := stats.AddDigest(destPath, truncatedFile.Name()); err != nil {
+			return time.Time{}, err
+		}
+		logger.Printf("left out %d items with less than %d pageviews from %s",
+			stats.TruncatedItems, opts.MinPageviews, destPath)
+	} else {
+		if err := PutInStorage(ctx, outFile.Name(), s3, "qrank", destPath, "application/zstd"); err != nil {
+			return time.Time{}, err
+		}
+		if err := stats.AddDigest(destPath, outFile.Name()); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	if parquetOut != nil {
+		if err := parquetOut.Put(ctx, newest, s3); err != nil {
+			return time.Time{}, err
 		}
 	}
 
-	if err := PutInStorage(ctx, outFile.Name(), s3, "qrank", destPath, "application/zstd"); err != nil {
+	if err := provenance.Put(ctx, s3); err != nil {
+		return time.Time{}, err
+	}
+
+	if err := stats.Put(ctx, s3); err != nil {
 		return time.Time{}, err
 	}
 
+	if err := classRanks.Put(ctx, newest, comments, s3); err != nil {
+		return time.Time{}, err
+	}
+
+	if opts.LabelsSize > 0 {
+		top := topItems.Top(0)
+		top = top[:min(len(top), opts.LabelsSize)]
+		if err := writeLabels(ctx, top, labels, newest, comments, s3); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	if views != nil {
+		if err := views.Close(); err != nil {
+			return time.Time{}, err
+		}
+		top := topItems.Top(0)
+		top = top[:min(len(top), opts.WikiSharesSize)]
+		if err := writeWikiShares(ctx, top, views, newest, comments, s3); err != nil {
+			return time.Time{}, err
+		}
+	}
+
 	if err := os.Remove(outFile.Name()); err != nil {
 		return time.Time{}, err
 	}
@@ -287,10 +901,51 @@ func buildItemSignals(ctx context.Context, pageviews []string, sites *WikiSites,
 	return newest, nil
 }
 
+func closeScanners(scanners []LineScanner) error {
+	for _, s := range scanners {
+		if closer, ok := s.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 type itemSignalsJoiner struct {
-	out                                                                  chan<- extsort.SortType
-	domain                                                               string
-	page, item, pageviews, wikitextBytes, claims, identifiers, sitelinks int64
+	out                                                       chan<- extsort.SortType
+	weights                                                   ProjectWeights
+	domain                                                    string
+	weight                                                    float64
+	rows                                                      map[string]int64 // domain → number of lines
+	page, item, wikitextBytes, claims, identifiers, sitelinks int64
+	views                                                     int64
+	disambiguation                                            bool
+	outlinks, infoboxes, externalLinks, templates             int64
+
+	// If positive, the weekly pageviews of an item get capped at this
+	// multiple of its median week, to reduce the effect of view-bombing
+	// campaigns and bot spikes on the ranking. Because an item can have
+	// pages on many wikis, the capping happens in ItemSignalsWriter;
+	// the joiner only records the views of each page in each of the
+	// numWeeks weeks. The caller sets week to the index of the week
+	// whose pageviews file contains the current line.
+	maxWeekMultiple float64
+	numWeeks, week  int
+	weekly          []float64
+
+	// Whether the current page already had a line from page_signals.
+	// Each page has at most one such line, but we do not want to count
+	// its signals twice if the input contains the same page again.
+	hasPageSignals bool
+	duplicates     int64 // number of ignored page_signals lines
+
+	// If not nil, the pageviews of each page get recorded together
+	// with their wiki, for the wiki share report.
+	wikiViews *wikiViews
+
+	// If not nil, only items in the sample get emitted.
+	sample *BuildSample
 }
 
 func (j *itemSignalsJoiner) Process(line string) error {
@@ -302,15 +957,29 @@ func (j *itemSignalsJoiner) Process(line string) error {
 	if err != nil {
 		return fmt.Errorf(`bad page: "%s"`, line)
 	}
+	if j.rows == nil {
+		j.rows = make(map[string]int64, 1000)
+	}
+	j.rows[cols[0]] += 1
 	if cols[0] != j.domain || page != j.page {
 		j.flush()
 		j.domain, j.page = cols[0], page
+		j.weight = j.weights.Weight(j.domain)
 	}
 
 	c := cols[2]
 	if c[0] != 'Q' {
 		if n, err := strconv.ParseInt(c, 10, 64); err == nil {
-			j.pageviews += n
+			j.views += n
+			if j.capsWeeks() {
+				if j.weekly == nil {
+					j.weekly = make([]float64, j.numWeeks)
+				}
+				if j.week < 0 || j.week >= j.numWeeks {
+					return fmt.Errorf("week %d out of range [0, %d)", j.week, j.numWeeks)
+				}
+				j.weekly[j.week] += float64(n)
+			}
 		} else {
 			return err
 		}
@@ -320,6 +989,11 @@ func (j *itemSignalsJoiner) Process(line string) error {
 		return nil
 	}
 
+	if j.hasPageSignals {
+		j.duplicates += 1
+		return nil
+	}
+
 	item, err := strconv.ParseInt(c[1:len(c)], 10, 64)
 	if err != nil {
 		return fmt.Errorf(`expected domain,page,item,...: "%s"`, line)
@@ -358,6 +1032,45 @@ func (j *itemSignalsJoiner) Process(line string) error {
 		j.sitelinks += n
 	}
 
+	if len(cols) > 7 && len(cols[7]) > 0 {
+		if cols[7] != "1" {
+			return fmt.Errorf(`cannot parse disambiguation: "%s"`, line)
+		}
+		j.disambiguation = true
+	}
+
+	if len(cols) > 8 && len(cols[8]) > 0 {
+		n, err := strconv.ParseInt(cols[8], 10, 64)
+		if err != nil {
+			return fmt.Errorf(`cannot parse outlinks: "%s"`, line)
+		}
+		j.outlinks += n
+	}
+
+	if len(cols) > 9 && len(cols[9]) > 0 {
+		if cols[9] != "1" {
+			return fmt.Errorf(`cannot parse infobox: "%s"`, line)
+		}
+		j.infoboxes += 1
+	}
+
+	if len(cols) > 10 && len(cols[10]) > 0 {
+		n, err := strconv.ParseInt(cols[10], 10, 64)
+		if err != nil {
+			return fmt.Errorf(`cannot parse externalLinks: "%s"`, line)
+		}
+		j.externalLinks += n
+	}
+
+	if len(cols) > 11 && len(cols[11]) > 0 {
+		n, err := strconv.ParseInt(cols[11], 10, 64)
+		if err != nil {
+			return fmt.Errorf(`cannot parse templates: "%s"`, line)
+		}
+		j.templates += n
+	}
+
+	j.hasPageSignals = true
 	return nil
 }
 
@@ -367,32 +1080,98 @@ func (j *itemSignalsJoiner) Close() {
 }
 
 func (j *itemSignalsJoiner) flush() {
-	if j.item != 0 {
+	if j.item != 0 && j.sample.KeepItem(j.item) {
+		pageviews := int64(math.Round(float64(j.views) * j.weight))
+		j.wikiViews.Add(j.item, j.domain, j.views, pageviews)
+		var weekly []float64
+		if j.views > 0 && j.capsWeeks() {
+			weekly = make([]float64, j.numWeeks)
+			for i, v := range j.weekly {
+				weekly[i] = v * j.weight
+			}
+		}
 		j.out <- ItemSignals{
-			item:          j.item,
-			pageviews:     j.pageviews,
-			wikitextBytes: j.wikitextBytes,
-			claims:        j.claims,
-			identifiers:   j.identifiers,
-			sitelinks:     j.sitelinks,
+			item:            j.item,
+			pageviews:       pageviews,
+			wikitextBytes:   j.wikitextBytes,
+			claims:          j.claims,
+			identifiers:     j.identifiers,
+			sitelinks:       j.sitelinks,
+			disambiguation:  j.disambiguation,
+			outlinks:        j.outlinks,
+			infoboxes:       j.infoboxes,
+			externalLinks:   j.externalLinks,
+			templates:       j.templates,
+			maxPageviews:    pageviews,
+			weeklyPageviews: weekly,
 		}
 	}
 	j.domain = ""
 	j.page = 0
 	j.item = 0
-	j.pageviews = 0
+	j.views = 0
+	clear(j.weekly)
 	j.wikitextBytes = 0
 	j.claims = 0
 	j.identifiers = 0
 	j.sitelinks = 0
+	j.disambiguation = false
+	j.outlinks = 0
+	j.infoboxes = 0
+	j.externalLinks = 0
+	j.templates = 0
+	j.hasPageSignals = false
+}
+
+// CapsWeeks returns true if the joiner records weekly pageviews
+// for capping them. Histories of fewer than three weeks have no
+// meaningful median, so they never get capped.
+func (j *itemSignalsJoiner) capsWeeks() bool {
+	return j.maxWeekMultiple > 0 && j.numWeeks >= 3
+}
+
+// CapWeeklyPageviews returns the sum of the weekly pageviews of an item,
+// where each week counts at most maxMultiple times the median week.
+// Weeks without any views count for the median, so a spike on an
+// otherwise rarely viewed item gets capped too; to let such items keep
+// a handful of views, the median is taken to be at least one. Histories
+// of fewer than three weeks have no meaningful median, so they never get
+// capped; neither does anything if maxMultiple is not positive. The
+// second result is the number of capped weeks.
+func capWeeklyPageviews(weeks []float64, maxMultiple float64) (float64, int64) {
+	var sum float64
+	if maxMultiple <= 0 || len(weeks) < 3 {
+		for _, v := range weeks {
+			sum += v
+		}
+		return sum, 0
+	}
+
+	sorted := slices.Clone(weeks)
+	slices.Sort(sorted)
+	median := sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		median = (median + sorted[len(sorted)/2-1]) / 2
+	}
+
+	limit := maxMultiple * max(median, 1)
+	var capped int64
+	for _, v := range weeks {
+		if v > limit {
+			sum += limit
+			capped += 1
+		} else {
+			sum += v
+		}
+	}
+	return sum, capped
 }
 
 func ItemSignalsVersion(pageviews []string, sites *WikiSites) time.Time {
 	var date time.Time
-	re := regexp.MustCompile(`^pageviews/pageviews-(\d{4}-W\d{2}).zst$`)
 	for _, pv := range pageviews {
-		if match := re.FindStringSubmatch(pv); match != nil {
-			if year, week, err := ParseISOWeek(match[1]); err == nil {
+		if w, ok := ParseWeeklyPageviewsPath(pv); ok {
+			if year, week, err := ParseISOWeek(w); err == nil {
 				weekStart := ISOWeekStart(year, week)
 				weekEnd := weekStart.AddDate(0, 0, 6) // weekStart + 6 days
 				if weekEnd.After(date) {
@@ -5,10 +5,17 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"reflect"
 	"slices"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,16 +23,120 @@ import (
 )
 
 func TestItemSignalsAdd(t *testing.T) {
-	s := ItemSignals{72, 1, 2, 3, 4, 5}
-	s.Add(ItemSignals{72, 2, 2, 2, 2, 2})
-	want := ItemSignals{72, 3, 4, 5, 6, 7}
+	s := ItemSignals{72, 1, 2, 3, 4, 5, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil}
+	s.Add(ItemSignals{72, 2, 2, 2, 2, 2, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil})
+	want := ItemSignals{72, 3, 4, 5, 6, 7, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil}
 	if !reflect.DeepEqual(s, want) {
 		t.Errorf("got %v, want %v", s, want)
 	}
 }
 
+func TestItemSignalsAdd_Disambiguation(t *testing.T) {
+	s := ItemSignals{72, 1, 2, 3, 4, 5, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil}
+	s.Add(ItemSignals{72, 2, 2, 2, 2, 2, true, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil})
+	s.Add(ItemSignals{72, 1, 1, 1, 1, 1, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil})
+	if !s.disambiguation {
+		t.Errorf("got %v, want disambiguation=true", s)
+	}
+}
+
+func TestItemSignalsAdd_Enterprise(t *testing.T) {
+	s := ItemSignals{72, 1, 2, 3, 4, 5, false, 10, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil}
+	s.Add(ItemSignals{72, 2, 2, 2, 2, 2, false, 7, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil})
+	want := ItemSignals{72, 3, 4, 5, 6, 7, false, 17, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("got %v, want %v", s, want)
+	}
+}
+
+func TestItemSignalsAdd_QualitySignals(t *testing.T) {
+	s := ItemSignals{72, 1, 0, 0, 0, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 12, 30, 0, nil}
+	s.Add(ItemSignals{72, 2, 0, 0, 0, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 5, 0, 0, nil})
+	want := ItemSignals{72, 3, 0, 0, 0, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 17, 30, 0, nil}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("got %v, want %v", s, want)
+	}
+}
+
+func TestItemSignalsAdd_MaxPageviews(t *testing.T) {
+	s := ItemSignals{72, 30, 0, 0, 0, 0, false, 0, 0, 30, 0, 0, 0, 0, 0, 0, 0, 0, nil}
+	s.Add(ItemSignals{72, 50, 0, 0, 0, 0, false, 0, 0, 50, 0, 0, 0, 0, 0, 0, 0, 0, nil})
+	s.Add(ItemSignals{72, 20, 0, 0, 0, 0, false, 0, 0, 20, 0, 0, 0, 0, 0, 0, 0, 0, nil})
+	want := ItemSignals{72, 100, 0, 0, 0, 0, false, 0, 0, 50, 0, 0, 0, 0, 0, 0, 0, 0, nil}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("got %v, want %v", s, want)
+	}
+}
+
+func TestItemSignalsAdd_Class(t *testing.T) {
+	s := ItemSignals{72, 30, 0, 0, 0, 0, false, 0, 0, 30, 0, 0, 0, 0, 0, 0, 0, 0, nil}
+	s.Add(ItemSignals{72, 0, 0, 0, 0, 0, false, 0, 0, 0, 515, 0, 0, 0, 0, 0, 0, 0, nil})
+	s.Add(ItemSignals{72, 20, 0, 0, 0, 0, false, 0, 0, 20, 0, 0, 0, 0, 0, 0, 0, 0, nil})
+	want := ItemSignals{72, 50, 0, 0, 0, 0, false, 0, 0, 30, 515, 0, 0, 0, 0, 0, 0, 0, nil}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("got %v, want %v", s, want)
+	}
+}
+
+func TestItemSignalsAdd_DumpSitelinks(t *testing.T) {
+	s := ItemSignals{72, 30, 0, 0, 0, 186, false, 0, 0, 30, 0, 0, 0, 0, 0, 0, 0, 0, nil}
+	s.Add(ItemSignals{72, 0, 0, 0, 0, 0, false, 0, 0, 0, 0, 188, 0, 0, 0, 0, 0, 0, nil})
+	want := ItemSignals{72, 30, 0, 0, 0, 186, false, 0, 0, 30, 0, 188, 0, 0, 0, 0, 0, 0, nil}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("got %v, want %v", s, want)
+	}
+}
+
+func TestItemSignalsAdd_CappedPages(t *testing.T) {
+	s := ItemSignals{72, 30, 0, 0, 0, 0, false, 0, 0, 30, 0, 0, 1, 0, 0, 0, 0, 0, nil}
+	s.Add(ItemSignals{72, 20, 0, 0, 0, 0, false, 0, 0, 20, 0, 0, 1, 0, 0, 0, 0, 0, nil})
+	want := ItemSignals{72, 50, 0, 0, 0, 0, false, 0, 0, 30, 0, 0, 2, 0, 0, 0, 0, 0, nil}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("got %v, want %v", s, want)
+	}
+}
+
+func TestItemSignalsIsItemOnly(t *testing.T) {
+	for _, tc := range []struct {
+		s    ItemSignals
+		want bool
+	}{
+		{ItemSignals{72, 0, 0, 0, 0, 0, false, 0, 0, 0, 515, 0, 0, 0, 0, 0, 0, 0, nil}, true},
+		{ItemSignals{72, 0, 0, 0, 0, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil}, false},
+		{ItemSignals{72, 1, 0, 0, 0, 0, false, 0, 0, 1, 515, 0, 0, 0, 0, 0, 0, 0, nil}, false},
+		{ItemSignals{72, 0, 0, 0, 0, 0, true, 0, 0, 0, 515, 0, 0, 0, 0, 0, 0, 0, nil}, false},
+		{ItemSignals{72, 0, 0, 0, 0, 0, false, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, nil}, true},
+		{ItemSignals{72, 0, 0, 0, 0, 0, false, 0, 0, 0, 515, 3, 0, 0, 0, 0, 0, 0, nil}, true},
+		{ItemSignals{72, 0, 0, 0, 0, 3, false, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, nil}, false},
+		{ItemSignals{72, 0, 0, 0, 0, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 17, nil}, true},
+	} {
+		if got := tc.s.IsItemOnly(); got != tc.want {
+			t.Errorf("got %v for %v, want %v", got, tc.s, tc.want)
+		}
+	}
+}
+
+func TestItemSignalsIsStub(t *testing.T) {
+	for _, tc := range []struct {
+		s    ItemSignals
+		want bool
+	}{
+		{ItemSignals{72, 0, 0, 3, 3, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil}, true},
+		{ItemSignals{72, 0, 0, 5, 3, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil}, true},
+		{ItemSignals{72, 0, 0, 6, 3, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil}, false},
+		{ItemSignals{72, 0, 0, 2, 0, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil}, false},
+		{ItemSignals{72, 1, 0, 3, 3, 0, false, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, nil}, false},
+		{ItemSignals{72, 0, 7, 3, 3, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil}, false},
+		{ItemSignals{72, 0, 0, 3, 3, 1, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil}, false},
+	} {
+		if got := tc.s.IsStub(); got != tc.want {
+			t.Errorf("got %v for %v, want %v", got, tc.s, tc.want)
+		}
+	}
+}
+
 func TestItemSignalsClear(t *testing.T) {
-	s := ItemSignals{1, 2, 3, 4, 5, 6}
+	s := ItemSignals{1, 2, 3, 4, 5, 6, true, 7, 8, 9, 10, 11, 0, 0, 0, 0, 0, 0, nil}
 	s.Clear()
 	want := ItemSignals{}
 	if !reflect.DeepEqual(s, want) {
@@ -35,36 +146,138 @@ func TestItemSignalsClear(t *testing.T) {
 
 func TestItemSignalsToBytes(t *testing.T) {
 	// Serialize and then de-serialize an ItemSignals struct.
-	a := ItemSignals{1, 2, 3, 4, 5, 6}
-	got := ItemSignalsFromBytes(a.ToBytes()).(ItemSignals)
-	if !reflect.DeepEqual(got, a) {
-		t.Errorf("got %v, want %v", got, a)
+	for _, a := range []ItemSignals{
+		ItemSignals{1, 2, 3, 4, 5, 6, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{1, 2, 3, 4, 5, 6, true, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{1, 2, 3, 4, 5, 6, false, 7, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{1, 2, 3, 4, 5, 6, false, 7, 8, 9, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{1, 2, 3, 4, 5, 6, false, 7, 8, 9, 515, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{1, 2, 3, 4, 5, 6, false, 7, 8, 9, 515, 11, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{1, 2, 3, 4, 5, 6, false, 7, 8, 9, 515, 11, 0, 72, 0, 0, 0, 0, nil},
+		ItemSignals{72, 0, 0, 0, 0, 0, false, 0, 0, 0, 0, 0, 0, 0, 4115189, 0, 0, 0, nil},
+		ItemSignals{1, 2, 3, 4, 5, 6, false, 7, 8, 9, 515, 11, 0, 0, 0, 31, 45, 0, nil},
+		ItemSignals{1, 2, 3, 4, 5, 6, false, 7, 8, 9, 515, 11, 0, 0, 0, 31, 45, 812, nil},
+		ItemSignals{1, 2, 0, 0, 0, 0, false, 0, 0, 2, 0, 0, 3, 0, 0, 0, 0, 0, []float64{0, 0.5, 1.5}},
+	} {
+		got := ItemSignalsFromBytes(a.ToBytes()).(ItemSignals)
+		if !reflect.DeepEqual(got, a) {
+			t.Errorf("got %v, want %v", got, a)
+		}
 	}
 }
 
+func TestDecodeItemSignals_Corrupt(t *testing.T) {
+	good := ItemSignals{1, 2, 3, 4, 5, 6, true, 7, 8, 9, 515, 0, 0, 0, 0, 0, 0, 0, nil}.ToBytes()
+	negative := ItemSignals{1, -2, 3, 4, 5, 6, true, 7, 8, 9, 515, 0, 0, 0, 0, 0, 0, 0, nil}.ToBytes()
+	zeroItem := ItemSignals{0, 2, 3, 4, 5, 6, true, 7, 8, 9, 515, 0, 0, 0, 0, 0, 0, 0, nil}.ToBytes()
+	badDisambiguation := slices.Clone(good)
+	badDisambiguation[6] = 4 // varint for 2
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"truncated", good[:len(good)-1]},
+		{"trailing", append(slices.Clone(good), 0)},
+		{"overflow", append([]byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}, good[1:]...)},
+		{"negative", negative},
+		{"zero item", zeroItem},
+		{"bad disambiguation", badDisambiguation},
+	} {
+		if _, err := decodeItemSignals(tc.data); !errors.Is(err, errCorruptItemSignals) {
+			t.Errorf("%s: got %v, want errCorruptItemSignals", tc.name, err)
+		}
+		sig := ItemSignalsFromBytes(tc.data)
+		if _, err := checkItemSignals(sig); !errors.Is(err, errCorruptItemSignals) {
+			t.Errorf("%s: checkItemSignals() got %v, want errCorruptItemSignals", tc.name, err)
+		}
+	}
+	if _, err := decodeItemSignals(good); err != nil {
+		t.Error(err)
+	}
+}
+
+// Corrupt data must come out first from the sorter,
+// so that sorting fails before producing any output.
+func TestItemSignalsLess_Corrupt(t *testing.T) {
+	corrupt := ItemSignalsFromBytes([]byte{0x80})
+	sig := ItemSignals{1, 0, 0, 0, 0, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil}
+	if !ItemSignalsLess(corrupt, sig) || ItemSignalsLess(sig, corrupt) {
+		t.Error("corrupt ItemSignals should sort before all others")
+	}
+}
+
+func FuzzItemSignalsFromBytes(f *testing.F) {
+	f.Add(ItemSignals{72, 2, 3, 4, 5, 6, true, 7, 8, 9, 515, 0, 0, 0, 0, 0, 0, 0, nil}.ToBytes())
+	f.Add(ItemSignals{1, 0, 0, 0, 0, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil}.ToBytes())
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sig, err := decodeItemSignals(data)
+		if err != nil {
+			if got := ItemSignalsFromBytes(data).(ItemSignals); got.item != corruptItem {
+				t.Errorf("ItemSignalsFromBytes(%x) got %v, want corrupt item", data, got)
+			}
+			return
+		}
+		got, err := decodeItemSignals(sig.ToBytes())
+		if err != nil || !reflect.DeepEqual(got, sig) {
+			t.Errorf("round trip of %v got %v, %v", sig, got, err)
+		}
+	})
+}
+
+func FuzzItemSignalsToBytes(f *testing.F) {
+	f.Add(int64(72), int64(2), int64(3), int64(4), int64(5), int64(6), true, int64(7), int64(8), int64(9), int64(515), int64(11))
+	f.Fuzz(func(t *testing.T, item, pageviews, wikitextBytes, claims, identifiers, sitelinks int64,
+		disambiguation bool, outlinks, infoboxes, maxPageviews, class, dumpSitelinks int64) {
+		sig := ItemSignals{item, pageviews, wikitextBytes, claims, identifiers, sitelinks,
+			disambiguation, outlinks, infoboxes, maxPageviews, class, dumpSitelinks, 0, 0, 0, 0, 0, 0, nil}
+		got, err := decodeItemSignals(sig.ToBytes())
+		valid := item > 0 && min(pageviews, wikitextBytes, claims, identifiers, sitelinks,
+			outlinks, infoboxes, maxPageviews, class, dumpSitelinks) >= 0
+		if valid && (err != nil || !reflect.DeepEqual(got, sig)) {
+			t.Errorf("round trip of %v got %v, %v", sig, got, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("expected error for %v, got %v", sig, got)
+		}
+	})
+}
+
 func TestItemSignalsLess(t *testing.T) {
 	for _, tc := range []struct {
 		a    string
 		b    string
 		want bool
 	}{
-		{"123456", "123456", false},
-		{"923456", "123456", false},
-		{"123456", "923456", true},
-
-		{"------", "------", false},
-		{"7-----", "------", false},
-		{"-7----", "------", false},
-		{"--7---", "------", false},
-		{"---7--", "------", false},
-		{"----7-", "------", false},
-		{"-----7", "------", false},
-		{"------", "7-----", true},
-		{"------", "-7----", true},
-		{"------", "--7---", true},
-		{"------", "---7--", true},
-		{"------", "----7-", true},
-		{"------", "-----7", true},
+		{"123456-----", "123456-----", false},
+		{"923456-----", "123456-----", false},
+		{"123456-----", "923456-----", true},
+
+		{"-----------", "-----------", false},
+		{"7----------", "-----------", false},
+		{"-7---------", "-----------", false},
+		{"--7--------", "-----------", false},
+		{"---7-------", "-----------", false},
+		{"----7------", "-----------", false},
+		{"-----7-----", "-----------", false},
+		{"------7----", "-----------", false},
+		{"-----------", "7----------", true},
+		{"-----------", "-7---------", true},
+		{"-----------", "--7--------", true},
+		{"-----------", "---7-------", true},
+		{"-----------", "----7------", true},
+		{"-----------", "-----7-----", true},
+		{"-----------", "------7----", true},
+		{"-------7---", "-----------", false},
+		{"--------7--", "-----------", false},
+		{"-----------", "-------7---", true},
+		{"-----------", "--------7--", true},
+		{"---------7-", "-----------", false},
+		{"-----------", "---------7-", true},
+		{"----------7", "-----------", false},
+		{"-----------", "----------7", true},
+		{"------7----", "------7----", false},
 	} {
 		a := ItemSignals{
 			item:          int64(tc.a[0]),
@@ -73,7 +286,12 @@ func TestItemSignalsLess(t *testing.T) {
 			claims:        int64(tc.a[3]),
 			identifiers:   int64(tc.a[4]),
 			sitelinks:     int64(tc.a[5]),
+			outlinks:      int64(tc.a[7]),
+			infoboxes:     int64(tc.a[8]),
+			maxPageviews:  int64(tc.a[9]),
+			class:         int64(tc.a[10]),
 		}
+		a.disambiguation = tc.a[6] == '7'
 		b := ItemSignals{
 			item:          int64(tc.b[0]),
 			pageviews:     int64(tc.b[1]),
@@ -81,7 +299,12 @@ func TestItemSignalsLess(t *testing.T) {
 			claims:        int64(tc.b[3]),
 			identifiers:   int64(tc.b[4]),
 			sitelinks:     int64(tc.b[5]),
+			outlinks:      int64(tc.b[7]),
+			infoboxes:     int64(tc.b[8]),
+			maxPageviews:  int64(tc.b[9]),
+			class:         int64(tc.b[10]),
 		}
+		b.disambiguation = tc.b[6] == '7'
 		got := ItemSignalsLess(a, b)
 		if got != tc.want {
 			t.Errorf("got %v, want %v, for ItemSignalsLess(%#v, %#v)", got, tc.want, a, b)
@@ -141,7 +364,7 @@ func TestBuildItemSignals(t *testing.T) {
 		Domains: map[string]*WikiSite{"rm.wikipedia.org": rmwikiSite, "www.wikidata.org": wikidatawikiSite},
 	}
 
-	date, err := buildItemSignals(ctx, pageviews, sites, s3)
+	date, err := buildItemSignals(ctx, pageviews, sites, BuildOptions{}, s3)
 	if err != nil {
 		t.Error(err)
 	}
@@ -155,19 +378,257 @@ func TestBuildItemSignals(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	wantComments := []string{
+		"# version: 2011-12-09",
+		"# commit: " + BuilderCommit(),
+		"# pageviews: 2011-W07..2011-W08",
+		"# provenance: qrank-meta-20111209.json",
+		"# schema: 2",
+	}
+	if len(got) < 5 || !slices.Equal(got[0:5], wantComments) {
+		t.Errorf("got %v, want comments %v", got, wantComments)
+	} else {
+		got = got[5:]
+	}
+	if _, ok := s3.data["public/qrank-meta-20111209.json"]; !ok {
+		t.Error("provenance file public/qrank-meta-20111209.json not in storage")
+	}
+
+	var stats SignalStats
+	if data, ok := s3.data["public/qrank-stats-20111209.json"]; !ok {
+		t.Error("stats file public/qrank-stats-20111209.json not in storage")
+	} else if err := json.Unmarshal(data, &stats); err != nil {
+		t.Error(err)
+	} else {
+		if stats.FormatVersion != 2 || stats.Items != 5 {
+			t.Errorf("got FormatVersion=%d Items=%d, want 2 and 5", stats.FormatVersion, stats.Items)
+		}
+		wantSites := map[string]*SiteStats{
+			"rm.wikipedia": {Key: "rmwiki", Dumped: "2011-12-09", Rows: 9},
+			"www.wikidata": {Key: "wikidatawiki", Dumped: "2011-04-03", Rows: 7},
+		}
+		if !reflect.DeepEqual(stats.Sites, wantSites) {
+			t.Errorf("got stats.Sites=%v, want %v", stats.Sites, wantSites)
+		}
+		digest := sha256.Sum256(s3.data["public/item_signals-20111209.csv.zst"])
+		wantSHA256 := map[string]string{"item_signals-20111209.csv.zst": hex.EncodeToString(digest[:])}
+		if !reflect.DeepEqual(stats.SHA256, wantSHA256) {
+			t.Errorf("got stats.SHA256=%v, want %v", stats.SHA256, wantSHA256)
+		}
+	}
+
 	want := []string{
-		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks",
-		"Q72,5585,3142,550,85,186",
-		"Q5296,314159267,2872,0,0,0",
-		"Q662541,5,4973,32,9,15",
-		"Q5649951,0,0,1,0,20",
-		"Q107661323,0,3470,0,0,0",
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes",
+		"Q72,5585,3142,550,85,186,0,0,0",
+		"Q5296,314159267,2872,0,0,0,0,0,0",
+		"Q662541,5,4973,32,9,15,0,0,0",
+		"Q5649951,0,0,1,0,20,0,0,0",
+		"Q107661323,0,3470,0,0,0,0,0,0",
 	}
 	if !slices.Equal(got, want) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
 
+func TestBuildItemSignals_Classes(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	s3.WriteLines([]string{"rm.wikipedia,1,5", "rm.wikipedia,3824,7", "rm.wikipedia,799,7"}, "pageviews/pageviews-2011-W07.zst")
+	s3.WriteLines([]string{"1,Q5296,2500", "3824,Q662541,4973", "799,Q72,3142"}, "page_signals/rmwiki-20111209-page_signals.zst")
+	rmDumped, _ := time.Parse(time.DateOnly, "2011-12-09")
+	rmwikiSite := &WikiSite{Key: "rmwiki", Domain: "rm.wikipedia.org", LastDumped: rmDumped}
+	sites := &WikiSites{
+		Sites:   map[string]*WikiSite{"rmwiki": rmwikiSite},
+		Domains: map[string]*WikiSite{"rm.wikipedia.org": rmwikiSite},
+	}
+	pageviews := []string{"pageviews/pageviews-2011-W07.zst"}
+	opts := BuildOptions{ItemSignalsSchema: 4, ClassRanks: []int64{515, 5}, ClassRankSize: 10}
+
+	// Without the output of the classes stage, we should fail.
+	if _, err := buildItemSignals(ctx, pageviews, sites, opts, s3); err == nil {
+		t.Error("expected error when classes are missing from storage")
+	}
+
+	classes := []string{"Q1,Q2", "Q662541,Q515", "Q72,Q515"}
+	s3.WriteLines(classes, "classes/wikidatawiki-20111201-classes.zst")
+	if _, err := buildItemSignals(ctx, pageviews, sites, opts, s3); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s3.ReadLines("public/item_signals-20111209.csv.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes,pageviews_52w_max_wiki,class",
+		"Q72,7,3142,0,0,0,0,0,0,7,Q515",
+		"Q5296,5,2500,0,0,0,0,0,0,5,",
+		"Q662541,7,4973,0,0,0,0,0,0,7,Q515",
+	}
+	if len(got) < len(want) || !slices.Equal(got[len(got)-len(want):], want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The class rankings start with the same provenance comments
+	// as the item signals.
+	comments := []string{
+		"# version: 2011-12-09",
+		"# commit: " + BuilderCommit(),
+		"# pageviews: 2011-W07..2011-W07",
+		"# provenance: qrank-meta-20111209.json",
+	}
+	got, err = s3.ReadLines("public/qrank-class-q515-20111209.csv.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(slices.Clone(comments), "Entity,QRank", "Q72,7", "Q662541,7"); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	got, err = s3.ReadLines("public/qrank-class-q5-20111209.csv.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(slices.Clone(comments), "Entity,QRank"); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestBuildItemSignals_MergedItems(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	s3.WriteLines([]string{"rm.wikipedia,1,5", "rm.wikipedia,3824,7", "rm.wikipedia,799,7"}, "pageviews/pageviews-2011-W07.zst")
+	s3.WriteLines([]string{"1,Q5296,2500", "3824,Q662541,4973", "799,Q72,3142"}, "page_signals/rmwiki-20111209-page_signals.zst")
+	s3.WriteLines([]string{"Q72,Q515"}, "classes/wikidatawiki-20111201-classes.zst")
+	rmDumped, _ := time.Parse(time.DateOnly, "2011-12-09")
+	rmwikiSite := &WikiSite{Key: "rmwiki", Domain: "rm.wikipedia.org", LastDumped: rmDumped}
+	sites := &WikiSites{
+		Sites:   map[string]*WikiSite{"rmwiki": rmwikiSite},
+		Domains: map[string]*WikiSite{"rm.wikipedia.org": rmwikiSite},
+	}
+	pageviews := []string{"pageviews/pageviews-2011-W07.zst"}
+	opts := BuildOptions{ItemSignalsSchema: 5}
+
+	// Without the output of the merged-items stage, we should fail.
+	if _, err := buildItemSignals(ctx, pageviews, sites, opts, s3); err == nil {
+		t.Error("expected error when merged items are missing from storage")
+	}
+
+	// Q5296 has been merged into Q72, but some wiki still links to it,
+	// so it keeps its own signals. Q8 has been merged into an item
+	// without any signals, so it does not appear in the output.
+	merged := []string{"Q4115189,Q72", "Q5296,Q72", "Q8,Q9", "Q13,Q662541"}
+	s3.WriteLines(merged, "merged_items/wikidatawiki-20111201-merged_items.zst")
+	if _, err := buildItemSignals(ctx, pageviews, sites, opts, s3); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s3.ReadLines("public/item_signals-20111209.csv.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes,pageviews_52w_max_wiki,class,merged_into",
+		"Q13,7,4973,0,0,0,0,0,0,7,,Q662541",
+		"Q72,7,3142,0,0,0,0,0,0,7,Q515,",
+		"Q5296,5,2500,0,0,0,0,0,0,5,,",
+		"Q662541,7,4973,0,0,0,0,0,0,7,,",
+		"Q4115189,7,3142,0,0,0,0,0,0,7,Q515,Q72",
+	}
+	if len(got) < len(want) || !slices.Equal(got[len(got)-len(want):], want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Merged items should not count twice in the stats.
+	var stats SignalStats
+	if err := json.Unmarshal(s3.data["public/qrank-stats-20111209.json"], &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Items != 3 {
+		t.Errorf("got stats.Items=%d, want 3", stats.Items)
+	}
+}
+
+func TestBuildItemSignals_MinPageviews(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	s3.WriteLines([]string{"rm.wikipedia,1,5", "rm.wikipedia,3824,2", "rm.wikipedia,799,7"}, "pageviews/pageviews-2011-W07.zst")
+	s3.WriteLines([]string{"1,Q5296,2500", "3824,Q662541,4973", "799,Q72,3142"}, "page_signals/rmwiki-20111209-page_signals.zst")
+	rmDumped, _ := time.Parse(time.DateOnly, "2011-12-09")
+	rmwikiSite := &WikiSite{Key: "rmwiki", Domain: "rm.wikipedia.org", LastDumped: rmDumped}
+	sites := &WikiSites{
+		Sites:   map[string]*WikiSite{"rmwiki": rmwikiSite},
+		Domains: map[string]*WikiSite{"rm.wikipedia.org": rmwikiSite},
+	}
+	pageviews := []string{"pageviews/pageviews-2011-W07.zst"}
+	if _, err := buildItemSignals(ctx, pageviews, sites, BuildOptions{MinPageviews: 5}, s3); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path  string
+		items []string
+	}{
+		{"public/item_signals-20111209.csv.zst", []string{"Q72", "Q5296"}},
+		{"public/item_signals_full-20111209.csv.zst", []string{"Q72", "Q5296", "Q662541"}},
+	} {
+		lines, err := s3.ReadLines(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var items []string
+		for _, line := range lines {
+			if strings.HasPrefix(line, "Q") {
+				item, _, _ := strings.Cut(line, ",")
+				items = append(items, item)
+			}
+		}
+		if !slices.Equal(items, tc.items) {
+			t.Errorf("%s: got items %v, want %v", tc.path, items, tc.items)
+		}
+	}
+
+	var stats SignalStats
+	if err := json.Unmarshal(s3.data["public/qrank-stats-20111209.json"], &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Items != 3 || stats.TruncatedItems != 1 {
+		t.Errorf("got stats.Items=%d stats.TruncatedItems=%d, want 3 and 1", stats.Items, stats.TruncatedItems)
+	}
+}
+
+// In strict mode, buildItemSignals() should refuse to publish
+// a release that looks anomalous compared to the previous one.
+func TestBuildItemSignals_Strict(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	s3.WriteLines([]string{"rm.wikipedia,1,5"}, "pageviews/pageviews-2011-W07.zst")
+	s3.WriteLines([]string{"1,Q5296,2500"}, "page_signals/rmwiki-20111209-page_signals.zst")
+	s3.data["public/qrank-stats-20110101.json"] = []byte(`{"format_version":2,"version":"2011-01-01","items":1000}`)
+	rmDumped, _ := time.Parse(time.DateOnly, "2011-12-09")
+	rmwikiSite := &WikiSite{Key: "rmwiki", Domain: "rm.wikipedia.org", LastDumped: rmDumped}
+	sites := &WikiSites{
+		Sites:   map[string]*WikiSite{"rmwiki": rmwikiSite},
+		Domains: map[string]*WikiSite{"rm.wikipedia.org": rmwikiSite},
+	}
+
+	pageviews := []string{"pageviews/pageviews-2011-W07.zst"}
+	_, err := buildItemSignals(ctx, pageviews, sites, BuildOptions{Strict: true}, s3)
+	if err == nil {
+		t.Error("expected error in strict mode")
+	}
+	if _, ok := s3.data["public/item_signals-20111209.csv.zst"]; ok {
+		t.Error("anomalous release should not have been published")
+	}
+	if _, ok := s3.data["internal/qrank-anomalies-20111209.json"]; !ok {
+		t.Error("anomaly report should be in storage")
+	}
+}
+
 // If the most recent pageview file is newer than the last dump
 // of any Wikimedia site, ItemSignalsVersion() should return
 // the last day of the week of the most recent pageviews file.
@@ -261,10 +722,305 @@ func TestItemSignalsJoiner(t *testing.T) {
 		got = append(got, s.(ItemSignals))
 	}
 	want := []ItemSignals{
-		ItemSignals{72, 201, 4, 550, 85, 186},
-		ItemSignals{662541, 0, 4973, 0, 0, 0},
+		ItemSignals{72, 201, 4, 550, 85, 186, false, 0, 0, 201, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{662541, 0, 4973, 0, 0, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestItemSignalsJoiner_Duplicates(t *testing.T) {
+	ch := make(chan extsort.SortType, 20)
+	joiner := itemSignalsJoiner{out: ch}
+	for _, line := range []string{
+		"test.wikipedia,200,198",
+		"test.wikipedia,200,3",
+		"test.wikipedia,200,Q72,4,550,85,186",
+		"test.wikipedia,200,Q72,4,550,85,186",
+		"www.wikidata,72,Q72,1,2,3,4",
+		"www.wikidata,72,Q72,1,2,3,4",
+	} {
+		if err := joiner.Process(line); err != nil {
+			t.Error(err)
+		}
+	}
+	joiner.Close()
+	got := make([]ItemSignals, 0, 20)
+	for s := range ch {
+		got = append(got, s.(ItemSignals))
+	}
+	want := []ItemSignals{
+		ItemSignals{72, 201, 4, 550, 85, 186, false, 0, 0, 201, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{72, 0, 1, 2, 3, 4, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if joiner.duplicates != 2 {
+		t.Errorf("got %d duplicates, want 2", joiner.duplicates)
+	}
+}
+
+func TestItemSignalsJoiner_Weights(t *testing.T) {
+	ch := make(chan extsort.SortType, 20)
+	weights := ProjectWeights{"wikipedia": 0.5, "wiktionary": 0.1}
+	joiner := itemSignalsJoiner{out: ch, weights: weights}
+	for _, line := range []string{
+		"en.wiktionary,7,3",
+		"en.wiktionary,7,4",
+		"en.wiktionary,7,Q5,10",
+		"test.wikipedia,200,198",
+		"test.wikipedia,200,3",
+		"test.wikipedia,200,Q72,4,550,85,186",
+		"test.wikisource,8,1000",
+		"test.wikisource,8,Q9",
+	} {
+		if err := joiner.Process(line); err != nil {
+			t.Error(err)
+		}
+	}
+	joiner.Close()
+	got := make([]ItemSignals, 0, 20)
+	for s := range ch {
+		got = append(got, s.(ItemSignals))
+	}
+	want := []ItemSignals{
+		ItemSignals{5, 1, 10, 0, 0, 0, false, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{72, 101, 4, 550, 85, 186, false, 0, 0, 101, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{9, 1000, 0, 0, 0, 0, false, 0, 0, 1000, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestItemSignalsJoiner_Disambiguation(t *testing.T) {
+	ch := make(chan extsort.SortType, 20)
+	joiner := itemSignalsJoiner{out: ch}
+	for _, line := range []string{
+		"de.wikipedia,5,70",
+		"de.wikipedia,5,Q1234,812,,,,1",
+		"de.wikipedia,6,Q72,3142",
+	} {
+		if err := joiner.Process(line); err != nil {
+			t.Error(err)
+		}
+	}
+	joiner.Close()
+	got := make([]ItemSignals, 0, 20)
+	for s := range ch {
+		got = append(got, s.(ItemSignals))
+	}
+	want := []ItemSignals{
+		ItemSignals{1234, 70, 812, 0, 0, 0, true, 0, 0, 70, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{72, 0, 3142, 0, 0, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if err := joiner.Process("de.wikipedia,7,Q5,1,,,,x"); err == nil {
+		t.Error("expected error for bad disambiguation column")
+	}
+}
+
+func TestItemSignalsJoiner_Enterprise(t *testing.T) {
+	ch := make(chan extsort.SortType, 20)
+	joiner := itemSignalsJoiner{out: ch}
+	for _, line := range []string{
+		"de.wikipedia,5,Q1234,812,,,,,17,1",
+		"en.wikipedia,8,Q1234,,,,,,5",
+		"rm.wikipedia,3,Q1234,,,,,,,1",
+	} {
+		if err := joiner.Process(line); err != nil {
+			t.Error(err)
+		}
+	}
+	joiner.Close()
+	got := make([]ItemSignals, 0, 20)
+	for s := range ch {
+		got = append(got, s.(ItemSignals))
+	}
+	want := []ItemSignals{
+		ItemSignals{1234, 0, 812, 0, 0, 0, false, 17, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{1234, 0, 0, 0, 0, 0, false, 5, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+		ItemSignals{1234, 0, 0, 0, 0, 0, false, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{
+		"de.wikipedia,7,Q5,1,,,,,x",
+		"de.wikipedia,7,Q5,1,,,,,,2",
+	} {
+		if err := joiner.Process(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestItemSignalsJoiner_QualitySignals(t *testing.T) {
+	ch := make(chan extsort.SortType, 20)
+	joiner := itemSignalsJoiner{out: ch}
+	for _, line := range []string{
+		"de.wikipedia,5,Q1234,812,,,,,17,1,31,45",
+		"en.wikipedia,8,Q1234,,,,,,,,,9",
+	} {
+		if err := joiner.Process(line); err != nil {
+			t.Error(err)
+		}
+	}
+	joiner.Close()
+	got := make([]ItemSignals, 0, 20)
+	for s := range ch {
+		got = append(got, s.(ItemSignals))
+	}
+	want := []ItemSignals{
+		ItemSignals{1234, 0, 812, 0, 0, 0, false, 17, 1, 0, 0, 0, 0, 0, 0, 31, 45, 0, nil},
+		ItemSignals{1234, 0, 0, 0, 0, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 9, 0, nil},
 	}
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("got %v, want %v", got, want)
 	}
+
+	for _, bad := range []string{
+		"de.wikipedia,7,Q5,1,,,,,,,x",
+		"de.wikipedia,7,Q5,1,,,,,,,,x",
+	} {
+		if err := joiner.Process(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestItemSignalsJoiner_MaxWeekMultiple(t *testing.T) {
+	ch := make(chan extsort.SortType, 20)
+	weights := ProjectWeights{"de.wikipedia": 0.5}
+	joiner := itemSignalsJoiner{out: ch, weights: weights, maxWeekMultiple: 10, numWeeks: 4}
+	for _, tc := range []struct {
+		week int
+		line string
+	}{
+		{0, "de.wikipedia,5,10"},
+		{2, "de.wikipedia,5,50000"},
+		{0, "de.wikipedia,5,Q1234"},
+		{1, "en.wikipedia,8,70"},
+		{3, "en.wikipedia,8,90"},
+		{0, "en.wikipedia,8,Q1234"},
+		{0, "en.wikipedia,9,Q5"},
+	} {
+		joiner.week = tc.week
+		if err := joiner.Process(tc.line); err != nil {
+			t.Error(err)
+		}
+	}
+	joiner.Close()
+	got := make([]ItemSignals, 0, 20)
+	for s := range ch {
+		got = append(got, s.(ItemSignals))
+	}
+
+	// The joiner only records the weighted views of each page
+	// in each week; capping happens in ItemSignalsWriter.
+	// Pages without any views have no weekly pageviews.
+	want := []ItemSignals{
+		ItemSignals{1234, 25005, 0, 0, 0, 0, false, 0, 0, 25005, 0, 0, 0, 0, 0, 0, 0, 0, []float64{5, 0, 25000, 0}},
+		ItemSignals{1234, 160, 0, 0, 0, 0, false, 0, 0, 160, 0, 0, 0, 0, 0, 0, 0, 0, []float64{0, 70, 0, 90}},
+		ItemSignals{5, 0, 0, 0, 0, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// Histories shorter than three weeks never get capped,
+// so the joiner does not record weekly pageviews for them.
+func TestItemSignalsJoiner_MaxWeekMultiple_ShortHistory(t *testing.T) {
+	ch := make(chan extsort.SortType, 20)
+	joiner := itemSignalsJoiner{out: ch, maxWeekMultiple: 10, numWeeks: 2}
+	for _, line := range []string{"de.wikipedia,5,10", "de.wikipedia,5,50000", "de.wikipedia,5,Q1234"} {
+		if err := joiner.Process(line); err != nil {
+			t.Error(err)
+		}
+	}
+	joiner.Close()
+	got := (<-ch).(ItemSignals)
+	want := ItemSignals{1234, 50010, 0, 0, 0, 0, false, 0, 0, 50010, 0, 0, 0, 0, 0, 0, 0, 0, nil}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCapWeeklyPageviews(t *testing.T) {
+	for _, tc := range []struct {
+		weeks       []float64
+		maxMultiple float64
+		want        float64
+		wantCapped  int64
+	}{
+		{[]float64{}, 10, 0, 0},
+		{[]float64{5, 1000}, 10, 1005, 0},
+		{[]float64{5, 1000, 6}, 10, 71, 1},
+		{[]float64{5, 1000, 6}, 0, 1011, 0},
+		{[]float64{5, 50, 6}, 10, 61, 0},
+		{[]float64{1, 1000, 3, 9}, 2, 1 + 12 + 3 + 9, 1},
+
+		// Weeks without views count for the median,
+		// which is taken to be at least one.
+		{[]float64{0, 0, 5000, 0}, 10, 10, 1},
+		{[]float64{0, 0, 8, 0}, 10, 8, 0},
+		{[]float64{0, 700, 0, 600, 0}, 10, 20, 2},
+	} {
+		got, capped := capWeeklyPageviews(tc.weeks, tc.maxMultiple)
+		if got != tc.want || capped != tc.wantCapped {
+			t.Errorf("capWeeklyPageviews(%v, %g) = %g, %d; want %g, %d",
+				tc.weeks, tc.maxMultiple, got, capped, tc.want, tc.wantCapped)
+		}
+	}
+}
+
+func TestBuildItemSignals_Labels(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	s3.WriteLines([]string{"rm.wikipedia,1,5", "rm.wikipedia,3824,2", "rm.wikipedia,799,7"}, "pageviews/pageviews-2011-W07.zst")
+	s3.WriteLines([]string{"1,Q5296,2500", "3824,Q662541,4973", "799,Q72,3142"}, "page_signals/rmwiki-20111209-page_signals.zst")
+	rmDumped, _ := time.Parse(time.DateOnly, "2011-12-09")
+	rmwikiSite := &WikiSite{Key: "rmwiki", Domain: "rm.wikipedia.org", LastDumped: rmDumped}
+	sites := &WikiSites{
+		Sites:   map[string]*WikiSite{"rmwiki": rmwikiSite},
+		Domains: map[string]*WikiSite{"rm.wikipedia.org": rmwikiSite},
+	}
+	pageviews := []string{"pageviews/pageviews-2011-W07.zst"}
+
+	// Without labels in storage, we should fail before doing any work.
+	if _, err := buildItemSignals(ctx, pageviews, sites, BuildOptions{LabelsSize: 2}, s3); err == nil {
+		t.Fatal("expected error when labels are missing")
+	}
+
+	s3.WriteLines([]string{"Q5296,Mawrth Vallis", "Q72,Zurich"}, "labels/wikidatawiki-20111201-labels.zst")
+	if _, err := buildItemSignals(ctx, pageviews, sites, BuildOptions{LabelsSize: 2}, s3); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(s3.data["public/qrank-labels-20111209.csv.gz"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	want := []string{
+		"# version: 2011-12-09",
+		"# commit: " + BuilderCommit(),
+		"# pageviews: 2011-W07..2011-W07",
+		"# provenance: qrank-meta-20111209.json",
+		"Entity,QRank,Label", "Q72,7,Zurich", "Q5296,5,Mawrth Vallis",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
 }
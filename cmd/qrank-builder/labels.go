@@ -0,0 +1,192 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// BuildLabels extracts the English labels of Wikidata items from the
+// truthy dump, and puts them into storage. The output has lines such
+// as "Q72,Zurich", sorted by item. Labels never contain line breaks;
+// labels with commas or double quotes get quoted, see quoteField().
+// The item-signals stage joins the labels with the top-ranked items,
+// see writeLabels().
+func buildLabels(ctx context.Context, dumps string, s3 S3) (string, error) {
+	return buildFromTruthyDump(ctx, dumps, "labels", readLabels, s3)
+}
+
+// ReadLabels reads a Wikidata dump in N-Triples format, and emits
+// lines such as "Q72,Zurich" for the English label of every item.
+func readLabels(ctx context.Context, r io.Reader, out chan<- string) error {
+	scanner := bufio.NewScanner(r)
+	maxLineSize := 1024 * 1024
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		item, label, ok := parseLabelTriple(scanner.Bytes())
+		if !ok {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- item + "," + quoteField(label, ','):
+		}
+	}
+	return scanner.Err()
+}
+
+var truthyLabel = []byte("> <http://www.w3.org/2000/01/rdf-schema#label> \"")
+
+// ParseLabelTriple parses a line of the truthy dump, returning
+// the item and its label if the line is an English rdfs:label.
+// A typical line looks like this:
+//
+//	<http://www.wikidata.org/entity/Q72>
+//	<http://www.w3.org/2000/01/rdf-schema#label> "Zurich"@en .
+func parseLabelTriple(line []byte) (item string, label string, ok bool) {
+	if !bytes.HasPrefix(line, truthyEntityPrefix) {
+		return "", "", false
+	}
+	pos := bytes.Index(line, truthyLabel)
+	if pos < 0 {
+		return "", "", false
+	}
+
+	// The entity prefix ends with "Q", which is part of the item ID.
+	id := line[len(truthyEntityPrefix)-1 : pos]
+	if len(id) < 2 || bytes.IndexFunc(id[1:], isNotDigit) >= 0 {
+		return "", "", false
+	}
+
+	// The literal starts with the quote at the end of truthyLabel.
+	literal := bytes.TrimSpace(line[pos+len(truthyLabel)-1:])
+	literal, found := bytes.CutSuffix(literal, []byte("@en ."))
+	if !found {
+		return "", "", false
+	}
+
+	// N-Triples uses the same escapes as Go for quotes,
+	// backslashes, control characters, and \uXXXX.
+	s, err := strconv.Unquote(string(literal))
+	if err != nil {
+		return "", "", false
+	}
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", "", false
+	}
+
+	return string(id), s, true
+}
+
+// FindLabels returns the storage path of the most recent labels file.
+func findLabels(ctx context.Context, s3 S3) (string, error) {
+	stored, err := ListStoredFiles(ctx, "labels", s3)
+	if err != nil {
+		return "", err
+	}
+	versions := stored["wikidatawiki"]
+	if len(versions) == 0 {
+		return "", fmt.Errorf("no item labels in storage; run the labels stage first")
+	}
+	return sitePath("labels", "wikidatawiki", versions[len(versions)-1]), nil
+}
+
+// LabelsPath returns the storage path of the labels for the
+// top-ranked items, such as public/qrank-labels-20240428.csv.gz.
+func labelsPath(version time.Time) string {
+	return PublicPath("qrank-labels", version, "csv.gz")
+}
+
+// WriteLabels joins the top-ranked items with their English labels
+// from labelsFile, and puts the result into storage as a gzipped CSV
+// file with the columns Entity, QRank and Label, sorted by decreasing
+// rank. Items without an English label get an empty label. The file
+// is meant for humans who want to eyeball the ranking; it is much
+// smaller than the main QRank file, and it is compressed with gzip
+// so it can be opened with common tools. The comments, such as
+// a summary of the provenance, go before the CSV header.
+func writeLabels(ctx context.Context, top []ClassRank, labelsFile string, version time.Time, comments []string, s3 S3) error {
+	reader, err := NewS3ReaderWithOptions(ctx, "qrank", labelsFile, s3, S3ReaderOptions{Compression: ZstdCompressed})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	labels := make(map[int64]string, len(top))
+	for _, t := range top {
+		labels[t.Item] = ""
+	}
+	scanner := NewLineScanner(reader)
+	for scanner.Scan() {
+		itemStr, label, _ := strings.Cut(scanner.Text(), ",")
+		item := int64(ParseItem(itemStr))
+		if _, wanted := labels[item]; wanted {
+			labels[item] = unquoteField(label)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	outFile, err := os.CreateTemp("", "qrank-labels-*.csv.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(outFile.Name())
+	defer outFile.Close()
+
+	gz, err := gzip.NewWriterLevel(outFile, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if err := writeCSVComments(gz, comments); err != nil {
+		return err
+	}
+	w := csv.NewWriter(gz)
+	if err := w.Write([]string{"Entity", "QRank", "Label"}); err != nil {
+		return err
+	}
+	for _, t := range top {
+		row := []string{fmt.Sprintf("Q%d", t.Item), strconv.FormatInt(t.Rank, 10), labels[t.Item]}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := outFile.Close(); err != nil {
+		return err
+	}
+
+	dest := labelsPath(version)
+	if err := PutInStorage(ctx, outFile.Name(), s3, "qrank", dest, "application/gzip"); err != nil {
+		return err
+	}
+	logger.Printf("published labels of %d top-ranked items to %s", len(top), dest)
+	return nil
+}
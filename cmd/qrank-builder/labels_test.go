@@ -0,0 +1,118 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildLabels(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	dumps := filepath.Join("testdata", "dumps")
+	s3 := NewFakeS3()
+
+	path, err := buildLabels(ctx, dumps, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "labels/wikidatawiki-20240401-labels.zst"; path != want {
+		t.Errorf("got %q, want %q", path, want)
+	}
+
+	got, err := s3.ReadLines(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`Q5296,"Mawrth ""Vallis"", Mars"`, "Q72,Zurich"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	found, err := findLabels(ctx, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != path {
+		t.Errorf("findLabels() returned %q, want %q", found, path)
+	}
+}
+
+func TestFindLabels_Missing(t *testing.T) {
+	if _, err := findLabels(context.Background(), NewFakeS3()); err == nil {
+		t.Error("expected error when no labels are in storage")
+	}
+}
+
+func TestParseLabelTriple(t *testing.T) {
+	const prefix = `<http://www.wikidata.org/entity/`
+	const label = `> <http://www.w3.org/2000/01/rdf-schema#label> `
+	for _, tc := range []struct {
+		line  string
+		item  string
+		label string
+		ok    bool
+	}{
+		{prefix + "Q72" + label + `"Zurich"@en .`, "Q72", "Zurich", true},
+		{prefix + "Q72" + label + `"Zürich"@en .`, "Q72", "Zürich", true},
+		{prefix + "Q1" + label + `"a \"b\"\tc"@en .`, "Q1", `a "b" c`, true},
+		{prefix + "Q72" + label + `"Zürich"@de .`, "", "", false},
+		{prefix + "Q72" + label + `"Zurich"@en-gb .`, "", "", false},
+		{prefix + "Q72" + label + `""@en .`, "", "", false},
+		{prefix + "P31" + label + `"instance of"@en .`, "", "", false},
+		{prefix + "Q72> <http://schema.org/name> \"Zurich\"@en .", "", "", false},
+		{"", "", "", false},
+	} {
+		item, label, ok := parseLabelTriple([]byte(tc.line))
+		if item != tc.item || label != tc.label || ok != tc.ok {
+			t.Errorf("got (%q, %q, %v) for %q, want (%q, %q, %v)",
+				item, label, ok, tc.line, tc.item, tc.label, tc.ok)
+		}
+	}
+}
+
+func TestWriteLabels(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	labels := "labels/wikidatawiki-20240401-labels.zst"
+	// Labels files from before we quoted fields have unquoted commas.
+	s3.WriteLines([]string{`Q1,"Universe, ""the"""`, "Q5296,Mawrth Vallis, Mars", "Q72,Zurich"}, labels)
+	top := []ClassRank{{Item: 72, Rank: 3000}, {Item: 5296, Rank: 20}, {Item: 7, Rank: 10}, {Item: 1, Rank: 5}}
+	version, _ := time.Parse(time.DateOnly, "2024-04-28")
+	comments := []string{"# version: 2024-04-28"}
+	if err := writeLabels(ctx, top, labels, version, comments, s3); err != nil {
+		t.Fatal(err)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(s3.data["public/qrank-labels-20240428.csv.gz"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	want := []string{
+		"# version: 2024-04-28",
+		"Entity,QRank,Label",
+		"Q72,3000,Zurich",
+		`Q5296,20,"Mawrth Vallis, Mars"`,
+		"Q7,10,",
+		`Q1,5,"Universe, ""the"""`,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
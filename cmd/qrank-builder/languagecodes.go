@@ -0,0 +1,134 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"strings"
+)
+
+//go:embed languagecodes.tsv
+var builtinLanguageCodes string
+
+// LanguageCode tells how to interpret a Wikimedia code, such as "als"
+// in the site key "alswiki" or the domain "als.wikipedia.org".
+type LanguageCode struct {
+	Language string // BCP 47 language tag, such as "gsw"
+	Project  string // replacement for the project, or empty to keep it
+}
+
+// LanguageCodes maps Wikimedia codes to how we interpret them.
+// Codes that are not in the table are valid language tags already.
+type LanguageCodes map[string]LanguageCode
+
+// The table that is used by the pipeline. It gets initialized from
+// the embedded languagecodes.tsv file; command-line flags can add
+// entries or override them, see ReadLanguageCodes().
+var languageCodes = mustParseLanguageCodes(builtinLanguageCodes)
+
+func mustParseLanguageCodes(s string) LanguageCodes {
+	codes, err := ParseLanguageCodes(strings.NewReader(s))
+	if err != nil {
+		panic(err)
+	}
+	return codes
+}
+
+// ParseLanguageCodes parses a table of language codes in the format
+// of languagecodes.tsv. Empty lines and lines starting with # are
+// ignored; other lines have two or three tab-separated columns.
+func ParseLanguageCodes(r io.Reader) (LanguageCodes, error) {
+	codes := make(LanguageCodes, 30)
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cols := strings.Split(line, "\t")
+		if len(cols) < 2 || len(cols) > 3 || cols[0] == "" || cols[1] == "" {
+			return nil, fmt.Errorf("line %d: expected 2 or 3 tab-separated columns, got %q", lineNum, line)
+		}
+		code := canonicalLanguageCode(cols[0])
+		if _, exists := codes[code]; exists {
+			return nil, fmt.Errorf("line %d: duplicate code %q", lineNum, cols[0])
+		}
+		lc := LanguageCode{Language: cols[1]}
+		if len(cols) == 3 {
+			lc.Project = cols[2]
+		}
+		codes[code] = lc
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// ReadLanguageCodes reads a table of language codes from a file,
+// and returns the built-in table with the entries of the file added.
+// Where the file has an entry for a built-in code, the file wins.
+func ReadLanguageCodes(path string) (LanguageCodes, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	overrides, err := ParseLanguageCodes(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	codes := mustParseLanguageCodes(builtinLanguageCodes)
+	maps.Copy(codes, overrides)
+	return codes, nil
+}
+
+// Lookup returns how to interpret a Wikimedia code. Underscores, as in
+// site keys, are treated like hyphens. If the code is not in the table,
+// the result is false.
+func (c LanguageCodes) Lookup(code string) (LanguageCode, bool) {
+	lc, ok := c[canonicalLanguageCode(code)]
+	return lc, ok
+}
+
+// Language returns the BCP 47 language tag for a Wikimedia code,
+// such as "gsw" for "als" or "nan" for "zh_min_nan".
+func (c LanguageCodes) Language(code string) string {
+	if lc, ok := c.Lookup(code); ok {
+		return lc.Language
+	}
+	return canonicalLanguageCode(code)
+}
+
+// Aliases returns the other codes that Wikimedia has used for the
+// same language as a code, including its BCP 47 tag. For example,
+// the aliases of "be-tarask" are "be-tarask" and "be-x-old".
+// Codes for multilingual sites, such as "commons", have no aliases.
+func (c LanguageCodes) Aliases(code string) []string {
+	lc, ok := c.Lookup(code)
+	if ok && lc.Project != "" {
+		return nil
+	}
+
+	lang := c.Language(code)
+	aliases := []string{lang}
+	for other, olc := range c {
+		if olc.Language == lang && olc.Project == "" && other != lang {
+			aliases = append(aliases, other)
+		}
+	}
+	return aliases
+}
+
+func canonicalLanguageCode(code string) string {
+	return strings.ReplaceAll(code, "_", "-")
+}
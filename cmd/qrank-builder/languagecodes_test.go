@@ -0,0 +1,185 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseLanguageCodes(t *testing.T) {
+	input := "# comment\n\nals\tgsw\nzh_yue\tyue\ncommons\tund\tcommons\n"
+	codes, err := ParseLanguageCodes(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		code string
+		want LanguageCode
+		ok   bool
+	}{
+		{"als", LanguageCode{Language: "gsw"}, true},
+		{"zh-yue", LanguageCode{Language: "yue"}, true},
+		{"zh_yue", LanguageCode{Language: "yue"}, true},
+		{"commons", LanguageCode{Language: "und", Project: "commons"}, true},
+		{"en", LanguageCode{}, false},
+	} {
+		got, ok := codes.Lookup(tc.code)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("Lookup(%q): got %v, %v; want %v, %v", tc.code, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestParseLanguageCodes_Errors(t *testing.T) {
+	for _, input := range []string{
+		"als\n",
+		"als\t\n",
+		"\tgsw\n",
+		"commons\tund\tcommons\textra\n",
+		"als\tgsw\nals\tde\n",
+		"zh-yue\tyue\nzh_yue\tyue\n",
+	} {
+		if _, err := ParseLanguageCodes(strings.NewReader(input)); err == nil {
+			t.Errorf("ParseLanguageCodes(%q): expected error", input)
+		}
+	}
+}
+
+func TestBuiltinLanguageCodes(t *testing.T) {
+	for _, tc := range []struct{ code, want string }{
+		{"als", "gsw"},
+		{"be-x-old", "be-tarask"},
+		{"be_x_old", "be-tarask"},
+		{"simple", "en-x-simple"},
+		{"zh-min-nan", "nan"},
+		{"zh_min_nan", "nan"},
+		{"nan", "nan"},
+		{"de", "de"},
+		{"zh_hans", "zh-hans"},
+	} {
+		if got := languageCodes.Language(tc.code); got != tc.want {
+			t.Errorf("Language(%q): got %q, want %q", tc.code, got, tc.want)
+		}
+	}
+
+	aliases := languageCodes.Aliases("be-tarask")
+	slices.Sort(aliases)
+	if want := []string{"be-tarask", "be-x-old"}; !slices.Equal(aliases, want) {
+		t.Errorf("Aliases(\"be-tarask\"): got %q, want %q", aliases, want)
+	}
+	if got := languageCodes.Aliases("commons"); got != nil {
+		t.Errorf("Aliases(\"commons\"): got %q, want nil", got)
+	}
+}
+
+func TestReadLanguageCodes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "codes.tsv")
+	data := "als\tals\nxyz\tund\twikixyz\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	codes, err := ReadLanguageCodes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ code, want string }{
+		{"als", "als"},    // overridden
+		{"zh-yue", "yue"}, // built-in
+		{"xyz", "und"},    // added
+		{"de", "de"},      // not in any table
+	} {
+		if got := codes.Language(tc.code); got != tc.want {
+			t.Errorf("Language(%q): got %q, want %q", tc.code, got, tc.want)
+		}
+	}
+
+	// The global table should stay unchanged.
+	if got := languageCodes.Language("als"); got != "gsw" {
+		t.Errorf("global table was modified, got %q for \"als\"", got)
+	}
+
+	if _, err := ReadLanguageCodes(filepath.Join(t.TempDir(), "missing.tsv")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+// Check that the site key, the domain and the site language of every
+// language edition in the Wikimedia sites table are normalized to the
+// same language. Wikidata links to pages by site key, whereas dumps
+// and pageviews use domains, so any mismatch would split the signals
+// for one language edition in two.
+func TestLanguageCodes_SitesTable(t *testing.T) {
+	path := filepath.Join("testdata", "dumps", "metawiki", "latest", "metawiki-latest-sites.sql.gz")
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gz.Close()
+
+	reader, err := NewSQLReader(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	columns := reader.Columns()
+	keyCol := slices.Index(columns, "site_global_key")
+	groupCol := slices.Index(columns, "site_group")
+	langCol := slices.Index(columns, "site_language")
+	domainCol := slices.Index(columns, "site_domain")
+	numChecked := 0
+	for {
+		row, err := reader.Read()
+		if row == nil {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		group := row[groupCol]
+		suffix := group
+		switch group {
+		case "wikipedia":
+			suffix = "wiki"
+		case "wikibooks", "wikinews", "wikiquote", "wikisource",
+			"wikiversity", "wikivoyage", "wiktionary":
+		default:
+			continue
+		}
+
+		key := row[keyCol]
+		prefix, ok := strings.CutSuffix(key, suffix)
+		if !ok {
+			t.Errorf("site %q: key does not end in %q", key, suffix)
+			continue
+		}
+		domain := decodeDomain(row[domainCol])
+		label, _, _ := strings.Cut(domain, ".")
+
+		fromKey := languageCodes.Language(prefix)
+		fromDomain := languageCodes.Language(label)
+		fromSiteLang := languageCodes.Language(row[langCol])
+		if fromKey != fromDomain || fromKey != fromSiteLang {
+			t.Errorf("site %q: key gives %q, domain %q gives %q, site language %q gives %q",
+				key, fromKey, domain, fromDomain, row[langCol], fromSiteLang)
+		}
+		numChecked += 1
+	}
+
+	if numChecked < 500 {
+		t.Errorf("checked only %d sites, expected at least 500", numChecked)
+	}
+}
@@ -4,17 +4,57 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"container/heap"
+	"errors"
 	"fmt"
+	"io"
 	"strings"
 )
 
+// MaxLineSize is the maximal length of a line that can be processed
+// by scanners created with NewLineScanner. The default limit of
+// bufio.Scanner is 64 KiB, which is too small for some of our inputs,
+// such as the lines in the Wikidata entities dump.
+const MaxLineSize = 8 * 1024 * 1024
+
+// LineCompare compares two lines, returning a negative number if a
+// sorts before b, zero if a and b are equivalent, and a positive number
+// if a sorts after b. The function bytes.Compare is a LineCompare.
+type LineCompare func(a, b []byte) int
+
+// LineMergerOptions controls the behavior of a LineMerger.
+type LineMergerOptions struct {
+	// Compare defines the sort order of the merged inputs. If nil,
+	// lines are compared byte-wise by calling bytes.Compare.
+	Compare LineCompare
+
+	// If CheckOrder is set, the merger verifies that each input is
+	// sorted according to Compare. When it encounters a mis-ordered line,
+	// the merger stops and Err() returns an error that names the input.
+	// This costs an extra copy of each line, so we only do it when
+	// debugging problems such as the one in issue #40.
+	CheckOrder bool
+}
+
+// CheckSortOrder makes every LineMerger verify that its inputs are
+// sorted, as if LineMergerOptions.CheckOrder had been set. It gets
+// set by the -check-order flag, for debugging a build that produces
+// wrong results.
+var checkSortOrder bool
+
 // Merges the lines of a multiple io.Readers whose content is in sorted order.
+//
+// The merger is a k-way merge on top of a binary heap. When several inputs
+// have equivalent lines, they are returned in the order of the input names;
+// if names are equal, too, in the order of the inputs passed to the
+// constructor. Therefore, the merged output is entirely deterministic.
 type LineMerger struct {
-	heap   lineMergerHeap
-	err    error
-	inited bool
+	heap       lineMergerHeap
+	err        error
+	inited     bool
+	checkOrder bool
 }
 
 // LineScanner is implemented by bufio.Scanner and our own pageSignalsScanner.
@@ -25,26 +65,52 @@ type LineScanner interface {
 	Text() string
 }
 
+// NewLineScanner returns a bufio.Scanner that can handle lines up to
+// MaxLineSize bytes. The scanner only allocates a large buffer
+// when it actually encounters a long line.
+func NewLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), MaxLineSize)
+	return scanner
+}
+
 // NewLineMerger creates an iterator that merges multiple sorted files,
 // returning their lines in sort order. The passed names identify the
 // scanners, and are part of the error message in case of failures.
 // Being able to identify the failing input is useful for debugging.
 // https://github.com/brawer/wikidata-qrank/issues/40
 func NewLineMerger(r []LineScanner, names []string) *LineMerger {
+	return NewLineMergerWithOptions(r, names, LineMergerOptions{})
+}
+
+// NewLineMergerWithOptions is like NewLineMerger, but allows callers
+// to supply a custom sort order and to enable order checking.
+func NewLineMergerWithOptions(r []LineScanner, names []string, opts LineMergerOptions) *LineMerger {
 	if len(r) != len(names) {
 		panic(fmt.Sprintf("len(r) must be len(names), got %d vs %d", len(r), len(names)))
 	}
 
-	m := &LineMerger{}
-	m.heap = make(lineMergerHeap, 0, len(r))
+	compare := opts.Compare
+	if compare == nil {
+		compare = bytes.Compare
+	}
+
+	m := &LineMerger{checkOrder: opts.CheckOrder || checkSortOrder}
+	m.heap = lineMergerHeap{
+		items:   make([]*mergee, 0, len(r)),
+		compare: compare,
+	}
 	for i, rr := range r {
-		item := &mergee{scanner: rr, name: names[i]}
+		item := &mergee{scanner: rr, name: names[i], index: i}
 		if item.scanner.Scan() {
-			m.heap = append(m.heap, item)
+			m.heap.items = append(m.heap.items, item)
+			if m.checkOrder {
+				item.last = append(item.last[:0], item.scanner.Bytes()...)
+			}
 		}
 		if err := item.scanner.Err(); err != nil {
 			logger.Printf(`LineMerger: scanner "%s" failed to scan first line, err=%v`, item.name, err)
-			m.err = err
+			m.err = wrapScanError(item.name, err)
 			return m
 		}
 	}
@@ -55,7 +121,7 @@ func (m *LineMerger) Advance() bool {
 	if m.err != nil {
 		return false
 	}
-	if len(m.heap) == 0 {
+	if len(m.heap.items) == 0 {
 		return false
 	}
 	if !m.inited {
@@ -63,19 +129,28 @@ func (m *LineMerger) Advance() bool {
 		m.inited = true
 		return true
 	}
-	item := m.heap[0]
+	item := m.heap.items[0]
 
 	if item.scanner.Scan() {
+		if m.checkOrder {
+			line := item.scanner.Bytes()
+			if m.heap.compare(item.last, line) > 0 {
+				m.err = fmt.Errorf("LineMerger: input %q is not sorted, %q comes after %q", item.name, line, item.last)
+				logger.Println(m.err)
+				return false
+			}
+			item.last = append(item.last[:0], line...)
+		}
 		heap.Fix(&m.heap, 0)
 	} else {
 		heap.Remove(&m.heap, 0)
 	}
 
 	if err := item.scanner.Err(); err != nil {
-		m.err = err
+		m.err = wrapScanError(item.name, err)
 		return false
 	}
-	return len(m.heap) > 0
+	return len(m.heap.items) > 0
 }
 
 func (m *LineMerger) Err() error {
@@ -83,66 +158,75 @@ func (m *LineMerger) Err() error {
 }
 
 func (m *LineMerger) Line() string {
-	n := len(m.heap)
+	n := len(m.heap.items)
 	if n > 0 {
-		return m.heap[0].scanner.Text()
+		return m.heap.items[0].scanner.Text()
 	} else {
 		return ""
 	}
 }
 
 func (m *LineMerger) Name() string {
-	n := len(m.heap)
+	n := len(m.heap.items)
 	if n > 0 {
-		return m.heap[0].name
+		return m.heap.items[0].name
 	} else {
 		return ""
 	}
 }
 
+// WrapScanError annotates bufio.ErrTooLong with the name of the failing input,
+// which otherwise is very hard to find when merging hundreds of files.
+// Other errors are passed through unchanged, so callers can still compare them.
+func wrapScanError(name string, err error) error {
+	if errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("%s: line longer than %d bytes: %w", name, MaxLineSize, err)
+	}
+	return err
+}
+
 type mergee struct {
 	scanner LineScanner
 	name    string
+	index   int
+	last    []byte // previous line, only kept if checking the input order
 }
 
-type lineMergerHeap []*mergee
+type lineMergerHeap struct {
+	items   []*mergee
+	compare LineCompare
+}
 
-func (h lineMergerHeap) Len() int { return len(h) }
+func (h lineMergerHeap) Len() int { return len(h.items) }
 
 func (h lineMergerHeap) Less(i, j int) bool {
-	if c := bytes.Compare(h[i].scanner.Bytes(), h[j].scanner.Bytes()); c < 0 {
-		return true
-	} else if c > 0 {
-		return false
+	a, b := h.items[i], h.items[j]
+	if c := h.compare(a.scanner.Bytes(), b.scanner.Bytes()); c != 0 {
+		return c < 0
 	}
 
 	// Make the processing order deterministic by imposing a total order.
 	// https://github.com/brawer/wikidata-qrank/issues/40#issuecomment-2118675361
-	if c := strings.Compare(h[i].name, h[j].name); c < 0 {
-		return true
-	} else if c > 0 {
-		return false
+	if c := strings.Compare(a.name, b.name); c != 0 {
+		return c < 0
 	}
 
-	// This should never happen in production.
-	msg := fmt.Sprintf("LineMergerHeap.Less() called on equivalent items; i=%d, h[i]=%v, j=%d, h[j]=%v", i, h[i], j, h[j])
-	logger.Println(msg)
-	panic(msg)
+	return a.index < b.index
 }
 
 func (h lineMergerHeap) Swap(i, j int) {
-	h[i], h[j] = h[j], h[i]
+	h.items[i], h.items[j] = h.items[j], h.items[i]
 }
 
 func (h *lineMergerHeap) Push(x interface{}) {
-	*h = append(*h, x.(*mergee))
+	h.items = append(h.items, x.(*mergee))
 }
 
 func (h *lineMergerHeap) Pop() interface{} {
-	old := *h
+	old := h.items
 	n := len(old)
 	item := old[n-1]
 	old[n-1] = nil // avoid memory leak
-	*h = old[0 : n-1]
+	h.items = old[0 : n-1]
 	return item
 }
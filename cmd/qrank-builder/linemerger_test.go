@@ -6,9 +6,13 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
+	"slices"
+	"sort"
 	"strings"
 	"testing"
 )
@@ -81,3 +85,142 @@ func TestLineMerger(t *testing.T) {
 		}
 	}
 }
+
+// TestLineMerger_Random merges thousands of randomly generated inputs,
+// and checks the result against sorting the concatenated inputs.
+func TestLineMerger_Random(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	rnd := rand.New(rand.NewSource(23))
+	alphabet := []string{"", "a", "b", ",", "é", "Q1", "Q10", "Q2", "\xff"}
+	for tc := 0; tc < 3000; tc++ {
+		numInputs := rnd.Intn(8)
+		scanners := make([]LineScanner, 0, numInputs)
+		names := make([]string, 0, numInputs)
+		all := make([]string, 0, 100)
+		for i := 0; i < numInputs; i++ {
+			lines := make([]string, rnd.Intn(12))
+			for j := range lines {
+				var buf strings.Builder
+				for k := rnd.Intn(4); k >= 0; k-- {
+					buf.WriteString(alphabet[rnd.Intn(len(alphabet))])
+				}
+				lines[j] = buf.String()
+			}
+			sort.Strings(lines)
+			all = append(all, lines...)
+			content := strings.Join(lines, "\n")
+			if len(lines) > 0 {
+				content += "\n"
+			}
+			scanners = append(scanners, NewLineScanner(strings.NewReader(content)))
+
+			// Use some duplicate names to exercise tie-breaking.
+			names = append(names, fmt.Sprintf("input-%d", rnd.Intn(3)))
+		}
+		sort.Strings(all)
+
+		opts := LineMergerOptions{CheckOrder: true}
+		merger := NewLineMergerWithOptions(scanners, names, opts)
+		got := make([]string, 0, len(all))
+		lastName := ""
+		for merger.Advance() {
+			line := merger.Line()
+			if n := len(got); n > 0 && got[n-1] == line && merger.Name() < lastName {
+				t.Fatalf("test case %d: equal lines not ordered by input name", tc)
+			}
+			got = append(got, line)
+			lastName = merger.Name()
+		}
+		if err := merger.Err(); err != nil {
+			t.Fatalf("test case %d: %v", tc, err)
+		}
+		if !slices.Equal(got, all) {
+			t.Fatalf("test case %d: got %q, want %q", tc, got, all)
+		}
+	}
+}
+
+func TestLineMerger_CheckOrder(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	scanners := []LineScanner{
+		NewLineScanner(strings.NewReader("a\nc\n")),
+		NewLineScanner(strings.NewReader("b\nd\nc\n")),
+	}
+	names := []string{"good", "bad"}
+	merger := NewLineMergerWithOptions(scanners, names, LineMergerOptions{CheckOrder: true})
+	for merger.Advance() {
+	}
+	err := merger.Err()
+	if err == nil || !strings.Contains(err.Error(), `"bad"`) {
+		t.Errorf("want error naming the unsorted input, got %v", err)
+	}
+}
+
+func TestLineMerger_CheckSortOrder(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	defer func(saved bool) { checkSortOrder = saved }(checkSortOrder)
+	checkSortOrder = true
+	scanners := []LineScanner{
+		NewLineScanner(strings.NewReader("b\na\n")),
+	}
+	merger := NewLineMerger(scanners, []string{"unsorted"})
+	for merger.Advance() {
+	}
+	err := merger.Err()
+	if err == nil || !strings.Contains(err.Error(), `"unsorted"`) {
+		t.Errorf("want error naming the unsorted input, got %v", err)
+	}
+}
+
+func TestLineMerger_Compare(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	scanners := []LineScanner{
+		NewLineScanner(strings.NewReader("c\nb\na\n")),
+		NewLineScanner(strings.NewReader("d\nb\n")),
+	}
+	reverse := func(a, b []byte) int { return bytes.Compare(b, a) }
+	opts := LineMergerOptions{Compare: reverse, CheckOrder: true}
+	merger := NewLineMergerWithOptions(scanners, []string{"x", "y"}, opts)
+	result := make([]string, 0, 5)
+	for merger.Advance() {
+		result = append(result, merger.Name()+merger.Line())
+	}
+	if err := merger.Err(); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(result, "|")
+	want := "yd|xc|xb|yb|xa"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLineMerger_LongLines(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	long := strings.Repeat("x", 200*1024)
+	scanners := []LineScanner{
+		NewLineScanner(strings.NewReader("a\n" + long + "\n")),
+		NewLineScanner(strings.NewReader("b\n")),
+	}
+	merger := NewLineMerger(scanners, []string{"long", "short"})
+	n := 0
+	for merger.Advance() {
+		n++
+	}
+	if err := merger.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("got %d lines, want 3", n)
+	}
+
+	tooLong := strings.Repeat("y", MaxLineSize+1)
+	scanners = []LineScanner{NewLineScanner(strings.NewReader("a\n" + tooLong + "\n"))}
+	merger = NewLineMerger(scanners, []string{"huge"})
+	for merger.Advance() {
+	}
+	err := merger.Err()
+	if !errors.Is(err, bufio.ErrTooLong) || !strings.Contains(err.Error(), "huge") {
+		t.Errorf("want ErrTooLong naming the input, got %v", err)
+	}
+}
@@ -11,9 +11,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"runtime"
 	"slices"
-	"strings"
 
 	"golang.org/x/sync/errgroup"
 
@@ -30,15 +28,13 @@ func joinLinkTargets(ctx context.Context, site *WikiSite, property string, dumps
 	if err != nil {
 		return err
 	}
-	defer temp.Close()
 	defer os.Remove(temp.Name())
+	defer temp.Close()
 
 	linesChan := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
-	sorter, outChan, errChan := extsort.Strings(linesChan, config)
+	config := newSortConfig(64)
 	group, groupCtx := errgroup.WithContext(ctx)
+	sorter, outChan, errChan := extsort.Strings(sortInput(groupCtx, "link_targets", linesChan, config), config)
 	group.Go(func() error {
 		defer close(linesChan)
 		if err := readLinkTargets(groupCtx, site, "A", dumps, linesChan); err != nil {
@@ -84,8 +80,8 @@ func joinLinkTargets(ctx context.Context, site *WikiSite, property string, dumps
 	if err != nil {
 		return err
 	}
-	defer sortedFile.Close()
 	defer os.Remove(sortedFile.Name())
+	defer sortedFile.Close()
 
 	decompressor, err := zstd.NewReader(sortedFile)
 	if err != nil {
@@ -108,7 +104,7 @@ func readLinkTargets(ctx context.Context, site *WikiSite, property string, dumps
 	ymd := site.LastDumped.Format("20060102")
 	filename := fmt.Sprintf("%s-%s-linktarget.sql.gz", site.Key, ymd)
 	path := filepath.Join(dumps, site.Key, ymd, filename)
-	file, err := os.Open(path)
+	file, err := openDump(ctx, path)
 	if err != nil {
 		return err
 	}
@@ -156,7 +152,9 @@ func readLinkTargets(ctx context.Context, site *WikiSite, property string, dumps
 			}
 		}
 
-		out <- fmt.Sprintf("%s\t%s\t%s%s", id, property, nsPrefix, title)
+		if line, ok := formatRecord('\t', id, property, nsPrefix+title); ok {
+			out <- line
+		}
 	}
 }
 
@@ -164,7 +162,7 @@ func readLinkTargetsFromPageLinks(ctx context.Context, site *WikiSite, property
 	ymd := site.LastDumped.Format("20060102")
 	filename := fmt.Sprintf("%s-%s-pagelinks.sql.gz", site.Key, ymd)
 	path := filepath.Join(dumps, site.Key, ymd, filename)
-	file, err := os.Open(path)
+	file, err := openDump(ctx, path)
 	if err != nil {
 		return err
 	}
@@ -221,7 +219,7 @@ func NewLinkTargetJoiner(property string, w io.Writer) *LinkTargetJoiner {
 }
 
 func (j *LinkTargetJoiner) Process(line string) error {
-	cols := strings.Split(line, "\t")
+	cols := splitRecord(line, '\t')
 	linktarget := cols[0]
 	stream := cols[1]
 	if stream == "A" {
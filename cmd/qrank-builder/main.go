@@ -5,29 +5,97 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/httpclient"
+	"github.com/brawer/wikidata-qrank/v2/internal/objstore"
+	"github.com/brawer/wikidata-qrank/v2/internal/profiling"
+	"github.com/brawer/wikidata-qrank/v2/pkg/qrank"
 )
 
 var logger *log.Logger
 
 func main() {
 	ctx := context.Background()
+	startTime := time.Now()
+
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [flags] [command]\n\n", os.Args[0])
+		fmt.Fprintf(out, "Commands:\n")
+		fmt.Fprintf(out, "  all\tRun all stages of the pipeline (default)\n")
+		for _, stage := range BuildStages {
+			fmt.Fprintf(out, "  %s\n", stage)
+		}
+		fmt.Fprintf(out, "  migrate-storage\tMove files in storage from legacy layouts to the current one\n")
+		fmt.Fprintf(out, "  train-dictionaries\tTrain zstd dictionaries for small per-site files\n")
+		fmt.Fprintf(out, "\nFlags:\n")
+		flag.PrintDefaults()
+	}
 
 	var dumps = flag.String("dumps", "/public/dumps/public", "path to Wikimedia dumps")
-	var testRun = flag.Bool("testRun", false, "if true, we process only a small fraction of the data; used for testing")
-	storagekey := flag.String("", "", "path to key with storage access credentials")
+	dumpDate := flag.String("dump-date", "", "date of the dump run to build from, such as 20240601, instead of whatever the latest symlinks point to; pageviews after this date get ignored")
+	testRun := flag.Bool("testRun", false, "if true, we process only the latest week of pageviews, and only a sample of wikis and items; used for testing")
+	testSites := flag.String("test-sites", strings.Join(defaultTestSites, ","), "comma-separated list of wikis that get processed in a -testRun; wikidatawiki is always included")
+	testItemRate := flag.Int64("test-item-rate", 100, "in a -testRun, keep one in this many items; 1 for keeping all items of the sampled wikis")
+	storagekey := flag.String("storage-key", "", "path to key with storage access credentials")
+	strict := flag.Bool("strict", false, "if true, do not publish releases with anomalies, such as a large drop in pageviews")
+	weightsPath := flag.String("weights", "", "path to JSON file with per-project pageview weights, such as {\"wikidata\": 0.1}")
+	disambiguation := flag.String("disambiguation", "keep", "how to rank items with disambiguation pages: keep, demote, or exclude")
+	schema := flag.Int("item-signals-schema", qrank.CurrentItemSignalsSchema, "schema version of the item_signals output, which determines its columns")
+	zstdDicts := flag.Bool("zstd-dicts", false, "if true, compress small per-site files with the zstd dictionaries in storage")
+	profile := flag.String("profile", "default", "resource profile: default for servers, or low-mem for machines with about 4 GB of RAM such as a Raspberry Pi, which sorts in small chunks, builds one site at a time, streams from storage, and skips optional signals")
+	maxIOReaders := flag.Int("max-io-readers", 0, "maximum number of concurrent reads from the dumps, to avoid saturating NFS; 0 for no limit")
+	maxRuntime := flag.Duration("max-runtime", 0, "stop starting new work after this time, such as 20h, and exit cleanly so the next run can continue; 0 for no limit")
+	languageCodesPath := flag.String("language-codes", "", "path to TSV file with language codes to add to, or override, the built-in languagecodes.tsv; empty for only the built-in table")
+	enterpriseDumps := flag.String("enterprise-dumps", "", "path to Wikimedia Enterprise HTML dumps, such as /public/dumps/public/other/enterprise_html/runs; empty for not using them")
+	qualitySignals := flag.Bool("quality-signals", false, "if true, count external links and templates of each page in the externallinks and templatelinks dumps, for item signals schema 7")
+	minPageviews := flag.Int64("min-pageviews", 0, "leave items with fewer pageviews out of the published item_signals file, and publish the full file as item_signals_full; 0 for publishing all items")
+	maxWeekMultiple := flag.Float64("max-week-multiple", 0, "cap the pageviews of an item in any single week at this multiple of its median week, summed over all its pages, to dampen bot spikes; 0 for no capping")
+	parquetOutput := flag.Bool("parquet", false, "if true, also publish the item signals in Parquet format, partitioned by ranges of item IDs")
+	sqliteOutput := flag.Bool("sqlite", false, "if true, the sqlite stage publishes the item signals as SQLite database qrank-YYYYMMDD.sqlite")
+	classRanks := flag.String("class-ranks", "", "comma-separated list of classes, such as Q5,Q515, for which to publish the top-ranked items; empty for none")
+	classRankSize := flag.Int("class-rank-size", 1000, "number of items in each per-class ranking")
+	labels := flag.Int("labels", 0, "number of top-ranked items for which to publish English labels as qrank-labels-YYYYMMDD.csv.gz; 0 for none")
+	wikiShares := flag.Int("wiki-shares", 0, "number of top-ranked items for which to publish the three wikis with most pageviews as qrank-wiki-shares-YYYYMMDD.csv.gz; 0 for none")
+	signingKeyPath := flag.String("signing-key", "", "path to minisign secret key without password, for signing public files; empty for not signing")
+	incrementalSites := flag.String("incremental-sites", "", "comma-separated list of sites, such as enwiki,wikidatawiki, whose page signals get updated from the daily adds-changes dumps; empty for none")
+	daemon := flag.Bool("daemon", false, "if true, keep running and start a build whenever new dumps or pageviews appear, instead of building once and exiting")
+	daemonInterval := flag.Duration("daemon-interval", time.Hour, "with -daemon, how often to look for new dumps or pageviews")
+	daemonJitter := flag.Duration("daemon-jitter", 10*time.Minute, "with -daemon, maximal random delay added to every -daemon-interval")
+	pageviewsSource := flag.String("pageviews-source", "pageview_complete", "where to read daily pageviews from: pageview_complete for the public dumps, or pageview_actor for an export from the Analytics cluster in -pageviews-dir")
+	monthlyPageviewsHorizon := flag.Int("monthly-pageviews-horizon", 0, "build weeks that lie this many weeks or more in the past from the much smaller monthly pageview dumps, after checking them against a daily dump; 0 for always using the daily dumps")
+	pageviewsDir := flag.String("pageviews-dir", "", "with -pageviews-source=pageview_actor, path to the exported pageviews")
+	excludeStubs := flag.Bool("exclude-stubs", false, "if true, leave out items that only hold external identifiers, without sitelinks, wikitext or pageviews")
+	sitelinksFromDump := flag.Bool("sitelinks-from-dump", false, "if true, count sitelinks in the wb_items_per_site dump instead of using the wb-sitelinks page property, and report discrepancies in the stats")
+	maxQuarantineShare := flag.Float64("max-quarantine-share", 0, "carry on when building per-site files fails for sites with at most this share of pageviews, such as 0.001 for 0.1%; 0, the default, for failing on any site")
+	pprofPort := flag.Int("pprof-port", 0, "if non-zero, serve net/http/pprof endpoints, and Prometheus metrics at /metrics, on this port of localhost, for inspecting a running build")
+	memStatsInterval := flag.Duration("mem-stats-interval", 0, "how often to log memory statistics, such as 10m; 0 for never")
+	checkOrder := flag.Bool("check-order", false, "if true, verify that all inputs to merges are sorted, and fail with an error naming the first mis-sorted input; slower, for debugging")
+	heapDumpRSS := flag.Uint64("heap-dump-rss", 0, "write a heap profile into the logs directory when the resident set size exceeds this many MiB; 0 for never")
 	flag.Parse()
 
+	stages, err := parseCommand(flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	// https://wikitech.wikimedia.org/wiki/Help:Toolforge/Build_Service#Using_NFS_shared_storage
 	if toolDir := os.Getenv("TOOL_DATA_DIR"); toolDir != "" {
 		if err := os.Chdir(toolDir); err != nil {
@@ -36,6 +104,9 @@ func main() {
 	}
 
 	workdir, _ := os.Getwd()
+	if err := os.MkdirAll("logs", 0755); err != nil {
+		log.Fatal(err)
+	}
 	logPath := filepath.Join("logs", "qrank-builder.log")
 	fmt.Printf("logs written to %s in workdir=%s", logPath, workdir)
 	fmt.Fprintf(os.Stderr, "logs written to %s in workdir=%s", logPath, workdir)
@@ -45,9 +116,121 @@ func main() {
 	}
 	defer logfile.Close()
 	logger = log.New(logfile, "", log.Ldate|log.Ltime|log.LUTC|log.Lshortfile)
-	logger.Printf("qrank-builder starting up")
+	logger.Printf("qrank-builder starting up, stages=%v", stages)
+	prometheus.MustRegister(sortCollector{})
+	err = profiling.Start(ctx, profiling.Options{
+		Name:             "qrank-builder",
+		Port:             *pprofPort,
+		Metrics:          promhttp.Handler(),
+		MemStatsInterval: *memStatsInterval,
+		HeapDumpRSS:      *heapDumpRSS << 20,
+		HeapDumpDir:      "logs",
+		Logger:           logger,
+	})
+	if err != nil {
+		logger.Fatal(err)
+	}
 
-	storage, err := NewStorageClient(*storagekey)
+	SetMaxDumpReaders(*maxIOReaders)
+	resources, err = ParseResourceProfile(*profile)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	pinnedDumpDate, err = ParseDumpDate(*dumpDate)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if !pinnedDumpDate.IsZero() && (*daemon || *incrementalSites != "") {
+		logger.Fatal("-dump-date cannot be combined with -daemon or -incremental-sites, which look for new dumps")
+	}
+	if *languageCodesPath != "" {
+		languageCodes, err = ReadLanguageCodes(*languageCodesPath)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+	checkSortOrder = *checkOrder
+	opts := BuildOptions{Strict: *strict, EnterpriseDumps: *enterpriseDumps, QualitySignals: *qualitySignals, ZstdDicts: *zstdDicts}
+	if *maxRuntime > 0 {
+		opts.Deadline = startTime.Add(*maxRuntime)
+	}
+	if _, err := qrank.LookupItemSignalsSchema(*schema); err != nil {
+		logger.Fatal(err)
+	}
+	opts.ItemSignalsSchema = *schema
+	opts.Disambiguation, err = ParseDisambiguationPolicy(*disambiguation)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	opts.ClassRanks, err = ParseClassList(*classRanks)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	opts.ClassRankSize = *classRankSize
+	opts.Parquet = *parquetOutput
+	opts.SQLite = *sqliteOutput
+	if *labels < 0 {
+		logger.Fatal("-labels must not be negative")
+	}
+	opts.LabelsSize = *labels
+	if *wikiShares < 0 {
+		logger.Fatal("-wiki-shares must not be negative")
+	}
+	opts.WikiSharesSize = *wikiShares
+	opts.SitelinksFromDump = *sitelinksFromDump
+	opts.ExcludeStubs = *excludeStubs
+	if *maxQuarantineShare < 0 || *maxQuarantineShare > 1 {
+		logger.Fatal("-max-quarantine-share must be between 0 and 1")
+	}
+	opts.MaxQuarantineShare = *maxQuarantineShare
+	opts.MonthlyPageviewsHorizon = *monthlyPageviewsHorizon
+	opts.PageviewsSource, err = NewPageviewsSource(*pageviewsSource, *dumps, *pageviewsDir)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	opts.IncrementalSites, err = ParseSiteList(*incrementalSites)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if *testRun {
+		sites, err := ParseSiteList(*testSites)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if *testItemRate < 1 {
+			logger.Fatal("-test-item-rate must be at least 1")
+		}
+		opts.Sample = NewBuildSample(sites, *testItemRate)
+	}
+	if *signingKeyPath != "" {
+		opts.SigningKey, err = ReadSigningKey(*signingKeyPath)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if *minPageviews < 0 {
+		logger.Fatal("-min-pageviews must not be negative")
+	}
+	opts.MinPageviews = *minPageviews
+	if *maxWeekMultiple < 0 || (*maxWeekMultiple > 0 && *maxWeekMultiple < 1) {
+		logger.Fatal("-max-week-multiple must be zero, or at least 1")
+	}
+	opts.MaxWeekMultiple = *maxWeekMultiple
+	if *weightsPath != "" {
+		weights, err := ReadProjectWeights(*weightsPath)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		opts.Weights = weights
+		logger.Printf("using project weights %v", weights)
+	}
+	if overridden := resources.limitOptions(&opts); len(overridden) > 0 {
+		logger.Printf("-profile=%s ignores %s", *profile, strings.Join(overridden, " "))
+	}
+
+	// A test run only processes a sample, so its outputs must not
+	// end up among the production files.
+	storage, err := NewStorageClient(*storagekey, opts.Sample.StoragePrefix())
 	if err != nil {
 		logger.Fatal(err)
 	}
@@ -57,53 +240,130 @@ func main() {
 		logger.Fatal(err)
 	}
 	if !bucketExists {
-		logger.Fatal("storage bucket \"qrank\" does not exist")
+		logger.Fatal("configured storage bucket does not exist")
 	}
 
-	if err := computeQRank(*dumps, *testRun, storage); err != nil {
-		logger.Printf("ComputeQRank failed: %v", err)
-		log.Fatal(err)
+	if slices.Equal(stages, []string{"migrate-storage"}) {
+		moved, err := MigrateStorage(ctx, storage)
+		if err != nil {
+			logger.Printf("migration failed: %v", err)
+			log.Fatal(err)
+		}
+		logger.Printf("migrated %d files in storage", moved)
 		return
 	}
 
-	logger.Printf("qrank-builder exiting")
-}
+	if slices.Equal(stages, []string{"train-dictionaries"}) {
+		if _, err := TrainZstdDicts(ctx, time.Now(), storage); err != nil {
+			logger.Printf("training dictionaries failed: %v", err)
+			log.Fatal(err)
+		}
+		return
+	}
 
-// NewStorageClient sets up a client for accessing S3-compatible object storage.
-func NewStorageClient(keypath string) (*minio.Client, error) {
-	var config struct{ Endpoint, Key, Secret string }
+	// In a test run, we only aggregate the most recent week of pageviews,
+	// which is what takes longest when running the pipeline locally.
+	numWeeks := 52
+	if *testRun {
+		numWeeks = 1
+	}
 
-	if keypath == "" {
-		config.Endpoint = os.Getenv("S3_ENDPOINT")
-		config.Key = os.Getenv("S3_KEY")
-		config.Secret = os.Getenv("S3_SECRET")
-	} else {
-		data, err := os.ReadFile(keypath)
-		if err != nil {
-			return nil, err
+	client := httpclient.New(httpclient.Options{Agent: "QRankBuilderBot"})
+	lockPath := filepath.Join(workdir, "qrank-builder.lock")
+	if *daemon {
+		if *daemonInterval <= 0 || *daemonJitter < 0 {
+			logger.Fatal("-daemon-interval must be positive, and -daemon-jitter must not be negative")
+		}
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		build := func(ctx context.Context) error {
+			if *maxRuntime > 0 {
+				opts.Deadline = time.Now().Add(*maxRuntime)
+			}
+			return BuildStage(client, *dumps, numWeeks, storage, opts, stages...)
 		}
-		if err := json.Unmarshal(data, &config); err != nil {
-			return nil, err
+		daemonOpts := DaemonOptions{
+			Interval:         *daemonInterval,
+			Jitter:           *daemonJitter,
+			IncrementalSites: opts.IncrementalSites,
+			LockPath:         lockPath,
+			PageviewsSource:  opts.PageviewsSource,
 		}
+		RunDaemon(ctx, build, *dumps, storage, daemonOpts)
+		logger.Printf("qrank-builder exiting")
+		return
 	}
 
-	client, err := minio.New(config.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(config.Key, config.Secret, ""),
-		Secure: true,
-	})
+	lock, err := acquireRunLock(lockPath)
+	if errors.Is(err, ErrBuildRunning) {
+		logger.Printf("qrank-builder exiting because %v", err)
+		return
+	} else if err != nil {
+		logger.Print(err)
+		log.Fatal(err)
+	}
+	err = BuildStage(client, *dumps, numWeeks, storage, opts, stages...)
+	lock.Release()
+	if errors.Is(err, ErrMaxRuntime) {
+		logger.Printf("qrank-builder stopping after -max-runtime=%v; the next run continues from here", *maxRuntime)
+		return
+	}
 	if err != nil {
-		return nil, err
+		logger.Printf("Build failed: %v", err)
+		log.Fatal(err)
+		return
 	}
 
-	client.SetAppInfo("QRankBuilder", "0.1")
-	return client, nil
+	logger.Printf("qrank-builder exiting")
 }
 
-func computeQRank(dumpsPath string, testRun bool, storage *minio.Client) error {
-	return Build(&http.Client{}, dumpsPath /*numWeeks*/, 52, storage)
+// ParseCommand returns the pipeline stages to run for the command-line
+// arguments that remain after parsing flags. Without any arguments,
+// or with the command "all", we run the entire pipeline. The commands
+// "migrate-storage" and "train-dictionaries" are not stages; they are
+// returned as-is. The preview stage only runs when asked for.
+func parseCommand(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return BuildStages, nil
+	}
+	if len(args) > 1 {
+		return nil, fmt.Errorf("expected one command, got %q", args)
+	}
+	if args[0] == "all" {
+		return BuildStages, nil
+	}
+	if args[0] == "migrate-storage" || args[0] == "train-dictionaries" {
+		return args, nil
+	}
+	if slices.Contains(BuildStages, args[0]) || args[0] == PreviewStage {
+		return args, nil
+	}
+	return nil, fmt.Errorf("unknown command %q", args[0])
+}
 
-	// TODO: Old code starts here, remove after new implementation is done.
+// NewStorageClient sets up a client for accessing S3-compatible object
+// storage. See package objstore for the format of the key file, which
+// can route public outputs and internal artifacts to different buckets.
+// If prefix is not empty, all objects get stored under that prefix;
+// see objstore.Config.Prefix.
+func NewStorageClient(keypath string, prefix string) (*objstore.Router, error) {
+	config, err := objstore.ReadConfig(keypath)
+	if err != nil {
+		return nil, err
+	}
+	config.Prefix = prefix
+	router, err := objstore.NewRouter(config, "QRankBuilder")
+	if err != nil {
+		return nil, err
+	}
+	router.SetLogger(logger)
+	return router, nil
+}
 
+// ComputeQRank runs the old pipeline, which was based on the Wikidata
+// entities dump. It is not called anymore.
+// TODO: Old code, remove after new implementation is done.
+func computeQRank(dumpsPath string, testRun bool, storage *objstore.Router) error {
 	ctx := context.Background()
 	outDir := "cache"
 	if testRun {
@@ -158,7 +418,7 @@ func computeQRank(dumpsPath string, testRun bool, storage *minio.Client) error {
 }
 
 // Upload puts the final output files into an S3-compatible object storage.
-func upload(date time.Time, qrank, stats string, storage *minio.Client) error {
+func upload(date time.Time, qrank, stats string, storage *objstore.Router) error {
 	ymd := date.Format("20060102")
 	qrankDest := fmt.Sprintf("public/qrank-%s.csv.gz", ymd)
 	if err := uploadFile(qrankDest, qrank, "text/csv", storage); err != nil {
@@ -174,7 +434,7 @@ func upload(date time.Time, qrank, stats string, storage *minio.Client) error {
 }
 
 // UploadFile puts one single file into an S3-compatible object storage.
-func uploadFile(dest, src, contentType string, storage *minio.Client) error {
+func uploadFile(dest, src, contentType string, storage *objstore.Router) error {
 	ctx := context.Background()
 	bucket := "qrank"
 
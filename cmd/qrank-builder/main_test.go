@@ -0,0 +1,39 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{}, BuildStages},
+		{[]string{"all"}, BuildStages},
+		{[]string{"titles"}, []string{"titles"}},
+		{[]string{"item-signals"}, []string{"item-signals"}},
+		{[]string{"migrate-storage"}, []string{"migrate-storage"}},
+		{[]string{"train-dictionaries"}, []string{"train-dictionaries"}},
+		{[]string{"foo"}, nil},
+		{[]string{"titles", "pageviews"}, nil},
+	} {
+		got, err := parseCommand(tc.args)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("parseCommand(%q) should fail, got %q", tc.args, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCommand(%q) failed: %v", tc.args, err)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("parseCommand(%q) = %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/lanrat/extsort"
+	"github.com/minio/minio-go/v7"
+)
+
+// BuildMergedItems finds the Wikidata items that have been merged
+// into another item, and puts the result into storage. The output has
+// lines such as "Q123,Q72", telling that Q123 has been merged into Q72.
+//
+// When two items about the same topic get merged, Wikidata turns one
+// of them into a redirect to the other. Redirected items have no signals
+// of their own, so they would vanish from the ranking; but external
+// databases still refer to them. We find them in the redirect table of
+// wikidatawiki, whose rows only contain the page ID of the redirect,
+// so we join them with the page table to find the redirected item.
+func buildMergedItems(ctx context.Context, dumps string, sites *WikiSites, s3 S3) (string, error) {
+	site, ok := sites.Sites["wikidatawiki"]
+	if !ok {
+		return "", fmt.Errorf("no dumps for wikidatawiki")
+	}
+
+	ymd := site.LastDumped.Format("20060102")
+	dest := SitePath("merged_items", site.Key, site.LastDumped)
+	stored, err := ListStoredFiles(ctx, "merged_items", s3)
+	if err != nil {
+		return "", err
+	}
+	versions := stored[site.Key]
+	if slices.Contains(versions, ymd) {
+		return dest, nil
+	}
+
+	logger.Printf("building %s", dest)
+	start := time.Now()
+
+	outFile, err := os.CreateTemp("", "merged_items-*.zst")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(outFile.Name())
+	defer outFile.Close()
+
+	writer, err := zstd.NewWriter(outFile, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		return "", err
+	}
+	defer writer.Close()
+
+	numItems := 0
+	ch := make(chan string, 10000)
+	config := newSortConfig(24)
+	g, subCtx := errgroup.WithContext(ctx)
+	sorter, outChan, errChan := extsort.Strings(sortInput(subCtx, "merged_items", ch, config), config)
+	g.Go(func() error {
+		defer close(ch)
+		redirects := filepath.Join(dumps, site.Key, ymd, fmt.Sprintf("%s-%s-redirect.sql.gz", site.Key, ymd))
+		if err := readItemRedirects(subCtx, redirects, ch); err != nil {
+			return err
+		}
+		pages := filepath.Join(dumps, site.Key, ymd, fmt.Sprintf("%s-%s-page.sql.gz", site.Key, ymd))
+		return readRedirectedItemPages(subCtx, pages, ch)
+	})
+	g.Go(func() error {
+		sorter.Sort(subCtx)
+		n, err := joinMergedItems(subCtx, outChan, writer)
+		numItems = n
+		return err
+	})
+	if err := g.Wait(); err != nil {
+		return "", err
+	}
+	if err := <-errChan; err != nil {
+		return "", err
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	if err := outFile.Close(); err != nil {
+		return "", err
+	}
+
+	if err := PutInStorage(ctx, outFile.Name(), s3, "qrank", dest, "application/zstd"); err != nil {
+		return "", err
+	}
+	logger.Printf("built %s with %d merged items in %.1fs",
+		dest, numItems, time.Since(start).Seconds())
+
+	// Clean up old versions, keeping the previous one for readers
+	// that are still working on it.
+	for i := 0; i < len(versions)-1; i++ {
+		path := sitePath("merged_items", site.Key, versions[i])
+		opts := minio.RemoveObjectOptions{}
+		if err := s3.RemoveObject(ctx, "qrank", path, opts); err != nil {
+			return "", err
+		}
+	}
+
+	return dest, nil
+}
+
+// ReadItemRedirects reads a dump of the redirect table of wikidatawiki,
+// and emits lines such as "5296\tA\tQ72" for redirects to items in the
+// main namespace, where 5296 is the page ID of the redirect.
+func readItemRedirects(ctx context.Context, path string, out chan<- string) error {
+	return readSQLDump(ctx, path, func(columns []string) (func(row []string) string, error) {
+		fromCol := slices.Index(columns, "rd_from")
+		namespaceCol := slices.Index(columns, "rd_namespace")
+		titleCol := slices.Index(columns, "rd_title")
+		interwikiCol := slices.Index(columns, "rd_interwiki")
+		if fromCol < 0 || namespaceCol < 0 || titleCol < 0 || interwikiCol < 0 {
+			return nil, fmt.Errorf("missing columns in %s", path)
+		}
+		return func(row []string) string {
+			target := row[titleCol]
+			if row[namespaceCol] != "0" || row[interwikiCol] != "" || !strings.HasPrefix(target, "Q") || ParseItem(target) == NoItem {
+				return ""
+			}
+			return row[fromCol] + "\tA\t" + target
+		}, nil
+	}, out)
+}
+
+// ReadRedirectedItemPages reads a dump of the page table of wikidatawiki,
+// and emits lines such as "5296\tB\tQ123" for redirect pages in the main
+// namespace, where 5296 is the page ID and Q123 the redirected item.
+func readRedirectedItemPages(ctx context.Context, path string, out chan<- string) error {
+	return readSQLDump(ctx, path, func(columns []string) (func(row []string) string, error) {
+		pageCol := slices.Index(columns, "page_id")
+		namespaceCol := slices.Index(columns, "page_namespace")
+		titleCol := slices.Index(columns, "page_title")
+		redirectCol := slices.Index(columns, "page_is_redirect")
+		if pageCol < 0 || namespaceCol < 0 || titleCol < 0 || redirectCol < 0 {
+			return nil, fmt.Errorf("missing columns in %s", path)
+		}
+		return func(row []string) string {
+			title := row[titleCol]
+			if row[namespaceCol] != "0" || row[redirectCol] != "1" || !strings.HasPrefix(title, "Q") || ParseItem(title) == NoItem {
+				return ""
+			}
+			return row[pageCol] + "\tB\t" + title
+		}, nil
+	}, out)
+}
+
+// ReadSQLDump reads a gzip-compressed SQL dump, and emits the lines
+// that get produced by a row formatter. The formatter gets created
+// for the columns of the table; rows for which it returns an empty
+// string are skipped.
+func readSQLDump(ctx context.Context, path string, formatter func(columns []string) (func(row []string) string, error), out chan<- string) error {
+	file, err := openDump(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	reader, err := NewSQLReader(gz)
+	if err != nil {
+		return err
+	}
+
+	format, err := formatter(reader.Columns())
+	if err != nil {
+		return err
+	}
+
+	for {
+		row, err := reader.Read()
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			return nil
+		}
+		line := format(row)
+		if line == "" {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- line:
+		}
+	}
+}
+
+// JoinMergedItems joins the sorted output of readItemRedirects() and
+// readRedirectedItemPages() by page ID, and writes a line such as
+// "Q123,Q72" for each merged item. The result is the number of
+// written lines.
+func joinMergedItems(ctx context.Context, lines <-chan string, w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	sample := buildSampleFrom(ctx)
+	page, target := "", ""
+	numItems := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return numItems, ctx.Err()
+
+		case line, more := <-lines:
+			if !more {
+				return numItems, bw.Flush()
+			}
+			cols := strings.SplitN(line, "\t", 3)
+			if len(cols) != 3 {
+				return numItems, fmt.Errorf(`bad line: "%s"`, line)
+			}
+			switch cols[1] {
+			case "A":
+				page, target = cols[0], cols[2]
+			case "B":
+				// A merged item gets the signals of its target,
+				// so it belongs to the sample of its target.
+				if cols[0] == page && cols[2] != target && sample.KeepItemID(target) {
+					numItems += 1
+					if _, err := fmt.Fprintf(bw, "%s,%s\n", cols[2], target); err != nil {
+						return numItems, err
+					}
+				}
+			}
+		}
+	}
+}
+
+// FindMergedItems returns the storage path of the most recent
+// merged_items file.
+func findMergedItems(ctx context.Context, s3 S3) (string, error) {
+	stored, err := ListStoredFiles(ctx, "merged_items", s3)
+	if err != nil {
+		return "", err
+	}
+	versions := stored["wikidatawiki"]
+	if len(versions) == 0 {
+		return "", fmt.Errorf("no merged items in storage; run the merged-items stage first")
+	}
+	return sitePath("merged_items", "wikidatawiki", versions[len(versions)-1]), nil
+}
+
+// SendMergedItems reads a merged_items file with lines such as
+// "Q123,Q72", and emits ItemSignals for the target item that only
+// carry the merged item. See ItemSignalsWriter for how they get
+// turned into rows of the output.
+func sendMergedItems(ctx context.Context, r io.Reader, out chan<- extsort.SortType) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		merged, target, ok := parseMergedItemsLine(line)
+		if !ok {
+			return fmt.Errorf(`bad line in merged_items: "%s"`, line)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- ItemSignals{item: target, mergedFrom: merged}:
+		}
+	}
+	return scanner.Err()
+}
+
+// ParseMergedItemsLine parses a line such as "Q123,Q72" into 123 and 72.
+func parseMergedItemsLine(line string) (merged int64, target int64, ok bool) {
+	mergedStr, targetStr, found := strings.Cut(line, ",")
+	if !found || !strings.HasPrefix(mergedStr, "Q") || !strings.HasPrefix(targetStr, "Q") {
+		return 0, 0, false
+	}
+	m, t := ParseItem(mergedStr), ParseItem(targetStr)
+	if m == NoItem || t == NoItem || m == t {
+		return 0, 0, false
+	}
+	return int64(m), int64(t), true
+}
@@ -0,0 +1,135 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lanrat/extsort"
+)
+
+func TestBuildMergedItems(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	dumps := filepath.Join("testdata", "dumps")
+	site := &WikiSite{Key: "wikidatawiki", LastDumped: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)}
+	sites := &WikiSites{Sites: map[string]*WikiSite{"wikidatawiki": site}}
+	s3 := NewFakeS3()
+	s3.data["merged_items/wikidatawiki-20240301-merged_items.zst"] = []byte("old")
+	s3.data["merged_items/wikidatawiki-20240315-merged_items.zst"] = []byte("previous")
+
+	path, err := buildMergedItems(ctx, dumps, sites, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "merged_items/wikidatawiki-20240401-merged_items.zst"; path != want {
+		t.Errorf("got %q, want %q", path, want)
+	}
+
+	// The testdata also has a redirect between two properties,
+	// which should be ignored.
+	got, err := s3.ReadLines(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Q4115189,Q72"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, ok := s3.data["merged_items/wikidatawiki-20240301-merged_items.zst"]; ok {
+		t.Error("old version should have been deleted")
+	}
+	if _, ok := s3.data["merged_items/wikidatawiki-20240315-merged_items.zst"]; !ok {
+		t.Error("previous version should have been kept")
+	}
+
+	found, err := findMergedItems(ctx, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != path {
+		t.Errorf("findMergedItems() returned %q, want %q", found, path)
+	}
+}
+
+func TestFindMergedItems_Missing(t *testing.T) {
+	if _, err := findMergedItems(context.Background(), NewFakeS3()); err == nil {
+		t.Error("expected error when no merged items are in storage")
+	}
+}
+
+func TestJoinMergedItems(t *testing.T) {
+	ch := make(chan string, 10)
+	for _, line := range []string{
+		"12\tA\tQ72",
+		"12\tB\tQ4115189",
+		"123\tB\tQ5", // not a redirect
+		"13\tA\tQ8",  // no page
+		"14\tA\tQ9",
+		"14\tB\tQ9", // redirect to itself
+	} {
+		ch <- line
+	}
+	close(ch)
+	var buf bytes.Buffer
+	n, err := joinMergedItems(context.Background(), ch, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("got %d merged items, want 1", n)
+	}
+	if got, want := buf.String(), "Q4115189,Q72\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSendMergedItems(t *testing.T) {
+	r := strings.NewReader("Q4115189,Q72\nQ13,Q662541\n")
+	ch := make(chan extsort.SortType, 10)
+	if err := sendMergedItems(context.Background(), r, ch); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	var got []ItemSignals
+	for s := range ch {
+		got = append(got, s.(ItemSignals))
+	}
+	want := []ItemSignals{{item: 72, mergedFrom: 4115189}, {item: 662541, mergedFrom: 13}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if err := sendMergedItems(context.Background(), strings.NewReader("Q1,P2\n"), ch); err == nil {
+		t.Error("expected error for bad line")
+	}
+}
+
+func TestParseMergedItemsLine(t *testing.T) {
+	for _, tc := range []struct {
+		line           string
+		merged, target int64
+		ok             bool
+	}{
+		{"Q4115189,Q72", 4115189, 72, true},
+		{"Q72,Q72", 0, 0, false},
+		{"P17,Q72", 0, 0, false},
+		{"Q4115189", 0, 0, false},
+		{"Q0,Q72", 0, 0, false},
+	} {
+		merged, target, ok := parseMergedItemsLine(tc.line)
+		if merged != tc.merged || target != tc.target || ok != tc.ok {
+			t.Errorf("%q: got (%d, %d, %v), want (%d, %d, %v)",
+				tc.line, merged, target, ok, tc.merged, tc.target, tc.ok)
+		}
+	}
+}
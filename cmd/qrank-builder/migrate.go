@@ -0,0 +1,66 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"sort"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// LegacySiteKinds maps the names of per-site files in earlier storage
+// layouts to their current names. The content of the files is the same,
+// only their path has changed.
+var legacySiteKinds = map[string]string{
+	"page_entities": "page_signals",
+}
+
+// MigrateStorage moves per-site files from legacy storage layouts
+// into the current layout, as defined by SitePath(). If a file already
+// exists under its new name, the legacy copy gets deleted without
+// overwriting the new file. Running the migration again is harmless.
+func MigrateStorage(ctx context.Context, s3 S3) (int, error) {
+	keys := make([]string, 0, 1000)
+	existing := make(map[string]bool, 1000)
+	for obj := range s3.ListObjects(ctx, "qrank", minio.ListObjectsOptions{Recursive: true}) {
+		if obj.Err != nil {
+			return 0, obj.Err
+		}
+		keys = append(keys, obj.Key)
+		existing[obj.Key] = true
+	}
+	sort.Strings(keys)
+
+	moved := 0
+	for _, key := range keys {
+		kind, site, ymd, ok := ParseSitePath(key)
+		if !ok {
+			continue
+		}
+		newKind, legacy := legacySiteKinds[kind]
+		if !legacy {
+			continue
+		}
+
+		dest := sitePath(newKind, site, ymd)
+		if !existing[dest] {
+			dst := minio.CopyDestOptions{Bucket: "qrank", Object: dest}
+			src := minio.CopySrcOptions{Bucket: "qrank", Object: key}
+			if _, err := s3.CopyObject(ctx, dst, src); err != nil {
+				return moved, err
+			}
+			existing[dest] = true
+			logger.Printf("copied %s to %s", key, dest)
+		}
+
+		if err := s3.RemoveObject(ctx, "qrank", key, minio.RemoveObjectOptions{}); err != nil {
+			return moved, err
+		}
+		logger.Printf("removed %s", key)
+		moved += 1
+	}
+
+	return moved, nil
+}
@@ -0,0 +1,56 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"slices"
+	"sort"
+	"testing"
+)
+
+func TestMigrateStorage(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	s3 := NewFakeS3()
+	s3.data["page_entities/rmwiki-20240401-page_entities.zst"] = []byte("old")
+	s3.data["page_entities/dewiki-20240501-page_entities.zst"] = []byte("legacy")
+	s3.data["page_signals/dewiki-20240501-page_signals.zst"] = []byte("new")
+	s3.data["page_signals/rmwiki-20240501-page_signals.zst"] = []byte("keep")
+	s3.data["public/item_signals-20240501.csv.zst"] = []byte("keep")
+
+	ctx := context.Background()
+	moved, err := MigrateStorage(ctx, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 2 {
+		t.Errorf("got moved=%d, want 2", moved)
+	}
+
+	got := make([]string, 0, len(s3.data))
+	for key, data := range s3.data {
+		got = append(got, key+"="+string(data))
+	}
+	sort.Strings(got)
+	want := []string{
+		"page_signals/dewiki-20240501-page_signals.zst=new",
+		"page_signals/rmwiki-20240401-page_signals.zst=old",
+		"page_signals/rmwiki-20240501-page_signals.zst=keep",
+		"public/item_signals-20240501.csv.zst=keep",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Running the migration a second time should not change anything.
+	moved, err = MigrateStorage(ctx, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 0 {
+		t.Errorf("second run: got moved=%d, want 0", moved)
+	}
+}
@@ -0,0 +1,387 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/compress"
+)
+
+// For weeks long past, reading seven daily pageview dumps is wasteful.
+// Wikimedia also publishes monthly aggregates of the daily dumps, such
+// as pageview_complete/monthly/2024/2024-03/pageviews-202403-user.bz2,
+// which have one line per page and month instead of one per page and
+// day. Like the hourly counts of the daily dumps, the last column
+// encodes the views of each day, but with letters for the day of
+// the month: "A" for the 1st, continuing in ASCII order past "Z"
+// up to "_" for the 31st. Because this tells the views of every
+// single day, a week gets the same counts as from the daily dumps.
+//
+// Before trusting a monthly dump, we compare its total for one day
+// to the daily dump of that day; see reconcileMonthlyPageviews().
+
+// MaxMonthlyPageviewsDeviation is how much the total views of a day
+// in a monthly dump may differ from its daily dump, as a fraction.
+const maxMonthlyPageviewsDeviation = 0.001
+
+// ErrMonthlyPageviewsMismatch tells that a monthly pageviews dump
+// does not agree with the daily dumps of the same month.
+var errMonthlyPageviewsMismatch = errors.New("monthly pageviews do not match daily pageviews")
+
+// MonthlyPageviewsPaths returns the paths where the monthly pageviews
+// dump of a month may be found, in all formats of pageviewsFormats.
+func monthlyPageviewsPaths(dumps string, year int, month time.Month) []string {
+	dir := filepath.Join(dumps, "other", "pageview_complete", "monthly",
+		fmt.Sprintf("%04d", year), fmt.Sprintf("%04d-%02d", year, month))
+	name := fmt.Sprintf("pageviews-%04d%02d-user", year, month)
+	paths := make([]string, 0, len(pageviewsFormats))
+	for _, format := range pageviewsFormats {
+		paths = append(paths, filepath.Join(dir, name+format))
+	}
+	return paths
+}
+
+// FindMonthlyPageviewsFile returns the path to the monthly pageviews
+// dump of a month. If there is none, the error wraps fs.ErrNotExist.
+func findMonthlyPageviewsFile(dumps string, year int, month time.Month) (string, error) {
+	paths := monthlyPageviewsPaths(dumps, year, month)
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		if err == nil {
+			return path, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no monthly pageviews for %04d-%02d, tried %s: %w",
+		year, month, strings.Join(paths, ", "), fs.ErrNotExist)
+}
+
+// MonthlyPageviews builds weekly pageview files from the monthly dumps.
+// It remembers which monthly dumps have been reconciled with a daily
+// dump, so every month gets checked only once per build.
+type monthlyPageviews struct {
+	dumps      string
+	reconciled map[string]error // "2024-03" → result of reconciliation
+}
+
+// NewMonthlyPageviews returns a builder for weeks from monthly dumps,
+// or nil if source has no monthly dumps. Only the public dumps have
+// them; the exports from the Analytics cluster do not.
+func newMonthlyPageviews(source PageviewsSource) *monthlyPageviews {
+	if pinned, ok := source.(pinnedPageviewsSource); ok {
+		source = pinned.PageviewsSource
+	}
+	if s, ok := source.(PageviewCompleteSource); ok {
+		return &monthlyPageviews{dumps: s.Dumps, reconciled: make(map[string]error, 12)}
+	}
+	return nil
+}
+
+// BuildWeeks aggregates the pageviews of ISO weeks from the monthly
+// dumps, in the same output format as buildWeeklyPageviews(). The keys
+// of weeks are ISO weeks such as "2024-W17", and the values are the
+// paths of their output files. Every monthly dump gets read only once,
+// no matter how many weeks it covers. The result is the weeks that have
+// been built, in sorted order. Weeks whose monthly dumps are missing,
+// or do not match the daily dumps, get left out; callers should build
+// them from the daily dumps.
+func (m *monthlyPageviews) buildWeeks(ctx context.Context, weeks map[string]string, domains PageviewDomains) ([]string, error) {
+	// Which days of which monthly dump go into which week.
+	parts := make(map[string][]monthlyPart, 8)
+	remaining := make(map[string]int, len(weeks)) // week → monthly dumps to read
+	sorted := make([]string, 0, len(weeks))
+	for week := range weeks {
+		sorted = append(sorted, week)
+	}
+	slices.Sort(sorted)
+	for _, weekString := range sorted {
+		year, week, err := ParseISOWeek(weekString)
+		if err != nil {
+			return nil, err
+		}
+		months, err := m.findMonths(ctx, weekDays(year, week))
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errMonthlyPageviewsMismatch) {
+			logger.Printf("building %s from daily dumps: %v", weekString, err)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for path, days := range months {
+			parts[path] = append(parts[path], monthlyPart{week: weekString, days: days})
+		}
+		remaining[weekString] = len(months)
+	}
+	paths := make([]string, 0, len(parts))
+	for path := range parts {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+
+	// Read the monthly dumps in chronological order. A week gets
+	// finished as soon as all its monthly dumps have been read, so
+	// only the weeks around the current month are being sorted.
+	built := make([]string, 0, len(remaining))
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		outs := make(map[string]chan<- string, 6)
+		defer func() {
+			for _, out := range outs {
+				close(out)
+			}
+		}()
+		for _, path := range paths {
+			for i, part := range parts[path] {
+				out, found := outs[part.week]
+				if !found {
+					what := fmt.Sprintf("week %s from monthly dumps", part.week)
+					var err error
+					out, err = startPageviewsWriter(groupCtx, group, what, weeks[part.week])
+					if err != nil {
+						return err
+					}
+					outs[part.week] = out
+				}
+				parts[path][i].out = out
+			}
+			if err := readMonthlyDump(groupCtx, path, parts[path], domains); err != nil {
+				return err
+			}
+			for _, part := range parts[path] {
+				remaining[part.week] -= 1
+				if remaining[part.week] == 0 {
+					close(outs[part.week])
+					delete(outs, part.week)
+					built = append(built, part.week)
+				}
+			}
+		}
+		return nil
+	})
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	slices.Sort(built)
+	return built, nil
+}
+
+// MonthlyPart is the share of a week in a monthly pageviews dump.
+type monthlyPart struct {
+	week string        // eg. "2024-W17"
+	days []int         // days of the month that belong to week
+	out  chan<- string // where to send the views of week
+}
+
+// FindMonths returns the monthly dumps that cover days, together with
+// the days of the month to read from each. Every monthly dump gets
+// reconciled with the daily dump of the first day that it is needed for.
+func (m *monthlyPageviews) findMonths(ctx context.Context, days []time.Time) (map[string][]int, error) {
+	result := make(map[string][]int, 2)
+	for _, day := range days {
+		path, err := findMonthlyPageviewsFile(m.dumps, day.Year(), day.Month())
+		if err != nil {
+			return nil, err
+		}
+		if _, found := result[path]; !found {
+			key := day.Format("2006-01")
+			err, checked := m.reconciled[key]
+			if !checked {
+				var ok bool
+				ok, err = reconcileMonthlyPageviews(ctx, m.dumps, path, day)
+				if err == nil && !ok {
+					reportStepFrom(ctx).addUnreconciled(path)
+				}
+				m.reconciled[key] = err
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		result[path] = append(result[path], day.Day())
+	}
+	return result, nil
+}
+
+// ReconcileMonthlyPageviews compares the total views of a day in a
+// monthly dump to the daily dump of the same day, and tells whether
+// the check was possible. If the daily dump is not available anymore,
+// which is common for periods long past, the monthly dump cannot be
+// checked; it then gets trusted, but the caller should record that
+// it has not been checked.
+func reconcileMonthlyPageviews(ctx context.Context, dumps string, monthly string, day time.Time) (bool, error) {
+	daily, err := FindPageviewsFile(dumps, day)
+	if errors.Is(err, fs.ErrNotExist) {
+		logger.Printf("cannot reconcile %s, no daily pageviews for %s", monthly, day.Format(time.DateOnly))
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	dailyTotal, err := sumPageviews(ctx, daily, 4, func(s string) (int64, error) {
+		return strconv.ParseInt(s, 10, 64)
+	})
+	if err != nil {
+		return false, err
+	}
+	monthlyTotal, err := sumPageviews(ctx, monthly, 5, func(s string) (int64, error) {
+		counts, err := parseDailyCounts(s)
+		return counts[day.Day()], err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	deviation := math.Abs(float64(monthlyTotal-dailyTotal)) / math.Max(float64(dailyTotal), 1)
+	if deviation > maxMonthlyPageviewsDeviation {
+		return true, fmt.Errorf("%s has %d views for %s, but %s has %d: %w",
+			monthly, monthlyTotal, day.Format(time.DateOnly), daily, dailyTotal, errMonthlyPageviewsMismatch)
+	}
+	logger.Printf("reconciled %s with %s, %d views", monthly, daily, dailyTotal)
+	return true, nil
+}
+
+// SumPageviews sums up a column of a pageviews dump over all pages
+// with a page ID, in the same way as readDailyPageviews() skips lines.
+func sumPageviews(ctx context.Context, path string, col int, parse func(string) (int64, error)) (int64, error) {
+	file, err := openDump(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader, err := compress.NewReaderForName(path, file)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	var total int64
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		cols := strings.Split(scanner.Text(), " ")
+		if len(cols) <= col {
+			continue
+		}
+		if id, err := strconv.ParseInt(cols[2], 10, 64); id <= 0 || err != nil {
+			continue
+		}
+		if c, err := parse(cols[col]); c > 0 && err == nil {
+			total += c
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	return total, nil
+}
+
+// ParseDailyCounts decodes the last column of a monthly pageviews dump,
+// such as "A3C12", into the views per day of the month, indexed from 1.
+func parseDailyCounts(s string) ([32]int64, error) {
+	var counts [32]int64
+	for i := 0; i < len(s); {
+		if s[i] < 'A' || s[i] > 'A'+30 {
+			return counts, fmt.Errorf("bad daily counts %q", s)
+		}
+		day := int(s[i]-'A') + 1
+		j := i + 1
+		for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+			j++
+		}
+		c, err := strconv.ParseInt(s[i+1:j], 10, 64)
+		if err != nil {
+			return counts, fmt.Errorf("bad daily counts %q", s)
+		}
+		counts[day] += c
+		i = j
+	}
+	return counts, nil
+}
+
+// ReadMonthlyDump reads the views of weeks from a monthly pageviews
+// dump, sending output as `Wiki,PageID,Count` to the channel of each
+// part, like readDailyPageviews() does for daily dumps.
+func readMonthlyDump(ctx context.Context, path string, parts []monthlyPart, domains PageviewDomains) error {
+	file, err := openDump(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := compress.NewReaderForName(path, file)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	type pending struct {
+		wiki      string
+		id, count int64
+	}
+	last := make([]pending, len(parts))
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		// "de.wikipedia Obergesteln 585473 desktop 12 A2T10"
+		cols := strings.Split(scanner.Text(), " ")
+		if len(cols) < 6 {
+			continue
+		}
+
+		id, err := strconv.ParseInt(cols[2], 10, 64)
+		if id <= 0 || err != nil {
+			continue
+		}
+
+		counts, err := parseDailyCounts(cols[5])
+		if err != nil {
+			continue
+		}
+
+		wiki := domains.Canonical(cols[0])
+		for i, part := range parts {
+			var c int64
+			for _, day := range part.days {
+				c += counts[day]
+			}
+			if c <= 0 {
+				continue
+			}
+
+			p := &last[i]
+			if wiki == p.wiki && id == p.id {
+				p.count += c
+				continue
+			}
+			if err := sendCount(p.wiki, p.id, p.count, ctx, part.out); err != nil {
+				return err
+			}
+			p.wiki, p.id, p.count = wiki, id, c
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for i, part := range parts {
+		p := last[i]
+		if err := sendCount(p.wiki, p.id, p.count, ctx, part.out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dsnet/compress/bzip2"
+)
+
+func TestParseDailyCounts(t *testing.T) {
+	got, err := parseDailyCounts("A3C12_5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want [32]int64
+	want[1], want[3], want[31] = 3, 12, 5
+	if got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, s := range []string{"a1", "`1", "A", "A1B"} {
+		if _, err := parseDailyCounts(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestFindMonthlyPageviewsFile(t *testing.T) {
+	dumps := t.TempDir()
+	writeMonthlyPageviewsForTest(t, dumps, "")
+	got, err := findMonthlyPageviewsFile(dumps, 2023, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(dumps, "other", "pageview_complete", "monthly", "2023", "2023-03", "pageviews-202303-user.gz")
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	_, err = findMonthlyPageviewsFile(dumps, 2023, 4)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestMonthlyPageviews_BuildWeeks(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	dumps := t.TempDir()
+	linkDailyPageviewsForTest(t, dumps)
+	writeMonthlyPageviewsForTest(t, dumps, monthlyPageviewsForTest(t))
+
+	daily := filepath.Join(t.TempDir(), "daily.zst")
+	if err := buildWeeklyPageviews(ctx, PageviewCompleteSource{dumps}, 2023, 12, nil, daily); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both weeks come from the same monthly dump, and W14 has no
+	// monthly dump at all.
+	monthly := newMonthlyPageviews(PageviewCompleteSource{dumps})
+	dir := t.TempDir()
+	weeks := map[string]string{
+		"2023-W11": filepath.Join(dir, "w11.zst"),
+		"2023-W12": filepath.Join(dir, "w12.zst"),
+		"2023-W14": filepath.Join(dir, "w14.zst"),
+	}
+	built, err := monthly.buildWeeks(ctx, weeks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"2023-W11", "2023-W12"}; !slices.Equal(built, want) {
+		t.Errorf("got built weeks %q, want %q", built, want)
+	}
+
+	got, want := readZstdLines(t, weeks["2023-W12"]), readZstdLines(t, daily)
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := readZstdLines(t, weeks["2023-W11"]); len(got) != 0 {
+		t.Errorf("got %q for week without views, want empty", got)
+	}
+}
+
+func TestMonthlyPageviews_Unreconciled(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := withBuildReport(context.Background(), NewBuildReport(time.Now()))
+	ctx, step := startReportStep(ctx, "pageviews")
+	dumps := t.TempDir()
+	writeMonthlyPageviewsForTest(t, dumps, monthlyPageviewsForTest(t))
+
+	// Without daily dumps, the monthly dump cannot be checked.
+	monthly := newMonthlyPageviews(PageviewCompleteSource{dumps})
+	path := filepath.Join(t.TempDir(), "w12.zst")
+	built, err := monthly.buildWeeks(ctx, map[string]string{"2023-W12": path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(built, []string{"2023-W12"}) {
+		t.Errorf("got built weeks %q, want [2023-W12]", built)
+	}
+	want := []string{monthlyPageviewsPaths(dumps, 2023, 3)[1]}
+	if !slices.Equal(step.Unreconciled, want) {
+		t.Errorf("got unreconciled %q, want %q", step.Unreconciled, want)
+	}
+
+	ok, err := reconcileMonthlyPageviews(ctx, dumps, want[0], time.Date(2023, 3, 20, 0, 0, 0, 0, time.UTC))
+	if ok || err != nil {
+		t.Errorf("got (%v, %v), want (false, nil)", ok, err)
+	}
+}
+
+func TestMonthlyPageviews_Mismatch(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	dumps := t.TempDir()
+	linkDailyPageviewsForTest(t, dumps)
+	writeMonthlyPageviewsForTest(t, dumps, "de.wikipedia Obergesteln 585473 desktop 900 T900\n")
+
+	monthly := newMonthlyPageviews(PageviewCompleteSource{dumps})
+	path := filepath.Join(t.TempDir(), "monthly.zst")
+	built, err := monthly.buildWeeks(ctx, map[string]string{"2023-W12": path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(built) != 0 {
+		t.Errorf("got built weeks %q, want none", built)
+	}
+	if err := monthly.reconciled["2023-03"]; !errors.Is(err, errMonthlyPageviewsMismatch) {
+		t.Errorf("got %v, want remembered errMonthlyPageviewsMismatch", err)
+	}
+}
+
+func TestNewMonthlyPageviews(t *testing.T) {
+	if newMonthlyPageviews(PageviewCompleteSource{"dumps"}) == nil {
+		t.Error("pageview_complete dumps should have monthly dumps")
+	}
+	if newMonthlyPageviews(pinnedPageviewsSource{PageviewCompleteSource{"dumps"}, pinnedDumpDate}) == nil {
+		t.Error("pinned pageview_complete dumps should have monthly dumps")
+	}
+	if newMonthlyPageviews(PageviewActorSource{"exports"}) != nil {
+		t.Error("pageview_actor exports do not have monthly dumps")
+	}
+}
+
+func TestBuildPageviews_MonthlyHorizon(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	for _, tc := range []struct {
+		monthly string
+		wantLog string
+	}{
+		{"", "from monthly dumps"},
+		{"de.wikipedia Obergesteln 585473 desktop 900 T900\n", "from daily dumps"},
+	} {
+		var logBuf bytes.Buffer
+		logger = log.New(&logBuf, "", log.Lshortfile)
+		ctx := context.Background()
+		dumps := t.TempDir()
+		linkDailyPageviewsForTest(t, dumps)
+		if tc.monthly == "" {
+			tc.monthly = monthlyPageviewsForTest(t)
+		}
+		writeMonthlyPageviewsForTest(t, dumps, tc.monthly)
+
+		// Make 2023-W13 the latest week, so 2023-W12 is one week back.
+		later := filepath.Join(dumps, "other", "pageview_complete", "2023", "2023-04", "pageviews-20230402-user.bz2")
+		mkdirs(t, filepath.Dir(later))
+		if err := os.WriteFile(later, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		s3 := NewFakeS3()
+		s3.data["pageviews/pageviews-2023-W13.zst"] = []byte("stored")
+		_, err := buildPageviews(ctx, PageviewCompleteSource{dumps} /*numWeeks*/, 2 /*monthlyHorizon*/, 1, nil, s3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, found := s3.data["pageviews/pageviews-2023-W12.zst"]; !found {
+			t.Error("buildPageviews() should upload newly computed 2023-W12 file")
+		}
+		if !strings.Contains(logBuf.String(), tc.wantLog) {
+			t.Errorf("want log to mention %q, got %q", tc.wantLog, logBuf.String())
+		}
+	}
+}
+
+// LinkDailyPageviewsForTest makes the daily pageview dumps in testdata
+// available in another dumps directory.
+func linkDailyPageviewsForTest(t *testing.T, dumps string) {
+	src, err := filepath.Abs(filepath.Join("testdata", "dumps", "other", "pageview_complete", "2023", "2023-03"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(dumps, "other", "pageview_complete", "2023")
+	mkdirs(t, dir)
+	if err := os.Symlink(src, filepath.Join(dir, "2023-03")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// MonthlyPageviewsForTest aggregates the daily pageview dumps in testdata
+// into the format of a monthly dump.
+func monthlyPageviewsForTest(t *testing.T) string {
+	dir := filepath.Join("testdata", "dumps", "other", "pageview_complete", "2023", "2023-03")
+	counts := make(map[string][32]int64)
+	var keys []string
+	for day := 20; day <= 26; day++ {
+		file, err := os.Open(filepath.Join(dir, fmt.Sprintf("pageviews-202303%02d-user.bz2", day)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		reader, err := bzip2.NewReader(file, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			cols := strings.Split(scanner.Text(), " ")
+			key := strings.Join(cols[0:4], " ")
+			var n int64
+			if _, err := fmt.Sscan(cols[4], &n); err != nil {
+				t.Fatal(err)
+			}
+			c, found := counts[key]
+			if !found {
+				keys = append(keys, key)
+			}
+			c[day] += n
+			counts[key] = c
+		}
+		if err := scanner.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	slices.Sort(keys)
+	var buf strings.Builder
+	for _, key := range keys {
+		c := counts[key]
+		var total int64
+		var daily strings.Builder
+		for day := 1; day <= 31; day++ {
+			if c[day] > 0 {
+				total += c[day]
+				fmt.Fprintf(&daily, "%c%d", 'A'+day-1, c[day])
+			}
+		}
+		fmt.Fprintf(&buf, "%s %d %s\n", key, total, daily.String())
+	}
+	return buf.String()
+}
+
+func writeMonthlyPageviewsForTest(t *testing.T, dumps string, content string) {
+	path := monthlyPageviewsPaths(dumps, 2023, 3)[1]
+	mkdirs(t, filepath.Dir(path))
+	if err := os.WriteFile(path, gzipForTest(t, content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -12,7 +12,6 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"runtime"
 	"slices"
 	"strconv"
 	"strings"
@@ -100,7 +99,11 @@ func ReadPageItems(ctx context.Context, path string, out chan<- PageItem) error
 	return nil
 }
 
-func buildPageItems(ctx context.Context, site *WikiSite, dumps string) (string, error) {
+// BuildPageItems writes a temporary file that maps the pages of a site
+// to their Wikidata items. If skipRedirects is set, redirects in the
+// item namespace of Wikidata get left out; these are merged items,
+// which item signals schemas with a merged_into column handle apart.
+func buildPageItems(ctx context.Context, site *WikiSite, dumps string, skipRedirects bool) (string, error) {
 	file, err := os.CreateTemp("", "pageitems-*.zst")
 	if err != nil {
 		return "", err
@@ -113,18 +116,16 @@ func buildPageItems(ctx context.Context, site *WikiSite, dumps string) (string,
 	// contains entries in non-sorted order.  Therefore, we need to re-sort
 	// the page_items ourselves.
 	items := make(chan extsort.SortType, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024
-	config.NumWorkers = runtime.NumCPU()
-	sorter, sortedChan, errChan := extsort.New(items, PageItemFromBytes, PageItemLess, config)
-
+	config := newSortConfig(1)
 	group, groupCtx := errgroup.WithContext(ctx)
+	sorter, sortedChan, errChan := extsort.New(sortInput(groupCtx, "page_items", items, config), PageItemFromBytes, PageItemLess, config)
+
 	group.Go(func() error {
 		defer close(items)
 		if err := readPageItemsFromPageProps(groupCtx, site, dumps, items); err != nil {
 			return err
 		}
-		if err := readPageItemsFromPage(groupCtx, site, dumps, items); err != nil {
+		if err := readPageItemsFromPage(groupCtx, site, dumps, skipRedirects, items); err != nil {
 			return err
 		}
 		return nil
@@ -136,8 +137,12 @@ func buildPageItems(ctx context.Context, site *WikiSite, dumps string) (string,
 		if err != nil {
 			return err
 		}
+		sample := buildSampleFrom(ctx)
 		for s := range sortedChan {
 			pi := s.(PageItem)
+			if !sample.KeepItem(int64(pi.Item)) {
+				continue
+			}
 			var buf bytes.Buffer
 			buf.WriteString(strconv.FormatUint(pi.Page, 10))
 			buf.WriteByte('\t')
@@ -153,6 +158,7 @@ func buildPageItems(ctx context.Context, site *WikiSite, dumps string) (string,
 		return nil
 	})
 	if err := group.Wait(); err != nil {
+		file.Close()
 		os.Remove(file.Name())
 		return "", err
 	}
@@ -170,7 +176,7 @@ func readPageItemsFromPageProps(ctx context.Context, site *WikiSite, dumps strin
 	ymd := site.LastDumped.Format("20060102")
 	propsFileName := fmt.Sprintf("%s-%s-page_props.sql.gz", site.Key, ymd)
 	propsPath := filepath.Join(dumps, site.Key, ymd, propsFileName)
-	propsFile, err := os.Open(propsPath)
+	propsFile, err := openDump(ctx, propsPath)
 	if err != nil {
 		return err
 	}
@@ -222,7 +228,7 @@ func readPageItemsFromPageProps(ctx context.Context, site *WikiSite, dumps strin
 // ReadPageItemsFromPageProps reads a stream of PageItems (which page
 // corresponds to what Wikidata item) from a site’s `page` table.
 // The results are streamed in order of increasing page ID.
-func readPageItemsFromPage(ctx context.Context, site *WikiSite, dumps string, out chan<- extsort.SortType) error {
+func readPageItemsFromPage(ctx context.Context, site *WikiSite, dumps string, skipRedirects bool, out chan<- extsort.SortType) error {
 	// Other than other wiki projects, wikidatawiki.page_props only contains
 	// Wikidata IDs for internal maintenance pages such as templates. To find
 	// the mapping from page-id to wikidata-id for the actually interesting
@@ -237,7 +243,7 @@ func readPageItemsFromPage(ctx context.Context, site *WikiSite, dumps string, ou
 	ymd := site.LastDumped.Format("20060102")
 	fileName := fmt.Sprintf("%s-%s-page.sql.gz", site.Key, ymd)
 	filePath := filepath.Join(dumps, site.Key, ymd, fileName)
-	file, err := os.Open(filePath)
+	file, err := openDump(ctx, filePath)
 	if err != nil {
 		return err
 	}
@@ -258,6 +264,7 @@ func readPageItemsFromPage(ctx context.Context, site *WikiSite, dumps string, ou
 	pageCol := slices.Index(columns, "page_id")
 	namespaceCol := slices.Index(columns, "page_namespace")
 	titleCol := slices.Index(columns, "page_title")
+	redirectCol := slices.Index(columns, "page_is_redirect")
 	for {
 		select {
 		case <-ctx.Done():
@@ -282,6 +289,12 @@ func readPageItemsFromPage(ctx context.Context, site *WikiSite, dumps string, ou
 			continue
 		}
 
+		// Merged items are redirects, which have no signals of their
+		// own; see buildMergedItems().
+		if skipRedirects && redirectCol >= 0 && row[redirectCol] == "1" {
+			continue
+		}
+
 		if item := ParseItem(row[titleCol]); item != NoItem {
 			select {
 			case <-ctx.Done():
@@ -49,7 +49,7 @@ func TestBuildPageItems(t *testing.T) {
 	rmwiki := &WikiSite{Key: "rmwiki", Domain: "rm.wikipedia.org", LastDumped: dumped}
 	dumps := filepath.Join("testdata", "dumps")
 
-	path, err := buildPageItems(ctx, rmwiki, dumps)
+	path, err := buildPageItems(ctx, rmwiki, dumps, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -67,21 +67,27 @@ func TestBuildPageItemsForWikidata(t *testing.T) {
 	site := &WikiSite{Key: "wikidatawiki", Domain: "www.wikidata.org", LastDumped: dumped}
 	dumps := filepath.Join("testdata", "dumps")
 
-	path, err := buildPageItems(ctx, site, dumps)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer os.Remove(path)
-	got := readPageItemsForTesting(path, t)
-	want := []string{
-		"1,Q107661323",
-		"200,Q72",
-		"623646,Q662541",
-		"5411171,Q5649951",
-		"19441465,Q5296",
-	}
-	if !slices.Equal(got, want) {
-		t.Errorf("got %v, want %v", got, want)
+	for _, skipRedirects := range []bool{false, true} {
+		path, err := buildPageItems(ctx, site, dumps, skipRedirects)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(path)
+		got := readPageItemsForTesting(path, t)
+		want := []string{
+			"1,Q107661323",
+			"200,Q72",
+			"623646,Q662541",
+			"5411171,Q5649951",
+			"5411902,Q4115189", // redirect, for a merged item
+			"19441465,Q5296",
+		}
+		if skipRedirects {
+			want = slices.Delete(want, 4, 5)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("skipRedirects=%v: got %v, want %v", skipRedirects, got, want)
+		}
 	}
 }
 
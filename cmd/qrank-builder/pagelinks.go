@@ -4,7 +4,6 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"compress/gzip"
 	"context"
@@ -12,7 +11,6 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"runtime"
 	"slices"
 	"strconv"
 	"strings"
@@ -21,38 +19,141 @@ import (
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/lanrat/extsort"
+	"github.com/minio/minio-go/v7"
 )
 
+// LinkShards tells into how many shards we split the processing of links
+// for very large sites. Each shard only processes the links from pages
+// whose ID modulo the number of shards equals the shard index, and gets
+// kept in storage once it is complete. If a build fails, the next run
+// only needs to redo the shards that have not been completed yet.
+var linkShards = map[string]int{
+	"enwiki":       16,
+	"wikidatawiki": 16,
+}
+
 // BuildLinks builds the `links` file for a WikiSite and puts it in S3 storage.
 // This includes any links between items of the same wiki. Interwiki links
 // are handled elsewhere, see BuildInterwikiLinks().
-func buildLinks(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
+func buildLinks(site *WikiSite, ctx context.Context, dumps string, dicts *ZstdDicts, s3 S3) error {
 	destPath := site.S3Path("links")
-	logger.Printf("building %s", destPath)
+	numShards := max(linkShards[site.Key], 1)
+	if numShards == 1 {
+		logger.Printf("building %s", destPath)
+		links, err := buildLinkShard(ctx, site, linkShard{0, 1}, dumps, dicts, s3)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(links)
+		return PutInStorage(ctx, links, s3, "qrank", destPath, "application/zstd")
+	}
 
-	unsorted, err := os.CreateTemp("", "*-links.zst")
+	logger.Printf("building %s in %d shards", destPath, numShards)
+	shardPaths := make([]string, 0, numShards)
+	completed := make(map[string]bool, numShards)
+	prefix := linkShardPrefix(site.Key, site.LastDumped)
+	for obj := range s3.ListObjects(ctx, "qrank", minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		completed[obj.Key] = true
+	}
+	for i := 0; i < numShards; i++ {
+		shard := linkShard{index: i, count: numShards}
+		shardPath := LinkShardPath(site.Key, site.LastDumped, i, numShards)
+		shardPaths = append(shardPaths, shardPath)
+		if completed[shardPath] {
+			logger.Printf("%s already completed in a previous run", shardPath)
+			continue
+		}
+		links, err := buildLinkShard(ctx, site, shard, dumps, dicts, s3)
+		if err != nil {
+			return fmt.Errorf("shard %d of %d: %w", i, numShards, err)
+		}
+		err = PutInStorage(ctx, links, s3, "qrank", shardPath, "application/zstd")
+		os.Remove(links)
+		if err != nil {
+			return err
+		}
+	}
+
+	links, err := mergeLinkShards(ctx, shardPaths, s3)
 	if err != nil {
 		return err
 	}
+	defer os.Remove(links)
+	if err := PutInStorage(ctx, links, s3, "qrank", destPath, "application/zstd"); err != nil {
+		return err
+	}
+
+	for _, shardPath := range shardPaths {
+		if err := s3.RemoveObject(ctx, "qrank", shardPath, minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LinkShard is a deterministic subset of the pages of a site,
+// namely those whose page ID modulo count equals index.
+type linkShard struct {
+	index int
+	count int
+}
+
+// Contains tells whether a line such as "799\tB\tZürich",
+// which starts with a page ID, belongs to the shard.
+func (s linkShard) Contains(line string) bool {
+	if s.count <= 1 {
+		return true
+	}
+	page, _, _ := strings.Cut(line, "\t")
+	id, err := strconv.ParseInt(page, 10, 64)
+	if err != nil {
+		return false
+	}
+	return id%int64(s.count) == int64(s.index)
+}
+
+// BuildLinkShard builds the links of a site that start from the pages
+// in a shard. The result is the path to a temporary file in the same
+// format as the `links` file, which the caller needs to remove.
+func buildLinkShard(ctx context.Context, site *WikiSite, shard linkShard, dumps string, dicts *ZstdDicts, s3 S3) (string, error) {
+	unsorted, err := os.CreateTemp("", "*-links.zst")
+	if err != nil {
+		return "", err
+	}
 	defer os.Remove(unsorted.Name())
 
+	pageLines := make(chan string, 10000)
 	linesChan := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
-	sorter, outChan, errChan := extsort.Strings(linesChan, config)
-
+	config := newSortConfig(64)
 	group, groupCtx := errgroup.WithContext(ctx)
+	sorter, outChan, errChan := extsort.Strings(sortInput(groupCtx, "links", linesChan, config), config)
+
 	group.Go(func() error {
-		defer close(linesChan)
-		if err := ReadPageItemsOld(groupCtx, site, "A", s3, linesChan); err != nil {
+		defer close(pageLines)
+		if err := ReadPageItemsOld(groupCtx, site, "A", s3, pageLines); err != nil {
 			return err
 		}
-		if err := readPageLinks(groupCtx, site, "B", dumps, linesChan); err != nil {
+		if err := readPageLinks(groupCtx, site, "B", dumps, pageLines); err != nil {
 			return err
 		}
 		return nil
 	})
+	group.Go(func() error {
+		defer close(linesChan)
+		for line := range pageLines {
+			if !shard.Contains(line) {
+				continue
+			}
+			select {
+			case linesChan <- line:
+			case <-groupCtx.Done():
+			}
+		}
+		return groupCtx.Err()
+	})
 	group.Go(func() error {
 		sorter.Sort(groupCtx)
 		joiner := NewPagelinksJoiner(site, unsorted)
@@ -73,36 +174,118 @@ func buildLinks(site *WikiSite, ctx context.Context, dumps string, s3 S3) error
 		}
 	})
 	if err := group.Wait(); err != nil {
-		return err
+		return "", err
 	}
 	if err := <-errChan; err != nil {
-		return err
+		return "", err
 	}
 
 	sorted, err := SortLines(ctx, unsorted.Name())
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer os.Remove(sorted)
 
-	links, err := joinPagelinksByTitle(ctx, site, sorted, s3)
+	return joinPagelinksByTitle(ctx, site, sorted, dicts, s3)
+}
+
+// MergeLinkShards merges the sorted links of several shards, which are
+// in the format of the `links` file. The result is the path to a temporary
+// file with the merged links, which the caller needs to remove.
+func mergeLinkShards(ctx context.Context, paths []string, s3 S3) (string, error) {
+	scanners := make([]LineScanner, 0, len(paths))
+	for _, path := range paths {
+		opts := S3ReaderOptions{Compression: ZstdCompressed}
+		reader, err := NewS3ReaderWithOptions(ctx, "qrank", path, s3, opts)
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+		scanners = append(scanners, NewLineScanner(reader))
+	}
+
+	dest, err := os.CreateTemp("", "links*")
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer os.Remove(links)
+	defer dest.Close()
 
-	if err := PutInStorage(ctx, links, s3, "qrank", destPath, "application/zstd"); err != nil {
-		return err
+	compressor, err := zstd.NewWriter(dest, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		os.Remove(dest.Name())
+		return "", err
 	}
+	defer compressor.Close()
 
-	return nil
+	// The links of different shards can only coincide if two pages
+	// are linked to the same item; we emit them just once.
+	writer := NewLinkWriter(compressor)
+	merger := NewLineMergerWithOptions(scanners, paths, LineMergerOptions{Compare: compareLinkLines})
+	for merger.Advance() {
+		link, ok := parseLinkLine(merger.Line())
+		if !ok {
+			os.Remove(dest.Name())
+			return "", fmt.Errorf("%s: bad line %q", merger.Name(), merger.Line())
+		}
+		if err := writer.Write(link); err != nil {
+			os.Remove(dest.Name())
+			return "", err
+		}
+	}
+	if err := merger.Err(); err != nil {
+		os.Remove(dest.Name())
+		return "", err
+	}
+	if err := writer.Flush(); err != nil {
+		os.Remove(dest.Name())
+		return "", err
+	}
+	if err := compressor.Close(); err != nil {
+		os.Remove(dest.Name())
+		return "", err
+	}
+	return dest.Name(), nil
+}
+
+// ParseLinkLine parses a line of a `links` file, such as "Q72,Q4022".
+func parseLinkLine(line string) (Link, bool) {
+	source, target, found := strings.Cut(line, ",")
+	if !found || !strings.HasPrefix(source, "Q") || !strings.HasPrefix(target, "Q") {
+		return Link{}, false
+	}
+	s, err := strconv.ParseInt(source[1:], 10, 64)
+	if err != nil {
+		return Link{}, false
+	}
+	t, err := strconv.ParseInt(target[1:], 10, 64)
+	if err != nil {
+		return Link{}, false
+	}
+	return Link{Source: s, Target: t}, true
+}
+
+// CompareLinkLines is a LineCompare for the lines of `links` files,
+// which are sorted numerically as per LinkLess.
+func compareLinkLines(a, b []byte) int {
+	aa, aok := parseLinkLine(string(a))
+	bb, bok := parseLinkLine(string(b))
+	if !aok || !bok {
+		return bytes.Compare(a, b)
+	}
+	if LinkLess(aa, bb) {
+		return -1
+	}
+	if LinkLess(bb, aa) {
+		return 1
+	}
+	return 0
 }
 
 func readPageLinks(ctx context.Context, site *WikiSite, property string, dumps string, out chan<- string) error {
 	ymd := site.LastDumped.Format("20060102")
 	pageLinksFileName := fmt.Sprintf("%s-%s-pagelinks.sql.gz", site.Key, ymd)
 	pageLinksPath := filepath.Join(dumps, site.Key, ymd, pageLinksFileName)
-	pageLinksFile, err := os.Open(pageLinksPath)
+	pageLinksFile, err := openDump(ctx, pageLinksPath)
 	if err != nil {
 		return err
 	}
@@ -154,7 +337,9 @@ func readPageLinks(ctx context.Context, site *WikiSite, property string, dumps s
 			}
 		}
 
-		out <- fmt.Sprintf("%s\t%s\t%s%s", fromPage, property, nsPrefix, title)
+		if line, ok := formatRecord('\t', fromPage, property, nsPrefix+title); ok {
+			out <- line
+		}
 	}
 }
 
@@ -174,7 +359,7 @@ func NewPagelinksJoiner(site *WikiSite, w io.WriteCloser) *pagelinksJoiner {
 
 func (j *pagelinksJoiner) Process(line string) error {
 	j.inLines += 1
-	cols := strings.Split(line, "\t")
+	cols := splitRecord(line, '\t')
 	page, err := strconv.ParseInt(cols[0], 10, 64)
 	if err != nil {
 		return err
@@ -207,7 +392,7 @@ func (j *pagelinksJoiner) Close() error {
 	return j.writer.Close()
 }
 
-func joinPagelinksByTitle(ctx context.Context, site *WikiSite, pagelinks string, s3 S3) (string, error) {
+func joinPagelinksByTitle(ctx context.Context, site *WikiSite, pagelinks string, dicts *ZstdDicts, s3 S3) (string, error) {
 	scanners := make([]LineScanner, 0, 3)
 	scannerNames := make([]string, 0, 3)
 	pagelinksFile, err := os.Open(pagelinks)
@@ -219,20 +404,18 @@ func joinPagelinksByTitle(ctx context.Context, site *WikiSite, pagelinks string,
 	if err != nil {
 		return "", err
 	}
-	scanners = append(scanners, bufio.NewScanner(pagelinksDecompressor))
+	scanners = append(scanners, NewLineScanner(pagelinksDecompressor))
 	scannerNames = append(scannerNames, "pagelinks")
 	for _, filename := range []string{"titles", "redirects"} {
 		s3Path := site.S3Path(filename)
-		reader, err := NewS3Reader(ctx, "qrank", s3Path, s3)
+		opts := S3ReaderOptions{Compression: ZstdCompressed, ZstdOptions: dicts.DecoderOptions()}
+		reader, err := NewS3ReaderWithOptions(ctx, "qrank", s3Path, s3, opts)
 		if err != nil {
 			logger.Printf("cannot read %s, err=%v", s3Path, err)
 			return "", err
 		}
-		decompressor, err := zstd.NewReader(reader)
-		if err != nil {
-			return "", err
-		}
-		scanners = append(scanners, bufio.NewScanner(decompressor))
+		defer reader.Close()
+		scanners = append(scanners, NewLineScanner(reader))
 		scannerNames = append(scannerNames, filename)
 	}
 
@@ -252,15 +435,14 @@ func joinPagelinksByTitle(ctx context.Context, site *WikiSite, pagelinks string,
 
 	ch := make(chan extsort.SortType, 50000)
 	group, groupCtx := errgroup.WithContext(ctx)
-	config := extsort.DefaultConfig()
-	config.NumWorkers = runtime.NumCPU()
-	sorter, outChan, errChan := extsort.New(ch, LinkFromBytes, LinkLess, config)
+	config := newSortConfig(8)
+	sorter, outChan, errChan := extsort.New(sortInput(groupCtx, "pagelinks_by_title", ch, config), LinkFromBytes, LinkLess, config)
 	group.Go(func() error {
 		defer close(ch)
 		merger := NewLineMerger(scanners, scannerNames)
 		ptj := pagelinksTitleJoiner{out: ch}
 		for merger.Advance() {
-			cols := strings.Split(merger.Line(), "\t")
+			cols := splitRecord(merger.Line(), '\t')
 			if merger.Name() == "pagelinks" {
 				if err := ptj.ProcessSource(cols[0], cols[1]); err != nil {
 					return err
@@ -294,15 +476,18 @@ func joinPagelinksByTitle(ctx context.Context, site *WikiSite, pagelinks string,
 		}
 	})
 	if err := group.Wait(); err != nil {
+		dest.Close()
 		os.Remove(dest.Name())
 		return "", err
 	}
 	if err := <-errChan; err != nil {
+		dest.Close()
 		os.Remove(dest.Name())
 		return "", err
 	}
 
 	if err := compressor.Close(); err != nil {
+		dest.Close()
 		os.Remove(dest.Name())
 		return "", err
 	}
@@ -56,7 +56,7 @@ func TestBuildLinksFromTitle(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := buildLinks(site, ctx, dumps, s3); err != nil {
+	if err := buildLinks(site, ctx, dumps, nil, s3); err != nil {
 		t.Fatal(err)
 	}
 
@@ -120,7 +120,7 @@ func TestBuildLinksFromLinkTarget(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := buildLinks(site, ctx, dumps, s3); err != nil {
+	if err := buildLinks(site, ctx, dumps, nil, s3); err != nil {
 		t.Fatal(err)
 	}
 
@@ -136,3 +136,118 @@ func TestBuildLinksFromLinkTarget(t *testing.T) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
+
+// Test for building the links of a site in several shards.
+func TestBuildLinks_Sharded(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	client := &http.Client{Transport: &FakeWikiSite{}}
+	dumps := filepath.Join("testdata", "dumps")
+	sites, err := ReadWikiSites(client, dumps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	site := sites.Sites["rmwiki"]
+	linkShards[site.Key] = 3
+	defer delete(linkShards, site.Key)
+
+	s3 := NewFakeS3()
+	err = s3.WriteLines([]string{
+		"1,Q5296,2500",
+		"3824,Q662541,4973",
+		"799,Q72,3142",
+	}, site.S3Path("page_signals"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s3.WriteLines([]string{
+		"Chantun_Turitg\tQ11943",
+		"Flum\tQ4022",
+		"Lai_da_Turitg\tQ14407",
+		"Turitg\tQ72",
+		"Wikipedia:Bainvegni\tQ17596642",
+	}, site.S3Path("titles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s3.WriteLines([]string{"Zürich\tQ72"}, site.S3Path("redirects"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a previous run that failed after completing shard 0,
+	// which should not get built again.
+	shard0 := LinkShardPath(site.Key, site.LastDumped, 0, 3)
+	if err := s3.WriteLines([]string{"Q1,Q2"}, shard0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := buildLinks(site, ctx, dumps, nil, s3); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s3.ReadLines(site.S3Path("links"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Q1,Q2",
+		"Q72,Q4022",
+		"Q72,Q11943",
+		"Q72,Q14407",
+		"Q5296,Q17596642",
+		"Q662541,Q72",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for i := 0; i < 3; i++ {
+		path := LinkShardPath(site.Key, site.LastDumped, i, 3)
+		if _, found := s3.data[path]; found {
+			t.Errorf("%s should have been removed", path)
+		}
+	}
+}
+
+func TestLinkShard(t *testing.T) {
+	shard := linkShard{index: 1, count: 3}
+	for _, tc := range []struct {
+		line string
+		want bool
+	}{
+		{"1\tA\tQ5296", true},
+		{"799\tB\tFlum", true},
+		{"3824\tA\tQ662541", false},
+		{"foo\tB\tFlum", false},
+	} {
+		if got := shard.Contains(tc.line); got != tc.want {
+			t.Errorf("got %v for %q, want %v", got, tc.line, tc.want)
+		}
+	}
+	if !(linkShard{index: 0, count: 1}).Contains("foo") {
+		t.Error("a single shard should contain all lines")
+	}
+}
+
+func TestCompareLinkLines(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"Q72,Q4022", "Q72,Q11943", -1},
+		{"Q5296,Q1", "Q72,Q4022", 1},
+		{"Q72,Q4022", "Q72,Q4022", 0},
+	} {
+		if got := compareLinkLines([]byte(tc.a), []byte(tc.b)); got != tc.want {
+			t.Errorf("got %d for %q vs. %q, want %d", got, tc.a, tc.b, tc.want)
+		}
+	}
+}
@@ -13,7 +13,6 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"slices"
 	"sort"
 	"strconv"
@@ -26,10 +25,24 @@ import (
 )
 
 // BuildPageSignals builds the page_signals file for a WikiSite and puts it in S3 storage.
-func buildPageSignals(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
+// If enterprise is not empty, it is the path to a local mirror of the Wikimedia
+// Enterprise HTML dumps, from where we take additional signals. If quality is true,
+// we also count the external links and templates of each page, see processLinkCounts().
+// If skipRedirects is true, redirects among Wikidata items get left out, because
+// they are merged items, which the item signals then handle separately.
+func buildPageSignals(site *WikiSite, ctx context.Context, dumps string, enterprise string, quality bool, skipRedirects bool, s3 S3) error {
 	destPath := site.S3Path("page_signals")
 	logger.Printf("building %s", destPath)
 
+	var enterpriseDump string
+	if enterprise != "" {
+		path, err := findEnterpriseDump(enterprise, site.Key)
+		if err != nil {
+			return err
+		}
+		enterpriseDump = path
+	}
+
 	outFile, err := os.CreateTemp("", "*-page_signals.zst")
 	if err != nil {
 		return err
@@ -41,25 +54,37 @@ func buildPageSignals(site *WikiSite, ctx context.Context, dumps string, s3 S3)
 	}
 
 	linesChan := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
-	sorter, outChan, errChan := extsort.Strings(linesChan, config)
-
+	config := newSortConfig(64)
 	group, groupCtx := errgroup.WithContext(ctx)
+	sorter, outChan, errChan := extsort.Strings(sortInput(groupCtx, "page_signals", linesChan, config), config)
+
 	group.Go(func() error {
 		defer close(linesChan)
 		if err := processPagePropsTable(groupCtx, dumps, site, linesChan); err != nil {
 			return err
 		}
-		if err := processPageTable(groupCtx, dumps, site, linesChan); err != nil {
+		if err := processPageTable(groupCtx, dumps, site, skipRedirects, linesChan); err != nil {
 			return err
 		}
+		if quality {
+			if err := processLinkCounts(groupCtx, dumps, site, "externallinks", "el_from", 'e', linesChan); err != nil {
+				return err
+			}
+			if err := processLinkCounts(groupCtx, dumps, site, "templatelinks", "tl_from", 't', linesChan); err != nil {
+				return err
+			}
+		}
+		if enterpriseDump != "" {
+			if err := processEnterpriseDump(groupCtx, enterpriseDump, linesChan); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 	group.Go(func() error {
 		sorter.Sort(groupCtx)
 		merger := NewPageSignalMerger(writer)
+		merger.sample = buildSampleFrom(ctx)
 		for {
 			select {
 			case <-groupCtx.Done():
@@ -106,7 +131,7 @@ func processPagePropsTable(ctx context.Context, dumps string, site *WikiSite, ou
 	ymd := site.LastDumped.Format("20060102")
 	propsFileName := fmt.Sprintf("%s-%s-page_props.sql.gz", site.Key, ymd)
 	propsPath := filepath.Join(dumps, site.Key, ymd, propsFileName)
-	propsFile, err := os.Open(propsPath)
+	propsFile, err := openDump(ctx, propsPath)
 	if err != nil {
 		return err
 	}
@@ -154,6 +179,10 @@ func processPagePropsTable(ctx context.Context, dumps string, site *WikiSite, ou
 			out <- fmt.Sprintf("%s,i=%s", page, value)
 		case "wb-sitelinks":
 			out <- fmt.Sprintf("%s,l=%s", page, value)
+		case "disambiguation":
+			// Set by the Disambiguator extension, with an empty value.
+			// https://www.mediawiki.org/wiki/Extension:Disambiguator
+			out <- fmt.Sprintf("%s,d=1", page)
 		}
 	}
 }
@@ -166,12 +195,12 @@ var wikidataTitleRe = regexp.MustCompile(`^Q\d+$`)
 
 // ProcessPageTable processes a dump of the `page` table for a Wikimedia site.
 // Called by function buildSitePageSignals().
-func processPageTable(ctx context.Context, dumps string, site *WikiSite, out chan<- string) error {
+func processPageTable(ctx context.Context, dumps string, site *WikiSite, skipRedirects bool, out chan<- string) error {
 	isWikidata := site.Key == "wikidatawiki"
 	ymd := site.LastDumped.Format("20060102")
 	propsFileName := fmt.Sprintf("%s-%s-page.sql.gz", site.Key, ymd)
 	propsPath := filepath.Join(dumps, site.Key, ymd, propsFileName)
-	propsFile, err := os.Open(propsPath)
+	propsFile, err := openDump(ctx, propsPath)
 	if err != nil {
 		return err
 	}
@@ -194,6 +223,7 @@ func processPageTable(ctx context.Context, dumps string, site *WikiSite, out cha
 	titleCol := slices.Index(columns, "page_title")
 	contentModelCol := slices.Index(columns, "page_content_model")
 	lenCol := slices.Index(columns, "page_len")
+	redirectCol := slices.Index(columns, "page_is_redirect")
 
 	for {
 		select {
@@ -215,7 +245,10 @@ func processPageTable(ctx context.Context, dumps string, site *WikiSite, out cha
 		// the mapping from page-id to wikidata-id for the actually interesting
 		// entities, we need to look at page titles.
 		// https://github.com/brawer/wikidata-qrank/issues/35
-		if isWikidata && row[namespaceCol] == "0" {
+		// Merged items are redirects, which have no signals of their own;
+		// see buildMergedItems().
+		isRedirect := skipRedirects && redirectCol >= 0 && row[redirectCol] == "1"
+		if isWikidata && row[namespaceCol] == "0" && !isRedirect {
 			title := row[titleCol]
 			if wikidataTitleRe.MatchString(title) {
 				out <- fmt.Sprintf("%s,%s", row[pageCol], title)
@@ -230,22 +263,86 @@ func processPageTable(ctx context.Context, dumps string, site *WikiSite, out cha
 	}
 }
 
+// ProcessLinkCounts counts the rows per page in a dump of a links table,
+// such as `externallinks` or `templatelinks`, and emits lines such as
+// "200,e=17". Because the rows are not sorted by page, the counts are
+// kept in memory; that is one entry per page that has any links.
+// Called by function buildSitePageSignals() if quality signals are
+// wanted. Some sites have no dump of the table, which we log and skip.
+//
+// External links are a rough proxy for the number of references,
+// since most citations link to their source. Templates tell how much
+// structure a page has, such as infoboxes, navigation boxes and
+// citation templates.
+func processLinkCounts(ctx context.Context, dumps string, site *WikiSite, table string, fromColumn string, kind byte, out chan<- string) error {
+	ymd := site.LastDumped.Format("20060102")
+	fileName := fmt.Sprintf("%s-%s-%s.sql.gz", site.Key, ymd, table)
+	path := filepath.Join(dumps, site.Key, ymd, fileName)
+	file, err := openDump(ctx, path)
+	if os.IsNotExist(err) {
+		logger.Printf("no %s dump for %s, skipping", table, site.Key)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	reader, err := NewSQLReader(gz)
+	if err != nil {
+		return err
+	}
+
+	fromCol := slices.Index(reader.Columns(), fromColumn)
+	if fromCol < 0 {
+		return fmt.Errorf("%s: missing column %s", path, fromColumn)
+	}
+
+	counts := make(map[string]int64, 10000)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		row, err := reader.Read()
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			break
+		}
+		counts[row[fromCol]] += 1
+	}
+
+	for page, n := range counts {
+		out <- fmt.Sprintf("%s,%c=%d", page, kind, n)
+	}
+	return nil
+}
+
 type pageSignalsScanner struct {
-	err          error
-	paths        []string
-	domains      []string
-	curDomain    int
-	storage      S3
-	reader       io.ReadCloser
-	decompressor *zstd.Decoder
-	scanner      *bufio.Scanner
-	curLine      bytes.Buffer
+	ctx       context.Context
+	err       error
+	paths     []string
+	domains   []string
+	curDomain int
+	storage   S3
+	reader    io.ReadCloser
+	scanner   *bufio.Scanner
+	curLine   bytes.Buffer
 }
 
 // NewPageSignalsScanner returns an object similar to bufio.Scanner
 // that sequentially scans pageid-to-qid mapping files for all WikiSites.
 // Lines are returned in the exact same order and format as pageviews files.
-func NewPageSignalsScanner(sites *WikiSites, s3 S3) *pageSignalsScanner {
+func NewPageSignalsScanner(ctx context.Context, sites *WikiSites, s3 S3) *pageSignalsScanner {
 	sorted := make([]*WikiSite, 0, len(sites.Sites))
 	for _, site := range sites.Sites {
 		sorted = append(sorted, site)
@@ -253,26 +350,29 @@ func NewPageSignalsScanner(sites *WikiSites, s3 S3) *pageSignalsScanner {
 	sort.Slice(sorted, func(i, j int) bool {
 		a := strings.TrimSuffix(sorted[i].Domain, ".org")
 		b := strings.TrimSuffix(sorted[j].Domain, ".org")
-		return a < b
+		if a != b {
+			return a < b
+		}
+		// Break ties by site key, so the order does not depend
+		// on the random iteration order of the sites map.
+		return sorted[i].Key < sorted[j].Key
 	})
 	paths := make([]string, 0, len(sorted))
 	domains := make([]string, 0, len(sorted))
 	for _, site := range sorted {
-		ymd := site.LastDumped.Format("20060102")
-		path := fmt.Sprintf("page_signals/%s-%s-page_signals.zst", site.Key, ymd)
-		paths = append(paths, path)
+		paths = append(paths, site.S3Path("page_signals"))
 		domains = append(domains, strings.TrimSuffix(site.Domain, ".org"))
 	}
 
 	return &pageSignalsScanner{
-		err:          nil,
-		paths:        paths,
-		domains:      domains,
-		curDomain:    -1,
-		storage:      s3,
-		reader:       nil,
-		decompressor: nil,
-		scanner:      nil,
+		ctx:       ctx,
+		err:       nil,
+		paths:     paths,
+		domains:   domains,
+		curDomain: -1,
+		storage:   s3,
+		reader:    nil,
+		scanner:   nil,
 	}
 }
 
@@ -302,35 +402,25 @@ func (s *pageSignalsScanner) Scan() bool {
 			break
 		}
 
-		path := s.paths[s.curDomain]
-		s.reader, s.err = NewS3Reader(context.Background(), "qrank", path, s.storage)
-		if s.err != nil {
-			logger.Printf(`PageSignalsScanner.Scan(): cannot open s3://qrank/%s, err=%v`, path, s.err)
-			break
+		// Close the file of the previous domain, whose temporary
+		// download would otherwise stay on disk until the end.
+		if s.reader != nil {
+			s.reader.Close()
+			s.reader = nil
 		}
 
-		if s.decompressor == nil {
-			s.decompressor, s.err = zstd.NewReader(nil)
-			if s.err != nil {
-				logger.Printf(`failed to create zstd decompressor, err=%v`, s.err)
-				break
-			}
-		}
-		s.err = s.decompressor.Reset(s.reader)
+		path := s.paths[s.curDomain]
+		opts := S3ReaderOptions{Compression: ZstdCompressed}
+		s.reader, s.err = NewS3ReaderWithOptions(s.ctx, "qrank", path, s.storage, opts)
 		if s.err != nil {
-			logger.Printf(`failed to reset zstd decompressor, err=%v`, s.err)
+			logger.Printf(`PageSignalsScanner.Scan(): cannot open s3://qrank/%s, err=%v`, path, s.err)
 			break
 		}
-		s.scanner = bufio.NewScanner(s.decompressor)
+		s.scanner = NewLineScanner(s.reader)
 	}
 
 	logger.Printf("PageSignalsScanner.Scan(): cleaning up")
 
-	if s.decompressor != nil {
-		s.decompressor.Close()
-		s.decompressor = nil
-	}
-
 	if s.reader != nil {
 		s.reader.Close()
 		s.reader = nil
@@ -352,6 +442,18 @@ func (s *pageSignalsScanner) Err() error {
 	return s.err
 }
 
+// Close releases the file of the current domain, in case the caller
+// stops scanning before the end. It is safe to call Close repeatedly.
+func (s *pageSignalsScanner) Close() error {
+	s.scanner = nil
+	if s.reader == nil {
+		return nil
+	}
+	err := s.reader.Close()
+	s.reader = nil
+	return err
+}
+
 // PageSignalMerger aggregates per-page signals from different sources
 // into a single output line. Input and output is keyed by page id.
 type pageSignalMerger struct {
@@ -362,10 +464,54 @@ type pageSignalMerger struct {
 	numClaims      int64
 	numIdentifiers int64
 	numSiteLinks   int64
+	disambiguation bool
+	numOutlinks    int64
+	infobox        bool
+	externalLinks  int64
+	templates      int64
+
+	// Signals that have been seen for the current page, as a bit set
+	// indexed by signalBit(). The same signal can come from more than
+	// one source; for example, wikidatawiki pages have an entity both
+	// in page_props and in the page table. We only count it once.
+	seen uint16
+
+	// If not nil, only pages of items in the sample get written.
+	// For wikidatawiki, which has a page for every item, this keeps
+	// test runs small.
+	sample *BuildSample
 
 	// Stats for logging.
-	inputRecords  int64
-	outputRecords int64
+	inputRecords     int64
+	outputRecords    int64
+	duplicateRecords int64
+}
+
+// SignalBit returns the bit for a signal kind in pageSignalMerger.seen.
+func signalBit(kind byte) uint16 {
+	switch kind {
+	case 'Q':
+		return 1 << 0
+	case 'c':
+		return 1 << 1
+	case 'i':
+		return 1 << 2
+	case 'l':
+		return 1 << 3
+	case 's':
+		return 1 << 4
+	case 'd':
+		return 1 << 5
+	case 'o':
+		return 1 << 6
+	case 'b':
+		return 1 << 7
+	case 'e':
+		return 1 << 8
+	case 't':
+		return 1 << 9
+	}
+	return 0
 }
 
 func NewPageSignalMerger(w io.WriteCloser) *pageSignalMerger {
@@ -374,13 +520,19 @@ func NewPageSignalMerger(w io.WriteCloser) *pageSignalMerger {
 
 // Process handles one line of input.
 // Input must be grouped by page (such as by sorting lines).
-// Recognized line formats:
+// If a signal appears more than once for the same page, only
+// its first occurrence is used. Recognized line formats:
 //
 //	  "200,Q72": wikipage 200 is for Wikidata entity Q72
 //		 "200,c=8": wikipage 200 has 8 claims in wikidatawiki
 //		 "200,i=17": wikipage 200 has 17 identifiers in wikidatawiki
 //		 "200,l=23": wikipage 200 has 23 sitelinks in wikidatawiki
 //	  "200,s=830167": wikipage 200 has 830167 bytes in wikitext format
+//	  "200,d=1": wikipage 200 is a disambiguation page
+//	  "200,o=17": wikipage 200 links to 17 other pages, in Enterprise HTML dumps
+//	  "200,b=1": wikipage 200 has an infobox, in Enterprise HTML dumps
+//	  "200,e=12": wikipage 200 has 12 external links, in externallinks table
+//	  "200,t=40": wikipage 200 transcludes 40 templates, in templatelinks table
 func (m *pageSignalMerger) Process(line string) error {
 	m.inputRecords += 1
 	pos := strings.IndexByte(line, ',')
@@ -392,6 +544,14 @@ func (m *pageSignalMerger) Process(line string) error {
 		m.page = page
 	}
 
+	kind := line[pos+1]
+	bit := signalBit(kind)
+	if m.seen&bit != 0 {
+		m.duplicateRecords += 1
+		return nil
+	}
+	m.seen |= bit
+
 	var value int64 = 0
 	if line[pos+2] == '=' {
 		n, err := strconv.ParseInt(line[pos+3:len(line)], 10, 64)
@@ -401,7 +561,7 @@ func (m *pageSignalMerger) Process(line string) error {
 		value = n
 	}
 
-	switch line[pos+1] {
+	switch kind {
 	case 'Q':
 		m.entity = line[pos+1 : len(line)]
 	case 'c':
@@ -412,6 +572,16 @@ func (m *pageSignalMerger) Process(line string) error {
 		m.numSiteLinks += value
 	case 's':
 		m.pageSize += value
+	case 'd':
+		m.disambiguation = value != 0
+	case 'o':
+		m.numOutlinks += value
+	case 'b':
+		m.infobox = value != 0
+	case 'e':
+		m.externalLinks += value
+	case 't':
+		m.templates += value
 	}
 
 	return nil
@@ -426,35 +596,36 @@ func (m *pageSignalMerger) Close() error {
 		return err
 	}
 
-	logger.Printf("PageSignalMerger: processed %d → %d records", m.inputRecords, m.outputRecords)
+	logger.Printf("PageSignalMerger: processed %d → %d records, ignored %d duplicates",
+		m.inputRecords, m.outputRecords, m.duplicateRecords)
 	return nil
 }
 
 func (m *pageSignalMerger) write() error {
 	var err error
-	if m.page != "" && m.entity != "" {
-		var buf bytes.Buffer
-		buf.WriteString(m.page)
-		buf.WriteByte(',')
-		buf.WriteString(m.entity)
-		buf.WriteByte(',')
-		if m.pageSize > 0 {
-			buf.WriteString(strconv.FormatInt(m.pageSize, 10))
+	if m.page != "" && m.entity != "" && m.sample.KeepItemID(m.entity) {
+		// Columns: page, entity, pageSize, claims, identifiers, sitelinks,
+		// disambiguation, outlinks, infobox, externalLinks, templates.
+		// Empty columns at the end of the line are left out, except
+		// for pageSize.
+		cols := []string{
+			m.page,
+			m.entity,
+			formatPositive(m.pageSize),
+			formatPositive(m.numClaims),
+			formatPositive(m.numIdentifiers),
+			formatPositive(m.numSiteLinks),
+			formatFlag(m.disambiguation),
+			formatPositive(m.numOutlinks),
+			formatFlag(m.infobox),
+			formatPositive(m.externalLinks),
+			formatPositive(m.templates),
 		}
-		if m.numClaims > 0 || m.numIdentifiers > 0 || m.numSiteLinks > 0 {
-			buf.WriteByte(',')
-			if m.numClaims > 0 {
-				buf.WriteString(strconv.FormatInt(m.numClaims, 10))
-			}
-			buf.WriteByte(',')
-			if m.numIdentifiers > 0 {
-				buf.WriteString(strconv.FormatInt(m.numIdentifiers, 10))
-			}
-			buf.WriteByte(',')
-			if m.numSiteLinks > 0 {
-				buf.WriteString(strconv.FormatInt(m.numSiteLinks, 10))
-			}
+		for len(cols) > 3 && cols[len(cols)-1] == "" {
+			cols = cols[:len(cols)-1]
 		}
+		var buf bytes.Buffer
+		buf.WriteString(strings.Join(cols, ","))
 		buf.WriteByte('\n')
 		_, err = m.writer.Write(buf.Bytes())
 		m.outputRecords += 1
@@ -466,29 +637,47 @@ func (m *pageSignalMerger) write() error {
 	m.numIdentifiers = 0
 	m.numSiteLinks = 0
 	m.pageSize = 0
+	m.disambiguation = false
+	m.numOutlinks = 0
+	m.infobox = false
+	m.externalLinks = 0
+	m.templates = 0
+	m.seen = 0
 
 	return err
 }
 
+// FormatPositive formats a number for page_signals files,
+// where zero is represented by an empty column.
+func formatPositive(n int64) string {
+	if n <= 0 {
+		return ""
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// FormatFlag formats a boolean for page_signals files,
+// where false is represented by an empty column.
+func formatFlag(b bool) string {
+	if b {
+		return "1"
+	}
+	return ""
+}
+
 // ReadPageItemsOld reads our page_signals file and emits lines of the form
 // `<PageID>,<property>,<WikidataItemID>` to an output channel.
 // TODO: Remove this method after refactoring clients to call ReadPageItems().
 func ReadPageItemsOld(ctx context.Context, site *WikiSite, property string, s3 S3, out chan<- string) error {
-	ymd := site.LastDumped.Format("20060102")
-	path := fmt.Sprintf("page_signals/%s-%s-page_signals.zst", site.Key, ymd)
-	reader, err := NewS3Reader(ctx, "qrank", path, s3)
+	path := site.S3Path("page_signals")
+	opts := S3ReaderOptions{Compression: ZstdCompressed}
+	reader, err := NewS3ReaderWithOptions(ctx, "qrank", path, s3, opts)
 	if err != nil {
 		return err
 	}
 	defer reader.Close()
 
-	decompressor, err := zstd.NewReader(reader)
-	if err != nil {
-		return err
-	}
-	defer decompressor.Close()
-
-	scanner := bufio.NewScanner(decompressor)
+	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
 		cols := strings.Split(scanner.Text(), ",")
 		if len(cols) >= 2 {
@@ -502,7 +691,6 @@ func ReadPageItemsOld(ctx context.Context, site *WikiSite, property string, s3 S
 		}
 	}
 
-	decompressor.Close()
 	if err := reader.Close(); err != nil {
 		return err
 	}
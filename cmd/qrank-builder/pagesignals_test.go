@@ -5,9 +5,11 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
 	"log"
+	"os"
 	"path/filepath"
 	"slices"
 	"strings"
@@ -30,7 +32,7 @@ func TestBuildPageSignals(t *testing.T) {
 	}
 	for _, siteKey := range []string{"rmwiki", "wikidatawiki"} {
 		site := sites.Sites[siteKey]
-		if err := buildPageSignals(site, ctx, dumps, s3); err != nil {
+		if err := buildPageSignals(site, ctx, dumps, "", false, false, s3); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -63,11 +65,57 @@ func TestBuildPageSignals(t *testing.T) {
 		"19441465,Q5296,372",
 		"200,Q72,,550,85,186",
 		"5411171,Q5649951,,1,,20",
+		"5411902,Q4115189,",
 		"623646,Q662541,,32,9,15",
 	}
 	if !slices.Equal(gotLines, wantLines) {
 		t.Errorf("got %v, want %v", gotLines, wantLines)
 	}
+
+	// Item signals schemas with a merged_into column handle merged
+	// items apart, so their redirect pages get left out.
+	if err := buildPageSignals(sites.Sites["wikidatawiki"], ctx, dumps, "", false, true, s3); err != nil {
+		t.Fatal(err)
+	}
+	gotLines, err = s3.ReadLines("page_signals/wikidatawiki-20240401-page_signals.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLines = slices.DeleteFunc(wantLines, func(s string) bool { return s == "5411902,Q4115189," })
+	if !slices.Equal(gotLines, wantLines) {
+		t.Errorf("skipping redirects: got %v, want %v", gotLines, wantLines)
+	}
+}
+
+func TestBuildPageSignals_QualitySignals(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	dumps := filepath.Join("testdata", "dumps")
+	s3 := NewFakeS3()
+	sites, err := ReadWikiSites(nil, dumps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := buildPageSignals(sites.Sites["rmwiki"], ctx, dumps, "", true, false, s3); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s3.ReadLines("page_signals/rmwiki-20240301-page_signals.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"1,Q5296,2500,,,,,,,,2",
+		"3824,Q662541,4973,,,,,,,1",
+		"799,Q72,3142,,,,,,,3,4",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Sites without dumps of the links tables have no quality signals.
+	if err := buildPageSignals(sites.Sites["rmwikibooks"], ctx, dumps, "", true, false, s3); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestPageSignalsScanner(t *testing.T) {
@@ -86,7 +134,7 @@ func TestPageSignalsScanner(t *testing.T) {
 	}
 
 	got := make([]string, 0, 10)
-	scanner := NewPageSignalsScanner(sites, s3)
+	scanner := NewPageSignalsScanner(context.Background(), sites, s3)
 	for scanner.Scan() {
 		got = append(got, scanner.Text())
 	}
@@ -123,6 +171,15 @@ func TestPageSignalMerger(t *testing.T) {
 		"22,Q72",
 		"22,s=830167",
 		"333,Q3",
+		"4444,Q4",
+		"4444,d=1",
+		"4444,s=120",
+		"55555,Q5",
+		"55555,o=17",
+		"55555,b=1",
+		"666666,Q6",
+		"666666,e=31",
+		"666666,t=45",
 	} {
 		if err := m.Process(line); err != nil {
 			t.Error(err)
@@ -141,7 +198,88 @@ func TestPageSignalMerger(t *testing.T) {
 	want := []string{
 		"22,Q72,830167",
 		"333,Q3,",
+		"4444,Q4,120,,,,1",
+		"55555,Q5,,,,,,17,1",
+		"666666,Q6,,,,,,,,31,45",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// On wikidatawiki, the same page can get its entity both from page_props
+// and from the page table. Signals must not be counted twice.
+func TestPageSignalMerger_Duplicates(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	var buf strings.Builder
+	m := NewPageSignalMerger(TestingWriteCloser(&buf))
+	for _, line := range []string{
+		"22,Q72",
+		"22,Q72",
+		"22,c=8",
+		"22,c=8",
+		"22,s=830",
+		"22,s=830",
+		"333,Q3",
+		"333,l=5",
+		"333,l=5",
+	} {
+		if err := m.Process(line); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := m.Close(); err != nil {
+		t.Error(err)
+	}
+	got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	want := []string{
+		"22,Q72,830,8",
+		"333,Q3,,,,5",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if m.duplicateRecords != 4 {
+		t.Errorf("got %d duplicates, want 4", m.duplicateRecords)
+	}
+}
+
+func TestProcessPagePropsTable(t *testing.T) {
+	dumps := t.TempDir()
+	dumped, _ := time.Parse(time.DateOnly, "2024-05-01")
+	site := &WikiSite{Key: "xxwiki", Domain: "xx.wikipedia.org", LastDumped: dumped}
+	dir := filepath.Join(dumps, "xxwiki", "20240501")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	sql := "CREATE TABLE `page_props` (\n" +
+		"  `pp_page` int(10) unsigned NOT NULL,\n" +
+		"  `pp_propname` varbinary(60) NOT NULL DEFAULT '',\n" +
+		"  `pp_value` blob NOT NULL,\n" +
+		"  `pp_sortkey` float DEFAULT NULL\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=binary;\n" +
+		"INSERT INTO `page_props` VALUES " +
+		"(7,'wikibase_item','Q1234',NULL),(7,'disambiguation','',NULL)," +
+		"(8,'wikibase_item','Q72',NULL),(8,'page_image_free','Zürich.png',NULL);\n"
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(sql))
+	gz.Close()
+	path := filepath.Join(dir, "xxwiki-20240501-page_props.sql.gz")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := make(chan string, 10)
+	if err := processPagePropsTable(context.Background(), dumps, site, out); err != nil {
+		t.Fatal(err)
+	}
+	close(out)
+	got := make([]string, 0, 10)
+	for line := range out {
+		got = append(got, line)
 	}
+	want := []string{"7,Q1234", "7,d=1", "8,Q72"}
 	if !slices.Equal(got, want) {
 		t.Errorf("got %v, want %v", got, want)
 	}
@@ -7,13 +7,15 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"slices"
 	"sort"
 	"strconv"
@@ -23,39 +25,153 @@ import (
 
 	"golang.org/x/sync/errgroup"
 
-	"github.com/andybalholm/brotli"
 	"github.com/dsnet/compress/bzip2"
 	"github.com/klauspost/compress/zstd"
 	"github.com/lanrat/extsort"
 	"github.com/minio/minio-go/v7"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/compress"
 )
 
+// Pageview dumps come in several layouts. The Wikimedia dumps server has
+// files like pageview_complete/2024/2024-03/pageviews-20240301-user.bz2,
+// whereas exports from the Analytics cluster use Hive-style partitions
+// such as pageview_complete/year=2024/month=3/day=1. Some mirrors also
+// recompress the files with gzip. To find the file for a day, we probe
+// all combinations in the order of pageviewsLayouts and pageviewsFormats.
+var pageviewsLayouts = []func(y int, m time.Month, d int) string{
+	func(y int, m time.Month, d int) string {
+		return filepath.Join(fmt.Sprintf("%04d", y), fmt.Sprintf("%04d-%02d", y, m))
+	},
+	func(y int, m time.Month, d int) string {
+		return filepath.Join(fmt.Sprintf("year=%d", y), fmt.Sprintf("month=%d", m), fmt.Sprintf("day=%d", d))
+	},
+}
+
+var pageviewsFormats = []string{".bz2", ".gz"}
+
+var pageviewsFileRegexp = regexp.MustCompile(`^pageviews-(\d{8})-user\.(?:bz2|gz)$`)
+
 // LastestPageviewsDump returns the date of the most recent pageviews dump.
 func LatestPageviewsDump(dumps string) (time.Time, error) {
 	dir := filepath.Join(dumps, "other", "pageview_complete")
-	re := regexp.MustCompile(`^pageviews-(\d{8})-user\.bz2$`)
-	path, err := LatestDump(dir, re)
+	var latest time.Time
+	path, err := LatestDump(dir, pageviewsFileRegexp)
+	if err == nil {
+		match := pageviewsFileRegexp.FindStringSubmatch(filepath.Base(path))
+		if latest, err = time.Parse("20060102", match[1]); err != nil {
+			return time.Time{}, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return time.Time{}, err
+	}
+
+	hive, err := latestHivePageviewsDump(dir)
 	if err != nil {
 		return time.Time{}, err
 	}
-	match := re.FindStringSubmatch(filepath.Base(path))
-	t, err := time.Parse("20060102", match[1])
+	if hive.After(latest) {
+		latest = hive
+	}
+	if latest.IsZero() {
+		return time.Time{}, fmt.Errorf("no pageviews dumps in %s: %w", dir, fs.ErrNotExist)
+	}
+	return latest, nil
+}
+
+// LatestHivePageviewsDump returns the date of the most recent pageviews
+// dump in a Hive-style directory tree, or the zero time if there is none.
+func latestHivePageviewsDump(dir string) (time.Time, error) {
+	years, err := hivePartitions(dir, "year")
 	if err != nil {
 		return time.Time{}, err
 	}
-	return t, nil
+	for _, y := range years {
+		yearDir := filepath.Join(dir, fmt.Sprintf("year=%d", y))
+		months, err := hivePartitions(yearDir, "month")
+		if err != nil {
+			return time.Time{}, err
+		}
+		for _, m := range months {
+			monthDir := filepath.Join(yearDir, fmt.Sprintf("month=%d", m))
+			days, err := hivePartitions(monthDir, "day")
+			if err != nil {
+				return time.Time{}, err
+			}
+			for _, d := range days {
+				entries, err := os.ReadDir(filepath.Join(monthDir, fmt.Sprintf("day=%d", d)))
+				if err != nil {
+					return time.Time{}, err
+				}
+				for _, e := range entries {
+					if pageviewsFileRegexp.MatchString(e.Name()) {
+						return time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC), nil
+					}
+				}
+			}
+		}
+	}
+	return time.Time{}, nil
 }
 
-// PageviewsPath returns the path to the pageviews file for the given day.
+// HivePartitions returns the values of the Hive-style partitions in dir,
+// such as 2024 for a subdirectory "year=2024", in decreasing order.
+func hivePartitions(dir string, key string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	result := make([]int, 0, len(entries))
+	for _, e := range entries {
+		if value, ok := strings.CutPrefix(e.Name(), key+"="); ok && e.IsDir() {
+			if n, err := strconv.Atoi(value); err == nil {
+				result = append(result, n)
+			}
+		}
+	}
+	slices.Sort(result)
+	slices.Reverse(result)
+	return result, nil
+}
+
+// PageviewsPath returns the path to the pageviews file for the given day,
+// in the layout of the Wikimedia dumps server. For finding the file in
+// other layouts or formats, use FindPageviewsFile().
 func PageviewsPath(dumps string, day time.Time) string {
+	return pageviewsPaths(dumps, day)[0]
+}
+
+// FindPageviewsFile returns the path to the pageviews file for the given
+// day, probing all known layouts and formats. If there is no such file,
+// the error lists what paths have been tried.
+func FindPageviewsFile(dumps string, day time.Time) (string, error) {
+	paths := pageviewsPaths(dumps, day)
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		if err == nil {
+			return path, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no pageviews for %s, tried %s: %w",
+		day.Format(time.DateOnly), strings.Join(paths, ", "), fs.ErrNotExist)
+}
+
+func pageviewsPaths(dumps string, day time.Time) []string {
 	y, m, d := day.Year(), day.Month(), day.Day()
-	return filepath.Join(
-		dumps,
-		"other",
-		"pageview_complete",
-		fmt.Sprintf("%04d", y),
-		fmt.Sprintf("%04d-%02d", y, m),
-		fmt.Sprintf("pageviews-%04d%02d%02d-user.bz2", y, m, d))
+	name := fmt.Sprintf("pageviews-%04d%02d%02d-user", y, m, d)
+	paths := make([]string, 0, len(pageviewsLayouts)*len(pageviewsFormats))
+	for _, layout := range pageviewsLayouts {
+		dir := filepath.Join(dumps, "other", "pageview_complete", layout(y, m, d))
+		for _, format := range pageviewsFormats {
+			paths = append(paths, filepath.Join(dir, name+format))
+		}
+	}
+	return paths
 }
 
 func processPageviews(testRun bool, dumpsPath string, date time.Time, outDir string, ctx context.Context) ([]string, error) {
@@ -80,17 +196,22 @@ func processPageviews(testRun bool, dumpsPath string, date time.Time, outDir str
 	return paths, nil
 }
 
+// BuildMonthlyPageviews aggregates the pageviews of a month into a cache
+// file in outDir, and returns its path. New caches get compressed with
+// zstd; caches in brotli format from earlier runs keep getting used.
+// Readers should open the cache with compress.NewReaderForName().
 func buildMonthlyPageviews(testRun bool, dumpsPath string, year int, month time.Month, outDir string, ctx context.Context) (string, error) {
-	outPath := filepath.Join(
-		outDir,
-		fmt.Sprintf("pageviews-%04d%02d.br", year, month))
-	_, err := os.Stat(outPath)
-	if err == nil {
-		return outPath, nil // use pre-existing file
-	}
-	if !os.IsNotExist(err) {
-		return "", err
+	for _, codec := range []compress.Codec{compress.Zstd, compress.Brotli} {
+		path := filepath.Join(outDir, fmt.Sprintf("pageviews-%04d%02d%s", year, month, codec.Ext()))
+		_, err := os.Stat(path)
+		if err == nil {
+			return path, nil // use pre-existing file
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
 	}
+	outPath := filepath.Join(outDir, fmt.Sprintf("pageviews-%04d%02d.zst", year, month))
 
 	logger.Printf("building monthly pageviews for %04d-%02d", year, month)
 	start := time.Now()
@@ -106,19 +227,17 @@ func buildMonthlyPageviews(testRun bool, dumpsPath string, year int, month time.
 	}
 	defer tmpFile.Close()
 
-	writer := brotli.NewWriterLevel(tmpFile, 9)
+	writer, err := compress.NewWriter(tmpFile, compress.Zstd, compress.BestLevel)
 	if err != nil {
 		return "", err
 	}
 	defer writer.Close()
 
 	ch := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
-	sorter, outChan, errChan := extsort.Strings(ch, config)
-
+	config := newSortConfig(64)
 	g, subCtx := errgroup.WithContext(ctx)
+	sorter, outChan, errChan := extsort.Strings(sortInput(subCtx, "monthly_pageviews", ch, config), config)
+
 	g.Go(func() error {
 		return readMonthlyPageviews(testRun, dumpsPath, year, month, ch, subCtx)
 	})
@@ -239,7 +358,7 @@ func readMonthlyPageviews(testRun bool, dumpsPath string, year int, month time.M
 }
 
 func readPageviewsFile(testRun bool, path string, ch chan<- string, ctx context.Context) error {
-	file, err := os.Open(path)
+	file, err := openDump(ctx, path)
 	if err != nil {
 		return err
 	}
@@ -333,42 +452,66 @@ func emitPageviews(site, title string, count int64, ch chan<- string, ctx contex
 // BuildPageviews builds weekly pageview files and puts them in storage.
 // If a weekly file is already stored, it is not getting re-built.
 // The implementation checks for the latest available pageviews dump,
-// and goes back `numWeeks` weeks.
-func buildPageviews(ctx context.Context, dumps string, numWeeks int, s3 S3) ([]string, error) {
+// and goes back `numWeeks` weeks. If monthlyHorizon is positive, weeks
+// at least that many weeks back get built from monthly dumps if possible.
+func buildPageviews(ctx context.Context, source PageviewsSource, numWeeks int, monthlyHorizon int, domains PageviewDomains, s3 S3) ([]string, error) {
 	result := make([]string, 0, numWeeks)
-	stored, err := storedPageviews(ctx, s3)
+	stored, err := storedPageviews(ctx, source, s3)
 	if err != nil {
 		return nil, err
 	}
 
-	latest, err := LatestPageviewsDump(dumps)
+	weeks, err := pageviewWeeks(source, numWeeks)
 	if err != nil {
 		return nil, err
 	}
 
-	// Find the last Sunday for which a pageviews dump is available.
-	// Other than ISO 8601, the golang time library starts weeks with Sunday.
-	latestSunday := latest.AddDate(0, 0, int(time.Sunday-latest.Weekday()))
-
 	tempDir, err := os.MkdirTemp("", "qrank-pageviews")
 	if err != nil {
 		return nil, err
 	}
 	defer os.RemoveAll(tempDir)
 
-	for i := 0; i < numWeeks; i++ {
-		day := latestSunday.AddDate(0, 0, -7*i)
-		year, week := day.ISOWeek()
-		weekString := fmt.Sprintf("%04d-W%02d", year, week)
-		fileName := "pageviews-" + weekString + ".zst"
-		destPath := "pageviews/" + fileName
+	tempPath := func(week string) string {
+		return filepath.Join(tempDir, filepath.Base(WeeklyPageviewsPath(source.Name(), week)))
+	}
+
+	// Weeks far enough back get built from the monthly dumps, all in
+	// one pass over each monthly dump.
+	var fromMonthly []string
+	if monthly := newMonthlyPageviews(source); monthly != nil && monthlyHorizon > 0 && !pastBuildDeadline(ctx) {
+		old := make(map[string]string, len(weeks))
+		for i, week := range weeks {
+			if _, found := slices.BinarySearch(stored, week); !found && i >= monthlyHorizon {
+				old[week] = tempPath(week)
+			}
+		}
+		if len(old) > 0 {
+			if fromMonthly, err = monthly.buildWeeks(ctx, old, domains); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var pending []string
+	for _, weekString := range weeks {
+		year, week, err := ParseISOWeek(weekString)
+		if err != nil {
+			return nil, err
+		}
+		destPath := WeeklyPageviewsPath(source.Name(), weekString)
 		result = append(result, destPath)
 
 		if _, found := slices.BinarySearch(stored, weekString); !found {
-
-			tempFile := filepath.Join(tempDir, fileName)
-			if err := buildWeeklyPageviews(ctx, dumps, year, week, tempFile); err != nil {
-				return nil, err
+			tempFile := tempPath(weekString)
+			if !slices.Contains(fromMonthly, weekString) {
+				if pastBuildDeadline(ctx) {
+					pending = append(pending, weekString)
+					continue
+				}
+				if err := buildWeeklyPageviews(ctx, source, year, week, domains, tempFile); err != nil {
+					return nil, err
+				}
 			}
 			defer os.Remove(tempFile)
 
@@ -378,25 +521,82 @@ func buildPageviews(ctx context.Context, dumps string, numWeeks int, s3 S3) ([]s
 		}
 	}
 
+	if len(pending) > 0 {
+		slices.Sort(pending)
+		reportStepFrom(ctx).addPending(pending...)
+		logger.Printf("maximum runtime exceeded, leaving pageviews for %d weeks to the next run", len(pending))
+		return nil, ErrMaxRuntime
+	}
+
 	sort.Strings(result)
 	return result, nil
 }
 
-// StoredPageviews returns what pageview files are available in storage.
-func storedPageviews(ctx context.Context, s3 S3) ([]string, error) {
-	re := regexp.MustCompile(`^pageviews/pageviews-(\d{4}-W\d{2}).zst$`)
+// FindPageviews returns the paths of the weekly pageview files in storage,
+// like buildPageviews() but without building any missing files.
+// If any of the `numWeeks` files is missing, an error is returned.
+func findPageviews(ctx context.Context, source PageviewsSource, numWeeks int, s3 S3) ([]string, error) {
+	stored, err := storedPageviews(ctx, source, s3)
+	if err != nil {
+		return nil, err
+	}
+
+	weeks, err := pageviewWeeks(source, numWeeks)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, len(weeks))
+	for _, week := range weeks {
+		if _, found := slices.BinarySearch(stored, week); !found {
+			return nil, fmt.Errorf("pageviews for week %s not in storage; run stage pageviews first", week)
+		}
+		result = append(result, WeeklyPageviewsPath(source.Name(), week))
+	}
+
+	sort.Strings(result)
+	return result, nil
+}
+
+// PageviewWeeks returns the ISO weeks, such as "2024-W07", whose pageviews
+// go into the ranking. The implementation checks for the latest available
+// pageviews in source, and goes back `numWeeks` weeks.
+func pageviewWeeks(source PageviewsSource, numWeeks int) ([]string, error) {
+	latest, err := source.Latest()
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the last Sunday for which a pageviews dump is available.
+	// Other than ISO 8601, the golang time library starts weeks with Sunday.
+	latestSunday := latest.AddDate(0, 0, int(time.Sunday-latest.Weekday()))
+
+	weeks := make([]string, 0, numWeeks)
+	for i := 0; i < numWeeks; i++ {
+		day := latestSunday.AddDate(0, 0, -7*i)
+		year, week := day.ISOWeek()
+		weeks = append(weeks, fmt.Sprintf("%04d-W%02d", year, week))
+	}
+	return weeks, nil
+}
+
+// StoredPageviews returns the weeks, such as "2024-W17", whose pageviews
+// from source are available in storage. Weeks from other sources are
+// not included.
+func storedPageviews(ctx context.Context, source PageviewsSource, s3 S3) ([]string, error) {
 	result := make([]string, 0, 60)
 	group, groupCtx := errgroup.WithContext(ctx)
 	group.Go(func() error {
 		ch := s3.ListObjects(groupCtx, "qrank", minio.ListObjectsOptions{
-			Prefix: "pageviews/",
+			Prefix: path.Dir(WeeklyPageviewsPath(source.Name(), "")) + "/",
 		})
 		for obj := range ch {
 			if obj.Err != nil {
 				return obj.Err
 			}
-			if match := re.FindStringSubmatch(obj.Key); match != nil {
-				result = append(result, match[1])
+			week, ok := ParseWeeklyPageviewsPath(obj.Key)
+			if ok && obj.Key == WeeklyPageviewsPath(source.Name(), week) {
+				result = append(result, week)
 			}
 		}
 		return nil
@@ -415,83 +615,140 @@ func storedPageviews(ctx context.Context, s3 S3) ([]string, error) {
 // means the page https://en.wikipedia.org/?curid=3422 has been
 // viewed 7 times during the week. In the output, rows are sorted
 // by increasing UTF-8 string order.
-func buildWeeklyPageviews(ctx context.Context, dumps string, year int, week int, outpath string) error {
-	logger.Printf("building pageviews for week %04d-W%02d", year, week)
+func buildWeeklyPageviews(ctx context.Context, source PageviewsSource, year int, week int, domains PageviewDomains, outpath string) error {
+	what := fmt.Sprintf("week %04d-W%02d", year, week)
+	return buildPageviewsForDays(ctx, source, weekDays(year, week), what, domains, outpath)
+}
+
+// BuildPageviewsForDays aggregates Wikimedia pageviews for a list
+// of days, in the same output format as buildWeeklyPageviews().
+// The description, such as "week 2024-W17", is used for logging.
+func buildPageviewsForDays(ctx context.Context, source PageviewsSource, days []time.Time, what string, domains PageviewDomains, outpath string) error {
+	return buildPageviewsFrom(ctx, what, outpath, func(ctx context.Context, out chan<- string) error {
+		return readDailyPageviewFiles(ctx, source, days, domains, out)
+	})
+}
+
+// BuildPageviewsFrom aggregates the pageviews that get sent by read,
+// in the same output format as buildWeeklyPageviews(). When read
+// returns, it must have closed its output channel.
+func buildPageviewsFrom(ctx context.Context, what string, outpath string, read func(ctx context.Context, out chan<- string) error) error {
+	g, subCtx := errgroup.WithContext(ctx)
+	ch, err := startPageviewsWriter(subCtx, g, what, outpath)
+	if err != nil {
+		return err
+	}
+	g.Go(func() error {
+		return read(subCtx, ch)
+	})
+	return g.Wait()
+}
+
+// StartPageviewsWriter starts to sort and sum up the `Wiki,PageID,Count`
+// lines sent to the returned channel into a file at outpath, in the
+// same output format as buildWeeklyPageviews(). The work runs in g;
+// the file is complete once the caller has closed the channel and
+// g.Wait() has returned without error.
+func startPageviewsWriter(ctx context.Context, g *errgroup.Group, what string, outpath string) (chan<- string, error) {
+	logger.Printf("building pageviews for %s", what)
 	start := time.Now()
 
 	file, err := os.Create(outpath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file.Close()
 
 	zstdLevel := zstd.WithEncoderLevel(zstd.SpeedBestCompression)
 	writer, err := zstd.NewWriter(file, zstdLevel)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
 
 	ch := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 16 * 1024 * 1024 / 32
-	config.NumWorkers = runtime.NumCPU()
-	sorter, outChan, errChan := extsort.Strings(ch, config)
-	g, subCtx := errgroup.WithContext(ctx)
-	g.Go(func() error {
-		return readWeeklyPageviews(subCtx, dumps, year, week, ch)
-	})
+	config := newSortConfig(16)
+	sorter, outChan, errChan := extsort.Strings(sortInput(ctx, "pageviews", ch, config), config)
 	g.Go(func() error {
-		sorter.Sort(subCtx)
-		return MergeCounts(subCtx, outChan, writer)
-	})
+		defer file.Close()
+		sorter.Sort(ctx)
+		if err := MergeCounts(ctx, outChan, writer); err != nil {
+			return err
+		}
 
-	if err := g.Wait(); err != nil {
-		return err
-	}
+		if err := <-errChan; err != nil {
+			return err
+		}
 
-	if err := <-errChan; err != nil {
-		return err
-	}
+		if err := writer.Close(); err != nil {
+			return err
+		}
 
-	if err := writer.Close(); err != nil {
-		return err
-	}
+		if err := file.Close(); err != nil {
+			return err
+		}
 
-	if err := file.Close(); err != nil {
-		return err
-	}
+		logger.Printf("built pageviews for %s in %.1fs", what, time.Since(start).Seconds())
+		return nil
+	})
+	return ch, nil
+}
 
-	logger.Printf("built pageviews for week %04d-W%02d in %.1fs",
-		year, week, time.Since(start).Seconds())
-	return nil
+// WeekDays returns the seven days of an ISO week, starting on Monday.
+func weekDays(year int, week int) []time.Time {
+	start := ISOWeekStart(year, week)
+	days := make([]time.Time, 0, 7)
+	for i := 0; i < 7; i++ {
+		days = append(days, start.AddDate(0, 0, i))
+	}
+	return days
 }
 
-// readWeeklyPageviews reads the Wikimedia pageview file of one week,
+// readWeeklyPageviews reads the pageviews of one week from source,
 // sending output as `Wiki,PageID,Count` to a string channel before
 // closing that channel.
-func readWeeklyPageviews(ctx context.Context, dumps string, year int, week int, out chan<- string) error {
+func readWeeklyPageviews(ctx context.Context, source PageviewsSource, year int, week int, domains PageviewDomains, out chan<- string) error {
+	return readDailyPageviewFiles(ctx, source, weekDays(year, week), domains, out)
+}
+
+// ReadDailyPageviewFiles is like readWeeklyPageviews(), but for a list of days.
+func readDailyPageviewFiles(ctx context.Context, source PageviewsSource, days []time.Time, domains PageviewDomains, out chan<- string) error {
 	defer close(out)
 	group, groupCtx := errgroup.WithContext(ctx)
-	start := ISOWeekStart(year, week)
-	for i := 0; i < 7; i++ {
-		day := start.AddDate(0, 0, i)
-		path := PageviewsPath(dumps, day)
+
+	// Find all files before starting to read, so we fail early
+	// when a day is missing.
+	paths := make([]string, 0, len(days))
+	for _, day := range days {
+		path, err := source.Find(day)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+	}
+
+	for i := range paths {
+		path := paths[i]
 		group.Go(func() error {
-			return readDailyPageviews(groupCtx, path, out)
+			return source.Read(groupCtx, path, domains, out)
 		})
 	}
 	return group.Wait()
 }
 
 // readDailyPageviews reads the Wikimedia pageview file of one single day,
-// sending output as `Wiki,PageID,Count` to a string channel.
+// sending output as `Wiki,PageID,Count` to a string channel. The wiki
+// codes of the dump get canonicalized with `domains`, so that the output
+// uses the same domains as the page_signals files.
 // If `ctx` gets cancelled while reading the file, an error is returned.
-func readDailyPageviews(ctx context.Context, path string, out chan<- string) error {
-	file, err := os.Open(path)
+func readDailyPageviews(ctx context.Context, path string, domains PageviewDomains, out chan<- string) error {
+	file, err := openDump(ctx, path)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	reader, err := bzip2.NewReader(file, &bzip2.ReaderConfig{})
-	if err != err {
+	reader, err := compress.NewReaderForName(path, file)
+	if err != nil {
 		return err
 	}
 	defer reader.Close()
@@ -506,7 +763,7 @@ func readDailyPageviews(ctx context.Context, path string, out chan<- string) err
 			continue
 		}
 
-		wiki, pageID, count := cols[0], cols[2], cols[4]
+		wiki, pageID, count := domains.Canonical(cols[0]), cols[2], cols[4]
 		id, err := strconv.ParseInt(pageID, 10, 64)
 		if id <= 0 || err != nil {
 			continue
@@ -532,15 +789,110 @@ func readDailyPageviews(ctx context.Context, path string, out chan<- string) err
 		return err
 	}
 
+	// Closing the reader also closes the file.
 	if err := reader.Close(); err != nil {
 		return err
 	}
 
-	if err := file.Close(); err != nil {
-		return err
+	return nil
+}
+
+// PageviewDomains maps the wiki codes of Wikimedia pageview dumps to
+// the domains of WikiSites, without ".org", which is how page_signals
+// files identify sites. Most codes are already such domains, but the
+// code for Wikidata is "wikidata", whereas its domain is "www.wikidata.org".
+// Some dumps also have codes for mobile sites, like "en.m.wikipedia",
+// whose pageviews belong to "en.wikipedia". A few language editions
+// are known under several codes, like "be-x-old.wikipedia" for
+// "be-tarask.wikipedia"; see languagecodes.tsv. Finally, wikis that
+// display their pages in several scripts or regional variants, such
+// as Chinese and Serbian, get their pageviews reported under codes
+// like "zh-hant.wikipedia" or "sr-el.wikipedia"; see languageVariants.
+type PageviewDomains map[string]string
+
+// LanguageVariants lists the variant codes under which the pageview
+// dumps report views of wikis in a given language. The variants are
+// different renderings of the same pages, so their views belong
+// to the wiki of the base language, such as "zh.wikipedia" for
+// "zh-hant.wikipedia". Some codes look like variants but are sites
+// of their own, such as "zh-yue" for Cantonese, which is why they
+// are not listed here.
+//
+// https://www.mediawiki.org/wiki/Writing_systems/Language_converter
+var languageVariants = map[string][]string{
+	"gan": {"gan-hans", "gan-hant"},
+	"iu":  {"ike-cans", "ike-latn"},
+	"kk":  {"kk-arab", "kk-cn", "kk-cyrl", "kk-kz", "kk-latn", "kk-tr"},
+	"ku":  {"ku-arab", "ku-latn"},
+	"shi": {"shi-latn", "shi-tfng"},
+	"sr":  {"sr-cyrl", "sr-ec", "sr-el", "sr-latn"},
+	"tg":  {"tg-cyrl", "tg-latn"},
+	"zh": {
+		"zh-cn", "zh-hans", "zh-hant", "zh-hk",
+		"zh-mo", "zh-my", "zh-sg", "zh-tw",
+	},
+}
+
+// NewPageviewDomains builds the mapping from pageview wiki codes to domains.
+func NewPageviewDomains(sites *WikiSites) PageviewDomains {
+	domains := make(PageviewDomains, len(sites.Sites)*2)
+	for _, site := range sites.Sites {
+		domain := strings.TrimSuffix(site.Domain, ".org")
+		domains[domain] = domain
+		if d, ok := strings.CutPrefix(domain, "www."); ok {
+			if _, exists := domains[d]; !exists {
+				domains[d] = domain
+			}
+		}
 	}
 
-	return nil
+	// Aliases for language codes and variants must not shadow
+	// the domain of another site, so we add them after all real domains.
+	for _, site := range sites.Sites {
+		domain := strings.TrimSuffix(site.Domain, ".org")
+		lang, project, ok := strings.Cut(domain, ".")
+		if !ok {
+			continue
+		}
+		for _, alias := range languageCodes.Aliases(lang) {
+			d := alias + "." + project
+			if _, exists := domains[d]; !exists {
+				domains[d] = domain
+			}
+		}
+		for _, variant := range languageVariants[lang] {
+			d := variant + "." + project
+			if _, exists := domains[d]; !exists {
+				domains[d] = domain
+			}
+		}
+	}
+	return domains
+}
+
+// Canonical returns the domain for a wiki code from a pageviews dump.
+// Labels for mobile and Wikipedia Zero variants get removed, so that
+// "en.m.wikipedia" and "en.zero.wikipedia" become "en.wikipedia".
+// Codes of unknown sites are returned without further change.
+func (d PageviewDomains) Canonical(code string) string {
+	if canonical, ok := d[code]; ok {
+		return canonical
+	}
+	if strings.Contains(code, "m.") || strings.Contains(code, "zero.") {
+		labels := strings.Split(code, ".")
+		kept := labels[:0]
+		for i, label := range labels {
+			if (label == "m" || label == "zero") && i < len(labels)-1 {
+				continue
+			}
+			kept = append(kept, label)
+		}
+		code = strings.Join(kept, ".")
+		if canonical, ok := d[code]; ok {
+			return canonical
+		}
+	}
+	return code
 }
 
 // SendCount is an internal helper for ReadDailyPageviews.
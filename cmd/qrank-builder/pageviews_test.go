@@ -19,6 +19,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/dsnet/compress/bzip2"
 	"github.com/klauspost/compress/zstd"
 	"golang.org/x/sync/errgroup"
 )
@@ -50,6 +51,115 @@ func TestPageviewsPath(t *testing.T) {
 	}
 }
 
+func TestBuildPageviews_Deadline(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := withBuildReport(context.Background(), NewBuildReport(time.Now()))
+	ctx, step := startReportStep(ctx, "pageviews")
+	ctx = withBuildDeadline(ctx, time.Now().Add(-time.Minute))
+	dumps := filepath.Join("testdata", "dumps")
+	s3 := NewFakeS3()
+	s3.data["pageviews/pageviews-2023-W11.zst"] = []byte("baz")
+
+	_, err := buildPageviews(ctx, PageviewCompleteSource{dumps} /*numWeeks*/, 2 /*monthlyHorizon*/, 0, nil, s3)
+	if !errors.Is(err, ErrMaxRuntime) {
+		t.Errorf("got %v, want ErrMaxRuntime", err)
+	}
+	if _, found := s3.data["pageviews/pageviews-2023-W12.zst"]; found {
+		t.Error("should not build pageviews after the deadline")
+	}
+	if want := []string{"2023-W12"}; !slices.Equal(step.Pending, want) {
+		t.Errorf("got pending %q, want %q", step.Pending, want)
+	}
+}
+
+func TestFindPageviewsFile(t *testing.T) {
+	dumps := t.TempDir()
+	base := filepath.Join(dumps, "other", "pageview_complete")
+	for _, path := range []string{
+		filepath.Join(base, "2024", "2024-03", "pageviews-20240301-user.bz2"),
+		filepath.Join(base, "2024", "2024-03", "pageviews-20240302-user.gz"),
+		filepath.Join(base, "year=2024", "month=3", "day=2", "pageviews-20240302-user.bz2"),
+		filepath.Join(base, "year=2024", "month=3", "day=3", "pageviews-20240303-user.gz"),
+	} {
+		mkdirs(t, filepath.Dir(path))
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct{ day, want string }{
+		{"2024-03-01", "2024/2024-03/pageviews-20240301-user.bz2"},
+		{"2024-03-02", "2024/2024-03/pageviews-20240302-user.gz"},
+		{"2024-03-03", "year=2024/month=3/day=3/pageviews-20240303-user.gz"},
+	} {
+		day, _ := time.Parse(time.DateOnly, tc.day)
+		got, err := FindPageviewsFile(dumps, day)
+		if err != nil {
+			t.Errorf("%s: %v", tc.day, err)
+			continue
+		}
+		if want := filepath.Join(base, filepath.FromSlash(tc.want)); got != want {
+			t.Errorf("%s: got %q, want %q", tc.day, got, want)
+		}
+	}
+
+	day, _ := time.Parse(time.DateOnly, "2024-03-04")
+	_, err := FindPageviewsFile(dumps, day)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want fs.ErrNotExist", err)
+	}
+	for _, tried := range pageviewsPaths(dumps, day) {
+		if err == nil || !strings.Contains(err.Error(), tried) {
+			t.Errorf("error should mention %q, got %v", tried, err)
+		}
+	}
+}
+
+func TestLatestPageviewsDump_Hive(t *testing.T) {
+	dumps := t.TempDir()
+	base := filepath.Join(dumps, "other", "pageview_complete")
+	for _, path := range []string{
+		filepath.Join(base, "2024", "2024-03", "pageviews-20240305-user.bz2"),
+		filepath.Join(base, "year=2024", "month=3", "day=9", "pageviews-20240309-user.gz"),
+		filepath.Join(base, "year=2024", "month=3", "day=10", "_SUCCESS"),
+		filepath.Join(base, "year=2023", "month=12", "day=31", "pageviews-20231231-user.gz"),
+	} {
+		mkdirs(t, filepath.Dir(path))
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	latest, err := LatestPageviewsDump(dumps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := latest.Format(time.DateOnly), "2024-03-09"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestReadDailyPageviews_Gzip(t *testing.T) {
+	data := gzipForTest(t, "rm.wikipedia Zürich 3824 desktop 2 A2\n")
+	path := filepath.Join(t.TempDir(), "pageviews-20240101-user.gz")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan string, 10)
+	if err := readDailyPageviews(context.Background(), path, nil, ch); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	got := make([]string, 0, 1)
+	for line := range ch {
+		got = append(got, line)
+	}
+	if want := []string{"rm.wikipedia,3824,2"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
 func TestReadPageviews(t *testing.T) {
 	tests := []struct{ input, expected string }{
 		{"", ""},
@@ -157,7 +267,7 @@ func TestBuildPageviews(t *testing.T) {
 	s3.data["pageviews/pageviews-2023-W09.zst"] = []byte("foo")
 	s3.data["pageviews/pageviews-2023-W10.zst"] = []byte("bar")
 	s3.data["pageviews/pageviews-2023-W11.zst"] = []byte("baz")
-	got, err := buildPageviews(ctx, dumps /*numWeeks*/, 4, s3)
+	got, err := buildPageviews(ctx, PageviewCompleteSource{dumps} /*numWeeks*/, 4 /*monthlyHorizon*/, 0, nil, s3)
 	if err != nil {
 		t.Error(err)
 	}
@@ -180,7 +290,8 @@ func TestStoredPageviews(t *testing.T) {
 	s3.data["pageviews/pageviews-2011-W51.zst"] = []byte("a")
 	s3.data["pageviews/pageviews-2019-W51.gz"] = []byte("junk")
 	s3.data["pageviews/pageviews-2024-W06.zst"] = []byte("b")
-	got, err := storedPageviews(context.Background(), s3)
+	s3.data["pageviews/pageview_actor/pageviews-2024-W07.zst"] = []byte("c")
+	got, err := storedPageviews(context.Background(), PageviewCompleteSource{}, s3)
 	if err != nil {
 		t.Error(err)
 	}
@@ -188,6 +299,15 @@ func TestStoredPageviews(t *testing.T) {
 	if !slices.Equal(got, want) {
 		t.Errorf("got %v, want %v", got, want)
 	}
+
+	// Weeks from another source must not get mixed up.
+	got, err = storedPageviews(context.Background(), PageviewActorSource{}, s3)
+	if err != nil {
+		t.Error(err)
+	}
+	if want := []string{"2024-W07"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
 }
 
 func TestBuildWeeklyPageviews(t *testing.T) {
@@ -199,7 +319,7 @@ func TestBuildWeeklyPageviews(t *testing.T) {
 	ctx := context.Background()
 	dumps := filepath.Join("testdata", "dumps")
 	path := filepath.Join(t.TempDir(), "pageviews-2023-W12.zst")
-	if err := buildWeeklyPageviews(ctx, dumps, 2023, 12, path); err != nil {
+	if err := buildWeeklyPageviews(ctx, PageviewCompleteSource{dumps}, 2023, 12, nil, path); err != nil {
 		t.Error(err)
 	}
 
@@ -256,7 +376,7 @@ func TestReadWeeklyPageviews(t *testing.T) {
 	})
 	group.Go(func() error {
 		dumps := filepath.Join("testdata", "dumps")
-		return readWeeklyPageviews(ctx, dumps, 2023, 12, ch)
+		return readWeeklyPageviews(ctx, PageviewCompleteSource{dumps}, 2023, 12, nil, ch)
 	})
 	if err := group.Wait(); err != nil {
 		t.Error(err)
@@ -271,7 +391,7 @@ func TestReadWeeklyPageviews_Canceled(t *testing.T) {
 	cancel()
 	ch := make(chan string, 2)
 	dumps := filepath.Join("testdata", "dumps")
-	if err := readWeeklyPageviews(ctx, dumps, 2023, 12, ch); err != context.Canceled {
+	if err := readWeeklyPageviews(ctx, PageviewCompleteSource{dumps}, 2023, 12, nil, ch); err != context.Canceled {
 		t.Errorf("want context.Canceled, got %v", err)
 	}
 }
@@ -279,7 +399,7 @@ func TestReadWeeklyPageviews_Canceled(t *testing.T) {
 func TestReadWeeklyPageviews_MissingFiles(t *testing.T) {
 	ctx := context.Background()
 	ch := make(chan string, 2)
-	if err := readWeeklyPageviews(ctx, "bad-path", 2021, 12, ch); err == nil {
+	if err := readWeeklyPageviews(ctx, PageviewCompleteSource{"bad-path"}, 2021, 12, nil, ch); err == nil {
 		t.Error("want error, got nil")
 	}
 }
@@ -291,7 +411,7 @@ func TestReadDailyPageviews(t *testing.T) {
 	go func() {
 		defer close(ch)
 		ctx := context.Background()
-		if err := readDailyPageviews(ctx, path, ch); err != nil {
+		if err := readDailyPageviews(ctx, path, nil, ch); err != nil {
 			t.Error(err)
 		}
 	}()
@@ -318,6 +438,143 @@ func TestReadDailyPageviews(t *testing.T) {
 	}
 }
 
+func TestReadDailyPageviews_Domains(t *testing.T) {
+	var buf bytes.Buffer
+	bz, err := bzip2.NewWriter(&buf, &bzip2.WriterConfig{Level: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"en.m.wikipedia Zürich 34 mobile-web 5 A5",
+		"en.wikipedia Zürich 34 desktop 3 A3",
+		"en.wikipedia Zürich 34 mobile-app 1 A1",
+		"en.zero.wikipedia Zürich 34 mobile-web 2 A2",
+		"m.wikidata Q72 200 mobile-web 4 A4",
+		"wikidata Q72 200 desktop 7 A7",
+		"xx.m.wikipedia Foo 1 mobile-web 1 A1",
+	} {
+		fmt.Fprintln(bz, line)
+	}
+	if err := bz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "pageviews-20240101-user.bz2")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sites := &WikiSites{Sites: map[string]*WikiSite{
+		"enwiki":       {Key: "enwiki", Domain: "en.wikipedia.org"},
+		"wikidatawiki": {Key: "wikidatawiki", Domain: "www.wikidata.org"},
+	}}
+	domains := NewPageviewDomains(sites)
+	ch := make(chan string, 10)
+	if err := readDailyPageviews(context.Background(), path, domains, ch); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	lines := make([]string, 0, 10)
+	for line := range ch {
+		lines = append(lines, line)
+	}
+	slices.Sort(lines)
+
+	sorted := make(chan string, len(lines))
+	for _, line := range lines {
+		sorted <- line
+	}
+	close(sorted)
+	var out bytes.Buffer
+	if err := MergeCounts(context.Background(), sorted, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	got := out.String()
+	want := "en.wikipedia,34,11\nwww.wikidata,200,11\nxx.wikipedia,1,1\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPageviewDomains(t *testing.T) {
+	sites := &WikiSites{Sites: map[string]*WikiSite{
+		"alswiki":      {Key: "alswiki", Domain: "als.wikipedia.org"},
+		"be_x_oldwiki": {Key: "be_x_oldwiki", Domain: "be-tarask.wikipedia.org"},
+		"commonswiki":  {Key: "commonswiki", Domain: "commons.wikimedia.org"},
+		"enwiki":       {Key: "enwiki", Domain: "en.wikipedia.org"},
+		"wikidatawiki": {Key: "wikidatawiki", Domain: "www.wikidata.org"},
+	}}
+	domains := NewPageviewDomains(sites)
+	for _, tc := range []struct{ code, want string }{
+		{"en.wikipedia", "en.wikipedia"},
+		{"en.m.wikipedia", "en.wikipedia"},
+		{"en.zero.wikipedia", "en.wikipedia"},
+		{"wikidata", "www.wikidata"},
+		{"m.wikidata", "www.wikidata"},
+		{"www.wikidata", "www.wikidata"},
+		{"commons.wikimedia", "commons.wikimedia"},
+		{"commons.m.wikimedia", "commons.wikimedia"},
+		{"de.wikipedia", "de.wikipedia"},
+		{"de.m.wikipedia", "de.wikipedia"},
+		{"m", "m"},
+		{"als.wikipedia", "als.wikipedia"},
+		{"gsw.wikipedia", "als.wikipedia"},
+		{"be-tarask.wikipedia", "be-tarask.wikipedia"},
+		{"be-x-old.wikipedia", "be-tarask.wikipedia"},
+		{"be-x-old.m.wikipedia", "be-tarask.wikipedia"},
+		{"und.wikimedia", "und.wikimedia"},
+	} {
+		if got := domains.Canonical(tc.code); got != tc.want {
+			t.Errorf("Canonical(%q): got %q, want %q", tc.code, got, tc.want)
+		}
+	}
+
+	// Without sites, only the mobile variants get canonicalized.
+	var none PageviewDomains
+	if got := none.Canonical("wikidata"); got != "wikidata" {
+		t.Errorf("got %q, want %q", got, "wikidata")
+	}
+	if got := none.Canonical("en.m.wikipedia"); got != "en.wikipedia" {
+		t.Errorf("got %q, want %q", got, "en.wikipedia")
+	}
+}
+
+func TestPageviewDomains_Variants(t *testing.T) {
+	sites := &WikiSites{Sites: map[string]*WikiSite{
+		"srwiki":       {Key: "srwiki", Domain: "sr.wikipedia.org"},
+		"zhwiki":       {Key: "zhwiki", Domain: "zh.wikipedia.org"},
+		"zhwikinews":   {Key: "zhwikinews", Domain: "zh.wikinews.org"},
+		"zh_yuewiki":   {Key: "zh_yuewiki", Domain: "zh-yue.wikipedia.org"},
+		"zh_min_nan":   {Key: "zh_min_nanwiki", Domain: "zh-min-nan.wikipedia.org"},
+		"zh_twwiki":    {Key: "zh_twwiki", Domain: "zh-tw.wikipedia.org"},
+		"kkwiktionary": {Key: "kkwiktionary", Domain: "kk.wiktionary.org"},
+	}}
+	domains := NewPageviewDomains(sites)
+	for _, tc := range []struct{ code, want string }{
+		{"zh.wikipedia", "zh.wikipedia"},
+		{"zh-hant.wikipedia", "zh.wikipedia"},
+		{"zh-hans.wikipedia", "zh.wikipedia"},
+		{"zh-hant.m.wikipedia", "zh.wikipedia"},
+		{"zh-cn.wikinews", "zh.wikinews"},
+		{"sr-ec.wikipedia", "sr.wikipedia"},
+		{"sr-el.wikipedia", "sr.wikipedia"},
+		{"sr-el.m.wikipedia", "sr.wikipedia"},
+		{"kk-latn.wiktionary", "kk.wiktionary"},
+
+		// Sites of their own must not get folded into another wiki.
+		{"zh-yue.wikipedia", "zh-yue.wikipedia"},
+		{"zh-min-nan.wikipedia", "zh-min-nan.wikipedia"},
+		{"zh-tw.wikipedia", "zh-tw.wikipedia"},
+
+		// Variants of wikis that are not in the sites table stay as they are.
+		{"sr-el.wikibooks", "sr-el.wikibooks"},
+	} {
+		if got := domains.Canonical(tc.code); got != tc.want {
+			t.Errorf("Canonical(%q): got %q, want %q", tc.code, got, tc.want)
+		}
+	}
+}
+
 func TestReadDailyPageviews_Canceled(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel()
@@ -325,7 +582,7 @@ func TestReadDailyPageviews_Canceled(t *testing.T) {
 	date, _ := time.Parse(time.DateOnly, "2023-03-20")
 	path := PageviewsPath(filepath.Join("testdata", "dumps"), date)
 	ch := make(chan string, 100)
-	if err := readDailyPageviews(ctx, path, ch); err != context.Canceled {
+	if err := readDailyPageviews(ctx, path, nil, ch); err != context.Canceled {
 		t.Errorf("want context.Canceled, got %v", err)
 	}
 }
@@ -333,7 +590,7 @@ func TestReadDailyPageviews_Canceled(t *testing.T) {
 func TestReadDailyPageviews_FileNotFound(t *testing.T) {
 	ctx := context.Background()
 	ch := make(chan string, 2)
-	if err := readDailyPageviews(ctx, "no-such-file.bz2", ch); err == nil {
+	if err := readDailyPageviews(ctx, "no-such-file.bz2", nil, ch); err == nil {
 		t.Error("want error, got nil")
 	}
 }
@@ -0,0 +1,239 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/compress"
+)
+
+// PageviewsSource is where the pipeline reads daily pageviews from.
+// Whatever the source, the pageviews get aggregated into the same
+// weekly files, so the rest of the pipeline does not need to know.
+type PageviewsSource interface {
+	// Name returns the name of the source on the command line, such
+	// as "pageview_complete". It tells where the weekly files of the
+	// source get stored; see WeeklyPageviewsPath().
+	Name() string
+
+	// Latest returns the most recent day with pageviews.
+	Latest() (time.Time, error)
+
+	// Find returns the path to the pageviews of a day. If there are
+	// no pageviews for that day, the error wraps fs.ErrNotExist.
+	Find(day time.Time) (string, error)
+
+	// Read reads the pageviews at a path returned by Find(), sending
+	// output as `Wiki,PageID,Count` to a string channel. The wikis get
+	// canonicalized with `domains`, like in readDailyPageviews().
+	Read(ctx context.Context, path string, domains PageviewDomains, out chan<- string) error
+}
+
+// NewPageviewsSource returns the source for a name given on the command
+// line, which is either "pageview_complete" for the public dumps, or
+// "pageview_actor" for an export from the Analytics cluster in dir.
+func NewPageviewsSource(name string, dumps string, dir string) (PageviewsSource, error) {
+	switch name {
+	case "", "pageview_complete":
+		return PageviewCompleteSource{Dumps: dumps}, nil
+	case "pageview_actor":
+		if dir == "" {
+			return nil, fmt.Errorf("pageviews source %q needs a directory", name)
+		}
+		return PageviewActorSource{Dir: dir}, nil
+	default:
+		return nil, fmt.Errorf("unknown pageviews source %q, expected pageview_complete or pageview_actor", name)
+	}
+}
+
+// PageviewCompleteSource reads the public pageview_complete dumps,
+// in any of the layouts and formats described at pageviewsLayouts.
+type PageviewCompleteSource struct {
+	Dumps string
+}
+
+func (s PageviewCompleteSource) Name() string {
+	return "pageview_complete"
+}
+
+func (s PageviewCompleteSource) Latest() (time.Time, error) {
+	return LatestPageviewsDump(s.Dumps)
+}
+
+func (s PageviewCompleteSource) Find(day time.Time) (string, error) {
+	return FindPageviewsFile(s.Dumps, day)
+}
+
+func (s PageviewCompleteSource) Read(ctx context.Context, path string, domains PageviewDomains, out chan<- string) error {
+	return readDailyPageviews(ctx, path, domains, out)
+}
+
+// PageviewActorSource reads pageviews that have been exported from the
+// pageview_actor table in the Analytics cluster. Unlike the public dumps,
+// whose counts include repeated views by the same reader, these counts
+// can be deduplicated per actor. The export is a Hive-style directory
+// tree such as year=2024/month=3/day=1, where each day has one or more
+// tab-separated part files with a header line, and a _SUCCESS marker
+// once the export of that day is complete. The columns `project`,
+// `page_id` and `view_count` are required; if there is a column
+// `agent_type`, only rows with agent type "user" are counted.
+type PageviewActorSource struct {
+	Dir string
+}
+
+func (s PageviewActorSource) Name() string {
+	return "pageview_actor"
+}
+
+func (s PageviewActorSource) Latest() (time.Time, error) {
+	years, err := hivePartitions(s.Dir, "year")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, y := range years {
+		yearDir := filepath.Join(s.Dir, fmt.Sprintf("year=%d", y))
+		months, err := hivePartitions(yearDir, "month")
+		if err != nil {
+			return time.Time{}, err
+		}
+		for _, m := range months {
+			monthDir := filepath.Join(yearDir, fmt.Sprintf("month=%d", m))
+			days, err := hivePartitions(monthDir, "day")
+			if err != nil {
+				return time.Time{}, err
+			}
+			for _, d := range days {
+				marker := filepath.Join(monthDir, fmt.Sprintf("day=%d", d), "_SUCCESS")
+				if _, err := os.Stat(marker); err == nil {
+					return time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC), nil
+				} else if !errors.Is(err, fs.ErrNotExist) {
+					return time.Time{}, err
+				}
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("no complete pageview_actor exports in %s: %w", s.Dir, fs.ErrNotExist)
+}
+
+func (s PageviewActorSource) Find(day time.Time) (string, error) {
+	dir := filepath.Join(s.Dir,
+		fmt.Sprintf("year=%d", day.Year()),
+		fmt.Sprintf("month=%d", day.Month()),
+		fmt.Sprintf("day=%d", day.Day()))
+	if _, err := os.Stat(filepath.Join(dir, "_SUCCESS")); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("no complete pageview_actor export for %s in %s: %w",
+				day.Format(time.DateOnly), dir, fs.ErrNotExist)
+		}
+		return "", err
+	}
+	return dir, nil
+}
+
+func (s PageviewActorSource) Read(ctx context.Context, path string, domains PageviewDomains, out chan<- string) error {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	parts := make([]string, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, "_") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		parts = append(parts, filepath.Join(path, name))
+	}
+	slices.Sort(parts)
+
+	for _, part := range parts {
+		if err := readPageviewActorPart(ctx, part, domains, out); err != nil {
+			return fmt.Errorf("%s: %w", part, err)
+		}
+	}
+	return nil
+}
+
+// ReadPageviewActorPart reads one part file of a pageview_actor export.
+func readPageviewActorPart(ctx context.Context, path string, domains PageviewDomains, out chan<- string) error {
+	file, err := openDump(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := compress.NewReaderForName(path, file)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	scanner := bufio.NewScanner(reader)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return nil // empty part
+	}
+	header := strings.Split(scanner.Text(), "\t")
+	projectCol := slices.Index(header, "project")
+	pageCol := slices.Index(header, "page_id")
+	countCol := slices.Index(header, "view_count")
+	agentCol := slices.Index(header, "agent_type")
+	if projectCol < 0 || pageCol < 0 || countCol < 0 {
+		return fmt.Errorf("missing columns in header %q", scanner.Text())
+	}
+	numCols := max(projectCol, pageCol, countCol, agentCol) + 1
+
+	var lastWiki string
+	var lastID, lastCount int64
+	for scanner.Scan() {
+		// "en.wikipedia	3422	user	7"
+		cols := strings.Split(scanner.Text(), "\t")
+		if len(cols) < numCols {
+			continue
+		}
+		if agentCol >= 0 && cols[agentCol] != "user" {
+			continue
+		}
+
+		wiki := domains.Canonical(cols[projectCol])
+		id, err := strconv.ParseInt(cols[pageCol], 10, 64)
+		if id <= 0 || err != nil {
+			continue
+		}
+		c, err := strconv.ParseInt(cols[countCol], 10, 64)
+		if c <= 0 || err != nil {
+			continue
+		}
+
+		if wiki == lastWiki && id == lastID {
+			lastCount += c
+			continue
+		}
+		if err := sendCount(lastWiki, lastID, lastCount, ctx, out); err != nil {
+			return err
+		}
+		lastWiki, lastID, lastCount = wiki, id, c
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := sendCount(lastWiki, lastID, lastCount, ctx, out); err != nil {
+		return err
+	}
+
+	// Closing the reader also closes the file.
+	return reader.Close()
+}
@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNewPageviewsSource(t *testing.T) {
+	if s, err := NewPageviewsSource("pageview_complete", "dumps", ""); err != nil || s != (PageviewCompleteSource{Dumps: "dumps"}) {
+		t.Errorf("got %v, %v", s, err)
+	}
+	if s, err := NewPageviewsSource("pageview_actor", "dumps", "exports"); err != nil || s != (PageviewActorSource{Dir: "exports"}) {
+		t.Errorf("got %v, %v", s, err)
+	}
+	if _, err := NewPageviewsSource("pageview_actor", "dumps", ""); err == nil {
+		t.Error("expected error for pageview_actor without directory")
+	}
+	if _, err := NewPageviewsSource("foo", "dumps", ""); err == nil {
+		t.Error("expected error for unknown source")
+	}
+}
+
+func TestPageviewActorSource(t *testing.T) {
+	dir := t.TempDir()
+	day9 := filepath.Join(dir, "year=2024", "month=3", "day=9")
+	day10 := filepath.Join(dir, "year=2024", "month=3", "day=10")
+	mkdirs(t, day9)
+	mkdirs(t, day10)
+	files := map[string][]byte{
+		filepath.Join(day9, "_SUCCESS"): nil,
+		filepath.Join(day9, "part-00000.tsv"): []byte(
+			"project\tpage_id\tagent_type\tview_count\n" +
+				"en.m.wikipedia\t3422\tuser\t4\n" +
+				"en.wikipedia\t3422\tuser\t3\n" +
+				"en.wikipedia\t3422\tspider\t99\n" +
+				"rm.wikipedia\t-1\tuser\t5\n" +
+				"short line\n"),
+		filepath.Join(day9, "part-00001.tsv.gz"): gzipForTest(t,
+			"project\tpage_id\tview_count\tagent_type\n"+
+				"rm.wikipedia\t3824\t2\tuser\n"),
+
+		// Incomplete export, which should be ignored.
+		filepath.Join(day10, "part-00000.tsv"): []byte("project\tpage_id\tview_count\n"),
+	}
+	for path, data := range files {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	source := PageviewActorSource{Dir: dir}
+	latest, err := source.Latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := latest.Format(time.DateOnly), "2024-03-09"; got != want {
+		t.Errorf("got latest %s, want %s", got, want)
+	}
+
+	if _, err := source.Find(latest.AddDate(0, 0, 1)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v for incomplete export, want fs.ErrNotExist", err)
+	}
+	path, err := source.Find(latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	domains := PageviewDomains{"en.wikipedia": "en.wikipedia", "rm.wikipedia": "rm.wikipedia"}
+	ch := make(chan string, 10)
+	if err := source.Read(context.Background(), path, domains, ch); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	got := make([]string, 0, 2)
+	for line := range ch {
+		got = append(got, line)
+	}
+	want := []string{"en.wikipedia,3422,7", "rm.wikipedia,3824,2"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPageviewActorSource_Empty(t *testing.T) {
+	source := PageviewActorSource{Dir: t.TempDir()}
+	if _, err := source.Latest(); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want fs.ErrNotExist", err)
+	}
+}
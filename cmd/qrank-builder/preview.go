@@ -0,0 +1,111 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// BuildPreview builds a preview of the item signals with the freshest
+// pageviews, so that data consumers can look at new data between
+// releases. Instead of aggregating a year of pageviews, we only
+// aggregate the days of the current ISO week for which dumps are
+// available, which may be a partial week, and join them with the
+// weekly pageview files of the preceding weeks that are already
+// in storage. The preview gets published as
+// public/item_signals_preview-YYYYMMDD.csv.zst, where the date
+// is the last day of pageviews; its header tells that it is
+// a preview. Older previews get deleted from storage.
+func buildPreview(ctx context.Context, dumps string, numWeeks int, sites *WikiSites, opts BuildOptions, s3 S3) (string, error) {
+	source := opts.pageviewsSource(dumps)
+	latest, err := source.Latest()
+	if err != nil {
+		return "", err
+	}
+	year, week := latest.ISOWeek()
+	monday := ISOWeekStart(year, week)
+
+	dest := PublicPath("item_signals_preview", latest, "csv.zst")
+	partial := PreviewPageviewsPath(latest)
+	stored := make(map[string]bool, 10)
+	for _, prefix := range []string{"public/item_signals_preview-", "preview/"} {
+		opts := minio.ListObjectsOptions{Prefix: prefix, Recursive: true}
+		for obj := range s3.ListObjects(ctx, "qrank", opts) {
+			if obj.Err != nil {
+				return "", obj.Err
+			}
+			stored[obj.Key] = true
+		}
+	}
+	if stored[dest] {
+		logger.Printf("preview %s is already in storage", dest)
+		return dest, nil
+	}
+
+	// The weeks before the current one must have been built
+	// by the pageviews stage.
+	weeks, err := storedPageviews(ctx, source, s3)
+	if err != nil {
+		return "", err
+	}
+	pageviews := make([]string, 0, numWeeks)
+	for i := numWeeks - 1; i >= 1; i-- {
+		y, w := monday.AddDate(0, 0, -7*i).ISOWeek()
+		weekString := fmt.Sprintf("%04d-W%02d", y, w)
+		if _, found := slices.BinarySearch(weeks, weekString); !found {
+			return "", fmt.Errorf("pageviews for week %s not in storage; run stage pageviews first", weekString)
+		}
+		pageviews = append(pageviews, WeeklyPageviewsPath(source.Name(), weekString))
+	}
+
+	if !stored[partial] {
+		days := make([]time.Time, 0, 7)
+		for day := monday; !day.After(latest); day = day.AddDate(0, 0, 1) {
+			days = append(days, day)
+		}
+		tempDir, err := os.MkdirTemp("", "qrank-preview")
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(tempDir)
+
+		tempFile := filepath.Join(tempDir, filepath.Base(partial))
+		what := fmt.Sprintf("preview %s..%s", monday.Format(time.DateOnly), latest.Format(time.DateOnly))
+		domains := NewPageviewDomains(sites)
+		if err := buildPageviewsForDays(ctx, source, days, what, domains, tempFile); err != nil {
+			return "", err
+		}
+		if err := PutInStorage(ctx, tempFile, s3, "qrank", partial, "application/zstd"); err != nil {
+			return "", err
+		}
+	}
+	pageviews = append(pageviews, partial)
+
+	opts.preview = latest
+	if _, err := buildItemSignals(ctx, pageviews, sites, opts, s3); err != nil {
+		return "", err
+	}
+
+	for key := range stored {
+		if key == dest || key == partial {
+			continue
+		}
+		if strings.HasPrefix(key, "preview/pageviews-") || strings.HasPrefix(key, "public/item_signals_preview-") {
+			logger.Printf("deleting outdated preview %s", key)
+			if err := s3.RemoveObject(ctx, "qrank", key, minio.RemoveObjectOptions{}); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return dest, nil
+}
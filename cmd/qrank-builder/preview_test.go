@@ -0,0 +1,92 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildPreview(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	dumps := filepath.Join("testdata", "dumps")
+	s3 := NewFakeS3()
+	s3.WriteLines([]string{"de.wikipedia,585473,17"}, "pageviews/pageviews-2023-W11.zst")
+	s3.WriteLines([]string{"585473,Q72,3142"}, "page_signals/dewiki-20230301-page_signals.zst")
+	s3.WriteLines([]string{"# outdated"}, "public/item_signals_preview-20230312.csv.zst")
+	s3.WriteLines([]string{"# outdated"}, "preview/pageviews-20230312.zst")
+	dumped, _ := time.Parse(time.DateOnly, "2023-03-01")
+	dewiki := &WikiSite{Key: "dewiki", Domain: "de.wikipedia.org", LastDumped: dumped}
+	sites := &WikiSites{
+		Sites:   map[string]*WikiSite{"dewiki": dewiki},
+		Domains: map[string]*WikiSite{"de.wikipedia.org": dewiki},
+	}
+
+	got, err := buildPreview(ctx, dumps, 2, sites, BuildOptions{MinPageviews: 1000}, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "public/item_signals_preview-20230326.csv.zst"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	lines, err := s3.ReadLines(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var preview bool
+	var items []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "# preview:") {
+			preview = true
+		}
+		if strings.HasPrefix(line, "Q") {
+			items = append(items, line)
+		}
+	}
+	if !preview {
+		t.Errorf("%s does not say it is a preview", got)
+	}
+	// MinPageviews does not apply to previews, so Q72 must be there.
+	if len(items) != 1 || !strings.HasPrefix(items[0], "Q72,") {
+		t.Errorf("got items %v, want Q72", items)
+	}
+
+	var keys []string
+	for key := range s3.data {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	want := []string{
+		"page_signals/dewiki-20230301-page_signals.zst",
+		"pageviews/pageviews-2023-W11.zst",
+		"preview/pageviews-20230326.zst",
+		"public/item_signals_preview-20230326.csv.zst",
+	}
+	if !slices.Equal(keys, want) {
+		t.Errorf("got %v, want %v", keys, want)
+	}
+}
+
+func TestBuildPreview_MissingWeek(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	dumps := filepath.Join("testdata", "dumps")
+	s3 := NewFakeS3()
+	_, err := buildPreview(ctx, dumps, 3, &WikiSites{}, BuildOptions{}, s3)
+	if err == nil || !strings.Contains(err.Error(), "2023-W10 not in storage") {
+		t.Errorf("got %v, want error about missing week 2023-W10", err)
+	}
+}
@@ -0,0 +1,245 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/minio/minio-go/v7"
+)
+
+// On wikidatawiki, the pages of properties such as P31 (“instance of”)
+// are in the Property namespace, whose number is 120. Other than items,
+// properties have no sitelinks or wikitext, but their pages get viewed
+// by editors, so their pageviews tell which properties matter most.
+const wikidataPropertyNamespace = "120"
+
+var wikidataPropertyTitleRe = regexp.MustCompile(`^P\d+$`)
+
+// BuildPropertyRank ranks the properties of Wikidata by the pageviews
+// of their pages on wikidatawiki, and puts the ranking into storage
+// as public/prank-YYYYMMDD.csv.zst. The output has lines such as
+// "P31,98765", sorted by decreasing rank, so that tools can order
+// their property suggestions. Properties without any pageviews are
+// listed at the end with rank 0. If skipRedirects is true, property
+// pages that redirect to another property get left out. Like the
+// item signals of the same version, the file starts with a summary
+// of the provenance.
+func buildPropertyRank(ctx context.Context, dumps string, pageviews []string, sites *WikiSites, skipRedirects bool, s3 S3) (string, error) {
+	site, ok := sites.Sites["wikidatawiki"]
+	if !ok {
+		return "", fmt.Errorf("no dump for wikidatawiki")
+	}
+
+	version := ItemSignalsVersion(pageviews, sites)
+	dest := PublicPath("prank", version, "csv.zst")
+	for obj := range s3.ListObjects(ctx, "qrank", minio.ListObjectsOptions{Prefix: dest}) {
+		if obj.Err != nil {
+			return "", obj.Err
+		}
+		if obj.Key == dest {
+			return dest, nil
+		}
+	}
+
+	logger.Printf("building %s", dest)
+	start := time.Now()
+
+	properties, err := readPropertyPages(ctx, dumps, site, skipRedirects)
+	if err != nil {
+		return "", err
+	}
+
+	domain := strings.TrimSuffix(site.Domain, ".org")
+	views := make(map[int64]int64, len(properties))
+	for _, pv := range pageviews {
+		if err := readPropertyViews(ctx, pv, domain, properties, views, s3); err != nil {
+			return "", err
+		}
+	}
+
+	ranks := make([]PropertyRank, 0, len(properties))
+	for _, prop := range properties {
+		ranks = append(ranks, PropertyRank{Property: prop, Rank: views[prop]})
+	}
+	slices.SortFunc(ranks, func(a, b PropertyRank) int {
+		if c := cmp.Compare(b.Rank, a.Rank); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Property, b.Property)
+	})
+
+	outFile, err := os.CreateTemp("", "prank-*.csv.zst")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(outFile.Name())
+	defer outFile.Close()
+
+	writer, err := zstd.NewWriter(outFile, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		return "", err
+	}
+	defer writer.Close()
+
+	comments := NewProvenance(version, pageviews, sites).CSVComment()
+	if err := writePropertyRanks(ranks, comments, writer); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	if err := outFile.Close(); err != nil {
+		return "", err
+	}
+
+	if err := PutInStorage(ctx, outFile.Name(), s3, "qrank", dest, "application/zstd"); err != nil {
+		return "", err
+	}
+	logger.Printf("built %s with %d properties in %.1fs",
+		dest, len(ranks), time.Since(start).Seconds())
+	return dest, nil
+}
+
+// PropertyRank is the rank of a Wikidata property, such as 31 for P31.
+type PropertyRank struct {
+	Property int64
+	Rank     int64
+}
+
+// ReadPropertyPages reads the `page` table of wikidatawiki, and returns
+// which page belongs to what property. For example, an entry 4785 → 31
+// means that page 4785 is the page of property P31. If skipRedirects
+// is true, redirect pages get left out.
+func readPropertyPages(ctx context.Context, dumps string, site *WikiSite, skipRedirects bool) (map[int64]int64, error) {
+	ymd := site.LastDumped.Format("20060102")
+	fileName := fmt.Sprintf("%s-%s-page.sql.gz", site.Key, ymd)
+	file, err := openDump(ctx, filepath.Join(dumps, site.Key, ymd, fileName))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	reader, err := NewSQLReader(gz)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := reader.Columns()
+	pageCol := slices.Index(columns, "page_id")
+	namespaceCol := slices.Index(columns, "page_namespace")
+	titleCol := slices.Index(columns, "page_title")
+	redirectCol := slices.Index(columns, "page_is_redirect")
+
+	result := make(map[int64]int64, 15000)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		row, err := reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			return result, nil
+		}
+
+		if row[namespaceCol] != wikidataPropertyNamespace {
+			continue
+		}
+		if skipRedirects && redirectCol >= 0 && row[redirectCol] == "1" {
+			continue
+		}
+		title := row[titleCol]
+		if !wikidataPropertyTitleRe.MatchString(title) {
+			continue
+		}
+		page, err := strconv.ParseInt(row[pageCol], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		prop, err := strconv.ParseInt(title[1:], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		result[page] = prop
+	}
+}
+
+// ReadPropertyViews reads a weekly pageviews file from storage, and adds
+// the views of property pages on `domain` to `views`, keyed by property.
+func readPropertyViews(ctx context.Context, path string, domain string, properties map[int64]int64, views map[int64]int64, s3 S3) error {
+	opts := S3ReaderOptions{Compression: ZstdCompressed}
+	reader, err := NewS3ReaderWithOptions(ctx, "qrank", path, s3, opts)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	prefix := domain + ","
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		rest, ok := strings.CutPrefix(scanner.Text(), prefix)
+		if !ok {
+			continue
+		}
+		page, count, ok := strings.Cut(rest, ",")
+		if !ok {
+			return fmt.Errorf("%s: bad line %q", path, scanner.Text())
+		}
+		p, err := strconv.ParseInt(page, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: bad line %q", path, scanner.Text())
+		}
+		prop, ok := properties[p]
+		if !ok {
+			continue
+		}
+		c, err := strconv.ParseInt(count, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: bad line %q", path, scanner.Text())
+		}
+		views[prop] += c
+	}
+	return scanner.Err()
+}
+
+// WritePropertyRanks writes property ranks in CSV format.
+func writePropertyRanks(ranks []PropertyRank, comments []string, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if err := writeCSVComments(bw, comments); err != nil {
+		return err
+	}
+	if _, err := bw.WriteString("Property,PRank\n"); err != nil {
+		return err
+	}
+	for _, r := range ranks {
+		if _, err := fmt.Fprintf(bw, "P%d,%d\n", r.Property, r.Rank); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
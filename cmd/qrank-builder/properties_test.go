@@ -0,0 +1,115 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"maps"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestBuildPropertyRank(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	dumps := filepath.Join("testdata", "dumps")
+	sites, err := ReadWikiSites(nil, dumps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s3 := NewFakeS3()
+	pageviews := []string{
+		"pageviews/pageviews-2024-W16.zst",
+		"pageviews/pageviews-2024-W17.zst",
+	}
+	s3.WriteLines([]string{
+		"rm.wikipedia,4785,1000",
+		"www.wikidata,200,17",
+		"www.wikidata,4785,5",
+		"www.wikidata,7021,8",
+	}, pageviews[0])
+	s3.WriteLines([]string{
+		"www.wikidata,4785,7",
+	}, pageviews[1])
+
+	path, err := buildPropertyRank(ctx, dumps, pageviews, sites, true, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "public/prank-20240501.csv.zst"; path != want {
+		t.Errorf("got %q, want %q", path, want)
+	}
+
+	got, err := s3.ReadLines(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"# version: 2024-05-01",
+		"# commit: " + BuilderCommit(),
+		"# pageviews: 2024-W16..2024-W17",
+		"# provenance: qrank-meta-20240501.json",
+		"Property,PRank", "P31,12", "P625,8", "P17,0",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// A second run should find the ranking in storage.
+	s3.data[path] = []byte("already built")
+	if _, err := buildPropertyRank(ctx, dumps, pageviews, sites, true, s3); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(s3.data[path]); got != "already built" {
+		t.Errorf("existing ranking should not be rebuilt, got %q", got)
+	}
+}
+
+func TestReadPropertyPages(t *testing.T) {
+	dumps := filepath.Join("testdata", "dumps")
+	sites, err := ReadWikiSites(nil, dumps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, skipRedirects := range []bool{false, true} {
+		got, err := readPropertyPages(context.Background(), dumps, sites.Sites["wikidatawiki"], skipRedirects)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[int64]int64{3837: 17, 4785: 31, 7021: 625, 7044300: 9999}
+		if skipRedirects {
+			delete(want, 7044300)
+		}
+		if !maps.Equal(got, want) {
+			t.Errorf("skipRedirects=%v: got %v, want %v", skipRedirects, got, want)
+		}
+	}
+}
+
+func TestReadPropertyViews_BadLine(t *testing.T) {
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	s3.WriteLines([]string{"www.wikidata,4785"}, "pageviews/pageviews-2024-W16.zst")
+	properties := map[int64]int64{4785: 31}
+	views := make(map[int64]int64)
+	err := readPropertyViews(ctx, "pageviews/pageviews-2024-W16.zst", "www.wikidata", properties, views, s3)
+	if err == nil {
+		t.Error("expected error for bad line")
+	}
+}
+
+func TestWritePropertyRanks(t *testing.T) {
+	var buf bytes.Buffer
+	ranks := []PropertyRank{{31, 12}, {625, 0}}
+	if err := writePropertyRanks(ranks, nil, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "Property,PRank\nP31,12\nP625,0\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
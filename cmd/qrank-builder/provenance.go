@@ -0,0 +1,182 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// Provenance describes how a data release was built, so that users
+// can find out what inputs went into a particular output file.
+// It gets published as a sidecar JSON file next to the data,
+// and a summary is also included as comment lines in CSV outputs.
+type Provenance struct {
+	Version       string             `json:"version"`           // eg. "2024-05-01"
+	Commit        string             `json:"commit"`            // git commit of qrank-builder
+	Dumps         map[string]string  `json:"dumps"`             // site key → dump date
+	PageviewWeeks []string           `json:"pageview_weeks"`    // eg. ["2024-W17", "2024-W18"]
+	Weights       map[string]float64 `json:"weights,omitempty"` // weight configuration
+
+	// Disambiguation is the policy for ranking disambiguation items,
+	// such as "demote". Empty if they were ranked like other items.
+	Disambiguation string `json:"disambiguation,omitempty"`
+
+	// FormulaVersion tells how the pageviews_52w of items were computed
+	// from the pageviews of their pages; see rankFormulaVersion.
+	FormulaVersion int `json:"formula_version"`
+
+	// DisambiguationDemotion is the factor by which the pageviews of
+	// disambiguation items were scaled, or zero if they were not.
+	DisambiguationDemotion float64 `json:"disambiguation_demotion,omitempty"`
+
+	// MinPageviews is the threshold below which items were left out
+	// from the published item_signals file, or zero if none were.
+	MinPageviews int64 `json:"min_pageviews,omitempty"`
+
+	// MaxWeekMultiple is the multiple of the median week at which
+	// the weekly pageviews of an item were capped, or zero if they
+	// were not.
+	MaxWeekMultiple float64 `json:"max_week_multiple,omitempty"`
+
+	// SitelinksFromDump tells whether sitelinks were counted in the
+	// wb_items_per_site dump instead of taken from page properties.
+	SitelinksFromDump bool `json:"sitelinks_from_dump,omitempty"`
+
+	// ExcludeStubs tells whether items that looked like stubs,
+	// holding nothing but external identifiers, were left out.
+	ExcludeStubs bool `json:"exclude_stubs,omitempty"`
+
+	// Sample tells which wikis and items went into a test run,
+	// or nil if the release was built from all data.
+	Sample *BuildSample `json:"sample,omitempty"`
+}
+
+// NewProvenance collects provenance metadata for a build.
+func NewProvenance(version time.Time, pageviews []string, sites *WikiSites) *Provenance {
+	p := &Provenance{
+		Version:        version.Format(time.DateOnly),
+		Commit:         BuilderCommit(),
+		FormulaVersion: rankFormulaVersion,
+		Dumps:          make(map[string]string, len(sites.Sites)),
+		PageviewWeeks:  make([]string, 0, len(pageviews)),
+	}
+
+	for key, site := range sites.Sites {
+		p.Dumps[key] = site.LastDumped.Format(time.DateOnly)
+	}
+
+	for _, pv := range pageviews {
+		if week, ok := ParseWeeklyPageviewsPath(pv); ok {
+			p.PageviewWeeks = append(p.PageviewWeeks, week)
+		}
+	}
+	sort.Strings(p.PageviewWeeks)
+
+	return p
+}
+
+// BuilderCommit returns the git commit from which the running binary
+// was built, or "unknown" if this information is not available.
+// Go embeds version control information when building binaries
+// from a git checkout, see https://pkg.go.dev/runtime/debug#BuildInfo.
+func BuilderCommit() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	var revision string
+	var modified bool
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+
+	if revision == "" {
+		return "unknown"
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// PageviewRange returns the first and last week of pageviews that went
+// into the build, or empty strings if there were no pageviews.
+func (p *Provenance) PageviewRange() (first, last string) {
+	if n := len(p.PageviewWeeks); n > 0 {
+		return p.PageviewWeeks[0], p.PageviewWeeks[n-1]
+	}
+	return "", ""
+}
+
+// CSVComment returns a short summary of the provenance, formatted
+// as comment lines for the beginning of a CSV file.
+func (p *Provenance) CSVComment() []string {
+	ymd := p.Version[0:4] + p.Version[5:7] + p.Version[8:10]
+	first, last := p.PageviewRange()
+	return []string{
+		fmt.Sprintf("# version: %s", p.Version),
+		fmt.Sprintf("# commit: %s", p.Commit),
+		fmt.Sprintf("# pageviews: %s..%s", first, last),
+		fmt.Sprintf("# provenance: qrank-meta-%s.json", ymd),
+	}
+}
+
+// WriteCSVComments writes comment lines, such as the ones returned by
+// CSVComment(), to the beginning of a CSV file.
+func writeCSVComments(w io.Writer, comments []string) error {
+	for _, c := range comments {
+		if _, err := io.WriteString(w, c+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StoragePath returns the path of the provenance file in S3 storage.
+func (p *Provenance) StoragePath() string {
+	t, _ := time.Parse(time.DateOnly, p.Version)
+	return PublicPath("qrank-meta", t, "json")
+}
+
+// Put stores the provenance as a JSON file in S3 storage.
+func (p *Provenance) Put(ctx context.Context, s3 S3) error {
+	return PutJSON(ctx, p, s3, "qrank", p.StoragePath())
+}
+
+// ReadProvenance returns the provenance file of a release in storage
+// as raw JSON, or nil if there is none, such as for releases built
+// before provenance files were introduced.
+func ReadProvenance(ctx context.Context, version time.Time, s3 S3) ([]byte, error) {
+	path := PublicPath("qrank-meta", version, "json")
+	if found, err := objectExists(ctx, path, s3); err != nil || !found {
+		return nil, err
+	}
+
+	r, err := NewS3Reader(ctx, "qrank", path, s3)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("%s: not valid JSON", path)
+	}
+	return data, nil
+}
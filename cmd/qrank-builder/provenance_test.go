@@ -0,0 +1,63 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestProvenance(t *testing.T) {
+	rmDumped, _ := time.Parse(time.DateOnly, "2024-03-01")
+	wdDumped, _ := time.Parse(time.DateOnly, "2024-04-01")
+	sites := &WikiSites{
+		Sites: map[string]*WikiSite{
+			"rmwiki":       &WikiSite{Key: "rmwiki", LastDumped: rmDumped},
+			"wikidatawiki": &WikiSite{Key: "wikidatawiki", LastDumped: wdDumped},
+		},
+	}
+	pageviews := []string{
+		"pageviews/pageviews-2024-W14.zst",
+		"pageviews/pageviews-2024-W12.zst",
+		"pageviews/pageviews-2024-W13.zst",
+	}
+	version, _ := time.Parse(time.DateOnly, "2024-04-07")
+	p := NewProvenance(version, pageviews, sites)
+
+	wantDumps := map[string]string{"rmwiki": "2024-03-01", "wikidatawiki": "2024-04-01"}
+	if !reflect.DeepEqual(p.Dumps, wantDumps) {
+		t.Errorf("got %v, want %v", p.Dumps, wantDumps)
+	}
+
+	if first, last := p.PageviewRange(); first != "2024-W12" || last != "2024-W14" {
+		t.Errorf("got PageviewRange() = %s, %s; want 2024-W12, 2024-W14", first, last)
+	}
+
+	got := p.CSVComment()
+	want := []string{
+		"# version: 2024-04-07",
+		"# commit: " + p.Commit,
+		"# pageviews: 2024-W12..2024-W14",
+		"# provenance: qrank-meta-20240407.json",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	s3 := NewFakeS3()
+	if err := p.Put(context.Background(), s3); err != nil {
+		t.Fatal(err)
+	}
+	var stored Provenance
+	if err := json.Unmarshal(s3.data["public/qrank-meta-20240407.json"], &stored); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&stored, p) {
+		t.Errorf("got %v, want %v", stored, *p)
+	}
+}
@@ -13,7 +13,6 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -44,6 +43,9 @@ func QRankFromBytes(b []byte) extsort.SortType {
 
 func QRankLess(a, b extsort.SortType) bool {
 	// Sort by decreasing rank, or (as secondary key) increasing entity ID.
+	// Without the secondary key, the order of entities with equal rank
+	// would depend on the chunking of the external sort, which would make
+	// diffs between releases noisy even when the inputs are the same.
 	x, y := a.(QRank), b.(QRank)
 	if x.Rank != y.Rank {
 		return x.Rank > y.Rank
@@ -89,9 +91,8 @@ func buildQRank(date time.Time, qviews string, outDir string, ctx context.Contex
 
 	ch := make(chan extsort.SortType, 50000)
 	g, subCtx := errgroup.WithContext(context.Background())
-	config := extsort.DefaultConfig()
-	config.NumWorkers = runtime.NumCPU()
-	sorter, outChan, errChan := extsort.New(ch, QRankFromBytes, QRankLess, config)
+	config := newSortConfig(8)
+	sorter, outChan, errChan := extsort.New(sortInput(subCtx, "qrank", ch, config), QRankFromBytes, QRankLess, config)
 	g.Go(func() error {
 		return readQViews(brotli.NewReader(qviewsFile), ch, subCtx)
 	})
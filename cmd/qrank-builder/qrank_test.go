@@ -5,7 +5,10 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"math/rand"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -31,3 +34,35 @@ func TestBuildQRank(t *testing.T) {
 		t.Errorf("expected %q, got %q", expected, got)
 	}
 }
+
+// Entities with equal counts must come out in a well-defined order,
+// no matter in which order they appear in the input.
+func TestBuildQRank_Ties(t *testing.T) {
+	var want strings.Builder
+	want.WriteString("Entity,QRank\n")
+	lines := make([]string, 0, 2000)
+	for i := 1; i <= 2000; i++ {
+		lines = append(lines, fmt.Sprintf("Q%d %d\n", i, i%3))
+	}
+	for count := 2; count >= 0; count-- {
+		for i := 1; i <= 2000; i++ {
+			if i%3 == count {
+				fmt.Fprintf(&want, "Q%d,%d\n", i, count)
+			}
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(7))
+	for run := 0; run < 2; run++ {
+		rnd.Shuffle(len(lines), func(i, j int) { lines[i], lines[j] = lines[j], lines[i] })
+		qviews := filepath.Join(t.TempDir(), "TestQRank-qviews.br")
+		writeBrotli(qviews, strings.Join(lines, ""))
+		path, err := buildQRank(time.Now(), qviews, t.TempDir(), context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readGzipFile(path); got != want.String() {
+			t.Errorf("run %d: output not in expected order", run)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// SiteFailure is a site whose per-site file could not be built.
+type siteFailure struct {
+	site string // eg. "rmwiki"
+	err  error
+}
+
+// SiteQuarantine keeps track of the sites that have been quarantined
+// during a run. The limit on their pageview share applies to the run
+// as a whole, so a series of stages cannot each quarantine another
+// batch of sites. A nil *siteQuarantine quarantines nothing.
+type siteQuarantine struct {
+	maxShare float64
+	share    float64              // combined share of quarantined sites
+	fallback map[string]time.Time // site key → dump date of stored file, zero if none
+}
+
+func newSiteQuarantine(maxShare float64) *siteQuarantine {
+	return &siteQuarantine{maxShare: maxShare, fallback: make(map[string]time.Time, 4)}
+}
+
+func (q *siteQuarantine) enabled() bool {
+	return q != nil && q.maxShare > 0
+}
+
+// QuarantineSites decides whether a per-site stage may carry on although
+// building the files of some sites has failed. A single malformed dump
+// of a tiny wiki should not stop the release for everyone else, so the
+// failed sites get quarantined if, taken together with the sites that
+// have already been quarantined earlier in the run, they account for
+// at most q.maxShare of the pageviews in the latest week. Quarantined
+// sites get listed in the build report. For the rest of the run,
+// they use their most recent file in storage, or they get left out
+// if there is no such file; see apply(). If quarantine is disabled,
+// or if the failed sites are too popular, the error of the first failed
+// site is returned.
+func quarantineSites(ctx context.Context, filename string, failures []siteFailure, stored map[string][]string, sites *WikiSites, q *siteQuarantine, s3 S3) error {
+	if len(failures) == 0 {
+		return nil
+	}
+	slices.SortFunc(failures, func(a, b siteFailure) int { return strings.Compare(a.site, b.site) })
+	first := failures[0]
+	firstErr := fmt.Errorf("%s: %w", first.site, first.err)
+	if !q.enabled() {
+		return firstErr
+	}
+
+	shares, err := readSitePageviewShares(ctx, s3)
+	if err != nil {
+		return fmt.Errorf("%w; cannot tell pageview share of failed sites: %v", firstErr, err)
+	}
+	siteShare := func(key string) float64 {
+		if site, ok := sites.Sites[key]; ok {
+			return shares[strings.TrimSuffix(site.Domain, ".org")]
+		}
+		return 0.0
+	}
+
+	// A site that has already been quarantined by an earlier stage
+	// does not count twice towards the limit.
+	share := 0.0
+	for _, f := range failures {
+		if _, seen := q.fallback[f.site]; !seen {
+			share += siteShare(f.site)
+		}
+	}
+	if q.share+share > q.maxShare {
+		return fmt.Errorf("building %s failed for %d sites with %.3f%% of pageviews, which together with %.3f%% quarantined earlier is more than the limit of %.3f%%: %w",
+			filename, len(failures), share*100, q.share*100, q.maxShare*100, firstErr)
+	}
+
+	quarantined := make([]string, 0, len(failures))
+	for _, f := range failures {
+		logger.Printf("quarantining %s for %s, which has %.4f%% of pageviews: %v",
+			f.site, filename, siteShare(f.site)*100, f.err)
+		quarantined = append(quarantined, f.site)
+		q.fallBackToStored(f.site, stored[f.site])
+	}
+	q.share += share
+	reportStepFrom(ctx).addQuarantined(share, quarantined...)
+	return nil
+}
+
+// FallBackToStored makes a quarantined site use its most recent file
+// in storage for the rest of the run, by pretending that its last dump
+// was the one from which that file was built. If no file is stored,
+// the site gets left out. When a site fails in several stages, the
+// fallback of the earliest stage wins.
+func (q *siteQuarantine) fallBackToStored(key string, versions []string) {
+	if _, seen := q.fallback[key]; seen {
+		return
+	}
+	var date time.Time
+	if n := len(versions); n > 0 {
+		if d, err := time.Parse("20060102", versions[n-1]); err == nil {
+			date = d
+		}
+	}
+	q.fallback[key] = date
+}
+
+// Apply returns the sites as seen by the rest of the run, with the
+// fallbacks of quarantined sites. The passed sites are left untouched;
+// if any site has been quarantined, the result is a modified copy.
+func (q *siteQuarantine) apply(sites *WikiSites) *WikiSites {
+	if q == nil || len(q.fallback) == 0 {
+		return sites
+	}
+	result := &WikiSites{
+		Sites:   make(map[string]*WikiSite, len(sites.Sites)),
+		Domains: make(map[string]*WikiSite, len(sites.Domains)),
+	}
+	for key, site := range sites.Sites {
+		date, quarantined := q.fallback[key]
+		if quarantined {
+			if date.IsZero() {
+				continue
+			}
+			s := *site
+			s.LastDumped = date
+			site = &s
+		}
+		result.Sites[key] = site
+		result.Domains[site.Domain] = site
+	}
+	return result
+}
+
+// ReadSitePageviewShares returns the share of each site in the pageviews
+// of the latest week in storage. Sites are identified by their domain
+// without ".org", such as "rm.wikipedia", like in the pageviews files.
+// For telling how popular a site is, the weekly file of any pageviews
+// source will do.
+func readSitePageviewShares(ctx context.Context, s3 S3) (map[string]float64, error) {
+	var path, latest string
+	listOpts := minio.ListObjectsOptions{Prefix: "pageviews/", Recursive: true}
+	for obj := range s3.ListObjects(ctx, "qrank", listOpts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if week, ok := ParseWeeklyPageviewsPath(obj.Key); ok && week > latest {
+			path, latest = obj.Key, week
+		}
+	}
+	if path == "" {
+		return nil, fmt.Errorf("no pageviews in storage")
+	}
+
+	opts := S3ReaderOptions{Compression: ZstdCompressed}
+	reader, err := NewS3ReaderWithOptions(ctx, "qrank", path, s3, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// Lines look like "rm.wikipedia,3824,7", and are sorted by domain.
+	views := make(map[string]int64, 1000)
+	var total int64
+	scanner := NewLineScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		domainEnd := bytes.IndexByte(line, ',')
+		countStart := bytes.LastIndexByte(line, ',')
+		if domainEnd <= 0 || countStart <= domainEnd {
+			continue
+		}
+		count, err := strconv.ParseInt(string(line[countStart+1:]), 10, 64)
+		if err != nil || count <= 0 {
+			continue
+		}
+		views[string(line[:domainEnd])] += count
+		total += count
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	shares := make(map[string]float64, len(views))
+	for domain, n := range views {
+		shares[domain] = float64(n) / float64(total)
+	}
+	return shares, nil
+}
@@ -0,0 +1,200 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildSiteFiles_Quarantine(t *testing.T) {
+	for _, tc := range []struct {
+		failing  string
+		maxShare float64
+		wantErr  bool
+	}{
+		{"rmwiki", 0.001, false},
+		{"rmwiki", 0, true},
+		{"wikidatawiki", 0.001, true},
+	} {
+		name := fmt.Sprintf("%s-%v", tc.failing, tc.maxShare)
+		t.Run(name, func(t *testing.T) {
+			logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+			ctx := withBuildReport(context.Background(), NewBuildReport(time.Now()))
+			ctx, step := startReportStep(ctx, "page-signals")
+			s3 := NewFakeS3()
+			s3.data["foobar/rmwiki-20030203-foobar.zst"] = []byte("old-2003")
+			writeTestSitePageviews(t, s3)
+
+			dumps := filepath.Join("testdata", "dumps")
+			sites, err := ReadWikiSites(nil, dumps)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buildFunc := func(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
+				if site.Key == tc.failing {
+					return fmt.Errorf("malformed page_props")
+				}
+				ymd := site.LastDumped.Format("20060102")
+				path := fmt.Sprintf("foobar/%s-%s-foobar.zst", site.Key, ymd)
+				s3.(*FakeS3).put(path, []byte("fresh"))
+				return nil
+			}
+			q := newSiteQuarantine(tc.maxShare)
+			err = buildSiteFiles(ctx, "foobar", "", buildFunc, dumps, sites, q, s3)
+			if tc.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "malformed page_props") {
+					t.Errorf("got %v, want error about malformed page_props", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(step.Quarantined, []string{"rmwiki"}) {
+				t.Errorf("got quarantined %v, want [rmwiki]", step.Quarantined)
+			}
+			if math.Abs(step.QuarantinedShare-0.0001) > 1e-9 {
+				t.Errorf("got quarantined share %v, want 0.0001", step.QuarantinedShare)
+			}
+
+			// For the rest of the run, rmwiki uses its stored file.
+			if got := q.apply(sites).Sites["rmwiki"].S3Path("foobar"); got != "foobar/rmwiki-20030203-foobar.zst" {
+				t.Errorf("got %s, want fallback to stored file", got)
+			}
+
+			// The sites passed to buildSiteFiles() stay untouched.
+			if got := sites.Sites["rmwiki"].S3Path("foobar"); got == "foobar/rmwiki-20030203-foobar.zst" {
+				t.Errorf("quarantine should not modify the passed sites, got %s", got)
+			}
+			if _, ok := s3.data["foobar/rmwiki-20030203-foobar.zst"]; !ok {
+				t.Error("stored file of quarantined site should be kept")
+			}
+			if _, ok := s3.data["foobar/wikidatawiki-20240401-foobar.zst"]; !ok {
+				t.Error("other sites should have been built")
+			}
+		})
+	}
+}
+
+func TestSiteQuarantine_Apply(t *testing.T) {
+	rm := &WikiSite{Key: "rmwiki", Domain: "rm.wikipedia.org", LastDumped: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)}
+	de := &WikiSite{Key: "dewiki", Domain: "de.wikipedia.org"}
+	sites := &WikiSites{
+		Sites:   map[string]*WikiSite{"rmwiki": rm, "dewiki": de},
+		Domains: map[string]*WikiSite{"rm.wikipedia.org": rm, "de.wikipedia.org": de},
+	}
+
+	q := newSiteQuarantine(0.001)
+	if got := q.apply(sites); got != sites {
+		t.Error("without quarantined sites, apply() should return its input")
+	}
+
+	q.fallBackToStored("rmwiki", []string{"20230101", "20240101"})
+	q.fallBackToStored("rmwiki", nil) // earliest fallback wins
+	got := q.apply(sites)
+	if d := got.Sites["rmwiki"].LastDumped.Format(time.DateOnly); d != "2024-01-01" {
+		t.Errorf("got %s, want 2024-01-01", d)
+	}
+	if got.Domains["rm.wikipedia.org"] != got.Sites["rmwiki"] {
+		t.Error("domain should map to the fallback site")
+	}
+	if d := rm.LastDumped.Format(time.DateOnly); d != "2024-04-01" {
+		t.Errorf("original site should be untouched, got %s", d)
+	}
+
+	q.fallBackToStored("dewiki", nil)
+	got = q.apply(sites)
+	if _, ok := got.Sites["dewiki"]; ok {
+		t.Error("site without stored file should be left out")
+	}
+	if _, ok := got.Domains["de.wikipedia.org"]; ok {
+		t.Error("domain of site without stored file should be left out")
+	}
+	if len(sites.Sites) != 2 || len(sites.Domains) != 2 {
+		t.Errorf("original sites should be untouched, got %v", sites.Sites)
+	}
+}
+
+func TestQuarantineSites_SharePerRun(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := withBuildReport(context.Background(), NewBuildReport(time.Now()))
+	s3 := NewFakeS3()
+	writeTestSitePageviews(t, s3)
+	sites, err := ReadWikiSites(nil, filepath.Join("testdata", "dumps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := newSiteQuarantine(0.00015)
+	failed := []siteFailure{{"rmwiki", fmt.Errorf("malformed")}}
+	if err := quarantineSites(ctx, "foo", failed, nil, sites, q, s3); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same site failing again does not count twice.
+	failed = []siteFailure{{"rmwiki", fmt.Errorf("malformed")}}
+	if err := quarantineSites(ctx, "bar", failed, nil, sites, q, s3); err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(q.share-0.0001) > 1e-9 {
+		t.Errorf("got share %v, want 0.0001", q.share)
+	}
+
+	// Another site would bring the run above the limit, although
+	// on its own, it would be within.
+	failed = []siteFailure{{"rmwikibooks", fmt.Errorf("malformed")}}
+	if err := quarantineSites(ctx, "baz", failed, nil, sites, q, s3); err == nil {
+		t.Error("want error for exceeding the limit of the run")
+	}
+}
+
+func TestReadSitePageviewShares(t *testing.T) {
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	if _, err := readSitePageviewShares(ctx, s3); err == nil {
+		t.Error("expected error when storage has no pageviews")
+	}
+
+	writeTestSitePageviews(t, s3)
+	shares, err := readSitePageviewShares(ctx, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for domain, want := range map[string]float64{
+		"rm.wikipedia": 0.0001,
+		"rm.wikibooks": 0.0001,
+		"www.wikidata": 0.9998,
+	} {
+		if got := shares[domain]; math.Abs(got-want) > 1e-9 {
+			t.Errorf("%s: got %v, want %v", domain, got, want)
+		}
+	}
+}
+
+func writeTestSitePageviews(t *testing.T, s3 *FakeS3) {
+	// An older week, which should be ignored.
+	if err := s3.WriteLines([]string{"rm.wikipedia,1,5000"}, "pageviews/pageviews-2024-W09.zst"); err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{
+		"rm.wikibooks,1,1",
+		"rm.wikipedia,1,1",
+		"www.wikidata,1,4999",
+		"www.wikidata,2,4999",
+	}
+	if err := s3.WriteLines(lines, "pageviews/pageviews-2024-W10.zst"); err != nil {
+		t.Fatal(err)
+	}
+}
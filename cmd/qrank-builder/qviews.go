@@ -4,7 +4,6 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/binary"
@@ -12,7 +11,6 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -21,6 +19,8 @@ import (
 
 	"github.com/andybalholm/brotli"
 	"github.com/lanrat/extsort"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/compress"
 )
 
 type QViewCount struct {
@@ -42,7 +42,14 @@ func QViewCountFromBytes(b []byte) extsort.SortType {
 }
 
 func QViewCountLess(a, b extsort.SortType) bool {
-	return a.(QViewCount).entity < b.(QViewCount).entity
+	// Sort by entity, and (as secondary key) by count. Although the counts
+	// get summed up anyway, a total order keeps the output independent
+	// of how the external sort happens to split its input into chunks.
+	aa, bb := a.(QViewCount), b.(QViewCount)
+	if aa.entity != bb.entity {
+		return aa.entity < bb.entity
+	}
+	return aa.count < bb.count
 }
 
 func buildQViews(testRun bool, date time.Time, sitelinks string, pageviews []string, outDir string, ctx context.Context) (string, error) {
@@ -79,7 +86,11 @@ func buildQViews(testRun bool, date time.Time, sitelinks string, pageviews []str
 
 	qfiles := make([]io.Reader, 1, len(pageviews)+1)
 	qfilenames := make([]string, 1, len(pageviews)+1)
-	qfiles[0] = brotli.NewReader(sitelinksFile)
+	sitelinksReader, err := compress.NewReaderForName(sitelinks, sitelinksFile)
+	if err != nil {
+		return "", err
+	}
+	qfiles[0] = sitelinksReader
 	qfilenames[0] = sitelinks
 	for _, pv := range pageviews {
 		pvFile, err := os.Open(pv)
@@ -87,15 +98,18 @@ func buildQViews(testRun bool, date time.Time, sitelinks string, pageviews []str
 			return "", err
 		}
 		defer pvFile.Close()
-		qfiles = append(qfiles, brotli.NewReader(pvFile))
+		pvReader, err := compress.NewReaderForName(pv, pvFile)
+		if err != nil {
+			return "", err
+		}
+		qfiles = append(qfiles, pvReader)
 		qfilenames = append(qfilenames, pv)
 	}
 
 	ch := make(chan extsort.SortType, 10000)
 	g, subCtx := errgroup.WithContext(context.Background())
-	config := extsort.DefaultConfig()
-	config.NumWorkers = runtime.NumCPU()
-	sorter, outChan, errChan := extsort.New(ch, QViewCountFromBytes, QViewCountLess, config)
+	config := newSortConfig(8)
+	sorter, outChan, errChan := extsort.New(sortInput(subCtx, "qviews", ch, config), QViewCountFromBytes, QViewCountLess, config)
 	g.Go(func() error {
 		return readQViewInputs(testRun, qfiles, qfilenames, ch, subCtx)
 	})
@@ -164,7 +178,7 @@ func readQViewInputs(testRun bool, inputs []io.Reader, inputNames []string, ch c
 	defer close(ch)
 	scanners := make([]LineScanner, 0, len(inputs))
 	for _, input := range inputs {
-		scanners = append(scanners, bufio.NewScanner(input))
+		scanners = append(scanners, NewLineScanner(input))
 	}
 	merger := NewLineMerger(scanners, inputNames)
 	var lastKey string
@@ -0,0 +1,300 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// BuildReport tells what a run of the pipeline did, so that operators
+// can find out how long each stage took on each site, and from which
+// inputs an output was built. The report gets stored in S3 storage as
+// internal/qrank-builder/report-YYYYMMDD.json. Because stages are often
+// run as separate jobs, all runs on the same day go into the same report.
+//
+// The report travels to the build functions inside their context.
+// Reads from the dumps via openDump(), reads from storage via
+// NewS3Reader(), and writes to storage via PutInStorage() get recorded
+// in the step whose context was passed to them.
+type BuildReport struct {
+	Date   string        `json:"date"`   // eg. "2024-05-01"
+	Commit string        `json:"commit"` // git commit of qrank-builder
+	Steps  []*ReportStep `json:"steps"`
+
+	mutex sync.Mutex
+}
+
+// ReportStep describes one stage of the pipeline, or the work that a
+// stage did for one site. The bytes of a site’s step are not included
+// in the step of its stage.
+type ReportStep struct {
+	Stage        string         `json:"stage"`          // eg. "titles"
+	Site         string         `json:"site,omitempty"` // eg. "rmwiki"
+	Start        time.Time      `json:"start"`
+	End          time.Time      `json:"end"`
+	Error        string         `json:"error,omitempty"`
+	Inputs       []ReportObject `json:"inputs,omitempty"`
+	Outputs      []ReportObject `json:"outputs,omitempty"`
+	BytesRead    int64          `json:"bytes_read"`
+	BytesWritten int64          `json:"bytes_written"`
+	Pending      []string       `json:"pending,omitempty"` // left for next run, see ErrMaxRuntime
+
+	// Quarantined lists the sites whose failure was tolerated, see
+	// quarantineSites(), and QuarantinedShare is their combined share
+	// of pageviews.
+	Quarantined      []string `json:"quarantined,omitempty"`
+	QuarantinedShare float64  `json:"quarantined_share,omitempty"`
+
+	// Unreconciled lists the monthly pageview dumps that could not be
+	// checked against a daily dump, see reconcileMonthlyPageviews().
+	Unreconciled []string `json:"unreconciled,omitempty"`
+
+	// InterwikiMap tells where the step got the interwiki map from,
+	// and how old it was; see loadInterwikiMap().
+	InterwikiMap *ReportCache `json:"interwiki_map,omitempty"`
+
+	report *BuildReport
+	mutex  sync.Mutex
+}
+
+// ReportObject is an input or output of a step. For files in storage,
+// the ETag identifies the version that was read or written; files in
+// the dumps have no ETag, but their paths contain the dump date.
+type ReportObject struct {
+	Path string `json:"path"`
+	ETag string `json:"etag,omitempty"`
+	Size int64  `json:"size"`
+}
+
+// ReportCache describes data that was either fetched over the network,
+// or taken from a copy that an earlier run has cached in storage.
+type ReportCache struct {
+	Source  string    `json:"source"` // "network", "cache" or "stale-cache"
+	Fetched time.Time `json:"fetched"`
+	AgeDays float64   `json:"age_days"`
+}
+
+type buildReportKey struct{}
+type reportStepKey struct{}
+
+// NewBuildReport returns an empty report for a run on the given day.
+func NewBuildReport(date time.Time) *BuildReport {
+	return &BuildReport{
+		Date:   date.UTC().Format(time.DateOnly),
+		Commit: BuilderCommit(),
+		Steps:  make([]*ReportStep, 0, 16),
+	}
+}
+
+// WithBuildReport returns a context for running stages whose
+// work should get recorded in a report.
+func withBuildReport(ctx context.Context, r *BuildReport) context.Context {
+	return context.WithValue(ctx, buildReportKey{}, r)
+}
+
+// StartReportStep starts recording a stage of the pipeline. If ctx has
+// no report, the returned step is nil, whose methods do nothing.
+func startReportStep(ctx context.Context, stage string) (context.Context, *ReportStep) {
+	r, _ := ctx.Value(buildReportKey{}).(*BuildReport)
+	if r == nil {
+		return ctx, nil
+	}
+	return r.start(ctx, stage, "")
+}
+
+// StartSiteReportStep starts recording the work for one site
+// within the stage whose step is in ctx.
+func startSiteReportStep(ctx context.Context, site string) (context.Context, *ReportStep) {
+	parent := reportStepFrom(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.report.start(ctx, parent.Stage, site)
+}
+
+func (r *BuildReport) start(ctx context.Context, stage string, site string) (context.Context, *ReportStep) {
+	step := &ReportStep{Stage: stage, Site: site, Start: time.Now().UTC(), report: r}
+	r.mutex.Lock()
+	r.Steps = append(r.Steps, step)
+	r.mutex.Unlock()
+	return context.WithValue(ctx, reportStepKey{}, step), step
+}
+
+// ReportStepFrom returns the step that is being recorded in ctx, or nil.
+func reportStepFrom(ctx context.Context) *ReportStep {
+	step, _ := ctx.Value(reportStepKey{}).(*ReportStep)
+	return step
+}
+
+// Finish records the end of a step, and whether it failed.
+func (s *ReportStep) finish(err error) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.End = time.Now().UTC()
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	// Concurrent workers record their objects in random order.
+	byPath := func(a, b ReportObject) int { return strings.Compare(a.Path, b.Path) }
+	slices.SortFunc(s.Inputs, byPath)
+	slices.SortFunc(s.Outputs, byPath)
+}
+
+func (s *ReportStep) addInput(obj ReportObject) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Inputs = append(s.Inputs, obj)
+	s.BytesRead += obj.Size
+}
+
+func (s *ReportStep) addOutput(obj ReportObject) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Outputs = append(s.Outputs, obj)
+	s.BytesWritten += obj.Size
+}
+
+// AddPending records work, such as the sites of a stage, that has been
+// left for the next run because the maximum runtime was exceeded.
+func (s *ReportStep) addPending(work ...string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Pending = append(s.Pending, work...)
+}
+
+// AddQuarantined records sites whose failure has been tolerated,
+// together with their combined share of pageviews.
+func (s *ReportStep) addQuarantined(share float64, sites ...string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Quarantined = append(s.Quarantined, sites...)
+	s.QuarantinedShare += share
+}
+
+// AddUnreconciled records monthly pageview dumps that have been used
+// without checking them against a daily dump, because the daily dump
+// was not available anymore.
+func (s *ReportStep) addUnreconciled(paths ...string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Unreconciled = append(s.Unreconciled, paths...)
+}
+
+// SetInterwikiMap records where the interwiki map came from.
+func (s *ReportStep) setInterwikiMap(c ReportCache) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.InterwikiMap = &c
+}
+
+// StoragePath returns the path of the report in S3 storage.
+func (r *BuildReport) StoragePath() string {
+	t, _ := time.Parse(time.DateOnly, r.Date)
+	return BuildReportPath(t)
+}
+
+// Put stores the report in S3 storage. If an earlier run on the same
+// day has already stored a report, our steps get appended to its steps.
+func (r *BuildReport) Put(ctx context.Context, s3 S3) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	path := r.StoragePath()
+	report := &BuildReport{Date: r.Date, Commit: r.Commit}
+	opts := minio.ListObjectsOptions{Prefix: path}
+	for obj := range s3.ListObjects(ctx, "qrank", opts) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if obj.Key == path {
+			stored, err := readBuildReport(ctx, path, s3)
+			if err != nil {
+				return err
+			}
+			report.Steps = stored.Steps
+		}
+	}
+
+	// List each stage before the steps for its sites, in a stable order.
+	steps := slices.Clone(r.Steps)
+	slices.SortStableFunc(steps, func(a, b *ReportStep) int {
+		if c := cmp.Compare(slices.Index(BuildStages, a.Stage), slices.Index(BuildStages, b.Stage)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Site, b.Site)
+	})
+	report.Steps = append(report.Steps, steps...)
+	return PutJSON(ctx, report, s3, "qrank", path)
+}
+
+func readBuildReport(ctx context.Context, path string, s3 S3) (*BuildReport, error) {
+	reader, err := NewS3Reader(ctx, "qrank", path, s3)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var report BuildReport
+	if err := json.NewDecoder(reader).Decode(&report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// RecordStorageInput records that the step in ctx has read an object
+// from storage, of which size bytes have been downloaded, or -1 if the
+// object is being streamed. To find the version of the object, we need
+// to list it, so this costs an extra request; it is only made if ctx
+// has a step.
+func recordStorageInput(ctx context.Context, bucket string, path string, size int64, s3 S3) {
+	step := reportStepFrom(ctx)
+	if step == nil {
+		return
+	}
+
+	obj := ReportObject{Path: path, Size: size}
+	for info := range s3.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: path}) {
+		if info.Err == nil && info.Key == path {
+			obj.ETag = info.ETag
+			if obj.Size < 0 {
+				obj.Size = info.Size
+			}
+		}
+	}
+	if obj.Size < 0 {
+		obj.Size = 0
+	}
+	step.addInput(obj)
+}
@@ -0,0 +1,187 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildStage_Report(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	dumps := filepath.Join("testdata", "dumps")
+	s3 := NewFakeS3()
+	if err := BuildStage(nil, dumps, 1, s3, BuildOptions{}, "pageviews", "page-signals"); err != nil {
+		t.Fatal(err)
+	}
+
+	report := readStoredBuildReport(t, s3)
+	if report.Commit != BuilderCommit() {
+		t.Errorf("got commit %q, want %q", report.Commit, BuilderCommit())
+	}
+
+	var stages, sites []string
+	for _, step := range report.Steps {
+		if step.Site == "" {
+			stages = append(stages, step.Stage)
+		} else if step.Stage == "page-signals" {
+			sites = append(sites, step.Site)
+		}
+		if step.Start.IsZero() || step.End.Before(step.Start) {
+			t.Errorf("%s %s: bad time range %v to %v", step.Stage, step.Site, step.Start, step.End)
+		}
+	}
+	if want := []string{"pageviews", "page-signals"}; !slices.Equal(stages, want) {
+		t.Errorf("got stages %q, want %q", stages, want)
+	}
+	if want := []string{"itwikibooks", "loginwiki", "rmwiki", "rmwikibooks", "wikidatawiki"}; !slices.Equal(sites, want) {
+		t.Errorf("got sites %q, want %q", sites, want)
+	}
+
+	pageviews := findReportStep(t, report, "pageviews", "")
+	if len(pageviews.Inputs) == 0 || pageviews.BytesRead == 0 {
+		t.Errorf("pageviews stage should have read dumps, got %+v", pageviews)
+	}
+	for _, out := range pageviews.Outputs {
+		data := s3.data[out.Path]
+		if out.ETag != etag(data) || out.Size != int64(len(data)) {
+			t.Errorf("got output %+v, want ETag %q and size %d", out, etag(data), len(data))
+		}
+	}
+
+	rmwiki := findReportStep(t, report, "page-signals", "rmwiki")
+	wantInput := filepath.Join(dumps, "rmwiki", "20240301", "rmwiki-20240301-page_props.sql.gz")
+	if !slices.ContainsFunc(rmwiki.Inputs, func(obj ReportObject) bool {
+		return obj.Path == wantInput && obj.Size > 0
+	}) {
+		t.Errorf("got inputs %+v, want %s", rmwiki.Inputs, wantInput)
+	}
+	wantOutput := "page_signals/rmwiki-20240301-page_signals.zst"
+	if len(rmwiki.Outputs) != 1 || rmwiki.Outputs[0].Path != wantOutput {
+		t.Errorf("got outputs %+v, want %s", rmwiki.Outputs, wantOutput)
+	}
+
+	// A second run on the same day should append to the report.
+	numSteps := len(report.Steps)
+	if err := BuildStage(nil, dumps, 1, s3, BuildOptions{}, "page-signals"); err != nil {
+		t.Fatal(err)
+	}
+	report = readStoredBuildReport(t, s3)
+	if got, want := len(report.Steps), numSteps+1; got != want {
+		t.Errorf("got %d steps after second run, want %d", got, want)
+	}
+}
+
+func TestBuildStage_ReportFailure(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	dumps := filepath.Join("testdata", "dumps")
+	s3 := NewFakeS3()
+	s3.FailNext("FPutObject", "page_signals/rmwiki-20240301-page_signals.zst", 1)
+	if err := BuildStage(nil, dumps, 1, s3, BuildOptions{}, "page-signals"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	report := readStoredBuildReport(t, s3)
+	if step := findReportStep(t, report, "page-signals", "rmwiki"); step.Error == "" {
+		t.Error("failed site should have an error in report")
+	}
+	if step := findReportStep(t, report, "page-signals", ""); step.Error == "" {
+		t.Error("failed stage should have an error in report")
+	}
+}
+
+func TestNewS3Reader_Report(t *testing.T) {
+	ctx := withBuildReport(context.Background(), NewBuildReport(time.Now()))
+	ctx, step := startReportStep(ctx, "item-signals")
+	s3 := NewFakeS3()
+	s3.data["foo/bar.txt"] = []byte("Hello")
+
+	r, err := NewS3Reader(ctx, "qrank", "foo/bar.txt", s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	step.finish(nil)
+
+	want := []ReportObject{{Path: "foo/bar.txt", ETag: etag([]byte("Hello")), Size: 5}}
+	if !slices.Equal(step.Inputs, want) || step.BytesRead != 5 {
+		t.Errorf("got inputs %+v with %d bytes, want %+v", step.Inputs, step.BytesRead, want)
+	}
+}
+
+func TestReportStep_NoReport(t *testing.T) {
+	ctx := context.Background()
+	ctx, step := startReportStep(ctx, "titles")
+	if step != nil {
+		t.Errorf("got %v, want nil without a report in context", step)
+	}
+	if _, step := startSiteReportStep(ctx, "rmwiki"); step != nil {
+		t.Errorf("got %v, want nil without a report in context", step)
+	}
+
+	// Methods on a nil step should do nothing.
+	step.addInput(ReportObject{Path: "foo"})
+	step.addOutput(ReportObject{Path: "bar"})
+	step.finish(errors.New("test"))
+}
+
+func TestReportStep_Finish(t *testing.T) {
+	ctx := withBuildReport(context.Background(), NewBuildReport(time.Now()))
+	ctx, stage := startReportStep(ctx, "titles")
+	_, site := startSiteReportStep(ctx, "rmwiki")
+	if site.Stage != "titles" || site.Site != "rmwiki" {
+		t.Errorf("got stage %q and site %q, want titles and rmwiki", site.Stage, site.Site)
+	}
+
+	site.addOutput(ReportObject{Path: "b", Size: 3})
+	site.addOutput(ReportObject{Path: "a", Size: 4})
+	site.finish(errors.New("boom"))
+	stage.finish(nil)
+
+	if got := []string{site.Outputs[0].Path, site.Outputs[1].Path}; !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("outputs should be sorted by path, got %q", got)
+	}
+	if site.BytesWritten != 7 {
+		t.Errorf("got BytesWritten=%d, want 7", site.BytesWritten)
+	}
+	if site.Error != "boom" || stage.Error != "" {
+		t.Errorf("got errors %q and %q, want \"boom\" and \"\"", site.Error, stage.Error)
+	}
+}
+
+func readStoredBuildReport(t *testing.T, s3 *FakeS3) *BuildReport {
+	for key, data := range s3.data {
+		if strings.HasPrefix(key, "internal/qrank-builder/report-") {
+			var report BuildReport
+			if err := json.Unmarshal(data, &report); err != nil {
+				t.Fatal(err)
+			}
+			return &report
+		}
+	}
+	t.Fatal("no build report in storage")
+	return nil
+}
+
+func findReportStep(t *testing.T, report *BuildReport, stage string, site string) *ReportStep {
+	for _, step := range report.Steps {
+		if step.Stage == stage && step.Site == site {
+			return step
+		}
+	}
+	t.Fatalf("no step for stage %q and site %q in report", stage, site)
+	return nil
+}
@@ -0,0 +1,115 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/lanrat/extsort"
+)
+
+// Resources tells how much memory and parallelism the pipeline may use.
+// All stages take their budgets from the global resources, which get
+// set from the -profile flag when qrank-builder starts up.
+type Resources struct {
+	// SortChunkBytes is the approximate number of bytes that each
+	// worker of an external sort keeps in memory before it writes
+	// a sorted chunk to disk.
+	SortChunkBytes int64
+
+	// Workers is the number of goroutines that sort chunks in parallel,
+	// and the number of CPUs to plan for when reading the Wikidata dump.
+	Workers int
+
+	// MaxSites is the number of sites whose per-site files get built
+	// in parallel.
+	MaxSites int
+
+	// If StreamStorage is set, objects in storage get read over the
+	// network as they are being processed. Otherwise, they first get
+	// downloaded to a temporary file, which is more robust against
+	// network problems, but needs RAM on machines with a tmpfs /tmp.
+	StreamStorage bool
+
+	// If SkipOptionalSignals is set, the build does not compute any
+	// signals that need extra memory and are not required for ranking,
+	// such as the counts of the quality signals and Enterprise dumps.
+	SkipOptionalSignals bool
+}
+
+// The resources of the running build.
+var resources = DefaultResources()
+
+// DefaultResources returns the budgets for a server, which use all CPUs.
+func DefaultResources() Resources {
+	return Resources{
+		SortChunkBytes: 8 * 1024 * 1024,
+		Workers:        runtime.NumCPU(),
+		MaxSites:       runtime.NumCPU(),
+	}
+}
+
+// LowMemResources returns the budgets for a machine with about 4 GB
+// of RAM, such as a Raspberry Pi, which is enough for building
+// the files of a small wiki end to end.
+func LowMemResources() Resources {
+	return Resources{
+		SortChunkBytes:      1024 * 1024,
+		Workers:             min(runtime.NumCPU(), 2),
+		MaxSites:            1,
+		StreamStorage:       true,
+		SkipOptionalSignals: true,
+	}
+}
+
+// ParseResourceProfile returns the resources for a -profile flag.
+func ParseResourceProfile(name string) (Resources, error) {
+	switch name {
+	case "", "default":
+		return DefaultResources(), nil
+	case "low-mem":
+		return LowMemResources(), nil
+	default:
+		return Resources{}, fmt.Errorf("unknown resource profile %q; want default or low-mem", name)
+	}
+}
+
+// LimitOptions turns off the build options that the resources cannot
+// afford, and returns the names of the flags it has overridden.
+func (r Resources) limitOptions(opts *BuildOptions) []string {
+	if !r.SkipOptionalSignals {
+		return nil
+	}
+
+	var overridden []string
+	if opts.QualitySignals {
+		opts.QualitySignals = false
+		overridden = append(overridden, "-quality-signals")
+	}
+	if opts.EnterpriseDumps != "" {
+		opts.EnterpriseDumps = ""
+		overridden = append(overridden, "-enterprise-dumps")
+	}
+	if opts.SitelinksFromDump {
+		opts.SitelinksFromDump = false
+		overridden = append(overridden, "-sitelinks-from-dump")
+	}
+	if len(opts.IncrementalSites) > 0 {
+		opts.IncrementalSites = nil
+		overridden = append(overridden, "-incremental-sites")
+	}
+	return overridden
+}
+
+// NewSortConfig returns the configuration for externally sorting
+// records that take avgRecordBytes on average when held in memory.
+// Chunks hold at least two records, because the extsort library
+// would replace smaller sizes by its default of a million records.
+func newSortConfig(avgRecordBytes int) *extsort.Config {
+	config := extsort.DefaultConfig()
+	config.ChunkSize = int(max(resources.SortChunkBytes/int64(avgRecordBytes), 2))
+	config.NumWorkers = max(resources.Workers, 1)
+	return config
+}
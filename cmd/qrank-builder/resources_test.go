@@ -0,0 +1,166 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseResourceProfile(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want Resources
+	}{
+		{"", DefaultResources()},
+		{"default", DefaultResources()},
+		{"low-mem", LowMemResources()},
+	} {
+		got, err := ParseResourceProfile(tc.name)
+		if err != nil {
+			t.Errorf("%q: %v", tc.name, err)
+		} else if got != tc.want {
+			t.Errorf("%q: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := ParseResourceProfile("huge"); err == nil {
+		t.Error("expected error for unknown profile")
+	}
+}
+
+func TestLowMemResources(t *testing.T) {
+	r := LowMemResources()
+	if r.MaxSites < 1 || r.MaxSites > 2 {
+		t.Errorf("got MaxSites=%d, want 1 or 2", r.MaxSites)
+	}
+	if r.SortChunkBytes >= DefaultResources().SortChunkBytes {
+		t.Errorf("got SortChunkBytes=%d, want less than default", r.SortChunkBytes)
+	}
+	if !r.StreamStorage || !r.SkipOptionalSignals {
+		t.Errorf("got %+v, want streaming without optional signals", r)
+	}
+}
+
+func TestResources_LimitOptions(t *testing.T) {
+	opts := BuildOptions{
+		Strict:            true,
+		QualitySignals:    true,
+		EnterpriseDumps:   "/enterprise",
+		SitelinksFromDump: true,
+		IncrementalSites:  []string{"rmwiki"},
+	}
+
+	if got := DefaultResources().limitOptions(&opts); got != nil {
+		t.Errorf("default profile should not override options, got %q", got)
+	}
+
+	got := LowMemResources().limitOptions(&opts)
+	want := []string{"-quality-signals", "-enterprise-dumps", "-sitelinks-from-dump", "-incremental-sites"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if opts.QualitySignals || opts.EnterpriseDumps != "" || opts.SitelinksFromDump || opts.IncrementalSites != nil {
+		t.Errorf("optional signals not turned off: %+v", opts)
+	}
+	if !opts.Strict {
+		t.Error("other options should be kept")
+	}
+}
+
+func TestNewSortConfig(t *testing.T) {
+	defer func(saved Resources) { resources = saved }(resources)
+
+	resources = Resources{SortChunkBytes: 8 * 1024 * 1024, Workers: 3}
+	config := newSortConfig(64)
+	if config.ChunkSize != 131072 || config.NumWorkers != 3 {
+		t.Errorf("got ChunkSize=%d NumWorkers=%d, want 131072 and 3", config.ChunkSize, config.NumWorkers)
+	}
+
+	// Even for huge records, chunks must hold at least two.
+	resources = Resources{SortChunkBytes: 16, Workers: 0}
+	config = newSortConfig(64)
+	if config.ChunkSize != 2 || config.NumWorkers != 1 {
+		t.Errorf("got ChunkSize=%d NumWorkers=%d, want 2 and 1", config.ChunkSize, config.NumWorkers)
+	}
+}
+
+func TestBuildSiteFiles_MaxSites(t *testing.T) {
+	defer func(saved Resources) { resources = saved }(resources)
+	resources.MaxSites = 1
+
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	dumps := filepath.Join("testdata", "dumps")
+	sites, err := ReadWikiSites(nil, dumps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var running, maxRunning atomic.Int32
+	buildFunc := func(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			old := maxRunning.Load()
+			if n <= old || maxRunning.CompareAndSwap(old, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+	err = buildSiteFiles(context.Background(), "foobar", "", buildFunc, dumps, sites, nil, NewFakeS3())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := maxRunning.Load(); got != 1 {
+		t.Errorf("got %d sites built in parallel, want 1", got)
+	}
+}
+
+func TestNewS3Reader_StreamStorageFallback(t *testing.T) {
+	defer func(saved Resources) { resources = saved }(resources)
+	resources.StreamStorage = true
+
+	// FakeS3 cannot stream, so reading falls back to a temporary file.
+	s3 := NewFakeS3()
+	s3.data["foo/bar.txt"] = []byte("Hello")
+	r, err := NewS3Reader(context.Background(), "qrank", "foo/bar.txt", s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "Hello" {
+		t.Errorf("got %q, want %q", got, "Hello")
+	}
+}
+
+func TestStreamingReader(t *testing.T) {
+	before := GetStorageIOStats()
+	r := &streamingReader{io.NopCloser(bytes.NewReader([]byte("Hello")))}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "Hello" {
+		t.Errorf("got %q, want %q", got, "Hello")
+	}
+	if n := GetStorageIOStats().Sub(before).Bytes; n != 5 {
+		t.Errorf("got %d bytes in storage stats, want 5", n)
+	}
+}
@@ -4,15 +4,23 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
-	"regexp"
+	"slices"
 	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/minio/minio-go/v7"
 	//"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/objstore"
 )
 
 // S3 is the subset of minio.Client used in this program.
@@ -25,6 +33,7 @@ type S3 interface {
 	RemoveObject(ctx context.Context, bucketName string, objectName string, opts minio.RemoveObjectOptions) error
 	FGetObject(ctx context.Context, bucketName, objectName, filePath string, opts minio.GetObjectOptions) error
 	FPutObject(ctx context.Context, bucketName, objectName, filePath string, opts minio.PutObjectOptions) (minio.UploadInfo, error)
+	CopyObject(ctx context.Context, dst minio.CopyDestOptions, src minio.CopySrcOptions) (minio.UploadInfo, error)
 }
 
 type tempFileReader struct {
@@ -53,15 +62,147 @@ func (r *tempFileReader) Close() error {
 	}
 }
 
+// Compression tells NewS3ReaderWithOptions how to decompress a blob.
+type Compression int
+
+const (
+	Uncompressed      Compression = iota // return the stored bytes as-is
+	DetectCompression                    // by path suffix, ".gz" or ".zst"
+	GzipCompressed
+	ZstdCompressed
+)
+
+// S3ReaderOptions controls how NewS3ReaderWithOptions reads a blob.
+// The zero value reads the stored bytes of the entire blob.
+type S3ReaderOptions struct {
+	// Compression tells how to decompress the blob.
+	Compression Compression
+
+	// ZstdOptions get passed to the zstd decoder, for example
+	// to supply dictionaries; see ZstdDicts.DecoderOptions().
+	ZstdOptions []zstd.DOption
+
+	// Offset is the position in the stored blob where reading starts.
+	// Only the remaining bytes get downloaded, so a caller can resume
+	// reading after a failure. Compressed streams cannot be entered
+	// in the middle, so Offset must be zero for decompressing readers.
+	Offset int64
+}
+
+// Like for dumps, we keep statistics about reads from storage, so that
+// the logs tell whether the network has been a bottleneck.
+var storageIO struct {
+	bytes       atomic.Int64 // bytes downloaded from storage
+	downloading atomic.Int64 // nanoseconds spent downloading
+}
+
+// StorageIOStats tells how much data was downloaded from storage,
+// and how long it took, summed over all concurrent downloads.
+type StorageIOStats struct {
+	Bytes       int64
+	Downloading time.Duration
+}
+
+// Sub returns the difference between two snapshots of the statistics.
+func (s StorageIOStats) Sub(other StorageIOStats) StorageIOStats {
+	return StorageIOStats{
+		Bytes:       s.Bytes - other.Bytes,
+		Downloading: s.Downloading - other.Downloading,
+	}
+}
+
+// MiBPerSecond returns the download throughput in MiB/s.
+func (s StorageIOStats) MiBPerSecond() float64 {
+	if s.Downloading <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / (1024 * 1024) / s.Downloading.Seconds()
+}
+
+// GetStorageIOStats returns a snapshot of the statistics about downloads.
+func GetStorageIOStats() StorageIOStats {
+	return StorageIOStats{
+		Bytes:       storageIO.bytes.Load(),
+		Downloading: time.Duration(storageIO.downloading.Load()),
+	}
+}
+
+// GetStorageCallStats returns a snapshot of the statistics about calls
+// to storage, such as how many got retried, if s3 keeps them.
+func GetStorageCallStats(s3 S3) objstore.Stats {
+	if s, ok := s3.(interface{ Stats() objstore.Stats }); ok {
+		return s.Stats()
+	}
+	return objstore.Stats{}
+}
+
 // NewS3Reader creates an io.ReadCloser for an S3 blob. To minimize the impact
 // of network problems (Wikimedia’s datacenter is sometimes a little flaky),
 // the blob is first downloaded to a temporary file on local disk; the temp file
 // gets deleted when the caller deletes the returned io.ReadCloser.
 func NewS3Reader(ctx context.Context, bucket string, path string, s3 S3) (io.ReadCloser, error) {
+	return NewS3ReaderWithOptions(ctx, bucket, path, s3, S3ReaderOptions{})
+}
+
+// NewS3ReaderWithOptions is like NewS3Reader, but can decompress the blob
+// or start reading in the middle, see S3ReaderOptions.
+func NewS3ReaderWithOptions(ctx context.Context, bucket string, path string, s3 S3, options S3ReaderOptions) (io.ReadCloser, error) {
+	compression := options.Compression
+	if compression == DetectCompression {
+		compression = Uncompressed
+		if strings.HasSuffix(path, ".gz") {
+			compression = GzipCompressed
+		} else if strings.HasSuffix(path, ".zst") {
+			compression = ZstdCompressed
+		}
+	}
+	if options.Offset < 0 || (options.Offset > 0 && compression != Uncompressed) {
+		return nil, fmt.Errorf("cannot read %s from offset %d", path, options.Offset)
+	}
+
+	raw, err := downloadFromS3(ctx, bucket, path, s3, options.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	switch compression {
+	case GzipCompressed:
+		gz, err := gzip.NewReader(raw)
+		if err != nil {
+			raw.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return &decompressingReader{gz, raw}, nil
+
+	case ZstdCompressed:
+		zstdOptions := options.ZstdOptions
+		if _, ok := raw.(*validatingReader); ok {
+			// Decode synchronously, so that no goroutine of the
+			// decoder is still reading when decompressingReader
+			// reports a decoding error to the validatingReader.
+			zstdOptions = append(slices.Clip(zstdOptions), zstd.WithDecoderConcurrency(1))
+		}
+		decoder, err := zstd.NewReader(raw, zstdOptions...)
+		if err != nil {
+			raw.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return &decompressingReader{decoder.IOReadCloser(), raw}, nil
+	}
+
+	return raw, nil
+}
+
+func downloadFromS3(ctx context.Context, bucket string, path string, s3 S3, offset int64) (io.ReadCloser, error) {
 	opts := minio.GetObjectOptions{}
+	if offset > 0 {
+		if err := opts.SetRange(offset, 0); err != nil {
+			return nil, err
+		}
+	}
 
-	// Initially, we did the following, but Wikimedia’s datacenter
-	// seems to be too unreliable for reading a stream over the network
+	// Initially, we processed the object as a stream, but Wikimedia’s
+	// datacenter seems to be too unreliable for reading a stream over the network
 	// for more than a few seconds. Therefore, we now download our S3 blobs
 	// to a temporary file. This decoupling of I/O from processing reduces
 	// the likelihood of getting hit by a network problem, at the cost of
@@ -72,14 +213,15 @@ func NewS3Reader(ctx context.Context, bucket string, path string, s3 S3) (io.Rea
 	// downloading the blobs to /tmp seems to work better in production.
 	//
 	// See https://github.com/brawer/wikidata-qrank/issues/40 for background.
-	//
-	// if client, ok := s3.(*minio.Client); ok {
-	//     obj, err := client.GetObject(ctx, bucket, path, opts)
-	//	   if err != nil {
-	//         return nil, err
-	//     }
-	//     return obj, nil
-	// }
+	// On machines with little memory, the resources can still ask for
+	// streaming; see streamFromS3.
+	if streamer, ok := s3.(objectStreamer); ok && resources.StreamStorage {
+		stream, err := streamFromS3(ctx, bucket, path, streamer, opts, s3)
+		if err != nil || offset != 0 || !strings.HasSuffix(path, ".zst") {
+			return stream, err
+		}
+		return newValidatingReader(ctx, bucket, path, stream, s3)
+	}
 
 	temp, err := os.CreateTemp("", "s3*")
 	if err != nil {
@@ -88,41 +230,164 @@ func NewS3Reader(ctx context.Context, bucket string, path string, s3 S3) (io.Rea
 	if err := temp.Close(); err != nil {
 		return nil, err
 	}
+	start := time.Now()
 	if err := s3.FGetObject(ctx, bucket, path, temp.Name(), opts); err != nil {
+		os.Remove(temp.Name())
 		return nil, err
 	}
+	storageIO.downloading.Add(int64(time.Since(start)))
 	tempPath := temp.Name()
 	temp, err = os.Open(tempPath)
 	if err != nil {
 		os.Remove(tempPath)
 		return nil, err
 	}
+	size := int64(-1)
+	if stat, err := temp.Stat(); err == nil {
+		size = stat.Size()
+		storageIO.bytes.Add(size)
+	}
+	if offset == 0 && strings.HasSuffix(path, ".zst") {
+		if err := validateDownload(ctx, bucket, path, temp, s3); err != nil {
+			temp.Close()
+			os.Remove(tempPath)
+			return nil, err
+		}
+	}
 
+	recordStorageInput(ctx, bucket, path, size, s3)
 	return &tempFileReader{temp}, nil
 }
 
-// PutInStorage stores a file in S3 storage.
+// ObjectStreamer is implemented by stores that can return an object
+// as a stream, such as minio.Client and objstore.Router.
+type objectStreamer interface {
+	GetObject(ctx context.Context, bucketName, objectName string, opts minio.GetObjectOptions) (*minio.Object, error)
+}
+
+// StreamFromS3 reads an object over the network while it is being
+// processed, without downloading it to a temporary file first. This
+// is less robust against network problems, but on machines with little
+// RAM and a tmpfs /tmp, a temporary copy of a large object would not fit.
+func streamFromS3(ctx context.Context, bucket string, path string, streamer objectStreamer, opts minio.GetObjectOptions, s3 S3) (io.ReadCloser, error) {
+	obj, err := streamer.GetObject(ctx, bucket, path, opts)
+	if err != nil {
+		return nil, err
+	}
+	recordStorageInput(ctx, bucket, path, -1, s3)
+	return &streamingReader{obj}, nil
+}
+
+// StreamingReader counts the bytes and time of a streamed download
+// into the statistics about storage I/O.
+type streamingReader struct {
+	obj io.ReadCloser
+}
+
+func (r *streamingReader) Read(buf []byte) (int, error) {
+	start := time.Now()
+	n, err := r.obj.Read(buf)
+	storageIO.downloading.Add(int64(time.Since(start)))
+	storageIO.bytes.Add(int64(n))
+	return n, err
+}
+
+func (r *streamingReader) Close() error {
+	return r.obj.Close()
+}
+
+// DecompressingReader reads from a decompressor, and closes both the
+// decompressor and the underlying reader when getting closed.
+type decompressingReader struct {
+	decompressor io.ReadCloser
+	raw          io.ReadCloser
+}
+
+func (r *decompressingReader) Read(buf []byte) (int, error) {
+	if r.decompressor == nil {
+		return 0, fmt.Errorf("already closed")
+	}
+	n, err := r.decompressor.Read(buf)
+	if err != nil && err != io.EOF {
+		if v, ok := r.raw.(*validatingReader); ok {
+			err = v.decodingFailed(err)
+		}
+	}
+	return n, err
+}
+
+func (r *decompressingReader) Close() error {
+	if r.decompressor == nil {
+		return nil
+	}
+	err1 := r.decompressor.Close()
+	err2 := r.raw.Close()
+	r.decompressor, r.raw = nil, nil
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+// PutInStorage stores a file in S3 storage. The stored object gets
+// recorded as an output of the build report step in ctx, if any.
+// For .zst files, the object metadata tells the size and digest,
+// so that downloads can be validated; see validateDownload().
 func PutInStorage(ctx context.Context, file string, s3 S3, bucket string, dest string, contentType string) error {
 	options := minio.PutObjectOptions{ContentType: contentType}
-	_, err := s3.FPutObject(ctx, bucket, dest, file, options)
-	return err
+	if strings.HasSuffix(dest, ".zst") {
+		metadata, err := integrityMetadata(file)
+		if err != nil {
+			return err
+		}
+		options.UserMetadata = metadata
+	}
+	info, err := s3.FPutObject(ctx, bucket, dest, file, options)
+	if err != nil {
+		return err
+	}
+	reportStepFrom(ctx).addOutput(ReportObject{Path: dest, ETag: info.ETag, Size: info.Size})
+	return nil
+}
+
+// PutJSON encodes a value as indented JSON and stores it in S3 storage.
+func PutJSON(ctx context.Context, v any, s3 S3, bucket string, dest string) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp("", "*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return PutInStorage(ctx, file.Name(), s3, bucket, dest, "application/json")
 }
 
 // ListStoredFiles returns what files are available in S3 storage.
 func ListStoredFiles(ctx context.Context, filename string, s3 S3) (map[string][]string, error) {
-	re := regexp.MustCompile(fmt.Sprintf(`^%s/([a-z0-9_\-]+)-(\d{8})-%s.zst$`, filename, filename))
 	result := make(map[string][]string, 1000)
 	opts := minio.ListObjectsOptions{Prefix: filename + "/"}
 	for obj := range s3.ListObjects(ctx, "qrank", opts) {
 		if obj.Err != nil {
 			return nil, obj.Err
 		}
-		if match := re.FindStringSubmatch(obj.Key); match != nil {
-			arr, ok := result[match[1]]
+		if kind, site, ymd, ok := ParseSitePath(obj.Key); ok && kind == filename {
+			arr, ok := result[site]
 			if !ok {
 				arr = make([]string, 0, 3)
 			}
-			result[match[1]] = append(arr, match[2])
+			result[site] = append(arr, ymd)
 		}
 	}
 	for _, val := range result {
@@ -6,38 +6,116 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net/http"
 	"os"
+	"path/filepath"
 	"reflect"
 	"slices"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/minio/minio-go/v7"
 )
 
+// FakeS3 is an in-memory fake of S3 storage, for testing. Besides the
+// content of objects, it keeps their modification time, and it can
+// simulate transient failures and slow reads.
 type FakeS3 struct {
-	data  map[string][]byte
-	mutex sync.RWMutex
+	data     map[string][]byte
+	modified map[string]time.Time
+	metadata map[string]map[string]string // user metadata
+	failures map[string]int
+	clock    time.Time
+	mutex    sync.RWMutex
+
+	// ReadDelay, if set, slows down every call to FGetObject.
+	ReadDelay time.Duration
 }
 
 func NewFakeS3() *FakeS3 {
 	fake := &FakeS3{
-		data: make(map[string][]byte, 10),
+		data:     make(map[string][]byte, 10),
+		modified: make(map[string]time.Time, 10),
+		metadata: make(map[string]map[string]string, 10),
+		failures: make(map[string]int, 10),
+		clock:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
 	}
 	return fake
 }
 
+// FailNext makes the next n calls of an operation on a key fail with
+// a transient error, as S3 servers do when they are overloaded. The
+// operation is the name of an S3 method such as "FGetObject"; for
+// "ListObjects", the key is the prefix of the listing.
+func (s3 *FakeS3) FailNext(op string, key string, n int) {
+	s3.mutex.Lock()
+	defer s3.mutex.Unlock()
+	s3.failures[op+" "+key] += n
+}
+
+// Fail returns an error if an operation on a key should fail.
+func (s3 *FakeS3) fail(op string, key string) error {
+	s3.mutex.Lock()
+	defer s3.mutex.Unlock()
+
+	k := op + " " + key
+	if s3.failures[k] <= 0 {
+		return nil
+	}
+	s3.failures[k] -= 1
+	return minio.ErrorResponse{
+		StatusCode: http.StatusServiceUnavailable,
+		Code:       "SlowDown",
+		Message:    "Please reduce your request rate.",
+		BucketName: "qrank",
+		Key:        key,
+	}
+}
+
+// Put stores an object. The caller must hold the write lock.
+// Each write advances a fake clock by one second, so that
+// modification times are distinct and deterministic.
+func (s3 *FakeS3) put(key string, data []byte) {
+	s3.clock = s3.clock.Add(time.Second)
+	s3.data[key] = data
+	s3.modified[key] = s3.clock
+	delete(s3.metadata, key)
+}
+
+// NoSuchKey returns the error that S3 returns for missing objects.
+func noSuchKey(bucket string, key string) error {
+	return minio.ErrorResponse{
+		StatusCode: http.StatusNotFound,
+		Code:       "NoSuchKey",
+		Message:    fmt.Sprintf("object not found: %s", key),
+		BucketName: bucket,
+		Key:        key,
+	}
+}
+
+// ETag returns the entity tag that S3 reports for an object
+// that was not uploaded in multiple parts.
+func etag(data []byte) string {
+	digest := md5.Sum(data)
+	return hex.EncodeToString(digest[:])
+}
+
 func (s3 *FakeS3) ReadLines(path string) ([]string, error) {
 	s3.mutex.RLock()
 	defer s3.mutex.RUnlock()
 
 	data, ok := s3.data[path]
 	if !ok {
-		return nil, fmt.Errorf("file not found: %s", path)
+		return nil, noSuchKey("qrank", path)
 	}
 
 	var buf bytes.Buffer
@@ -90,44 +168,124 @@ func (s3 *FakeS3) WriteLines(lines []string, path string) error {
 		return err
 	}
 
-	s3.data[path] = buf.Bytes()
+	s3.put(path, buf.Bytes())
 	return nil
 }
 
+// ListObjects lists the objects whose key starts with a prefix,
+// in lexicographic order. Like S3, it returns "directories" whose
+// keys end in "/" unless the listing is recursive.
 func (s3 *FakeS3) ListObjects(ctx context.Context, bucketName string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	ch := make(chan minio.ObjectInfo, 2)
+	if err := s3.fail("ListObjects", opts.Prefix); err != nil {
+		ch <- minio.ObjectInfo{Err: err}
+		close(ch)
+		return ch
+	}
+
 	s3.mutex.RLock()
 	defer s3.mutex.RUnlock()
 
-	ch := make(chan minio.ObjectInfo, 2)
+	objects := make([]minio.ObjectInfo, 0, len(s3.data))
+	dirs := make(map[string]bool, 10)
+	if bucketName == "qrank" {
+		for key, data := range s3.data {
+			rest, ok := strings.CutPrefix(key, opts.Prefix)
+			if !ok {
+				continue
+			}
+			if i := strings.IndexByte(rest, '/'); i >= 0 && !opts.Recursive {
+				dir := opts.Prefix + rest[:i+1]
+				if !dirs[dir] {
+					dirs[dir] = true
+					objects = append(objects, minio.ObjectInfo{Key: dir})
+				}
+				continue
+			}
+			objects = append(objects, minio.ObjectInfo{
+				Key:          key,
+				Size:         int64(len(data)),
+				LastModified: s3.modified[key],
+				ETag:         etag(data),
+			})
+		}
+	}
+	slices.SortFunc(objects, func(a, b minio.ObjectInfo) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
 	go func() {
 		defer close(ch)
-		prefix := opts.Prefix
-		if bucketName == "qrank" {
-			for key, _ := range s3.data {
-				if strings.HasPrefix(key, prefix) {
-					ch <- minio.ObjectInfo{Key: key}
-				}
+		for _, obj := range objects {
+			select {
+			case ch <- obj:
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
 	return ch
 }
 
+// RemoveObject removes an object. Like S3, it does not fail
+// if the object does not exist.
 func (s3 *FakeS3) RemoveObject(ctx context.Context, bucketName string, objectName string, opts minio.RemoveObjectOptions) error {
+	if err := s3.fail("RemoveObject", objectName); err != nil {
+		return err
+	}
+
 	s3.mutex.Lock()
 	defer s3.mutex.Unlock()
 
 	if bucketName != "qrank" {
 		return fmt.Errorf(`unexpected bucket "%s"`, bucketName)
 	}
-	if _, ok := s3.data[objectName]; !ok {
-		return fmt.Errorf(`file not found: %s`, objectName)
-	}
 	delete(s3.data, objectName)
+	delete(s3.modified, objectName)
+	delete(s3.metadata, objectName)
 	return nil
 }
 
+// StatObject returns the metadata of an object. Like S3, it returns
+// the user metadata with keys in canonical header form.
+func (s3 *FakeS3) StatObject(ctx context.Context, bucketName, objectName string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	if err := s3.fail("StatObject", objectName); err != nil {
+		return minio.ObjectInfo{}, err
+	}
+
+	s3.mutex.RLock()
+	defer s3.mutex.RUnlock()
+
+	data, ok := s3.data[objectName]
+	if bucketName != "qrank" || !ok {
+		return minio.ObjectInfo{}, noSuchKey(bucketName, objectName)
+	}
+	metadata := make(minio.StringMap, len(s3.metadata[objectName]))
+	for k, v := range s3.metadata[objectName] {
+		metadata[http.CanonicalHeaderKey(k)] = v
+	}
+	return minio.ObjectInfo{
+		Key:          objectName,
+		Size:         int64(len(data)),
+		LastModified: s3.modified[objectName],
+		ETag:         etag(data),
+		UserMetadata: metadata,
+	}, nil
+}
+
 func (s3 *FakeS3) FGetObject(ctx context.Context, bucketName, objectName, filePath string, opts minio.GetObjectOptions) error {
+	if err := s3.fail("FGetObject", objectName); err != nil {
+		return err
+	}
+
+	if s3.ReadDelay > 0 {
+		select {
+		case <-time.After(s3.ReadDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
 	s3.mutex.RLock()
 	defer s3.mutex.RUnlock()
 
@@ -136,8 +294,22 @@ func (s3 *FakeS3) FGetObject(ctx context.Context, bucketName, objectName, filePa
 	}
 	data, ok := s3.data[objectName]
 	if !ok {
-		return fmt.Errorf("object not found: %s", objectName)
+		return noSuchKey(bucketName, objectName)
+	}
+
+	// Support ranges like "bytes=5-" and "bytes=5-9", which is what
+	// NewS3ReaderWithOptions() uses for reading from an offset.
+	if rng := opts.Header().Get("Range"); rng != "" {
+		var start, end int
+		if n, _ := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); n == 2 && start <= end && end < len(data) {
+			data = data[start : end+1]
+		} else if n == 1 && start < len(data) {
+			data = data[start:]
+		} else {
+			return fmt.Errorf("invalid range %q for %d bytes", rng, len(data))
+		}
 	}
+
 	file, err := os.Create(filePath)
 	if err != nil {
 		return err
@@ -157,11 +329,44 @@ func (s3 *FakeS3) FGetObject(ctx context.Context, bucketName, objectName, filePa
 	return nil
 }
 
-func (s3 *FakeS3) FPutObject(ctx context.Context, bucketName, objectName, filePath string, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+func (s3 *FakeS3) CopyObject(ctx context.Context, dst minio.CopyDestOptions, src minio.CopySrcOptions) (minio.UploadInfo, error) {
+	info := minio.UploadInfo{}
+	if err := s3.fail("CopyObject", src.Object); err != nil {
+		return info, err
+	}
+
 	s3.mutex.Lock()
 	defer s3.mutex.Unlock()
 
+	if dst.Bucket != "qrank" || src.Bucket != "qrank" {
+		return info, fmt.Errorf("unexpected bucket %v or %v", dst.Bucket, src.Bucket)
+	}
+	data, ok := s3.data[src.Object]
+	if !ok {
+		return info, noSuchKey(src.Bucket, src.Object)
+	}
+	metadata := s3.metadata[src.Object]
+	s3.put(dst.Object, data)
+	if metadata != nil {
+		s3.metadata[dst.Object] = metadata
+	}
+	info.Bucket, info.Key, info.ETag = dst.Bucket, dst.Object, etag(data)
+	info.Size, info.LastModified = int64(len(data)), s3.clock
+	return info, nil
+}
+
+// FPutObject stores a file. It honors the conditions that get set
+// with opts.SetMatchETag() and opts.SetMatchETagExcept(); an ETag
+// of "*" matches any existing object.
+func (s3 *FakeS3) FPutObject(ctx context.Context, bucketName, objectName, filePath string, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
 	info := minio.UploadInfo{}
+	if err := s3.fail("FPutObject", objectName); err != nil {
+		return info, err
+	}
+
+	s3.mutex.Lock()
+	defer s3.mutex.Unlock()
+
 	if bucketName != "qrank" {
 		return info, fmt.Errorf("unexpected bucket %v", bucketName)
 	}
@@ -171,7 +376,29 @@ func (s3 *FakeS3) FPutObject(ctx context.Context, bucketName, objectName, filePa
 		return info, err
 	}
 
-	s3.data[objectName] = file
+	old, exists := s3.data[objectName]
+	matches := func(header string) bool {
+		tag := strings.Trim(opts.Header().Get(header), `"`)
+		return exists && (tag == "*" || tag == etag(old))
+	}
+	ifMatch := opts.Header().Get("If-Match") != ""
+	ifNoneMatch := opts.Header().Get("If-None-Match") != ""
+	if (ifMatch && !matches("If-Match")) || (ifNoneMatch && matches("If-None-Match")) {
+		return info, minio.ErrorResponse{
+			StatusCode: http.StatusPreconditionFailed,
+			Code:       "PreconditionFailed",
+			Message:    "At least one of the pre-conditions you specified did not hold",
+			BucketName: bucketName,
+			Key:        objectName,
+		}
+	}
+
+	s3.put(objectName, file)
+	if len(opts.UserMetadata) > 0 {
+		s3.metadata[objectName] = opts.UserMetadata
+	}
+	info.Bucket, info.Key, info.ETag = bucketName, objectName, etag(file)
+	info.Size, info.LastModified = int64(len(file)), s3.clock
 	return info, nil
 }
 
@@ -231,6 +458,111 @@ func TestReadWriteLinest(t *testing.T) {
 	}
 }
 
+func TestNewS3ReaderWithOptions(t *testing.T) {
+	var zst bytes.Buffer
+	zw, err := zstd.NewWriter(&zst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write([]byte("Hello from zstd"))
+	zw.Close()
+
+	s3 := NewFakeS3()
+	s3.data["plain.txt"] = []byte("Hello, world")
+	s3.data["greeting.gz"] = gzipForTest(t, "Hello from gzip")
+	s3.data["greeting.zst"] = zst.Bytes()
+	s3.data["greeting"] = zst.Bytes()
+
+	for _, tc := range []struct {
+		path string
+		opts S3ReaderOptions
+		want string
+	}{
+		{"plain.txt", S3ReaderOptions{}, "Hello, world"},
+		{"plain.txt", S3ReaderOptions{Compression: DetectCompression}, "Hello, world"},
+		{"plain.txt", S3ReaderOptions{Offset: 7}, "world"},
+		{"greeting.gz", S3ReaderOptions{Compression: DetectCompression}, "Hello from gzip"},
+		{"greeting.gz", S3ReaderOptions{Compression: GzipCompressed}, "Hello from gzip"},
+		{"greeting.zst", S3ReaderOptions{Compression: DetectCompression}, "Hello from zstd"},
+		{"greeting", S3ReaderOptions{Compression: ZstdCompressed}, "Hello from zstd"},
+		{"greeting.gz", S3ReaderOptions{}, string(s3.data["greeting.gz"])},
+	} {
+		r, err := NewS3ReaderWithOptions(context.Background(), "qrank", tc.path, s3, tc.opts)
+		if err != nil {
+			t.Errorf("%s %+v: %v", tc.path, tc.opts, err)
+			continue
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Errorf("%s %+v: %v", tc.path, tc.opts, err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s %+v: got %q, want %q", tc.path, tc.opts, got, tc.want)
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("%s %+v: %v", tc.path, tc.opts, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("%s %+v: second Close() failed, %v", tc.path, tc.opts, err)
+		}
+	}
+}
+
+func TestNewS3ReaderWithOptions_Errors(t *testing.T) {
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	s3.data["plain.txt"] = []byte("Hello, world")
+	s3.data["greeting.zst"] = []byte("not zstd")
+
+	for _, tc := range []struct {
+		path string
+		opts S3ReaderOptions
+	}{
+		{"missing.txt", S3ReaderOptions{}},
+		{"plain.txt", S3ReaderOptions{Offset: -1}},
+		{"plain.txt", S3ReaderOptions{Offset: 99}},
+		{"plain.txt", S3ReaderOptions{Compression: GzipCompressed}},
+		{"greeting.zst", S3ReaderOptions{Compression: DetectCompression, Offset: 3}},
+	} {
+		if r, err := NewS3ReaderWithOptions(ctx, "qrank", tc.path, s3, tc.opts); err == nil {
+			r.Close()
+			t.Errorf("%s %+v: expected error", tc.path, tc.opts)
+		}
+	}
+
+	// Bad zstd data gets noticed when opening, not only when reading.
+	saved := logger
+	t.Cleanup(func() { logger = saved })
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	_, err := NewS3ReaderWithOptions(ctx, "qrank", "greeting.zst", s3, S3ReaderOptions{Compression: DetectCompression})
+	var corrupt *corruptObjectError
+	if !errors.As(err, &corrupt) {
+		t.Errorf("got %v, want corruptObjectError", err)
+	}
+}
+
+func TestGetStorageIOStats(t *testing.T) {
+	s3 := NewFakeS3()
+	s3.data["foo.txt"] = []byte("Hello")
+	before := GetStorageIOStats()
+	r, err := NewS3Reader(context.Background(), "qrank", "foo.txt", s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	stats := GetStorageIOStats().Sub(before)
+	if stats.Bytes != 5 {
+		t.Errorf("got %d bytes, want 5", stats.Bytes)
+	}
+	if stats.Downloading < 0 || stats.MiBPerSecond() < 0 {
+		t.Errorf("got %+v", stats)
+	}
+	if got := (StorageIOStats{Bytes: 1024 * 1024, Downloading: time.Second / 2}).MiBPerSecond(); got != 2.0 {
+		t.Errorf("got %v MiB/s, want 2.0", got)
+	}
+}
+
 func TestListStoredFiles(t *testing.T) {
 	s3 := NewFakeS3()
 	for _, path := range []string{
@@ -253,3 +585,159 @@ func TestListStoredFiles(t *testing.T) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
+
+func TestFakeS3_ListObjects(t *testing.T) {
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	for _, path := range []string{"b/2", "b/1", "a/x/y", "a/z", "c"} {
+		if err := s3.WriteLines([]string{path}, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		prefix    string
+		recursive bool
+		want      string
+	}{
+		{"", false, "a/ b/ c"},
+		{"", true, "a/x/y a/z b/1 b/2 c"},
+		{"a/", false, "a/x/ a/z"},
+		{"a/", true, "a/x/y a/z"},
+		{"b/", false, "b/1 b/2"},
+		{"d", true, ""},
+	} {
+		keys := make([]string, 0, 5)
+		opts := minio.ListObjectsOptions{Prefix: tc.prefix, Recursive: tc.recursive}
+		for obj := range s3.ListObjects(ctx, "qrank", opts) {
+			if obj.Err != nil {
+				t.Fatal(obj.Err)
+			}
+			keys = append(keys, obj.Key)
+		}
+		if got := strings.Join(keys, " "); got != tc.want {
+			t.Errorf("prefix=%q recursive=%v: got %q, want %q", tc.prefix, tc.recursive, got, tc.want)
+		}
+	}
+}
+
+func TestFakeS3_Metadata(t *testing.T) {
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	s3.WriteLines([]string{"foo"}, "a")
+	s3.WriteLines([]string{"foo"}, "b")
+	s3.data["c"] = []byte("bar\n")
+
+	opts := minio.ListObjectsOptions{Recursive: true}
+	objs := make([]minio.ObjectInfo, 0, 3)
+	for obj := range s3.ListObjects(ctx, "qrank", opts) {
+		objs = append(objs, obj)
+	}
+	if len(objs) != 3 {
+		t.Fatalf("got %d objects, want 3", len(objs))
+	}
+	for _, obj := range objs {
+		if obj.Size != 4 {
+			t.Errorf("%s: got size %d, want 4", obj.Key, obj.Size)
+		}
+	}
+	if !objs[0].LastModified.Before(objs[1].LastModified) {
+		t.Errorf("got LastModified %v and %v, want increasing", objs[0].LastModified, objs[1].LastModified)
+	}
+	if !objs[2].LastModified.IsZero() {
+		t.Errorf("got LastModified %v for object put without FakeS3 API, want zero", objs[2].LastModified)
+	}
+	if objs[0].ETag != objs[1].ETag || objs[0].ETag == objs[2].ETag {
+		t.Errorf("got ETags %q, %q, %q", objs[0].ETag, objs[1].ETag, objs[2].ETag)
+	}
+}
+
+func TestFakeS3_ConditionalPut(t *testing.T) {
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(condition func(*minio.PutObjectOptions)) (minio.UploadInfo, error) {
+		var opts minio.PutObjectOptions
+		if condition != nil {
+			condition(&opts)
+		}
+		return s3.FPutObject(ctx, "qrank", "obj", path, opts)
+	}
+	precondition := func(err error) bool {
+		return minio.ToErrorResponse(err).Code == "PreconditionFailed"
+	}
+
+	if _, err := put(func(o *minio.PutObjectOptions) { o.SetMatchETag("*") }); !precondition(err) {
+		t.Errorf("If-Match on missing object: got %v, want PreconditionFailed", err)
+	}
+	info, err := put(func(o *minio.PutObjectOptions) { o.SetMatchETagExcept("*") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := put(func(o *minio.PutObjectOptions) { o.SetMatchETagExcept("*") }); !precondition(err) {
+		t.Errorf("If-None-Match on existing object: got %v, want PreconditionFailed", err)
+	}
+	if _, err := put(func(o *minio.PutObjectOptions) { o.SetMatchETag("wrong") }); !precondition(err) {
+		t.Errorf("If-Match with wrong ETag: got %v, want PreconditionFailed", err)
+	}
+	if _, err := put(func(o *minio.PutObjectOptions) { o.SetMatchETag(info.ETag) }); err != nil {
+		t.Errorf("If-Match with right ETag: got %v, want success", err)
+	}
+	if _, err := put(nil); err != nil {
+		t.Errorf("unconditional put: got %v, want success", err)
+	}
+}
+
+func TestFakeS3_FailNext(t *testing.T) {
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	s3.WriteLines([]string{"foo"}, "a/b")
+	s3.FailNext("FGetObject", "a/b", 2)
+	s3.FailNext("ListObjects", "a/", 1)
+
+	path := filepath.Join(t.TempDir(), "file")
+	for i, wantErr := range []bool{true, true, false} {
+		err := s3.FGetObject(ctx, "qrank", "a/b", path, minio.GetObjectOptions{})
+		if gotErr := err != nil; gotErr != wantErr {
+			t.Errorf("FGetObject call %d: got %v, want error=%v", i, err, wantErr)
+		}
+		if err != nil && minio.ToErrorResponse(err).StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("FGetObject call %d: got %v, want status 503", i, err)
+		}
+	}
+
+	opts := minio.ListObjectsOptions{Prefix: "a/"}
+	for i, wantErr := range []bool{true, false} {
+		var err error
+		for obj := range s3.ListObjects(ctx, "qrank", opts) {
+			if obj.Err != nil {
+				err = obj.Err
+			}
+		}
+		if gotErr := err != nil; gotErr != wantErr {
+			t.Errorf("ListObjects call %d: got %v, want error=%v", i, err, wantErr)
+		}
+	}
+
+	err := s3.FGetObject(ctx, "qrank", "missing", path, minio.GetObjectOptions{})
+	if code := minio.ToErrorResponse(err).Code; code != "NoSuchKey" {
+		t.Errorf("got %v, want NoSuchKey", err)
+	}
+}
+
+func TestFakeS3_ReadDelay(t *testing.T) {
+	s3 := NewFakeS3()
+	s3.WriteLines([]string{"foo"}, "a")
+	s3.ReadDelay = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	path := filepath.Join(t.TempDir(), "file")
+	err := s3.FGetObject(ctx, "qrank", "a", path, minio.GetObjectOptions{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+}
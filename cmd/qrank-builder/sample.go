@@ -0,0 +1,146 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// BuildSample restricts a build to a fixed set of wikis and to a
+// deterministic sample of items, so that a test run produces a small
+// release whose parts fit together. Every stage applies the same
+// sample, so an item is either kept everywhere or nowhere; and since
+// the sample does not depend on the order of the input, two test runs
+// on the same dumps produce the same output.
+type BuildSample struct {
+	// Sites are the keys of the sampled wikis, such as "rmwiki".
+	// Wikidata is always included, because the items come from there.
+	Sites []string `json:"sites"`
+
+	// ItemRate tells how many items there are for each sampled item.
+	// With 100, about one percent of all items get kept; with 1 or less,
+	// all items of the sampled wikis get kept.
+	ItemRate int64 `json:"item_rate"`
+}
+
+// DefaultTestSites are the wikis of a test run, unless -test-sites
+// tells otherwise. Apart from Wikidata, they are small wikis.
+var defaultTestSites = []string{"rmwiki", "rmwikibooks", "wikidatawiki"}
+
+// NewBuildSample returns a sample of the given sites, plus Wikidata.
+func NewBuildSample(sites []string, itemRate int64) *BuildSample {
+	s := &BuildSample{Sites: slices.Clone(sites), ItemRate: itemRate}
+	if !slices.Contains(s.Sites, "wikidatawiki") {
+		s.Sites = append(s.Sites, "wikidatawiki")
+	}
+	slices.Sort(s.Sites)
+	return s
+}
+
+// ID identifies the sample, such as "100-rmwiki,rmwikibooks,wikidatawiki"
+// for one in 100 items of three wikis. Outputs built from different
+// samples differ, so the ID is part of the code of per-site files,
+// and of the storage prefix of test runs. A nil sample, which stands
+// for all data, has the empty string as its ID.
+func (s *BuildSample) ID() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%s", max(s.ItemRate, 1), strings.Join(s.Sites, ","))
+}
+
+// StoragePrefix returns where a build of the sample keeps its objects
+// in storage, apart from production and from builds of other samples;
+// see objstore.Config.Prefix. For a nil sample, the result is empty.
+func (s *BuildSample) StoragePrefix() string {
+	if s == nil {
+		return ""
+	}
+	return "testrun/" + s.ID() + "/"
+}
+
+// FilterSites returns the sampled sites. If the sample is nil,
+// all sites are returned.
+func (s *BuildSample) FilterSites(sites *WikiSites) *WikiSites {
+	if s == nil {
+		return sites
+	}
+	result := &WikiSites{
+		Sites:   make(map[string]*WikiSite, len(s.Sites)),
+		Domains: make(map[string]*WikiSite, len(s.Sites)),
+	}
+	for key, site := range sites.Sites {
+		if slices.Contains(s.Sites, key) {
+			result.Sites[key] = site
+		}
+	}
+	for domain, site := range sites.Domains {
+		if slices.Contains(s.Sites, site.Key) {
+			result.Domains[domain] = site
+		}
+	}
+	return result
+}
+
+// FilterKeys returns the site keys that are in the sample.
+// If the sample is nil, all keys are returned.
+func (s *BuildSample) FilterKeys(keys []string) []string {
+	if s == nil {
+		return keys
+	}
+	result := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if slices.Contains(s.Sites, key) {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// KeepItem tells whether an item, such as 72 for Q72, is in the sample.
+// Items get mixed before taking the remainder, so that the sample
+// is not skewed towards items that were created in certain batches.
+// If the sample is nil, all items are kept.
+func (s *BuildSample) KeepItem(item int64) bool {
+	if s == nil || s.ItemRate <= 1 {
+		return true
+	}
+	h := uint64(item) * 0x9e3779b97f4a7c15
+	h ^= h >> 31
+	return h%uint64(s.ItemRate) == 0
+}
+
+// KeepItemID is like KeepItem for an item ID such as "Q72".
+// IDs that cannot be parsed are kept.
+func (s *BuildSample) KeepItemID(id string) bool {
+	if s == nil {
+		return true
+	}
+	item, err := strconv.ParseInt(strings.TrimPrefix(id, "Q"), 10, 64)
+	if err != nil {
+		return true
+	}
+	return s.KeepItem(item)
+}
+
+type buildSampleKey struct{}
+
+// WithBuildSample returns a context for running stages on a sample
+// of the data. If the sample is nil, stages process all data.
+func withBuildSample(ctx context.Context, sample *BuildSample) context.Context {
+	if sample == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, buildSampleKey{}, sample)
+}
+
+// BuildSampleFrom returns the sample in ctx, or nil for all data.
+func buildSampleFrom(ctx context.Context) *BuildSample {
+	sample, _ := ctx.Value(buildSampleKey{}).(*BuildSample)
+	return sample
+}
@@ -0,0 +1,204 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBuildSample_FilterSites(t *testing.T) {
+	rmwiki := &WikiSite{Key: "rmwiki", Domain: "rm.wikipedia.org"}
+	dewiki := &WikiSite{Key: "dewiki", Domain: "de.wikipedia.org"}
+	wikidatawiki := &WikiSite{Key: "wikidatawiki", Domain: "www.wikidata.org"}
+	sites := &WikiSites{
+		Sites: map[string]*WikiSite{"rmwiki": rmwiki, "dewiki": dewiki, "wikidatawiki": wikidatawiki},
+		Domains: map[string]*WikiSite{
+			"rm.wikipedia.org": rmwiki,
+			"de.wikipedia.org": dewiki,
+			"www.wikidata.org": wikidatawiki,
+		},
+	}
+
+	sample := NewBuildSample([]string{"rmwiki"}, 100)
+	if want := []string{"rmwiki", "wikidatawiki"}; !slices.Equal(sample.Sites, want) {
+		t.Errorf("got %v, want %v", sample.Sites, want)
+	}
+	got := sample.FilterSites(sites)
+	if len(got.Sites) != 2 || got.Sites["rmwiki"] != rmwiki || got.Sites["wikidatawiki"] != wikidatawiki {
+		t.Errorf("got sites %v", got.Sites)
+	}
+	if len(got.Domains) != 2 || got.Domains["rm.wikipedia.org"] != rmwiki {
+		t.Errorf("got domains %v", got.Domains)
+	}
+	if got := sample.FilterKeys([]string{"dewiki", "wikidatawiki"}); !slices.Equal(got, []string{"wikidatawiki"}) {
+		t.Errorf("got %v, want [wikidatawiki]", got)
+	}
+
+	var none *BuildSample
+	if none.FilterSites(sites) != sites {
+		t.Error("nil sample should keep all sites")
+	}
+}
+
+func TestBuildSample_KeepItem(t *testing.T) {
+	var none *BuildSample
+	sample := NewBuildSample(nil, 10)
+	kept := 0
+	for item := int64(1); item <= 100000; item++ {
+		if !none.KeepItem(item) {
+			t.Fatalf("nil sample should keep Q%d", item)
+		}
+		if sample.KeepItem(item) {
+			kept += 1
+		}
+	}
+	if kept < 9000 || kept > 11000 {
+		t.Errorf("kept %d of 100000 items, want about 10000", kept)
+	}
+
+	for _, item := range []int64{1, 72, 5296} {
+		if got, want := sample.KeepItemID(Item(item).String()), sample.KeepItem(item); got != want {
+			t.Errorf("KeepItemID(Q%d) = %v, want %v", item, got, want)
+		}
+	}
+	if !sample.KeepItemID("P31") {
+		t.Error("IDs that are not items should be kept")
+	}
+	if all := NewBuildSample(nil, 1); !all.KeepItem(2) || !all.KeepItem(3) {
+		t.Error("ItemRate 1 should keep all items")
+	}
+}
+
+func TestWriteItemLines_Sample(t *testing.T) {
+	ctx := withBuildSample(context.Background(), NewBuildSample(nil, 3))
+	ch := make(chan string, 5)
+	for _, line := range []string{"Q1,1,2", "Q1,3,4", "Q10,5,6", "Q2,7,8", "Q5,9,10"} {
+		ch <- line
+	}
+	close(ch)
+	var buf bytes.Buffer
+	n, err := writeItemLines(ctx, ch, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "Q1,1,2\nQ5,9,10\n"; got != want || n != 2 {
+		t.Errorf("got %q for %d items, want %q for 2 items", got, n, want)
+	}
+}
+
+func TestBuildSample_ID(t *testing.T) {
+	var none *BuildSample
+	if got := none.ID(); got != "" {
+		t.Errorf("got %q, want empty ID for nil sample", got)
+	}
+	if got := none.StoragePrefix(); got != "" {
+		t.Errorf("got %q, want empty prefix for nil sample", got)
+	}
+	sample := NewBuildSample([]string{"rmwikibooks", "rmwiki"}, 100)
+	if got, want := sample.ID(), "100-rmwiki,rmwikibooks,wikidatawiki"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := sample.StoragePrefix(), "testrun/100-rmwiki,rmwikibooks,wikidatawiki/"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if other := NewBuildSample([]string{"rmwiki"}, 100); other.ID() == sample.ID() {
+		t.Errorf("samples of different sites should have different IDs")
+	}
+}
+
+func TestCountItemLines_Sample(t *testing.T) {
+	ctx := withBuildSample(context.Background(), NewBuildSample(nil, 3))
+	ch := make(chan string, 5)
+	for _, line := range []string{"Q1", "Q1", "Q10", "Q2", "Q5"} {
+		ch <- line
+	}
+	close(ch)
+	var buf bytes.Buffer
+	n, err := countItemLines(ctx, ch, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "Q1,2\nQ5,1\n"; got != want || n != 2 {
+		t.Errorf("got %q for %d items, want %q for 2 items", got, n, want)
+	}
+}
+
+func TestJoinMergedItems_Sample(t *testing.T) {
+	ctx := withBuildSample(context.Background(), NewBuildSample(nil, 3))
+	ch := make(chan string, 4)
+	for _, line := range []string{"7\tA\tQ1", "7\tB\tQ2", "8\tA\tQ10", "8\tB\tQ5"} {
+		ch <- line
+	}
+	close(ch)
+	var buf bytes.Buffer
+	n, err := joinMergedItems(ctx, ch, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "Q2,Q1\n"; got != want || n != 1 {
+		t.Errorf("got %q for %d items, want %q for 1 item", got, n, want)
+	}
+}
+
+func TestPageSignalMerger_Sample(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	var buf bytes.Buffer
+	m := NewPageSignalMerger(NopWriteCloser(&buf))
+	m.sample = NewBuildSample(nil, 3)
+	for _, line := range []string{"1,Q1", "1,s=7", "2,Q10", "2,s=8", "3,Q5"} {
+		if err := m.Process(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "1,Q1,7\n3,Q5,\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestBuildItemSignals_Sample(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	s3 := NewFakeS3()
+	s3.WriteLines([]string{
+		"rm.wikipedia,1,5",
+		"rm.wikipedia,3824,2",
+		"rm.wikipedia,799,7",
+	}, "pageviews/pageviews-2011-W07.zst")
+	s3.WriteLines([]string{"1,Q5296,2500", "3824,Q662541,4973", "799,Q72,3142"}, "page_signals/rmwiki-20111209-page_signals.zst")
+	dumped, _ := time.Parse(time.DateOnly, "2011-12-09")
+	rmwiki := &WikiSite{Key: "rmwiki", Domain: "rm.wikipedia.org", LastDumped: dumped}
+	sites := &WikiSites{
+		Sites:   map[string]*WikiSite{"rmwiki": rmwiki},
+		Domains: map[string]*WikiSite{"rm.wikipedia.org": rmwiki},
+	}
+
+	// With one in three items, only Q72 is in the sample.
+	sample := NewBuildSample([]string{"rmwiki"}, 3)
+	ctx := withBuildSample(context.Background(), sample)
+	pageviews := []string{"pageviews/pageviews-2011-W07.zst"}
+	if _, err := buildItemSignals(ctx, pageviews, sites, BuildOptions{Sample: sample}, s3); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s3.ReadLines("public/item_signals-20111209.csv.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []string
+	for _, line := range got {
+		if len(line) > 0 && line[0] == 'Q' {
+			items = append(items, line[:bytes.IndexByte([]byte(line), ',')])
+		}
+	}
+	if want := []string{"Q72"}; !slices.Equal(items, want) {
+		t.Errorf("got items %v, want %v", items, want)
+	}
+}
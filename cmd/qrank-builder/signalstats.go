@@ -0,0 +1,274 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"math"
+	"math/bits"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/brawer/wikidata-qrank/v2/pkg/qrank"
+)
+
+// SignalStats describes the distribution of item signals in a release.
+// It gets published next to the signals, so that data quality regressions
+// become visible immediately; for example, if a large wiki is missing
+// from a release, its row count will be zero.
+//
+// This is version 2 of the QRank stats format. Version 1 was produced
+// by buildStats for the old pipeline, and it only contained samples
+// for plotting the QRank distribution.
+type SignalStats struct {
+	FormatVersion   int                   `json:"format_version"` // always 2
+	Version         string                `json:"version"`        // eg. "2024-05-01"
+	Items           int64                 `json:"items"`
+	Totals          map[string]int64      `json:"totals"`
+	ItemsWithSignal map[string]int64      `json:"items_with_signal"`
+	Histograms      map[string][]int64    `json:"histograms"`
+	Sites           map[string]*SiteStats `json:"sites"` // domain → stats
+
+	// TruncatedItems is the number of items that were left out from
+	// the published item_signals file because they had fewer pageviews
+	// than BuildOptions.MinPageviews. The other fields always describe
+	// the full file, which includes these items.
+	TruncatedItems int64 `json:"truncated_items,omitempty"`
+
+	// CappedItems is the number of items whose pageviews were capped
+	// because a single week had more than BuildOptions.MaxWeekMultiple
+	// times the views of the item's median week, which is typical for
+	// view-bombing campaigns and bot spikes.
+	CappedItems int64 `json:"capped_items,omitempty"`
+
+	// ExcludedStubs is the number of items that were left out because
+	// they looked like stubs, if the release was built with
+	// BuildOptions.ExcludeStubs. Unlike TruncatedItems, these items
+	// are not described by the other fields.
+	ExcludedStubs int64 `json:"excluded_stubs,omitempty"`
+
+	// SitelinkSources compares the two sources for sitelink counts,
+	// if the release was built with BuildOptions.SitelinksFromDump.
+	SitelinkSources *SitelinkSourceStats `json:"sitelink_sources,omitempty"`
+
+	// SHA256 maps the names of published files, such as
+	// "item_signals-20240501.csv.zst", to the hex-encoded SHA-256
+	// digest of their content. The webserver checks its downloads
+	// against it before serving them.
+	SHA256 map[string]string `json:"sha256,omitempty"`
+
+	// Distribution is the cumulative distribution of pageviews over
+	// the ranked items, at the percentages in distributionPercents.
+	// Buckets counts the ranked items in each QRankBucket from 1 to 10.
+	// Both get filled in by ComputeDistribution.
+	Distribution []DistributionPoint `json:"distribution,omitempty"`
+	Buckets      []int64             `json:"buckets,omitempty"`
+
+	// For computing the distribution, we count how many items have
+	// each number of pageviews. There are far fewer distinct values
+	// than items, so this fits into memory even for all of Wikidata.
+	pageviewCounts map[int64]int64
+}
+
+// DistributionPoint is a point on the cumulative distribution of
+// pageviews. The top Percent of all ranked items have at least
+// Pageviews; the last of them is at position Rank.
+type DistributionPoint struct {
+	Percent   int   `json:"percent"`
+	Rank      int64 `json:"rank"`
+	Pageviews int64 `json:"pageviews"`
+}
+
+// The percentages for which ComputeDistribution reports the
+// cumulative distribution.
+var distributionPercents = []int{1, 2, 5, 10, 20, 50, 100}
+
+// SitelinkSourceStats tells how often the wb-sitelinks page property
+// differs from the sitelinks counted in the wb_items_per_site dump.
+// Because the page property is sometimes stale, this quantifies
+// its staleness. The released item signals use the dump counts.
+type SitelinkSourceStats struct {
+	Differing      int64 `json:"differing"`        // items with differing counts
+	PagePropHigher int64 `json:"page_prop_higher"` // items where page prop > dump
+	DumpHigher     int64 `json:"dump_higher"`      // items where dump > page prop
+	AbsDifference  int64 `json:"abs_difference"`   // sum of |page prop - dump|
+}
+
+// SiteStats tells how much data a Wikimedia site contributed to a release.
+type SiteStats struct {
+	Key    string `json:"key,omitempty"`    // eg. "rmwiki"
+	Dumped string `json:"dumped,omitempty"` // dump date, eg. "2024-05-01"
+	Rows   int64  `json:"rows"`             // number of rows consumed
+}
+
+// SignalNames are the names of the signals in SignalStats, in the same
+// order as the columns of the item signals file.
+var signalNames = qrank.ItemSignalsSchemas[qrank.CurrentItemSignalsSchema].Columns[1:]
+
+// NewSignalStats returns empty stats for a release. Every site gets
+// an entry, even if it does not contribute any rows to the release.
+func NewSignalStats(version time.Time, sites *WikiSites) *SignalStats {
+	s := &SignalStats{
+		FormatVersion:   2,
+		Version:         version.Format(time.DateOnly),
+		Totals:          make(map[string]int64, len(signalNames)),
+		ItemsWithSignal: make(map[string]int64, len(signalNames)),
+		Histograms:      make(map[string][]int64, len(signalNames)),
+		Sites:           make(map[string]*SiteStats, len(sites.Sites)),
+	}
+	for _, name := range signalNames {
+		s.Totals[name] = 0
+		s.ItemsWithSignal[name] = 0
+		s.Histograms[name] = []int64{}
+	}
+	for _, site := range sites.Sites {
+		domain := strings.TrimSuffix(site.Domain, ".org")
+		s.Sites[domain] = &SiteStats{
+			Key:    site.Key,
+			Dumped: site.LastDumped.Format(time.DateOnly),
+		}
+	}
+	return s
+}
+
+// AddItem accounts for the signals of one item.
+func (s *SignalStats) AddItem(sig ItemSignals) {
+	s.Items += 1
+	if s.pageviewCounts == nil {
+		s.pageviewCounts = make(map[int64]int64, 1024)
+	}
+	s.pageviewCounts[sig.pageviews] += 1
+	if sig.cappedWeeks > 0 {
+		s.CappedItems += 1
+	}
+	for _, name := range signalNames {
+		v := itemSignalsColumns[name](&sig)
+		s.Totals[name] += v
+		if v > 0 {
+			s.ItemsWithSignal[name] += 1
+		}
+		bucket := histogramBucket(v)
+		hist := s.Histograms[name]
+		for len(hist) <= bucket {
+			hist = append(hist, 0)
+		}
+		hist[bucket] += 1
+		s.Histograms[name] = hist
+	}
+}
+
+// ComputeDistribution fills in the cumulative distribution of pageviews
+// and the number of items in each QRankBucket, after all items have
+// been added.
+func (s *SignalStats) ComputeDistribution() {
+	values := make([]int64, 0, len(s.pageviewCounts))
+	for v := range s.pageviewCounts {
+		values = append(values, v)
+	}
+	slices.Sort(values)
+	slices.Reverse(values)
+
+	s.Distribution = make([]DistributionPoint, 0, len(distributionPercents))
+	s.Buckets = make([]int64, 10)
+	if len(values) == 0 {
+		return
+	}
+	maxValue := values[0]
+	next := 0
+	var pos int64 // position of the last item with the current value
+	for _, v := range values {
+		count := s.pageviewCounts[v]
+		pos += count
+		s.Buckets[QRankBucket(v, maxValue)-1] += count
+		for next < len(distributionPercents) {
+			p := int64(distributionPercents[next])
+			rank := (p*s.Items + 99) / 100 // ceil(p% of items)
+			if rank > pos {
+				break
+			}
+			s.Distribution = append(s.Distribution, DistributionPoint{int(p), rank, v})
+			next += 1
+		}
+	}
+}
+
+// QRankBucket maps a QRank value to a logarithmic bucket from 1 to 10,
+// relative to the highest QRank value. The top item is in bucket 10,
+// and items without any views are in bucket 1.
+func QRankBucket(value, maxValue int64) int {
+	if value <= 0 || maxValue <= 0 {
+		return 1
+	}
+	bucket := 1 + int(9*math.Log1p(float64(value))/math.Log1p(float64(maxValue)))
+	if bucket > 10 {
+		bucket = 10
+	}
+	return bucket
+}
+
+// AddSitelinkSources accounts for the sitelink counts of one item,
+// as given by the wb-sitelinks page property and the dump.
+func (s *SignalStats) AddSitelinkSources(pageProp int64, dump int64) {
+	if s.SitelinkSources == nil {
+		s.SitelinkSources = &SitelinkSourceStats{}
+	}
+	src := s.SitelinkSources
+	if pageProp > dump {
+		src.Differing += 1
+		src.PagePropHigher += 1
+		src.AbsDifference += pageProp - dump
+	} else if dump > pageProp {
+		src.Differing += 1
+		src.DumpHigher += 1
+		src.AbsDifference += dump - pageProp
+	}
+}
+
+// AddRows accounts for rows that were consumed for a domain,
+// such as "rm.wikipedia".
+func (s *SignalStats) AddRows(domain string, rows int64) {
+	site, ok := s.Sites[domain]
+	if !ok {
+		site = &SiteStats{}
+		s.Sites[domain] = site
+	}
+	site.Rows += rows
+}
+
+// AddDigest records the SHA-256 digest of a local file that gets
+// published at a storage path, such as "public/item_signals-20240501.csv.zst".
+func (s *SignalStats) AddDigest(dest string, file string) error {
+	digest, err := fileSHA256(file)
+	if err != nil {
+		return err
+	}
+	if s.SHA256 == nil {
+		s.SHA256 = make(map[string]string, 1)
+	}
+	s.SHA256[path.Base(dest)] = digest
+	return nil
+}
+
+// StoragePath returns the path of the stats file in S3 storage.
+func (s *SignalStats) StoragePath() string {
+	t, _ := time.Parse(time.DateOnly, s.Version)
+	return PublicPath("qrank-stats", t, "json")
+}
+
+// Put stores the stats as a JSON file in S3 storage.
+func (s *SignalStats) Put(ctx context.Context, s3 S3) error {
+	return PutJSON(ctx, s, s3, "qrank", s.StoragePath())
+}
+
+// HistogramBucket returns the histogram bucket for a signal value.
+// Bucket 0 counts zero values; bucket i > 0 counts the values
+// from 2^(i-1) to 2^i - 1. Negative values count as zero.
+func histogramBucket(v int64) int {
+	if v <= 0 {
+		return 0
+	}
+	return bits.Len64(uint64(v))
+}
@@ -0,0 +1,148 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSignalStats(t *testing.T) {
+	dumped, _ := time.Parse(time.DateOnly, "2024-04-03")
+	site := &WikiSite{Key: "rmwiki", Domain: "rm.wikipedia.org", LastDumped: dumped}
+	sites := &WikiSites{Sites: map[string]*WikiSite{"rmwiki": site}}
+	version, _ := time.Parse(time.DateOnly, "2024-05-01")
+	stats := NewSignalStats(version, sites)
+
+	stats.AddItem(ItemSignals{1, 0, 0, 0, 0, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil})
+	stats.AddItem(ItemSignals{2, 1, 3, 0, 0, 0, false, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, nil})
+	stats.AddItem(ItemSignals{3, 5, 4, 1, 0, 2, true, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, nil})
+	stats.AddRows("rm.wikipedia", 7)
+	stats.AddRows("www.wikidata", 2)
+
+	if got, want := stats.Items, int64(3); got != want {
+		t.Errorf("got Items=%d, want %d", got, want)
+	}
+	if got, want := stats.CappedItems, int64(1); got != want {
+		t.Errorf("got CappedItems=%d, want %d", got, want)
+	}
+
+	wantTotals := map[string]int64{
+		"pageviews_52w":  6,
+		"wikitext_bytes": 7,
+		"claims":         1,
+		"identifiers":    0,
+		"sitelinks":      2,
+		"disambiguation": 1,
+		"outlinks":       0,
+		"infoboxes":      0,
+	}
+	if !reflect.DeepEqual(stats.Totals, wantTotals) {
+		t.Errorf("got Totals=%v, want %v", stats.Totals, wantTotals)
+	}
+
+	wantWithSignal := map[string]int64{
+		"pageviews_52w":  2,
+		"wikitext_bytes": 2,
+		"claims":         1,
+		"identifiers":    0,
+		"sitelinks":      1,
+		"disambiguation": 1,
+		"outlinks":       0,
+		"infoboxes":      0,
+	}
+	if !reflect.DeepEqual(stats.ItemsWithSignal, wantWithSignal) {
+		t.Errorf("got ItemsWithSignal=%v, want %v", stats.ItemsWithSignal, wantWithSignal)
+	}
+
+	wantHist := map[string][]int64{
+		"pageviews_52w":  {1, 1, 0, 1},
+		"wikitext_bytes": {1, 0, 1, 1},
+		"claims":         {2, 1},
+		"identifiers":    {3},
+		"sitelinks":      {2, 0, 1},
+		"disambiguation": {2, 1},
+		"outlinks":       {3},
+		"infoboxes":      {3},
+	}
+	if !reflect.DeepEqual(stats.Histograms, wantHist) {
+		t.Errorf("got Histograms=%v, want %v", stats.Histograms, wantHist)
+	}
+
+	wantSites := map[string]*SiteStats{
+		"rm.wikipedia": {Key: "rmwiki", Dumped: "2024-04-03", Rows: 7},
+		"www.wikidata": {Rows: 2},
+	}
+	if !reflect.DeepEqual(stats.Sites, wantSites) {
+		t.Errorf("got Sites=%v, want %v", stats.Sites, wantSites)
+	}
+
+	if got, want := stats.StoragePath(), "public/qrank-stats-20240501.json"; got != want {
+		t.Errorf("got StoragePath()=%q, want %q", got, want)
+	}
+}
+
+func TestHistogramBucket(t *testing.T) {
+	for _, tc := range []struct {
+		v    int64
+		want int
+	}{
+		{-1, 0},
+		{0, 0},
+		{1, 1},
+		{2, 2},
+		{3, 2},
+		{4, 3},
+		{1023, 10},
+		{1024, 11},
+	} {
+		if got := histogramBucket(tc.v); got != tc.want {
+			t.Errorf("histogramBucket(%d) = %d, want %d", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestSignalStats_ComputeDistribution(t *testing.T) {
+	stats := NewSignalStats(time.Now(), &WikiSites{})
+	for i, pv := range []int64{4721864130, 107330319, 69160330, 5111172, 51123, 156, 1, 1, 1} {
+		stats.AddItem(ItemSignals{item: int64(i + 1), pageviews: pv})
+	}
+	stats.ComputeDistribution()
+
+	wantDist := []DistributionPoint{
+		{1, 1, 4721864130},
+		{2, 1, 4721864130},
+		{5, 1, 4721864130},
+		{10, 1, 4721864130},
+		{20, 2, 107330319},
+		{50, 5, 51123},
+		{100, 9, 1},
+	}
+	if !reflect.DeepEqual(stats.Distribution, wantDist) {
+		t.Errorf("got Distribution=%v, want %v", stats.Distribution, wantDist)
+	}
+	wantBuckets := []int64{3, 0, 1, 0, 1, 0, 1, 2, 0, 1}
+	if !reflect.DeepEqual(stats.Buckets, wantBuckets) {
+		t.Errorf("got Buckets=%v, want %v", stats.Buckets, wantBuckets)
+	}
+}
+
+func TestQRankBucket(t *testing.T) {
+	for _, tc := range []struct {
+		value, max int64
+		want       int
+	}{
+		{17602336, 17602336, 10},
+		{2470590, 17602336, 8},
+		{24545, 17602336, 6},
+		{1, 17602336, 1},
+		{0, 17602336, 1},
+		{0, 0, 1},
+	} {
+		if got := QRankBucket(tc.value, tc.max); got != tc.want {
+			t.Errorf("QRankBucket(%d, %d) = %d, want %d", tc.value, tc.max, got, tc.want)
+		}
+	}
+}
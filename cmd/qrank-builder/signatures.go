@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/minisign"
+)
+
+// SignatureExt is the extension of detached signatures in storage,
+// which are stored next to the signed file.
+const signatureExt = ".minisig"
+
+// BuildSignatures puts a detached minisign signature next to every
+// public file in storage that does not have one yet, such as
+// public/qrank-stats-20240501.json.minisig for the stats file.
+// Signatures whose signed file has been deleted get cleaned up.
+// The result is the number of files that got signed.
+func buildSignatures(ctx context.Context, key *minisign.PrivateKey, s3 S3) (int, error) {
+	files := make(map[string]bool, 100)
+	signatures := make(map[string]bool, 100)
+	opts := minio.ListObjectsOptions{Prefix: "public/", Recursive: true}
+	for obj := range s3.ListObjects(ctx, "qrank", opts) {
+		if obj.Err != nil {
+			return 0, obj.Err
+		}
+		if signed, ok := strings.CutSuffix(obj.Key, signatureExt); ok {
+			signatures[signed] = true
+		} else if !strings.HasSuffix(obj.Key, "/") {
+			files[obj.Key] = true
+		}
+	}
+
+	numSigned := 0
+	for file := range files {
+		if signatures[file] {
+			continue
+		}
+		if pastBuildDeadline(ctx) {
+			return numSigned, ErrMaxRuntime
+		}
+		if err := signFile(ctx, file, key, s3); err != nil {
+			return numSigned, err
+		}
+		numSigned += 1
+	}
+
+	for signed := range signatures {
+		if !files[signed] {
+			dest := signed + signatureExt
+			logger.Printf("deleting %s because %s does not exist anymore", dest, signed)
+			if err := s3.RemoveObject(ctx, "qrank", dest, minio.RemoveObjectOptions{}); err != nil {
+				return numSigned, err
+			}
+		}
+	}
+
+	logger.Printf("signed %d public files with key %s", numSigned, key.ID)
+	return numSigned, nil
+}
+
+// SignFile signs a file in storage, and stores its signature next to it.
+// Like the minisign tool, we put a timestamp and the file name into
+// the trusted comment, so that a signature cannot be passed off as
+// belonging to another file.
+func signFile(ctx context.Context, file string, key *minisign.PrivateKey, s3 S3) error {
+	reader, err := NewS3Reader(ctx, "qrank", file, s3)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	comment := fmt.Sprintf("timestamp:%d\tfile:%s\thashed", time.Now().Unix(), path.Base(file))
+	sig, err := key.Sign(reader, comment)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	text, err := sig.MarshalText()
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp("", "*"+signatureExt)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(text); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return PutInStorage(ctx, temp.Name(), s3, "qrank", file+signatureExt, "text/plain")
+}
+
+// ReadSigningKey reads a minisign secret key without password,
+// as created by “minisign -G -W”.
+func ReadSigningKey(keyPath string) (*minisign.PrivateKey, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := minisign.ParsePrivateKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyPath, err)
+	}
+	return key, nil
+}
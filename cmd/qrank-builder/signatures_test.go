@@ -0,0 +1,101 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/minisign"
+)
+
+func TestBuildSignatures(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	pub, key, err := minisign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s3 := NewFakeS3()
+	s3.data["public/qrank-stats-20240501.json"] = []byte(`{"Samples": []}`)
+	s3.WriteLines([]string{"signals"}, "public/item_signals-20240501.csv.zst")
+	s3.data["public/item_signals-20240424.csv.zst.minisig"] = []byte("orphaned")
+	s3.data["public/prank-20240501.csv.zst"] = []byte("prank")
+	s3.data["public/prank-20240501.csv.zst.minisig"] = []byte("already signed")
+	s3.data["page_signals/rmwiki-20240501-page_signals.zst"] = []byte("not public")
+
+	n, err := buildSignatures(ctx, key, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("got %d signed files, want 2", n)
+	}
+
+	for _, file := range []string{"public/qrank-stats-20240501.json", "public/item_signals-20240501.csv.zst"} {
+		sig, err := minisign.ParseSignature(string(s3.data[file+".minisig"]))
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		if err := pub.Verify(bytes.NewReader(s3.data[file]), sig); err != nil {
+			t.Errorf("%s: %v", file, err)
+		}
+		if want := "\tfile:" + filepath.Base(file) + "\t"; !strings.Contains(sig.TrustedComment, want) {
+			t.Errorf("%s: trusted comment %q should contain %q", file, sig.TrustedComment, want)
+		}
+	}
+
+	if got := string(s3.data["public/prank-20240501.csv.zst.minisig"]); got != "already signed" {
+		t.Errorf("existing signature should have been kept, got %q", got)
+	}
+	if _, ok := s3.data["public/item_signals-20240424.csv.zst.minisig"]; ok {
+		t.Error("orphaned signature should have been deleted")
+	}
+	if _, ok := s3.data["page_signals/rmwiki-20240501-page_signals.zst.minisig"]; ok {
+		t.Error("non-public file should not have been signed")
+	}
+
+	// Running again should not sign anything.
+	if n, err := buildSignatures(ctx, key, s3); err != nil || n != 0 {
+		t.Errorf("second run signed %d files, err=%v; want 0, nil", n, err)
+	}
+}
+
+func TestReadSigningKey(t *testing.T) {
+	pub, key, err := minisign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := key.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "qrank.key")
+	if err := os.WriteFile(path, text, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadSigningKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Public().String() != pub.String() {
+		t.Errorf("got key %s, want %s", got.Public(), pub)
+	}
+
+	bad := filepath.Join(dir, "bad.key")
+	if err := os.WriteFile(bad, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSigningKey(bad); err == nil {
+		t.Error("expected error for bad key")
+	}
+}
@@ -0,0 +1,248 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/lanrat/extsort"
+	"github.com/minio/minio-go/v7"
+)
+
+// BuildSitelinks counts the sitelinks of Wikidata items in the
+// wb_items_per_site table of the wikidatawiki dump, and puts the
+// result into storage. The output has lines such as "Q72,188",
+// sorted by item.
+//
+// Normally, the sitelink counts come from the wb-sitelinks page
+// property, which is cheaper to read but sometimes stale because
+// Wikibase does not always update it when sitelinks change.
+func buildSitelinks(ctx context.Context, dumps string, sites *WikiSites, s3 S3) (string, error) {
+	site, ok := sites.Sites["wikidatawiki"]
+	if !ok {
+		return "", fmt.Errorf("no dumps for wikidatawiki")
+	}
+
+	ymd := site.LastDumped.Format("20060102")
+	dest := SitePath("sitelinks", site.Key, site.LastDumped)
+	stored, err := ListStoredFiles(ctx, "sitelinks", s3)
+	if err != nil {
+		return "", err
+	}
+	versions := stored[site.Key]
+	if slices.Contains(versions, ymd) {
+		return dest, nil
+	}
+
+	logger.Printf("building %s", dest)
+	start := time.Now()
+
+	outFile, err := os.CreateTemp("", "sitelinks-*.zst")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(outFile.Name())
+	defer outFile.Close()
+
+	writer, err := zstd.NewWriter(outFile, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		return "", err
+	}
+	defer writer.Close()
+
+	numItems := 0
+	ch := make(chan string, 10000)
+	config := newSortConfig(16)
+	g, subCtx := errgroup.WithContext(ctx)
+	sorter, outChan, errChan := extsort.Strings(sortInput(subCtx, "sitelinks", ch, config), config)
+	g.Go(func() error {
+		defer close(ch)
+		filename := fmt.Sprintf("%s-%s-wb_items_per_site.sql.gz", site.Key, ymd)
+		path := filepath.Join(dumps, site.Key, ymd, filename)
+		return readItemsPerSite(subCtx, path, ch)
+	})
+	g.Go(func() error {
+		sorter.Sort(subCtx)
+		n, err := countItemLines(subCtx, outChan, writer)
+		numItems = n
+		return err
+	})
+	if err := g.Wait(); err != nil {
+		return "", err
+	}
+	if err := <-errChan; err != nil {
+		return "", err
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	if err := outFile.Close(); err != nil {
+		return "", err
+	}
+
+	if err := PutInStorage(ctx, outFile.Name(), s3, "qrank", dest, "application/zstd"); err != nil {
+		return "", err
+	}
+	logger.Printf("built %s with sitelinks for %d items in %.1fs",
+		dest, numItems, time.Since(start).Seconds())
+
+	// Clean up old versions, keeping the previous one for readers
+	// that are still working on it.
+	for i := 0; i < len(versions)-1; i++ {
+		path := sitePath("sitelinks", site.Key, versions[i])
+		opts := minio.RemoveObjectOptions{}
+		if err := s3.RemoveObject(ctx, "qrank", path, opts); err != nil {
+			return "", err
+		}
+	}
+
+	return dest, nil
+}
+
+// ReadItemsPerSite reads a dump of the wb_items_per_site table,
+// and emits the item, such as "Q72", for every sitelink.
+func readItemsPerSite(ctx context.Context, path string, out chan<- string) error {
+	file, err := openDump(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	reader, err := NewSQLReader(gz)
+	if err != nil {
+		return err
+	}
+
+	itemCol := slices.Index(reader.Columns(), "ips_item_id")
+	if itemCol < 0 {
+		return fmt.Errorf("column ips_item_id not found in %s", path)
+	}
+
+	for {
+		row, err := reader.Read()
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			return nil
+		}
+
+		item := row[itemCol]
+		if _, err := strconv.ParseInt(item, 10, 64); err != nil {
+			return fmt.Errorf("bad ips_item_id in %s: %q", path, item)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- "Q" + item:
+		}
+	}
+}
+
+// CountItemLines counts runs of equal lines, such as "Q72", and writes
+// a line such as "Q72,188" for each run. The input must be sorted.
+// The result is the number of written lines.
+func countItemLines(ctx context.Context, lines <-chan string, w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	lastItem := ""
+	count := 0
+	numItems := 0
+	sample := buildSampleFrom(ctx)
+	write := func() error {
+		if count == 0 || !sample.KeepItemID(lastItem) {
+			return nil
+		}
+		numItems += 1
+		_, err := fmt.Fprintf(bw, "%s,%d\n", lastItem, count)
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return numItems, ctx.Err()
+
+		case item, more := <-lines:
+			if !more {
+				if err := write(); err != nil {
+					return numItems, err
+				}
+				return numItems, bw.Flush()
+			}
+			if item != lastItem {
+				if err := write(); err != nil {
+					return numItems, err
+				}
+				lastItem = item
+				count = 0
+			}
+			count += 1
+		}
+	}
+}
+
+// FindSitelinks returns the storage path of the most recent sitelinks file.
+func findSitelinks(ctx context.Context, s3 S3) (string, error) {
+	stored, err := ListStoredFiles(ctx, "sitelinks", s3)
+	if err != nil {
+		return "", err
+	}
+	versions := stored["wikidatawiki"]
+	if len(versions) == 0 {
+		return "", fmt.Errorf("no sitelink counts in storage; run the sitelinks stage first")
+	}
+	return sitePath("sitelinks", "wikidatawiki", versions[len(versions)-1]), nil
+}
+
+// SendSitelinks reads a sitelinks file with lines such as "Q72,188",
+// and emits ItemSignals that only carry the item and its sitelink count.
+func sendSitelinks(ctx context.Context, r io.Reader, out chan<- extsort.SortType) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		item, count, ok := parseSitelinksLine(line)
+		if !ok {
+			return fmt.Errorf(`bad line in sitelinks: "%s"`, line)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- ItemSignals{item: item, dumpSitelinks: count}:
+		}
+	}
+	return scanner.Err()
+}
+
+// ParseSitelinksLine parses a line such as "Q72,188" into 72 and 188.
+func parseSitelinksLine(line string) (item int64, count int64, ok bool) {
+	itemStr, countStr, found := strings.Cut(line, ",")
+	if !found || !strings.HasPrefix(itemStr, "Q") {
+		return 0, 0, false
+	}
+	i := ParseItem(itemStr)
+	n, err := strconv.ParseInt(countStr, 10, 64)
+	if i == NoItem || err != nil || n <= 0 {
+		return 0, 0, false
+	}
+	return int64(i), n, true
+}
@@ -0,0 +1,111 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lanrat/extsort"
+)
+
+func TestBuildSitelinks(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	dumps := filepath.Join("testdata", "dumps")
+	site := &WikiSite{Key: "wikidatawiki", LastDumped: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)}
+	sites := &WikiSites{Sites: map[string]*WikiSite{"wikidatawiki": site}}
+	s3 := NewFakeS3()
+	s3.data["sitelinks/wikidatawiki-20240301-sitelinks.zst"] = []byte("old")
+	s3.data["sitelinks/wikidatawiki-20240315-sitelinks.zst"] = []byte("previous")
+
+	path, err := buildSitelinks(ctx, dumps, sites, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "sitelinks/wikidatawiki-20240401-sitelinks.zst"; path != want {
+		t.Errorf("got %q, want %q", path, want)
+	}
+
+	got, err := s3.ReadLines(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Q5296,2", "Q662541,2", "Q72,3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, ok := s3.data["sitelinks/wikidatawiki-20240301-sitelinks.zst"]; ok {
+		t.Error("old version should have been deleted")
+	}
+	if _, ok := s3.data["sitelinks/wikidatawiki-20240315-sitelinks.zst"]; !ok {
+		t.Error("previous version should have been kept")
+	}
+
+	found, err := findSitelinks(ctx, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != path {
+		t.Errorf("findSitelinks() returned %q, want %q", found, path)
+	}
+}
+
+func TestFindSitelinks_Missing(t *testing.T) {
+	if _, err := findSitelinks(context.Background(), NewFakeS3()); err == nil {
+		t.Error("expected error when no sitelinks are in storage")
+	}
+}
+
+func TestCountItemLines(t *testing.T) {
+	ch := make(chan string, 10)
+	for _, item := range []string{"Q1", "Q1", "Q1", "Q10", "Q2", "Q2"} {
+		ch <- item
+	}
+	close(ch)
+	var buf bytes.Buffer
+	n, err := countItemLines(context.Background(), ch, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("got %d items, want 3", n)
+	}
+	if got, want := buf.String(), "Q1,3\nQ10,1\nQ2,2\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSendSitelinks(t *testing.T) {
+	ch := make(chan extsort.SortType, 10)
+	if err := sendSitelinks(context.Background(), strings.NewReader("Q72,188\nQ1,5\n"), ch); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	got := make([]ItemSignals, 0, 2)
+	for s := range ch {
+		got = append(got, s.(ItemSignals))
+	}
+	want := []ItemSignals{{item: 72, dumpSitelinks: 188}, {item: 1, dumpSitelinks: 5}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSendSitelinks_BadLine(t *testing.T) {
+	for _, line := range []string{"Q72", "Q72,", "Q72,x", "Q72,0", "Q72,-1", "72,5", "Q,5"} {
+		ch := make(chan extsort.SortType, 10)
+		if err := sendSitelinks(context.Background(), strings.NewReader(line), ch); err == nil {
+			t.Errorf("expected error for %q", line)
+		}
+	}
+}
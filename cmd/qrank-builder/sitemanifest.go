@@ -0,0 +1,202 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Per-site files are named after the dump date of their site. When
+// Wikimedia (or a mirror) re-lists an identical dump under a new date,
+// this would make us recompute the same files again. Therefore, we
+// also key per-site files by the content of their inputs: a hash over
+// the checksums of the dump files and the version of the code that
+// built them. For each kind of per-site file, a small manifest in
+// storage tells the input key of every stored file. If a new dump
+// has the same input key as a stored file, we copy that file instead
+// of building it; if a stored file has been built by another version
+// of the code, we build it again.
+
+// SiteFileVersions tells the version of the code that builds each kind
+// of per-site file. Whenever a change to a builder alters its output,
+// its version must be incremented, so that stored files get rebuilt.
+var siteFileVersions = map[string]int{
+	"page_signals": 1,
+	"page_items":   1,
+}
+
+// SiteFileCode identifies the code that builds a kind of per-site file,
+// such as "page_signals/1", followed by a variant for build options
+// that change the output, such as "page_signals/1+quality".
+func siteFileCode(filename string, variant string) string {
+	code := fmt.Sprintf("%s/%d", filename, siteFileVersions[filename])
+	if variant != "" {
+		code += "+" + variant
+	}
+	return code
+}
+
+// SiteFileManifest tells the input keys of the stored per-site files
+// of one kind. Files that were stored before we kept manifests have
+// no entry; we keep them, since we cannot tell how they were built.
+type siteFileManifest struct {
+	Inputs map[string]string `json:"inputs"` // storage path → input key
+}
+
+// ReadSiteFileManifest returns the manifest for a kind of per-site file,
+// or an empty manifest if storage has none yet.
+func readSiteFileManifest(ctx context.Context, filename string, s3 S3) (*siteFileManifest, error) {
+	manifest := &siteFileManifest{Inputs: make(map[string]string, 100)}
+	path := SiteManifestPath(filename)
+	opts := minio.ListObjectsOptions{Prefix: path}
+	found := false
+	for obj := range s3.ListObjects(ctx, "qrank", opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if obj.Key == path {
+			found = true
+		}
+	}
+	if !found {
+		return manifest, nil
+	}
+
+	reader, err := NewS3Reader(ctx, "qrank", path, s3)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	if err := json.NewDecoder(reader).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if manifest.Inputs == nil {
+		manifest.Inputs = make(map[string]string, 100)
+	}
+	return manifest, nil
+}
+
+// Find returns the stored path of another file of a site that has been
+// built from the same inputs, or the empty string if there is none.
+func (m *siteFileManifest) find(filename string, siteKey string, key string, stored []string) string {
+	for _, ymd := range stored {
+		path := sitePath(filename, siteKey, ymd)
+		if m.Inputs[path] == key {
+			return path
+		}
+	}
+	return ""
+}
+
+// SiteInputKey returns a hash over the dump files of a site and the
+// code that processes them. Because the names of the dump files get
+// hashed without their date, an identical dump has the same key under
+// any date. The checksums are taken from the sha1sums and md5sums files
+// of the dump; small files without a listed checksum get hashed here.
+// If a large file has no checksum, or the dump cannot be found, the
+// result is the empty string, meaning that the inputs are unknown.
+func siteInputKey(dumps string, site *WikiSite, code string) (string, error) {
+	ymd := site.LastDumped.Format("20060102")
+	dir := filepath.Join(dumps, site.Key, ymd)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	checksums, err := readDumpChecksums(dir)
+	if err != nil {
+		return "", err
+	}
+
+	prefix := fmt.Sprintf("%s-%s-", site.Key, ymd)
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n", code)
+	numFiles := 0
+	for _, e := range entries {
+		table, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok || e.IsDir() || !strings.HasSuffix(table, ".gz") {
+			continue
+		}
+		sum, ok := checksums[e.Name()]
+		if !ok {
+			info, err := e.Info()
+			if err != nil {
+				return "", err
+			}
+			if info.Size() > maxValidatedDumpSize {
+				return "", nil
+			}
+			sum, err = fileSHA256(filepath.Join(dir, e.Name()))
+			if err != nil {
+				return "", err
+			}
+		}
+		fmt.Fprintf(hash, "%s  %s\n", sum, table)
+		numFiles += 1
+	}
+	if numFiles == 0 {
+		return "", nil
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ReadDumpChecksums reads the sha1sums and md5sums files of a dump,
+// returning the checksum of each listed file. Where both are listed,
+// the SHA-1 checksum wins.
+func readDumpChecksums(dir string) (map[string]string, error) {
+	result := make(map[string]string, 50)
+	for _, pattern := range []string{"*-sha1sums.txt", "*-md5sums.txt"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range matches {
+			if err := readChecksumFile(path, result); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func readChecksumFile(path string, checksums map[string]string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Lines look like "7d7b0f1c0b5e8f4d  rmwiki-20240301-page.sql.gz".
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if _, found := checksums[fields[1]]; !found {
+			checksums[fields[1]] = fields[0]
+		}
+	}
+	return scanner.Err()
+}
+
+// Write stores the manifest for a kind of per-site file.
+func (m *siteFileManifest) write(ctx context.Context, filename string, s3 S3) error {
+	return PutJSON(ctx, m, s3, "qrank", SiteManifestPath(filename))
+}
@@ -0,0 +1,159 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSiteInputKey(t *testing.T) {
+	dumps := t.TempDir()
+	writeDump := func(ymd, table, content string) {
+		dir := filepath.Join(dumps, "rmwiki", ymd)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("rmwiki-%s-%s", ymd, table))
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := func(ymd, code string) string {
+		dumped, _ := time.Parse("20060102", ymd)
+		key, err := siteInputKey(dumps, &WikiSite{Key: "rmwiki", LastDumped: dumped}, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	writeDump("20240301", "page.sql.gz", "pages")
+	writeDump("20240301", "page_props.sql.gz", "props")
+	writeDump("20240308", "page.sql.gz", "pages")
+	writeDump("20240308", "page_props.sql.gz", "props")
+	writeDump("20240315", "page.sql.gz", "pages")
+	writeDump("20240315", "page_props.sql.gz", "changed props")
+
+	if key("20240301", "foo/1") == "" {
+		t.Error("key should not be empty")
+	}
+	if key("20240301", "foo/1") != key("20240308", "foo/1") {
+		t.Error("identical dumps under different dates should have the same key")
+	}
+	if key("20240301", "foo/1") == key("20240315", "foo/1") {
+		t.Error("changed dump should change the key")
+	}
+	if key("20240301", "foo/1") == key("20240301", "foo/2") {
+		t.Error("changed code should change the key")
+	}
+	if got := key("20240501", "foo/1"); got != "" {
+		t.Errorf("got %q for missing dump, want empty key", got)
+	}
+
+	// Checksums listed by Wikimedia take precedence over the content.
+	before := key("20240308", "foo/1")
+	writeDump("20240308", "sha1sums.txt", "0123abcd  rmwiki-20240308-page.sql.gz\n")
+	if key("20240308", "foo/1") == before {
+		t.Error("key should be derived from checksum file")
+	}
+}
+
+func TestBuildSiteFiles_ReusesIdenticalInputs(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	dumps := filepath.Join("testdata", "dumps")
+	sites, err := ReadWikiSites(nil, dumps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rmwiki, err := siteInputKey(dumps, sites.Sites["rmwiki"], "foobar/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wikidata, err := siteInputKey(dumps, sites.Sites["wikidatawiki"], "foobar/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The dump of rmwiki is identical to an older one, whose file
+	// we can reuse. The file for wikidatawiki has been built by
+	// an older version of the code, so it needs to be rebuilt.
+	s3 := NewFakeS3()
+	s3.data["foobar/rmwiki-20240220-foobar.zst"] = []byte("old")
+	s3.data["foobar/wikidatawiki-20240401-foobar.zst"] = []byte("outdated")
+	manifest := &siteFileManifest{Inputs: map[string]string{
+		"foobar/rmwiki-20240220-foobar.zst":       rmwiki,
+		"foobar/wikidatawiki-20240401-foobar.zst": "0000",
+	}}
+	if err := manifest.write(ctx, "foobar", s3); err != nil {
+		t.Fatal(err)
+	}
+
+	var built []string
+	var mutex sync.Mutex
+	buildFunc := func(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		built = append(built, site.Key)
+		s3.(*FakeS3).data[site.S3Path("foobar")] = []byte("fresh")
+		return nil
+	}
+	if err := buildSiteFiles(ctx, "foobar", "foobar/1", buildFunc, dumps, sites, nil, s3); err != nil {
+		t.Fatal(err)
+	}
+
+	slices.Sort(built)
+	if want := []string{"itwikibooks", "loginwiki", "rmwikibooks", "wikidatawiki"}; !slices.Equal(built, want) {
+		t.Errorf("got built %q, want %q", built, want)
+	}
+	for path, want := range map[string]string{
+		"foobar/rmwiki-20240220-foobar.zst":       "old",
+		"foobar/rmwiki-20240301-foobar.zst":       "old",
+		"foobar/wikidatawiki-20240401-foobar.zst": "fresh",
+	} {
+		if got := string(s3.data[path]); got != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+
+	got, err := readSiteFileManifest(ctx, "foobar", s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k := got.Inputs["foobar/rmwiki-20240301-foobar.zst"]; k != rmwiki {
+		t.Errorf("manifest has %q for reused file, want %q", k, rmwiki)
+	}
+	if k := got.Inputs["foobar/wikidatawiki-20240401-foobar.zst"]; k != wikidata {
+		t.Errorf("manifest has %q for rebuilt file, want %q", k, wikidata)
+	}
+
+	// Running again should not build anything.
+	built = nil
+	if err := buildSiteFiles(ctx, "foobar", "foobar/1", buildFunc, dumps, sites, nil, s3); err != nil {
+		t.Fatal(err)
+	}
+	if len(built) != 0 {
+		t.Errorf("second run should not build anything, got %q", built)
+	}
+}
+
+func TestReadSiteFileManifest_Missing(t *testing.T) {
+	manifest, err := readSiteFileManifest(context.Background(), "foobar", NewFakeS3())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Inputs == nil || len(manifest.Inputs) != 0 {
+		t.Errorf("got %v, want empty manifest", manifest.Inputs)
+	}
+}
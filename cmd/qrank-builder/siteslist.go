@@ -0,0 +1,275 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// MaxSitesListAge is how old a list of sites can get before we look
+// for a fresher one. Wikimedia dumps the sites table of metawiki twice
+// a month, so a table older than this means that the dumps are stuck.
+const maxSitesListAge = 40 * 24 * time.Hour
+
+// SitesList maps the keys of Wikimedia sites to their domains,
+// such as "rmwiki" to "rm.wikipedia.org". Whenever we get a fresh
+// list, we cache it in storage, so that a later run can still find
+// the sites if the dump of the sites table is missing.
+type sitesList struct {
+	Source  string            `json:"source"` // "sites-table" or "sitematrix"
+	Date    string            `json:"date"`   // YYYY-MM-DD
+	Domains map[string]string `json:"domains"`
+}
+
+var sitesListPathRegexp = regexp.MustCompile(`^internal/sites-\d{8}\.json$`)
+
+// LoadSitesList finds the list of Wikimedia sites. If the sites
+// table of metawiki is missing or stale, we use the list that has
+// been cached in storage by a previous run; if that is stale too,
+// we fetch the sitematrix from the live Action API. As a last
+// resort, we take the newest of the stale lists. If the dump date
+// is pinned, the sites table of that run is never considered stale.
+func loadSitesList(ctx context.Context, client *http.Client, dumps string, s3 S3, now time.Time) (*sitesList, error) {
+	table, tableErr := readSitesTable(dumps)
+	if tableErr == nil && (!table.isStale(now) || !pinnedDumpDate.IsZero()) {
+		if err := cacheSitesList(ctx, table, s3); err != nil {
+			return nil, err
+		}
+		return table, nil
+	}
+	if tableErr != nil {
+		logger.Printf("cannot read sites table of metawiki: %v", tableErr)
+	} else {
+		logger.Printf("sites table of metawiki is stale, dumped on %s", table.Date)
+	}
+
+	cached, err := readCachedSitesList(ctx, s3)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil && !cached.isStale(now) {
+		logger.Printf("using cached list of %d sites from %s of %s", len(cached.Domains), cached.Source, cached.Date)
+		return cached, nil
+	}
+
+	if client != nil {
+		matrix, err := fetchSitematrix(client, now)
+		if err == nil {
+			logger.Printf("using sitematrix with %d sites", len(matrix.Domains))
+			if err := cacheSitesList(ctx, matrix, s3); err != nil {
+				return nil, err
+			}
+			return matrix, nil
+		}
+		logger.Printf("cannot fetch sitematrix: %v", err)
+	}
+
+	best := table
+	if cached != nil && (best == nil || cached.Date > best.Date) {
+		best = cached
+	}
+	if best == nil {
+		return nil, tableErr
+	}
+	logger.Printf("using stale list of sites from %s of %s", best.Source, best.Date)
+	return best, nil
+}
+
+// IsStale returns whether the list is older than maxSitesListAge.
+func (list *sitesList) isStale(now time.Time) bool {
+	date, err := time.Parse(time.DateOnly, list.Date)
+	if err != nil {
+		return true
+	}
+	return now.Sub(date) > maxSitesListAge
+}
+
+// ReadSitesTable reads the list of sites from the latest dump
+// of the sites table of metawiki, or from the pinned dump run.
+func readSitesTable(dumps string) (*sitesList, error) {
+	path := siteDumpPath(dumps, "metawiki", "sites.sql.gz")
+	f, err := openDump(context.Background(), path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	reader, err := NewSQLReader(gz)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &sitesList{Source: "sites-table", Domains: make(map[string]string, 1000)}
+	if latest, err := filepath.EvalSymlinks(path); err == nil {
+		version := filepath.Base(filepath.Dir(latest))
+		if dumped, err := time.Parse("20060102", version); err == nil {
+			list.Date = dumped.Format(time.DateOnly)
+		}
+	}
+
+	columns := reader.Columns()
+	globalKeyCol := slices.Index(columns, "site_global_key")
+	domainCol := slices.Index(columns, "site_domain")
+	for {
+		row, err := reader.Read()
+		if row == nil {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		list.Domains[row[globalKeyCol]] = decodeDomain(row[domainCol])
+	}
+
+	return list, nil
+}
+
+// ReadCachedSitesList returns the newest list of sites that has been
+// cached in storage, or nil if there is none.
+func readCachedSitesList(ctx context.Context, s3 S3) (*sitesList, error) {
+	keys, err := listCachedSitesLists(ctx, s3)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	reader, err := NewS3Reader(ctx, "qrank", keys[len(keys)-1], s3)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var list sitesList
+	if err := json.NewDecoder(reader).Decode(&list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// CacheSitesList stores a list of sites in storage, unless it is
+// already there, and deletes any older lists.
+func cacheSitesList(ctx context.Context, list *sitesList, s3 S3) error {
+	date, err := time.Parse(time.DateOnly, list.Date)
+	if err != nil {
+		return err
+	}
+
+	keys, err := listCachedSitesLists(ctx, s3)
+	if err != nil {
+		return err
+	}
+	path := InternalPath("sites", date, "json")
+	if n := len(keys); n > 0 && keys[n-1] >= path {
+		return nil
+	}
+
+	if err := PutJSON(ctx, list, s3, "qrank", path); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		logger.Printf("deleting outdated list of sites %s", key)
+		if err := s3.RemoveObject(ctx, "qrank", key, minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListCachedSitesLists returns the storage paths of the cached lists
+// of sites, sorted from oldest to newest.
+func listCachedSitesLists(ctx context.Context, s3 S3) ([]string, error) {
+	var keys []string
+	opts := minio.ListObjectsOptions{Prefix: "internal/sites-"}
+	for obj := range s3.ListObjects(ctx, "qrank", opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if sitesListPathRegexp.MatchString(obj.Key) {
+			keys = append(keys, obj.Key)
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+// FetchSitematrix fetches the list of sites from the live Action API.
+// https://www.mediawiki.org/wiki/Extension:SiteMatrix/API
+func fetchSitematrix(client *http.Client, now time.Time) (*sitesList, error) {
+	u := "https://meta.wikimedia.org/w/api.php?action=sitematrix&format=json&formatversion=2&smlimit=max"
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to fetch %s; StatusCode=%d", u, resp.StatusCode)
+	}
+
+	type site struct {
+		URL    string `json:"url"`
+		DBName string `json:"dbname"`
+	}
+	type language struct {
+		Site []site `json:"site"`
+	}
+	var result struct {
+		Sitematrix map[string]json.RawMessage `json:"sitematrix"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	list := &sitesList{
+		Source:  "sitematrix",
+		Date:    now.UTC().Format(time.DateOnly),
+		Domains: make(map[string]string, 1000),
+	}
+	add := func(sites []site) {
+		for _, s := range sites {
+			if u, err := url.Parse(s.URL); err == nil && s.DBName != "" && u.Hostname() != "" {
+				list.Domains[s.DBName] = u.Hostname()
+			}
+		}
+	}
+	for key, value := range result.Sitematrix {
+		switch key {
+		case "count":
+			continue
+		case "specials":
+			var specials []site
+			if err := json.Unmarshal(value, &specials); err != nil {
+				return nil, err
+			}
+			add(specials)
+		default:
+			var lang language
+			if err := json.Unmarshal(value, &lang); err != nil {
+				return nil, err
+			}
+			add(lang.Site)
+		}
+	}
+
+	if len(list.Domains) == 0 {
+		return nil, fmt.Errorf("empty sitematrix")
+	}
+	return list, nil
+}
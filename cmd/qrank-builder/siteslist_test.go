@@ -0,0 +1,205 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestLoadSitesList(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	s3.data["internal/sites-20240301.json"] = []byte(`{"source":"sites-table","date":"2024-03-01","domains":{}}`)
+	now := time.Date(2024, 4, 10, 0, 0, 0, 0, time.UTC)
+	list, err := loadSitesList(ctx, nil, filepath.Join("testdata", "dumps"), s3, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Source != "sites-table" || list.Date != "2024-04-01" {
+		t.Errorf("got %s of %s, want sites-table of 2024-04-01", list.Source, list.Date)
+	}
+	if got := list.Domains["rmwiki"]; got != "rm.wikipedia.org" {
+		t.Errorf(`got %q for rmwiki, want "rm.wikipedia.org"`, got)
+	}
+	if got, want := storedSitesLists(s3), []string{"internal/sites-20240401.json"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestLoadSitesList_MissingTable(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	s3.data["internal/sites-20240401.json"] = []byte(`{"source":"sites-table","date":"2024-04-01","domains":{"rmwiki":"rm.wikipedia.org"}}`)
+	now := time.Date(2024, 4, 10, 0, 0, 0, 0, time.UTC)
+	list, err := loadSitesList(ctx, nil, t.TempDir(), s3, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Date != "2024-04-01" || list.Domains["rmwiki"] != "rm.wikipedia.org" {
+		t.Errorf("got %v, want cached list", list)
+	}
+}
+
+func TestLoadSitesList_Sitematrix(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	s3.data["internal/sites-20240101.json"] = []byte(`{"source":"sites-table","date":"2024-01-01","domains":{}}`)
+	client := &http.Client{Transport: &fakeSitematrix{}}
+	now := time.Date(2024, 7, 15, 13, 14, 15, 0, time.UTC)
+
+	// The table in testdata is from 2024-04-01, which is stale by July.
+	list, err := loadSitesList(ctx, client, filepath.Join("testdata", "dumps"), s3, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Source != "sitematrix" || list.Date != "2024-07-15" {
+		t.Errorf("got %s of %s, want sitematrix of 2024-07-15", list.Source, list.Date)
+	}
+	want := map[string]string{
+		"rmwiki":       "rm.wikipedia.org",
+		"rmwikibooks":  "rm.wikibooks.org",
+		"wikidatawiki": "www.wikidata.org",
+	}
+	if fmt.Sprint(list.Domains) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", list.Domains, want)
+	}
+	if got, want := storedSitesLists(s3), []string{"internal/sites-20240715.json"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestLoadSitesList_Stale(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	s3.data["internal/sites-20240101.json"] = []byte(`{"source":"sitematrix","date":"2024-01-01","domains":{}}`)
+	client := &http.Client{Transport: &fakeSitematrix{broken: true}}
+	now := time.Date(2024, 7, 15, 0, 0, 0, 0, time.UTC)
+
+	// If everything is stale, the newest list wins.
+	list, err := loadSitesList(ctx, client, filepath.Join("testdata", "dumps"), s3, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Source != "sites-table" || list.Date != "2024-04-01" {
+		t.Errorf("got %s of %s, want sites-table of 2024-04-01", list.Source, list.Date)
+	}
+
+	// Stale lists do not get cached.
+	if got, want := storedSitesLists(s3), []string{"internal/sites-20240101.json"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := loadSitesList(ctx, client, t.TempDir(), NewFakeS3(), now); err == nil {
+		t.Error("expected error if there is no list of sites at all")
+	}
+}
+
+func TestReadWikiSitesWithFallback(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	client := &http.Client{Transport: &FakeWikiSite{}}
+	now := time.Date(2024, 4, 10, 0, 0, 0, 0, time.UTC)
+	sites, err := ReadWikiSitesWithFallback(ctx, client, filepath.Join("testdata", "dumps"), NewFakeS3(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := sites.Sites["rmwiki"]
+	if site == nil || site != sites.Domains["rm.wikipedia.org"] {
+		t.Fatalf("rmwiki not found or not registered by domain")
+	}
+	if got := site.LastDumped.Format(time.DateOnly); got != "2024-03-01" {
+		t.Errorf("got LastDumped=%s, want 2024-03-01", got)
+	}
+	if got := site.ResolveInterwikiPrefix("d"); got == nil || got.Key != "wikidatawiki" {
+		t.Errorf("got %v for interwiki prefix d, want wikidatawiki", got)
+	}
+}
+
+func TestCacheSitesList(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	s3.data["internal/sites-20240301.json"] = []byte("{}")
+	s3.data["internal/sites-stats-20240301.json"] = []byte("{}")
+	list := &sitesList{Source: "sites-table", Date: "2024-04-01", Domains: map[string]string{"rmwiki": "rm.wikipedia.org"}}
+	if err := cacheSitesList(ctx, list, s3); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := storedSitesLists(s3), []string{"internal/sites-20240401.json", "internal/sites-stats-20240301.json"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	var stored sitesList
+	if err := json.Unmarshal(s3.data["internal/sites-20240401.json"], &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Date != "2024-04-01" || stored.Domains["rmwiki"] != "rm.wikipedia.org" {
+		t.Errorf("got %v, want %v", stored, list)
+	}
+
+	// Caching an older list should not replace a newer one.
+	older := &sitesList{Source: "sitematrix", Date: "2024-03-15", Domains: map[string]string{}}
+	if err := cacheSitesList(ctx, older, s3); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := s3.data["internal/sites-20240315.json"]; found {
+		t.Error("older list should not have been cached")
+	}
+}
+
+func storedSitesLists(s3 *FakeS3) []string {
+	var keys []string
+	for key := range s3.data {
+		if filepath.Dir(key) == "internal" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// FakeSitematrix is a fake of the sitematrix API of the live site.
+type fakeSitematrix struct {
+	broken bool
+}
+
+func (f *fakeSitematrix) RoundTrip(req *http.Request) (*http.Response, error) {
+	header := make(http.Header)
+	if f.broken {
+		body := io.NopCloser(bytes.NewBufferString("Service Unavailable"))
+		return &http.Response{StatusCode: 503, Body: body, Header: header}, nil
+	}
+
+	if req.URL.Host == "meta.wikimedia.org" && req.URL.Query().Get("action") == "sitematrix" {
+		header.Add("Content-Type", "application/json")
+		body := io.NopCloser(bytes.NewBufferString(`{"sitematrix": {
+			"count": 3,
+			"0": {"code": "rm", "name": "rumantsch", "site": [
+				{"url": "https://rm.wikipedia.org", "dbname": "rmwiki", "code": "wiki"},
+				{"url": "https://rm.wikibooks.org", "dbname": "rmwikibooks", "code": "wikibooks", "closed": true}
+			]},
+			"specials": [
+				{"url": "https://www.wikidata.org", "dbname": "wikidatawiki", "code": "wikidata"}
+			]
+		}}`))
+		return &http.Response{StatusCode: 200, Body: body, Header: header}, nil
+	}
+
+	return nil, fmt.Errorf("unexpected request: %s", req.URL.String())
+}
@@ -0,0 +1,233 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lanrat/extsort"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Like for dumps and storage, we keep statistics about external sorting,
+// which takes much of the time in the long stages for large wikis such
+// as enwiki. Every sorter gets fed through sortInput(), which counts
+// the records, the chunks that the sorter spills to disk, and the time
+// that producers spend blocked because the sorter cannot keep up.
+// The statistics are kept by the name of the sort, such as "titles",
+// summed over all sites.
+var sortStats struct {
+	mutex  sync.Mutex
+	byName map[string]*sortCounters
+}
+
+type sortCounters struct {
+	records atomic.Int64 // records fed into sorters
+	chunks  atomic.Int64 // chunks spilled to disk
+	merges  atomic.Int64 // merge passes over spilled chunks
+	blocked atomic.Int64 // nanoseconds that producers were blocked
+}
+
+// SortInputBuffer is the capacity of the channels that sortInput()
+// returns. Producers have their own buffered channels; this one only
+// needs to smooth out the hand-over between goroutines.
+const sortInputBuffer = 1024
+
+// SortStats tells how much work went into external sorting. The
+// lanrat/extsort library spills every chunk of ChunkSize records
+// to disk, and then merges all chunks in a single pass. Blocked is
+// the time that producers could not hand over records because the
+// sorter was busy, summed over all concurrent sorts; if it is large,
+// sorting is the bottleneck of a stage.
+type SortStats struct {
+	Records int64
+	Chunks  int64
+	Merges  int64
+	Blocked time.Duration
+}
+
+// Sub returns the difference between two snapshots of the statistics.
+func (s SortStats) Sub(other SortStats) SortStats {
+	return SortStats{
+		Records: s.Records - other.Records,
+		Chunks:  s.Chunks - other.Chunks,
+		Merges:  s.Merges - other.Merges,
+		Blocked: s.Blocked - other.Blocked,
+	}
+}
+
+func (c *sortCounters) stats() SortStats {
+	return SortStats{
+		Records: c.records.Load(),
+		Chunks:  c.chunks.Load(),
+		Merges:  c.merges.Load(),
+		Blocked: time.Duration(c.blocked.Load()),
+	}
+}
+
+// GetSortStats returns a snapshot of the statistics about external
+// sorting, summed over all sorts.
+func GetSortStats() SortStats {
+	var total SortStats
+	for _, s := range getSortStatsByName() {
+		total.Records += s.Records
+		total.Chunks += s.Chunks
+		total.Merges += s.Merges
+		total.Blocked += s.Blocked
+	}
+	return total
+}
+
+func getSortStatsByName() map[string]SortStats {
+	sortStats.mutex.Lock()
+	defer sortStats.mutex.Unlock()
+
+	result := make(map[string]SortStats, len(sortStats.byName))
+	for name, c := range sortStats.byName {
+		result[name] = c.stats()
+	}
+	return result
+}
+
+func sortCountersFor(name string) *sortCounters {
+	sortStats.mutex.Lock()
+	defer sortStats.mutex.Unlock()
+
+	if sortStats.byName == nil {
+		sortStats.byName = make(map[string]*sortCounters, 20)
+	}
+	c, ok := sortStats.byName[name]
+	if !ok {
+		c = &sortCounters{}
+		sortStats.byName[name] = c
+	}
+	return c
+}
+
+// SortInput forwards the records of a producer to the channel that it
+// returns, which is meant to be the input of an external sorter with
+// config. On the way, it counts the records and spilled chunks, and how
+// long the sorter has kept the producer waiting. When in gets closed,
+// or when ctx is done, the returned channel gets closed too. Callers
+// should pass the context of the errgroup that runs the sorter, so the
+// forwarding stops when the sorter gives up reading.
+func sortInput[T any](ctx context.Context, name string, in <-chan T, config *extsort.Config) chan T {
+	counters := sortCountersFor(name)
+
+	// The extsort library replaces chunk sizes below 2 by its default,
+	// which newSortConfig() never produces; see mergeConfig() in extsort.
+	chunkSize := int64(config.ChunkSize)
+	if chunkSize < 2 {
+		chunkSize = int64(extsort.DefaultConfig().ChunkSize)
+	}
+
+	out := make(chan T, sortInputBuffer)
+	go func() {
+		defer close(out)
+
+		// To not contend on the shared counters for every record,
+		// we count in local variables and only add to the counters
+		// every few thousand records, and once more at the end.
+		var n, flushed int64
+		var blocked time.Duration
+		defer func() {
+			counters.records.Add(n - flushed)
+			counters.blocked.Add(int64(blocked))
+			if n%chunkSize != 0 {
+				counters.chunks.Add(1)
+			}
+			if n > 0 {
+				counters.merges.Add(1)
+			}
+		}()
+
+		for {
+			var rec T
+			select {
+			case r, more := <-in:
+				if !more {
+					return
+				}
+				rec = r
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case out <- rec:
+			default:
+				start := time.Now()
+				select {
+				case out <- rec:
+					blocked += time.Since(start)
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			n += 1
+			if n%chunkSize == 0 {
+				counters.chunks.Add(1)
+			}
+			if n-flushed == 4096 {
+				counters.records.Add(n - flushed)
+				counters.blocked.Add(int64(blocked))
+				flushed, blocked = n, 0
+			}
+		}
+	}()
+	return out
+}
+
+var (
+	sortRecordsDesc = prometheus.NewDesc(
+		"qrank_builder_sort_records_total",
+		"Number of records fed into external sorting, by sort.",
+		[]string{"sort"}, nil)
+	sortChunksDesc = prometheus.NewDesc(
+		"qrank_builder_sort_chunks_spilled_total",
+		"Number of sorted chunks spilled to disk by external sorting, by sort.",
+		[]string{"sort"}, nil)
+	sortMergesDesc = prometheus.NewDesc(
+		"qrank_builder_sort_merge_passes_total",
+		"Number of merge passes over spilled chunks, by sort.",
+		[]string{"sort"}, nil)
+	sortBlockedDesc = prometheus.NewDesc(
+		"qrank_builder_sort_blocked_seconds_total",
+		"Time that producers were blocked because external sorting could not keep up, by sort.",
+		[]string{"sort"}, nil)
+)
+
+// SortCollector exports the statistics about external sorting
+// to Prometheus.
+type sortCollector struct{}
+
+// Describe implements prometheus.Collector.
+func (sortCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sortRecordsDesc
+	ch <- sortChunksDesc
+	ch <- sortMergesDesc
+	ch <- sortBlockedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (sortCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := getSortStatsByName()
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		s := stats[name]
+		ch <- prometheus.MustNewConstMetric(sortRecordsDesc, prometheus.CounterValue, float64(s.Records), name)
+		ch <- prometheus.MustNewConstMetric(sortChunksDesc, prometheus.CounterValue, float64(s.Chunks), name)
+		ch <- prometheus.MustNewConstMetric(sortMergesDesc, prometheus.CounterValue, float64(s.Merges), name)
+		ch <- prometheus.MustNewConstMetric(sortBlockedDesc, prometheus.CounterValue, s.Blocked.Seconds(), name)
+	}
+}
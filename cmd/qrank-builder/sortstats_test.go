@@ -0,0 +1,142 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/lanrat/extsort"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSortInput(t *testing.T) {
+	before := getSortStatsByName()["test_sort_input"]
+
+	ch := make(chan string, 100)
+	config := extsort.DefaultConfig()
+	config.ChunkSize = 4
+	sorter, outChan, errChan := extsort.Strings(sortInput(context.Background(), "test_sort_input", ch, config), config)
+	for i := 10; i > 0; i-- {
+		ch <- fmt.Sprintf("%02d", i)
+	}
+	close(ch)
+	sorter.Sort(context.Background())
+
+	var got []string
+	for s := range outChan {
+		got = append(got, s)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"01", "02", "03", "04", "05", "06", "07", "08", "09", "10"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	stats := getSortStatsByName()["test_sort_input"].Sub(before)
+	if stats.Records != 10 || stats.Chunks != 3 || stats.Merges != 1 {
+		t.Errorf("got %+v, want 10 records in 3 chunks with 1 merge pass", stats)
+	}
+}
+
+func TestSortInput_Blocked(t *testing.T) {
+	before := getSortStatsByName()["test_sort_blocked"]
+
+	// Nobody reads from the sorter until the producer has filled
+	// the buffer, so the producer gets blocked.
+	ch := make(chan string)
+	config := extsort.DefaultConfig()
+	out := sortInput(context.Background(), "test_sort_blocked", ch, config)
+	go func() {
+		defer close(ch)
+		for i := 0; i < sortInputBuffer+10; i++ {
+			ch <- "x"
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	n := 0
+	for range out {
+		n += 1
+	}
+	if n != sortInputBuffer+10 {
+		t.Errorf("got %d records, want %d", n, sortInputBuffer+10)
+	}
+
+	stats := getSortStatsByName()["test_sort_blocked"].Sub(before)
+	if stats.Blocked < 10*time.Millisecond {
+		t.Errorf("got Blocked=%v, want at least 10ms", stats.Blocked)
+	}
+	if stats.Chunks != 1 || stats.Merges != 1 {
+		t.Errorf("got %+v, want 1 chunk and 1 merge pass", stats)
+	}
+}
+
+func TestSortInput_Canceled(t *testing.T) {
+	before := getSortStatsByName()["test_sort_canceled"]
+
+	// Nobody ever reads from the sorter, and the producer never
+	// closes its channel. Once the context is done, the forwarding
+	// goroutine must give up and close its output.
+	ch := make(chan string)
+	ctx, cancel := context.WithCancel(context.Background())
+	out := sortInput(ctx, "test_sort_canceled", ch, extsort.DefaultConfig())
+	for i := 0; i < sortInputBuffer+1; i++ {
+		ch <- "x"
+	}
+	cancel()
+
+	n := 0
+	for range out {
+		n += 1
+	}
+	if n != sortInputBuffer {
+		t.Errorf("got %d records, want %d", n, sortInputBuffer)
+	}
+	stats := getSortStatsByName()["test_sort_canceled"].Sub(before)
+	if stats.Records != sortInputBuffer {
+		t.Errorf("got %+v, want %d records", stats, sortInputBuffer)
+	}
+}
+
+func TestSortCollector(t *testing.T) {
+	ch := make(chan string, 1)
+	ch <- "foo"
+	close(ch)
+	for range sortInput(context.Background(), "test_sort_collector", ch, extsort.DefaultConfig()) {
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(sortCollector{})
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]float64, len(families))
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "sort" && label.GetValue() == "test_sort_collector" {
+					got[f.GetName()] = m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	for name, want := range map[string]float64{
+		"qrank_builder_sort_records_total":         1,
+		"qrank_builder_sort_chunks_spilled_total":  1,
+		"qrank_builder_sort_merge_passes_total":    1,
+		"qrank_builder_sort_blocked_seconds_total": 0,
+	} {
+		if v, ok := got[name]; !ok {
+			t.Errorf("%s: missing", name)
+		} else if v != want {
+			t.Errorf("%s: got %v, want %v", name, v, want)
+		}
+	}
+}
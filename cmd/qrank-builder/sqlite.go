@@ -0,0 +1,312 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/brawer/wikidata-qrank/v2/pkg/qrank"
+)
+
+// SQLiteColumn tells how to store a column of item_signals files
+// in the SQLite database.
+type sqliteColumn struct {
+	Type  string
+	Value func(s *qrank.ItemSignals) any
+}
+
+// SQLiteColumns maps the columns of item_signals files, except for
+// "item", to their SQLite type and value. Text columns are NULL
+// where the item_signals file has an empty value, so that queries
+// can use IS NULL.
+var sqliteColumns = map[string]sqliteColumn{
+	"pageviews_52w":          {"INTEGER NOT NULL", func(s *qrank.ItemSignals) any { return s.Pageviews }},
+	"wikitext_bytes":         {"INTEGER NOT NULL", func(s *qrank.ItemSignals) any { return s.WikitextBytes }},
+	"claims":                 {"INTEGER NOT NULL", func(s *qrank.ItemSignals) any { return s.Claims }},
+	"identifiers":            {"INTEGER NOT NULL", func(s *qrank.ItemSignals) any { return s.Identifiers }},
+	"sitelinks":              {"INTEGER NOT NULL", func(s *qrank.ItemSignals) any { return s.Sitelinks }},
+	"disambiguation":         {"INTEGER NOT NULL", func(s *qrank.ItemSignals) any { return s.Disambiguation }},
+	"outlinks":               {"INTEGER NOT NULL", func(s *qrank.ItemSignals) any { return s.Outlinks }},
+	"infoboxes":              {"INTEGER NOT NULL", func(s *qrank.ItemSignals) any { return s.Infoboxes }},
+	"pageviews_52w_max_wiki": {"INTEGER NOT NULL", func(s *qrank.ItemSignals) any { return s.MaxWikiPageviews }},
+	"class":                  {"TEXT", func(s *qrank.ItemSignals) any { return nullString(s.Class) }},
+	"merged_into":            {"TEXT", func(s *qrank.ItemSignals) any { return nullString(s.MergedInto) }},
+	"is_stub":                {"INTEGER NOT NULL", func(s *qrank.ItemSignals) any { return s.Stub }},
+	"external_links":         {"INTEGER NOT NULL", func(s *qrank.ItemSignals) any { return s.ExternalLinks }},
+	"templates":              {"INTEGER NOT NULL", func(s *qrank.ItemSignals) any { return s.Templates }},
+	"inlinks":                {"INTEGER NOT NULL", func(s *qrank.ItemSignals) any { return s.Inlinks }},
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// SQLitePath returns the storage path of the SQLite database
+// of a release, such as public/qrank-20240428.sqlite.
+func SQLitePath(version time.Time) string {
+	return PublicPath("qrank", version, "sqlite")
+}
+
+// BuildSQLite converts the most recent item_signals file in storage
+// into a SQLite database, for downstream scripts that would rather
+// run SQL queries than parse CSV. If storage has no item signals,
+// or the database has been built before, nothing gets done.
+func buildSQLite(ctx context.Context, s3 S3) (string, error) {
+	releases, err := listItemSignalsReleases(ctx, s3)
+	if err != nil {
+		return "", err
+	}
+	if len(releases) == 0 {
+		logger.Printf("no item signals in storage, not building SQLite database")
+		return "", nil
+	}
+
+	version := releases[len(releases)-1]
+	dest := SQLitePath(version)
+	if found, err := objectExists(ctx, dest, s3); err != nil {
+		return "", err
+	} else if found {
+		return dest, nil
+	}
+
+	logger.Printf("building %s", dest)
+	start := time.Now()
+	src := PublicPath("item_signals", version, "csv.zst")
+	opts := S3ReaderOptions{Compression: ZstdCompressed}
+	r, err := NewS3ReaderWithOptions(ctx, "qrank", src, s3, opts)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	reader, err := qrank.NewItemSignalsReader(r)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", src, err)
+	}
+
+	dir, err := os.MkdirTemp("", "qrank-sqlite-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "qrank.sqlite")
+
+	// The provenance tells how the ranks were computed, which the
+	// webserver needs for explaining them.
+	provenance, err := ReadProvenance(ctx, version, s3)
+	if err != nil {
+		return "", err
+	}
+
+	numItems, err := writeSQLite(ctx, reader, version, provenance, path)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", src, err)
+	}
+	if err := PutInStorage(ctx, path, s3, "qrank", dest, "application/vnd.sqlite3"); err != nil {
+		return "", err
+	}
+	logger.Printf("built %s with %d items in %.1fs", dest, numItems, time.Since(start).Seconds())
+	return dest, nil
+}
+
+// WriteSQLite writes item signals into a new SQLite database at path.
+// The item_signals table has one row per item, with its numeric ID,
+// its rank by pageviews, its percentile and QRankBucket, and the
+// signals in the schema of the source file. The percentile is the
+// percentage of items that rank lower, so the top 1% have a percentile
+// of 99 or more. Items with equal pageviews are ranked by ascending ID,
+// but share their percentile. Merged items
+// get the rank, percentile and bucket of the item they have been merged
+// into.
+// Unless it is nil, the provenance of the release gets stored as JSON
+// in the metadata table.
+// Afterwards, the database gets indexed and analyzed, so that the
+// query planner knows how selective the indexes are.
+func writeSQLite(ctx context.Context, reader *qrank.ItemSignalsReader, version time.Time, provenance []byte, path string) (int64, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	// There is only one connection, which writes a new file.
+	// If anything goes wrong, we start from scratch anyway.
+	db.SetMaxOpenConns(1)
+	for _, pragma := range []string{"journal_mode = OFF", "synchronous = OFF"} {
+		if _, err := db.ExecContext(ctx, "PRAGMA "+pragma); err != nil {
+			return 0, err
+		}
+	}
+
+	schema := reader.Schema()
+	columns := make([]string, 0, len(schema.Columns))
+	defs := make([]string, 0, len(schema.Columns)+3)
+	defs = append(defs, "id INTEGER PRIMARY KEY", "item TEXT NOT NULL", "rank INTEGER", "percentile INTEGER", "bucket INTEGER")
+	for _, name := range schema.Columns[1:] {
+		col, ok := sqliteColumns[name]
+		if !ok {
+			return 0, fmt.Errorf("no SQLite type for column %q", name)
+		}
+		columns = append(columns, name)
+		defs = append(defs, name+" "+col.Type)
+	}
+	hasMerged := slices.Contains(columns, "merged_into")
+
+	stmts := []string{
+		fmt.Sprintf("CREATE TABLE item_signals (%s)", strings.Join(defs, ", ")),
+		"CREATE TABLE metadata (key TEXT PRIMARY KEY, value TEXT NOT NULL)",
+	}
+	for _, stmt := range stmts {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return 0, err
+		}
+	}
+	metadata := [][2]string{
+		{"version", version.Format(time.DateOnly)},
+		{"item_signals_schema", strconv.Itoa(schema.Version)},
+		{"source", strings.TrimPrefix(PublicPath("item_signals", version, "csv.zst"), "public/")},
+	}
+	if provenance != nil {
+		metadata = append(metadata, [2]string{"provenance", string(provenance)})
+	}
+	for _, kv := range metadata {
+		if _, err := db.ExecContext(ctx, "INSERT INTO metadata VALUES (?, ?)", kv[0], kv[1]); err != nil {
+			return 0, err
+		}
+	}
+
+	numItems, err := insertItemSignals(ctx, db, reader, columns)
+	if err != nil {
+		return 0, err
+	}
+
+	rankFilter := ""
+	if hasMerged {
+		rankFilter = " WHERE merged_into IS NULL"
+	}
+	var maxPageviews int64
+	row := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(pageviews_52w), 0) FROM item_signals"+rankFilter)
+	if err := row.Scan(&maxPageviews); err != nil {
+		return 0, err
+	}
+	stmts = []string{
+		"CREATE UNIQUE INDEX item_signals_item ON item_signals (item)",
+		`UPDATE item_signals SET rank = ranked.rank, percentile = ranked.percentile FROM (
+			SELECT id, ROW_NUMBER() OVER (ORDER BY pageviews_52w DESC, id) AS rank,
+				100 * (COUNT(*) OVER () - RANK() OVER (ORDER BY pageviews_52w DESC)) / COUNT(*) OVER () AS percentile
+			FROM item_signals` + rankFilter + `
+		) AS ranked WHERE item_signals.id = ranked.id`,
+		"UPDATE item_signals SET bucket = " + sqliteBucketExpr(maxPageviews) + rankFilter,
+	}
+	if hasMerged {
+		stmts = append(stmts, `UPDATE item_signals SET (rank, percentile, bucket) = (
+			SELECT target.rank, target.percentile, target.bucket FROM item_signals AS target
+			WHERE target.item = item_signals.merged_into
+		) WHERE merged_into IS NOT NULL`)
+	}
+	stmts = append(stmts, "CREATE INDEX item_signals_rank ON item_signals (rank)")
+	if slices.Contains(columns, "class") {
+		stmts = append(stmts, "CREATE INDEX item_signals_class ON item_signals (class, rank)")
+	}
+	stmts = append(stmts, "ANALYZE")
+	for _, stmt := range stmts {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		return 0, err
+	}
+	return numItems, nil
+}
+
+// SQLiteBucketExpr returns an SQL expression that computes QRankBucket
+// for the pageviews_52w column. Rather than computing logarithms in SQL,
+// which might round differently, we find the lowest number of pageviews
+// for each bucket and compare against these thresholds.
+func sqliteBucketExpr(maxPageviews int64) string {
+	var buf strings.Builder
+	for bucket := 10; bucket > 1; bucket-- {
+		// QRankBucket is monotonic in the value, so a binary search
+		// finds the lowest value that falls into bucket or above.
+		lo, hi := int64(1), maxPageviews+1
+		for lo < hi {
+			mid := lo + (hi-lo)/2
+			if QRankBucket(mid, maxPageviews) >= bucket {
+				hi = mid
+			} else {
+				lo = mid + 1
+			}
+		}
+		if lo <= maxPageviews {
+			fmt.Fprintf(&buf, " WHEN pageviews_52w >= %d THEN %d", lo, bucket)
+		}
+	}
+	if buf.Len() == 0 {
+		return "1"
+	}
+	return "CASE" + buf.String() + " ELSE 1 END"
+}
+
+// InsertItemSignals inserts all rows of an item_signals file
+// into the item_signals table, in one single transaction.
+func insertItemSignals(ctx context.Context, db *sql.DB, reader *qrank.ItemSignalsReader, columns []string) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	placeholders := strings.Repeat(", ?", len(columns))
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(
+		"INSERT INTO item_signals (id, item, %s) VALUES (?, ?%s)",
+		strings.Join(columns, ", "), placeholders))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	values := make([]any, len(columns)+2)
+	var numItems int64
+	for {
+		sig, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		item := ParseItem(sig.Item)
+		if item == NoItem {
+			return 0, fmt.Errorf("bad item %q", sig.Item)
+		}
+		values[0], values[1] = int64(item), sig.Item
+		for i, name := range columns {
+			values[i+2] = sqliteColumns[name].Value(sig)
+		}
+		if _, err := stmt.ExecContext(ctx, values...); err != nil {
+			return 0, err
+		}
+		numItems += 1
+	}
+
+	if err := stmt.Close(); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return numItems, nil
+}
@@ -0,0 +1,174 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBuildSQLite(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	if dest, err := buildSQLite(ctx, s3); err != nil || dest != "" {
+		t.Fatalf(`got %q, %v; want "", nil`, dest, err)
+	}
+
+	err := s3.WriteLines([]string{
+		"# schema: 5",
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes,pageviews_52w_max_wiki,class,merged_into",
+		"Q1,500,10,1,2,3,0,4,1,300,Q5,",
+		"Q2,100,0,0,0,0,1,0,0,0,,",
+		"Q3,500,0,0,0,0,0,0,0,0,Q5,",
+		"Q10,900,0,0,0,0,0,0,0,0,Q515,",
+		"Q6,500,0,0,0,0,0,0,0,0,,Q1",
+	}, "public/item_signals-20240428.csv.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest, err := buildSQLite(ctx, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dest != "public/qrank-20240428.sqlite" {
+		t.Errorf("got %q, want public/qrank-20240428.sqlite", dest)
+	}
+
+	path := filepath.Join(t.TempDir(), "qrank.sqlite")
+	if err := os.WriteFile(path, s3.data[dest], 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Ties get ranked by ascending ID, but share their percentile;
+	// merged items have the rank, percentile and bucket of the item
+	// they were merged into.
+	rows, err := db.Query("SELECT item, rank, percentile, bucket, COALESCE(merged_into, '') FROM item_signals ORDER BY rank, id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for rows.Next() {
+		var item, merged string
+		var rank, percentile, bucket int64
+		if err := rows.Scan(&item, &rank, &percentile, &bucket, &merged); err != nil {
+			t.Fatal(err)
+		}
+		fields := []string{item, strconv.FormatInt(rank, 10), strconv.FormatInt(percentile, 10), strconv.FormatInt(bucket, 10), merged}
+		got = append(got, strings.TrimSuffix(strings.Join(fields, ","), ","))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Q10,1,75,10", "Q1,2,50,9", "Q6,2,50,9,Q1", "Q3,3,50,9", "Q2,4,0,7"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	var outlinks, disambiguation int64
+	var class sql.NullString
+	row := db.QueryRow("SELECT outlinks, disambiguation, class FROM item_signals WHERE item = 'Q1'")
+	if err := row.Scan(&outlinks, &disambiguation, &class); err != nil {
+		t.Fatal(err)
+	}
+	if outlinks != 4 || disambiguation != 0 || class.String != "Q5" {
+		t.Errorf("got outlinks=%d, disambiguation=%d, class=%v", outlinks, disambiguation, class)
+	}
+	if err := db.QueryRow("SELECT class FROM item_signals WHERE item = 'Q2'").Scan(&class); err != nil || class.Valid {
+		t.Errorf("got class %v, %v; want NULL", class, err)
+	}
+
+	var version string
+	if err := db.QueryRow("SELECT value FROM metadata WHERE key = 'version'").Scan(&version); err != nil || version != "2024-04-28" {
+		t.Errorf("got version %q, %v; want 2024-04-28", version, err)
+	}
+
+	// The indexes should have statistics, so the query planner uses them.
+	var indexes []string
+	rows, err = db.Query("SELECT idx FROM sqlite_stat1 ORDER BY idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var idx string
+		if err := rows.Scan(&idx); err != nil {
+			t.Fatal(err)
+		}
+		indexes = append(indexes, idx)
+	}
+	if want := []string{"item_signals_class", "item_signals_item", "item_signals_rank", "sqlite_autoindex_metadata_1"}; !slices.Equal(indexes, want) {
+		t.Errorf("got analyzed indexes %q, want %q", indexes, want)
+	}
+
+	// Once the database is in storage, it does not get built again.
+	s3.data[dest] = []byte("old")
+	if _, err := buildSQLite(ctx, s3); err != nil {
+		t.Fatal(err)
+	}
+	if string(s3.data[dest]) != "old" {
+		t.Error("should not rebuild SQLite database that is already in storage")
+	}
+}
+
+func TestBuildSQLite_Provenance(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	err := s3.WriteLines([]string{
+		"# schema: 2",
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes",
+		"Q1,500,10,1,2,3,0,4,1",
+	}, "public/item_signals-20240428.csv.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := `{"version":"2024-04-28","formula_version":1,"weights":{"wikidata":0.1}}`
+	s3.data["public/qrank-meta-20240428.json"] = []byte(meta)
+
+	dest, err := buildSQLite(ctx, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "qrank.sqlite")
+	if err := os.WriteFile(path, s3.data[dest], 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var got string
+	if err := db.QueryRow("SELECT value FROM metadata WHERE key = 'provenance'").Scan(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got != meta {
+		t.Errorf("got provenance %q, want %q", got, meta)
+	}
+}
+
+func TestSQLiteBucketExpr(t *testing.T) {
+	got := sqliteBucketExpr(900)
+	if !strings.HasPrefix(got, "CASE WHEN pageviews_52w >= 900 THEN 10 WHEN") || !strings.HasSuffix(got, " ELSE 1 END") {
+		t.Errorf("got %q", got)
+	}
+	if got, want := sqliteBucketExpr(0), "1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -5,7 +5,9 @@ package main
 
 import (
 	"bufio"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"strings"
 	"unicode"
@@ -15,6 +17,7 @@ import (
 type SQLReader struct {
 	lexer   sqlLexer
 	columns []string // The names of database table columns, such as ["pp_page", "pp_propname"]
+	types   []string // The types of database table columns, such as ["int(10) unsigned", "varbinary(60)"]
 	state   parseState
 }
 
@@ -31,6 +34,7 @@ func NewSQLReader(r io.Reader) (*SQLReader, error) {
 	rd := &SQLReader{
 		lexer:   sqlLexer{bufio.NewReader(r)},
 		columns: make([]string, 0, 8),
+		types:   make([]string, 0, 8),
 		state:   base,
 	}
 
@@ -47,6 +51,13 @@ func (r *SQLReader) Columns() []string {
 	return r.columns
 }
 
+// ColumnTypes returns the SQL types of the table columns, in the same
+// order as Columns(). Types are lowercased and include their length
+// and signedness, such as "int(8) unsigned" or "varbinary(255)".
+func (r *SQLReader) ColumnTypes() []string {
+	return r.types
+}
+
 func (r *SQLReader) Read() ([]string, error) {
 	for {
 		switch r.state {
@@ -80,12 +91,78 @@ func (r *SQLReader) parseCreate() error {
 			return r.skipUntil(semicolon, "")
 		}
 		r.columns = append(r.columns, tokenText)
+		colType, last, err := r.parseColumnType()
+		if err != nil {
+			return err
+		}
+		r.types = append(r.types, colType)
+		if last == comma || last == rightParen {
+			continue
+		}
 		if err := r.skipUntilEither(comma, rightParen); err != nil {
 			return err
 		}
 	}
 }
 
+// ParseColumnType parses the type of a column in a CREATE TABLE
+// statement, such as "int(8) unsigned" in "`pp_page` int(8) unsigned
+// NOT NULL". The second result is the last consumed token; if it is
+// a comma or a closing parenthesis, the column definition has ended.
+func (r *SQLReader) parseColumnType() (string, sqlToken, error) {
+	token, txt, err := r.readToken()
+	if err != nil {
+		return "", token, err
+	}
+	if token != word {
+		return "", token, nil
+	}
+
+	var buf strings.Builder
+	buf.WriteString(strings.ToLower(txt))
+	token, txt, err = r.readToken()
+	if err != nil {
+		return "", token, err
+	}
+	if token == leftParen {
+		buf.WriteByte('(')
+		for {
+			token, txt, err = r.readToken()
+			if err != nil {
+				return "", token, err
+			}
+			if token == rightParen {
+				break
+			}
+			switch token {
+			case number:
+				buf.WriteString(txt)
+			case text:
+				buf.WriteByte('\'')
+				buf.WriteString(strings.ReplaceAll(txt, "'", "''"))
+				buf.WriteByte('\'')
+			case comma:
+				buf.WriteByte(',')
+			default:
+				return "", token, parseError
+			}
+		}
+		buf.WriteByte(')')
+		token, txt, err = r.readToken()
+		if err != nil {
+			return "", token, err
+		}
+	}
+	if token == word && strings.EqualFold(txt, "unsigned") {
+		buf.WriteString(" unsigned")
+		token, _, err = r.readToken()
+		if err != nil {
+			return "", token, err
+		}
+	}
+	return buf.String(), token, nil
+}
+
 func (r *SQLReader) parseInsertValue() ([]string, error) {
 	if token, _, err := r.readToken(); err != nil {
 		return nil, err
@@ -183,7 +260,7 @@ const (
 	word       // DROP, TABLE, CHARSET, blob, float, int, unsigned
 	name       // `page_props`, `pp_propname_sortkey_page`
 	number     // 12, 12.3, -4
-	text       // "foo"
+	text       // "foo", _binary 'foo', X'666F6F', 0x666F6F
 	comment    // -- MySQL dump
 	leftParen
 	rightParen
@@ -212,11 +289,13 @@ func (lex *sqlLexer) read() (sqlToken, string, error) {
 
 	switch c {
 	case '`':
-		text, err := lex.readUntil('`')
+		text, err := lex.readName()
 		if err != nil {
 			return unexpected, "", err
 		}
 		return name, text, err
+	case '_':
+		return lex.readIntroducer()
 	case '-':
 		next, _, err := lex.reader.ReadRune()
 		if err == io.EOF {
@@ -267,6 +346,23 @@ func (lex *sqlLexer) read() (sqlToken, string, error) {
 	case ';':
 		return semicolon, "", nil
 	}
+	if c == 'X' || c == 'x' || c == '0' {
+		next, _, err := lex.reader.ReadRune()
+		if err != nil && err != io.EOF {
+			return unexpected, "", err
+		}
+		if c != '0' && next == '\'' {
+			return lex.readHexString()
+		}
+		if c == '0' && next == 'x' {
+			return lex.readHexNumber()
+		}
+		if err == nil {
+			if unreadErr := lex.reader.UnreadRune(); unreadErr != nil {
+				return unexpected, "", unreadErr
+			}
+		}
+	}
 	if isWordChar(c) {
 		return lex.readWord(c)
 	}
@@ -276,6 +372,150 @@ func (lex *sqlLexer) read() (sqlToken, string, error) {
 	return unexpected, string(c), nil
 }
 
+// ReadIntroducer reads a string literal with a character set introducer,
+// such as _binary 'foo', after the leading underscore has been consumed.
+// MySQL dumps use this for columns of binary type. The introducer gets
+// dropped; if it is not followed by a string literal, the result is a word.
+func (lex *sqlLexer) readIntroducer() (sqlToken, string, error) {
+	var buf strings.Builder
+	buf.WriteByte('_')
+	for {
+		c, _, err := lex.reader.ReadRune()
+		if err == io.EOF {
+			return word, buf.String(), nil
+		} else if err != nil {
+			return unexpected, "", err
+		}
+		if isWordChar(c) || (c >= '0' && c <= '9') || c == '_' {
+			buf.WriteRune(c)
+			continue
+		}
+		if err := lex.reader.UnreadRune(); err != nil {
+			return unexpected, "", err
+		}
+		break
+	}
+
+	for {
+		c, _, err := lex.reader.ReadRune()
+		if err == io.EOF {
+			return word, buf.String(), nil
+		} else if err != nil {
+			return unexpected, "", err
+		}
+		if unicode.IsSpace(c) {
+			continue
+		}
+		switch c {
+		case '\'':
+			t, err := lex.readString()
+			if err != nil {
+				return unexpected, "", err
+			}
+			return text, t, nil
+		case 'X', 'x':
+			next, _, err := lex.reader.ReadRune()
+			if err != nil && err != io.EOF {
+				return unexpected, "", err
+			}
+			if next == '\'' {
+				return lex.readHexString()
+			}
+			return unexpected, "", parseError
+		case '0':
+			next, _, err := lex.reader.ReadRune()
+			if err != nil && err != io.EOF {
+				return unexpected, "", err
+			}
+			if next == 'x' {
+				return lex.readHexNumber()
+			}
+			return unexpected, "", parseError
+		}
+		if err := lex.reader.UnreadRune(); err != nil {
+			return unexpected, "", err
+		}
+		return word, buf.String(), nil
+	}
+}
+
+// ReadHexString reads a hexadecimal string literal such as X'666F6F',
+// after the opening quote has been consumed, and returns its decoded
+// bytes as text.
+func (lex *sqlLexer) readHexString() (sqlToken, string, error) {
+	digits, err := lex.reader.ReadString('\'')
+	if err == io.EOF {
+		return unexpected, "", fmt.Errorf("%w: unterminated hex literal", parseError)
+	} else if err != nil {
+		return unexpected, "", err
+	}
+	return decodeHexLiteral(digits[:len(digits)-1])
+}
+
+// ReadHexNumber reads a hexadecimal literal such as 0x666F6F, as produced
+// by mysqldump --hex-blob, after the leading "0x" has been consumed,
+// and returns its decoded bytes as text.
+func (lex *sqlLexer) readHexNumber() (sqlToken, string, error) {
+	var buf strings.Builder
+	for {
+		c, err := lex.reader.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return unexpected, "", err
+		}
+		if !isHexDigit(c) {
+			if err := lex.reader.UnreadByte(); err != nil {
+				return unexpected, "", err
+			}
+			break
+		}
+		buf.WriteByte(c)
+	}
+	return decodeHexLiteral(buf.String())
+}
+
+func decodeHexLiteral(digits string) (sqlToken, string, error) {
+	decoded, err := hex.DecodeString(digits)
+	if err != nil {
+		return unexpected, "", fmt.Errorf("%w: bad hex literal %q", parseError, digits)
+	}
+	return text, string(decoded), nil
+}
+
+// ReadName reads a quoted identifier such as `page_props`, after the
+// opening backtick has been consumed. A backtick inside the identifier
+// is escaped by doubling it.
+func (lex *sqlLexer) readName() (string, error) {
+	var buf strings.Builder
+	for {
+		c, _, err := lex.reader.ReadRune()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if c == '`' {
+			next, _, err := lex.reader.ReadRune()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return "", err
+			}
+			if next == '`' {
+				buf.WriteRune(next)
+				continue
+			}
+			if err := lex.reader.UnreadRune(); err != nil {
+				return "", err
+			}
+			break
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String(), nil
+}
+
 func (lex *sqlLexer) readWord(start rune) (sqlToken, string, error) {
 	var buf strings.Builder
 	buf.WriteRune(start)
@@ -299,24 +539,46 @@ func (lex *sqlLexer) readWord(start rune) (sqlToken, string, error) {
 	return word, text, nil
 }
 
+// ReadString reads a string literal, after the opening quote has been
+// consumed. The string gets read byte by byte, so that binary data
+// passes through unchanged even if it is not valid UTF-8.
 func (lex *sqlLexer) readString() (string, error) {
 	var buf strings.Builder
 	for {
-		c, _, err := lex.reader.ReadRune()
-		if c == '\'' || err == io.EOF {
+		c, err := lex.reader.ReadByte()
+		if err == io.EOF {
 			break
 		} else if err != nil {
 			return "", err
 		}
 
-		// Handle escape sequences.
+		// A quote inside the string is either escaped with a backslash,
+		// or doubled as in 'it''s'.
+		if c == '\'' {
+			next, err := lex.reader.ReadByte()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return "", err
+			}
+			if next == '\'' {
+				buf.WriteByte(next)
+				continue
+			}
+			if err := lex.reader.UnreadByte(); err != nil {
+				return "", err
+			}
+			break
+		}
+
+		// Handle escape sequences, as written by mysqldump.
 		if c == '\\' {
-			next, _, err := lex.reader.ReadRune()
+			next, err := lex.reader.ReadByte()
 			if err != nil {
 				return "", err
 			}
-			if next == '\'' {
-				buf.WriteRune(next)
+			if unescaped, ok := sqlEscapes[next]; ok {
+				buf.WriteByte(unescaped)
 				continue
 			}
 			// TODO: There sometimes are numeric escape sequences such as \327,
@@ -324,16 +586,30 @@ func (lex *sqlLexer) readString() (string, error) {
 			// to process them; is this UTF-8 encoding plus octal escaping?
 			// For now, we don’t actually need to decode these strings in any
 			// application code, so we just keep them escaped.
-			buf.WriteRune(c)
-			buf.WriteRune(next)
+			buf.WriteByte(c)
+			buf.WriteByte(next)
 			continue
 		}
 
-		buf.WriteRune(c)
+		buf.WriteByte(c)
 	}
 	return buf.String(), nil
 }
 
+// SqlEscapes maps the characters after a backslash in MySQL string
+// literals to the bytes they stand for.
+var sqlEscapes = map[byte]byte{
+	'0':  0,
+	'\'': '\'',
+	'"':  '"',
+	'b':  '\b',
+	'n':  '\n',
+	'r':  '\r',
+	't':  '\t',
+	'Z':  0x1a,
+	'\\': '\\',
+}
+
 func (lex *sqlLexer) readNumber(start rune) (sqlToken, string, error) {
 	gotDot := (start == '.')
 	var buf strings.Builder
@@ -401,6 +677,10 @@ func isNumberStart(c rune) bool {
 	return (c >= '0' && c <= '9') || c == '.'
 }
 
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'A' && c <= 'F') || (c >= 'a' && c <= 'f')
+}
+
 func isWordChar(c rune) bool {
 	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
 }
@@ -125,6 +125,91 @@ func TestSQLReader_MultipleInserts(t *testing.T) {
 	}
 }
 
+// TestSQLReader_BinaryLiterals checks that we can read dumps with
+// binary columns, as produced by newer versions of mysqldump.
+func TestSQLReader_BinaryLiterals(t *testing.T) {
+	dump := "CREATE TABLE `page` (\n" +
+		"  `page_id` int(8) unsigned NOT NULL AUTO_INCREMENT,\n" +
+		"  `page_namespace` int(11) NOT NULL DEFAULT 0,\n" +
+		"  `page_title` varbinary(255) NOT NULL DEFAULT '',\n" +
+		"  `page_random` double unsigned NOT NULL DEFAULT 0,\n" +
+		"  `page_touched` binary(14) NOT NULL,\n" +
+		"  `page_content_model` enum('wikitext','json') DEFAULT NULL,\n" +
+		"  `page_len` int(8) unsigned NOT NULL DEFAULT 0,\n" +
+		"  PRIMARY KEY (`page_id`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=binary;\n" +
+		"INSERT INTO `page` VALUES " +
+		"(1,0,_binary 'Hauptseite',0.5,_binary '20240402204829','wikitext',12)," +
+		"(2,0,X'5AC3BC72696368',0.7,0x3230323430343032323034383239,NULL,0)," +
+		"(3,4,'Don''t \\'panic\\'',0.1,'20240402204829','wikitext',7);\n"
+
+	reader, err := NewSQLReader(strings.NewReader(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantColumns := []string{
+		"page_id", "page_namespace", "page_title", "page_random",
+		"page_touched", "page_content_model", "page_len",
+	}
+	if got := reader.Columns(); !slices.Equal(got, wantColumns) {
+		t.Errorf("got columns %q, want %q", got, wantColumns)
+	}
+
+	wantTypes := []string{
+		"int(8) unsigned", "int(11)", "varbinary(255)", "double unsigned",
+		"binary(14)", "enum('wikitext','json')", "int(8) unsigned",
+	}
+	if got := reader.ColumnTypes(); !slices.Equal(got, wantTypes) {
+		t.Errorf("got column types %q, want %q", got, wantTypes)
+	}
+
+	var table []string
+	for {
+		row, err := reader.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row == nil {
+			break
+		}
+		table = append(table, strings.Join(row, "|"))
+	}
+	wantTable := []string{
+		"1|0|Hauptseite|0.5|20240402204829|wikitext|12",
+		"2|0|Zürich|0.7|20240402204829||0",
+		"3|4|Don't 'panic'|0.1|20240402204829|wikitext|7",
+	}
+	if !slices.Equal(table, wantTable) {
+		t.Errorf("got %q, want %q", table, wantTable)
+	}
+}
+
+func FuzzSQLReader(f *testing.F) {
+	f.Add("CREATE TABLE `t` (`a` int, `b` varbinary(255));\n" +
+		"INSERT INTO `t` VALUES (1,'x'),(2,NULL);\n" +
+		"INSERT INTO `t` VALUES (-3,'\\'y\\'');\n")
+	f.Add("CREATE TABLE `t` (`a` int);\n")
+	f.Add("CREATE TABLE `t` (`a``b` binary(2));\n" +
+		"INSERT INTO `t` VALUES (_binary 'x\\0'),(X'4142'),(0x4142);\n")
+	f.Add("/* comment */ CREATE TABLE `t` (\n  `a` int -- x\n);\nINSERT INTO `t` VALUES (0.5);")
+	f.Fuzz(func(t *testing.T, data string) {
+		r, err := NewSQLReader(strings.NewReader(data))
+		if err != nil {
+			return
+		}
+		// Every read consumes input, so the number of rows
+		// cannot exceed the size of the input.
+		for i := 0; i <= len(data); i++ {
+			row, err := r.Read()
+			if err != nil || row == nil {
+				return
+			}
+		}
+		t.Errorf("SQLReader.Read() does not terminate for %q", data)
+	})
+}
+
 func TestSQLLexer(t *testing.T) {
 	for _, tc := range []struct{ input, want string }{
 		{"", ""},
@@ -144,6 +229,19 @@ func TestSQLLexer(t *testing.T) {
 		{"'foo'", "Text[foo]"},
 		{`'fo\'o'`, "Text[fo'o]"},
 		{`'ba\327r'`, `Text[ba\327r]`}, // see comment in implementation
+		{`'a\\b\"c\nd'`, "Text[a\\b\"c\nd]"},
+		{"'it''s', ''", "Text[it's] Comma Text"},
+		{"_binary 'Zürich'", "Text[Zürich]"},
+		{"_binary'\xff\x00'", "Text[\xff\x00]"},
+		{"_utf8mb4 'foo'", "Text[foo]"},
+		{"_binary", "Word[_binary]"},
+		{"X'5A75726963', x''", "Text[Zuric] Comma Text"},
+		{"0x5A75726963,0x", "Text[Zuric] Comma Text"},
+		{"0.5, 0", "Number[0.5] Comma Number[0]"},
+		{"X, xyz", "Word[X] Comma Word[xyz]"},
+		{"X'5'", "sql parse error: bad hex literal \"5\""},
+		{"`page`", "Name[page]"},
+		{"`a``b`", "Name[a`b]"},
 		{"/", "Slash"},
 		{"2/3", "Number[2] Slash Number[3]"},
 		{"/* foo */", "Comment[foo]"},
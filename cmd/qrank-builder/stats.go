@@ -7,6 +7,8 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -23,6 +25,11 @@ type Sample []interface{} // [ID, Rank, Value]
 type Stats struct {
 	Median  int
 	Samples []Sample
+
+	// SHA256 maps the name of the published QRank file, such as
+	// "qrank-20240501.csv.gz", to the hex-encoded SHA-256 digest
+	// of its content.
+	SHA256 map[string]string `json:"sha256,omitempty"`
 }
 
 func buildStats(date time.Time, qrankPath string, topN int, numSamples int, outDir string) (string, error) {
@@ -47,7 +54,7 @@ func buildStats(date time.Time, qrankPath string, topN int, numSamples int, outD
 	numRanks -= 1 // Don’t count CSV header.
 	medianRank := numRanks/2 + 1
 
-	if _, err := qrankFile.Seek(0, os.SEEK_SET); err != nil {
+	if _, err := qrankFile.Seek(0, io.SeekStart); err != nil {
 		return "", err
 	}
 	qrankReader, err = gzip.NewReader(qrankFile)
@@ -55,8 +62,15 @@ func buildStats(date time.Time, qrankPath string, topN int, numSamples int, outD
 		return "", err
 	}
 
+	digest, err := fileSHA256(qrankPath)
+	if err != nil {
+		return "", err
+	}
+	qrankName := fmt.Sprintf("qrank-%04d%02d%02d.csv.gz", date.Year(), date.Month(), date.Day())
+
 	samplingDistanceSq := 4.0 * 4.0
 	var stats Stats
+	stats.SHA256 = map[string]string{qrankName: digest}
 	stats.Samples = make([]Sample, 0, numSamples)
 	var id string
 	var rank, value int64
@@ -138,6 +152,21 @@ func buildStats(date time.Time, qrankPath string, topN int, numSamples int, outD
 	return statsPath, nil
 }
 
+// FileSHA256 returns the hex-encoded SHA-256 digest of a local file.
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 // CountLines counts the number of lines in its input.
 func countLines(r io.Reader) (int64, error) {
 	var count int64
@@ -26,7 +26,8 @@ Q7,1
 Q8,1
 Q9,1
 `)
-	statsPath, err := buildStats(time.Now(), qrank, 2, 8, t.TempDir())
+	date, _ := time.Parse(time.DateOnly, "2024-05-01")
+	statsPath, err := buildStats(date, qrank, 2, 8, t.TempDir())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -47,8 +48,17 @@ Q9,1
 		t.Fatal(err)
 	}
 
+	digest, err := fileSHA256(qrank)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(digest) != 64 {
+		t.Errorf("got digest %q, want 64 hex digits", digest)
+	}
+
 	got := string(buf)
-	want := `{"Median":2,"Samples":[["Q1",1,4721864130],["Q2",2,107330319],["Q5",5,51123],["Q9",9,1]]}`
+	want := `{"Median":2,"Samples":[["Q1",1,4721864130],["Q2",2,107330319],["Q5",5,51123],["Q9",9,1]],` +
+		`"sha256":{"qrank-20240501.csv.gz":"` + digest + `"}}`
 	if got != want {
 		t.Errorf("got %s, want %s", got, want)
 	}
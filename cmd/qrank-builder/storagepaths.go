@@ -0,0 +1,162 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// This file defines the names of our objects in S3 storage.
+// Code that reads or writes storage should build its paths
+// with these functions, so the layout is defined in one place.
+//
+// Per-site files:  page_signals/rmwiki-20240501-page_signals.zst
+// Increments:      increments/rmwiki-20240501.json
+// Pageviews:       pageviews/pageviews-2024-W17.zst
+// Preview input:   preview/pageviews-20240502.zst
+// Public releases: public/item_signals-20240501.csv.zst
+// Parquet:         public/item_signals_parquet-20240501/part-0007.parquet
+// Dictionaries:    dictionaries/titles-20240501.zdict
+// Build reports:   internal/qrank-builder/report-20240501.json
+// Sites list:      internal/sites-20240501.json
+// Daemon state:    internal/qrank-builder/daemon-state.json
+// Link shards:     internal/links/enwiki-20240501-links-03-of-16.zst
+// Site manifests:  internal/manifests/page_signals.json
+
+// SitePath returns the storage path of a per-site file, such as
+// "page_signals/rmwiki-20240501-page_signals.zst" for kind "page_signals",
+// siteKey "rmwiki" and a dump date of May 1, 2024.
+func SitePath(kind string, siteKey string, dumped time.Time) string {
+	return sitePath(kind, siteKey, dumped.Format("20060102"))
+}
+
+func sitePath(kind string, siteKey string, ymd string) string {
+	return fmt.Sprintf("%s/%s-%s-%s.zst", kind, siteKey, ymd, kind)
+}
+
+var sitePathRegexp = regexp.MustCompile(`^([a-z_]+)/([a-z0-9_\-]+)-(\d{8})-([a-z_]+)\.zst$`)
+
+// ParseSitePath splits the storage path of a per-site file into its kind,
+// such as "page_signals", the site key, and the dump date in YYYYMMDD
+// format. The result is false if the path is not a per-site file.
+func ParseSitePath(path string) (kind string, siteKey string, ymd string, ok bool) {
+	m := sitePathRegexp.FindStringSubmatch(path)
+	if m == nil || m[1] != m[4] {
+		return "", "", "", false
+	}
+	return m[1], m[2], m[3], true
+}
+
+// IncrementStatePath returns the storage path of the IncrementState
+// of a site, such as "increments/rmwiki-20240501.json" for siteKey
+// "rmwiki" and a full dump of May 1, 2024.
+func IncrementStatePath(siteKey string, dumped time.Time) string {
+	return fmt.Sprintf("increments/%s-%s.json", siteKey, dumped.Format("20060102"))
+}
+
+// WeeklyPageviewsPath returns the storage path of the pageviews file for
+// an ISO week, such as "pageviews/pageviews-2024-W17.zst" for "2024-W17".
+// Weeks that were aggregated from another source than the public
+// pageview_complete dumps go into a directory named after their source,
+// such as "pageviews/pageview_actor/pageviews-2024-W17.zst", so that
+// switching the source never mixes up weeks from different sources.
+func WeeklyPageviewsPath(source string, week string) string {
+	if source == "" || source == "pageview_complete" {
+		return "pageviews/pageviews-" + week + ".zst"
+	}
+	return "pageviews/" + source + "/pageviews-" + week + ".zst"
+}
+
+var pageviewsPathRegexp = regexp.MustCompile(`^pageviews/(?:[a-z_]+/)?pageviews-(\d{4}-W\d{2}).zst$`)
+
+// ParseWeeklyPageviewsPath returns the ISO week of a pageviews file in storage,
+// such as "2024-W17". The result is false if the path is not a pageviews file.
+func ParseWeeklyPageviewsPath(path string) (week string, ok bool) {
+	m := pageviewsPathRegexp.FindStringSubmatch(path)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// PreviewPageviewsPath returns the storage path of the pageviews file
+// for a preview build, which covers the days of an ISO week up to and
+// including the last day, such as "preview/pageviews-20240502.zst".
+func PreviewPageviewsPath(last time.Time) string {
+	return "preview/pageviews-" + last.Format("20060102") + ".zst"
+}
+
+// PublicPath returns the storage path of a published file,
+// such as "public/qrank-stats-20240501.json" for name "qrank-stats"
+// and extension "json".
+func PublicPath(name string, version time.Time, ext string) string {
+	return fmt.Sprintf("public/%s-%s.%s", name, version.Format("20060102"), ext)
+}
+
+// ItemSignalsParquetPath returns the storage path of a partition
+// of the item signals in Parquet format, such as
+// "public/item_signals_parquet-20240501/part-0007.parquet" for the
+// items from Q70000000 to Q79999999, see ItemSignalsParquet.
+func ItemSignalsParquetPath(version time.Time, part int64) string {
+	return fmt.Sprintf("public/item_signals_parquet-%s/part-%04d.parquet", version.Format("20060102"), part)
+}
+
+// InternalPath returns the storage path of a file that is kept
+// for our own use, such as "internal/qrank-anomalies-20240501.json".
+func InternalPath(name string, version time.Time, ext string) string {
+	return fmt.Sprintf("internal/%s-%s.%s", name, version.Format("20060102"), ext)
+}
+
+// DictionaryPath returns the storage path of a zstd dictionary for
+// compressing per-site files of a kind, such as "titles".
+func DictionaryPath(kind string, version time.Time) string {
+	return fmt.Sprintf("dictionaries/%s-%s.zdict", kind, version.Format("20060102"))
+}
+
+var dictionaryPathRegexp = regexp.MustCompile(`^dictionaries/([a-z_]+)-(\d{8})\.zdict$`)
+
+// ParseDictionaryPath splits the storage path of a zstd dictionary into
+// its kind and version in YYYYMMDD format. The result is false if the
+// path is not a dictionary.
+func ParseDictionaryPath(path string) (kind string, ymd string, ok bool) {
+	m := dictionaryPathRegexp.FindStringSubmatch(path)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// BuildReportPath returns the storage path of the report about the runs
+// of qrank-builder on a day, such as "internal/qrank-builder/report-20240501.json".
+func BuildReportPath(date time.Time) string {
+	return fmt.Sprintf("internal/qrank-builder/report-%s.json", date.Format("20060102"))
+}
+
+// DaemonStatePath returns the storage path where qrank-builder -daemon
+// remembers the inputs of its last successful build.
+func DaemonStatePath() string {
+	return "internal/qrank-builder/daemon-state.json"
+}
+
+// LinkShardPath returns the storage path of one shard of the links
+// of a site, such as "internal/links/enwiki-20240501-links-03-of-16.zst"
+// for shard 3 of 16. See buildLinks() for how shards get used.
+func LinkShardPath(siteKey string, dumped time.Time, shard int, numShards int) string {
+	return fmt.Sprintf("%s%02d-of-%02d.zst", linkShardPrefix(siteKey, dumped), shard, numShards)
+}
+
+// LinkShardPrefix returns the common prefix of the storage paths
+// of all link shards of a site dump, for listing them.
+func linkShardPrefix(siteKey string, dumped time.Time) string {
+	return fmt.Sprintf("internal/links/%s-%s-links-", siteKey, dumped.Format("20060102"))
+}
+
+// SiteManifestPath returns the storage path of the manifest that tells
+// the inputs of the stored per-site files of a kind, such as
+// "internal/manifests/page_signals.json". See siteFileManifest.
+func SiteManifestPath(filename string) string {
+	return fmt.Sprintf("internal/manifests/%s.json", filename)
+}
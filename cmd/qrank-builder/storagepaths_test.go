@@ -0,0 +1,99 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSitePath(t *testing.T) {
+	dumped, _ := time.Parse(time.DateOnly, "2024-05-01")
+	got := SitePath("page_signals", "rmwiki", dumped)
+	want := "page_signals/rmwiki-20240501-page_signals.zst"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseSitePath(t *testing.T) {
+	for _, tc := range []struct {
+		path, kind, site, ymd string
+		ok                    bool
+	}{
+		{"page_signals/rmwiki-20240501-page_signals.zst", "page_signals", "rmwiki", "20240501", true},
+		{"interwiki_links/zh_min_nanwiki-20240420-interwiki_links.zst", "interwiki_links", "zh_min_nanwiki", "20240420", true},
+		{"page_entities/be-taraskwiki-20240401-page_entities.zst", "page_entities", "be-taraskwiki", "20240401", true},
+		{"titles/rmwiki-20240501-redirects.zst", "", "", "", false},
+		{"pageviews/pageviews-2024-W17.zst", "", "", "", false},
+		{"public/item_signals-20240501.csv.zst", "", "", "", false},
+	} {
+		kind, site, ymd, ok := ParseSitePath(tc.path)
+		if kind != tc.kind || site != tc.site || ymd != tc.ymd || ok != tc.ok {
+			t.Errorf("ParseSitePath(%q) = %q, %q, %q, %v; want %q, %q, %q, %v",
+				tc.path, kind, site, ymd, ok, tc.kind, tc.site, tc.ymd, tc.ok)
+		}
+	}
+}
+
+func TestIncrementStatePath(t *testing.T) {
+	dumped, _ := time.Parse(time.DateOnly, "2024-05-01")
+	got := IncrementStatePath("rmwiki", dumped)
+	want := "increments/rmwiki-20240501.json"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWeeklyPageviewsPath(t *testing.T) {
+	for _, tc := range []struct {
+		source string
+		want   string
+	}{
+		{"pageview_complete", "pageviews/pageviews-2024-W17.zst"},
+		{"pageview_actor", "pageviews/pageview_actor/pageviews-2024-W17.zst"},
+	} {
+		path := WeeklyPageviewsPath(tc.source, "2024-W17")
+		if path != tc.want {
+			t.Errorf("got %q, want %q", path, tc.want)
+		}
+		if week, ok := ParseWeeklyPageviewsPath(path); !ok || week != "2024-W17" {
+			t.Errorf("got %q, %v; want \"2024-W17\", true", week, ok)
+		}
+	}
+	if _, ok := ParseWeeklyPageviewsPath("pageviews/foo.zst"); ok {
+		t.Error("expected false for pageviews/foo.zst")
+	}
+}
+
+func TestPublicPath(t *testing.T) {
+	version, _ := time.Parse(time.DateOnly, "2024-05-01")
+	for _, tc := range []struct{ got, want string }{
+		{PublicPath("item_signals", version, "csv.zst"), "public/item_signals-20240501.csv.zst"},
+		{PublicPath("qrank-stats", version, "json"), "public/qrank-stats-20240501.json"},
+		{InternalPath("qrank-anomalies", version, "json"), "internal/qrank-anomalies-20240501.json"},
+		{BuildReportPath(version), "internal/qrank-builder/report-20240501.json"},
+		{ItemSignalsParquetPath(version, 7), "public/item_signals_parquet-20240501/part-0007.parquet"},
+		{LinkShardPath("enwiki", version, 3, 16), "internal/links/enwiki-20240501-links-03-of-16.zst"},
+		{linkShardPrefix("enwiki", version), "internal/links/enwiki-20240501-links-"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("got %q, want %q", tc.got, tc.want)
+		}
+	}
+}
+
+func TestDictionaryPath(t *testing.T) {
+	version, _ := time.Parse(time.DateOnly, "2024-05-01")
+	path := DictionaryPath("titles", version)
+	if want := "dictionaries/titles-20240501.zdict"; path != want {
+		t.Errorf("got %q, want %q", path, want)
+	}
+	if kind, ymd, ok := ParseDictionaryPath(path); !ok || kind != "titles" || ymd != "20240501" {
+		t.Errorf("got %q, %q, %v; want \"titles\", \"20240501\", true", kind, ymd, ok)
+	}
+	if _, _, ok := ParseDictionaryPath("dictionaries/titles.zdict"); ok {
+		t.Error("expected false for dictionaries/titles.zdict")
+	}
+}
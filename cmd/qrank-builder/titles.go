@@ -12,10 +12,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"runtime"
 	"slices"
 	"strconv"
-	"strings"
 
 	"golang.org/x/sync/errgroup"
 
@@ -29,26 +27,26 @@ import (
 //
 // Category:Foo Q123
 // Zürich Q72
-func buildTitles(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
-	ymd := site.LastDumped.Format("20060102")
-	destPath := fmt.Sprintf("titles/%s-%s-titles.zst", site.Key, ymd)
-	destRedirectsPath := fmt.Sprintf("redirects/%s-%s-redirects.zst", site.Key, ymd)
+//
+// If dicts has a dictionary for titles or redirects, small files get
+// compressed with that dictionary.
+func buildTitles(site *WikiSite, ctx context.Context, dumps string, dicts *ZstdDicts, s3 S3) error {
+	destPath := site.S3Path("titles")
+	destRedirectsPath := site.S3Path("redirects")
 	logger.Printf("building %s and %s", destPath, destRedirectsPath)
 
 	unsorted, err := os.CreateTemp("", "*-titles-unsorted")
 	if err != nil {
 		return err
 	}
-	defer unsorted.Close()
 	defer os.Remove(unsorted.Name())
+	defer unsorted.Close()
 
 	linesChan := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
-	sorter, outChan, errChan := extsort.Strings(linesChan, config)
-
+	config := newSortConfig(64)
 	group, groupCtx := errgroup.WithContext(ctx)
+	sorter, outChan, errChan := extsort.Strings(sortInput(groupCtx, "titles", linesChan, config), config)
+
 	group.Go(func() error {
 		defer close(linesChan)
 		if err := ReadPageItemsOld(groupCtx, site, "A", s3, linesChan); err != nil {
@@ -103,6 +101,13 @@ func buildTitles(site *WikiSite, ctx context.Context, dumps string, s3 S3) error
 	}
 	defer os.Remove(redirectsPath)
 
+	if err := dicts.Recompress(titleItemsPath, "titles"); err != nil {
+		return err
+	}
+	if err := dicts.Recompress(redirectsPath, "redirects"); err != nil {
+		return err
+	}
+
 	if err := PutInStorage(ctx, titleItemsPath, s3, "qrank", destPath, "application/zstd"); err != nil {
 		return err
 	}
@@ -118,7 +123,7 @@ func readTitles(ctx context.Context, site *WikiSite, property string, dumps stri
 	ymd := site.LastDumped.Format("20060102")
 	pageFileName := fmt.Sprintf("%s-%s-page.sql.gz", site.Key, ymd)
 	pagePath := filepath.Join(dumps, site.Key, ymd, pageFileName)
-	pageFile, err := os.Open(pagePath)
+	pageFile, err := openDump(ctx, pagePath)
 	if err != nil {
 		return err
 	}
@@ -166,7 +171,9 @@ func readTitles(ctx context.Context, site *WikiSite, property string, dumps stri
 			}
 		}
 
-		out <- fmt.Sprintf("%s\t%s\t%s%s", page, property, nsPrefix, title)
+		if line, ok := formatRecord('\t', page, property, nsPrefix+title); ok {
+			out <- line
+		}
 	}
 }
 
@@ -175,16 +182,14 @@ func buildRedirectTitles(ctx context.Context, site *WikiSite, dumps string) (str
 	if err != nil {
 		return "", err
 	}
-	defer file.Close()
 	defer os.Remove(file.Name())
+	defer file.Close()
 
 	linesChan := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
-	sorter, outChan, errChan := extsort.Strings(linesChan, config)
-
+	config := newSortConfig(64)
 	group, groupCtx := errgroup.WithContext(ctx)
+	sorter, outChan, errChan := extsort.Strings(sortInput(groupCtx, "redirect_titles", linesChan, config), config)
+
 	group.Go(func() error {
 		defer close(linesChan)
 		if err := readRedirects(groupCtx, site, "A", dumps, linesChan); err != nil {
@@ -233,7 +238,7 @@ func readRedirects(ctx context.Context, site *WikiSite, property string, dumps s
 	ymd := site.LastDumped.Format("20060102")
 	filename := fmt.Sprintf("%s-%s-redirect.sql.gz", site.Key, ymd)
 	path := filepath.Join(dumps, site.Key, ymd, filename)
-	file, err := os.Open(path)
+	file, err := openDump(ctx, path)
 	if os.IsNotExist(err) {
 		// Intentionally not failing when a wiki has no redirects file.
 		return nil
@@ -288,7 +293,9 @@ func readRedirects(ctx context.Context, site *WikiSite, property string, dumps s
 		// They are quite rare, so it's probably fine if we ignore them
 		// for the purpose of computing PageRank for Wikidata.
 		if interwiki == "" {
-			out <- fmt.Sprintf("%s\t%s\t%s%s", from, property, namespacePrefix, title)
+			if line, ok := formatRecord('\t', from, property, namespacePrefix+title); ok {
+				out <- line
+			}
 		}
 	}
 }
@@ -309,7 +316,7 @@ func NewTitleJoiner(site *WikiSite, w io.WriteCloser) *titleJoiner {
 
 func (j *titleJoiner) Process(line string) error {
 	j.inLines += 1
-	cols := strings.Split(line, "\t")
+	cols := splitRecord(line, '\t')
 	page, err := strconv.ParseInt(cols[0], 10, 64)
 	if err != nil {
 		return err
@@ -358,7 +365,7 @@ func NewRedirectTitleJoiner(site *WikiSite, w io.WriteCloser) *redirectTitleJoin
 
 func (j *redirectTitleJoiner) Process(line string) error {
 	j.inLines += 1
-	cols := strings.Split(line, "\t")
+	cols := splitRecord(line, '\t')
 	page, err := strconv.ParseInt(cols[0], 10, 64)
 	if err != nil {
 		return err
@@ -391,6 +398,26 @@ func (j *redirectTitleJoiner) Close() error {
 	return j.writer.Close()
 }
 
+// MaxRedirectHops is the maximal length of redirect chains that get
+// resolved by buildRedirects(). MediaWiki only follows a single hop
+// when rendering pages, and bots usually fix double redirects within
+// days, so longer chains are rare; but they do occur in the dumps.
+const maxRedirectHops = 5
+
+// RedirectStats counts what happened while resolving redirect chains.
+type redirectStats struct {
+	// Hops[i] is the number of aliases resolved in i+1 hops.
+	hops []int64
+
+	// Cycles is the number of aliases that were dropped because
+	// their title had already been resolved in an earlier hop.
+	cycles int64
+
+	// Truncated is the number of aliases that could only have
+	// been resolved in more than maxRedirectHops hops.
+	truncated int64
+}
+
 // buildRedirects mixes regular page titles with redirects to build the final `redirects` file.
 // Both input files contain tab-separated values in zstandard compression; their lines
 // must be sorted.
@@ -398,32 +425,213 @@ func (j *redirectTitleJoiner) Close() error {
 // For example, a titleItem "Zürich Q72" gets merged with a redirectTitle "Zürich Zurigo"
 // into the two output lines "Zurigo Q72" and "Zürich Q72". The lines in the output file
 // are in strong sort order; its file path (in a temporary directoy) is returned as a result.
+//
+// Double redirects get resolved iteratively, up to maxRedirectHops. In each hop,
+// the aliases from the previous hop are merged again with the redirectTitles.
+// Aliases whose title is already known get dropped, so redirect cycles cannot
+// make us loop.
 func buildRedirects(ctx context.Context, site *WikiSite, titleItemsPath string, redirectTitlesPath string) (string, error) {
-	scanners := make([]LineScanner, 0, 2)
-	scannerNames := make([]string, 0, 2)
-	for _, path := range []string{titleItemsPath, redirectTitlesPath} {
-		file, err := os.Open(path)
+	redirectItems, err := os.CreateTemp("", "redirect_items-*.tsv")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(redirectItems.Name())
+
+	redirectItemsPath := redirectItems.Name()
+	writer := bufio.NewWriterSize(redirectItems, 128*1024)
+
+	var stats redirectStats
+	hopPaths := make([]string, 0, maxRedirectHops)
+	defer func() {
+		for _, path := range hopPaths {
+			os.Remove(path)
+		}
+	}()
+
+	itemsPath := titleItemsPath
+	for hop := 1; hop <= maxRedirectHops+1; hop++ {
+		var known []string
+		if hop > 1 {
+			known = append([]string{titleItemsPath}, hopPaths...)
+		}
+		hopPath, resolved, cycles, err := resolveRedirectHop(ctx, itemsPath, redirectTitlesPath, known)
 		if err != nil {
 			return "", err
 		}
+		hopPaths = append(hopPaths, hopPath)
+		stats.cycles += cycles
+		if hop > maxRedirectHops {
+			stats.truncated = resolved
+			break
+		}
+		stats.hops = append(stats.hops, resolved)
+		if err := appendLines(writer, hopPath); err != nil {
+			return "", err
+		}
+		if resolved == 0 {
+			break
+		}
+		itemsPath = hopPath
+	}
+
+	if err := writer.Flush(); err != nil {
+		return "", err
+	}
+	if err := redirectItems.Close(); err != nil {
+		return "", err
+	}
+
+	logger.Printf("%s: resolved redirects by hops: %v, dropped %d in cycles, %d in chains longer than %d hops",
+		site.Key, stats.hops, stats.cycles, stats.truncated, maxRedirectHops)
+
+	sortedRedirects, err := SortLines(ctx, redirectItemsPath)
+	if err != nil {
+		return "", err
+	}
+
+	return sortedRedirects, nil
+}
+
+// ResolveRedirectHop merges the aliases in itemsPath with redirectTitles.
+// Both inputs contain sorted, tab-separated values in zstandard compression.
+// The result is a sorted file of newly resolved aliases in the same format,
+// plus the number of aliases in that file. Aliases whose title appears in
+// any of the known files get dropped; their number is returned as cycles.
+func resolveRedirectHop(ctx context.Context, itemsPath string, redirectTitlesPath string, known []string) (string, int64, int64, error) {
+	joined, err := os.CreateTemp("", "redirect_hop-*.tsv")
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer os.Remove(joined.Name())
+
+	if err := joinRedirects(itemsPath, redirectTitlesPath, joined); err != nil {
+		joined.Close()
+		return "", 0, 0, err
+	}
+	if err := joined.Close(); err != nil {
+		return "", 0, 0, err
+	}
+
+	candidatesPath, err := SortLines(ctx, joined.Name())
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer os.Remove(candidatesPath)
+
+	paths := append([]string{candidatesPath}, known...)
+	scanners := make([]LineScanner, 0, len(paths))
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return "", 0, 0, err
+		}
 		defer file.Close()
 		reader, err := zstd.NewReader(file)
 		if err != nil {
-			return "", err
+			return "", 0, 0, err
 		}
-		scanners = append(scanners, bufio.NewScanner(reader))
-		scannerNames = append(scannerNames, path)
+		defer reader.Close()
+		scanners = append(scanners, NewLineScanner(reader))
 	}
 
-	redirectItems, err := os.CreateTemp("", "redirect_items-*.tsv")
+	outFile, err := os.CreateTemp("", "redirect_hop-*.zst")
 	if err != nil {
-		return "", err
+		return "", 0, 0, err
+	}
+	writer, err := zstd.NewWriter(outFile, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		outFile.Close()
+		os.Remove(outFile.Name())
+		return "", 0, 0, err
 	}
-	defer os.Remove(redirectItems.Name())
 
-	redirectItemsPath := redirectItems.Name()
-	writer := bufio.NewWriterSize(redirectItems, 128*1024)
+	// Because all inputs are sorted, the lines for the same title come
+	// out of the merger in a row, so we can decide at the end of each
+	// run whether its candidates are new.
+	var resolved, cycles int64
+	var title string
+	var isKnown bool
+	var pending []string
+	flush := func() error {
+		if isKnown {
+			cycles += int64(len(pending))
+		} else {
+			for _, line := range pending {
+				if _, err := io.WriteString(writer, line); err != nil {
+					return err
+				}
+				if _, err := io.WriteString(writer, "\n"); err != nil {
+					return err
+				}
+				resolved += 1
+			}
+		}
+		pending = pending[:0]
+		isKnown = false
+		return nil
+	}
+
+	merger := NewLineMerger(scanners, paths)
+	for merger.Advance() {
+		line := merger.Line()
+		lineTitle, _, _ := cutRecord(line, '\t')
+		if lineTitle != title {
+			if err := flush(); err != nil {
+				writer.Close()
+				outFile.Close()
+				os.Remove(outFile.Name())
+				return "", 0, 0, err
+			}
+			title = lineTitle
+		}
+		if merger.Name() == candidatesPath {
+			pending = append(pending, line)
+		} else {
+			isKnown = true
+		}
+	}
+	err = merger.Err()
+	if err == nil {
+		err = flush()
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = outFile.Close()
+	}
+	if err != nil {
+		outFile.Close()
+		os.Remove(outFile.Name())
+		return "", 0, 0, err
+	}
+
+	return outFile.Name(), resolved, cycles, nil
+}
 
+// JoinRedirects merges a sorted file of title/item pairs with a sorted
+// file of target/redirect pairs. For every redirect whose target has
+// an item, a line with the redirect and the item is written to w.
+// The output is not sorted.
+func joinRedirects(itemsPath string, redirectTitlesPath string, w io.Writer) error {
+	scanners := make([]LineScanner, 0, 2)
+	scannerNames := make([]string, 0, 2)
+	for _, path := range []string{itemsPath, redirectTitlesPath} {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader, err := zstd.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		scanners = append(scanners, NewLineScanner(reader))
+		scannerNames = append(scannerNames, path)
+	}
+
+	writer := bufio.NewWriterSize(w, 128*1024)
 	merger := NewLineMerger(scanners, scannerNames)
 	var title string
 	var item string
@@ -451,33 +659,41 @@ func buildRedirects(ctx context.Context, site *WikiSite, titleItemsPath string,
 		return nil
 	}
 	for merger.Advance() {
-		cols := strings.Split(merger.Line(), "\t")
+		cols := splitRecord(merger.Line(), '\t')
 		if cols[0] != title {
 			if err := write(); err != nil {
-				return "", err
+				return err
 			}
 			title = cols[0]
 		}
-		if merger.Name() == titleItemsPath {
+		if merger.Name() == itemsPath {
 			item = cols[1]
 		} else {
 			aliases = append(aliases, cols[1])
 		}
 	}
-	if err := write(); err != nil {
-		return "", err
-	}
-	if err := writer.Flush(); err != nil {
-		return "", err
+	if err := merger.Err(); err != nil {
+		return err
 	}
-	if err := redirectItems.Close(); err != nil {
-		return "", err
+	if err := write(); err != nil {
+		return err
 	}
+	return writer.Flush()
+}
 
-	sortedRedirects, err := SortLines(ctx, redirectItemsPath)
+// AppendLines decompresses a zstandard-compressed file and writes
+// its content to w.
+func appendLines(w io.Writer, path string) error {
+	file, err := os.Open(path)
 	if err != nil {
-		return "", err
+		return err
 	}
-
-	return sortedRedirects, nil
+	defer file.Close()
+	reader, err := zstd.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(w, reader)
+	return err
 }
@@ -8,9 +8,13 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"os"
 	"path/filepath"
 	"slices"
+	"strings"
 	"testing"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 func TestBuildTitles(t *testing.T) {
@@ -29,10 +33,10 @@ func TestBuildTitles(t *testing.T) {
 
 	site := sites.Sites["rmwiki"]
 	s3 := NewFakeS3()
-	if err := buildPageSignals(site, ctx, dumps, s3); err != nil {
+	if err := buildPageSignals(site, ctx, dumps, "", false, false, s3); err != nil {
 		t.Fatal(err)
 	}
-	if err := buildTitles(site, ctx, dumps, s3); err != nil {
+	if err := buildTitles(site, ctx, dumps, nil, s3); err != nil {
 		t.Fatal(err)
 	}
 
@@ -61,3 +65,140 @@ func TestBuildTitles(t *testing.T) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
+
+func TestBuildRedirects(t *testing.T) {
+	var logged bytes.Buffer
+	logger = log.New(&logged, "", log.Lshortfile)
+	ctx := context.Background()
+	site := &WikiSite{Key: "xywiki"}
+
+	titleItems := writeSortedLines(t, []string{
+		"Bern	Q70",
+		"Zürich	Q72",
+	})
+	redirectTitles := writeSortedLines(t, []string{
+		// Single hop: Zurigo → Zürich.
+		"Zürich	Zurigo",
+
+		// Chain: Berna → Bärn → Bernn → Bern.
+		"Bern	Bernn",
+		"Bernn	Bärn",
+		"Bärn	Berna",
+
+		// Cycle without any item: Foo → Bar → Foo.
+		"Bar	Foo",
+		"Foo	Bar",
+
+		// Cycle that goes through an item page.
+		"Zurigo	Zürich",
+
+		// Chain of 7 hops, longer than maxRedirectHops.
+		"Bern	C1",
+		"C1	C2",
+		"C2	C3",
+		"C3	C4",
+		"C4	C5",
+		"C5	C6",
+		"C6	C7",
+	})
+
+	path, err := buildRedirects(ctx, site, titleItems, redirectTitles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	got := readZstdLines(t, path)
+	want := []string{
+		"Berna	Q70",
+		"Bernn	Q70",
+		"Bärn	Q70",
+		"C1	Q70",
+		"C2	Q70",
+		"C3	Q70",
+		"C4	Q70",
+		"C5	Q70",
+		"Zurigo	Q72",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	wantLog := "xywiki: resolved redirects by hops: [3 2 2 1 1], dropped 1 in cycles, 1 in chains longer than 5 hops"
+	if !strings.Contains(logged.String(), wantLog) {
+		t.Errorf("log should contain %q, got %q", wantLog, logged.String())
+	}
+}
+
+func TestBuildRedirects_HostileTitles(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	site := &WikiSite{Key: "xywiki"}
+	record := func(fields ...string) string {
+		line, ok := formatRecord('\t', fields...)
+		if !ok {
+			t.Fatalf("cannot format %q", fields)
+		}
+		return line
+	}
+
+	titleItems := writeSortedLines(t, []string{
+		record(`"Heroes"_(song)`, "Q1"),
+		record("Tab\there", "Q2"),
+	})
+	redirectTitles := writeSortedLines(t, []string{
+		record(`"Heroes"_(song)`, `Heroes,_"David_Bowie"`),
+		record("Tab\there", "Tab"),
+		record("Tab", `"`),
+	})
+	path, err := buildRedirects(ctx, site, titleItems, redirectTitles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	got := readZstdLines(t, path)
+	want := []string{
+		record(`"`, "Q2"),
+		record(`Heroes,_"David_Bowie"`, "Q1"),
+		record("Tab", "Q2"),
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func writeSortedLines(t *testing.T, lines []string) string {
+	path := filepath.Join(t.TempDir(), "lines.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sorted, err := SortLines(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(sorted) })
+	return sorted
+}
+
+func readZstdLines(t *testing.T, path string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := zstd.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	lines := make([]string, 0, 10)
+	scanner := NewLineScanner(reader)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
@@ -12,7 +12,6 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -117,7 +116,6 @@ func LatestDump(dir string, re *regexp.Regexp) (string, error) {
 var caser = cases.Fold()
 
 func formatLine(lang, site, title, value string) string {
-	// https://en.wikipedia.org/wiki/List_of_Wikipedias#Wikipedia_edition_codes
 	switch lang {
 	case "":
 		lang = "und"
@@ -131,31 +129,6 @@ func formatLine(lang, site, title, value string) string {
 	case "az":
 		title = strings.ToLowerSpecial(unicode.AzeriCase, title)
 
-	case "als":
-		lang = "gsw"
-
-	case "bat_smg":
-		fallthrough
-	case "bat-smg":
-		lang = "sgs"
-
-	case "be_x_old":
-		lang = "be-tarask"
-
-	case "cbk_zam":
-		fallthrough
-	case "cbk-zam":
-		lang = "cbk-x-zam"
-
-	case "commons":
-		lang = "und"
-		site = "commons"
-
-	case "fiu_vro":
-		fallthrough
-	case "fiu-vro":
-		lang = "vro"
-
 	case "incubator":
 		// Q11736 in Wikidata entitities dump has site: "incubatorwiki"
 		// (passed to as as lang="incubator", site="wikipedia")
@@ -167,66 +140,17 @@ func formatLine(lang, site, title, value string) string {
 			title = parts[2]
 		}
 
-	case "map_bms": // Banyumasan dialect of Javanese
-		fallthrough
-	case "map-bms":
-		lang = "jv-x-bms"
-
-	case "media": // mediawiki.org
-		lang = "und"
-		site = "mediawiki"
-
-	case "meta": // meta.wikimedia.org
-		lang = "und"
-		site = "metawiki"
-
-	case "roa_rup":
-		fallthrough
-	case "roa-rup":
-		lang = "rup"
-
-	case "roa_tara": // Tarantino dialect of Neapolitan
-		fallthrough
-	case "roa-tara": // Tarantino dialect of Neapolitan
-		lang = "nap-x-tara"
-
-	case "simple":
-		lang = "en-x-simple" // Simplified English
-
-	case "sources":
-		// Q16574 in Wikidata has site: "wikisources"
-		// title: "Author:蒋中正"
-		lang = "und"
-		site = "wikisource"
-
-	case "species":
-		lang = "und"
-		site = "wikispecies"
-
-	case "nds_nl":
-		fallthrough
-	case "nds-nl":
-		lang = "nds-NL"
-
 	case "tr":
 		title = strings.ToLowerSpecial(unicode.TurkishCase, title)
 
-	case "zh_classical":
-		fallthrough
-	case "zh-classical":
-		lang = "lzh"
-
-	case "zh_min_nan":
-		fallthrough
-	case "zh-min-nan":
-		// https://phabricator.wikimedia.org/T30442
-		// https://phabricator.wikimedia.org/T86915
-		lang = "nan"
-
-	case "zh_yue":
-		fallthrough
-	case "zh-yue":
-		lang = "yue"
+	default:
+		// Codes such as "als" or "zh_min_nan", see languagecodes.tsv.
+		if lc, ok := languageCodes.Lookup(lang); ok {
+			lang = lc.Language
+			if lc.Project != "" {
+				site = lc.Project
+			}
+		}
 	}
 
 	var buf strings.Builder
@@ -434,6 +358,14 @@ func ISOWeekStart(year, week int) time.Time {
 	return t.AddDate(0, 0, (week-w)*7)
 }
 
+// SortLines sorts the lines of a text file, and returns the path to a
+// temporary file with the sorted lines in zstd-compressed form. Lines
+// are compared byte by byte, just like Go string comparison; the order
+// does not depend on the locale, so it is the same order in which
+// LineMerger and our other merge joins expect their inputs. The sort
+// is done in Go, spilling to temporary files for large inputs, without
+// calling any external tools. The caller should delete the returned
+// file when it is not needed anymore.
 func SortLines(ctx context.Context, path string) (string, error) {
 	outFile, err := os.CreateTemp("", "*-sorted.zst")
 	if err != nil {
@@ -445,11 +377,9 @@ func SortLines(ctx context.Context, path string) (string, error) {
 		return "", err
 	}
 	linesChan := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
-	sorter, sortedChan, errChan := extsort.Strings(linesChan, config)
+	config := newSortConfig(64)
 	group, groupCtx := errgroup.WithContext(ctx)
+	sorter, sortedChan, errChan := extsort.Strings(sortInput(groupCtx, "sort_lines", linesChan, config), config)
 	group.Go(func() error {
 		defer close(linesChan)
 
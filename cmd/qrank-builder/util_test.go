@@ -224,16 +224,42 @@ func TestISOWeekStart(t *testing.T) {
 }
 
 func TestSortLines(t *testing.T) {
-	unsorted, _ := os.CreateTemp("", "*.txt")
-	unsorted.Close()
-	defer os.Remove(unsorted.Name())
-	os.WriteFile(unsorted.Name(), []byte("C\nB\nA\n"), 0666)
+	got := sortLinesForTest(t, []string{"C", "B", "A"})
+	want := []string{"A", "B", "C"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// The merge joins of our pipeline rely on byte-wise ordering. Unlike
+// the Unix sort tool in most locales, SortLines must not ignore case,
+// punctuation or whitespace, nor treat accented letters specially.
+func TestSortLines_ByteOrder(t *testing.T) {
+	lines := []string{
+		"a", "B", "Z", "_x", "a-b", "ab", "a b", "a\tb",
+		"é", "e", "f", "Ä", "ä", "10", "9", "a,2", "a,10",
+	}
+	got := sortLinesForTest(t, lines)
+	want := slices.Clone(lines)
+	slices.Sort(want) // byte-wise, like Go string comparison
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func sortLinesForTest(t *testing.T, lines []string) []string {
+	unsorted := filepath.Join(t.TempDir(), "unsorted.txt")
+	data := []byte(strings.Join(lines, "\n") + "\n")
+	if err := os.WriteFile(unsorted, data, 0666); err != nil {
+		t.Fatal(err)
+	}
 
 	ctx := context.Background()
-	gotPath, err := SortLines(ctx, unsorted.Name())
+	gotPath, err := SortLines(ctx, unsorted)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer os.Remove(gotPath)
 
 	gotFile, err := os.Open(gotPath)
 	if err != nil {
@@ -248,9 +274,5 @@ func TestSortLines(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	got := strings.Split(strings.TrimSuffix(string(gotBytes), "\n"), "\n")
-	want := []string{"A", "B", "C"}
-	if !slices.Equal(got, want) {
-		t.Errorf("got %v, want %v", got, want)
-	}
+	return strings.Split(strings.TrimSuffix(string(gotBytes), "\n"), "\n")
 }
@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// ProjectWeights tells how much the pageviews of a Wikimedia project
+// contribute to the item signals. Without weights, the pageviews of all
+// projects are summed up equally, so Wikipedia dwarfs everything else.
+//
+// Keys are either project names such as "wikipedia", "wiktionary"
+// or "commons", or domains without ".org" such as "en.wikipedia"
+// for overriding the weight of an individual site. Projects and sites
+// that are not listed have weight 1.0. A nil ProjectWeights gives
+// every project the same weight.
+type ProjectWeights map[string]float64
+
+// ReadProjectWeights reads a JSON file with project weights, such as
+// {"wikipedia": 1.0, "wikidata": 0.1, "commons": 0.5}.
+func ReadProjectWeights(path string) (ProjectWeights, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var weights ProjectWeights
+	if err := json.Unmarshal(data, &weights); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for key, w := range weights {
+		if w < 0 || math.IsInf(w, 0) || math.IsNaN(w) {
+			return nil, fmt.Errorf("%s: bad weight for %q: %v", path, key, w)
+		}
+	}
+
+	return weights, nil
+}
+
+// Weight returns the weight for a domain such as "en.wikipedia",
+// which is how domains appear in pageviews and page_signals files.
+func (w ProjectWeights) Weight(domain string) float64 {
+	if len(w) == 0 {
+		return 1.0
+	}
+	if weight, ok := w[domain]; ok {
+		return weight
+	}
+	if weight, ok := w[projectOf(domain)]; ok {
+		return weight
+	}
+	return 1.0
+}
+
+// ProjectOf returns the Wikimedia project for a domain without ".org",
+// for example "wikipedia" for "en.wikipedia" and "commons" for
+// "commons.wikimedia".
+func projectOf(domain string) string {
+	domain = strings.TrimSuffix(domain, ".org")
+	if strings.HasSuffix(domain, ".wikimedia") {
+		return strings.TrimSuffix(domain, ".wikimedia")
+	}
+	if pos := strings.LastIndexByte(domain, '.'); pos >= 0 {
+		return domain[pos+1:]
+	}
+	return domain
+}
+
+// DisambiguationPolicy tells how to rank items that have a disambiguation
+// page on at least one wiki. Such pages get plenty of views because
+// readers pass through them, but many users of QRank do not want them
+// near the top of an entity ranking.
+type DisambiguationPolicy string
+
+const (
+	// KeepDisambiguation ranks disambiguation items like any other item.
+	KeepDisambiguation DisambiguationPolicy = ""
+
+	// DemoteDisambiguation scales the pageviews of disambiguation items
+	// by disambiguationDemotion.
+	DemoteDisambiguation DisambiguationPolicy = "demote"
+
+	// ExcludeDisambiguation omits disambiguation items from the output.
+	ExcludeDisambiguation DisambiguationPolicy = "exclude"
+)
+
+// RankFormulaVersion identifies how pageviews_52w gets computed: the
+// weekly pageviews of every page of an item get multiplied by the weight
+// of its wiki and summed up over all pages; each week of that sum gets
+// capped at a multiple of the item's median week, and the total gets
+// scaled by disambiguationDemotion for disambiguation items. It gets
+// published with every release, so that a rank can be explained later
+// on. Increment it whenever the formula changes.
+const rankFormulaVersion = 2
+
+// DisambiguationDemotion is the factor for scaling the pageviews
+// of disambiguation items with the DemoteDisambiguation policy.
+const disambiguationDemotion = 0.01
+
+// ParseDisambiguationPolicy parses a command-line flag value,
+// which is one of "keep", "demote" or "exclude".
+func ParseDisambiguationPolicy(s string) (DisambiguationPolicy, error) {
+	switch s {
+	case "", "keep":
+		return KeepDisambiguation, nil
+	case "demote":
+		return DemoteDisambiguation, nil
+	case "exclude":
+		return ExcludeDisambiguation, nil
+	default:
+		return KeepDisambiguation, fmt.Errorf(`bad disambiguation policy %q, must be "keep", "demote" or "exclude"`, s)
+	}
+}
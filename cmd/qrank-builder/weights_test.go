@@ -0,0 +1,112 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadProjectWeights(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "weights.json")
+	data := `{"wikipedia": 1.0, "wikidata": 0.1, "commons": 0.5}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadProjectWeights(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ProjectWeights{"wikipedia": 1.0, "wikidata": 0.1, "commons": 0.5}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReadProjectWeights_Bad(t *testing.T) {
+	for _, data := range []string{
+		`{"wikipedia": -1}`,
+		`{"wikipedia": "heavy"}`,
+		`[1, 2, 3]`,
+	} {
+		path := filepath.Join(t.TempDir(), "weights.json")
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadProjectWeights(path); err == nil {
+			t.Errorf("expected error for %s, got nil", data)
+		}
+	}
+}
+
+func TestProjectWeights(t *testing.T) {
+	w := ProjectWeights{
+		"wikipedia":    1.0,
+		"wikidata":     0.1,
+		"commons":      0.5,
+		"rm.wikipedia": 3.0,
+	}
+	for _, tc := range []struct {
+		domain string
+		want   float64
+	}{
+		{"en.wikipedia", 1.0},
+		{"rm.wikipedia", 3.0},
+		{"www.wikidata", 0.1},
+		{"commons.wikimedia", 0.5},
+		{"species.wikimedia", 1.0},
+		{"de.wiktionary", 1.0},
+	} {
+		if got := w.Weight(tc.domain); got != tc.want {
+			t.Errorf("Weight(%q) = %v, want %v", tc.domain, got, tc.want)
+		}
+	}
+
+	var empty ProjectWeights
+	if got := empty.Weight("en.wikipedia"); got != 1.0 {
+		t.Errorf("nil weights: got %v, want 1.0", got)
+	}
+}
+
+func TestProjectOf(t *testing.T) {
+	for _, tc := range []struct{ domain, want string }{
+		{"en.wikipedia", "wikipedia"},
+		{"en.wikipedia.org", "wikipedia"},
+		{"de.wikisource", "wikisource"},
+		{"www.wikidata", "wikidata"},
+		{"commons.wikimedia", "commons"},
+		{"species.wikimedia", "species"},
+		{"wikidata", "wikidata"},
+	} {
+		if got := projectOf(tc.domain); got != tc.want {
+			t.Errorf("projectOf(%q) = %q, want %q", tc.domain, got, tc.want)
+		}
+	}
+}
+
+func TestParseDisambiguationPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want DisambiguationPolicy
+	}{
+		{"", KeepDisambiguation},
+		{"keep", KeepDisambiguation},
+		{"demote", DemoteDisambiguation},
+		{"exclude", ExcludeDisambiguation},
+	} {
+		got, err := ParseDisambiguationPolicy(tc.s)
+		if err != nil {
+			t.Errorf("%q: %v", tc.s, err)
+		} else if got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.s, got, tc.want)
+		}
+	}
+
+	if _, err := ParseDisambiguationPolicy("drop"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
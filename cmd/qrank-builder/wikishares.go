@@ -0,0 +1,286 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// WikiSharesTop is the number of wikis listed for each item
+// in the wiki share report.
+const wikiSharesTop = 3
+
+// WikiViews records the pageviews of every page with a Wikidata item,
+// keeping the wiki of the page. The item signals only have totals
+// per item, so they cannot tell why an item got ranked surprisingly
+// high. Once the ranking is known, writeWikiShares() picks the lines
+// of the top-ranked items from the recorded file. Lines look like
+// "72,rm.wikipedia,5555,2778" for the raw and the weighted pageviews
+// of a page, and they are in the order of the joiner, which is by wiki
+// and page.
+type wikiViews struct {
+	file       *os.File
+	compressor *zstd.Encoder
+	buf        *bufio.Writer
+}
+
+// NewWikiViews returns a recorder that writes into a temporary file.
+// The caller must call Remove() when done.
+func newWikiViews() (*wikiViews, error) {
+	file, err := os.CreateTemp("", "*-wiki_views.zst")
+	if err != nil {
+		return nil, err
+	}
+	compressor, err := zstd.NewWriter(file, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &wikiViews{file: file, compressor: compressor, buf: bufio.NewWriter(compressor)}, nil
+}
+
+// Add records the raw and the weighted pageviews of a page. Write errors
+// are sticky, and get reported by Close().
+func (v *wikiViews) Add(item int64, domain string, views, weighted int64) {
+	if v == nil || weighted <= 0 {
+		return
+	}
+	v.buf.WriteString(strconv.FormatInt(item, 10))
+	v.buf.WriteByte(',')
+	v.buf.WriteString(domain)
+	v.buf.WriteByte(',')
+	v.buf.WriteString(strconv.FormatInt(views, 10))
+	v.buf.WriteByte(',')
+	v.buf.WriteString(strconv.FormatInt(weighted, 10))
+	v.buf.WriteByte('\n')
+}
+
+// Close finishes writing the recorded file.
+func (v *wikiViews) Close() error {
+	if err := v.buf.Flush(); err != nil {
+		return err
+	}
+	if err := v.compressor.Close(); err != nil {
+		return err
+	}
+	return v.file.Close()
+}
+
+// Remove deletes the recorded file.
+func (v *wikiViews) Remove() {
+	v.file.Close()
+	os.Remove(v.file.Name())
+}
+
+// WikiShare is the share of a wiki in the pageviews of an item.
+type wikiShare struct {
+	Domain   string // eg. "rm.wikipedia"
+	Share    float64
+	Views    int64 // sum of raw pageviews of the item's pages on the wiki
+	Weighted int64 // same, after weighting by project
+}
+
+// WikiShares are the top wikis of an item, together with the weighted
+// pageviews of all the item's pages, before capping.
+type wikiShares struct {
+	Weighted int64
+	Top      []wikiShare
+}
+
+// ReadWikiShares aggregates the recorded pageviews of the given items
+// per wiki, and returns the top wikis of each item, sorted by decreasing
+// share. Ties are broken by domain, to keep the output stable.
+func readWikiShares(r io.Reader, items map[int64]bool) (map[int64]wikiShares, error) {
+	views := make(map[int64]map[string]wikiShare, len(items))
+	scanner := NewLineScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		itemStr, rest, ok := strings.Cut(line, ",")
+		if !ok {
+			return nil, fmt.Errorf(`bad line: "%s"`, line)
+		}
+		item, err := strconv.ParseInt(itemStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf(`bad item: "%s"`, line)
+		}
+		if !items[item] {
+			continue
+		}
+		domain, rest, ok := strings.Cut(rest, ",")
+		if !ok {
+			return nil, fmt.Errorf(`bad line: "%s"`, line)
+		}
+		viewsStr, weightedStr, ok := strings.Cut(rest, ",")
+		if !ok {
+			return nil, fmt.Errorf(`bad line: "%s"`, line)
+		}
+		count, err := strconv.ParseInt(viewsStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf(`bad pageviews: "%s"`, line)
+		}
+		weighted, err := strconv.ParseInt(weightedStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf(`bad weighted pageviews: "%s"`, line)
+		}
+		if views[item] == nil {
+			views[item] = make(map[string]wikiShare, 4)
+		}
+		s := views[item][domain]
+		s.Views += count
+		s.Weighted += weighted
+		views[item][domain] = s
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make(map[int64]wikiShares, len(views))
+	for item, domains := range views {
+		var total int64
+		for _, s := range domains {
+			total += s.Weighted
+		}
+		if total <= 0 {
+			continue
+		}
+		shares := make([]wikiShare, 0, len(domains))
+		for domain, s := range domains {
+			s.Domain = domain
+			s.Share = float64(s.Weighted) / float64(total)
+			shares = append(shares, s)
+		}
+		slices.SortFunc(shares, func(a, b wikiShare) int {
+			if c := cmp.Compare(b.Share, a.Share); c != 0 {
+				return c
+			}
+			return strings.Compare(a.Domain, b.Domain)
+		})
+		result[item] = wikiShares{Weighted: total, Top: shares[:min(len(shares), wikiSharesTop)]}
+	}
+	return result, nil
+}
+
+// WikiSharesPath returns the storage path of the wiki share report,
+// such as public/qrank-wiki-shares-20240428.csv.gz.
+func wikiSharesPath(version time.Time) string {
+	return PublicPath("qrank-wiki-shares", version, "csv.gz")
+}
+
+// WriteWikiShares puts a report into storage that tells, for the
+// top-ranked items, which three wikis contributed most of their
+// pageviews, and with what share. This helps to debug surprising
+// ranks, such as an item that is only popular on one small wiki.
+// The columns are Entity, QRank, and three pairs of Wiki and Share;
+// shares are relative to the pageviews of the item's own pages.
+// For telling how capping changed the pageviews, the report also has
+// the item's weighted pageviews before capping, followed by the raw
+// and the weighted pageviews of each of the three wikis. These come
+// last, so readers that only know the first columns keep working.
+// Like the labels, the report is a gzipped CSV file sorted by
+// decreasing rank, whose header is preceded by the comments.
+func writeWikiShares(ctx context.Context, top []ClassRank, views *wikiViews, version time.Time, comments []string, s3 S3) error {
+	items := make(map[int64]bool, len(top))
+	for _, t := range top {
+		items[t.Item] = true
+	}
+
+	inFile, err := os.Open(views.file.Name())
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+	decompressor, err := zstd.NewReader(inFile)
+	if err != nil {
+		return err
+	}
+	defer decompressor.Close()
+	shares, err := readWikiShares(decompressor, items)
+	if err != nil {
+		return err
+	}
+
+	outFile, err := os.CreateTemp("", "qrank-wiki-shares-*.csv.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(outFile.Name())
+	defer outFile.Close()
+
+	gz, err := gzip.NewWriterLevel(outFile, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if err := writeCSVComments(gz, comments); err != nil {
+		return err
+	}
+	w := csv.NewWriter(gz)
+	header := []string{"Entity", "QRank"}
+	for i := 1; i <= wikiSharesTop; i++ {
+		header = append(header, fmt.Sprintf("Wiki%d", i), fmt.Sprintf("Share%d", i))
+	}
+	header = append(header, "WeightedTotal")
+	for i := 1; i <= wikiSharesTop; i++ {
+		header = append(header, fmt.Sprintf("Views%d", i), fmt.Sprintf("Weighted%d", i))
+	}
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	for _, t := range top {
+		row := []string{fmt.Sprintf("Q%d", t.Item), strconv.FormatInt(t.Rank, 10)}
+		s := shares[t.Item]
+		for i := 0; i < wikiSharesTop; i++ {
+			if i < len(s.Top) {
+				row = append(row, s.Top[i].Domain, strconv.FormatFloat(s.Top[i].Share, 'f', 4, 64))
+			} else {
+				row = append(row, "", "")
+			}
+		}
+		if s.Weighted > 0 {
+			row = append(row, strconv.FormatInt(s.Weighted, 10))
+		} else {
+			row = append(row, "")
+		}
+		for i := 0; i < wikiSharesTop; i++ {
+			if i < len(s.Top) {
+				row = append(row, strconv.FormatInt(s.Top[i].Views, 10), strconv.FormatInt(s.Top[i].Weighted, 10))
+			} else {
+				row = append(row, "", "")
+			}
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := outFile.Close(); err != nil {
+		return err
+	}
+
+	dest := wikiSharesPath(version)
+	if err := PutInStorage(ctx, outFile.Name(), s3, "qrank", dest, "application/gzip"); err != nil {
+		return err
+	}
+	logger.Printf("published wiki shares of %d top-ranked items to %s", len(top), dest)
+	return nil
+}
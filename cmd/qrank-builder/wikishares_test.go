@@ -0,0 +1,112 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"log"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadWikiShares(t *testing.T) {
+	input := strings.Join([]string{
+		"72,de.wikipedia,10,10",
+		"72,rm.wikipedia,40,40",
+		"5296,rm.wikipedia,7,7",
+		"72,en.wikipedia,30,30",
+		"72,fr.wikipedia,10,10",
+		"1,en.wikipedia,99,99",
+		"72,rm.wikipedia,10,10",
+		"72,www.wikidata,100,0",
+	}, "\n")
+	got, err := readWikiShares(strings.NewReader(input), map[int64]bool{72: true, 5296: true, 7: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int64]wikiShares{
+		72: {Weighted: 100, Top: []wikiShare{
+			{"rm.wikipedia", 0.5, 50, 50},
+			{"en.wikipedia", 0.3, 30, 30},
+			{"de.wikipedia", 0.1, 10, 10},
+		}},
+		5296: {Weighted: 7, Top: []wikiShare{{"rm.wikipedia", 1.0, 7, 7}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{"72", "Q72,rm.wikipedia,1,1", "72,rm.wikipedia", "72,rm.wikipedia,1", "72,rm.wikipedia,x,1", "72,rm.wikipedia,1,x"} {
+		if _, err := readWikiShares(strings.NewReader(bad), map[int64]bool{72: true}); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestBuildItemSignals_WikiShares(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	s3.WriteLines([]string{
+		"rm.wikipedia,1,5",
+		"rm.wikipedia,3824,2",
+		"rm.wikipedia,799,7",
+		"www.wikidata,200,21",
+	}, "pageviews/pageviews-2011-W07.zst")
+	s3.WriteLines([]string{"1,Q5296,2500", "3824,Q662541,4973", "799,Q72,3142"}, "page_signals/rmwiki-20111209-page_signals.zst")
+	s3.WriteLines([]string{"200,Q72,,550,85,186"}, "page_signals/wikidatawiki-20111209-page_signals.zst")
+	s3.WriteLines([]string{"Q5296,Mawrth Vallis", "Q72,Zurich"}, "labels/wikidatawiki-20111201-labels.zst")
+	dumped, _ := time.Parse(time.DateOnly, "2011-12-09")
+	rmwiki := &WikiSite{Key: "rmwiki", Domain: "rm.wikipedia.org", LastDumped: dumped}
+	wikidatawiki := &WikiSite{Key: "wikidatawiki", Domain: "www.wikidata.org", LastDumped: dumped}
+	sites := &WikiSites{
+		Sites:   map[string]*WikiSite{"rmwiki": rmwiki, "wikidatawiki": wikidatawiki},
+		Domains: map[string]*WikiSite{"rm.wikipedia.org": rmwiki, "www.wikidata.org": wikidatawiki},
+	}
+	pageviews := []string{"pageviews/pageviews-2011-W07.zst"}
+	opts := BuildOptions{LabelsSize: 1, WikiSharesSize: 2}
+	if _, err := buildItemSignals(ctx, pageviews, sites, opts, s3); err != nil {
+		t.Fatal(err)
+	}
+
+	comments := []string{
+		"# version: 2011-12-09",
+		"# commit: " + BuilderCommit(),
+		"# pageviews: 2011-W07..2011-W07",
+		"# provenance: qrank-meta-20111209.json",
+	}
+	got := readGzipLines(t, s3.data["public/qrank-wiki-shares-20111209.csv.gz"])
+	want := append(slices.Clone(comments),
+		"Entity,QRank,Wiki1,Share1,Wiki2,Share2,Wiki3,Share3,WeightedTotal,Views1,Weighted1,Views2,Weighted2,Views3,Weighted3",
+		"Q72,28,www.wikidata,0.7500,rm.wikipedia,0.2500,,,28,21,21,7,7,,",
+		"Q5296,5,rm.wikipedia,1.0000,,,,,5,5,5,,,,",
+	)
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The labels have their own size.
+	got = readGzipLines(t, s3.data["public/qrank-labels-20111209.csv.gz"])
+	if want := append(slices.Clone(comments), "Entity,QRank,Label", "Q72,28,Zurich"); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func readGzipLines(t *testing.T, data []byte) []string {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
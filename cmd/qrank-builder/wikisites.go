@@ -5,6 +5,7 @@ package main
 
 import (
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -29,13 +30,14 @@ type WikiSite struct {
 	Key           string    // Wikimedia key, such as "enwiki"
 	Domain        string    // Internet domain, such as "en.wikipedia.org"
 	LastDumped    time.Time // Date of last complete database dump
+	DumpSize      int64     // Bytes in siteDumpFiles of last dump, 0 if unknown
 	InterwikiMaps []map[string]*WikiSite
 	Namespaces    map[string]*Namespace
 }
 
+// S3Path returns the storage path of a per-site file, see SitePath().
 func (site *WikiSite) S3Path(filename string) string {
-	ymd := site.LastDumped.Format("20060102")
-	return fmt.Sprintf("%s/%s-%s-%s.zst", filename, site.Key, ymd, filename)
+	return SitePath(filename, site.Key, site.LastDumped)
 }
 
 type WikiSites struct {
@@ -43,55 +45,70 @@ type WikiSites struct {
 	Domains map[string]*WikiSite
 }
 
+// ReadWikiSites reads the Wikimedia sites that have database dumps,
+// taking the list of sites from the sites table of metawiki. It fails
+// if that table is missing; see ReadWikiSitesWithFallback.
 func ReadWikiSites(client *http.Client, dumps string) (*WikiSites, error) {
-	dirContent, err := os.ReadDir(dumps)
+	list, err := readSitesTable(dumps)
 	if err != nil {
 		return nil, err
 	}
-	dumpDirs := make(map[string]os.DirEntry, len(dirContent))
-	for _, d := range dirContent {
-		dumpDirs[d.Name()] = d
-	}
 
-	sites := &WikiSites{
-		Sites:   make(map[string]*WikiSite, 400),
-		Domains: make(map[string]*WikiSite, 400),
+	var iwmap map[string]string
+	if client != nil {
+		if iwmap, err = fetchInterwikiMap(client); err != nil {
+			return nil, err
+		}
 	}
+	return newWikiSites(dumps, list.Domains, iwmap)
+}
 
-	f, err := os.Open(filepath.Join(
-		dumps, "metawiki", "latest/metawiki-latest-sites.sql.gz",
-	))
+// ReadWikiSitesWithFallback is like ReadWikiSites, but it does not fail
+// if the sites table of metawiki is missing or stale. In that case,
+// the list of sites comes from a previous run that has been cached
+// in storage, or from the sitematrix of the live Action API.
+// Likewise, the interwiki map comes from storage when the cached
+// copy is fresh, or when the live site cannot be reached.
+func ReadWikiSitesWithFallback(ctx context.Context, client *http.Client, dumps string, s3 S3, now time.Time) (*WikiSites, error) {
+	list, err := loadSitesList(ctx, client, dumps, s3, now)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-
-	gz, err := gzip.NewReader(f)
+	iwmap, err := loadInterwikiMap(ctx, client, s3, now)
 	if err != nil {
 		return nil, err
 	}
-	defer gz.Close()
+	return newWikiSites(dumps, list.Domains, iwmap)
+}
 
-	reader, err := NewSQLReader(gz)
+// NewWikiSites sets up the sites that have database dumps, given
+// a map from site keys such as "rmwiki" to domains, and the global
+// interwiki map. If the interwiki map is nil, the sites do not know
+// any interwiki prefixes.
+func newWikiSites(dumps string, domains map[string]string, iwmap map[string]string) (*WikiSites, error) {
+	dirContent, err := os.ReadDir(dumps)
 	if err != nil {
 		return nil, err
 	}
+	dumpDirs := make(map[string]os.DirEntry, len(dirContent))
+	for _, d := range dirContent {
+		dumpDirs[d.Name()] = d
+	}
 
-	columns := reader.Columns()
-	globalKeyCol := slices.Index(columns, "site_global_key")
-	domainCol := slices.Index(columns, "site_domain")
-	for {
-		row, err := reader.Read()
-		if row == nil {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
+	sites := &WikiSites{
+		Sites:   make(map[string]*WikiSite, 400),
+		Domains: make(map[string]*WikiSite, 400),
+	}
 
+	keys := make([]string, 0, len(domains))
+	for key := range domains {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
 		site := &WikiSite{
-			Key:           row[globalKeyCol],
-			Domain:        decodeDomain(row[domainCol]),
+			Key:           key,
+			Domain:        domains[key],
 			InterwikiMaps: make([]map[string]*WikiSite, 0, 3),
 			Namespaces:    make(map[string]*Namespace, 20),
 		}
@@ -99,19 +116,23 @@ func ReadWikiSites(client *http.Client, dumps string) (*WikiSites, error) {
 			continue
 		}
 
-		for _, f := range []string{"page.sql.gz", "pagelinks.sql.gz", "page_props.sql.gz"} {
-			latestFile := fmt.Sprintf("%s-latest-%s", site.Key, f)
-			latestPath := filepath.Join(dumps, site.Key, "latest", latestFile)
-			if latest, err := filepath.EvalSymlinks(latestPath); err == nil {
-				dir, _ := filepath.Split(latest)
-				_, version := filepath.Split(filepath.Dir(dir))
-				if dumped, err := time.Parse("20060102", version); err == nil {
-					if site.LastDumped.IsZero() || dumped.Before(site.LastDumped) {
-						site.LastDumped = dumped
-					}
+		dumped, incomplete := siteDumpDate(dumps, site.Key, true)
+		if incomplete != nil {
+			latest, _ := siteDumpDate(dumps, site.Key, false)
+			dumped = previousSiteDumpDate(dumps, site.Key, latest)
+			if dumped.IsZero() {
+				if logger != nil {
+					logger.Printf("skipping %s, whose dump is incomplete: %v", site.Key, incomplete)
 				}
+				continue
+			}
+			if logger != nil {
+				logger.Printf("dump %s of %s is incomplete, using the one of %s: %v",
+					latest.Format("20060102"), site.Key, dumped.Format("20060102"), incomplete)
 			}
 		}
+		site.LastDumped = dumped
+		site.DumpSize = siteDumpSize(dumps, site.Key)
 
 		if !site.LastDumped.IsZero() {
 			if err := readNamespaces(site, dumps); err != nil {
@@ -122,12 +143,7 @@ func ReadWikiSites(client *http.Client, dumps string) (*WikiSites, error) {
 		}
 	}
 
-	if client != nil {
-		iwmap, err := fetchInterwikiMap(client)
-		if err != nil {
-			return nil, err
-		}
-
+	if iwmap != nil {
 		globalInterwikiMap := make(map[string]*WikiSite, 200)
 		for key, domain := range iwmap {
 			if prefix, found := strings.CutPrefix(key, "__global:"); found {
@@ -185,6 +201,96 @@ func ReadWikiSites(client *http.Client, dumps string) (*WikiSites, error) {
 	return sites, nil
 }
 
+// SiteDumpFiles are the dump files that tell the date of a site's
+// latest dump. They are also the bulk of what per-site stages read.
+var siteDumpFiles = []string{"page.sql.gz", "pagelinks.sql.gz", "page_props.sql.gz"}
+
+// SiteDumpDate returns the date of the latest dump of a site, which is
+// the oldest of its page, pagelinks and page_props dumps, or the zero
+// time if the site has none of these files. If the dump date is pinned,
+// only the files of that run count; see pinnedDumpDate. If check is true, the
+// result is an error if any of the files is still being written.
+func siteDumpDate(dumps string, siteKey string, check bool) (time.Time, error) {
+	var result time.Time
+	for _, f := range siteDumpFiles {
+		if latest, err := filepath.EvalSymlinks(siteDumpPath(dumps, siteKey, f)); err == nil {
+			if check {
+				if err := checkDumpComplete(latest); err != nil {
+					return time.Time{}, err
+				}
+			}
+			dir, _ := filepath.Split(latest)
+			_, version := filepath.Split(filepath.Dir(dir))
+			if dumped, err := time.Parse("20060102", version); err == nil {
+				if result.IsZero() || dumped.Before(result) {
+					result = dumped
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// PreviousSiteDumpDate returns the date of the newest dump of a site
+// before the given one, whose files are all complete, or the zero time
+// if there is no such dump. The earlier dump must have the same
+// siteDumpFiles as the latest one. If a site's latest dump is still
+// being written, we build from the previous one instead of leaving
+// the site out.
+func previousSiteDumpDate(dumps string, siteKey string, before time.Time) time.Time {
+	var files []string
+	for _, f := range siteDumpFiles {
+		if _, err := os.Stat(siteDumpPath(dumps, siteKey, f)); err == nil {
+			files = append(files, f)
+		}
+	}
+	if len(files) == 0 {
+		return time.Time{}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dumps, siteKey))
+	if err != nil {
+		return time.Time{}
+	}
+	var dates []time.Time
+	for _, e := range entries {
+		if date, err := time.Parse("20060102", e.Name()); err == nil && e.IsDir() && date.Before(before) {
+			dates = append(dates, date)
+		}
+	}
+	slices.SortFunc(dates, func(a, b time.Time) int { return b.Compare(a) })
+
+	for _, date := range dates {
+		ymd := date.Format("20060102")
+		complete := true
+		for _, f := range files {
+			path := filepath.Join(dumps, siteKey, ymd, fmt.Sprintf("%s-%s-%s", siteKey, ymd, f))
+			if err := checkDumpComplete(path); err != nil {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			return date
+		}
+	}
+	return time.Time{}
+}
+
+// SiteDumpSize returns the total size of the latest siteDumpFiles of
+// a site, in bytes. Per-site stages take roughly proportional time,
+// so this is good enough for scheduling work and estimating progress.
+// Files that cannot be found count as empty.
+func siteDumpSize(dumps string, siteKey string) int64 {
+	var size int64
+	for _, f := range siteDumpFiles {
+		if info, err := os.Stat(siteDumpPath(dumps, siteKey, f)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
 func (w *WikiSite) ResolveInterwikiPrefix(prefix string) *WikiSite {
 	for _, m := range w.InterwikiMaps {
 		if target, found := m[prefix]; found {
@@ -214,17 +320,11 @@ func decodeDomain(s string) string {
 // See also https://www.mediawiki.org/wiki/Manual:Interwiki_cache.
 func fetchInterwikiMap(client *http.Client) (map[string]string, error) {
 	u := "https://noc.wikimedia.org/conf/interwiki.php.txt"
-	req, err := http.NewRequest("GET", u, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	// https://foundation.wikimedia.org/wiki/Policy:User-Agent_policy
-	req.Header.Set("User-Agent", "QRankBuilderBot/1.0 (https://github.com/brawer/wikidata-qrank; sascha@brawer.ch)")
-	resp, err := client.Do(req)
+	resp, err := client.Get(u)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("failed to fetch %s; StatusCode=%d", u, resp.StatusCode)
@@ -274,7 +374,7 @@ func readNamespaces(site *WikiSite, dumps string) error {
 	ymd := site.LastDumped.Format("20060102")
 	filename := fmt.Sprintf("%s-%s-siteinfo-namespaces.json.gz", site.Key, ymd)
 	path := filepath.Join(dumps, site.Key, ymd, filename)
-	file, err := os.Open(path)
+	file, err := openDump(context.Background(), path)
 	if os.IsNotExist(err) {
 		// Intentionally logging an error without failing, because some
 		// deprecated wiki projects such as ukwikimedia do not contain
@@ -38,10 +38,13 @@ func TestReadWikiSites(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	tests := []struct{ key, domain, lastDumped string }{
-		{"loginwiki", "login.wikimedia.org", "2024-05-01"},
-		{"rmwiki", "rm.wikipedia.org", "2024-03-01"},
-		{"wikidatawiki", "www.wikidata.org", "2024-04-01"},
+	tests := []struct {
+		key, domain, lastDumped string
+		dumpSize                int64
+	}{
+		{"loginwiki", "login.wikimedia.org", "2024-05-01", 1376},
+		{"rmwiki", "rm.wikipedia.org", "2024-03-01", 928 + 936},
+		{"wikidatawiki", "www.wikidata.org", "2024-04-01", 989 + 706},
 	}
 	for _, tc := range tests {
 		site := sites.Sites[tc.key]
@@ -55,6 +58,9 @@ func TestReadWikiSites(t *testing.T) {
 		if lastDumped != tc.lastDumped {
 			t.Errorf(`got %s, want %s, for sites["%s"].LastDumped`, lastDumped, tc.lastDumped, tc.key)
 		}
+		if site.DumpSize != tc.dumpSize {
+			t.Errorf(`got %d, want %d, for sites["%s"].DumpSize`, site.DumpSize, tc.dumpSize, tc.key)
+		}
 	}
 
 	for _, tc := range []struct {
@@ -0,0 +1,246 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+	"github.com/minio/minio-go/v7"
+)
+
+// DictionaryKinds are the kinds of per-site files that can get compressed
+// with a zstd dictionary. For the hundreds of tiny wikis, these files are
+// only a few kilobytes in size, and zstd cannot compress them well
+// without knowing what they typically look like.
+var dictionaryKinds = []string{"titles", "redirects"}
+
+// SmallFileSize is the maximal size of uncompressed data that gets
+// compressed with a dictionary. For larger files, a dictionary makes
+// hardly any difference.
+const smallFileSize = 256 * 1024
+
+// MaxDictionarySamples is the maximal number of files that we sample
+// for training a dictionary, and maxSampleSize is the maximal number
+// of bytes that we take from each file.
+const (
+	maxDictionarySamples = 500
+	maxSampleSize        = 32 * 1024
+)
+
+// ZstdDicts holds the zstd dictionaries in storage. Per-site files that
+// were compressed with a dictionary can only be decompressed with the
+// same dictionary, so readers need to know all of them. A nil *ZstdDicts
+// is valid and means that no dictionaries are used.
+type ZstdDicts struct {
+	latest map[string][]byte // kind → most recent dictionary
+	all    [][]byte
+}
+
+// LoadZstdDicts fetches all zstd dictionaries from storage.
+func LoadZstdDicts(ctx context.Context, s3 S3) (*ZstdDicts, error) {
+	paths := make([]string, 0, 10)
+	opts := minio.ListObjectsOptions{Prefix: "dictionaries/"}
+	for obj := range s3.ListObjects(ctx, "qrank", opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if _, _, ok := ParseDictionaryPath(obj.Key); ok {
+			paths = append(paths, obj.Key)
+		}
+	}
+	sort.Strings(paths) // in each kind, most recent dictionary comes last
+
+	d := &ZstdDicts{
+		latest: make(map[string][]byte, len(dictionaryKinds)),
+		all:    make([][]byte, 0, len(paths)),
+	}
+	for _, path := range paths {
+		data, err := readFromStorage(ctx, path, s3)
+		if err != nil {
+			return nil, err
+		}
+		kind, _, _ := ParseDictionaryPath(path)
+		d.latest[kind] = data
+		d.all = append(d.all, data)
+	}
+	return d, nil
+}
+
+// DecoderOptions returns options for zstd.NewReader that make it
+// understand files that were compressed with any of our dictionaries.
+func (d *ZstdDicts) DecoderOptions() []zstd.DOption {
+	if d == nil || len(d.all) == 0 {
+		return nil
+	}
+	return []zstd.DOption{zstd.WithDecoderDicts(d.all...)}
+}
+
+// Recompress re-compresses a local zstd file with the dictionary for
+// its kind, provided that there is such a dictionary and that the file
+// is small. Otherwise, the file is left unchanged.
+func (d *ZstdDicts) Recompress(path string, kind string) error {
+	if d == nil {
+		return nil
+	}
+	dictionary, ok := d.latest[kind]
+	if !ok {
+		return nil
+	}
+
+	data, err := readZstdFile(path, smallFileSize+1, d.DecoderOptions()...)
+	if err != nil {
+		return err
+	}
+	if len(data) > smallFileSize {
+		return nil
+	}
+
+	encoder, err := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+		zstd.WithEncoderDict(dictionary))
+	if err != nil {
+		return err
+	}
+	defer encoder.Close()
+	return os.WriteFile(path, encoder.EncodeAll(data, nil), 0644)
+}
+
+// TrainZstdDicts trains a new dictionary for each kind of per-site file
+// in dictionaryKinds, and puts them into storage. As training samples,
+// we take the smallest files of each kind, because those are the ones
+// that benefit from a dictionary.
+func TrainZstdDicts(ctx context.Context, version time.Time, s3 S3) ([]string, error) {
+	existing, err := LoadZstdDicts(ctx, s3)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, len(dictionaryKinds))
+	for _, kind := range dictionaryKinds {
+		samples, err := readDictionarySamples(ctx, kind, existing, s3)
+		if err != nil {
+			return nil, err
+		}
+		if len(samples) == 0 {
+			logger.Printf("no %s files in storage, not training a dictionary", kind)
+			continue
+		}
+
+		dictionary, err := dict.BuildZstdDict(samples, dict.Options{
+			MaxDictSize: 112640, // same as the zstd command-line tool
+			HashBytes:   6,
+			ZstdLevel:   zstd.SpeedBestCompression,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot train dictionary for %s: %w", kind, err)
+		}
+
+		tmp, err := os.CreateTemp("", "*.zdict")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmp.Name())
+		if _, err := tmp.Write(dictionary); err != nil {
+			tmp.Close()
+			return nil, err
+		}
+		if err := tmp.Close(); err != nil {
+			return nil, err
+		}
+
+		dest := DictionaryPath(kind, version)
+		if err := PutInStorage(ctx, tmp.Name(), s3, "qrank", dest, "application/octet-stream"); err != nil {
+			return nil, err
+		}
+		logger.Printf("trained %s from %d samples, %d bytes", dest, len(samples), len(dictionary))
+		result = append(result, dest)
+	}
+	return result, nil
+}
+
+// ReadDictionarySamples returns the beginning of the smallest per-site
+// files of a kind, for training a dictionary.
+func readDictionarySamples(ctx context.Context, kind string, dicts *ZstdDicts, s3 S3) ([][]byte, error) {
+	objects := make([]minio.ObjectInfo, 0, 1000)
+	opts := minio.ListObjectsOptions{Prefix: kind + "/"}
+	for obj := range s3.ListObjects(ctx, "qrank", opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if k, _, _, ok := ParseSitePath(obj.Key); ok && k == kind {
+			objects = append(objects, obj)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].Size != objects[j].Size {
+			return objects[i].Size < objects[j].Size
+		}
+		return objects[i].Key < objects[j].Key
+	})
+
+	samples := make([][]byte, 0, min(len(objects), maxDictionarySamples))
+	tempDir, err := os.MkdirTemp("", "dictionary-samples-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	for i, obj := range objects[:min(len(objects), maxDictionarySamples)] {
+		path := filepath.Join(tempDir, fmt.Sprintf("%d.zst", i))
+		if err := s3.FGetObject(ctx, "qrank", obj.Key, path, minio.GetObjectOptions{}); err != nil {
+			return nil, err
+		}
+		data, err := readZstdFile(path, maxSampleSize, dicts.DecoderOptions()...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", obj.Key, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+		if len(data) > 0 {
+			samples = append(samples, data)
+		}
+	}
+	return samples, nil
+}
+
+// ReadZstdFile decompresses up to limit bytes from a local zstd file.
+func readZstdFile(path string, limit int64, opts ...zstd.DOption) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder, err := zstd.NewReader(file, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(decoder, limit)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadFromStorage returns the content of a small file in storage.
+func readFromStorage(ctx context.Context, path string, s3 S3) ([]byte, error) {
+	reader, err := NewS3Reader(ctx, "qrank", path, s3)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestZstdDicts(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	for i := 0; i < 40; i++ {
+		lines := make([]string, 0, 20)
+		for j := 0; j < 20; j++ {
+			lines = append(lines, fmt.Sprintf("Category:Wikipedia articles %d\tQ%d", i*20+j, 1000+i*j))
+		}
+		path := fmt.Sprintf("titles/site%dwiki-20240501-titles.zst", i)
+		if err := s3.WriteLines(lines, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	version, _ := time.Parse(time.DateOnly, "2024-05-20")
+	trained, err := TrainZstdDicts(ctx, version, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dictionaries/titles-20240520.zdict"}; !slices.Equal(trained, want) {
+		t.Errorf("got %v, want %v", trained, want)
+	}
+
+	dicts, err := LoadZstdDicts(ctx, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := "Category:Wikipedia articles 7\tQ1001\nCategory:Wikipedia articles 8\tQ1002\n"
+	path := filepath.Join(t.TempDir(), "titles.zst")
+	writeZstdFile(t, path, content)
+	plain, _ := os.Stat(path)
+	if err := dicts.Recompress(path, "titles"); err != nil {
+		t.Fatal(err)
+	}
+	compressed, _ := os.Stat(path)
+	if compressed.Size() >= plain.Size() {
+		t.Errorf("got %d bytes with dictionary, %d without", compressed.Size(), plain.Size())
+	}
+
+	got, err := readZstdFile(path, 1000, dicts.DecoderOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Errorf("got %q, want %q", got, content)
+	}
+
+	// Without the dictionary, the file cannot be decompressed.
+	if _, err := readZstdFile(path, 1000); err == nil {
+		t.Error("expected error when decompressing without dictionary")
+	}
+
+	// There is no dictionary for redirects, so they stay as they are.
+	redirects := filepath.Join(t.TempDir(), "redirects.zst")
+	writeZstdFile(t, redirects, content)
+	before, _ := os.ReadFile(redirects)
+	if err := dicts.Recompress(redirects, "redirects"); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(redirects); !bytes.Equal(before, after) {
+		t.Error("redirects should not have been re-compressed")
+	}
+}
+
+func TestZstdDicts_LargeFile(t *testing.T) {
+	dicts := &ZstdDicts{latest: map[string][]byte{"titles": []byte("unused")}}
+	path := filepath.Join(t.TempDir(), "titles.zst")
+	writeZstdFile(t, path, strings.Repeat("x", smallFileSize+1))
+	before, _ := os.ReadFile(path)
+	if err := dicts.Recompress(path, "titles"); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Error("large file should not have been re-compressed")
+	}
+}
+
+func TestZstdDicts_Nil(t *testing.T) {
+	var dicts *ZstdDicts
+	if opts := dicts.DecoderOptions(); opts != nil {
+		t.Errorf("got %v, want nil", opts)
+	}
+	if err := dicts.Recompress("does-not-exist.zst", "titles"); err != nil {
+		t.Error(err)
+	}
+}
+
+func writeZstdFile(t *testing.T, path string, content string) {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	if err := os.WriteFile(path, encoder.EncodeAll([]byte(content), nil), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
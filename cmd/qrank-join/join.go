@@ -0,0 +1,322 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/lanrat/extsort"
+	"golang.org/x/sync/errgroup"
+)
+
+// JoinOptions controls how Join reads and writes its data.
+type JoinOptions struct {
+	// Column is the name of the input column that holds Wikidata IDs.
+	// If empty, the column gets detected from the header or the first row.
+	Column string
+
+	// InputComma and OutputComma are the field delimiters for the user
+	// input and the annotated output. Zero means comma.
+	InputComma  rune
+	OutputComma rune
+
+	// TempDir is the directory for temporary files of the external sort.
+	// If empty, the operating system default will be used.
+	TempDir string
+}
+
+// Join annotates each row of a user-supplied table with the matching row
+// of a reference file, such as the published item signals or QRank file.
+//
+// Both inputs are streamed through an external sort, so neither the user
+// table nor the reference file needs to fit into memory. The output has
+// the same rows in the same order as the input, followed by the columns
+// of the reference file. Rows whose item is unknown or unparseable get
+// empty reference columns.
+func Join(ctx context.Context, input io.Reader, ref io.Reader, out io.Writer, opts JoinOptions) error {
+	inReader := csv.NewReader(input)
+	if opts.InputComma != 0 {
+		inReader.Comma = opts.InputComma
+	}
+	inReader.Comment = '#'
+
+	refReader := csv.NewReader(ref)
+	refReader.Comment = '#'
+
+	inHeader, err := inReader.Read()
+	if err != nil {
+		return fmt.Errorf("cannot read input header: %w", err)
+	}
+
+	refHeader, err := refReader.Read()
+	if err != nil {
+		return fmt.Errorf("cannot read reference header: %w", err)
+	}
+	refKey := findKeyColumn(refHeader)
+	if refKey < 0 {
+		refKey = 0
+	}
+
+	// Read the first row now, so we can sniff the item column from it.
+	firstRow, err := inReader.Read()
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	inKey, err := findInputColumn(inHeader, firstRow, opts.Column)
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(out)
+	if opts.OutputComma != 0 {
+		writer.Comma = opts.OutputComma
+	}
+	outHeader := append(append([]string{}, inHeader...), without(refHeader, refKey)...)
+	if err := writer.Write(outHeader); err != nil {
+		return err
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	config := extsort.DefaultConfig()
+	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
+	config.NumWorkers = runtime.NumCPU()
+	config.TempFilesDir = opts.TempDir
+
+	byItemChan := make(chan extsort.SortType, 10000)
+	byItemSorter, byItemOut, byItemErr := extsort.New(byItemChan, joinRecordFromBytes, joinRecordLessByItem, config)
+
+	config2 := *config
+	byLineChan := make(chan extsort.SortType, 10000)
+	byLineSorter, byLineOut, byLineErr := extsort.New(byLineChan, joinRecordFromBytes, joinRecordLessByLine, &config2)
+
+	g.Go(func() error {
+		defer close(byItemChan)
+		if err := readReference(ctx, refReader, refKey, byItemChan); err != nil {
+			return err
+		}
+		return readInput(ctx, inReader, firstRow, inKey, byItemChan)
+	})
+
+	g.Go(func() error {
+		defer close(byLineChan)
+		byItemSorter.Sort(ctx)
+		numRefColumns := len(refHeader) - 1
+		var refItem int64
+		var refFields []string
+		for r := range byItemOut {
+			rec := r.(joinRecord)
+			if rec.line < 0 {
+				// Reference rows sort before input rows of the same item.
+				// If the reference has duplicates, we use only one of them.
+				if rec.item != refItem {
+					refItem, refFields = rec.item, rec.fields
+				}
+				continue
+			}
+			if rec.item != 0 && rec.item == refItem {
+				rec.fields = append(rec.fields, refFields...)
+			} else {
+				rec.fields = append(rec.fields, make([]string, numRefColumns)...)
+			}
+			select {
+			case byLineChan <- rec:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return <-byItemErr
+	})
+
+	g.Go(func() error {
+		byLineSorter.Sort(ctx)
+		for r := range byLineOut {
+			if err := writer.Write(r.(joinRecord).fields); err != nil {
+				return err
+			}
+		}
+		return <-byLineErr
+	})
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// ParseItem parses a Wikidata item ID such as "Q42", "wd:Q42" or
+// "http://www.wikidata.org/entity/Q42", as found in the results
+// of Wikidata Query Service. If s is not an item ID, the result is 0.
+func ParseItem(s string) int64 {
+	s = strings.TrimSpace(s)
+	if pos := strings.LastIndexAny(s, "/:"); pos >= 0 {
+		s = s[pos+1:]
+	}
+	if len(s) < 2 || (s[0] != 'Q' && s[0] != 'q') {
+		return 0
+	}
+	id, err := strconv.ParseInt(s[1:], 10, 64)
+	if err != nil || id <= 0 {
+		return 0
+	}
+	return id
+}
+
+func readReference(ctx context.Context, r *csv.Reader, key int, out chan<- extsort.SortType) error {
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		item := ParseItem(row[key])
+		if item == 0 {
+			continue
+		}
+
+		rec := joinRecord{item: item, line: -1, fields: without(row, key)}
+		select {
+		case out <- rec:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func readInput(ctx context.Context, r *csv.Reader, firstRow []string, key int, out chan<- extsort.SortType) error {
+	row := firstRow
+	for line := int64(0); row != nil; line++ {
+		var item int64
+		if key < len(row) {
+			item = ParseItem(row[key])
+		}
+
+		rec := joinRecord{item: item, line: line, fields: row}
+		select {
+		case out <- rec:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		var err error
+		row, err = r.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindKeyColumn returns the index of the column that is conventionally
+// used for Wikidata IDs, or -1 if there is no such column.
+func findKeyColumn(header []string) int {
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "item", "entity", "qid", "wikidata":
+			return i
+		}
+	}
+	return -1
+}
+
+// FindInputColumn figures out which column of the user input holds
+// the Wikidata IDs. If the caller has named a column, it must exist.
+// Otherwise, we look for a conventional column name, and as a last
+// resort for the first column whose value in the first row is an ID.
+func findInputColumn(header []string, firstRow []string, name string) (int, error) {
+	if name != "" {
+		for i, h := range header {
+			if h == name {
+				return i, nil
+			}
+		}
+		return -1, fmt.Errorf("input has no column %q", name)
+	}
+
+	if i := findKeyColumn(header); i >= 0 {
+		return i, nil
+	}
+
+	for i, value := range firstRow {
+		if ParseItem(value) != 0 {
+			return i, nil
+		}
+	}
+
+	return -1, errors.New("cannot find column with Wikidata IDs; use -column to specify it")
+}
+
+func without(row []string, index int) []string {
+	result := make([]string, 0, len(row))
+	result = append(result, row[:index]...)
+	return append(result, row[index+1:]...)
+}
+
+// JoinRecord is a row of either the user input or the reference file,
+// which gets passed through the external sort. Reference rows have
+// a negative line number.
+type joinRecord struct {
+	item   int64
+	line   int64
+	fields []string
+}
+
+func (r joinRecord) ToBytes() []byte {
+	size := 3 * binary.MaxVarintLen64
+	for _, f := range r.fields {
+		size += binary.MaxVarintLen64 + len(f)
+	}
+	buf := make([]byte, 0, size)
+	buf = binary.AppendVarint(buf, r.item)
+	buf = binary.AppendVarint(buf, r.line)
+	buf = binary.AppendUvarint(buf, uint64(len(r.fields)))
+	for _, f := range r.fields {
+		buf = binary.AppendUvarint(buf, uint64(len(f)))
+		buf = append(buf, f...)
+	}
+	return buf
+}
+
+func joinRecordFromBytes(b []byte) extsort.SortType {
+	item, n := binary.Varint(b)
+	b = b[n:]
+	line, n := binary.Varint(b)
+	b = b[n:]
+	numFields, n := binary.Uvarint(b)
+	b = b[n:]
+	fields := make([]string, numFields)
+	for i := range fields {
+		size, n := binary.Uvarint(b)
+		b = b[n:]
+		fields[i] = string(b[:size])
+		b = b[size:]
+	}
+	return joinRecord{item: item, line: line, fields: fields}
+}
+
+func joinRecordLessByItem(a, b extsort.SortType) bool {
+	aa, bb := a.(joinRecord), b.(joinRecord)
+	if aa.item != bb.item {
+		return aa.item < bb.item
+	}
+	return aa.line < bb.line
+}
+
+func joinRecordLessByLine(a, b extsort.SortType) bool {
+	return a.(joinRecord).line < b.(joinRecord).line
+}
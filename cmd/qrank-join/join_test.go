@@ -0,0 +1,136 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestJoin(t *testing.T) {
+	ref := "# version: 2024-05-01\n" +
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks\n" +
+		"Q1,100,1000,10,5,3\n" +
+		"Q42,4200,42000,420,42,7\n" +
+		"Q64,640,6400,64,6,4\n"
+	input := "name,qid\n" +
+		"Douglas Adams,http://www.wikidata.org/entity/Q42\n" +
+		"nothing,Q999\n" +
+		"universe,wd:Q1\n" +
+		"garbage,foo\n" +
+		"Douglas Adams again,Q42\n"
+	want := "name,qid,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks\n" +
+		"Douglas Adams,http://www.wikidata.org/entity/Q42,4200,42000,420,42,7\n" +
+		"nothing,Q999,,,,,\n" +
+		"universe,wd:Q1,100,1000,10,5,3\n" +
+		"garbage,foo,,,,,\n" +
+		"Douglas Adams again,Q42,4200,42000,420,42,7\n"
+
+	var buf strings.Builder
+	err := Join(context.Background(), strings.NewReader(input), strings.NewReader(ref), &buf, JoinOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestJoin_TSV(t *testing.T) {
+	ref := "Entity,QRank\nQ42,4200\nQ1,100\n"
+	input := "label\tx\nthe universe\tQ1\nno match\tQ2\n"
+	want := "label\tx\tQRank\nthe universe\tQ1\t100\nno match\tQ2\t\n"
+
+	var buf strings.Builder
+	opts := JoinOptions{InputComma: '\t', OutputComma: '\t'}
+	err := Join(context.Background(), strings.NewReader(input), strings.NewReader(ref), &buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestJoin_Column(t *testing.T) {
+	ref := "Entity,QRank\nQ42,4200\nQ1,100\n"
+	input := "a,b\nQ42,Q1\n"
+
+	var buf strings.Builder
+	err := Join(context.Background(), strings.NewReader(input), strings.NewReader(ref), &buf, JoinOptions{Column: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "a,b,QRank\nQ42,Q1,100\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	buf.Reset()
+	err = Join(context.Background(), strings.NewReader(input), strings.NewReader(ref), &buf, JoinOptions{Column: "c"})
+	if err == nil {
+		t.Error("expected error for missing column, got nil")
+	}
+}
+
+// Check that the output preserves the order of a larger input
+// whose items come in random order.
+func TestJoin_Large(t *testing.T) {
+	const n = 50000
+	var ref, input, want strings.Builder
+	ref.WriteString("Entity,QRank\n")
+	for i := n; i > 0; i-- {
+		if i%3 != 0 {
+			fmt.Fprintf(&ref, "Q%d,%d\n", i, i*10)
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(23))
+	input.WriteString("id\n")
+	want.WriteString("id,QRank\n")
+	for i := 0; i < n; i++ {
+		id := rnd.Intn(n) + 1
+		fmt.Fprintf(&input, "Q%d\n", id)
+		if id%3 != 0 {
+			fmt.Fprintf(&want, "Q%d,%d\n", id, id*10)
+		} else {
+			fmt.Fprintf(&want, "Q%d,\n", id)
+		}
+	}
+
+	var buf strings.Builder
+	err := Join(context.Background(), strings.NewReader(input.String()), strings.NewReader(ref.String()), &buf, JoinOptions{TempDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != want.String() {
+		t.Error("output does not match expectation")
+	}
+}
+
+func TestParseItem(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want int64
+	}{
+		{"Q42", 42},
+		{"q42", 42},
+		{" Q42 ", 42},
+		{"wd:Q42", 42},
+		{"http://www.wikidata.org/entity/Q42", 42},
+		{"https://www.wikidata.org/wiki/Q42", 42},
+		{"Q", 0},
+		{"Q0", 0},
+		{"Q-1", 0},
+		{"P31", 0},
+		{"", 0},
+		{"foo", 0},
+	} {
+		if got := ParseItem(tc.s); got != tc.want {
+			t.Errorf("ParseItem(%q) = %d, want %d", tc.s, got, tc.want)
+		}
+	}
+}
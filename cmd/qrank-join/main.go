@@ -0,0 +1,140 @@
+// Tool for annotating a list of Wikidata items with ranking signals.
+//
+// The input is a CSV or TSV file with a column of Wikidata IDs, such as
+// the results of a query that was exported from Wikidata Query Service.
+// The output has the same rows in the same order, with the columns
+// of the published QRank or item signals file appended to each row.
+//
+//	qrank-join -qrank item_signals-20240501.csv.zst query.csv >out.csv
+//
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func main() {
+	qrank := flag.String("qrank", "", "path to QRank or item signals file, optionally compressed with .gz or .zst")
+	column := flag.String("column", "", "name of input column with Wikidata IDs; detected automatically if empty")
+	out := flag.String("o", "", "path to output file; standard output if empty")
+	tsv := flag.Bool("tsv", false, "read and write tab-separated values; default for .tsv inputs")
+	tmpDir := flag.String("tmpdir", "", "directory for temporary files; system default if empty")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -qrank file [flags] [input]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Reads standard input if no input file is given.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *qrank == "" || flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	inPath := flag.Arg(0)
+	if err := run(*qrank, inPath, *out, *column, *tsv, *tmpDir); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(qrankPath, inPath, outPath, column string, tsv bool, tmpDir string) error {
+	ref, err := openInput(qrankPath)
+	if err != nil {
+		return err
+	}
+	defer ref.Close()
+
+	var input io.ReadCloser = os.Stdin
+	if inPath != "" && inPath != "-" {
+		input, err = openInput(inPath)
+		if err != nil {
+			return err
+		}
+		defer input.Close()
+	}
+
+	opts := JoinOptions{Column: column, TempDir: tmpDir}
+	if tsv || strings.HasSuffix(strings.TrimSuffix(strings.TrimSuffix(inPath, ".gz"), ".zst"), ".tsv") {
+		opts.InputComma = '\t'
+		opts.OutputComma = '\t'
+	}
+
+	if outPath == "" {
+		w := bufio.NewWriter(os.Stdout)
+		if err := Join(context.Background(), input, ref, w, opts); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(outFile)
+	if err := Join(context.Background(), input, ref, w, opts); err != nil {
+		outFile.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		outFile.Close()
+		return err
+	}
+	return outFile.Close()
+}
+
+// OpenInput opens a file for reading, decompressing it on the fly
+// if its name ends in .gz or .zst.
+func openInput(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &decompressingReader{reader, file}, nil
+
+	case strings.HasSuffix(path, ".zst"):
+		reader, err := zstd.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &decompressingReader{reader.IOReadCloser(), file}, nil
+
+	default:
+		return file, nil
+	}
+}
+
+type decompressingReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (r *decompressingReader) Close() error {
+	err := r.ReadCloser.Close()
+	if ferr := r.file.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
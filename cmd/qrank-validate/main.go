@@ -0,0 +1,205 @@
+// Tool for checking a copy of the QRank data, such as on a mirror.
+//
+// The tool reads qrank.csv.gz from a local file or a URL, computes
+// its SHA-256 digest, and checks that the CSV is well-formed and
+// sorted by decreasing QRank. When given the stats file of the same
+// release, it also checks that the number of rows matches. When given
+// a minisign public key, it checks the detached signature of the file.
+//
+//	qrank-validate -stats qrank-stats.json -sha256 1f2e… qrank.csv.gz
+//	qrank-validate -pubkey minisign.pub https://qrank.wmcloud.org/download/qrank.csv.gz
+//
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/httpclient"
+	"github.com/brawer/wikidata-qrank/v2/internal/minisign"
+)
+
+func main() {
+	statsPath := flag.String("stats", "", "path or URL to qrank-stats.json of the same release; not checked if empty")
+	wantSHA256 := flag.String("sha256", "", "expected SHA-256 digest of qrank.csv.gz in hex; not checked if empty")
+	publicKey := flag.String("pubkey", "", "minisign public key, or path to a minisign public key file, for checking the signature; not checked if empty")
+	signaturePath := flag.String("signature", "", "path or URL to the minisign signature of qrank.csv.gz; default: input with .minisig appended")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] qrank.csv.gz\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "The input can be a local path or an http(s) URL.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := checks{stats: *statsPath, sha256: *wantSHA256, publicKey: *publicKey, signature: *signaturePath}
+	summary, err := run(httpclient.New(httpclient.Options{Agent: "QRankValidate"}), flag.Arg(0), c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	printSummary(os.Stdout, summary)
+	if !summary.OK() {
+		os.Exit(1)
+	}
+}
+
+// Checks tells what run should check besides the content of the file.
+// Empty fields are not checked.
+type checks struct {
+	stats     string // path or URL to the stats file of the same release
+	sha256    string // expected SHA-256 digest in hex
+	publicKey string // minisign public key, or path to a public key file
+	signature string // path or URL to the signature; default: file + ".minisig"
+}
+
+func run(client *http.Client, qrankPath string, c checks) (*Summary, error) {
+	var verifier *minisign.Verifier
+	var sig *minisign.Signature
+	var sigProblem string
+	if c.publicKey != "" {
+		key, err := readPublicKey(c.publicKey)
+		if err != nil {
+			return nil, err
+		}
+		sigPath := c.signature
+		if sigPath == "" {
+			sigPath = qrankPath + ".minisig"
+		}
+		sig, err = readSignature(client, sigPath)
+		if err != nil {
+			return nil, err
+		}
+		verifier, err = key.NewVerifier(sig)
+		if err != nil {
+			sigProblem = err.Error()
+		}
+	}
+
+	qrank, err := openInput(client, qrankPath)
+	if err != nil {
+		return nil, err
+	}
+	defer qrank.Close()
+
+	var r io.Reader = qrank
+	if verifier != nil {
+		r = io.TeeReader(qrank, verifier)
+	}
+	summary, err := Validate(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", qrankPath, err)
+	}
+
+	if c.sha256 != "" && !strings.EqualFold(c.sha256, summary.SHA256) {
+		summary.problem("SHA-256 digest is %s, want %s", summary.SHA256, strings.ToLower(c.sha256))
+	}
+
+	if sigProblem != "" {
+		summary.problem("%s", sigProblem)
+	} else if verifier != nil {
+		if err := verifier.Verify(); err != nil {
+			summary.problem("%v", err)
+		} else {
+			summary.Signature = fmt.Sprintf("key %s, %s", sig.KeyID, sig.TrustedComment)
+		}
+	}
+
+	if c.stats != "" {
+		statsPath := c.stats
+		stats, err := openInput(client, statsPath)
+		if err != nil {
+			return nil, err
+		}
+		defer stats.Close()
+		if err := CheckStats(summary, stats); err != nil {
+			return nil, fmt.Errorf("%s: %w", statsPath, err)
+		}
+	}
+
+	return summary, nil
+}
+
+// OpenInput opens a local file, or starts downloading a URL.
+func openInput(client *http.Client, path string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		return os.Open(path)
+	}
+
+	resp, err := client.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// ReadPublicKey parses a minisign public key, which is either given
+// directly or as the path to a public key file.
+func readPublicKey(s string) (*minisign.PublicKey, error) {
+	if data, err := os.ReadFile(s); err == nil {
+		key, err := minisign.ParsePublicKey(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s, err)
+		}
+		return key, nil
+	}
+	return minisign.ParsePublicKey(s)
+}
+
+// ReadSignature reads a minisign signature from a local file or a URL.
+func readSignature(client *http.Client, path string) (*minisign.Signature, error) {
+	r, err := openInput(client, path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(io.LimitReader(r, 4096))
+	if err != nil {
+		return nil, err
+	}
+	sig, err := minisign.ParseSignature(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return sig, nil
+}
+
+// PrintSummary writes a human-readable report about a QRank file.
+func printSummary(w io.Writer, s *Summary) {
+	fmt.Fprintf(w, "SHA-256:  %s\n", s.SHA256)
+	fmt.Fprintf(w, "Columns:  %s\n", strings.Join(s.Columns, ","))
+	fmt.Fprintf(w, "Rows:     %d\n", s.Rows)
+	if s.Rows > 0 {
+		fmt.Fprintf(w, "Top:      %s, QRank %d\n", s.Top, s.TopQRank)
+	}
+	if s.Signature != "" {
+		fmt.Fprintf(w, "Signed:   %s\n", s.Signature)
+	}
+	if s.OK() {
+		fmt.Fprintf(w, "OK\n")
+		return
+	}
+	fmt.Fprintf(w, "\nProblems:\n")
+	for _, p := range s.Problems {
+		fmt.Fprintf(w, "  %s\n", p)
+	}
+	if s.Omitted > 0 {
+		fmt.Fprintf(w, "  … and %d more\n", s.Omitted)
+	}
+}
@@ -0,0 +1,195 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The columns of qrank.csv.gz.
+var qrankColumns = []string{"Entity", "QRank"}
+
+var entityRegexp = regexp.MustCompile(`^Q[1-9][0-9]*$`)
+
+// MaxProblems limits how many problems get reported, so that a badly
+// broken file does not flood the terminal with millions of lines.
+const maxProblems = 20
+
+// Summary tells what Validate found in a QRank file.
+type Summary struct {
+	SHA256    string   // hex-encoded digest of the compressed file
+	Columns   []string // CSV header, such as [Entity QRank]
+	Rows      int64    // number of data rows, not counting the header
+	Top       string   // entity in the first row, such as "Q5"
+	TopQRank  int64    // QRank of the entity in the first row
+	Signature string   // key and trusted comment of a good signature, if checked
+	Problems  []string // problems found, at most maxProblems
+	Omitted   int64    // number of problems that were not listed
+}
+
+// OK returns true if no problems were found.
+func (s *Summary) OK() bool {
+	return len(s.Problems) == 0
+}
+
+func (s *Summary) problem(format string, args ...any) {
+	if len(s.Problems) < maxProblems {
+		s.Problems = append(s.Problems, fmt.Sprintf(format, args...))
+	} else {
+		s.Omitted += 1
+	}
+}
+
+// Validate reads a gzip-compressed QRank file and checks its contents.
+// The SHA-256 digest is computed over the compressed bytes, which is
+// what mirrors are supposed to serve unchanged. Rows must have the same
+// number of columns as the header, and they must be sorted by QRank in
+// decreasing order. Lines starting with # are comments, such as the
+// provenance of the file. Problems with the content get listed in the
+// returned summary; the error is only set if the file cannot be read.
+func Validate(r io.Reader) (*Summary, error) {
+	summary := &Summary{}
+	hash := sha256.New()
+	gz, err := gzip.NewReader(io.TeeReader(r, hash))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	scanner := bufio.NewScanner(gz)
+	lineNum := 0
+	var last int64 = -1
+	for scanner.Scan() {
+		lineNum += 1
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		cols := strings.Split(line, ",")
+		if summary.Columns == nil {
+			if !slices.Equal(cols, qrankColumns) {
+				summary.problem("line %d: bad header %q, want %q", lineNum, line, strings.Join(qrankColumns, ","))
+				break
+			}
+			summary.Columns = cols
+			continue
+		}
+
+		summary.Rows += 1
+		if len(cols) != len(summary.Columns) {
+			summary.problem("line %d: got %d columns, want %d", lineNum, len(cols), len(summary.Columns))
+			continue
+		}
+		if !entityRegexp.MatchString(cols[0]) {
+			summary.problem("line %d: bad entity %q", lineNum, cols[0])
+		}
+
+		qrank, err := strconv.ParseInt(cols[1], 10, 64)
+		if err != nil || qrank < 0 {
+			summary.problem("line %d: bad QRank %q", lineNum, cols[1])
+			continue
+		}
+
+		if summary.Rows == 1 {
+			summary.Top = cols[0]
+			summary.TopQRank = qrank
+		}
+
+		// QRank must never increase.
+		if last >= 0 && qrank > last {
+			summary.problem("line %d: QRank %d is larger than %d on previous row",
+				lineNum, qrank, last)
+		}
+		last = qrank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if summary.Columns == nil && summary.OK() {
+		summary.problem("missing CSV header")
+	}
+
+	// Drain any trailing bytes, so the digest covers the entire file.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, err
+	}
+	summary.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return summary, nil
+}
+
+// CheckStats compares a summary of a QRank file to its stats file,
+// and adds any inconsistencies to the summary’s problems. In the stats,
+// Samples is a list of [Entity, Rank, QRank] triples whose first and
+// last elements are the first and last rows of the QRank file.
+func CheckStats(summary *Summary, r io.Reader) error {
+	var raw struct {
+		Samples [][]any
+	}
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return err
+	}
+
+	if len(raw.Samples) == 0 {
+		summary.problem("stats: no samples")
+		return nil
+	}
+
+	first, err := parseSample(raw.Samples[0])
+	if err != nil {
+		return err
+	}
+	if first.entity != summary.Top || first.qrank != summary.TopQRank {
+		summary.problem("stats: top sample is %s with QRank %d, but file starts with %s with QRank %d",
+			first.entity, first.qrank, summary.Top, summary.TopQRank)
+	}
+
+	last, err := parseSample(raw.Samples[len(raw.Samples)-1])
+	if err != nil {
+		return err
+	}
+	if last.rank != summary.Rows {
+		summary.problem("stats: last sample has rank %d, but file has %d rows", last.rank, summary.Rows)
+	}
+	return nil
+}
+
+type sample struct {
+	entity string
+	rank   int64
+	qrank  int64
+}
+
+func parseSample(s []any) (sample, error) {
+	if len(s) != 3 {
+		return sample{}, fmt.Errorf("stats: bad sample %v", s)
+	}
+	entity, ok1 := s[0].(string)
+	rank, ok2 := s[1].(json.Number)
+	qrank, ok3 := s[2].(json.Number)
+	if !ok1 || !ok2 || !ok3 {
+		return sample{}, fmt.Errorf("stats: bad sample %v", s)
+	}
+	r, err := rank.Int64()
+	if err != nil {
+		return sample{}, fmt.Errorf("stats: bad sample %v", s)
+	}
+	q, err := qrank.Int64()
+	if err != nil {
+		return sample{}, fmt.Errorf("stats: bad sample %v", s)
+	}
+	return sample{entity: entity, rank: r, qrank: q}, nil
+}
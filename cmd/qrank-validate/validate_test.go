@@ -0,0 +1,288 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/minisign"
+)
+
+const testQRank = "# version: 2024-05-01\n" +
+	"Entity,QRank\n" +
+	"Q5,900\n" +
+	"Q72,800\n" +
+	"Q1234,7\n"
+
+const testStats = `{"Median":1,` +
+	`"Samples":[["Q5",1,900],["Q72",2,800],["Q1234",3,7]]}`
+
+func gzipped(s string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestValidate(t *testing.T) {
+	data := gzipped(testQRank)
+	got, err := Validate(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.OK() {
+		t.Errorf("got problems %q", got.Problems)
+	}
+	digest := sha256.Sum256(data)
+	if want := hex.EncodeToString(digest[:]); got.SHA256 != want {
+		t.Errorf("got SHA256 %s, want %s", got.SHA256, want)
+	}
+	if want := []string{"Entity", "QRank"}; !slices.Equal(got.Columns, want) {
+		t.Errorf("got columns %q, want %q", got.Columns, want)
+	}
+	if got.Rows != 3 {
+		t.Errorf("got %d rows, want 3", got.Rows)
+	}
+	if got.Top != "Q5" || got.TopQRank != 900 {
+		t.Errorf("got top %s with QRank %d, want Q5 with QRank 900", got.Top, got.TopQRank)
+	}
+}
+
+func TestValidate_Problems(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  string
+	}{
+		{"Entity,QRank\nQ5,900\nQ72,800\n", ""},
+		{"", "missing CSV header"},
+		{"Item,Rank\nQ5,900\n", `line 1: bad header "Item,Rank", want "Entity,QRank"`},
+		{"Entity,QRank\nQ5,900,7\n", "line 2: got 3 columns, want 2"},
+		{"Entity,QRank\nfoo,900\n", `line 2: bad entity "foo"`},
+		{"Entity,QRank\nQ0,900\n", `line 2: bad entity "Q0"`},
+		{"Entity,QRank\nQ5,x\n", `line 2: bad QRank "x"`},
+		{"Entity,QRank\nQ5,-3\n", `line 2: bad QRank "-3"`},
+		{"Entity,QRank\nQ5,7\nQ72,800\n", "line 3: QRank 800 is larger than 7 on previous row"},
+		{"Entity,QRank,Percentile\nQ5,7,99\n", `line 1: bad header "Entity,QRank,Percentile", want "Entity,QRank"`},
+	} {
+		got, err := Validate(bytes.NewReader(gzipped(tc.input)))
+		if err != nil {
+			t.Errorf("Validate(%q) failed: %v", tc.input, err)
+			continue
+		}
+		if tc.want == "" {
+			if !got.OK() {
+				t.Errorf("Validate(%q) got problems %q, want none", tc.input, got.Problems)
+			}
+			continue
+		}
+		if !slices.Equal(got.Problems, []string{tc.want}) {
+			t.Errorf("Validate(%q) got problems %q, want %q", tc.input, got.Problems, tc.want)
+		}
+	}
+}
+
+func TestValidate_TooManyProblems(t *testing.T) {
+	var input strings.Builder
+	input.WriteString("Entity,QRank\n")
+	for i := 0; i < maxProblems+5; i++ {
+		input.WriteString("foo,1\n")
+	}
+	got, err := Validate(bytes.NewReader(gzipped(input.String())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Problems) != maxProblems || got.Omitted != 5 {
+		t.Errorf("got %d problems and %d omitted, want %d and 5",
+			len(got.Problems), got.Omitted, maxProblems)
+	}
+}
+
+func TestValidate_NotGzip(t *testing.T) {
+	if _, err := Validate(strings.NewReader("Entity,QRank\n")); err == nil {
+		t.Error("expected error for uncompressed input")
+	}
+}
+
+func TestCheckStats(t *testing.T) {
+	for _, tc := range []struct {
+		stats string
+		want  []string
+	}{
+		{testStats, nil},
+		{
+			`{"Samples":[["Q5",1,900],["Q1234",4,7]]}`,
+			[]string{"stats: last sample has rank 4, but file has 3 rows"},
+		},
+		{
+			`{"Samples":[["Q72",1,800],["Q1234",3,7]]}`,
+			[]string{"stats: top sample is Q72 with QRank 800, but file starts with Q5 with QRank 900"},
+		},
+		{`{"Samples":[]}`, []string{"stats: no samples"}},
+	} {
+		summary, err := Validate(bytes.NewReader(gzipped(testQRank)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := CheckStats(summary, strings.NewReader(tc.stats)); err != nil {
+			t.Errorf("CheckStats(%q) failed: %v", tc.stats, err)
+			continue
+		}
+		if !slices.Equal(summary.Problems, tc.want) {
+			t.Errorf("CheckStats(%q) got problems %q, want %q", tc.stats, summary.Problems, tc.want)
+		}
+	}
+}
+
+func TestCheckStats_BadSample(t *testing.T) {
+	summary := &Summary{Rows: 1, Top: "Q5", TopQRank: 900}
+	err := CheckStats(summary, strings.NewReader(`{"Samples":[["Q5","1",900]]}`))
+	if err == nil {
+		t.Error("expected error for bad sample")
+	}
+}
+
+func TestRun(t *testing.T) {
+	data := gzipped(testQRank)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/download/qrank.csv.gz":
+			w.Write(data)
+		case "/download/qrank-stats.json":
+			w.Write([]byte(testStats))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+
+	localPath := filepath.Join(t.TempDir(), "qrank.csv.gz")
+	if err := os.WriteFile(localPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256(data)
+	goodSHA256 := hex.EncodeToString(digest[:])
+	badSHA256 := strings.Repeat("0", 64)
+	for _, tc := range []struct {
+		qrank, stats, sha256 string
+		wantOK               bool
+	}{
+		{server.URL + "/download/qrank.csv.gz", server.URL + "/download/qrank-stats.json", goodSHA256, true},
+		{localPath, "", strings.ToUpper(goodSHA256), true},
+		{localPath, "", badSHA256, false},
+	} {
+		summary, err := run(server.Client(), tc.qrank, checks{stats: tc.stats, sha256: tc.sha256})
+		if err != nil {
+			t.Errorf("run(%q, %q) failed: %v", tc.qrank, tc.stats, err)
+			continue
+		}
+		if summary.OK() != tc.wantOK {
+			t.Errorf("run(%q, %q) got problems %q", tc.qrank, tc.stats, summary.Problems)
+		}
+	}
+
+	if _, err := run(server.Client(), server.URL+"/not-found", checks{}); err == nil {
+		t.Error("expected error for missing URL")
+	}
+}
+
+func TestRun_Signature(t *testing.T) {
+	data := gzipped(testQRank)
+	pub, key, err := minisign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, otherKey, err := minisign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(key *minisign.PrivateKey, data []byte) []byte {
+		sig, err := key.Sign(bytes.NewReader(data), "file:qrank-20240501.csv.gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		text, _ := sig.MarshalText()
+		return text
+	}
+
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	qrankPath := write("qrank.csv.gz", data)
+	write("qrank.csv.gz.minisig", sign(key, data))
+	badSig := write("bad.minisig", sign(key, gzipped("Entity,QRank\n")))
+	otherSig := write("other.minisig", sign(otherKey, data))
+	pubText, _ := pub.MarshalText()
+	pubPath := write("minisign.pub", pubText)
+
+	for _, tc := range []struct {
+		c      checks
+		wantOK bool
+	}{
+		{checks{publicKey: pub.String()}, true},
+		{checks{publicKey: pubPath}, true},
+		{checks{publicKey: pub.String(), signature: badSig}, false},
+		{checks{publicKey: pub.String(), signature: otherSig}, false},
+		{checks{publicKey: otherPub.String(), signature: otherSig}, true},
+	} {
+		summary, err := run(http.DefaultClient, qrankPath, tc.c)
+		if err != nil {
+			t.Errorf("%+v: %v", tc.c, err)
+			continue
+		}
+		if summary.OK() != tc.wantOK {
+			t.Errorf("%+v: got problems %q", tc.c, summary.Problems)
+		}
+		if tc.wantOK && !strings.Contains(summary.Signature, "file:qrank-20240501.csv.gz") {
+			t.Errorf("%+v: got Signature %q", tc.c, summary.Signature)
+		}
+	}
+
+	if _, err := run(http.DefaultClient, qrankPath, checks{publicKey: "garbage"}); err == nil {
+		t.Error("expected error for bad public key")
+	}
+	missing := filepath.Join(dir, "missing.minisig")
+	if _, err := run(http.DefaultClient, qrankPath, checks{publicKey: pub.String(), signature: missing}); err == nil {
+		t.Error("expected error for missing signature")
+	}
+}
+
+func TestPrintSummary(t *testing.T) {
+	var buf strings.Builder
+	printSummary(&buf, &Summary{
+		SHA256:   "abc",
+		Columns:  []string{"Entity", "QRank"},
+		Rows:     2,
+		Top:      "Q5",
+		TopQRank: 900,
+		Problems: []string{"line 3: bad entity \"foo\""},
+		Omitted:  7,
+	})
+	want := "SHA-256:  abc\n" +
+		"Columns:  Entity,QRank\n" +
+		"Rows:     2\n" +
+		"Top:      Q5, QRank 900\n" +
+		"\nProblems:\n" +
+		"  line 3: bad entity \"foo\"\n" +
+		"  … and 7 more\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
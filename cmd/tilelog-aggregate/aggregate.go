@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+
+	"github.com/lanrat/extsort"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/compress"
+	"github.com/brawer/wikidata-qrank/v2/pkg/osmviews"
+)
+
+// TileLogRegexp matches the names of daily tile logs, such as
+// "tiles-2024-05-01.txt.xz" on planet.openstreetmap.org, also when
+// they have been re-compressed in another format or uncompressed.
+var tileLogRegexp = regexp.MustCompile(`^tiles-\d{4}-\d\d-\d\d\.txt(\.[a-z0-9]+)?$`)
+
+// FindTileLogs returns the tile logs to aggregate, sorted by path.
+// Files get taken as they are, whatever their name; directories get
+// searched, non-recursively, for files whose name looks like a tile log.
+func findTileLogs(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+
+		entries, err := os.ReadDir(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() && tileLogRegexp.MatchString(e.Name()) {
+				paths = append(paths, filepath.Join(arg, e.Name()))
+			}
+		}
+	}
+	slices.Sort(paths)
+	return slices.Compact(paths), nil
+}
+
+// Aggregate sums up the impressions of each tile over all the tile logs
+// at paths, and writes the result to w. Tile logs may be uncompressed,
+// or compressed in any format that is known to internal/compress.
+func aggregate(ctx context.Context, paths []string, w io.Writer) error {
+	feed := func(ctx context.Context, out chan<- extsort.SortType) error {
+		for i, path := range paths {
+			if logger != nil {
+				logger.Printf("reading %s [%d/%d]", path, i+1, len(paths))
+			}
+			if err := readTileLog(ctx, path, out); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return osmviews.AggregateTileCounts(ctx, feed, w)
+}
+
+func readTileLog(ctx context.Context, path string, out chan<- extsort.SortType) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	reader, err := compress.NewReaderForName(path, file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	defer reader.Close()
+
+	return osmviews.ReadTileCounts(ctx, reader, out)
+}
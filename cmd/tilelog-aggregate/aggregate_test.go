@@ -0,0 +1,103 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/compress"
+)
+
+func TestFindTileLogs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"tiles-2024-05-02.txt.xz", "tiles-2024-05-01.txt", "index.html", "tiles-2024-05-03.txt.xz.tmp"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := filepath.Join(t.TempDir(), "march.log")
+	if err := os.WriteFile(other, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := findTileLogs([]string{dir, other, filepath.Join(dir, "tiles-2024-05-01.txt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(dir, "tiles-2024-05-01.txt"),
+		filepath.Join(dir, "tiles-2024-05-02.txt.xz"),
+		other,
+	}
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, err := findTileLogs([]string{filepath.Join(dir, "no-such-file")}); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestWriteOutput(t *testing.T) {
+	dir := t.TempDir()
+	writeTileLog(t, filepath.Join(dir, "tiles-2024-05-01.txt.gz"), "1/1/0 4\n0/0/0 9\n")
+	writeTileLog(t, filepath.Join(dir, "tiles-2024-05-02.txt.xz"), "1/1/0 6\n")
+	paths, err := findTileLogs([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "out", "tiles.txt.zst")
+	if err := writeOutput(context.Background(), paths, out); err == nil {
+		t.Error("expected error for missing output directory")
+	}
+
+	out = filepath.Join(dir, "tiles.txt.zst")
+	if err := writeOutput(context.Background(), paths, out); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := compress.NewReaderForName(out, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "0/0/0 9\n1/1/0 10\n"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := os.Stat(out + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file should have been removed, got %v", err)
+	}
+}
+
+func writeTileLog(t *testing.T, path string, content string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := compress.NewWriter(f, compress.CodecForName(path), compress.DefaultLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
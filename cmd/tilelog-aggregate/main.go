@@ -0,0 +1,87 @@
+// Tool for aggregating OpenStreetMap tile logs.
+//
+// The input is any number of daily tile logs, as published on
+// https://planet.openstreetmap.org/tile_logs/, or directories
+// containing them. The output has one line per tile with the sum
+// of its impressions over all input logs, sorted by tile in the
+// same order as the weekly caches of osmviews-builder.
+//
+//	tilelog-aggregate -o tiles-2024-q1.txt.zst /data/tile_logs/2024-0[1-3]*
+//
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/compress"
+)
+
+var logger *log.Logger
+
+func main() {
+	output := flag.String("o", "", "path to output file, compressed according to its extension such as .zst or .gz; standard output if empty")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] file-or-directory...\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Directories get searched for daily tile logs, such as tiles-2024-05-01.txt.xz.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	logger = log.New(os.Stderr, "", log.LstdFlags)
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	paths, err := findTileLogs(flag.Args())
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if len(paths) == 0 {
+		logger.Fatal("no tile logs found")
+	}
+
+	if err := writeOutput(context.Background(), paths, *output); err != nil {
+		logger.Fatal(err)
+	}
+}
+
+// WriteOutput aggregates tile logs into a file at path, or to standard
+// output if path is empty. The file gets written under a temporary
+// name and renamed when complete, so a failed run does not leave
+// a truncated file behind.
+func writeOutput(ctx context.Context, paths []string, path string) error {
+	if path == "" {
+		return aggregate(ctx, paths, os.Stdout)
+	}
+
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer file.Close()
+
+	writer, err := compress.NewWriter(file, compress.CodecForName(path), compress.BestLevel)
+	if err != nil {
+		return err
+	}
+	if err := aggregate(ctx, paths, writer); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,300 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// For grant reports, the tool maintainers need to know how often
+// our files get downloaded. However, Toolforge policy forbids storing
+// IP addresses. Therefore, we only keep aggregate counters per day.
+// To estimate the number of distinct clients, we hash the client
+// address and user agent with a random salt that is only kept in
+// memory and gets replaced every day, and feed the hashes into
+// a HyperLogLog sketch. Neither the salt nor the sketch ever get
+// written to disk, so the stored statistics cannot be linked back
+// to any client, not even by trying all possible IP addresses.
+type accessStats struct {
+	dir      string
+	now      func() time.Time
+	mutex    sync.Mutex
+	month    *monthlyAccessStats
+	today    *dailyAccessStats
+	salt     []byte
+	clients  *hyperLogLog
+	restored int64 // clients counted today before a restart
+}
+
+// MonthlyAccessStats is the content of the access-stats-YYYY-MM.json
+// file that gets written to the statistics directory.
+type monthlyAccessStats struct {
+	Month string              `json:"month"` // eg. "2024-03"
+	Days  []*dailyAccessStats `json:"days"`
+}
+
+type dailyAccessStats struct {
+	Date          string           `json:"date"` // eg. "2024-03-17", in UTC
+	Downloads     map[string]int64 `json:"downloads"`
+	Bytes         map[string]int64 `json:"bytes"`
+	UniqueClients int64            `json:"unique_clients"`
+}
+
+var (
+	dailyDownloadsDesc = prometheus.NewDesc(
+		"qrank_webserver_daily_downloads",
+		"Number of downloads today (UTC), by file.",
+		[]string{"file"}, nil)
+	dailyBytesDesc = prometheus.NewDesc(
+		"qrank_webserver_daily_download_bytes",
+		"Number of bytes served for downloads today (UTC), by file.",
+		[]string{"file"}, nil)
+	dailyClientsDesc = prometheus.NewDesc(
+		"qrank_webserver_daily_unique_clients",
+		"Estimated number of distinct clients that downloaded files today (UTC).",
+		nil, nil)
+)
+
+// NewAccessStats returns access statistics that get written to dir.
+// If a statistics file for the current month already exists, we continue
+// counting from its values, so a restart of the webserver does not lose
+// the counts of earlier days.
+func newAccessStats(dir string, now func() time.Time) (*accessStats, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &accessStats{dir: dir, now: now}
+	date := now().UTC()
+	month := date.Format("2006-01")
+	s.month = &monthlyAccessStats{Month: month, Days: make([]*dailyAccessStats, 0, 31)}
+	data, err := os.ReadFile(s.monthPath(month))
+	if err == nil {
+		if err := json.Unmarshal(data, s.month); err != nil {
+			return nil, fmt.Errorf("%s: %w", s.monthPath(month), err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if err := s.startDay(date.Format("2006-01-02")); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// RecordDownload counts a download of a file from our storage,
+// which has sent a number of bytes to the client.
+func (s *accessStats) recordDownload(req *http.Request, file string, bytes int64) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.maybeStartNewDay(); err != nil {
+		log.Printf("access stats: %v", err)
+	}
+	s.today.Downloads[file] += 1
+	s.today.Bytes[file] += bytes
+	s.clients.Add(s.clientHash(req))
+}
+
+// ClientHash returns a salted hash of the client address and user agent.
+// Because the webserver runs behind the Wikimedia proxy, the client
+// address comes from the X-Forwarded-For header.
+func (s *accessStats) clientHash(req *http.Request) uint64 {
+	client, _, _ := strings.Cut(req.Header.Get("X-Forwarded-For"), ",")
+	client = strings.TrimSpace(client)
+	if client == "" {
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			client = host
+		} else {
+			client = req.RemoteAddr
+		}
+	}
+
+	mac := hmac.New(sha256.New, s.salt)
+	mac.Write([]byte(client))
+	mac.Write([]byte{0})
+	mac.Write([]byte(req.UserAgent()))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// MaybeStartNewDay checks whether the day has changed since the last
+// download. If so, the statistics of the finished day get written out,
+// and we start counting the new day with a fresh salt.
+func (s *accessStats) maybeStartNewDay() error {
+	date := s.now().UTC()
+	day := date.Format("2006-01-02")
+	if day == s.today.Date {
+		return nil
+	}
+
+	s.today.UniqueClients = s.restored + s.clients.Estimate()
+	err := s.write()
+	if month := date.Format("2006-01"); month != s.month.Month {
+		s.month = &monthlyAccessStats{Month: month, Days: make([]*dailyAccessStats, 0, 31)}
+	}
+	if startErr := s.startDay(day); startErr != nil {
+		return startErr
+	}
+	return err
+}
+
+// StartDay starts counting a day, resuming its counts if the monthly
+// file already had them. The previous salt gets discarded, so
+// hashes from different days cannot be linked.
+func (s *accessStats) startDay(day string) error {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	s.salt = salt
+	s.clients = &hyperLogLog{}
+	s.restored = 0
+
+	for _, d := range s.month.Days {
+		if d.Date == day {
+			s.today = d
+			s.restored = d.UniqueClients
+			if d.Downloads == nil {
+				d.Downloads = make(map[string]int64, 4)
+			}
+			if d.Bytes == nil {
+				d.Bytes = make(map[string]int64, 4)
+			}
+			return nil
+		}
+	}
+
+	s.today = &dailyAccessStats{
+		Date:      day,
+		Downloads: make(map[string]int64, 4),
+		Bytes:     make(map[string]int64, 4),
+	}
+	s.month.Days = append(s.month.Days, s.today)
+	return nil
+}
+
+// Flush writes the statistics of the current month to disk.
+func (s *accessStats) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.maybeStartNewDay(); err != nil {
+		return err
+	}
+	s.today.UniqueClients = s.restored + s.clients.Estimate()
+	return s.write()
+}
+
+// Watch periodically writes the statistics to disk, so a crash
+// does not lose more than a few minutes of counts.
+func (s *accessStats) Watch(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				log.Printf("access stats: %v", err)
+			}
+		}
+	}
+}
+
+func (s *accessStats) monthPath(month string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("access-stats-%s.json", month))
+}
+
+// Write stores the monthly statistics, replacing the previous file
+// atomically so readers never see a partially written file.
+// The caller must hold the mutex.
+func (s *accessStats) write() error {
+	data, err := json.MarshalIndent(s.month, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := s.monthPath(s.month.Month)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Describe implements prometheus.Collector.
+func (s *accessStats) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dailyDownloadsDesc
+	ch <- dailyBytesDesc
+	ch <- dailyClientsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (s *accessStats) Collect(ch chan<- prometheus.Metric) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.maybeStartNewDay(); err != nil {
+		log.Printf("access stats: %v", err)
+	}
+
+	files := make([]string, 0, len(s.today.Downloads))
+	for file := range s.today.Downloads {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		ch <- prometheus.MustNewConstMetric(dailyDownloadsDesc, prometheus.GaugeValue, float64(s.today.Downloads[file]), file)
+		ch <- prometheus.MustNewConstMetric(dailyBytesDesc, prometheus.GaugeValue, float64(s.today.Bytes[file]), file)
+	}
+	clients := s.restored + s.clients.Estimate()
+	ch <- prometheus.MustNewConstMetric(dailyClientsDesc, prometheus.GaugeValue, float64(clients))
+}
+
+// CountingResponseWriter keeps track of the status code and
+// the number of body bytes sent to the client.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
@@ -0,0 +1,171 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestAccessStats(t *testing.T) {
+	dir := t.TempDir()
+	clock := newTestClock("2024-03-31T22:00:00Z")
+	access, err := newAccessStats(dir, clock.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := &Webserver{storage: testWebserver.storage, access: access}
+
+	download := func(method, client string, header http.Header) int {
+		req := httptest.NewRequest(method, "/download/c.txt", nil)
+		req.Header = header
+		req.Header.Set("X-Forwarded-For", client+", 172.16.0.1")
+		w := httptest.NewRecorder()
+		ws.HandleDownload(w, req)
+		return w.Result().StatusCode
+	}
+	download("GET", "192.0.2.1", http.Header{})
+	download("GET", "192.0.2.1", http.Header{})
+	download("GET", "192.0.2.2", http.Header{})
+	download("GET", "192.0.2.3", http.Header{"Range": {"bytes=2-4"}})
+	download("HEAD", "192.0.2.4", http.Header{})
+	if status := download("GET", "192.0.2.5", http.Header{"If-None-Match": {`"ETag-123"`}}); status != http.StatusNotModified {
+		t.Fatalf("got status %d, want %d", status, http.StatusNotModified)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(access)
+	if got, want := gatherForTest(t, reg), []string{
+		"qrank_webserver_daily_download_bytes{file=c.txt} 24",
+		"qrank_webserver_daily_downloads{file=c.txt} 4",
+		"qrank_webserver_daily_unique_clients 3",
+	}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got metrics %q, want %q", got, want)
+	}
+
+	// On the next day, which is also in the next month,
+	// the statistics for March should get written out.
+	clock.Advance(3 * time.Hour)
+	download("GET", "192.0.2.1", http.Header{})
+	march := readAccessStatsForTest(t, filepath.Join(dir, "access-stats-2024-03.json"))
+	if got, want := fmt.Sprint(march.Days[0]), "&{2024-03-31 map[c.txt:4] map[c.txt:24] 3}"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if err := access.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	april := readAccessStatsForTest(t, filepath.Join(dir, "access-stats-2024-04.json"))
+	if got, want := fmt.Sprint(april.Days[0]), "&{2024-04-01 map[c.txt:1] map[c.txt:7] 1}"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// The files must not contain any client addresses.
+	for _, month := range []string{"2024-03", "2024-04"} {
+		data, err := os.ReadFile(filepath.Join(dir, "access-stats-"+month+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "192.0.2") {
+			t.Errorf("access-stats-%s.json contains client address: %s", month, data)
+		}
+	}
+
+	// After a restart, we should continue counting from the stored values.
+	restarted, err := newAccessStats(dir, clock.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.access = restarted
+	download("GET", "192.0.2.9", http.Header{})
+	if err := restarted.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	april = readAccessStatsForTest(t, filepath.Join(dir, "access-stats-2024-04.json"))
+	if got, want := fmt.Sprint(april.Days[0]), "&{2024-04-01 map[c.txt:2] map[c.txt:14] 2}"; got != want {
+		t.Errorf("after restart: got %s, want %s", got, want)
+	}
+}
+
+func TestAccessStats_Nil(t *testing.T) {
+	var access *accessStats
+	req := httptest.NewRequest("GET", "/download/c.txt", nil)
+	access.recordDownload(req, "c.txt", 7) // should not crash
+}
+
+func TestAccessStats_BadFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "access-stats-2024-03.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	clock := newTestClock("2024-03-17T12:00:00Z")
+	if _, err := newAccessStats(dir, clock.Now); err == nil {
+		t.Error("expected error for malformed statistics file")
+	}
+}
+
+func readAccessStatsForTest(t *testing.T, path string) *monthlyAccessStats {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats monthlyAccessStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		t.Fatal(err)
+	}
+	return &stats
+}
+
+// GatherForTest returns the metrics of a registry in a compact form,
+// such as "name{label=value} 42".
+func gatherForTest(t *testing.T, reg *prometheus.Registry) []string {
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []string
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			var labels []string
+			for _, l := range m.GetLabel() {
+				labels = append(labels, l.GetName()+"="+l.GetValue())
+			}
+			name := f.GetName()
+			if len(labels) > 0 {
+				name += "{" + strings.Join(labels, ",") + "}"
+			}
+			result = append(result, fmt.Sprintf("%s %v", name, m.GetGauge().GetValue()))
+		}
+	}
+	return result
+}
+
+type testClock struct {
+	now time.Time
+}
+
+func newTestClock(s string) *testClock {
+	now, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return &testClock{now: now}
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
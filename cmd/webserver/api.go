@@ -0,0 +1,284 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ApiVersion is the version of our JSON API. Incompatible changes
+// go into a new version, served under a new path such as /api/v2,
+// while the old version keeps working for existing clients.
+const apiVersion = 1
+
+// ApiEndpoint defines one endpoint of our JSON API. The routing
+// layer and the OpenAPI document are both generated from apiEndpoints,
+// so the documentation cannot get out of sync with the handlers.
+type apiEndpoint struct {
+	path     string // relative to /api/v1, eg. "/top" or "/explain/{item}"
+	summary  string
+	params   []apiParam
+	response any // zero value of the response type, for its schema
+	handler  func(ws *Webserver, w http.ResponseWriter, req *http.Request)
+}
+
+// ApiParam defines a parameter of an API endpoint. Parameters whose
+// name appears in braces in the path of the endpoint are path segments,
+// all others are query parameters.
+type apiParam struct {
+	name        string
+	description string
+	schema      map[string]any
+}
+
+var apiEndpoints = []apiEndpoint{
+	{
+		path:    "/top",
+		summary: "Top-ranked Wikidata items",
+		params: []apiParam{
+			{"limit", "Number of items to return.", map[string]any{"type": "integer", "minimum": 1, "maximum": maxTopLimit, "default": 100}},
+			{"offset", "Number of top-ranked items to skip. Together with limit, at most the top 10000 items can be retrieved.", map[string]any{"type": "integer", "minimum": 0, "default": 0}},
+			{"wiki", "Take the ranking from a single wiki, such as de.wikipedia, instead of all Wikimedia projects.", map[string]any{"type": "string", "pattern": wikiParamRegexp.String()}},
+			{"class", "Only return items of a class, such as Q5 for humans, keeping their rank in the overall ranking. Cannot be combined with wiki.", map[string]any{"type": "string", "pattern": `^Q[1-9][0-9]*$`}},
+		},
+		response: topResponse{},
+		handler:  (*Webserver).HandleTop,
+	},
+	{
+		path:    "/explain/{item}",
+		summary: "How the rank of a Wikidata item was computed",
+		params: []apiParam{
+			{"item", "Wikidata item, such as Q42.", map[string]any{"type": "string", "pattern": `^Q[1-9][0-9]*$`}},
+		},
+		response: explainResponse{},
+		handler:  (*Webserver).HandleExplain,
+	},
+}
+
+// HandleAPI routes requests for /api/ to the handlers in apiEndpoints,
+// and serves the OpenAPI document at /api/openapi.json.
+func (ws *Webserver) HandleAPI(w http.ResponseWriter, req *http.Request) {
+	setCORSHeaders(w.Header())
+	if req.URL.Path == "/api/openapi.json" {
+		ws.HandleOpenAPI(w, req)
+		return
+	}
+
+	prefix := fmt.Sprintf("/api/v%d/", apiVersion)
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		http.Error(w, fmt.Sprintf("unknown API version, expected %s", prefix), http.StatusNotFound)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, prefix[:len(prefix)-1])
+	for _, e := range apiEndpoints {
+		if !matchAPIPath(e.path, path) {
+			continue
+		}
+		if req.Method != http.MethodOptions && !acceptsJSON(req.Header.Get("Accept")) {
+			http.Error(w, "this API only produces application/json", http.StatusNotAcceptable)
+			return
+		}
+		e.handler(ws, w, req)
+		return
+	}
+	http.NotFound(w, req)
+}
+
+// MatchAPIPath returns true if path matches the path of an endpoint,
+// where a segment in braces such as "{item}" matches any non-empty
+// segment.
+func matchAPIPath(pattern, path string) bool {
+	want, got := strings.Split(pattern, "/"), strings.Split(path, "/")
+	if len(want) != len(got) {
+		return false
+	}
+	for i, w := range want {
+		if strings.HasPrefix(w, "{") && strings.HasSuffix(w, "}") {
+			if got[i] == "" {
+				return false
+			}
+		} else if w != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// HandleOpenAPI serves the OpenAPI document for our JSON API,
+// from which client developers can generate typed bindings.
+func (ws *Webserver) HandleOpenAPI(w http.ResponseWriter, req *http.Request) {
+	if !checkMethod(w, req) {
+		return
+	}
+	if !acceptsJSON(req.Header.Get("Accept")) {
+		http.Error(w, "the OpenAPI document is only available as application/json", http.StatusNotAcceptable)
+		return
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(openAPIDocument()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeBody(w, req, "application/json", body.Bytes())
+}
+
+// AcceptsJSON returns true if a client with the given Accept header
+// can handle a response in application/json. A missing header means
+// that the client accepts anything, as per RFC 9110, section 12.5.1.
+func acceptsJSON(accept string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+	for _, r := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(r))
+		if err != nil {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		switch mediaType {
+		case "*/*", "application/*", "application/json":
+			return true
+		}
+	}
+	return false
+}
+
+// OpenAPIDocument returns an OpenAPI 3.0 description of apiEndpoints.
+// See https://spec.openapis.org/oas/v3.0.3 for the format.
+func openAPIDocument() map[string]any {
+	schemas := make(map[string]any, 4)
+	paths := make(map[string]any, len(apiEndpoints))
+	for _, e := range apiEndpoints {
+		params := make([]any, 0, len(e.params))
+		for _, p := range e.params {
+			inPath := strings.Contains(e.path, "{"+p.name+"}")
+			in := "query"
+			if inPath {
+				in = "path"
+			}
+			params = append(params, map[string]any{
+				"name":        p.name,
+				"in":          in,
+				"description": p.description,
+				"required":    inPath,
+				"schema":      p.schema,
+			})
+		}
+		operation, _, _ := strings.Cut(strings.TrimPrefix(e.path, "/"), "/")
+		paths[e.path] = map[string]any{
+			"get": map[string]any{
+				"summary":     e.summary,
+				"operationId": operation,
+				"parameters":  params,
+				"responses": map[string]any{
+					"200": map[string]any{
+						"description": "OK",
+						"content": map[string]any{
+							"application/json": map[string]any{
+								"schema": jsonSchema(reflect.TypeOf(e.response), schemas),
+							},
+						},
+					},
+					"304": map[string]any{"description": "Not modified since the ETag in If-None-Match"},
+					"400": map[string]any{"description": "Bad request parameters"},
+					"404": map[string]any{"description": "Ranking or item not found"},
+					"406": map[string]any{"description": "Client does not accept application/json"},
+					"503": map[string]any{"description": "Class index not ready"},
+				},
+			},
+		}
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "QRank API",
+			"description": "Ranking of Wikidata entities by aggregated pageviews on Wikimedia projects.",
+			"version":     fmt.Sprintf("%d.0.0", apiVersion),
+			"license": map[string]any{
+				"name": "CC0 1.0 (data)",
+				"url":  "https://creativecommons.org/publicdomain/zero/1.0/",
+			},
+		},
+		"servers":    []any{map[string]any{"url": fmt.Sprintf("/api/v%d", apiVersion)}},
+		"paths":      paths,
+		"components": map[string]any{"schemas": schemas},
+	}
+}
+
+// JSONSchema returns a schema for values of type t, as they get encoded
+// by encoding/json. Struct types get added to schemas under their name,
+// and the result refers to them.
+func jsonSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": jsonSchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": jsonSchema(t.Elem(), schemas)}
+	case reflect.Pointer:
+		return jsonSchema(t.Elem(), schemas)
+	case reflect.Struct:
+		name := schemaName(t)
+		ref := map[string]any{"$ref": "#/components/schemas/" + name}
+		if _, ok := schemas[name]; ok {
+			return ref
+		}
+		schemas[name] = nil // placeholder, in case the type is recursive
+		props := make(map[string]any, t.NumField())
+		required := make([]string, 0, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			field, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if field == "-" {
+				continue
+			}
+			if field == "" {
+				field = f.Name
+			}
+			props[field] = jsonSchema(f.Type, schemas)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, field)
+			}
+		}
+		schemas[name] = map[string]any{"type": "object", "properties": props, "required": required}
+		return ref
+	default:
+		return map[string]any{}
+	}
+}
+
+// SchemaName returns the name of a Go type in the OpenAPI document,
+// such as "TopResponse" for topResponse.
+func schemaName(t reflect.Type) string {
+	name := t.Name()
+	r, size := utf8.DecodeRuneInString(name)
+	return string(unicode.ToUpper(r)) + name[size:]
+}
@@ -0,0 +1,148 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWebserver_API(t *testing.T) {
+	ws := makeTestWebserver()
+	path := filepath.Join(t.TempDir(), "qrank.csv.gz")
+	if err := os.WriteFile(path, gzipped("Entity,QRank\nQ5,900\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ws.storage.files["qrank.csv.gz"] = &localFile{Path: path, ETag: "abc"}
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		accept string
+		want   int
+	}{
+		{"GET", "/api/v1/top", "", http.StatusOK},
+		{"GET", "/api/v1/top", "application/json", http.StatusOK},
+		{"GET", "/api/v1/top", "text/html, application/*;q=0.5", http.StatusOK},
+		{"GET", "/api/v1/top", "*/*", http.StatusOK},
+		{"GET", "/api/v1/top", "text/html", http.StatusNotAcceptable},
+		{"GET", "/api/v1/top", "application/json;q=0", http.StatusNotAcceptable},
+		{"OPTIONS", "/api/v1/top", "text/html", http.StatusNoContent},
+		{"GET", "/api/v2/top", "", http.StatusNotFound},
+		{"GET", "/api/top", "", http.StatusNotFound},
+		{"GET", "/api/v1/unknown", "", http.StatusNotFound},
+		{"GET", "/api/v1/explain/Q5", "text/html", http.StatusNotAcceptable},
+		{"GET", "/api/openapi.json", "", http.StatusOK},
+		{"GET", "/api/openapi.json", "text/html", http.StatusNotAcceptable},
+		{"POST", "/api/openapi.json", "", http.StatusMethodNotAllowed},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		w := httptest.NewRecorder()
+		ws.HandleAPI(w, req)
+		if got := w.Result().StatusCode; got != tc.want {
+			t.Errorf("%s %s, Accept: %q: got status %d, want %d",
+				tc.method, tc.path, tc.accept, got, tc.want)
+		}
+	}
+}
+
+func TestWebserver_OpenAPI(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/openapi.json", nil)
+	w := httptest.NewRecorder()
+	testWebserver.HandleAPI(w, req)
+	res := w.Result()
+	if got := res.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", got)
+	}
+
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+		Paths map[string]struct {
+			Get struct {
+				Parameters []struct {
+					Name string `json:"name"`
+					In   string `json:"in"`
+				} `json:"parameters"`
+				Responses map[string]any `json:"responses"`
+			} `json:"get"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != "3.0.3" {
+		t.Errorf("got openapi %q, want 3.0.3", doc.OpenAPI)
+	}
+	if len(doc.Servers) != 1 || doc.Servers[0].URL != "/api/v1" {
+		t.Errorf("got servers %v, want /api/v1", doc.Servers)
+	}
+
+	// Every endpoint in the routing table should be documented.
+	for _, e := range apiEndpoints {
+		if _, ok := doc.Paths[e.path]; !ok {
+			t.Errorf("path %s missing in OpenAPI document", e.path)
+		}
+	}
+	top := doc.Paths["/top"].Get
+	if got := fmt.Sprint(top.Parameters); got != "[{limit query} {offset query} {wiki query} {class query}]" {
+		t.Errorf("got parameters %s", got)
+	}
+	explain := doc.Paths["/explain/{item}"].Get
+	if got := fmt.Sprint(explain.Parameters); got != "[{item path}]" {
+		t.Errorf("got parameters %s", got)
+	}
+
+	got, _ := json.Marshal(map[string]any{
+		"TopItem":     doc.Components.Schemas["TopItem"],
+		"TopResponse": doc.Components.Schemas["TopResponse"],
+	})
+	want := `{"TopItem":{"properties":{"entity":{"type":"string"},"qrank":{"type":"integer"},"rank":{"type":"integer"}},"required":["rank","entity","qrank"],"type":"object"},` +
+		`"TopResponse":{"properties":{"class":{"type":"string"},"items":{"items":{"$ref":"#/components/schemas/TopItem"},"type":"array"},"limit":{"type":"integer"},"offset":{"type":"integer"},"wiki":{"type":"string"}},"required":["offset","limit","items"],"type":"object"}}`
+	if string(got) != want {
+		t.Errorf("got schemas %s, want %s", got, want)
+	}
+
+	// Maps have a schema for their values.
+	got, _ = json.Marshal(doc.Components.Schemas["ExplainResponse"])
+	if want := `"signals":{"additionalProperties":{"type":"integer"},"type":"object"}`; !strings.Contains(string(got), want) {
+		t.Errorf("got schema %s, want it to contain %s", got, want)
+	}
+}
+
+func TestAcceptsJSON(t *testing.T) {
+	for _, tc := range []struct {
+		accept string
+		want   bool
+	}{
+		{"", true},
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"application/*", true},
+		{"*/*;q=0.1", true},
+		{"text/html,application/xhtml+xml,*/*;q=0.8", true},
+		{"text/html", false},
+		{"application/xml", false},
+		{"application/json;q=0", false},
+		{"garbage;;", false},
+	} {
+		if got := acceptsJSON(tc.accept); got != tc.want {
+			t.Errorf("got %v for %q, want %v", got, tc.accept, tc.want)
+		}
+	}
+}
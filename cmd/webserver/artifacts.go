@@ -0,0 +1,321 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultRequiredArtifacts are the files that must be loaded
+// for the webserver to be ready. The item-signals stage of
+// qrank-builder does not publish qrank.csv.gz, so the webserver
+// should not wait for it; it still gets served if it is in storage.
+var defaultRequiredArtifacts = []string{"item_signals.csv.zst", "qrank-stats.json"}
+
+// ChecksummedArtifacts are the files whose SHA-256 digest gets published
+// in the stats file of their release. A new version only replaces the
+// live one after its download has been checked against that digest.
+// Since the builders upload the stats file last, a new version is not
+// loaded before the stats file of its release is in storage.
+var checksummedArtifacts = map[string]bool{
+	"qrank.csv.gz":         true,
+	"item_signals.csv.zst": true,
+}
+
+// ArtifactStatus tells how loading a file from storage went.
+type artifactStatus struct {
+	Version  string    // dated name of the live version, or empty
+	Loaded   time.Time // when the live version was loaded
+	Err      error     // why the last load failed, or nil
+	Failures int64     // number of failed loads since startup
+}
+
+var (
+	artifactLoadedDesc = prometheus.NewDesc(
+		"qrank_webserver_artifact_loaded",
+		"Whether a version of a file is live (1) or not (0), by file.",
+		[]string{"file"}, nil)
+	artifactLoadTimeDesc = prometheus.NewDesc(
+		"qrank_webserver_artifact_load_timestamp_seconds",
+		"Time when the live version of a file was loaded, by file.",
+		[]string{"file"}, nil)
+	artifactLoadErrorsDesc = prometheus.NewDesc(
+		"qrank_webserver_artifact_load_errors_total",
+		"Number of failed attempts to load a new version of a file, by file.",
+		[]string{"file"}, nil)
+	storageListErrorsDesc = prometheus.NewDesc(
+		"qrank_webserver_storage_list_errors_total",
+		"Number of failed attempts to list the files in storage.",
+		nil, nil)
+)
+
+// ReleaseDigests looks up the SHA-256 digests of published files in
+// the stats file of their release, such as qrank-stats-20240601.json
+// for item_signals-20240601.csv.zst. A stats file only gets fetched
+// when a new file of its release needs to be checked, and only once
+// per reload.
+type releaseDigests struct {
+	client  storageClient
+	stats   map[string]minio.ObjectInfo  // date → stats file
+	digests map[string]map[string]string // date → dated name → digest
+}
+
+func newReleaseDigests(client storageClient, stats map[string]minio.ObjectInfo) *releaseDigests {
+	return &releaseDigests{
+		client:  client,
+		stats:   stats,
+		digests: make(map[string]map[string]string, len(stats)),
+	}
+}
+
+// Lookup returns the expected SHA-256 digest for a stored object.
+// The result is empty if the object does not need to be checked,
+// or if its release is from before the stats files had digests.
+func (d *releaseDigests) lookup(ctx context.Context, obj minio.ObjectInfo) (string, error) {
+	filename, date, ok := parseStorageKey(obj.Key)
+	if !ok || !checksummedArtifacts[filename] {
+		return "", nil
+	}
+
+	digests, found := d.digests[date]
+	if !found {
+		statsObj, found := d.stats[date]
+		if !found {
+			return "", fmt.Errorf("public/qrank-stats-%s.json is not in storage yet", date)
+		}
+		var err error
+		digests, err = d.fetch(ctx, statsObj)
+		if err != nil {
+			return "", err
+		}
+		d.digests[date] = digests
+	}
+
+	return digests[strings.TrimPrefix(obj.Key, "public/")], nil
+}
+
+// Fetch reads the digests from a stats file in storage.
+func (d *releaseDigests) fetch(ctx context.Context, obj minio.ObjectInfo) (map[string]string, error) {
+	tmp, err := os.CreateTemp("", "qrank-stats-*.json")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := d.client.FGetObject(ctx, "qrank", obj.Key, tmp.Name(), minio.GetObjectOptions{}); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	var stats struct {
+		SHA256 map[string]string `json:"sha256"`
+	}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return nil, fmt.Errorf("%s: %w", obj.Key, err)
+	}
+	return stats.SHA256, nil
+}
+
+// VerifyDownload checks a freshly downloaded file before it may replace
+// the live version. If want is not empty, the file must have that
+// SHA-256 digest; stats files must be well-formed JSON.
+func verifyDownload(filename, path, want string) error {
+	if filename == "qrank-stats.json" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !json.Valid(data) {
+			return fmt.Errorf("not valid JSON")
+		}
+	}
+
+	if want == "" {
+		return nil
+	}
+	got, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(got, want) {
+		return fmt.Errorf("SHA-256 digest is %s, want %s", got, want)
+	}
+	return nil
+}
+
+// FileSHA256 returns the hex-encoded SHA-256 digest of a local file.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// RecordLoad remembers how loading a file went. If the load failed,
+// live is the previous version, which stays in service, or nil.
+func (s *Storage) recordLoad(filename string, live *localFile, err error, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.status == nil {
+		s.status = make(map[string]*artifactStatus, 10)
+	}
+	st, found := s.status[filename]
+	if !found {
+		st = &artifactStatus{}
+		s.status[filename] = st
+	}
+	if live != nil && live.DatedName != st.Version {
+		st.Version, st.Loaded = live.DatedName, now
+	}
+	st.Err = err
+	if err != nil {
+		st.Failures += 1
+	}
+}
+
+// RecordListError remembers whether listing the files in storage
+// failed, or nil if it worked.
+func (s *Storage) recordListError(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.listErr = err
+	if err != nil {
+		s.listErrors += 1
+	}
+}
+
+// Ready tells whether every required artifact has a live version.
+// The report has one line per required artifact, plus any load errors.
+func (s *Storage) Ready() (bool, string) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var report bytes.Buffer
+	ready := true
+	for _, name := range s.required {
+		st := s.status[name]
+		if _, live := s.files[name]; !live || st == nil || st.Version == "" {
+			ready = false
+			if st != nil && st.Err != nil {
+				fmt.Fprintf(&report, "%s: not loaded: %v\n", name, st.Err)
+			} else {
+				fmt.Fprintf(&report, "%s: not found in storage\n", name)
+			}
+			continue
+		}
+		fmt.Fprintf(&report, "%s: %s, loaded %s\n", name, st.Version, st.Loaded.UTC().Format(time.RFC3339))
+	}
+
+	failed := make([]string, 0, len(s.status))
+	for name, st := range s.status {
+		if st.Err != nil && st.Version != "" {
+			failed = append(failed, name)
+		}
+	}
+	slices.Sort(failed)
+	for _, name := range failed {
+		st := s.status[name]
+		fmt.Fprintf(&report, "%s: still serving %s: %v\n", name, st.Version, st.Err)
+	}
+	if s.listErr != nil {
+		fmt.Fprintf(&report, "storage: %v\n", s.listErr)
+	}
+	return ready, report.String()
+}
+
+// HandleReadyz tells load balancers and monitoring whether the webserver
+// has loaded all required files from storage. The status is 200 if it
+// has, and 503 if it has not; the body tells what got loaded, and why
+// loading has failed. A file that fails to load does not make the
+// webserver unready if a previous version is still in service.
+func (ws *Webserver) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r) {
+		return
+	}
+	ready, report := ws.storage.Ready()
+	if ready {
+		report = "ready\n" + report
+	} else {
+		report = "not ready\n" + report
+	}
+
+	// Unlike writeBody, we may need to send an error status.
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(report)))
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if r.Method != http.MethodHead {
+		w.Write([]byte(report))
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (s *Storage) Describe(ch chan<- *prometheus.Desc) {
+	ch <- artifactLoadedDesc
+	ch <- artifactLoadTimeDesc
+	ch <- artifactLoadErrorsDesc
+	ch <- storageListErrorsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (s *Storage) Collect(ch chan<- prometheus.Metric) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	names := make(map[string]bool, len(s.status)+len(s.required))
+	for name := range s.status {
+		names[name] = true
+	}
+	for _, name := range s.required {
+		names[name] = true
+	}
+
+	for name := range names {
+		st := s.status[name]
+		if st == nil {
+			st = &artifactStatus{}
+		}
+		loaded := 0.0
+		if st.Version != "" {
+			loaded = 1.0
+			ch <- prometheus.MustNewConstMetric(artifactLoadTimeDesc, prometheus.GaugeValue,
+				float64(st.Loaded.Unix()), name)
+		}
+		ch <- prometheus.MustNewConstMetric(artifactLoadedDesc, prometheus.GaugeValue, loaded, name)
+		ch <- prometheus.MustNewConstMetric(artifactLoadErrorsDesc, prometheus.CounterValue,
+			float64(st.Failures), name)
+	}
+	ch <- prometheus.MustNewConstMetric(storageListErrorsDesc, prometheus.CounterValue, float64(s.listErrors))
+}
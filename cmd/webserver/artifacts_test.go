@@ -0,0 +1,221 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// FakeObjectStore is a storageClient whose content can be changed
+// by tests, keyed by object name such as "public/qrank-20240601.csv.gz".
+type fakeObjectStore struct {
+	storageClient
+	objects   map[string][]byte
+	downloads []string
+}
+
+func (s *fakeObjectStore) ListObjects(ctx context.Context, bucketName string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	ch := make(chan minio.ObjectInfo, len(s.objects))
+	for key, content := range s.objects {
+		digest := sha256.Sum256(content)
+		_, ymd, _ := parseStorageKey(key)
+		date, _ := time.Parse("20060102", ymd)
+		ch <- minio.ObjectInfo{
+			Key:          key,
+			Size:         int64(len(content)),
+			ETag:         hex.EncodeToString(digest[:8]),
+			LastModified: date,
+		}
+	}
+	close(ch)
+	return ch
+}
+
+func (s *fakeObjectStore) FGetObject(ctx context.Context, bucketName, objectName, filePath string, opts minio.GetObjectOptions) error {
+	content, found := s.objects[objectName]
+	if !found {
+		return fmt.Errorf("object not found: %s/%s", bucketName, objectName)
+	}
+	s.downloads = append(s.downloads, objectName)
+	return os.WriteFile(filePath, content, 0644)
+}
+
+// Publish puts a release into the fake store, with a stats file
+// that tells the SHA-256 digest of the QRank file. If digest is empty,
+// the correct digest gets published.
+func (s *fakeObjectStore) publish(date, content, digest string) {
+	qrank := fmt.Sprintf("qrank-%s.csv.gz", date)
+	s.objects["public/"+qrank] = []byte(content)
+	if digest == "" {
+		sum := sha256.Sum256([]byte(content))
+		digest = hex.EncodeToString(sum[:])
+	}
+	s.objects[fmt.Sprintf("public/qrank-stats-%s.json", date)] = []byte(
+		fmt.Sprintf(`{"format_version":2,"sha256":{"%s":"%s"}}`, qrank, digest))
+}
+
+func newTestArtifactStorage(t *testing.T) (*Storage, *fakeObjectStore) {
+	client := &fakeObjectStore{objects: make(map[string][]byte, 10)}
+	storage := &Storage{
+		client:   client,
+		workdir:  t.TempDir(),
+		required: []string{"qrank.csv.gz", "qrank-stats.json"},
+		files:    make(map[string]*localFile, 10),
+	}
+	return storage, client
+}
+
+func TestStorage_ReloadVerifiesDigest(t *testing.T) {
+	ctx := context.Background()
+	storage, client := newTestArtifactStorage(t)
+	client.publish("20240601", "Entity,QRank\nQ1,7\n", "")
+	if err := storage.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := storage.Latest("qrank.csv.gz"); got != "qrank-20240601.csv.gz" {
+		t.Errorf("got %q, want qrank-20240601.csv.gz", got)
+	}
+	if ready, report := storage.Ready(); !ready {
+		t.Errorf("should be ready, got %q", report)
+	}
+
+	// A corrupt release must not replace the live one.
+	client.publish("20240608", "Entity,QRank\nQ1,8\n", strings.Repeat("0", 64))
+	err := storage.Reload(ctx)
+	if err == nil || !strings.Contains(err.Error(), "SHA-256 digest is") {
+		t.Errorf("got %v, want digest mismatch", err)
+	}
+	if got, _ := storage.Latest("qrank.csv.gz"); got != "qrank-20240601.csv.gz" {
+		t.Errorf("got %q, want qrank-20240601.csv.gz to stay live", got)
+	}
+	c, err := storage.Retrieve("qrank.csv.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(c)
+	c.Close()
+	if string(content) != "Entity,QRank\nQ1,7\n" {
+		t.Errorf("got %q, want content of old release", content)
+	}
+	ready, report := storage.Ready()
+	if !ready || !strings.Contains(report, "qrank.csv.gz: still serving qrank-20240601.csv.gz: cannot load public/qrank-20240608.csv.gz") {
+		t.Errorf("got ready=%v, report %q", ready, report)
+	}
+	if got := storage.status["qrank.csv.gz"].Failures; got != 1 {
+		t.Errorf("got %d failures, want 1", got)
+	}
+
+	// Once the release is fixed, it becomes live.
+	client.publish("20240608", "Entity,QRank\nQ1,8\n", "")
+	if err := storage.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := storage.Latest("qrank.csv.gz"); got != "qrank-20240608.csv.gz" {
+		t.Errorf("got %q, want qrank-20240608.csv.gz", got)
+	}
+	if _, report := storage.Ready(); strings.Contains(report, "still serving") {
+		t.Errorf("error should be cleared, got %q", report)
+	}
+}
+
+func TestStorage_ReloadWaitsForStats(t *testing.T) {
+	ctx := context.Background()
+	storage, client := newTestArtifactStorage(t)
+	client.publish("20240601", "old", "")
+	if err := storage.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	client.objects["public/qrank-20240608.csv.gz"] = []byte("new")
+	err := storage.Reload(ctx)
+	if err == nil || !strings.Contains(err.Error(), "qrank-stats-20240608.json is not in storage yet") {
+		t.Errorf("got %v, want error about missing stats file", err)
+	}
+	if slices.Contains(client.downloads, "public/qrank-20240608.csv.gz") {
+		t.Error("should not download files before their release is complete")
+	}
+	if got, _ := storage.Latest("qrank.csv.gz"); got != "qrank-20240601.csv.gz" {
+		t.Errorf("got %q, want qrank-20240601.csv.gz", got)
+	}
+}
+
+func TestStorage_ReloadLegacyStats(t *testing.T) {
+	// Releases from before the stats files had digests get loaded
+	// without checking them.
+	storage, client := newTestArtifactStorage(t)
+	client.objects["public/qrank-20220601.csv.gz"] = []byte("legacy")
+	client.objects["public/qrank-stats-20220601.json"] = []byte(`{"Median":2,"Samples":[]}`)
+	if err := storage.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ready, report := storage.Ready(); !ready {
+		t.Errorf("should be ready, got %q", report)
+	}
+}
+
+func TestWebserver_HandleReadyz(t *testing.T) {
+	storage, client := newTestArtifactStorage(t)
+	client.objects["public/qrank-stats-20240601.json"] = []byte("{broken")
+	if err := storage.Reload(context.Background()); err == nil {
+		t.Error("expected error for malformed stats file")
+	}
+
+	ws := &Webserver{storage: storage}
+	req := httptest.NewRequest("GET", "/readyz", nil)
+	w := httptest.NewRecorder()
+	ws.HandleReadyz(w, req)
+	res := w.Result()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+	want := "not ready\n" +
+		"qrank.csv.gz: not found in storage\n" +
+		"qrank-stats.json: not loaded: cannot load public/qrank-stats-20240601.json: not valid JSON\n"
+	if string(body) != want {
+		t.Errorf("got %q, want %q", body, want)
+	}
+	if got := res.Header.Get("Cache-Control"); got != "no-store" {
+		t.Errorf("got Cache-Control %q, want no-store", got)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(storage)
+	got := gatherForTest(t, reg)
+	for _, m := range []string{
+		"qrank_webserver_artifact_loaded{file=qrank-stats.json} 0",
+		"qrank_webserver_artifact_loaded{file=qrank.csv.gz} 0",
+	} {
+		if !slices.Contains(got, m) {
+			t.Errorf("metrics should contain %q, got %v", m, got)
+		}
+	}
+	if got := storage.status["qrank-stats.json"].Failures; got != 1 {
+		t.Errorf("got %d failures, want 1", got)
+	}
+
+	client.publish("20240601", "ok", "")
+	if err := storage.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	ws.HandleReadyz(w, req)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "ready\n") {
+		t.Errorf("got status %d, body %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,81 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+)
+
+// ChurnSummary holds the headline numbers of the churn report,
+// which gets published by the churn stage of qrank-builder.
+type churnSummary struct {
+	Version         string  `json:"version"`
+	PreviousVersion string  `json:"previous_version"`
+	TopItems        int64   `json:"top_items"`
+	KendallTau      float64 `json:"kendall_tau"`
+	Spearman        float64 `json:"spearman"`
+	MoveThreshold   int64   `json:"move_threshold"`
+	Moved           int64   `json:"moved"`
+}
+
+// ReadChurnSummary reads the live version of qrank-churn.json.
+// If storage has no churn report, the result is nil without error.
+// The report is only parsed again when its ETag has changed, so
+// the home page does not decode it for every visit.
+func (ws *Webserver) readChurnSummary() (*churnSummary, error) {
+	if _, found := ws.storage.Latest("qrank-churn.json"); !found {
+		return nil, nil
+	}
+	c, err := ws.storage.Retrieve("qrank-churn.json")
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	ws.churnMutex.Lock()
+	defer ws.churnMutex.Unlock()
+	if ws.churn != nil && c.ETag == ws.churn.etag {
+		return ws.churn.summary, ws.churn.err
+	}
+
+	data, err := io.ReadAll(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// A report that cannot be parsed stays broken until it gets
+	// replaced, so we remember the error along with the ETag.
+	cached := &cachedChurn{etag: c.ETag}
+	var summary churnSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		cached.err = fmt.Errorf("qrank-churn.json: %w", err)
+	} else {
+		cached.summary = &summary
+	}
+	ws.churn = cached
+	return cached.summary, cached.err
+}
+
+// CachedChurn is the churn summary that was last parsed,
+// together with the ETag of the report it was parsed from.
+type cachedChurn struct {
+	etag    string
+	summary *churnSummary // nil if the report could not be parsed
+	err     error
+}
+
+// HTML returns a paragraph about the stability
+// of the ranking, for showing on the home page.
+func (s *churnSummary) html() string {
+	return fmt.Sprintf(`
+<p>Between the releases of %s and %s, the ranks of the top %d items
+had a Kendall tau of %.3f and a Spearman correlation of %.3f;
+%d items moved by more than %d places. For details, see
+<a href="/download/qrank-churn.json">qrank-churn.json</a>.</p>
+`, html.EscapeString(s.PreviousVersion), html.EscapeString(s.Version),
+		s.TopItems, s.KendallTau, s.Spearman, s.Moved, s.MoveThreshold)
+}
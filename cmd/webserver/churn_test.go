@@ -0,0 +1,64 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWebserver_Churn(t *testing.T) {
+	ws := makeDatedTestWebserver(t)
+	home := func() string {
+		req := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		ws.HandleMain(w, req)
+		body, _ := io.ReadAll(w.Result().Body)
+		return string(body)
+	}
+
+	if body := home(); strings.Contains(body, "Kendall") {
+		t.Error("home page should not mention churn without a churn report")
+	}
+
+	path := filepath.Join(ws.storage.workdir, "qrank-churn.json")
+	report := `{"version":"2024-04-28","previous_version":"2024-04-21",` +
+		`"top_items":1000000,"common":987654,"kendall_tau":0.91234,` +
+		`"spearman":0.98765,"move_threshold":1000,"moved":4321}`
+	if err := os.WriteFile(path, []byte(report), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ws.storage.files["qrank-churn.json"] = &localFile{
+		Path:        path,
+		ContentType: "application/json",
+		ETag:        "ETag-789",
+		DatedName:   "qrank-churn-20240428.json",
+	}
+
+	body := home()
+	for _, want := range []string{"2024-04-21", "2024-04-28", "Kendall tau of 0.912", "Spearman correlation of 0.988", "4321 items moved"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("home page should contain %q", want)
+		}
+	}
+
+	// As long as the ETag stays the same, the parsed report
+	// gets served from the cache.
+	report = strings.Replace(report, `"moved":4321`, `"moved":1234`, 1)
+	if err := os.WriteFile(path, []byte(report), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if body := home(); !strings.Contains(body, "4321 items moved") {
+		t.Error("home page should show the cached churn report")
+	}
+
+	ws.storage.files["qrank-churn.json"].ETag = "ETag-790"
+	if body := home(); !strings.Contains(body, "1234 items moved") {
+		t.Error("home page should show the churn report with the new ETag")
+	}
+}
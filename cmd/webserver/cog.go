@@ -0,0 +1,122 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/cogtiff"
+)
+
+// CogReader decodes tiles from the Cloud-Optimized GeoTIFF produced
+// by osmviews-builder. The file contains one image per zoom level,
+// each tiled into 256×256 pixels of zlib-compressed float32 samples.
+// The TIFF tile at (x, y) in the image for zoom level z covers the same
+// area as the web map tile z/x/y.
+type cogReader struct {
+	levels map[int]*cogtiff.Image // zoom → image
+}
+
+const cogTileSize = 256
+
+func newCogReader(r io.ReaderAt) (*cogReader, error) {
+	tiff, err := cogtiff.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cogReader{levels: make(map[int]*cogtiff.Image, len(tiff.Images))}
+	for _, img := range tiff.Images {
+		if img.TileWidth != cogTileSize || img.TileHeight != cogTileSize {
+			return nil, fmt.Errorf("got %d×%d tiles, want %d×%d", img.TileWidth, img.TileHeight, cogTileSize, cogTileSize)
+		}
+		zoom := -1
+		for z := 0; z < 24; z++ {
+			if img.Width == cogTileSize<<z {
+				zoom = z
+				break
+			}
+		}
+		if zoom < 0 {
+			return nil, fmt.Errorf("unsupported image width %d", img.Width)
+		}
+		c.levels[zoom] = img
+	}
+
+	return c, nil
+}
+
+// ReadTile decodes the pixels of the tile at zoom/x/y. If the TIFF
+// has no such tile, the result is nil without an error.
+func (c *cogReader) ReadTile(zoom, x, y int) ([]float32, error) {
+	img, ok := c.levels[zoom]
+	if !ok || x < 0 || y < 0 || uint32(x) >= img.TilesAcross() || uint32(y) >= img.TilesDown() {
+		return nil, nil
+	}
+
+	pixels := make([]float32, cogTileSize*cogTileSize)
+	index := y*int(img.TilesAcross()) + x
+	if err := img.ReadTile(index, pixels); err != nil {
+		return nil, err
+	}
+	return pixels, nil
+}
+
+// TileStats summarizes the pixel values of a tile.
+type tileStats struct {
+	Zoom int     `json:"zoom"`
+	X    int     `json:"x"`
+	Y    int     `json:"y"`
+	Min  float32 `json:"min"`
+	Max  float32 `json:"max"`
+	Mean float64 `json:"mean"`
+}
+
+func newTileStats(zoom, x, y int, pixels []float32) *tileStats {
+	s := &tileStats{Zoom: zoom, X: x, Y: y}
+	if len(pixels) == 0 {
+		return s
+	}
+	s.Min, s.Max = pixels[0], pixels[0]
+	var sum float64
+	for _, p := range pixels {
+		if p < s.Min {
+			s.Min = p
+		}
+		if p > s.Max {
+			s.Max = p
+		}
+		sum += float64(p)
+	}
+	s.Mean = sum / float64(len(pixels))
+	return s
+}
+
+// RenderTile turns tile pixels into a grayscale image on a logarithmic
+// scale, stretched to the tile's own maximum. Brighter pixels have more
+// views. Because the contrast is per tile, brightness is not comparable
+// across tiles; the image is meant for a quick visual inspection.
+func renderTile(pixels []float32) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, cogTileSize, cogTileSize))
+	var max float32
+	for _, p := range pixels {
+		if p > max {
+			max = p
+		}
+	}
+	if max <= 0 {
+		return img
+	}
+	scale := 255.0 / math.Log1p(float64(max))
+	for i, p := range pixels {
+		if p > 0 {
+			img.SetGray(i%cogTileSize, i/cogTileSize, color.Gray{uint8(math.Log1p(float64(p)) * scale)})
+		}
+	}
+	return img
+}
@@ -0,0 +1,226 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCogReader(t *testing.T) {
+	cog, err := newCogReader(bytes.NewReader(makeTestCOG()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		zoom, x, y int
+		want       float32
+	}{
+		{0, 0, 0, 10},
+		{1, 0, 0, 1},
+		{1, 1, 0, 2},
+		{1, 0, 1, 3},
+		{1, 1, 1, 4},
+	} {
+		pixels, err := cog.ReadTile(tc.zoom, tc.x, tc.y)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pixels) != 256*256 || pixels[0] != tc.want || pixels[len(pixels)-1] != tc.want {
+			t.Errorf("tile %d/%d/%d: got wrong pixels", tc.zoom, tc.x, tc.y)
+		}
+	}
+
+	for _, tc := range [][3]int{{0, 1, 0}, {1, 2, 0}, {1, 0, -1}, {2, 0, 0}} {
+		pixels, err := cog.ReadTile(tc[0], tc[1], tc[2])
+		if pixels != nil || err != nil {
+			t.Errorf("tile %v: want nil, nil; got %v, %v", tc, pixels, err)
+		}
+	}
+}
+
+func TestCogReader_BadInput(t *testing.T) {
+	for _, data := range [][]byte{
+		[]byte{},
+		[]byte("GIF89a"),
+		[]byte{'I', 'I', 42, 0, 0xff, 0xff, 0, 0},
+		makeTestCOG()[0:100],
+	} {
+		if _, err := newCogReader(bytes.NewReader(data)); err == nil {
+			t.Errorf("expected error for %q", data)
+		}
+	}
+}
+
+func TestWebserver_COG(t *testing.T) {
+	ws := makeTestWebserver()
+	path := filepath.Join(t.TempDir(), "osmviews.tiff")
+	if err := os.WriteFile(path, makeTestCOG(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lastmod, _ := time.Parse(time.RFC3339, "2024-01-02T03:04:05Z")
+	ws.storage.files["osmviews.tiff"] = &localFile{
+		Path:         path,
+		ContentType:  "image/tiff",
+		ETag:         "TIFF-ETag",
+		LastModified: lastmod,
+	}
+
+	get := func(path string) *http.Response {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		ws.HandleCOG(w, req)
+		return w.Result()
+	}
+
+	res := get("/cog/1/1/0.json")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	var stats tileStats
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	want := tileStats{Zoom: 1, X: 1, Y: 0, Min: 2, Max: 2, Mean: 2}
+	if stats != want {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+	if got, want := res.Header.Get("ETag"), `"TIFF-ETag-1-1-0-json"`; got != want {
+		t.Errorf("got ETag %s, want %s", got, want)
+	}
+
+	res = get("/cog/0/0/0.png")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	if got := res.Header.Get("Content-Type"); got != "image/png" {
+		t.Errorf("got Content-Type %s, want image/png", got)
+	}
+	img, err := png.Decode(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 256 || b.Dy() != 256 {
+		t.Errorf("got image bounds %v, want 256×256", b)
+	}
+
+	for _, path := range []string{"/cog/3/0/0.json", "/cog/1/0/0.gif", "/cog/foo"} {
+		if res := get(path); res.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", path, res.StatusCode, http.StatusNotFound)
+		}
+	}
+}
+
+func TestRenderTile(t *testing.T) {
+	pixels := make([]float32, 256*256)
+	pixels[1] = 1
+	pixels[2] = 1000
+	img := renderTile(pixels)
+	if img.GrayAt(0, 0).Y != 0 || img.GrayAt(2, 0).Y != 255 {
+		t.Errorf("got %d and %d, want 0 and 255", img.GrayAt(0, 0).Y, img.GrayAt(2, 0).Y)
+	}
+	if y := img.GrayAt(1, 0).Y; y == 0 || y == 255 {
+		t.Errorf("got %d, want value between 0 and 255", y)
+	}
+}
+
+// MakeTestCOG returns a small GeoTIFF in the same layout as the files
+// produced by osmviews-builder, with images for zoom levels 1 and 0.
+// At zoom 1, all pixels of tile x/y have value 1 + y*2 + x;
+// at zoom 0, all pixels have value 10.
+func makeTestCOG() []byte {
+	type level struct {
+		zoom  int
+		tiles [][]float32
+	}
+	uniform := func(v float32) []float32 {
+		p := make([]float32, 256*256)
+		for i := range p {
+			p[i] = v
+		}
+		return p
+	}
+	levels := []level{
+		{1, [][]float32{uniform(1), uniform(2), uniform(3), uniform(4)}},
+		{0, [][]float32{uniform(10)}},
+	}
+
+	const numEntries = 9
+	const ifdSize = 2 + numEntries*12 + 4
+	pos := uint32(8 + len(levels)*ifdSize)
+	arrayPos := make([]uint32, len(levels))
+	for i, lev := range levels {
+		if len(lev.tiles) > 1 {
+			arrayPos[i] = pos
+			pos += uint32(len(lev.tiles) * 8)
+		}
+	}
+
+	var data bytes.Buffer
+	offsets := make([][]uint32, len(levels))
+	sizes := make([][]uint32, len(levels))
+	for i, lev := range levels {
+		for _, tile := range lev.tiles {
+			var compressed bytes.Buffer
+			w := zlib.NewWriter(&compressed)
+			binary.Write(w, binary.LittleEndian, tile)
+			w.Close()
+			offsets[i] = append(offsets[i], pos+uint32(data.Len()))
+			sizes[i] = append(sizes[i], uint32(compressed.Len()))
+			data.Write(compressed.Bytes())
+		}
+	}
+
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	buf.Write([]byte{'I', 'I', 42, 0})
+	binary.Write(&buf, le, uint32(8))
+	for i, lev := range levels {
+		entry := func(tag, typ uint16, count, value uint32) {
+			binary.Write(&buf, le, tag)
+			binary.Write(&buf, le, typ)
+			binary.Write(&buf, le, count)
+			binary.Write(&buf, le, value)
+		}
+		width := uint32(256 << lev.zoom)
+		binary.Write(&buf, le, uint16(numEntries))
+		entry(256, 4, 1, width)
+		entry(257, 4, 1, width)
+		entry(258, 3, 1, 32)
+		entry(259, 3, 1, 8)
+		entry(322, 4, 1, 256)
+		entry(323, 4, 1, 256)
+		if n := uint32(len(lev.tiles)); n > 1 {
+			entry(324, 4, n, arrayPos[i])
+			entry(325, 4, n, arrayPos[i]+n*4)
+		} else {
+			entry(324, 4, 1, offsets[i][0])
+			entry(325, 4, 1, sizes[i][0])
+		}
+		entry(339, 3, 1, 3)
+		next := uint32(0)
+		if i+1 < len(levels) {
+			next = uint32(8 + (i+1)*ifdSize)
+		}
+		binary.Write(&buf, le, next)
+	}
+	for i, lev := range levels {
+		if len(lev.tiles) > 1 {
+			binary.Write(&buf, le, offsets[i])
+			binary.Write(&buf, le, sizes[i])
+		}
+	}
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
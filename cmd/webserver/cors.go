@@ -0,0 +1,65 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Headers for Cross-Origin Resource Sharing. Browser-based applications,
+// such as web maps or notebooks, fetch our downloads and call our API
+// directly from other origins, so every route allows any origin.
+// See https://fetch.spec.whatwg.org/#http-cors-protocol for the protocol.
+const (
+	corsAllowMethods  = "GET, HEAD, OPTIONS"
+	corsAllowHeaders  = "ETag, If-Match, If-None-Match, If-Modified-Since, If-Range, Range"
+	corsExposeHeaders = "Accept-Ranges, Content-Range, ETag, X-QRank-Data-Date"
+	corsMaxAge        = "86400" // 1 day
+)
+
+// SetCORSHeaders sets the headers that let browsers hand a response
+// to scripts from other origins. Handlers call this before looking up
+// anything, so that also error responses can be read by such scripts.
+func setCORSHeaders(h http.Header) {
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+}
+
+// CheckMethod answers CORS pre-flight requests, and rejects any methods
+// other than GET and HEAD. It returns true if the caller should go on
+// serving the request.
+func checkMethod(w http.ResponseWriter, req *http.Request) bool {
+	h := w.Header()
+	setCORSHeaders(h)
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+
+	case http.MethodOptions: // CORS pre-flight
+		h.Set("Allow", corsAllowMethods)
+		h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+		h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		h.Set("Access-Control-Max-Age", corsMaxAge)
+		w.WriteHeader(http.StatusNoContent)
+		return false
+
+	default:
+		h.Set("Allow", corsAllowMethods)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return false
+	}
+}
+
+// WriteBody sends a response body that has been generated in memory.
+// For HEAD requests, only the headers get sent, with the same
+// Content-Length as the body that would have been sent for GET.
+func writeBody(w http.ResponseWriter, req *http.Request, contentType string, body []byte) {
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	if req.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/minisign"
+)
+
+func TestWebserver_CORS(t *testing.T) {
+	pub, _, err := minisign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := makeDatedTestWebserver(t)
+	ws.signingKey = pub
+	path := filepath.Join(t.TempDir(), "qrank-de.wikipedia.csv.gz")
+	if err := os.WriteFile(path, gzipped("Entity,QRank\nQ5,900\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ws.storage.files["qrank-de.wikipedia.csv.gz"] = &localFile{Path: path, ETag: "abc"}
+
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		path    string
+		status  int // of GET and HEAD requests
+	}{
+		{ws.HandleMain, "/", http.StatusOK},
+		{ws.HandleRobotsTxt, "/robots.txt", http.StatusOK},
+		{ws.HandleSigningKey, "/minisign.pub", http.StatusOK},
+		{ws.HandleDownload, "/download/qrank-20240601.csv.gz", http.StatusOK},
+		{ws.HandleLatest, "/latest/qrank.csv.gz", http.StatusFound},
+		{ws.HandleCOG, "/cog/0/0/0.png", http.StatusNotFound},
+		{ws.HandleAPI, "/api/openapi.json", http.StatusOK},
+		{ws.HandleAPI, "/api/v1/top?wiki=de.wikipedia", http.StatusOK},
+	} {
+		serve := func(method string) (*http.Response, []byte) {
+			req := httptest.NewRequest(method, tc.path, nil)
+			req.Header.Set("Origin", "https://observablehq.com")
+			w := httptest.NewRecorder()
+			tc.handler(w, req)
+			res := w.Result()
+			body, _ := io.ReadAll(res.Body)
+			return res, body
+		}
+
+		res, body := serve("OPTIONS")
+		if res.StatusCode != http.StatusNoContent || len(body) != 0 {
+			t.Errorf("OPTIONS %s: got status %d, body %q", tc.path, res.StatusCode, body)
+		}
+		for key, want := range map[string]string{
+			"Access-Control-Allow-Origin":   "*",
+			"Access-Control-Allow-Methods":  "GET, HEAD, OPTIONS",
+			"Access-Control-Allow-Headers":  corsAllowHeaders,
+			"Access-Control-Expose-Headers": corsExposeHeaders,
+			"Access-Control-Max-Age":        "86400",
+		} {
+			if got := res.Header.Get(key); got != want {
+				t.Errorf("OPTIONS %s: got %s: %q, want %q", tc.path, key, got, want)
+			}
+		}
+
+		get, getBody := serve("GET")
+		head, headBody := serve("HEAD")
+		for method, res := range map[string]*http.Response{"GET": get, "HEAD": head} {
+			if res.StatusCode != tc.status {
+				t.Errorf("%s %s: got status %d, want %d", method, tc.path, res.StatusCode, tc.status)
+			}
+			if got := res.Header.Get("Access-Control-Allow-Origin"); got != "*" {
+				t.Errorf("%s %s: got Access-Control-Allow-Origin %q, want *", method, tc.path, got)
+			}
+		}
+		if tc.status != http.StatusNotFound && len(headBody) != 0 {
+			t.Errorf("HEAD %s: got body %q, want none", tc.path, headBody)
+		}
+		if tc.status == http.StatusOK {
+			want := strconv.Itoa(len(getBody))
+			if got := head.Header.Get("Content-Length"); got != want {
+				t.Errorf("HEAD %s: got Content-Length %q, want %q", tc.path, got, want)
+			}
+		}
+
+		res, _ = serve("DELETE")
+		if res.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("DELETE %s: got status %d, want %d", tc.path, res.StatusCode, http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,463 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// ExplainResponse is the response of /api/v1/explain/{item}.
+type explainResponse struct {
+	Entity      string `json:"entity"`         // eg. "Q42"
+	Version     string `json:"version"`        // release, eg. "2024-06-01"
+	Rank        int64  `json:"rank,omitempty"` // 1 for the top item
+	RankedItems int64  `json:"ranked_items"`
+	Percentile  int64  `json:"percentile,omitempty"` // percentage of items that rank lower
+	Bucket      int64  `json:"bucket,omitempty"`     // logarithmic, 10 for the top item
+	QRank       int64  `json:"qrank"`                // pageviews_52w, after weights and caps
+	Class       string `json:"class,omitempty"`
+	MergedInto  string `json:"merged_into,omitempty"`
+
+	// Signals are the raw item signals, keyed by column name
+	// in the schema of the release, such as "sitelinks".
+	Signals map[string]int64 `json:"signals"`
+
+	// Formula tells how QRank was computed from the pageviews.
+	Formula explainFormula `json:"formula"`
+
+	// PageviewsBeforeDemotion is the QRank that a disambiguation item
+	// would have had without being demoted, up to rounding.
+	PageviewsBeforeDemotion int64 `json:"pageviews_before_demotion,omitempty"`
+
+	// PageviewsBeforeCapping is the sum of the weighted pageviews
+	// of the item's pages, before capping its weekly pageviews,
+	// if the wiki share report of the release records it.
+	PageviewsBeforeCapping int64 `json:"pageviews_before_capping,omitempty"`
+
+	// TopWikis are the wikis that contributed most pageviews,
+	// if the release has a wiki share report that covers the item.
+	TopWikis []explainWiki `json:"top_wikis,omitempty"`
+}
+
+// ExplainFormula is the configuration of the formula for computing
+// QRank, as recorded by qrank-builder in the provenance of a release.
+type explainFormula struct {
+	Version                int                `json:"version"` // zero if not recorded
+	Weights                map[string]float64 `json:"weights,omitempty"`
+	MaxWeekMultiple        float64            `json:"max_week_multiple,omitempty"`
+	Disambiguation         string             `json:"disambiguation,omitempty"`
+	DisambiguationDemotion float64            `json:"disambiguation_demotion,omitempty"`
+	PageviewWeeks          []string           `json:"pageview_weeks,omitempty"`
+}
+
+// ExplainWiki is the contribution of one wiki to the QRank of an item.
+// Views and Weighted are zero for wiki share reports that predate them.
+type explainWiki struct {
+	Wiki      string  `json:"wiki"`               // eg. "rm.wikipedia"
+	Share     float64 `json:"share"`              // fraction of the item's pageviews
+	Views     int64   `json:"views,omitempty"`    // raw pageviews of the item's pages
+	Weighted  int64   `json:"weighted,omitempty"` // same, after weighting by project
+	Pageviews int64   `json:"pageviews"`          // after capping, before demotion
+}
+
+// ExplainWikis are the top wikis of an item in the wiki share report,
+// together with the weighted pageviews of the item before capping.
+type explainWikis struct {
+	weighted int64 // zero if not recorded
+	top      []explainWiki
+}
+
+// ExplainDB is an open SQLite database of a release, as published
+// by the sqlite stage of qrank-builder, together with the wiki share
+// report of the same release.
+type explainDB struct {
+	etag        string // of qrank.sqlite and the wiki share report
+	db          *sql.DB
+	version     string // eg. "2024-06-01"
+	formula     explainFormula
+	rankedItems int64
+	wikiShares  map[string]explainWikis // "Q42" → top wikis
+
+	// Guarded by Webserver.explainMutex. When storage has a new
+	// release, the database becomes stale, but it only gets closed
+	// once the requests that are still using it have finished.
+	refs  int
+	stale bool
+}
+
+// HandleExplain serves a JSON document that tells how the rank of an
+// item was computed, for example /api/v1/explain/Q42. The signals
+// come from the SQLite database of the latest release, whose metadata
+// also records the formula; the top wikis come from the wiki share
+// report of the same release, if it covers the item.
+func (ws *Webserver) HandleExplain(w http.ResponseWriter, req *http.Request) {
+	if !checkMethod(w, req) {
+		return
+	}
+
+	id, ok := parseItemID(strings.TrimPrefix(req.URL.Path, "/api/v1/explain/"))
+	if !ok {
+		http.Error(w, "bad item, expected an item ID such as Q42", http.StatusBadRequest)
+		return
+	}
+	entity := "Q" + strconv.FormatInt(id, 10)
+
+	c, err := ws.storage.Retrieve("qrank.sqlite")
+	if err != nil {
+		http.Error(w, "explaining ranks needs qrank.sqlite, which is not in storage", http.StatusNotFound)
+		return
+	}
+	defer c.Close()
+
+	db, err := ws.explainDB(c)
+	if err != nil {
+		log.Printf("cannot open qrank.sqlite: %v", err)
+		http.Error(w, "cannot open database", http.StatusInternalServerError)
+		return
+	}
+	defer ws.releaseExplainDB(db)
+
+	resp, err := db.explain(entity)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, fmt.Sprintf("%s not found in release %s", entity, db.version), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("cannot explain %s: %v", entity, err)
+		http.Error(w, "cannot read database", http.StatusInternalServerError)
+		return
+	}
+
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// As per https://tools.ietf.org/html/rfc7232, ETag must have quotes.
+	h := w.Header()
+	h.Set("ETag", fmt.Sprintf(`"%s-explain-%s"`, db.etag, entity))
+	h.Set("Content-Type", "application/json")
+	if ws.freshness != nil {
+		ws.freshness.SetHeader(h)
+	}
+	http.ServeContent(w, req, "", c.LastModified, bytes.NewReader(body.Bytes()))
+}
+
+// ExplainDB returns the database for the live version of qrank.sqlite.
+// The database stays open until storage has a file with a different
+// ETag, or a different wiki share report, and no request is using it
+// anymore. The caller must call releaseExplainDB() when done.
+func (ws *Webserver) explainDB(c *Content) (*explainDB, error) {
+	shares, sharesName := ws.retrieveWikiShares()
+	if shares != nil {
+		defer shares.Close()
+	}
+	etag := c.ETag
+	if shares != nil {
+		etag += "+" + shares.ETag
+	}
+
+	ws.explainMutex.Lock()
+	defer ws.explainMutex.Unlock()
+
+	if ws.explain != nil && ws.explain.etag == etag {
+		ws.explain.refs++
+		return ws.explain, nil
+	}
+
+	db, err := openExplainDB(c.f.Name())
+	if err != nil {
+		return nil, err
+	}
+	db.etag = etag
+	if shares != nil {
+		db.wikiShares, err = readExplainWikiShares(shares)
+		if err != nil {
+			db.db.Close()
+			return nil, fmt.Errorf("%s: %w", sharesName, err)
+		}
+	}
+
+	if old := ws.explain; old != nil {
+		old.stale = true
+		if old.refs == 0 {
+			old.db.Close()
+		}
+	}
+	db.refs = 1
+	ws.explain = db
+	return db, nil
+}
+
+// ReleaseExplainDB tells that a request has finished using a database
+// returned by explainDB(). The last request to release a stale database
+// closes it.
+func (ws *Webserver) releaseExplainDB(db *explainDB) {
+	ws.explainMutex.Lock()
+	defer ws.explainMutex.Unlock()
+
+	db.refs--
+	if db.stale && db.refs == 0 {
+		db.db.Close()
+	}
+}
+
+// RetrieveWikiShares opens the wiki share report of the same release
+// as the live qrank.sqlite, returning nil if there is no such report.
+func (ws *Webserver) retrieveWikiShares() (*Content, string) {
+	sqliteName, found := ws.storage.Latest("qrank.sqlite")
+	if !found {
+		return nil, ""
+	}
+	name := "qrank-wiki-shares-" + strings.TrimPrefix(sqliteName, "qrank-")
+	name = strings.TrimSuffix(name, ".sqlite") + ".csv.gz"
+	shares, err := ws.storage.Retrieve(name)
+	if err != nil {
+		return nil, ""
+	}
+	return shares, name
+}
+
+// OpenExplainDB opens a SQLite database of a release for reading,
+// and reads its metadata.
+func openExplainDB(path string) (*explainDB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+
+	e := &explainDB{db: db}
+	if err := e.readMetadata(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+// ReadMetadata reads the version and formula of the release from
+// the metadata table, and counts the ranked items.
+func (e *explainDB) readMetadata() error {
+	rows, err := e.db.Query("SELECT key, value FROM metadata")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		switch key {
+		case "version":
+			e.version = value
+		case "provenance":
+			// Same field names as the provenance JSON of qrank-builder.
+			var p struct {
+				FormulaVersion         int                `json:"formula_version"`
+				Weights                map[string]float64 `json:"weights"`
+				MaxWeekMultiple        float64            `json:"max_week_multiple"`
+				Disambiguation         string             `json:"disambiguation"`
+				DisambiguationDemotion float64            `json:"disambiguation_demotion"`
+				PageviewWeeks          []string           `json:"pageview_weeks"`
+			}
+			if err := json.Unmarshal([]byte(value), &p); err != nil {
+				return fmt.Errorf("bad provenance: %w", err)
+			}
+			e.formula = explainFormula{
+				Version:                p.FormulaVersion,
+				Weights:                p.Weights,
+				MaxWeekMultiple:        p.MaxWeekMultiple,
+				Disambiguation:         p.Disambiguation,
+				DisambiguationDemotion: p.DisambiguationDemotion,
+				PageviewWeeks:          p.PageviewWeeks,
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	row := e.db.QueryRow("SELECT COALESCE(MAX(rank), 0) FROM item_signals")
+	return row.Scan(&e.rankedItems)
+}
+
+// Explain looks up the signals of an item, such as "Q42". If the item
+// is not in the database, the error is sql.ErrNoRows.
+func (e *explainDB) explain(entity string) (*explainResponse, error) {
+	rows, err := e.db.Query("SELECT * FROM item_signals WHERE item = ?", entity)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]any, len(columns))
+	ptrs := make([]any, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return nil, err
+	}
+
+	resp := &explainResponse{
+		Entity:      entity,
+		Version:     e.version,
+		RankedItems: e.rankedItems,
+		Signals:     make(map[string]int64, len(columns)),
+		Formula:     e.formula,
+	}
+	for i, col := range columns {
+		switch v := values[i].(type) {
+		case int64:
+			switch col {
+			case "id":
+			case "rank":
+				resp.Rank = v
+			case "percentile":
+				resp.Percentile = v
+			case "bucket":
+				resp.Bucket = v
+			default:
+				resp.Signals[col] = v
+			}
+		case string:
+			switch col {
+			case "class":
+				resp.Class = v
+			case "merged_into":
+				resp.MergedInto = v
+			}
+		}
+	}
+	resp.QRank = resp.Signals["pageviews_52w"]
+
+	// Demotion scales the pageviews of disambiguation items, so we
+	// undo it for telling how many views came from each wiki.
+	undemoted := resp.QRank
+	if resp.Signals["disambiguation"] > 0 && e.formula.DisambiguationDemotion > 0 {
+		undemoted = int64(math.Round(float64(resp.QRank) / e.formula.DisambiguationDemotion))
+		resp.PageviewsBeforeDemotion = undemoted
+	}
+	// Capping scales all pageviews of an item by the same factor,
+	// so each wiki keeps its share of the weighted pageviews.
+	wikis := e.wikiShares[entity]
+	resp.PageviewsBeforeCapping = wikis.weighted
+	for _, s := range wikis.top {
+		if wikis.weighted > 0 && s.Weighted > 0 {
+			s.Pageviews = int64(math.Round(float64(s.Weighted) * float64(undemoted) / float64(wikis.weighted)))
+		} else {
+			s.Pageviews = int64(math.Round(s.Share * float64(undemoted)))
+		}
+		resp.TopWikis = append(resp.TopWikis, s)
+	}
+	return resp, nil
+}
+
+// ReadExplainWikiShares reads a gzipped wiki share report, whose
+// columns are Entity, QRank, and pairs of Wiki and Share. Newer
+// reports also have WeightedTotal, and pairs of Views and Weighted;
+// since columns are looked up by name, older reports still work.
+func readExplainWikiShares(r io.Reader) (map[string]explainWikis, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	reader := csv.NewReader(gz)
+	reader.Comment = '#' // provenance
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(header) < 2 || header[0] != "Entity" || header[1] != "QRank" {
+		return nil, fmt.Errorf("unexpected header %q", header)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+
+	// Returns the cell in the named column, or "" if there is none.
+	cell := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+
+	// Parses an optional count, which is empty if not recorded.
+	count := func(row []string, name string) (int64, error) {
+		s := cell(row, name)
+		if s == "" {
+			return 0, nil
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad %s in %q", name, row)
+		}
+		return n, nil
+	}
+
+	result := make(map[string]explainWikis, 1000)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		var wikis explainWikis
+		if wikis.weighted, err = count(row, "WeightedTotal"); err != nil {
+			return nil, err
+		}
+		for i := 1; ; i++ {
+			suffix := strconv.Itoa(i)
+			if _, ok := columns["Wiki"+suffix]; !ok {
+				break
+			}
+			wiki := explainWiki{Wiki: cell(row, "Wiki"+suffix)}
+			if wiki.Wiki == "" {
+				continue
+			}
+			if wiki.Share, err = strconv.ParseFloat(cell(row, "Share"+suffix), 64); err != nil {
+				return nil, fmt.Errorf("bad share in %q", row)
+			}
+			if wiki.Views, err = count(row, "Views"+suffix); err != nil {
+				return nil, err
+			}
+			if wiki.Weighted, err = count(row, "Weighted"+suffix); err != nil {
+				return nil, err
+			}
+			wikis.top = append(wikis.top, wiki)
+		}
+		result[row[0]] = wikis
+	}
+	return result, nil
+}
@@ -0,0 +1,195 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHandleExplain(t *testing.T) {
+	ws := makeTestWebserver()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "qrank.sqlite")
+	writeExplainDBForTest(t, path)
+	ws.storage.files["qrank.sqlite"] = &localFile{
+		Path:      path,
+		ETag:      "db1",
+		DatedName: "qrank-20240601.sqlite",
+	}
+	sharesPath := filepath.Join(dir, "qrank-wiki-shares.csv.gz")
+	// Q8 lacks the columns after Share3, like in older reports.
+	shares := "# version: 2024-06-01\n" +
+		"Entity,QRank,Wiki1,Share1,Wiki2,Share2,Wiki3,Share3,WeightedTotal,Views1,Weighted1,Views2,Weighted2,Views3,Weighted3\n" +
+		"Q72,900,de.wikipedia,0.7500,www.wikidata,0.2500,,,1200,900,900,3000,300,,\n" +
+		"Q8,1,en.wikipedia,1.0000,,,,\n"
+	if err := os.WriteFile(sharesPath, gzipped(shares), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ws.storage.files["qrank-wiki-shares.csv.gz"] = &localFile{
+		Path:      sharesPath,
+		ETag:      "shares1",
+		DatedName: "qrank-wiki-shares-20240601.csv.gz",
+	}
+
+	get := func(path string) (*http.Response, *explainResponse) {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		ws.HandleAPI(w, req)
+		res := w.Result()
+		if res.StatusCode != http.StatusOK {
+			return res, nil
+		}
+		var resp explainResponse
+		if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return res, &resp
+	}
+
+	res, got := get("/api/v1/explain/Q72")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", res.StatusCode)
+	}
+	if etag := res.Header.Get("ETag"); etag != `"db1+shares1-explain-Q72"` {
+		t.Errorf("got ETag %s", etag)
+	}
+	want := &explainResponse{
+		Entity:      "Q72",
+		Version:     "2024-06-01",
+		Rank:        1,
+		RankedItems: 2,
+		Percentile:  50,
+		Bucket:      10,
+		QRank:       900,
+		Class:       "Q515",
+		Signals:     map[string]int64{"pageviews_52w": 900, "sitelinks": 12, "disambiguation": 0},
+		Formula: explainFormula{
+			Version:                1,
+			Weights:                map[string]float64{"wikidata": 0.1},
+			Disambiguation:         "demote",
+			DisambiguationDemotion: 0.01,
+			PageviewWeeks:          []string{"2024-W20", "2024-W21"},
+		},
+		PageviewsBeforeCapping: 1200,
+		TopWikis: []explainWiki{
+			{Wiki: "de.wikipedia", Share: 0.75, Views: 900, Weighted: 900, Pageviews: 675},
+			{Wiki: "www.wikidata", Share: 0.25, Views: 3000, Weighted: 300, Pageviews: 225},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Disambiguation items were demoted, which gets undone for
+	// telling how many pageviews came from each wiki.
+	_, got = get("/api/v1/explain/Q8")
+	if got == nil {
+		t.Fatal("Q8 not found")
+	}
+	if got.PageviewsBeforeDemotion != 100 || len(got.TopWikis) != 1 || got.TopWikis[0].Pageviews != 100 {
+		t.Errorf("got %+v, want 100 pageviews before demotion", got)
+	}
+
+	for path, wantStatus := range map[string]int{
+		"/api/v1/explain/Q3":   http.StatusNotFound,
+		"/api/v1/explain/foo":  http.StatusBadRequest,
+		"/api/v1/explain/":     http.StatusNotFound,
+		"/api/v1/explain/Q1/x": http.StatusNotFound,
+	} {
+		if res, _ := get(path); res.StatusCode != wantStatus {
+			t.Errorf("%s: got status %d, want %d", path, res.StatusCode, wantStatus)
+		}
+	}
+
+	delete(ws.storage.files, "qrank.sqlite")
+	if res, _ := get("/api/v1/explain/Q72"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("without qrank.sqlite, got status %d, want 404", res.StatusCode)
+	}
+}
+
+func TestExplainDB_Release(t *testing.T) {
+	ws := makeTestWebserver()
+	path := filepath.Join(t.TempDir(), "qrank.sqlite")
+	writeExplainDBForTest(t, path)
+	ws.storage.files["qrank.sqlite"] = &localFile{Path: path, ETag: "db1", DatedName: "qrank-20240601.sqlite"}
+
+	open := func() *explainDB {
+		c, err := ws.storage.Retrieve("qrank.sqlite")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		db, err := ws.explainDB(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	// A request is still using the database of the old release
+	// when storage gets a new one.
+	old := open()
+	ws.storage.files["qrank.sqlite"].ETag = "db2"
+	ws.releaseExplainDB(open())
+	if _, err := old.explain("Q72"); err != nil {
+		t.Errorf("stale database closed while in use: %v", err)
+	}
+	ws.releaseExplainDB(old)
+	if err := old.db.Ping(); err == nil {
+		t.Error("stale database not closed after last release")
+	}
+
+	// The live database stays open when no request uses it.
+	if err := ws.explain.db.Ping(); err != nil {
+		t.Errorf("live database closed: %v", err)
+	}
+}
+
+func TestMatchAPIPath(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/top", "/top", true},
+		{"/top", "/top/", false},
+		{"/explain/{item}", "/explain/Q42", true},
+		{"/explain/{item}", "/explain/", false},
+		{"/explain/{item}", "/explain/Q42/foo", false},
+		{"/explain/{item}", "/top", false},
+	} {
+		if got := matchAPIPath(tc.pattern, tc.path); got != tc.want {
+			t.Errorf("matchAPIPath(%q, %q) = %v, want %v", tc.pattern, tc.path, got, tc.want)
+		}
+	}
+}
+
+// WriteExplainDBForTest writes a SQLite database in the format of the
+// sqlite stage of qrank-builder.
+func writeExplainDBForTest(t *testing.T, path string) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	provenance := `{"version":"2024-06-01","commit":"abc","pageview_weeks":["2024-W20","2024-W21"],` +
+		`"weights":{"wikidata":0.1},"formula_version":1,"disambiguation":"demote","disambiguation_demotion":0.01}`
+	for _, stmt := range []string{
+		"CREATE TABLE item_signals (id INTEGER PRIMARY KEY, item TEXT NOT NULL, rank INTEGER, percentile INTEGER, bucket INTEGER, pageviews_52w INTEGER NOT NULL, sitelinks INTEGER NOT NULL, disambiguation INTEGER NOT NULL, class TEXT)",
+		"CREATE TABLE metadata (key TEXT PRIMARY KEY, value TEXT NOT NULL)",
+		"INSERT INTO item_signals VALUES (72, 'Q72', 1, 50, 10, 900, 12, 0, 'Q515'), (8, 'Q8', 2, 0, 1, 1, 0, 1, NULL)",
+		"INSERT INTO metadata VALUES ('version', '2024-06-01'), ('provenance', '" + provenance + "')",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// PublishedFile is a dated file in storage, such as
+// "qrank-20240601.csv.gz". Unlike localFile, it need not be live.
+type publishedFile struct {
+	Filename     string // undated name, such as "qrank.csv.gz"
+	DatedName    string // dated name, such as "qrank-20240601.csv.gz"
+	Date         string // release date, such as "20240601"
+	Size         int64
+	LastModified time.Time
+}
+
+// Release is a set of files that got published together.
+type release struct {
+	Product string    // "QRank" or "OSMViews"
+	Date    time.Time // release date
+	Main    publishedFile
+	Files   []publishedFile // sorted by dated name
+	Updated time.Time       // when the last file was stored
+}
+
+// MaxFeedEntries is the number of releases announced in the feed.
+// With weekly releases, this covers about a year.
+const maxFeedEntries = 50
+
+// RecordPublished remembers the dated files that were found
+// when listing storage.
+func (s *Storage) recordPublished(files []publishedFile) {
+	slices.SortFunc(files, func(a, b publishedFile) int {
+		return strings.Compare(a.DatedName, b.DatedName)
+	})
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.published = files
+}
+
+// Published returns the dated files in storage as of the last reload,
+// sorted by dated name. The caller must not modify the result.
+func (s *Storage) Published() []publishedFile {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.published
+}
+
+// FindReleases groups published files into releases, newest first.
+// OSMViews gets released by its own pipeline, on its own schedule,
+// so its files form separate releases. A QRank release gets announced
+// with its item signals, and it is only complete once its stats file is in
+// storage, because the builders upload that file last; incomplete
+// releases are left out.
+func findReleases(files []publishedFile) []*release {
+	byKey := make(map[string]*release, len(files))
+	for _, f := range files {
+		product, main := "QRank", "item_signals.csv.zst"
+		if strings.HasPrefix(f.Filename, "osmviews") {
+			product, main = "OSMViews", "osmviews.tiff"
+		}
+		key := product + "-" + f.Date
+		r, found := byKey[key]
+		if !found {
+			date, err := time.Parse("20060102", f.Date)
+			if err != nil {
+				continue
+			}
+			r = &release{Product: product, Date: date}
+			byKey[key] = r
+		}
+		if f.Filename == main {
+			r.Main = f
+		}
+		r.Files = append(r.Files, f)
+		if f.LastModified.After(r.Updated) {
+			r.Updated = f.LastModified
+		}
+	}
+
+	result := make([]*release, 0, len(byKey))
+	for _, r := range byKey {
+		if r.Main.DatedName == "" {
+			continue
+		}
+		if r.Product == "QRank" && !slices.ContainsFunc(r.Files, func(f publishedFile) bool {
+			return f.Filename == "qrank-stats.json"
+		}) {
+			continue
+		}
+		slices.SortFunc(r.Files, func(a, b publishedFile) int {
+			return strings.Compare(a.DatedName, b.DatedName)
+		})
+		result = append(result, r)
+	}
+	slices.SortFunc(result, func(a, b *release) int {
+		if c := b.Date.Compare(a.Date); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Product, b.Product)
+	})
+	if len(result) > maxFeedEntries {
+		result = result[:maxFeedEntries]
+	}
+	return result
+}
+
+// AtomFeed is a feed in the Atom Syndication Format, RFC 4287.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Summary string      `xml:"summary"`
+	Content atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// NewAtomFeed returns a feed that announces releases. The baseURL,
+// such as "https://qrank.wmcloud.org", is needed because feed readers
+// resolve links without knowing where the feed came from.
+func newAtomFeed(releases []*release, baseURL string) *atomFeed {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	feed := &atomFeed{
+		Title:  "Wikidata QRank releases",
+		ID:     baseURL + "/feed.xml",
+		Author: atomAuthor{Name: "Wikidata QRank", URI: baseURL + "/"},
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: baseURL + "/feed.xml"},
+			{Rel: "alternate", Type: "text/html", Href: baseURL + "/"},
+		},
+		Entries: make([]atomEntry, 0, len(releases)),
+	}
+
+	var updated time.Time
+	for _, r := range releases {
+		if r.Updated.After(updated) {
+			updated = r.Updated
+		}
+		url := baseURL + "/download/" + r.Main.DatedName
+		var content strings.Builder
+		content.WriteString("<ul>\n")
+		for _, f := range r.Files {
+			fmt.Fprintf(&content, "<li><a href=\"%s\">%s</a>, %d bytes</li>\n",
+				html.EscapeString(baseURL+"/download/"+f.DatedName),
+				html.EscapeString(f.DatedName), f.Size)
+		}
+		content.WriteString("</ul>\n")
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   fmt.Sprintf("%s release %s", r.Product, r.Date.Format(time.DateOnly)),
+			ID:      url,
+			Updated: r.Updated.UTC().Format(time.RFC3339),
+			Link:    atomLink{Rel: "alternate", Href: url},
+			Summary: fmt.Sprintf("%s data of %s, published in %d files.",
+				r.Product, r.Date.Format(time.DateOnly), len(r.Files)),
+			Content: atomContent{Type: "html", Body: content.String()},
+		})
+	}
+	if updated.IsZero() {
+		updated = time.Unix(0, 0)
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+	return feed
+}
+
+// HandleFeed serves an Atom feed at /feed.xml that announces new
+// releases of QRank and OSMViews, so downstream consumers can subscribe
+// instead of polling the downloads with conditional requests.
+func (ws *Webserver) HandleFeed(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r) {
+		return
+	}
+
+	releases := findReleases(ws.storage.Published())
+	feed := newAtomFeed(releases, ws.baseURL)
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+	enc := xml.NewEncoder(&body)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body.WriteString("\n")
+
+	var lastModified time.Time
+	for _, rel := range releases {
+		if rel.Updated.After(lastModified) {
+			lastModified = rel.Updated
+		}
+	}
+
+	// As per https://tools.ietf.org/html/rfc7232, ETag must have quotes.
+	digest := sha256.Sum256(body.Bytes())
+	h := w.Header()
+	h.Set("ETag", fmt.Sprintf(`"%s"`, hex.EncodeToString(digest[:8])))
+	h.Set("Content-Type", "application/atom+xml; charset=utf-8")
+	h.Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", lastModified, bytes.NewReader(body.Bytes()))
+}
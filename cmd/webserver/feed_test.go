@@ -0,0 +1,97 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestWebserver_HandleFeed(t *testing.T) {
+	storage, client := newTestArtifactStorage(t)
+	client.publish("20240601", "first", "")
+	client.publish("20240608", "second", "")
+	client.objects["public/item_signals-20240601.csv.zst"] = []byte("first")
+	client.objects["public/item_signals-20240608.csv.zst"] = []byte("second")
+	client.objects["public/osmviews-20240603.tiff"] = []byte("tiff")
+
+	// Not announced yet, because the stats file is missing.
+	client.objects["public/item_signals-20240615.csv.zst"] = []byte("third")
+
+	// Not announced, because releases are keyed by their item signals.
+	client.publish("20240622", "fourth", "")
+
+	storage.Reload(context.Background())
+	ws := &Webserver{storage: storage, baseURL: "https://qrank.example.org/"}
+	req := httptest.NewRequest("GET", "/feed.xml", nil)
+	w := httptest.NewRecorder()
+	ws.HandleFeed(w, req)
+	res := w.Result()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	if got, want := res.Header.Get("Content-Type"), "application/atom+xml; charset=utf-8"; got != want {
+		t.Errorf("got Content-Type %q, want %q", got, want)
+	}
+	if got := res.Header.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("got Access-Control-Allow-Origin %q, want *", got)
+	}
+
+	var feed atomFeed
+	if err := xml.Unmarshal(body, &feed); err != nil {
+		t.Fatal(err)
+	}
+	var titles, ids []string
+	for _, e := range feed.Entries {
+		titles = append(titles, e.Title)
+		ids = append(ids, e.ID)
+	}
+	wantTitles := []string{
+		"QRank release 2024-06-08",
+		"OSMViews release 2024-06-03",
+		"QRank release 2024-06-01",
+	}
+	if !slices.Equal(titles, wantTitles) {
+		t.Errorf("got entries %q, want %q", titles, wantTitles)
+	}
+	if got, want := ids[0], "https://qrank.example.org/download/item_signals-20240608.csv.zst"; got != want {
+		t.Errorf("got entry ID %q, want %q", got, want)
+	}
+	if got, want := feed.Updated, "2024-06-08T00:00:00Z"; got != want {
+		t.Errorf("got updated %q, want %q", got, want)
+	}
+
+	// Feed readers poll with conditional requests.
+	req = httptest.NewRequest("GET", "/feed.xml", nil)
+	req.Header.Set("If-None-Match", res.Header.Get("ETag"))
+	w = httptest.NewRecorder()
+	ws.HandleFeed(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("got status %d for conditional request, want %d", w.Code, http.StatusNotModified)
+	}
+}
+
+func TestFindReleases_Limit(t *testing.T) {
+	files := make([]publishedFile, 0, 2*(maxFeedEntries+10))
+	for i := 0; i < maxFeedEntries+10; i++ {
+		date := time.Date(2023, 1, 1+7*i, 0, 0, 0, 0, time.UTC).Format("20060102")
+		files = append(files,
+			publishedFile{Filename: "osmviews.tiff", DatedName: "osmviews-" + date + ".tiff", Date: date},
+			publishedFile{Filename: "osmviews.tiff", DatedName: "broken", Date: "not-a-date"})
+	}
+	releases := findReleases(files)
+	if len(releases) != maxFeedEntries {
+		t.Fatalf("got %d releases, want %d", len(releases), maxFeedEntries)
+	}
+	if got, want := releases[0].Main.DatedName, "osmviews-20240218.tiff"; got != want {
+		t.Errorf("got %q as newest release, want %q", got, want)
+	}
+}
@@ -0,0 +1,171 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DataFreshness tells how old the served ranking is. If the pipeline
+// stops producing releases, the webserver keeps serving the last one;
+// with this, clients and monitoring can notice that the data is stale.
+type dataFreshness struct {
+	storage *Storage
+	maxAge  time.Duration // 0 for never warning about stale data
+	now     func() time.Time
+
+	mutex     sync.Mutex
+	statsETag string    // ETag of the stats file that was last parsed
+	statsDate time.Time // version found in that file, or zero
+}
+
+var (
+	dataAgeDesc = prometheus.NewDesc(
+		"qrank_data_age_days",
+		"Number of days since the version date of the served QRank data.",
+		nil, nil)
+
+	datedNameRegexp = regexp.MustCompile(`-(2[0-9]{7})\.`)
+)
+
+// NewDataFreshness returns a tracker for the age of the data in storage.
+// The web page warns about stale data if it is older than maxAge.
+func newDataFreshness(storage *Storage, maxAge time.Duration, now func() time.Time) *dataFreshness {
+	return &dataFreshness{storage: storage, maxAge: maxAge, now: now}
+}
+
+// DataDate returns the version date of the served ranking. It is taken
+// from the stats file that gets published with every release. If storage
+// has no stats file, or one without version such as the stats files
+// of the old pipeline, the date is taken from the dated name
+// of qrank.csv.gz.
+func (f *dataFreshness) DataDate() (time.Time, bool) {
+	if date := f.readStatsDate(); !date.IsZero() {
+		return date, true
+	}
+	if dated, found := f.storage.Latest("qrank.csv.gz"); found {
+		if m := datedNameRegexp.FindStringSubmatch(dated); m != nil {
+			if date, err := time.Parse("20060102", m[1]); err == nil {
+				return date, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// ReadStatsDate returns the version of the live qrank-stats.json file,
+// or the zero time if it cannot be found. The file is only parsed
+// again when its ETag has changed.
+func (f *dataFreshness) readStatsDate() time.Time {
+	c, err := f.storage.Retrieve("qrank-stats.json")
+	if err != nil {
+		return time.Time{}
+	}
+	defer c.Close()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if c.ETag == f.statsETag {
+		return f.statsDate
+	}
+
+	f.statsETag, f.statsDate = c.ETag, time.Time{}
+	data, err := io.ReadAll(c)
+	if err != nil {
+		log.Printf("cannot read qrank-stats.json: %v", err)
+		return time.Time{}
+	}
+	var stats struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		log.Printf("cannot parse qrank-stats.json: %v", err)
+		return time.Time{}
+	}
+	if date, err := time.Parse(time.DateOnly, stats.Version); err == nil {
+		f.statsDate = date
+	}
+	return f.statsDate
+}
+
+// Age returns how much time has passed since the version date
+// of the served data.
+func (f *dataFreshness) Age() (time.Duration, bool) {
+	date, ok := f.DataDate()
+	if !ok {
+		return 0, false
+	}
+	return f.now().Sub(date), true
+}
+
+// SetHeader tells clients the version date of the served data,
+// in an X-QRank-Data-Date header such as "2024-06-01".
+func (f *dataFreshness) SetHeader(h http.Header) {
+	if date, ok := f.DataDate(); ok {
+		h.Set("X-QRank-Data-Date", date.Format(time.DateOnly))
+	}
+}
+
+// SetDownloadHeader tells clients the version date of a downloaded
+// release artifact. A file retrieved by its dated name, such as
+// "qrank-20240101.csv.gz", carries the date in its name, which may
+// be older than the served release. A live file carries the date of
+// the served release, but only if storage has a dated version of it;
+// files that are not part of a release get no header.
+func (f *dataFreshness) SetDownloadHeader(h http.Header, name string, c *Content) {
+	if c.Immutable {
+		if m := datedNameRegexp.FindStringSubmatch(name); m != nil {
+			if date, err := time.Parse("20060102", m[1]); err == nil {
+				h.Set("X-QRank-Data-Date", date.Format(time.DateOnly))
+			}
+		}
+		return
+	}
+	if _, found := f.storage.Latest(c.Filename); found {
+		f.SetHeader(h)
+	}
+}
+
+// WarningHTML returns a banner about stale data for showing on the
+// home page, or an empty string if the data is fresh enough.
+func (f *dataFreshness) warningHTML() string {
+	if f.maxAge <= 0 {
+		return ""
+	}
+	date, ok := f.DataDate()
+	if !ok {
+		return ""
+	}
+	age := f.now().Sub(date)
+	if age <= f.maxAge {
+		return ""
+	}
+	return fmt.Sprintf(`
+<p class="warning">The served data is from %s, which is %d days ago.
+New releases are usually published every week, so the data may be
+stale. Please check again later.</p>
+`, html.EscapeString(date.Format(time.DateOnly)), int(age.Hours()/24))
+}
+
+// Describe implements prometheus.Collector.
+func (f *dataFreshness) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dataAgeDesc
+}
+
+// Collect implements prometheus.Collector.
+func (f *dataFreshness) Collect(ch chan<- prometheus.Metric) {
+	if age, ok := f.Age(); ok {
+		ch <- prometheus.MustNewConstMetric(dataAgeDesc, prometheus.GaugeValue, age.Hours()/24)
+	}
+}
@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDataFreshness(t *testing.T) {
+	ws := makeDatedTestWebserver(t)
+	clock := newTestClock("2024-06-11T12:00:00Z")
+	ws.freshness = newDataFreshness(ws.storage, 14*24*time.Hour, clock.Now)
+	home := func() (string, string) {
+		req := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		ws.HandleMain(w, req)
+		res := w.Result()
+		body, _ := io.ReadAll(res.Body)
+		return res.Header.Get("X-QRank-Data-Date"), string(body)
+	}
+
+	// Without a stats file, the date comes from the name of qrank.csv.gz.
+	date, body := home()
+	if date != "2024-06-01" {
+		t.Errorf("got X-QRank-Data-Date %q, want 2024-06-01", date)
+	}
+	if strings.Contains(body, `class="warning"`) {
+		t.Error("home page should not warn about fresh data")
+	}
+
+	req := httptest.NewRequest("HEAD", "/download/qrank.csv.gz", nil)
+	w := httptest.NewRecorder()
+	ws.HandleDownload(w, req)
+	if got := w.Result().Header.Get("X-QRank-Data-Date"); got != "2024-06-01" {
+		t.Errorf("got X-QRank-Data-Date %q for download, want 2024-06-01", got)
+	}
+
+	// The stats file, if any, takes precedence.
+	path := filepath.Join(ws.storage.workdir, "qrank-stats.json")
+	if err := os.WriteFile(path, []byte(`{"format_version":2,"version":"2024-05-29"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ws.storage.files["qrank-stats.json"] = &localFile{
+		Path:        path,
+		ContentType: "application/json",
+		ETag:        "ETag-stats",
+		DatedName:   "qrank-stats-20240529.json",
+	}
+	clock.Advance(14 * 24 * time.Hour)
+	date, body = home()
+	if date != "2024-05-29" {
+		t.Errorf("got X-QRank-Data-Date %q, want 2024-05-29", date)
+	}
+	if !strings.Contains(body, "The served data is from 2024-05-29, which is 27 days ago.") {
+		t.Errorf("home page should warn about stale data, got %s", body)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(ws.freshness)
+	if got, want := gatherForTest(t, reg), []string{"qrank_data_age_days 27.5"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got metrics %q, want %q", got, want)
+	}
+
+	// Files downloaded by their dated name carry the date in their name;
+	// files without a dated version are not part of any release.
+	download := func(name string) string {
+		req := httptest.NewRequest("HEAD", "/download/"+name, nil)
+		w := httptest.NewRecorder()
+		ws.HandleDownload(w, req)
+		if status := w.Result().StatusCode; status != http.StatusOK {
+			t.Fatalf("%s: got status %d", name, status)
+		}
+		return w.Result().Header.Get("X-QRank-Data-Date")
+	}
+	if got := download("qrank.csv.gz"); got != "2024-05-29" {
+		t.Errorf("got X-QRank-Data-Date %q for live download, want 2024-05-29", got)
+	}
+	if got := download("qrank-20240601.csv.gz"); got != "2024-06-01" {
+		t.Errorf("got X-QRank-Data-Date %q for dated download, want 2024-06-01", got)
+	}
+	undated := filepath.Join(ws.storage.workdir, "qrank-notes.txt")
+	if err := os.WriteFile(undated, []byte("notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ws.storage.files["qrank-notes.txt"] = &localFile{Path: undated, ContentType: "text/plain", ETag: "ETag-notes"}
+	if got := download("qrank-notes.txt"); got != "" {
+		t.Errorf("got X-QRank-Data-Date %q for undated download, want none", got)
+	}
+
+	// With a zero threshold, the home page never warns.
+	ws.freshness.maxAge = 0
+	if _, body := home(); strings.Contains(body, `class="warning"`) {
+		t.Error("home page should not warn if maxAge is zero")
+	}
+}
+
+func TestDataFreshness_NoData(t *testing.T) {
+	ws := makeTestWebserver()
+	ws.freshness = newDataFreshness(ws.storage, 14*24*time.Hour, time.Now)
+	if date, ok := ws.freshness.DataDate(); ok {
+		t.Errorf("got data date %s, want none", date)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(ws.freshness)
+	if got := gatherForTest(t, reg); len(got) != 0 {
+		t.Errorf("got metrics %q, want none", got)
+	}
+}
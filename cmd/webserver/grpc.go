@@ -0,0 +1,270 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	grpcprom "github.com/grpc-ecosystem/go-grpc-middleware/providers/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	"github.com/brawer/wikidata-qrank/v2/pkg/qrankpb"
+)
+
+// MaxBatchSize is the maximal number of entities in one BatchGetRank call.
+const maxBatchSize = 1000
+
+// RankService implements the QRankService gRPC service for tools
+// that need low-latency lookups without parsing files. Lookups are
+// answered from a rank index, which gets rebuilt whenever storage
+// has a new release of qrank.csv.gz. The same index also serves
+// /api/v1/top when filtering by class.
+type rankService struct {
+	qrankpb.UnimplementedQRankServiceServer
+
+	storage  *Storage
+	indexDir string
+	mutex    sync.RWMutex
+	index    *rankIndex // nil until the first index has been built
+}
+
+// NewRankService returns a service that keeps its rank index in indexDir.
+func newRankService(storage *Storage, indexDir string) (*rankService, error) {
+	if err := os.MkdirAll(indexDir, 0755); err != nil {
+		return nil, err
+	}
+	return &rankService{storage: storage, indexDir: indexDir}, nil
+}
+
+// NewGRPCServer sets up a gRPC server for a rank service, with server
+// reflection so that tools such as grpcurl can discover the API,
+// and with metrics about the handled calls.
+func newGRPCServer(svc *rankService, registerer prometheus.Registerer) (*grpc.Server, error) {
+	metrics := grpcprom.NewServerMetrics(grpcprom.WithServerHandlingTimeHistogram())
+	if err := registerer.Register(metrics); err != nil {
+		return nil, err
+	}
+
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(metrics.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(metrics.StreamServerInterceptor()),
+	)
+	qrankpb.RegisterQRankServiceServer(server, svc)
+	reflection.Register(server)
+	metrics.InitializeMetrics(server)
+	return server, nil
+}
+
+// Reload builds a new rank index if storage has a new release
+// of qrank.csv.gz or item_signals.csv.zst, and deletes any obsolete
+// index files. The item signals are only needed for the classes
+// of items; without them, the index has no classes.
+func (svc *rankService) Reload(ctx context.Context) error {
+	version, found := svc.storage.Latest("qrank.csv.gz")
+	if !found {
+		return nil
+	}
+	classVersion, _ := svc.storage.Latest("item_signals.csv.zst")
+
+	svc.mutex.RLock()
+	current := svc.index
+	svc.mutex.RUnlock()
+	if current != nil && current.version == version && current.classVersion == classVersion {
+		return nil
+	}
+
+	name := strings.TrimSuffix(version, ".csv.gz")
+	if classVersion != "" {
+		name += "+" + strings.TrimSuffix(classVersion, ".csv.zst")
+	}
+	path, err := filepath.Abs(filepath.Join(svc.indexDir, name+".idx"))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		start := time.Now()
+		if err := svc.build(version, classVersion, path); err != nil {
+			return err
+		}
+		log.Printf("built rank index for %s in %v", name, time.Since(start))
+	}
+
+	index, err := openRankIndex(path, version, classVersion)
+	if err != nil {
+		// Most likely, the index has been built by an older version
+		// of this program. Removing it makes the next reload rebuild it.
+		os.Remove(path)
+		return err
+	}
+
+	svc.mutex.Lock()
+	old := svc.index
+	svc.index = index
+	if old != nil {
+		old.Close()
+	}
+	svc.mutex.Unlock()
+
+	ff, err := os.ReadDir(svc.indexDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range ff {
+		fp, err := filepath.Abs(filepath.Join(svc.indexDir, f.Name()))
+		if err != nil {
+			return err
+		}
+		if fp != path {
+			log.Printf("Deleting obsolete rank index: %s", fp)
+			if err := os.Remove(fp); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Build builds a rank index file from the live versions of a ranking
+// and, unless classVersion is empty, of an item_signals file.
+func (svc *rankService) build(version, classVersion, path string) error {
+	c, err := svc.storage.Retrieve(version)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var signals io.Reader
+	if classVersion != "" {
+		sc, err := svc.storage.Retrieve(classVersion)
+		if err != nil {
+			return err
+		}
+		defer sc.Close()
+		signals = sc
+	}
+
+	return buildRankIndex(c, signals, path)
+}
+
+// Watch rebuilds the rank index whenever there is a new release.
+func (svc *rankService) Watch(ctx context.Context) error {
+	if err := svc.Reload(ctx); err != nil {
+		log.Println(err)
+	}
+	ticker := time.NewTicker(30 * time.Second)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := svc.Reload(ctx); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// GetRank implements the GetRank call of QRankService.
+func (svc *rankService) GetRank(ctx context.Context, req *qrankpb.GetRankRequest) (*qrankpb.GetRankResponse, error) {
+	id, ok := parseItemID(req.Entity)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "bad entity %q, expected an item ID such as Q72", req.Entity)
+	}
+
+	svc.mutex.RLock()
+	defer svc.mutex.RUnlock()
+	if svc.index == nil {
+		return nil, status.Error(codes.Unavailable, "rank index not ready")
+	}
+
+	rank, qrank := svc.index.Lookup(id)
+	if rank == 0 {
+		return nil, status.Errorf(codes.NotFound, "%s is not ranked", req.Entity)
+	}
+	resp := &qrankpb.GetRankResponse{
+		Entity:  &qrankpb.RankedEntity{Entity: req.Entity, Rank: rank, Qrank: qrank},
+		Version: svc.index.version,
+	}
+	return resp, nil
+}
+
+// BatchGetRank implements the BatchGetRank call of QRankService.
+func (svc *rankService) BatchGetRank(ctx context.Context, req *qrankpb.BatchGetRankRequest) (*qrankpb.BatchGetRankResponse, error) {
+	if len(req.Entities) > maxBatchSize {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d entities per call", maxBatchSize)
+	}
+	ids := make([]int64, len(req.Entities))
+	for i, entity := range req.Entities {
+		id, ok := parseItemID(entity)
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "bad entity %q, expected an item ID such as Q72", entity)
+		}
+		ids[i] = id
+	}
+
+	svc.mutex.RLock()
+	defer svc.mutex.RUnlock()
+	if svc.index == nil {
+		return nil, status.Error(codes.Unavailable, "rank index not ready")
+	}
+
+	resp := &qrankpb.BatchGetRankResponse{
+		Entities: make([]*qrankpb.RankedEntity, 0, len(ids)),
+		Version:  svc.index.version,
+	}
+	for i, id := range ids {
+		rank, qrank := svc.index.Lookup(id)
+		resp.Entities = append(resp.Entities, &qrankpb.RankedEntity{
+			Entity: req.Entities[i],
+			Rank:   rank,
+			Qrank:  qrank,
+		})
+	}
+	return resp, nil
+}
+
+// TopN implements the TopN call of QRankService. Unlike /api/v1/top,
+// it can page through the entire ranking.
+func (svc *rankService) TopN(ctx context.Context, req *qrankpb.TopNRequest) (*qrankpb.TopNResponse, error) {
+	if req.Limit < 1 || req.Limit > maxTopLimit {
+		return nil, status.Errorf(codes.InvalidArgument, "limit must be between 1 and %d", maxTopLimit)
+	}
+	if req.Offset < 0 {
+		return nil, status.Error(codes.InvalidArgument, "offset must be at least 0")
+	}
+
+	svc.mutex.RLock()
+	defer svc.mutex.RUnlock()
+	if svc.index == nil {
+		return nil, status.Error(codes.Unavailable, "rank index not ready")
+	}
+
+	end := min(req.Offset+int64(req.Limit), svc.index.Len())
+	resp := &qrankpb.TopNResponse{
+		Entities: make([]*qrankpb.RankedEntity, 0, max(end-req.Offset, 0)),
+		Version:  svc.index.version,
+	}
+	for pos := req.Offset + 1; pos <= end; pos++ {
+		id, qrank := svc.index.At(pos)
+		resp.Entities = append(resp.Entities, &qrankpb.RankedEntity{
+			Entity: "Q" + strconv.FormatInt(id, 10),
+			Rank:   pos,
+			Qrank:  qrank,
+		})
+	}
+	return resp, nil
+}
@@ -0,0 +1,244 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/compress"
+	"github.com/brawer/wikidata-qrank/v2/pkg/qrankpb"
+)
+
+func TestRankService(t *testing.T) {
+	ctx := context.Background()
+	client := startTestRankService(t)
+
+	got, err := client.GetRank(ctx, &qrankpb.GetRankRequest{Entity: "Q72"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := got.Entity; e.Entity != "Q72" || e.Rank != 2 || e.Qrank != 800 {
+		t.Errorf("GetRank(Q72) = %v, want rank 2 and qrank 800", e)
+	}
+	if got.Version != "qrank-20240501.csv.gz" {
+		t.Errorf("got version %q, want qrank-20240501.csv.gz", got.Version)
+	}
+
+	for entity, want := range map[string]codes.Code{
+		"Q73": codes.NotFound,
+		"P31": codes.InvalidArgument,
+		"":    codes.InvalidArgument,
+	} {
+		_, err := client.GetRank(ctx, &qrankpb.GetRankRequest{Entity: entity})
+		if got := status.Code(err); got != want {
+			t.Errorf("GetRank(%q) failed with %v, want %v", entity, got, want)
+		}
+	}
+
+	batch, err := client.BatchGetRank(ctx, &qrankpb.BatchGetRankRequest{
+		Entities: []string{"Q1234", "Q73", "Q5"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(batch.Entities); n != 3 {
+		t.Fatalf("got %d entities, want 3", n)
+	}
+	for i, want := range []struct{ rank, qrank int64 }{{3, 7}, {0, 0}, {1, 900}} {
+		if e := batch.Entities[i]; e.Rank != want.rank || e.Qrank != want.qrank {
+			t.Errorf("BatchGetRank entities[%d] = %v, want rank %d and qrank %d", i, e, want.rank, want.qrank)
+		}
+	}
+
+	tooMany := make([]string, maxBatchSize+1)
+	for i := range tooMany {
+		tooMany[i] = "Q1"
+	}
+	_, err = client.BatchGetRank(ctx, &qrankpb.BatchGetRankRequest{Entities: tooMany})
+	if got := status.Code(err); got != codes.InvalidArgument {
+		t.Errorf("BatchGetRank with too many entities failed with %v, want InvalidArgument", got)
+	}
+
+	top, err := client.TopN(ctx, &qrankpb.TopNRequest{Limit: 5, Offset: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(top.Entities); n != 2 {
+		t.Fatalf("got %d entities, want 2", n)
+	}
+	if e := top.Entities[0]; e.Entity != "Q72" || e.Rank != 2 || e.Qrank != 800 {
+		t.Errorf("TopN entities[0] = %v, want Q72 with rank 2 and qrank 800", e)
+	}
+	if e := top.Entities[1]; e.Entity != "Q1234" || e.Rank != 3 || e.Qrank != 7 {
+		t.Errorf("TopN entities[1] = %v, want Q1234 with rank 3 and qrank 7", e)
+	}
+
+	for _, req := range []*qrankpb.TopNRequest{
+		{Limit: 0},
+		{Limit: maxTopLimit + 1},
+		{Limit: 1, Offset: -1},
+	} {
+		_, err := client.TopN(ctx, req)
+		if got := status.Code(err); got != codes.InvalidArgument {
+			t.Errorf("TopN(%v) failed with %v, want InvalidArgument", req, got)
+		}
+	}
+}
+
+func TestRankService_NotReady(t *testing.T) {
+	svc, err := newRankService(makeTestWebserver().storage, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.GetRank(context.Background(), &qrankpb.GetRankRequest{Entity: "Q72"})
+	if got := status.Code(err); got != codes.Unavailable {
+		t.Errorf("got %v, want Unavailable", got)
+	}
+}
+
+func TestRankService_Reload(t *testing.T) {
+	ctx := context.Background()
+	storage := makeTestWebserver().storage
+	indexDir := t.TempDir()
+	obsolete := filepath.Join(indexDir, "qrank-20240424.idx")
+	if err := os.WriteFile(obsolete, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	svc, err := newRankService(storage, indexDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTestRanking(t, storage, "qrank-20240501.csv.gz", "Entity,QRank\nQ5,900\n")
+	if err := svc.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(obsolete); err == nil {
+		t.Errorf("rankService.Reload() should delete obsolete %s", obsolete)
+	}
+
+	putTestRanking(t, storage, "qrank-20240508.csv.gz", "Entity,QRank\nQ72,5\nQ5,4\n")
+	if err := svc.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := svc.GetRank(ctx, &qrankpb.GetRankRequest{Entity: "Q5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Version != "qrank-20240508.csv.gz" || resp.Entity.Rank != 2 {
+		t.Errorf("got %v, want rank 2 in qrank-20240508.csv.gz", resp)
+	}
+	ff, err := os.ReadDir(indexDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ff) != 1 || ff[0].Name() != "qrank-20240508.idx" {
+		t.Errorf("got %v, want only qrank-20240508.idx in index directory", ff)
+	}
+
+	// A new release of the item signals also leads to a new index.
+	putTestItemSignals(t, storage, "item_signals-20240508.csv.zst", testItemSignals)
+	if err := svc.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if idx := svc.index; idx.classVersion != "item_signals-20240508.csv.zst" || !idx.HasClasses() {
+		t.Errorf("got class version %q, want item_signals-20240508.csv.zst with classes", idx.classVersion)
+	}
+	ff, err = os.ReadDir(indexDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ff) != 1 || ff[0].Name() != "qrank-20240508+item_signals-20240508.idx" {
+		t.Errorf("got %v, want only qrank-20240508+item_signals-20240508.idx in index directory", ff)
+	}
+}
+
+func startTestRankService(t *testing.T) qrankpb.QRankServiceClient {
+	storage := makeTestWebserver().storage
+	putTestRanking(t, storage, "qrank-20240501.csv.gz",
+		"# version: 2024-05-01\n"+
+			"Entity,QRank,Percentile,Bucket\n"+
+			"Q5,900,99,10\nQ72,800,66,9\nQ1234,7,33,3\n")
+	svc, err := newRankService(storage, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := newGRPCServer(svc, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := bufconn.Listen(1 << 20)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	dial := func(ctx context.Context, _ string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	}
+	conn, err := grpc.Dial("passthrough:///bufnet",
+		grpc.WithContextDialer(dial),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return qrankpb.NewQRankServiceClient(conn)
+}
+
+// PutTestRanking makes a gzipped ranking the live version of qrank.csv.gz.
+func putTestRanking(t *testing.T, storage *Storage, datedName, content string) {
+	path := filepath.Join(t.TempDir(), datedName)
+	if err := os.WriteFile(path, gzipped(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	storage.files["qrank.csv.gz"] = &localFile{
+		Path:         path,
+		ContentType:  "application/gzip",
+		ETag:         "ETag-" + datedName,
+		LastModified: time.Now(),
+		DatedName:    datedName,
+	}
+}
+
+// PutTestItemSignals makes zstd-compressed item signals the live
+// version of item_signals.csv.zst.
+func putTestItemSignals(t *testing.T, storage *Storage, datedName, content string) {
+	var buf bytes.Buffer
+	w, err := compress.NewWriter(&buf, compress.Zstd, compress.BestLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(content))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), datedName)
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	storage.files["item_signals.csv.zst"] = &localFile{
+		Path:         path,
+		ContentType:  "application/zstd",
+		ETag:         "ETag-" + datedName,
+		LastModified: time.Now(),
+		DatedName:    datedName,
+	}
+}
@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"math"
+	"math/bits"
+)
+
+// HyperLogLogPrecision is the number of hash bits for selecting
+// a register. With 2^12 registers, the standard error of the
+// estimate is 1.04/sqrt(4096) = 1.6%, using 4 KiB of memory.
+const hyperLogLogPrecision = 12
+
+// HyperLogLog estimates the number of distinct hashes it has seen,
+// following Flajolet et al., “HyperLogLog: the analysis of a
+// near-optimal cardinality estimation algorithm” (2007). The sketch
+// only keeps, for each register, the longest run of leading zero bits,
+// so the original hashes cannot be recovered from it.
+type hyperLogLog struct {
+	registers [1 << hyperLogLogPrecision]uint8
+}
+
+// Add adds a 64-bit hash to the sketch.
+func (h *hyperLogLog) Add(hash uint64) {
+	const p = hyperLogLogPrecision
+	index := hash >> (64 - p)
+	rest := hash<<p | 1<<(p-1) // guard bit, so rho is at most 64-p+1
+	rho := uint8(bits.LeadingZeros64(rest) + 1)
+	if rho > h.registers[index] {
+		h.registers[index] = rho
+	}
+}
+
+// Estimate returns the estimated number of distinct hashes.
+func (h *hyperLogLog) Estimate() int64 {
+	m := float64(len(h.registers))
+	alpha := 0.7213 / (1 + 1.079/m)
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := alpha * m * m / sum
+
+	// For small cardinalities, linear counting is more accurate.
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(estimate))
+}
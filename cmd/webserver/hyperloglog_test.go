@@ -0,0 +1,32 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 1000, 50000} {
+		var h hyperLogLog
+		for i := 0; i < n; i++ {
+			hash := splitMix64(uint64(i))
+			h.Add(hash)
+			h.Add(hash) // duplicates must not be counted
+		}
+		got := h.Estimate()
+		if tolerance := math.Max(1, 0.05*float64(n)); math.Abs(float64(got-int64(n))) > tolerance {
+			t.Errorf("n=%d: got estimate %d", n, got)
+		}
+	}
+}
+
+// SplitMix64 returns a well-mixed hash of x, so tests are deterministic.
+func splitMix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
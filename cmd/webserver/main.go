@@ -4,22 +4,40 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"image/png"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	//"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/minisign"
 )
 
 func main() {
 	port := flag.Int("port", 0, "port for serving HTTP requests")
 	workdir := flag.String("workdir", "webserver-workdir", "path to working directory on local disk")
+	statsDir := flag.String("access-stats", "internal", "path to directory for monthly access statistics, which must not be inside -workdir")
+	publicKeyPath := flag.String("public-key", "", "path to minisign public key that verifies the signatures of downloads; empty for not announcing any")
+	grpcPort := flag.Int("grpc-port", 0, "port for serving gRPC requests; 0 for not serving gRPC")
+	indexDir := flag.String("index-dir", "index", "path to directory for the rank index of the gRPC service, which must not be inside -workdir")
+	classFilter := flag.Bool("class-filter", false, "whether /api/v1/top can filter by class, which needs a rank index like the gRPC service")
+	requiredArtifacts := flag.String("required-artifacts", strings.Join(defaultRequiredArtifacts, ","), "comma-separated files that must be loaded from storage before /readyz reports the webserver as ready")
+	baseURL := flag.String("base-url", "https://qrank.wmcloud.org", "public URL of the webserver, for absolute links in the feed of releases")
+	maxDataAge := flag.Duration("max-data-age", 14*24*time.Hour, "age of the served data after which the home page warns that it is stale; 0 for never warning")
 	flag.Parse()
 
 	if *port == 0 {
@@ -29,35 +47,116 @@ func main() {
 		}
 	}
 
-	storage, err := NewStorage(*workdir)
+	storage, err := NewStorage(*workdir, strings.Split(*requiredArtifacts, ","))
 	if err != nil {
 		log.Fatal(err)
 	}
+	prometheus.MustRegister(storage)
 
+	// If some files cannot be loaded, we still start serving;
+	// /readyz tells what is missing, and Storage.Watch keeps trying.
 	if err := storage.Reload(context.Background()); err != nil {
+		log.Println(err)
+	}
+
+	// Storage.Reload deletes everything in workdir that is not a live file.
+	if rel, err := filepath.Rel(*workdir, *statsDir); err == nil && !strings.HasPrefix(rel, "..") {
+		log.Fatalf("-access-stats=%s must not be inside -workdir=%s", *statsDir, *workdir)
+	}
+	access, err := newAccessStats(*statsDir, time.Now)
+	if err != nil {
 		log.Fatal(err)
 	}
+	prometheus.MustRegister(access)
+
+	freshness := newDataFreshness(storage, *maxDataAge, time.Now)
+	prometheus.MustRegister(freshness)
+
+	var signingKey *minisign.PublicKey
+	if *publicKeyPath != "" {
+		data, err := os.ReadFile(*publicKeyPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		signingKey, err = minisign.ParsePublicKey(string(data))
+		if err != nil {
+			log.Fatalf("%s: %v", *publicKeyPath, err)
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	go storage.Watch(ctx)
-	server := &Webserver{storage: storage}
+	go access.Watch(ctx)
+
+	var ranks *rankService
+	if *grpcPort != 0 || *classFilter {
+		if rel, err := filepath.Rel(*workdir, *indexDir); err == nil && !strings.HasPrefix(rel, "..") {
+			log.Fatalf("-index-dir=%s must not be inside -workdir=%s", *indexDir, *workdir)
+		}
+		ranks, err = newRankService(storage, *indexDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go ranks.Watch(ctx)
+	}
+
+	if *grpcPort != 0 {
+		grpcServer, err := newGRPCServer(ranks, prometheus.DefaultRegisterer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listener, err := net.Listen("tcp", ":"+strconv.Itoa(*grpcPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Listening for gRPC requests on port %d", *grpcPort)
+		go grpcServer.Serve(listener)
+	}
+
+	server := &Webserver{storage: storage, access: access, freshness: freshness, ranks: ranks, signingKey: signingKey, baseURL: *baseURL}
 	http.HandleFunc("/", server.HandleMain)
 	http.HandleFunc("/robots.txt", server.HandleRobotsTxt)
+	http.HandleFunc("/minisign.pub", server.HandleSigningKey)
+	http.HandleFunc("/readyz", server.HandleReadyz)
+	http.HandleFunc("/feed.xml", server.HandleFeed)
 	http.Handle("/metrics", promhttp.Handler())
 	http.HandleFunc("/download/", server.HandleDownload)
+	http.HandleFunc("/latest/", server.HandleLatest)
+	http.HandleFunc("/cog/", server.HandleCOG)
+	http.HandleFunc("/api/", server.HandleAPI)
 	log.Printf("Listening for HTTP requests on port %d", *port)
 	http.ListenAndServe(":"+strconv.Itoa(*port), nil)
 	cancel()
 }
 
 type Webserver struct {
-	storage *Storage
+	storage      *Storage
+	access       *accessStats   // nil for not collecting access statistics
+	freshness    *dataFreshness // nil for not telling the age of the data
+	ranks        *rankService   // nil for not filtering /api/v1/top by class
+	topMutex     sync.Mutex
+	top          map[string]*topList // filename → head of ranking
+	explainMutex sync.Mutex
+	explain      *explainDB // nil until the first /api/v1/explain request
+	churnMutex   sync.Mutex
+	churn        *cachedChurn // nil until the home page shows a churn report
+	baseURL      string       // public URL, such as "https://qrank.wmcloud.org"
+
+	// Public key for verifying the signatures of downloads,
+	// or nil if the downloads are not signed.
+	signingKey *minisign.PublicKey
 }
 
 func (ws *Webserver) HandleMain(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "%s",
+	if !checkMethod(w, r) {
+		return
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "%s",
 		`<html>
 <head>
+<link rel="alternate" type="application/atom+xml" title="Wikidata QRank releases" href="/feed.xml"/>
 <link href='https://tools-static.wmflabs.org/fontcdn/css?family=Roboto+Slab:400,700' rel='stylesheet' type='text/css'/>
 <style>
 * {
@@ -71,9 +170,20 @@ h1 {
 p {
   margin-left: 5em;
 }
+p.warning {
+  background-color: #fff3cd;
+  border-left: 0.3em solid #ffb000;
+  padding: 0.5em 1em;
+}
 </style>
 </head>
 <body><h1>Wikidata QRank</h1>
+`)
+	if ws.freshness != nil {
+		ws.freshness.SetHeader(w.Header())
+		body.WriteString(ws.freshness.warningHTML())
+	}
+	fmt.Fprintf(&body, "%s", `
 
 <p>QRank is ranking <a href="https://www.wikidata.org/">Wikidata entities</a>
 by aggregating page views on Wikipedia, Wikispecies, Wikibooks, Wikiquote,
@@ -84,8 +194,33 @@ and other Wikimedia projects. For an introduction, see the <a href="https://gith
 <p>To <b>download</b> the latest QRank data, <a href="/download/qrank.csv.gz">click
 here</a>.  The file gets updated periodically; use
 <a href="https://developer.mozilla.org/en-US/docs/Web/HTTP/Conditional_requests"
->conditional requests</a> to check for updates.
-The QRank data is dedicated to the <b>Public Domain</b> via <a
+>conditional requests</a> to check for updates, or subscribe to the
+<a href="/feed.xml">Atom feed</a> that announces new releases.</p>
+`)
+	if _, found := ws.storage.Latest("qrank.sqlite"); found {
+		fmt.Fprintf(&body, "%s", `
+<p>For scripts, the ranking signals of all items are also available as
+a <a href="/download/qrank.sqlite">SQLite database</a>, with a table
+<code>item_signals</code> that is indexed by item, rank and class.
+For example, <code>SELECT item, rank FROM item_signals WHERE item = 'Q72'</code>
+tells the rank of Zürich.</p>
+`)
+	}
+	if churn, err := ws.readChurnSummary(); err != nil {
+		log.Printf("churn report: %v", err)
+	} else if churn != nil {
+		fmt.Fprint(&body, churn.html())
+	}
+	if ws.signingKey != nil {
+		fmt.Fprintf(&body, `
+<p>Every download comes with a detached <a href="https://jedisct1.github.io/minisign/">minisign</a>
+signature; append <code>.minisig</code> to its URL. The signatures
+can be checked with <a href="/minisign.pub">our public key</a>:<br/>
+<code>%s</code></p>
+`, ws.signingKey)
+	}
+	fmt.Fprintf(&body, "%s", `
+<p>The QRank data is dedicated to the <b>Public Domain</b> via <a
 href="https://creativecommons.org/publicdomain/zero/1.0/">Creative
 Commons Zero 1.0</a>. To the extent possible under law, we have waived
 all copyright and related or neighboring rights to this work. This work
@@ -96,14 +231,21 @@ Foundation in the United States.</p>
 width="88" height="31" alt="Public Domain" style="float:left"/></p>
 
 </body></html>`)
+	writeBody(w, r, "text/html; charset=utf-8", body.Bytes())
 }
 
+// MaxDownloadRanges is the maximal number of byte ranges that we serve
+// for a single request to /download.
+const maxDownloadRanges = 16
+
 func (ws *Webserver) HandleDownload(w http.ResponseWriter, req *http.Request) {
 	if !strings.HasPrefix(req.URL.Path, "/download/") {
 		http.NotFound(w, req)
 		return
 	}
 
+	h := w.Header()
+	setCORSHeaders(h)
 	path := strings.TrimPrefix(req.URL.Path, "/download/")
 	c, err := ws.storage.Retrieve(path)
 	if err != nil {
@@ -112,31 +254,133 @@ func (ws *Webserver) HandleDownload(w http.ResponseWriter, req *http.Request) {
 	}
 	defer c.Close()
 
+	if !checkMethod(w, req) {
+		return
+	}
+
+	// As per https://tools.ietf.org/html/rfc7232, ETag must have quotes.
+	h.Set("ETag", fmt.Sprintf(`"%s"`, c.ETag))
+	h.Set("Content-Type", c.ContentType)
+	if c.Immutable {
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	if ws.freshness != nil {
+		ws.freshness.SetDownloadHeader(h, path, c)
+	}
+	// Clients that resume a download ask for a single range, or maybe
+	// a few. Since every part of a multipart response comes with its
+	// own headers, serving thousands of tiny ranges would send far more
+	// than the file itself, so we serve the entire file instead, which
+	// is allowed by https://www.rfc-editor.org/rfc/rfc9110#section-14.2.
+	if strings.Count(req.Header.Get("Range"), ",") >= maxDownloadRanges {
+		req = req.Clone(req.Context())
+		req.Header.Del("Range")
+	}
+
+	// For resumed downloads, http.ServeContent checks If-Range against
+	// our ETag and Last-Modified, so a client never gets a range of a
+	// different file than the one it started with; if the validator
+	// does not match, it gets the entire current file.
+	cw := &countingResponseWriter{ResponseWriter: w}
+	http.ServeContent(cw, req, "", c.LastModified, c)
+	if req.Method == http.MethodGet && (cw.status == http.StatusOK || cw.status == http.StatusPartialContent) {
+		ws.access.recordDownload(req, c.Filename, cw.bytes)
+	}
+}
+
+// HandleLatest redirects requests for /latest/qrank.csv.gz to the dated
+// name of the live version, such as /download/qrank-20240601.csv.gz.
+// Scripts can keep using a stable URL, while caches and mirrors see
+// names whose content never changes.
+func (ws *Webserver) HandleLatest(w http.ResponseWriter, req *http.Request) {
 	h := w.Header()
-	switch req.Method {
-	case http.MethodHead:
-		fallthrough
-
-	case http.MethodGet:
-		// As per https://tools.ietf.org/html/rfc7232, ETag must have quotes.
-		h.Set("ETag", fmt.Sprintf(`"%s"`, c.ETag))
-		h.Set("Content-Type", c.ContentType)
-		h.Set("Access-Control-Allow-Origin", "*")
-		http.ServeContent(w, req, "", c.LastModified, c)
-
-	case http.MethodOptions: // CORS pre-flight
-		h.Set("Allow", "GET, HEAD, OPTIONS")
-		h.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
-		h.Set("Access-Control-Allow-Headers", "ETag, If-Match, If-None-Match, If-Modified-Since, If-Range, Range")
-		h.Set("Access-Control-Allow-Origin", "*")
-		h.Set("Access-Control-Expose-Headers", "ETag")
-		h.Set("Access-Control-Max-Age", "86400") // 1 day
-		w.WriteHeader(http.StatusNoContent)
-
-	default:
-		h.Set("Allow", "GET, HEAD, OPTIONS")
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	setCORSHeaders(h)
+	filename := strings.TrimPrefix(req.URL.Path, "/latest/")
+	dated, found := ws.storage.Latest(filename)
+	if !found {
+		http.NotFound(w, req)
+		return
+	}
+
+	if !checkMethod(w, req) {
+		return
 	}
+
+	// Unlike http.Redirect, we do not send a body with a link to the
+	// target; browsers follow the Location header anyway, and this way
+	// GET and HEAD responses only differ in the method.
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Location", "/download/"+dated)
+	w.WriteHeader(http.StatusFound)
+}
+
+var cogPathRegexp = regexp.MustCompile(`^/cog/(\d{1,2})/(\d{1,8})/(\d{1,8})\.(json|png)$`)
+
+// HandleCOG serves a tile of the latest OSMViews GeoTIFF, so casual
+// users can inspect the data without installing GDAL. Requests for
+// /cog/z/x/y.json return statistics about the tile's pixel values;
+// /cog/z/x/y.png returns a grayscale rendering of the tile.
+func (ws *Webserver) HandleCOG(w http.ResponseWriter, req *http.Request) {
+	m := cogPathRegexp.FindStringSubmatch(req.URL.Path)
+	if m == nil {
+		http.NotFound(w, req)
+		return
+	}
+	zoom, _ := strconv.Atoi(m[1])
+	x, _ := strconv.Atoi(m[2])
+	y, _ := strconv.Atoi(m[3])
+	format := m[4]
+
+	if !checkMethod(w, req) {
+		return
+	}
+
+	c, err := ws.storage.Retrieve("osmviews.tiff")
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer c.Close()
+
+	cog, err := newCogReader(c)
+	if err != nil {
+		log.Printf("cannot decode osmviews.tiff: %v", err)
+		http.Error(w, "cannot decode GeoTIFF", http.StatusInternalServerError)
+		return
+	}
+
+	pixels, err := cog.ReadTile(zoom, x, y)
+	if err != nil {
+		log.Printf("cannot decode tile %d/%d/%d of osmviews.tiff: %v", zoom, x, y, err)
+		http.Error(w, "cannot decode tile", http.StatusInternalServerError)
+		return
+	}
+	if pixels == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	h := w.Header()
+	var body bytes.Buffer
+	switch format {
+	case "json":
+		h.Set("Content-Type", "application/json")
+		stats := newTileStats(zoom, x, y, pixels)
+		if err := json.NewEncoder(&body).Encode(stats); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case "png":
+		h.Set("Content-Type", "image/png")
+		if err := png.Encode(&body, renderTile(pixels)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// As per https://tools.ietf.org/html/rfc7232, ETag must have quotes.
+	h.Set("ETag", fmt.Sprintf(`"%s-%d-%d-%d-%s"`, c.ETag, zoom, x, y, format))
+	http.ServeContent(w, req, "", c.LastModified, bytes.NewReader(body.Bytes()))
 }
 
 // HandleRobotsTxt sends a constant robots.txt file back to the
@@ -145,6 +389,26 @@ func (ws *Webserver) HandleDownload(w http.ResponseWriter, req *http.Request) {
 // a deny-all response and return that to the caller.
 func (ws *Webserver) HandleRobotsTxt(w http.ResponseWriter, r *http.Request) {
 	// https://wikitech.wikimedia.org/wiki/Help:Toolforge/Web#/robots.txt
-	w.Header().Set("Content-Type", "text/plain")
-	fmt.Fprintf(w, "%s", "User-Agent: *\nAllow: /\n")
+	if !checkMethod(w, r) {
+		return
+	}
+	writeBody(w, r, "text/plain", []byte("User-Agent: *\nAllow: /\n"))
+}
+
+// HandleSigningKey serves the public key for verifying the signatures
+// of downloads, in the format of minisign public key files.
+func (ws *Webserver) HandleSigningKey(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r) {
+		return
+	}
+	if ws.signingKey == nil {
+		http.NotFound(w, r)
+		return
+	}
+	text, err := ws.signingKey.MarshalText()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeBody(w, r, "text/plain", text)
 }
@@ -0,0 +1,32 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+//go:build !unix
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// MmapFile reads the first size bytes of a file into memory.
+// On platforms without mmap, this is only good enough for
+// development; in production, the webserver runs on Linux.
+func mmapFile(f *os.File, size int, writable bool) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(io.NewSectionReader(f, 0, int64(size)), data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// MunmapFile releases memory that was returned by mmapFile.
+// If writable is true, the data gets written back to the file.
+func munmapFile(f *os.File, data []byte, writable bool) error {
+	if writable {
+		_, err := f.WriteAt(data, 0)
+		return err
+	}
+	return nil
+}
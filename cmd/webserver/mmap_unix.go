@@ -0,0 +1,27 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// MmapFile maps the first size bytes of a file into memory.
+// If writable is true, changes to the returned bytes get written
+// back to the file.
+func mmapFile(f *os.File, size int, writable bool) ([]byte, error) {
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+	return syscall.Mmap(int(f.Fd()), 0, size, prot, syscall.MAP_SHARED)
+}
+
+// MunmapFile releases a mapping that was returned by mmapFile.
+func munmapFile(f *os.File, data []byte, writable bool) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,461 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/compress"
+	"github.com/brawer/wikidata-qrank/v2/pkg/qrank"
+)
+
+// RankIndexMagic is at the start of every rank index file.
+var rankIndexMagic = []byte("QRankIx2")
+
+// RankIndexHeaderSize is the size of the header of a rank index file:
+// the magic bytes, followed by the number of ranked items, the highest
+// item ID, the number of classes, and the number of class postings,
+// all as uint64.
+const rankIndexHeaderSize = 40
+
+// RankIndex gives random access to the ranking in qrank.csv.gz,
+// without having to keep the entire ranking in memory. The index
+// is a file in local storage that gets mapped into memory. After
+// the header, the file contains six arrays, all little-endian:
+//
+//   - qranks: uint64 QRank of the item at position i in the ranking;
+//   - items: uint32 ID of the item at position i in the ranking;
+//   - positions: uint32 one-based position in the ranking of
+//     item ID i, or zero if item ID i is not ranked;
+//   - classes: uint32 ID of the class (P31, “instance of”) of the
+//     item at position i in the ranking, or zero if unknown;
+//   - directory: for every class, sorted by class ID, three uint32
+//     for the class ID, the start of its postings, and their count;
+//   - postings: uint32 one-based positions of the items of each
+//     class, grouped by class and sorted by rank within each group.
+//
+// With about 120 million Wikidata items, the file is about 1.5 GiB,
+// but only the pages that get actually accessed need to be in memory.
+type rankIndex struct {
+	version       string // eg. "qrank-20240601.csv.gz"
+	classVersion  string // eg. "item_signals-20240601.csv.zst", or empty
+	data          []byte
+	numItems      int64
+	maxID         int64
+	numClasses    int64
+	classesStart  int64
+	classDirStart int64
+	postingsStart int64
+}
+
+// BuildRankIndex converts a gzipped QRank file into a rank index file.
+// The input gets read twice: first for finding the size of the index,
+// and then for filling it. The classes of the ranked items are taken
+// from signals, an item_signals file that may be compressed; if it
+// is nil, or if its schema has no class column, the index has no
+// classes.
+func buildRankIndex(r io.ReadSeeker, signals io.Reader, path string) error {
+	var numItems, maxID int64
+	err := scanRanking(r, func(id, qrank int64) error {
+		numItems += 1
+		maxID = max(maxID, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	l := newRankIndexLayout(numItems, maxID, 0, 0)
+	if err := f.Truncate(l.size); err != nil {
+		return err
+	}
+
+	data, err := mmapFile(f, int(l.size), true)
+	if err != nil {
+		return err
+	}
+	copy(data, rankIndexMagic)
+	binary.LittleEndian.PutUint64(data[8:16], uint64(numItems))
+	binary.LittleEndian.PutUint64(data[16:24], uint64(maxID))
+	var pos int64
+	err = scanRanking(r, func(id, qrank int64) error {
+		if pos >= numItems || id > maxID {
+			return fmt.Errorf("ranking changed while building index")
+		}
+		binary.LittleEndian.PutUint64(data[l.qranksStart+pos*8:], uint64(qrank))
+		binary.LittleEndian.PutUint32(data[l.itemsStart+pos*4:], uint32(id))
+		binary.LittleEndian.PutUint32(data[l.positionsStart+id*4:], uint32(pos+1))
+		pos += 1
+		return nil
+	})
+
+	// Fill the classes array, and count the ranked items per class.
+	counts := make(map[uint32]uint32, 1000)
+	if err == nil && signals != nil {
+		err = scanClasses(signals, func(id, class int64) error {
+			if id > maxID {
+				return nil
+			}
+			p := int64(binary.LittleEndian.Uint32(data[l.positionsStart+id*4:]))
+			if p == 0 {
+				return nil
+			}
+			binary.LittleEndian.PutUint32(data[l.classesStart+(p-1)*4:], uint32(class))
+			counts[uint32(class)] += 1
+			return nil
+		})
+	}
+	if err := munmapFile(f, data, true); err != nil {
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(counts) > 0 {
+		if err := buildClassPostings(f, numItems, maxID, counts); err != nil {
+			return err
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// BuildClassPostings extends a rank index file, whose classes array
+// has already been filled, by the class directory and the postings.
+func buildClassPostings(f *os.File, numItems, maxID int64, counts map[uint32]uint32) error {
+	classes := make([]uint32, 0, len(counts))
+	var numPostings int64
+	for class, count := range counts {
+		classes = append(classes, class)
+		numPostings += int64(count)
+	}
+	slices.Sort(classes)
+
+	l := newRankIndexLayout(numItems, maxID, int64(len(classes)), numPostings)
+	if err := f.Truncate(l.size); err != nil {
+		return err
+	}
+	data, err := mmapFile(f, int(l.size), true)
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(data[24:32], uint64(len(classes)))
+	binary.LittleEndian.PutUint64(data[32:40], uint64(numPostings))
+
+	next := make(map[uint32]uint32, len(classes))
+	var start uint32
+	for i, class := range classes {
+		entry := data[l.classDirStart+int64(i)*12:]
+		binary.LittleEndian.PutUint32(entry[0:4], class)
+		binary.LittleEndian.PutUint32(entry[4:8], start)
+		binary.LittleEndian.PutUint32(entry[8:12], counts[class])
+		next[class] = start
+		start += counts[class]
+	}
+
+	// Iterating over the ranking in order sorts the postings by rank.
+	for pos := int64(1); pos <= numItems; pos++ {
+		class := binary.LittleEndian.Uint32(data[l.classesStart+(pos-1)*4:])
+		if class == 0 {
+			continue
+		}
+		p := int64(next[class])
+		binary.LittleEndian.PutUint32(data[l.postingsStart+p*4:], uint32(pos))
+		next[class] += 1
+	}
+
+	return munmapFile(f, data, true)
+}
+
+// RankIndexLayout tells where the arrays of a rank index are located.
+type rankIndexLayout struct {
+	qranksStart, itemsStart, positionsStart          int64
+	classesStart, classDirStart, postingsStart, size int64
+}
+
+func newRankIndexLayout(numItems, maxID, numClasses, numPostings int64) rankIndexLayout {
+	var l rankIndexLayout
+	l.qranksStart = rankIndexHeaderSize
+	l.itemsStart = l.qranksStart + numItems*8
+	l.positionsStart = l.itemsStart + numItems*4
+	l.classesStart = l.positionsStart + (maxID+1)*4
+	l.classDirStart = l.classesStart + numItems*4
+	l.postingsStart = l.classDirStart + numClasses*12
+	l.size = l.postingsStart + numPostings*4
+	return l
+}
+
+// OpenRankIndex maps a rank index file into memory.
+func openRankIndex(path string, version, classVersion string) (*rankIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+	if size < rankIndexHeaderSize {
+		return nil, fmt.Errorf("%s: not a rank index", path)
+	}
+
+	data, err := mmapFile(f, int(size), false)
+	if err != nil {
+		return nil, err
+	}
+
+	numItems := int64(binary.LittleEndian.Uint64(data[8:16]))
+	maxID := int64(binary.LittleEndian.Uint64(data[16:24]))
+	numClasses := int64(binary.LittleEndian.Uint64(data[24:32]))
+	numPostings := int64(binary.LittleEndian.Uint64(data[32:40]))
+	if !bytes.Equal(data[0:8], rankIndexMagic) ||
+		numItems < 0 || numItems > math.MaxUint32 ||
+		maxID < 0 || maxID > math.MaxUint32 ||
+		numClasses < 0 || numClasses > numItems ||
+		numPostings < 0 || numPostings > numItems ||
+		size != newRankIndexLayout(numItems, maxID, numClasses, numPostings).size {
+		munmapFile(f, data, false)
+		return nil, fmt.Errorf("%s: not a rank index", path)
+	}
+
+	l := newRankIndexLayout(numItems, maxID, numClasses, numPostings)
+	idx := &rankIndex{
+		version:       version,
+		classVersion:  classVersion,
+		data:          data,
+		numItems:      numItems,
+		maxID:         maxID,
+		numClasses:    numClasses,
+		classesStart:  l.classesStart,
+		classDirStart: l.classDirStart,
+		postingsStart: l.postingsStart,
+	}
+	return idx, nil
+}
+
+// Close unmaps the index from memory. The caller must make sure that
+// nobody is accessing the index anymore.
+func (idx *rankIndex) Close() error {
+	data := idx.data
+	idx.data = nil
+	return munmapFile(nil, data, false)
+}
+
+// Len returns the number of ranked items.
+func (idx *rankIndex) Len() int64 {
+	return idx.numItems
+}
+
+// Lookup returns the one-based position in the ranking and the QRank
+// of an item, given its numeric ID. If the item is not ranked,
+// the returned position and QRank are zero.
+func (idx *rankIndex) Lookup(id int64) (int64, int64) {
+	if id <= 0 || id > idx.maxID {
+		return 0, 0
+	}
+	positionsStart := rankIndexHeaderSize + idx.numItems*12
+	pos := int64(binary.LittleEndian.Uint32(idx.data[positionsStart+id*4:]))
+	if pos == 0 {
+		return 0, 0
+	}
+	qrank := int64(binary.LittleEndian.Uint64(idx.data[rankIndexHeaderSize+(pos-1)*8:]))
+	return pos, qrank
+}
+
+// At returns the numeric item ID and the QRank of the item at a
+// one-based position in the ranking, which must be between 1 and Len().
+func (idx *rankIndex) At(pos int64) (int64, int64) {
+	qrank := int64(binary.LittleEndian.Uint64(idx.data[rankIndexHeaderSize+(pos-1)*8:]))
+	itemsStart := rankIndexHeaderSize + idx.numItems*8
+	id := int64(binary.LittleEndian.Uint32(idx.data[itemsStart+(pos-1)*4:]))
+	return id, qrank
+}
+
+// HasClasses returns true if the index knows the classes of items.
+func (idx *rankIndex) HasClasses() bool {
+	return idx.numClasses > 0
+}
+
+// Class returns the numeric item ID of the class of the item at
+// a one-based position in the ranking, or zero if the class is unknown.
+func (idx *rankIndex) Class(pos int64) int64 {
+	return int64(binary.LittleEndian.Uint32(idx.data[idx.classesStart+(pos-1)*4:]))
+}
+
+// ClassLen returns the number of ranked items in a class.
+func (idx *rankIndex) ClassLen(class int64) int64 {
+	_, count := idx.classPostings(class)
+	return count
+}
+
+// ClassPositions returns the one-based positions in the overall
+// ranking of the items in a class, skipping the offset best-ranked
+// ones and returning at most limit positions.
+func (idx *rankIndex) ClassPositions(class int64, offset, limit int64) []int64 {
+	start, count := idx.classPostings(class)
+	if offset >= count || limit <= 0 {
+		return nil
+	}
+	end := min(offset+limit, count)
+	result := make([]int64, 0, end-offset)
+	for i := start + offset; i < start+end; i++ {
+		pos := binary.LittleEndian.Uint32(idx.data[idx.postingsStart+i*4:])
+		result = append(result, int64(pos))
+	}
+	return result
+}
+
+// ClassPostings finds a class in the directory, returning the start
+// and count of its postings. If the class is unknown, count is zero.
+func (idx *rankIndex) classPostings(class int64) (int64, int64) {
+	if class <= 0 || class > math.MaxUint32 {
+		return 0, 0
+	}
+	entry := func(i int) []byte {
+		return idx.data[idx.classDirStart+int64(i)*12:]
+	}
+	i := sort.Search(int(idx.numClasses), func(i int) bool {
+		return int64(binary.LittleEndian.Uint32(entry(i))) >= class
+	})
+	if i >= int(idx.numClasses) || int64(binary.LittleEndian.Uint32(entry(i))) != class {
+		return 0, 0
+	}
+	e := entry(i)
+	return int64(binary.LittleEndian.Uint32(e[4:8])), int64(binary.LittleEndian.Uint32(e[8:12]))
+}
+
+// ScanRanking calls a function for every line of a gzipped QRank file,
+// whose first two columns are Entity and QRank, passing the numeric
+// item ID and the QRank. Lines starting with # are comments.
+func scanRanking(r io.Reader, fn func(id, qrank int64) error) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	scanner := bufio.NewScanner(gz)
+	header := true
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if header {
+			if !strings.HasPrefix(line, "Entity,QRank") {
+				return fmt.Errorf("unexpected header %q", line)
+			}
+			header = false
+			continue
+		}
+
+		cols := strings.SplitN(line, ",", 3)
+		if len(cols) < 2 {
+			return fmt.Errorf("bad line %q", line)
+		}
+		id, ok := parseItemID(cols[0])
+		if !ok {
+			return fmt.Errorf("bad line %q", line)
+		}
+		qrank, err := strconv.ParseInt(cols[1], 10, 64)
+		if err != nil || qrank < 0 {
+			return fmt.Errorf("bad line %q", line)
+		}
+		if err := fn(id, qrank); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// ScanClasses calls a function for every item in an item_signals file
+// that has a class, passing the numeric IDs of the item and its class.
+// The file may be compressed in any format known to internal/compress.
+// Merged items get skipped, since their signals are those of the item
+// they have been merged into, which gets reported on its own.
+func scanClasses(r io.Reader, fn func(id, class int64) error) error {
+	dec, err := compress.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	reader, err := qrank.NewItemSignalsReader(dec)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(reader.Schema().Columns, "class") {
+		return nil
+	}
+	for {
+		s, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if s.Class == "" || s.MergedInto != "" {
+			continue
+		}
+		id, ok := parseItemID(s.Item)
+		if !ok {
+			return fmt.Errorf("bad item %q", s.Item)
+		}
+		class, ok := parseItemID(s.Class)
+		if !ok {
+			return fmt.Errorf("%s: bad class %q", s.Item, s.Class)
+		}
+		if err := fn(id, class); err != nil {
+			return err
+		}
+	}
+}
+
+// ParseItemID parses a Wikidata item ID such as "Q72" into its
+// numeric part. Item IDs must fit into the uint32 slots of a rank
+// index; Wikidata currently is at about Q130000000.
+func parseItemID(s string) (int64, bool) {
+	if len(s) < 2 || s[0] != 'Q' || s[1] == '0' {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(s[1:], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return int64(id), true
+}
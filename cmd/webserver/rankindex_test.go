@@ -0,0 +1,188 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRankIndex(t *testing.T) {
+	data := gzipped("# version: 2024-05-01\n" +
+		"Entity,QRank,Percentile,Bucket\n" +
+		"Q5,900,99,10\nQ72,800,66,9\nQ1234,7,33,3\n")
+	path := filepath.Join(t.TempDir(), "qrank-20240501.idx")
+	if err := buildRankIndex(bytes.NewReader(data), nil, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); err == nil {
+		t.Errorf("temporary file %s.tmp should have been deleted", path)
+	}
+
+	idx, err := openRankIndex(path, "qrank-20240501.csv.gz", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	if got := idx.Len(); got != 3 {
+		t.Errorf("got Len()=%d, want 3", got)
+	}
+
+	for _, tc := range []struct {
+		id, rank, qrank int64
+	}{
+		{5, 1, 900},
+		{72, 2, 800},
+		{1234, 3, 7},
+		{1, 0, 0},
+		{73, 0, 0},
+		{1235, 0, 0},
+		{-1, 0, 0},
+	} {
+		rank, qrank := idx.Lookup(tc.id)
+		if rank != tc.rank || qrank != tc.qrank {
+			t.Errorf("Lookup(%d) = %d, %d; want %d, %d", tc.id, rank, qrank, tc.rank, tc.qrank)
+		}
+		if tc.rank > 0 {
+			id, qrank := idx.At(tc.rank)
+			if id != tc.id || qrank != tc.qrank {
+				t.Errorf("At(%d) = %d, %d; want %d, %d", tc.rank, id, qrank, tc.id, tc.qrank)
+			}
+		}
+	}
+}
+
+// TestItemSignals is an item_signals file for the ranking of TestRankIndex.
+// Q1 has no class, and Q100 is not ranked; Q73 got merged into Q72.
+const testItemSignals = "# schema: 5\n" +
+	"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes,pageviews_52w_max_wiki,class,merged_into\n" +
+	"Q1,1,0,0,0,0,0,0,0,0,,\n" +
+	"Q5,900,0,0,0,0,0,0,0,0,Q5,\n" +
+	"Q6,500,0,0,0,0,0,0,0,0,Q515,\n" +
+	"Q72,800,0,0,0,0,0,0,0,0,Q515,\n" +
+	"Q73,800,0,0,0,0,0,0,0,0,Q515,Q72\n" +
+	"Q100,3,0,0,0,0,0,0,0,0,Q515,\n" +
+	"Q1234,7,0,0,0,0,0,0,0,0,Q515,\n"
+
+func TestRankIndex_Classes(t *testing.T) {
+	data := gzipped("Entity,QRank\nQ5,900\nQ72,800\nQ6,500\nQ1,8\nQ1234,7\n")
+	path := filepath.Join(t.TempDir(), "qrank-20240501+item_signals-20240501.idx")
+	signals := strings.NewReader(testItemSignals)
+	if err := buildRankIndex(bytes.NewReader(data), signals, path); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := openRankIndex(path, "qrank-20240501.csv.gz", "item_signals-20240501.csv.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	if !idx.HasClasses() {
+		t.Error("HasClasses() should be true")
+	}
+	for pos, want := range []int64{5, 515, 515, 0, 515} {
+		if got := idx.Class(int64(pos + 1)); got != want {
+			t.Errorf("Class(%d) = %d, want %d", pos+1, got, want)
+		}
+	}
+	for _, tc := range []struct {
+		class, offset, limit int64
+		want                 []int64
+	}{
+		{515, 0, 10, []int64{2, 3, 5}},
+		{515, 1, 1, []int64{3}},
+		{515, 3, 10, nil},
+		{5, 0, 10, []int64{1}},
+		{6, 0, 10, nil},
+		{9999, 0, 10, nil},
+		{0, 0, 10, nil},
+	} {
+		got := idx.ClassPositions(tc.class, tc.offset, tc.limit)
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("ClassPositions(%d, %d, %d) = %v, want %v", tc.class, tc.offset, tc.limit, got, tc.want)
+		}
+	}
+	if got := idx.ClassLen(515); got != 3 {
+		t.Errorf("ClassLen(515) = %d, want 3", got)
+	}
+
+	// Lookups in the ranking still work.
+	if rank, qrank := idx.Lookup(1234); rank != 5 || qrank != 7 {
+		t.Errorf("Lookup(1234) = %d, %d; want 5, 7", rank, qrank)
+	}
+}
+
+func TestRankIndex_NoClasses(t *testing.T) {
+	data := gzipped("Entity,QRank\nQ5,900\n")
+	path := filepath.Join(t.TempDir(), "qrank-20240501.idx")
+	signals := strings.NewReader("item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks\nQ5,900,0,0,0,0\n")
+	if err := buildRankIndex(bytes.NewReader(data), signals, path); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := openRankIndex(path, "qrank-20240501.csv.gz", "item_signals-20240501.csv.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	if idx.HasClasses() {
+		t.Error("HasClasses() should be false for item signals without class column")
+	}
+	if got := idx.ClassPositions(5, 0, 10); got != nil {
+		t.Errorf("got %v, want nil", got)
+	}
+}
+
+func TestBuildRankIndex_BadInput(t *testing.T) {
+	for _, bad := range []string{
+		"Foo,Bar\n",
+		"Entity,QRank\nQ1,x\n",
+		"Entity,QRank\nQ1,-5\n",
+		"Entity,QRank\nL1,5\n",
+		"Entity,QRank\nQ99999999999,5\n",
+	} {
+		path := filepath.Join(t.TempDir(), "bad.idx")
+		if err := buildRankIndex(bytes.NewReader(gzipped(bad)), nil, path); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestOpenRankIndex_BadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.idx")
+	if err := os.WriteFile(path, []byte("QRankIx2 but truncated content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openRankIndex(path, "qrank-20240501.csv.gz", ""); err == nil {
+		t.Error("expected error for bad index file")
+	}
+}
+
+func TestParseItemID(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		id   int64
+		okay bool
+	}{
+		{"Q72", 72, true},
+		{"Q4294967295", 4294967295, true},
+		{"Q4294967296", 0, false},
+		{"Q0", 0, false},
+		{"Q072", 0, false},
+		{"Q+72", 0, false},
+		{"Q", 0, false},
+		{"P31", 0, false},
+		{"", 0, false},
+	} {
+		id, ok := parseItemID(tc.s)
+		if id != tc.id || ok != tc.okay {
+			t.Errorf("parseItemID(%q) = %d, %v; want %d, %v", tc.s, id, ok, tc.id, tc.okay)
+		}
+	}
+}
@@ -6,23 +6,35 @@ package main
 import (
 	"context"
 	"encoding/base32"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/objstore"
 )
 
 type Storage struct {
-	client  storageClient
-	workdir string
-	mutex   sync.RWMutex
-	files   map[string]*localFile
+	client   storageClient
+	workdir  string
+	required []string // files that must be live for being ready
+	mutex    sync.RWMutex
+	files    map[string]*localFile
+
+	// How loading from storage went, guarded by mutex.
+	status     map[string]*artifactStatus // filename → status
+	listErr    error                      // why listing last failed, or nil
+	listErrors int64                      // number of failed listings
+
+	// Dated files in storage as of the last listing, guarded by mutex.
+	published []publishedFile
 }
 
 // LocalFile represents a file in the local working directory,
@@ -32,6 +44,11 @@ type localFile struct {
 	ContentType  string
 	ETag         string
 	LastModified time.Time
+
+	// DatedName is the name of the stored object, such as
+	// "qrank-20240601.csv.gz" for the live version of "qrank.csv.gz".
+	// Since we never overwrite dated objects, its content is immutable.
+	DatedName string
 }
 
 // StorageClient is the subset of minio.Client used in this program.
@@ -42,96 +59,113 @@ type storageClient interface {
 }
 
 // NewStorage sets up a client for accessing S3-compatible object storage.
-func NewStorage(workdir string) (*Storage, error) {
+// The webserver is ready once the required files have been loaded.
+func NewStorage(workdir string, required []string) (*Storage, error) {
 	if err := os.MkdirAll(workdir, 0755); err != nil {
 		return nil, err
 	}
 
-	var config struct{ Endpoint, Key, Secret string }
-	config.Endpoint = os.Getenv("S3_ENDPOINT")
-	config.Key = os.Getenv("S3_KEY")
-	config.Secret = os.Getenv("S3_SECRET")
-
-	client, err := minio.New(config.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(config.Key, config.Secret, ""),
-		Secure: true,
-	})
+	config, err := objstore.ReadConfig("")
+	if err != nil {
+		return nil, err
+	}
+	client, err := objstore.NewRouter(config, "QRankWebserver")
 	if err != nil {
 		return nil, err
 	}
 
-	client.SetAppInfo("QRankWebserver", "0.1")
 	return &Storage{
-		client:  client,
-		workdir: workdir,
-		files:   make(map[string]*localFile, 10),
+		client:   client,
+		workdir:  workdir,
+		required: required,
+		files:    make(map[string]*localFile, 10),
+		status:   make(map[string]*artifactStatus, 10),
 	}, nil
 }
 
-var objRegexp = regexp.MustCompile(`public/([a-z_\-]+)\-(2[0-9]{7})\.([a-z0-9\.]+)`)
+var objRegexp = regexp.MustCompile(`public/([a-z0-9_\-\.]+)\-(2[0-9]{7})\.([a-z0-9\.]+)`)
+
+// PartRegexp matches the partitions of a dated directory, such as
+// the Parquet files of the item signals.
+var partRegexp = regexp.MustCompile(`^public/([a-z0-9_]+)\-(2[0-9]{7})/(part-[0-9]{4}\.parquet)$`)
+
+// ParseStorageKey splits the key of a dated object in storage into
+// its undated filename and its date. For example, the filename of
+// "public/qrank-20240601.csv.gz" is "qrank.csv.gz", and that of
+// "public/item_signals_parquet-20240601/part-0007.parquet" is
+// "item_signals_parquet/part-0007.parquet".
+func parseStorageKey(key string) (filename string, date string, ok bool) {
+	if m := partRegexp.FindStringSubmatch(key); m != nil {
+		return m[1] + "/" + m[3], m[2], true
+	}
+	if m := objRegexp.FindStringSubmatch(key); m != nil {
+		return fmt.Sprintf("%s.%s", m[1], m[3]), m[2], true
+	}
+	return "", "", false
+}
 
 // Reload caches public content from remote object storage to local disk.
 // Any old content (which is not live anymore) is deleted from local disk.
+// If a new version of a file cannot be loaded, for example because its
+// download does not match the digest in the stats file of its release,
+// the previous version stays live; the returned error lists such files.
 func (s *Storage) Reload(ctx context.Context) error {
-	// Find the most recent version of each file in storage.
+	// Find the most recent version of each file in storage,
+	// and the stats files of all releases. Listing is recursive,
+	// so that partitioned files get found too.
 	objects := s.client.ListObjects(ctx, "qrank", minio.ListObjectsOptions{
 		Prefix:    "public/",
-		Recursive: false,
+		Recursive: true,
 	})
 	inStorage := make(map[string]minio.ObjectInfo, 5)
+	stats := make(map[string]minio.ObjectInfo, 5)
+	published := make([]publishedFile, 0, 50)
 	for obj := range objects {
-		if m := objRegexp.FindStringSubmatch(obj.Key); m != nil {
-			filename := fmt.Sprintf("%s.%s", m[1], m[3])
+		if obj.Err != nil {
+			s.recordListError(obj.Err)
+			return obj.Err
+		}
+		if filename, date, ok := parseStorageKey(obj.Key); ok {
+			if filename == "qrank-stats.json" {
+				stats[date] = obj
+			}
+			published = append(published, publishedFile{
+				Filename:     filename,
+				DatedName:    strings.TrimPrefix(obj.Key, "public/"),
+				Date:         date,
+				Size:         obj.Size,
+				LastModified: obj.LastModified.UTC(),
+			})
 			info := inStorage[filename]
 			if obj.LastModified.After(info.LastModified) {
 				inStorage[filename] = obj
 			}
 		}
 	}
+	s.recordListError(nil)
+	s.recordPublished(published)
 
+	s.mutex.RLock()
+	old := s.files
+	s.mutex.RUnlock()
+
+	digests := newReleaseDigests(s.client, stats)
 	files := make(map[string]*localFile, len(inStorage))
+	var errs []error
 	for filename, obj := range inStorage {
-		mangled := base32.HexEncoding.EncodeToString([]byte(obj.ETag))
-		path, err := filepath.Abs(filepath.Join(
-			s.workdir,
-			fmt.Sprintf("%s-%s", mangled, filename)))
+		loc, err := s.load(ctx, filename, obj, digests)
 		if err != nil {
-			return err
-		}
-		if _, err := os.Stat(path); err != nil {
-			tmpPath := path + ".tmp"
-			if err := s.client.FGetObject(ctx, "qrank", obj.Key, tmpPath, minio.GetObjectOptions{}); err != nil {
-				return err
-			}
-			if err := os.Chtimes(tmpPath, time.Now(), obj.LastModified); err != nil {
-				return err
+			if ctx.Err() != nil {
+				return ctx.Err()
 			}
-			if err := os.Rename(tmpPath, path); err != nil {
-				return err
-			}
-		}
-
-		loc := &localFile{
-			LastModified: obj.LastModified.UTC(),
-			ContentType:  "application/octet-stream",
-			ETag:         obj.ETag,
-			Path:         path,
+			err = fmt.Errorf("cannot load %s: %w", obj.Key, err)
+			errs = append(errs, err)
+			loc = old[filename]
 		}
-
-		switch filepath.Ext(filename) {
-		case ".gz":
-			loc.ContentType = "application/gzip"
-		case ".json":
-			loc.ContentType = "application/json"
-		case ".tiff":
-			loc.ContentType = "image/tiff"
-		case ".txt":
-			loc.ContentType = "text/plain"
-		case ".zst":
-			loc.ContentType = "application/zstd"
+		if loc != nil {
+			files[filename] = loc
 		}
-
-		files[filename] = loc
+		s.recordLoad(filename, loc, err, time.Now())
 	}
 
 	live := make(map[string]bool, len(files))
@@ -169,7 +203,69 @@ func (s *Storage) Reload(ctx context.Context) error {
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
+}
+
+// Load returns the local copy of a stored object, downloading it
+// if there is none yet. Downloads get verified before they are
+// moved into place, so the local copies can be trusted.
+func (s *Storage) load(ctx context.Context, filename string, obj minio.ObjectInfo, digests *releaseDigests) (*localFile, error) {
+	mangled := base32.HexEncoding.EncodeToString([]byte(obj.ETag))
+	path, err := filepath.Abs(filepath.Join(
+		s.workdir,
+		fmt.Sprintf("%s-%s", mangled, strings.ReplaceAll(filename, "/", "-"))))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		want, err := digests.lookup(ctx, obj)
+		if err != nil {
+			return nil, err
+		}
+		tmpPath := path + ".tmp"
+		if err := s.client.FGetObject(ctx, "qrank", obj.Key, tmpPath, minio.GetObjectOptions{}); err != nil {
+			return nil, err
+		}
+		if err := verifyDownload(filename, tmpPath, want); err != nil {
+			os.Remove(tmpPath)
+			return nil, err
+		}
+		if err := os.Chtimes(tmpPath, time.Now(), obj.LastModified); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(tmpPath, path); err != nil {
+			return nil, err
+		}
+	}
+
+	loc := &localFile{
+		LastModified: obj.LastModified.UTC(),
+		ContentType:  "application/octet-stream",
+		ETag:         obj.ETag,
+		Path:         path,
+		DatedName:    strings.TrimPrefix(obj.Key, "public/"),
+	}
+
+	switch filepath.Ext(filename) {
+	case ".gz":
+		loc.ContentType = "application/gzip"
+	case ".json":
+		loc.ContentType = "application/json"
+	case ".minisig":
+		loc.ContentType = "text/plain"
+	case ".parquet":
+		loc.ContentType = "application/vnd.apache.parquet"
+	case ".sqlite":
+		loc.ContentType = "application/vnd.sqlite3"
+	case ".tiff":
+		loc.ContentType = "image/tiff"
+	case ".txt":
+		loc.ContentType = "text/plain"
+	case ".zst":
+		loc.ContentType = "application/zstd"
+	}
+
+	return loc, nil
 }
 
 func (s *Storage) Watch(ctx context.Context) error {
@@ -192,6 +288,8 @@ func (s *Storage) Watch(ctx context.Context) error {
 
 type Content struct {
 	f            *os.File
+	Filename     string // undated name, such as "qrank.csv.gz"
+	Immutable    bool   // whether retrieved by the dated name
 	ContentType  string
 	ETag         string
 	LastModified time.Time
@@ -205,15 +303,28 @@ func (c *Content) Seek(offset int64, whence int) (int64, error) {
 	return c.f.Seek(offset, whence)
 }
 
+func (c *Content) ReadAt(p []byte, off int64) (int, error) {
+	return c.f.ReadAt(p, off)
+}
+
 func (c *Content) Close() error {
 	return c.f.Close()
 }
 
-func (s *Storage) Retrieve(filename string) (*Content, error) {
+// Retrieve opens the live version of a file, given either its undated
+// name such as "qrank.csv.gz", or its dated name such as
+// "qrank-20240601.csv.gz". Only the live version can be retrieved
+// by its dated name; older versions are not kept.
+func (s *Storage) Retrieve(name string) (*Content, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	loc, found := s.files[filename]
+	filename, immutable := name, false
+	loc, found := s.files[name]
+	if !found {
+		filename, loc, found = s.findDated(name)
+		immutable = true
+	}
 	if !found {
 		return nil, fmt.Errorf("not found")
 	}
@@ -225,9 +336,36 @@ func (s *Storage) Retrieve(filename string) (*Content, error) {
 
 	c := &Content{
 		f:            f,
+		Filename:     filename,
+		Immutable:    immutable,
 		ContentType:  loc.ContentType,
 		ETag:         loc.ETag,
 		LastModified: loc.LastModified,
 	}
 	return c, nil
 }
+
+// FindDated finds a live file by its dated name. The caller must hold
+// s.mutex. There are only a handful of live files, so we do not bother
+// to keep an index.
+func (s *Storage) findDated(datedName string) (string, *localFile, bool) {
+	for filename, loc := range s.files {
+		if loc.DatedName != "" && loc.DatedName == datedName {
+			return filename, loc, true
+		}
+	}
+	return "", nil, false
+}
+
+// Latest returns the dated name of the live version of a file,
+// such as "qrank-20240601.csv.gz" for "qrank.csv.gz".
+func (s *Storage) Latest(filename string) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	loc, found := s.files[filename]
+	if !found || loc.DatedName == "" {
+		return "", false
+	}
+	return loc.DatedName, true
+}
@@ -53,6 +53,10 @@ func TestStorage_Reload(t *testing.T) {
 		t.Errorf("got ContentType=%s, want text/plain", loc.ContentType)
 	}
 
+	if loc.DatedName != "hello-20211229.txt" {
+		t.Errorf("got DatedName=%s, want hello-20211229.txt", loc.DatedName)
+	}
+
 	gotContent, err := os.ReadFile(loc.Path)
 	if err != nil {
 		t.Error(err)
@@ -145,11 +149,48 @@ func (s *fakeStorageClient) FGetObject(ctx context.Context, bucketName, objectNa
 	}
 }
 
+func TestParseStorageKey(t *testing.T) {
+	for _, tc := range []struct{ key, filename, date string }{
+		{"public/qrank-20240601.csv.gz", "qrank.csv.gz", "20240601"},
+		{"public/qrank-stats-20240601.json", "qrank-stats.json", "20240601"},
+		{"public/item_signals_parquet-20240601/part-0007.parquet", "item_signals_parquet/part-0007.parquet", "20240601"},
+		{"public/item_signals_parquet-20240601/other.txt", "", ""},
+		{"public/qrank.csv.gz", "", ""},
+	} {
+		filename, date, ok := parseStorageKey(tc.key)
+		if filename != tc.filename || date != tc.date || ok != (tc.filename != "") {
+			t.Errorf("%s: got (%q, %q, %v), want (%q, %q)", tc.key, filename, date, ok, tc.filename, tc.date)
+		}
+	}
+}
+
+func TestStorage_ReloadPartitions(t *testing.T) {
+	storage, client := newTestArtifactStorage(t)
+	client.publish("20240601", "Entity,QRank\nQ1,7\n", "")
+	client.objects["public/item_signals_parquet-20240601/part-0000.parquet"] = []byte("PAR1")
+	if err := storage.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"item_signals_parquet/part-0000.parquet", "item_signals_parquet-20240601/part-0000.parquet"} {
+		c, err := storage.Retrieve(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		c.Close()
+		if got, want := c.ContentType, "application/vnd.apache.parquet"; got != want {
+			t.Errorf("%s: got Content-Type %q, want %q", name, got, want)
+		}
+	}
+}
+
 func TestStorage_objRegexp(t *testing.T) {
 	for _, s := range []string{
 		"public/qrank-20220631.csv.gz",
 		"public/qrank-stats-20220631.json",
 		"public/osmviews-20220631.tiff",
+		"public/qrank-de.wikipedia-20220631.csv.gz",
+		"public/qrank-20220631.csv.gz.minisig",
 	} {
 		if !objRegexp.MatchString(s) {
 			t.Errorf("should match but does not: %v", s)
@@ -0,0 +1,254 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxTopItems is the number of top-ranked items that can be retrieved
+// via /api/v1/top. Deeper pages would require keeping the entire
+// ranking in memory; clients that need more should download the file.
+const maxTopItems = 10000
+
+// MaxTopLimit is the maximal number of items in one /api/v1/top response.
+const maxTopLimit = 1000
+
+// TopItem is one entry in the response of /api/v1/top.
+type topItem struct {
+	Rank   int64  `json:"rank"`   // 1 for the top item
+	Entity string `json:"entity"` // eg. "Q72"
+	QRank  int64  `json:"qrank"`
+}
+
+// TopResponse is the response of /api/v1/top.
+type topResponse struct {
+	Wiki   string    `json:"wiki,omitempty"`
+	Class  string    `json:"class,omitempty"`
+	Offset int       `json:"offset"`
+	Limit  int       `json:"limit"`
+	Items  []topItem `json:"items"`
+}
+
+// TopList is the head of a ranking file, parsed into memory.
+type topList struct {
+	etag  string
+	items []topItem
+}
+
+var wikiParamRegexp = regexp.MustCompile(`^[a-z0-9\-]+\.[a-z]+$`)
+
+// HandleTop serves the top-ranked items as JSON, for example
+// /api/v1/top?limit=100&offset=0. With &wiki=de.wikipedia,
+// the ranking is taken from the per-wiki file qrank-de.wikipedia.csv.gz,
+// if there is such a file in storage. With &class=Q5, only items
+// of that class (P31, “instance of”) are returned, keeping their
+// rank in the overall ranking; this needs the rank index.
+func (ws *Webserver) HandleTop(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/api/v1/top" {
+		http.NotFound(w, req)
+		return
+	}
+
+	if !checkMethod(w, req) {
+		return
+	}
+
+	query := req.URL.Query()
+	limit, err := intParam(query.Get("limit"), 100)
+	if err != nil || limit < 1 || limit > maxTopLimit {
+		http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxTopLimit), http.StatusBadRequest)
+		return
+	}
+	offset, err := intParam(query.Get("offset"), 0)
+	if err != nil || offset < 0 || offset+limit > maxTopItems {
+		http.Error(w, fmt.Sprintf("offset must be at least 0, and offset+limit at most %d", maxTopItems), http.StatusBadRequest)
+		return
+	}
+
+	if class := query.Get("class"); class != "" {
+		if query.Get("wiki") != "" {
+			http.Error(w, "class cannot be combined with wiki", http.StatusBadRequest)
+			return
+		}
+		ws.handleClassTop(w, req, class, offset, limit)
+		return
+	}
+
+	filename := "qrank.csv.gz"
+	wiki := query.Get("wiki")
+	if wiki != "" {
+		if !wikiParamRegexp.MatchString(wiki) {
+			http.Error(w, "bad wiki, expected a domain such as de.wikipedia", http.StatusBadRequest)
+			return
+		}
+		filename = fmt.Sprintf("qrank-%s.csv.gz", wiki)
+	}
+
+	c, err := ws.storage.Retrieve(filename)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	defer c.Close()
+
+	items, err := ws.topItems(filename, c)
+	if err != nil {
+		log.Printf("cannot read %s: %v", filename, err)
+		http.Error(w, "cannot read ranking", http.StatusInternalServerError)
+		return
+	}
+
+	resp := topResponse{Wiki: wiki, Offset: offset, Limit: limit, Items: []topItem{}}
+	if offset < len(items) {
+		resp.Items = items[offset:min(offset+limit, len(items))]
+	}
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// As per https://tools.ietf.org/html/rfc7232, ETag must have quotes.
+	h := w.Header()
+	h.Set("ETag", fmt.Sprintf(`"%s-top-%d-%d"`, c.ETag, offset, limit))
+	h.Set("Content-Type", "application/json")
+	if ws.freshness != nil {
+		ws.freshness.SetHeader(h)
+	}
+	http.ServeContent(w, req, "", c.LastModified, bytes.NewReader(body.Bytes()))
+}
+
+// HandleClassTop serves the top-ranked items of a class, taking them
+// from the per-class postings of the rank index.
+func (ws *Webserver) handleClassTop(w http.ResponseWriter, req *http.Request, class string, offset, limit int) {
+	classID, ok := parseItemID(class)
+	if !ok {
+		http.Error(w, "bad class, expected an item ID such as Q5", http.StatusBadRequest)
+		return
+	}
+	if ws.ranks == nil {
+		http.Error(w, "filtering by class is not enabled", http.StatusNotFound)
+		return
+	}
+
+	ws.ranks.mutex.RLock()
+	defer ws.ranks.mutex.RUnlock()
+	idx := ws.ranks.index
+	if idx == nil || !idx.HasClasses() {
+		http.Error(w, "class index not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	resp := topResponse{Class: class, Offset: offset, Limit: limit, Items: []topItem{}}
+	for _, pos := range idx.ClassPositions(classID, int64(offset), int64(limit)) {
+		id, qrank := idx.At(pos)
+		resp.Items = append(resp.Items, topItem{
+			Rank:   pos,
+			Entity: "Q" + strconv.FormatInt(id, 10),
+			QRank:  qrank,
+		})
+	}
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The index is immutable, so its versions make a good ETag.
+	h := w.Header()
+	h.Set("ETag", fmt.Sprintf(`"%s+%s-top-%s-%d-%d"`, idx.version, idx.classVersion, class, offset, limit))
+	h.Set("Content-Type", "application/json")
+	if ws.freshness != nil {
+		ws.freshness.SetHeader(h)
+	}
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(body.Bytes()))
+}
+
+// TopItems returns the head of a ranking file. The parsed items are
+// cached in memory until storage has a file with a different ETag.
+func (ws *Webserver) topItems(filename string, c *Content) ([]topItem, error) {
+	ws.topMutex.Lock()
+	defer ws.topMutex.Unlock()
+
+	if list, ok := ws.top[filename]; ok && list.etag == c.ETag {
+		return list.items, nil
+	}
+
+	items, err := readTopItems(c, maxTopItems)
+	if err != nil {
+		return nil, err
+	}
+	if ws.top == nil {
+		ws.top = make(map[string]*topList, 4)
+	}
+	ws.top[filename] = &topList{etag: c.ETag, items: items}
+	return items, nil
+}
+
+// ReadTopItems reads up to max items from a gzipped QRank file, whose
+// first two columns are Entity and QRank. Lines starting with # are
+// comments, such as the provenance of the file.
+func readTopItems(r io.Reader, max int) ([]topItem, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	items := make([]topItem, 0, 1000)
+	scanner := bufio.NewScanner(gz)
+	header := true
+	for len(items) < max && scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if header {
+			if !strings.HasPrefix(line, "Entity,QRank") {
+				return nil, fmt.Errorf("unexpected header %q", line)
+			}
+			header = false
+			continue
+		}
+
+		cols := strings.SplitN(line, ",", 3)
+		if len(cols) < 2 || !strings.HasPrefix(cols[0], "Q") {
+			return nil, fmt.Errorf("bad line %q", line)
+		}
+		qrank, err := strconv.ParseInt(cols[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad line %q", line)
+		}
+		items = append(items, topItem{
+			Rank:   int64(len(items) + 1),
+			Entity: cols[0],
+			QRank:  qrank,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// IntParam parses an integer query parameter, returning defaultValue
+// if the parameter is missing.
+func intParam(s string, defaultValue int) (int, error) {
+	if s == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(s)
+}
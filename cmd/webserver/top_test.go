@@ -0,0 +1,213 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebserver_Top(t *testing.T) {
+	ws := makeTestWebserver()
+	lastmod, _ := time.Parse(time.RFC3339, "2024-05-01T03:04:05Z")
+	for filename, content := range map[string]string{
+		"qrank.csv.gz": "# version: 2024-05-01\n" +
+			"Entity,QRank,Percentile,Bucket\n" +
+			"Q5,900,99,10\nQ72,800,66,9\nQ1234,7,33,3\n",
+		"qrank-rm.wikipedia.csv.gz": "Entity,QRank\nQ72,30\nQ5296,20\n",
+	} {
+		path := filepath.Join(t.TempDir(), filename)
+		if err := os.WriteFile(path, gzipped(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		ws.storage.files[filename] = &localFile{
+			Path:         path,
+			ContentType:  "application/gzip",
+			ETag:         "ETag-" + filename,
+			LastModified: lastmod,
+		}
+	}
+
+	get := func(path string) *http.Response {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		ws.HandleTop(w, req)
+		return w.Result()
+	}
+
+	for _, tc := range []struct {
+		path string
+		want string
+		etag string
+	}{
+		{
+			"/api/v1/top",
+			`{"offset":0,"limit":100,"items":[{"rank":1,"entity":"Q5","qrank":900},{"rank":2,"entity":"Q72","qrank":800},{"rank":3,"entity":"Q1234","qrank":7}]}`,
+			`"ETag-qrank.csv.gz-top-0-100"`,
+		},
+		{
+			"/api/v1/top?offset=1&limit=1",
+			`{"offset":1,"limit":1,"items":[{"rank":2,"entity":"Q72","qrank":800}]}`,
+			`"ETag-qrank.csv.gz-top-1-1"`,
+		},
+		{
+			"/api/v1/top?offset=50",
+			`{"offset":50,"limit":100,"items":[]}`,
+			`"ETag-qrank.csv.gz-top-50-100"`,
+		},
+		{
+			"/api/v1/top?wiki=rm.wikipedia&limit=1",
+			`{"wiki":"rm.wikipedia","offset":0,"limit":1,"items":[{"rank":1,"entity":"Q72","qrank":30}]}`,
+			`"ETag-qrank-rm.wikipedia.csv.gz-top-0-1"`,
+		},
+	} {
+		res := get(tc.path)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: got status %d, want %d", tc.path, res.StatusCode, http.StatusOK)
+			continue
+		}
+		var body bytes.Buffer
+		body.ReadFrom(res.Body)
+		if got := strings.TrimSpace(body.String()); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.path, got, tc.want)
+		}
+		if got := res.Header.Get("ETag"); got != tc.etag {
+			t.Errorf("%s: got ETag %s, want %s", tc.path, got, tc.etag)
+		}
+		if got := res.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("%s: got Content-Type %s, want application/json", tc.path, got)
+		}
+	}
+
+	for path, want := range map[string]int{
+		"/api/v1/top?limit=0":                    http.StatusBadRequest,
+		"/api/v1/top?limit=1001":                 http.StatusBadRequest,
+		"/api/v1/top?limit=x":                    http.StatusBadRequest,
+		"/api/v1/top?offset=-1":                  http.StatusBadRequest,
+		"/api/v1/top?offset=9950":                http.StatusBadRequest,
+		"/api/v1/top?wiki=../etc":                http.StatusBadRequest,
+		"/api/v1/top?wiki=de.wikipedia":          http.StatusNotFound,
+		"/api/v1/topx":                           http.StatusNotFound,
+		"/api/v1/top?offset=9900&limit=100&x=yz": http.StatusOK,
+	} {
+		if got := get(path).StatusCode; got != want {
+			t.Errorf("%s: got status %d, want %d", path, got, want)
+		}
+	}
+}
+
+func TestWebserver_TopClass(t *testing.T) {
+	ws := makeTestWebserver()
+	get := func(path string) *http.Response {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		ws.HandleTop(w, req)
+		return w.Result()
+	}
+
+	// Without a rank service, there is no filtering by class.
+	if got := get("/api/v1/top?class=Q515").StatusCode; got != http.StatusNotFound {
+		t.Errorf("got status %d without rank service, want %d", got, http.StatusNotFound)
+	}
+
+	var err error
+	ws.ranks, err = newRankService(ws.storage, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTestRanking(t, ws.storage, "qrank-20240501.csv.gz",
+		"Entity,QRank\nQ5,900\nQ72,800\nQ6,500\nQ1,8\nQ1234,7\n")
+	if err := ws.ranks.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := get("/api/v1/top?class=Q515").StatusCode; got != http.StatusServiceUnavailable {
+		t.Errorf("got status %d without item signals, want %d", got, http.StatusServiceUnavailable)
+	}
+
+	putTestItemSignals(t, ws.storage, "item_signals-20240501.csv.zst", testItemSignals)
+	if err := ws.ranks.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	res := get("/api/v1/top?class=Q515&offset=1&limit=5")
+	var body bytes.Buffer
+	body.ReadFrom(res.Body)
+	want := `{"class":"Q515","offset":1,"limit":5,"items":[{"rank":3,"entity":"Q6","qrank":500},{"rank":5,"entity":"Q1234","qrank":7}]}`
+	if got := strings.TrimSpace(body.String()); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	etag := `"qrank-20240501.csv.gz+item_signals-20240501.csv.zst-top-Q515-1-5"`
+	if got := res.Header.Get("ETag"); got != etag {
+		t.Errorf("got ETag %s, want %s", got, etag)
+	}
+
+	for path, want := range map[string]int{
+		"/api/v1/top?class=Q9999":                  http.StatusOK,
+		"/api/v1/top?class=515":                    http.StatusBadRequest,
+		"/api/v1/top?class=Q0515":                  http.StatusBadRequest,
+		"/api/v1/top?class=Q515&wiki=rm.wikipedia": http.StatusBadRequest,
+		"/api/v1/top?class=Q515&offset=9950":       http.StatusBadRequest,
+	} {
+		if got := get(path).StatusCode; got != want {
+			t.Errorf("%s: got status %d, want %d", path, got, want)
+		}
+	}
+}
+
+func TestWebserver_TopETagMatch(t *testing.T) {
+	ws := makeTestWebserver()
+	path := filepath.Join(t.TempDir(), "qrank.csv.gz")
+	if err := os.WriteFile(path, gzipped("Entity,QRank\nQ5,900\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ws.storage.files["qrank.csv.gz"] = &localFile{Path: path, ETag: "abc"}
+
+	req := httptest.NewRequest("GET", "/api/v1/top?limit=10", nil)
+	req.Header.Set("If-None-Match", `"abc-top-0-10"`)
+	w := httptest.NewRecorder()
+	ws.HandleTop(w, req)
+	if got := w.Result().StatusCode; got != http.StatusNotModified {
+		t.Errorf("got status %d, want %d", got, http.StatusNotModified)
+	}
+}
+
+func TestReadTopItems(t *testing.T) {
+	var data strings.Builder
+	data.WriteString("Entity,QRank\n")
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&data, "Q%d,%d\n", i+1, 100-i)
+	}
+	items, err := readTopItems(bytes.NewReader(gzipped(data.String())), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(items)
+	want := `[{"rank":1,"entity":"Q1","qrank":100},{"rank":2,"entity":"Q2","qrank":99},{"rank":3,"entity":"Q3","qrank":98},{"rank":4,"entity":"Q4","qrank":97},{"rank":5,"entity":"Q5","qrank":96}]`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	for _, bad := range []string{"Foo,Bar\n", "Entity,QRank\nQ1,x\n", "Entity,QRank\nfoo\n"} {
+		if _, err := readTopItems(bytes.NewReader(gzipped(bad)), 5); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func gzipped(s string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.Bytes()
+}
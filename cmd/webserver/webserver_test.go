@@ -4,14 +4,22 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/brawer/wikidata-qrank/v2/internal/minisign"
 )
 
 func sendRequest(method, path string, reqHeader http.Header) (status int, h http.Header, body []byte, err error) {
@@ -89,6 +97,133 @@ func TestWebserver_DownloadETagMatch(t *testing.T) {
 	}
 }
 
+func TestWebserver_DownloadRange(t *testing.T) {
+	for _, tc := range []struct {
+		rangeHeader, ifRange string
+		status               int
+		contentRange, body   string
+	}{
+		{"bytes=2-4", "", http.StatusPartialContent, "bytes 2-4/7", "nte"},
+		{"bytes=4-", "", http.StatusPartialContent, "bytes 4-6/7", "ent"},
+		{"bytes=-2", "", http.StatusPartialContent, "bytes 5-6/7", "nt"},
+
+		// Resuming with a matching validator gets the rest of the file.
+		{"bytes=3-", `"ETag-123"`, http.StatusPartialContent, "bytes 3-6/7", "tent"},
+		{"bytes=3-", "Tue, 21 Nov 2023 19:20:21 GMT", http.StatusPartialContent, "bytes 3-6/7", "tent"},
+
+		// If the file has changed, the client gets all of it.
+		{"bytes=3-", `"ETag-456"`, http.StatusOK, "", "Content"},
+		{"bytes=3-", `W/"ETag-123"`, http.StatusOK, "", "Content"},
+		{"bytes=3-", "Mon, 20 Nov 2023 19:20:21 GMT", http.StatusOK, "", "Content"},
+
+		{"bytes=9-", "", http.StatusRequestedRangeNotSatisfiable, "bytes */7", ""},
+	} {
+		rh := make(http.Header)
+		rh.Set("Range", tc.rangeHeader)
+		if tc.ifRange != "" {
+			rh.Set("If-Range", tc.ifRange)
+		}
+		status, header, body, err := sendRequest("GET", "/download/c.txt", rh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc := fmt.Sprintf("Range: %s, If-Range: %s", tc.rangeHeader, tc.ifRange)
+		if status != tc.status {
+			t.Errorf("%s: got status %d, want %d", desc, status, tc.status)
+		}
+		if got := header.Get("Content-Range"); got != tc.contentRange {
+			t.Errorf("%s: got Content-Range %q, want %q", desc, got, tc.contentRange)
+		}
+		if tc.status == http.StatusRequestedRangeNotSatisfiable {
+			continue
+		}
+		if string(body) != tc.body {
+			t.Errorf("%s: got body %q, want %q", desc, body, tc.body)
+		}
+		if got := header.Get("Accept-Ranges"); got != "bytes" {
+			t.Errorf("%s: got Accept-Ranges %q, want bytes", desc, got)
+		}
+	}
+}
+
+func TestWebserver_DownloadMultiRange(t *testing.T) {
+	rh := make(http.Header)
+	rh.Set("Range", "bytes=0-1,4-6")
+	rh.Set("If-Range", `"ETag-123"`)
+	status, header, body, err := sendRequest("GET", "/download/c.txt", rh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusPartialContent {
+		t.Errorf("got status %d, want %d", status, http.StatusPartialContent)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("got Content-Type %q, want multipart/byteranges", header.Get("Content-Type"))
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var got []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s %s %s", part.Header.Get("Content-Range"), part.Header.Get("Content-Type"), data))
+	}
+	want := []string{"bytes 0-1/7 text/plain Co", "bytes 4-6/7 text/plain ent"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got parts %q, want %q", got, want)
+	}
+
+	// With a mismatched validator, there are no parts.
+	rh.Set("If-Range", `"ETag-456"`)
+	status, header, body, err = sendRequest("GET", "/download/c.txt", rh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || header.Get("Content-Type") != "text/plain" || string(body) != "Content" {
+		t.Errorf("got status %d, Content-Type %q, body %q; want entire file", status, header.Get("Content-Type"), body)
+	}
+}
+
+func TestWebserver_DownloadTooManyRanges(t *testing.T) {
+	ws := makeTestWebserver()
+	path := filepath.Join(t.TempDir(), "big.txt")
+	content := strings.Repeat("0123456789", 100)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ws.storage.files["big.txt"] = &localFile{Path: path, ContentType: "text/plain", ETag: "big"}
+
+	get := func(numRanges int) *http.Response {
+		ranges := make([]string, numRanges)
+		for i := range ranges {
+			ranges[i] = fmt.Sprintf("%d-%d", i*10, i*10)
+		}
+		req := httptest.NewRequest("GET", "/download/big.txt", nil)
+		req.Header.Set("Range", "bytes="+strings.Join(ranges, ","))
+		w := httptest.NewRecorder()
+		ws.HandleDownload(w, req)
+		return w.Result()
+	}
+
+	if got := get(maxDownloadRanges).StatusCode; got != http.StatusPartialContent {
+		t.Errorf("%d ranges: got status %d, want %d", maxDownloadRanges, got, http.StatusPartialContent)
+	}
+	res := get(maxDownloadRanges + 1)
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != content {
+		t.Errorf("%d ranges: got status %d with %d bytes, want entire file", maxDownloadRanges+1, res.StatusCode, len(body))
+	}
+}
+
 func TestWebserver_DownloadNotFound(t *testing.T) {
 	rh := make(http.Header)
 	status, _, _, err := sendRequest("GET", "/download/unkown", rh)
@@ -136,7 +271,7 @@ func TestWebserver_DownloadOptions(t *testing.T) {
 		t.Errorf(`expected "Access-Control-Allow-Headers: %s", got "%s"`, want, got)
 	}
 
-	want = "ETag"
+	want = "Accept-Ranges, Content-Range, ETag, X-QRank-Data-Date"
 	if got := header.Get("Access-Control-Expose-Headers"); got != want {
 		t.Errorf(`expected "Access-Control-Expose-Headers: %s", got "%s"`, want, got)
 	}
@@ -183,6 +318,143 @@ func TestWebserver_DownloadMethodNotAllowed(t *testing.T) {
 	}
 }
 
+func makeDatedTestWebserver(t *testing.T) *Webserver {
+	storage := &Storage{
+		client:  &fakeStorageClient{},
+		workdir: t.TempDir(),
+		files:   make(map[string]*localFile, 10),
+	}
+	path := filepath.Join(storage.workdir, "qrank.csv.gz")
+	if err := os.WriteFile(path, []byte("QRank"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	storage.files["qrank.csv.gz"] = &localFile{
+		Path:        path,
+		ContentType: "application/gzip",
+		ETag:        "ETag-456",
+		DatedName:   "qrank-20240601.csv.gz",
+	}
+	return &Webserver{storage: storage}
+}
+
+func TestWebserver_Latest(t *testing.T) {
+	ws := makeDatedTestWebserver(t)
+	for _, method := range []string{"GET", "HEAD"} {
+		req := httptest.NewRequest(method, "/latest/qrank.csv.gz", nil)
+		w := httptest.NewRecorder()
+		ws.HandleLatest(w, req)
+		res := w.Result()
+		if res.StatusCode != http.StatusFound {
+			t.Errorf("%s: got status %d, want %d", method, res.StatusCode, http.StatusFound)
+		}
+		if got, want := res.Header.Get("Location"), "/download/qrank-20240601.csv.gz"; got != want {
+			t.Errorf("%s: got Location %q, want %q", method, got, want)
+		}
+	}
+
+	for _, path := range []string{"/latest/missing.csv.gz", "/latest/qrank-20240601.csv.gz"} {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		ws.HandleLatest(w, req)
+		if got := w.Result().StatusCode; got != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", path, got, http.StatusNotFound)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/latest/qrank.csv.gz", nil)
+	w := httptest.NewRecorder()
+	ws.HandleLatest(w, req)
+	if got := w.Result().StatusCode; got != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got status %d, want %d", got, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestWebserver_DownloadDated(t *testing.T) {
+	ws := makeDatedTestWebserver(t)
+	for _, tc := range []struct {
+		path, cacheControl string
+	}{
+		{"/download/qrank-20240601.csv.gz", "public, max-age=31536000, immutable"},
+		{"/download/qrank.csv.gz", ""},
+	} {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		w := httptest.NewRecorder()
+		ws.HandleDownload(w, req)
+		res := w.Result()
+		body, _ := io.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK || string(body) != "QRank" {
+			t.Errorf("%s: got status %d, body %q", tc.path, res.StatusCode, body)
+		}
+		if got := res.Header.Get("Cache-Control"); got != tc.cacheControl {
+			t.Errorf("%s: got Cache-Control %q, want %q", tc.path, got, tc.cacheControl)
+		}
+	}
+
+	// Older versions are not kept by the webserver.
+	req := httptest.NewRequest("GET", "/download/qrank-20240501.csv.gz", nil)
+	w := httptest.NewRecorder()
+	ws.HandleDownload(w, req)
+	if got := w.Result().StatusCode; got != http.StatusNotFound {
+		t.Errorf("got status %d for old version, want %d", got, http.StatusNotFound)
+	}
+}
+
+func TestWebserver_MainSQLite(t *testing.T) {
+	ws := makeDatedTestWebserver(t)
+	get := func() string {
+		w := httptest.NewRecorder()
+		ws.HandleMain(w, httptest.NewRequest("GET", "/", nil))
+		body, _ := io.ReadAll(w.Result().Body)
+		return string(body)
+	}
+	if strings.Contains(get(), "qrank.sqlite") {
+		t.Error("home page should not mention SQLite database before it is in storage")
+	}
+
+	ws.storage.files["qrank.sqlite"] = &localFile{
+		Path:        filepath.Join(ws.storage.workdir, "qrank.sqlite"),
+		ContentType: "application/vnd.sqlite3",
+		DatedName:   "qrank-20240601.sqlite",
+	}
+	if !strings.Contains(get(), `<a href="/download/qrank.sqlite">`) {
+		t.Error("home page should link to SQLite database")
+	}
+}
+
+func TestWebserver_SigningKey(t *testing.T) {
+	pub, _, err := minisign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(ws *Webserver, handler http.HandlerFunc, path string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		body, _ := io.ReadAll(w.Result().Body)
+		return w.Result().StatusCode, string(body)
+	}
+
+	ws := &Webserver{storage: testWebserver.storage, signingKey: pub}
+	status, body := get(ws, ws.HandleSigningKey, "/minisign.pub")
+	if status != http.StatusOK {
+		t.Errorf("got status %d, want %d", status, http.StatusOK)
+	}
+	if got, err := minisign.ParsePublicKey(body); err != nil || got.String() != pub.String() {
+		t.Errorf("got %q, want public key %s", body, pub)
+	}
+	if _, body := get(ws, ws.HandleMain, "/"); !strings.Contains(body, pub.String()) {
+		t.Errorf("home page should show public key %s", pub)
+	}
+
+	ws = &Webserver{storage: testWebserver.storage}
+	if status, _ := get(ws, ws.HandleSigningKey, "/minisign.pub"); status != http.StatusNotFound {
+		t.Errorf("got status %d without signing key, want %d", status, http.StatusNotFound)
+	}
+	if _, body := get(ws, ws.HandleMain, "/"); strings.Contains(body, "minisig") {
+		t.Error("home page should not mention signatures without signing key")
+	}
+}
+
 var testWebserver *Webserver = makeTestWebserver()
 
 func makeTestWebserver() *Webserver {
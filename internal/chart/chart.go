@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+// Package chart draws the simple charts of our plotting tools, either
+// as PNG raster images or as SVG vector graphics.
+//
+// The Canvas interface is a subset of fogleman/gg, so existing drawing
+// code keeps working when it gets switched from *gg.Context to Canvas.
+// For PNG, we simply draw with gg. For SVG, every drawing operation gets
+// translated to an SVG element; text is measured with the same font
+// face as for PNG, so both formats have the same layout.
+//
+// Because the tools also run in CI and on Wikimedia Toolforge, where
+// we do not want to ship font files, LoadFont falls back to the Go
+// fonts that are compiled into the binary.
+package chart
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// Format is the file format of a chart.
+type Format string
+
+const (
+	PNG Format = "png"
+	SVG Format = "svg"
+)
+
+// ParseFormat parses the value of a -format flag.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case PNG, SVG:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unsupported chart format %q, expected png or svg", s)
+	}
+}
+
+// FormatFromPath returns the format for a file path, based on its extension.
+func FormatFromPath(path string) (Format, error) {
+	return ParseFormat(strings.TrimPrefix(filepath.Ext(path), "."))
+}
+
+// Canvas is a surface for drawing a chart. Like in gg, paths are
+// built with MoveTo, LineTo and DrawCircle, and then get drawn
+// by Stroke or Fill in the current color.
+type Canvas interface {
+	SetRGB(r, g, b float64)
+	SetLineWidth(width float64)
+	Clear()
+
+	MoveTo(x, y float64)
+	LineTo(x, y float64)
+	DrawLine(x1, y1, x2, y2 float64)
+	DrawCircle(x, y, r float64)
+	Stroke()
+	Fill()
+
+	SetFont(f *Font)
+	MeasureString(s string) (w, h float64)
+	DrawString(s string, x, y float64)
+
+	Push()
+	Pop()
+	RotateAbout(angle, x, y float64)
+
+	// Save writes the chart to a file.
+	Save(path string) error
+}
+
+// NewCanvas returns a canvas for drawing a chart in the given format.
+func NewCanvas(format Format, width, height int) (Canvas, error) {
+	switch format {
+	case PNG:
+		return newPNGCanvas(width, height), nil
+	case SVG:
+		return newSVGCanvas(width, height), nil
+	default:
+		return nil, fmt.Errorf("unsupported chart format %q", format)
+	}
+}
+
+// Font is a font face at a particular size.
+type Font struct {
+	Face   font.Face
+	Family string  // font family name, used for SVG output
+	Size   float64 // in points
+}
+
+// LoadFont loads a TrueType font from a file. If path is empty,
+// the result is the Go Regular font, which is built into the binary.
+func LoadFont(path string, points float64) (*Font, error) {
+	data := goregular.TTF
+	if path != "" {
+		var err error
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := truetype.Parse(data)
+	if err != nil {
+		if path != "" {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return nil, err
+	}
+
+	face := truetype.NewFace(f, &truetype.Options{Size: points})
+	return &Font{Face: face, Family: f.Name(truetype.NameIDFontFamily), Size: points}, nil
+}
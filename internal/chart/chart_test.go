@@ -0,0 +1,173 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package chart
+
+import (
+	"encoding/xml"
+	"errors"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseFormat(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want Format
+		ok   bool
+	}{
+		{"png", PNG, true},
+		{"SVG", SVG, true},
+		{"", "", false},
+		{"gif", "", false},
+	} {
+		got, err := ParseFormat(tc.s)
+		if got != tc.want || (err == nil) != tc.ok {
+			t.Errorf("ParseFormat(%q): got %q, %v; want %q", tc.s, got, err, tc.want)
+		}
+	}
+
+	if got, err := FormatFromPath("/tmp/out.svg"); got != SVG || err != nil {
+		t.Errorf("FormatFromPath: got %q, %v; want svg", got, err)
+	}
+	if _, err := FormatFromPath("/tmp/out"); err == nil {
+		t.Error("FormatFromPath: expected error for path without extension")
+	}
+}
+
+func TestLoadFont(t *testing.T) {
+	f, err := LoadFont("", 18)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Family != "Go" || f.Size != 18 {
+		t.Errorf("got family %q size %v, want built-in Go font at 18", f.Family, f.Size)
+	}
+
+	if _, err := LoadFont(filepath.Join(t.TempDir(), "missing.ttf"), 18); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: got %v, want os.ErrNotExist", err)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.ttf")
+	if err := os.WriteFile(bad, []byte("not a font"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFont(bad, 18); err == nil {
+		t.Error("expected error for malformed font")
+	}
+}
+
+func TestCanvas(t *testing.T) {
+	dir := t.TempDir()
+	for _, format := range []Format{PNG, SVG} {
+		c, err := NewCanvas(format, 100, 80)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "chart."+string(format))
+		drawTestChart(t, c)
+		if err := c.Save(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, "chart.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 100 || b.Dy() != 80 {
+		t.Errorf("got PNG size %v, want 100×80", b)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "chart.svg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svg := string(data)
+	for _, want := range []string{
+		`<svg xmlns="http://www.w3.org/2000/svg" width="100" height="80" viewBox="0 0 100 80">`,
+		`<rect width="100" height="80" fill="#ffffff"/>`,
+		`<path d="M10 70L90 10.5" fill="none" stroke="#0066ff" stroke-width="2"/>`,
+		`<path d="M54 40A4 4 0 1 0 46 40A4 4 0 1 0 54 40Z" fill="#0066ff"/>`,
+		`font-family="Go, sans-serif" font-size="11" fill="#000000">Q&amp;A &lt;1&gt;</text>`,
+		`fill="#000000" transform="rotate(-90 50 40)">Views</text>`,
+	} {
+		if !strings.Contains(svg, want) {
+			t.Errorf("SVG output should contain %s, got:\n%s", want, svg)
+		}
+	}
+	if strings.Count(svg, "transform=") != 1 {
+		t.Errorf("Pop should have ended the rotation, got:\n%s", svg)
+	}
+
+	// Check that the output is well-formed XML.
+	decoder := xml.NewDecoder(strings.NewReader(svg))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMeasureString(t *testing.T) {
+	font, err := LoadFont("", 18)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes [][2]float64
+	for _, format := range []Format{PNG, SVG} {
+		c, err := NewCanvas(format, 10, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetFont(font)
+		w, h := c.MeasureString("Rank")
+		sizes = append(sizes, [2]float64{w, h})
+	}
+	if sizes[0] != sizes[1] {
+		t.Errorf("PNG measures %v, SVG measures %v", sizes[0], sizes[1])
+	}
+	if sizes[0][0] < 20 || math.IsNaN(sizes[0][0]) {
+		t.Errorf("implausible width %v", sizes[0][0])
+	}
+}
+
+func drawTestChart(t *testing.T, c Canvas) {
+	font, err := LoadFont("", 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetRGB(1, 1, 1)
+	c.Clear()
+	c.SetRGB(0, 0.4, 1)
+	c.SetLineWidth(2)
+	c.MoveTo(10, 70)
+	c.LineTo(90, 10.5)
+	c.Stroke()
+	c.DrawCircle(50, 40, 4)
+	c.Fill()
+
+	c.SetRGB(0, 0, 0)
+	c.SetFont(font)
+	c.DrawString("Q&A <1>", 5, 75)
+	c.Push()
+	c.RotateAbout(-math.Pi/2, 50, 40)
+	c.DrawString("Views", 50, 40)
+	c.Pop()
+	c.DrawString("Rank", 60, 75)
+}
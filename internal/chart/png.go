@@ -0,0 +1,26 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package chart
+
+import (
+	"github.com/fogleman/gg"
+)
+
+// PngCanvas draws a chart into a raster image. Most methods
+// of Canvas are directly implemented by the embedded gg.Context.
+type pngCanvas struct {
+	*gg.Context
+}
+
+func newPNGCanvas(width, height int) *pngCanvas {
+	return &pngCanvas{gg.NewContext(width, height)}
+}
+
+func (c *pngCanvas) SetFont(f *Font) {
+	c.SetFontFace(f.Face)
+}
+
+func (c *pngCanvas) Save(path string) error {
+	return c.SavePNG(path)
+}
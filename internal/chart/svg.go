@@ -0,0 +1,188 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package chart
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/font"
+)
+
+// SvgCanvas draws a chart as SVG vector graphics. Each call to Stroke
+// or Fill emits one <path> element for the path built since the last
+// call, and each call to DrawString emits one <text> element.
+type svgCanvas struct {
+	width, height int
+	body          bytes.Buffer
+	path          strings.Builder
+	hasCurrent    bool
+	state         svgState
+	stack         []svgState
+}
+
+// SvgState is the part of the drawing state that gets saved by Push.
+type svgState struct {
+	color     string
+	lineWidth float64
+	font      *Font
+	transform string
+}
+
+func newSVGCanvas(width, height int) *svgCanvas {
+	return &svgCanvas{
+		width:  width,
+		height: height,
+		state:  svgState{color: "#000000", lineWidth: 1},
+	}
+}
+
+func (c *svgCanvas) SetRGB(r, g, b float64) {
+	c.state.color = fmt.Sprintf("#%02x%02x%02x", colorByte(r), colorByte(g), colorByte(b))
+}
+
+func colorByte(v float64) int {
+	return int(math.Round(math.Max(0, math.Min(1, v)) * 255))
+}
+
+func (c *svgCanvas) SetLineWidth(width float64) {
+	c.state.lineWidth = width
+}
+
+func (c *svgCanvas) Clear() {
+	fmt.Fprintf(&c.body, `<rect width="%d" height="%d" fill="%s"/>`+"\n", c.width, c.height, c.state.color)
+}
+
+func (c *svgCanvas) MoveTo(x, y float64) {
+	fmt.Fprintf(&c.path, "M%s %s", svgNum(x), svgNum(y))
+	c.hasCurrent = true
+}
+
+// LineTo adds a line to the current path. Like in gg, a path without
+// a current point starts at the given point.
+func (c *svgCanvas) LineTo(x, y float64) {
+	if !c.hasCurrent {
+		c.MoveTo(x, y)
+		return
+	}
+	fmt.Fprintf(&c.path, "L%s %s", svgNum(x), svgNum(y))
+}
+
+func (c *svgCanvas) DrawLine(x1, y1, x2, y2 float64) {
+	c.MoveTo(x1, y1)
+	c.LineTo(x2, y2)
+}
+
+// DrawCircle adds a circle to the current path, made of two arcs
+// because a single SVG arc cannot start and end at the same point.
+func (c *svgCanvas) DrawCircle(x, y, r float64) {
+	rs := svgNum(r)
+	fmt.Fprintf(&c.path, "M%s %sA%s %s 0 1 0 %s %sA%s %s 0 1 0 %s %sZ",
+		svgNum(x+r), svgNum(y), rs, rs, svgNum(x-r), svgNum(y),
+		rs, rs, svgNum(x+r), svgNum(y))
+	c.hasCurrent = true
+}
+
+func (c *svgCanvas) Stroke() {
+	if c.path.Len() > 0 {
+		fmt.Fprintf(&c.body, `<path d="%s" fill="none" stroke="%s" stroke-width="%s"%s/>`+"\n",
+			c.path.String(), c.state.color, svgNum(c.state.lineWidth), c.transformAttr())
+	}
+	c.clearPath()
+}
+
+func (c *svgCanvas) Fill() {
+	if c.path.Len() > 0 {
+		fmt.Fprintf(&c.body, `<path d="%s" fill="%s"%s/>`+"\n",
+			c.path.String(), c.state.color, c.transformAttr())
+	}
+	c.clearPath()
+}
+
+func (c *svgCanvas) clearPath() {
+	c.path.Reset()
+	c.hasCurrent = false
+}
+
+func (c *svgCanvas) SetFont(f *Font) {
+	c.state.font = f
+}
+
+// MeasureString returns the same size as gg, which rounds the width
+// down to whole pixels, and whose height is the line height of the
+// font rather than that of the text.
+func (c *svgCanvas) MeasureString(s string) (w, h float64) {
+	if c.state.font == nil {
+		return 0, 0
+	}
+	face := c.state.font.Face
+	return float64(font.MeasureString(face, s) >> 6), float64(face.Metrics().Height) / 64
+}
+
+// DrawString draws text with its baseline at y, like in gg.
+func (c *svgCanvas) DrawString(s string, x, y float64) {
+	family, size := "sans-serif", 13.0
+	if f := c.state.font; f != nil {
+		size = f.Size
+		if f.Family != "" {
+			family = f.Family + ", sans-serif"
+		}
+	}
+
+	fmt.Fprintf(&c.body, `<text x="%s" y="%s" font-family="`, svgNum(x), svgNum(y))
+	xml.EscapeText(&c.body, []byte(family))
+	fmt.Fprintf(&c.body, `" font-size="%s" fill="%s"%s>`, svgNum(size), c.state.color, c.transformAttr())
+	xml.EscapeText(&c.body, []byte(s))
+	c.body.WriteString("</text>\n")
+}
+
+func (c *svgCanvas) Push() {
+	c.stack = append(c.stack, c.state)
+}
+
+func (c *svgCanvas) Pop() {
+	if n := len(c.stack); n > 0 {
+		c.state = c.stack[n-1]
+		c.stack = c.stack[:n-1]
+	}
+}
+
+// RotateAbout rotates subsequent drawing by angle radians around x, y.
+// With y pointing down, positive angles rotate clockwise in both gg and SVG.
+func (c *svgCanvas) RotateAbout(angle, x, y float64) {
+	rotate := fmt.Sprintf("rotate(%s %s %s)", svgNum(angle*180/math.Pi), svgNum(x), svgNum(y))
+	if c.state.transform == "" {
+		c.state.transform = rotate
+	} else {
+		c.state.transform += " " + rotate
+	}
+}
+
+func (c *svgCanvas) transformAttr() string {
+	if c.state.transform == "" {
+		return ""
+	}
+	return fmt.Sprintf(` transform="%s"`, c.state.transform)
+}
+
+func (c *svgCanvas) Save(path string) error {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n",
+		c.width, c.height, c.width, c.height)
+	buf.Write(c.body.Bytes())
+	buf.WriteString("</svg>\n")
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// SvgNum formats a coordinate with at most two decimals,
+// which is plenty for a chart and keeps the files small.
+func svgNum(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
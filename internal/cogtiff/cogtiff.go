@@ -0,0 +1,430 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+// Package cogtiff reads tiled TIFF files, such as the Cloud-Optimized
+// GeoTIFF produced by osmviews-builder.
+//
+// The reader is not a general-purpose TIFF decoder. It supports exactly
+// what we need for our own files: tiled images with one sample per pixel,
+// stored as 32-bit floating point numbers that are either uncompressed
+// or compressed with zlib/deflate. However, it does understand both
+// classic TIFF and BigTIFF in either byte order, and it can iterate
+// over all images in the file, so callers can access overview images.
+//
+// Because our files can be very large, the reader does not load any
+// tile data until it is needed. Likewise, the TileOffsets and
+// TileByteCounts arrays are only read in full when a caller asks
+// for them; looking up a single tile just reads its two entries.
+package cogtiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Reader gives access to the images of a TIFF file.
+type Reader struct {
+	r       io.ReaderAt
+	order   binary.ByteOrder
+	bigTIFF bool
+
+	// Images in the order in which they appear in the file.
+	// For Cloud-Optimized GeoTIFF, the first image has the
+	// highest resolution, followed by the overview images.
+	Images []*Image
+}
+
+// Image is a single image in a TIFF file, either the main image
+// or an overview (a subsampled version of the main image).
+type Image struct {
+	Width, Height         uint32
+	TileWidth, TileHeight uint32
+	BitsPerSample         uint16
+	Compression           uint16
+	SampleFormat          uint16
+	NewSubfileType        uint32 // 1 for overviews, 0 for the main image
+
+	reader         *Reader
+	tileOffsets    array
+	tileByteCounts array
+}
+
+// Array is the location of a TIFF array of unsigned integers.
+type array struct {
+	typ   uint16 // typeShort, typeLong or typeLong8
+	count uint64
+	pos   int64
+}
+
+const (
+	typeShort = 3
+	typeLong  = 4
+	typeLong8 = 16
+	typeIFD8  = 18
+
+	compressionNone    = 1
+	compressionDeflate = 8
+	compressionAdobe   = 32946 // old code for deflate, still used by some tools
+
+	sampleFormatUint  = 1
+	sampleFormatFloat = 3
+
+	// Limits that protect against malformed input.
+	maxImages    = 64
+	maxIFDLength = 1024
+	maxTileSize  = 16384
+)
+
+var ErrFormat = errors.New("cogtiff: unsupported format")
+
+// NewReader decodes the directory structure of a TIFF file.
+func NewReader(r io.ReaderAt) (*Reader, error) {
+	var header [16]byte
+	if _, err := r.ReadAt(header[0:8], 0); err != nil {
+		return nil, err
+	}
+
+	t := &Reader{r: r}
+	switch string(header[0:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, ErrFormat
+	}
+
+	var ifdPos uint64
+	switch t.order.Uint16(header[2:4]) {
+	case 42:
+		ifdPos = uint64(t.order.Uint32(header[4:8]))
+
+	case 43:
+		t.bigTIFF = true
+		if _, err := r.ReadAt(header[8:16], 8); err != nil {
+			return nil, err
+		}
+		if t.order.Uint16(header[4:6]) != 8 || t.order.Uint16(header[6:8]) != 0 {
+			return nil, ErrFormat
+		}
+		ifdPos = t.order.Uint64(header[8:16])
+
+	default:
+		return nil, ErrFormat
+	}
+
+	visited := make(map[uint64]bool, 20)
+	for ifdPos != 0 {
+		if len(t.Images) >= maxImages || visited[ifdPos] {
+			return nil, fmt.Errorf("cogtiff: bad chain of image file directories")
+		}
+		visited[ifdPos] = true
+		img, next, err := t.readIFD(int64(ifdPos))
+		if err != nil {
+			return nil, err
+		}
+		t.Images = append(t.Images, img)
+		ifdPos = next
+	}
+
+	if len(t.Images) == 0 {
+		return nil, fmt.Errorf("cogtiff: no images")
+	}
+
+	return t, nil
+}
+
+// BigTIFF returns true if the file is in BigTIFF format.
+func (t *Reader) BigTIFF() bool {
+	return t.bigTIFF
+}
+
+// Overviews returns the overview images, which are all images except
+// the first one. For our GeoTIFFs, they are in order of decreasing
+// resolution.
+func (t *Reader) Overviews() []*Image {
+	return t.Images[1:]
+}
+
+// ReadIFD decodes the image file directory at pos, and returns
+// the image together with the position of the next directory,
+// or 0 if this was the last one.
+func (t *Reader) readIFD(pos int64) (*Image, uint64, error) {
+	countSize, entrySize, nextSize := int64(2), int64(12), int64(4)
+	if t.bigTIFF {
+		countSize, entrySize, nextSize = 8, 20, 8
+	}
+
+	var buf [20]byte
+	if _, err := t.r.ReadAt(buf[0:countSize], pos); err != nil {
+		return nil, 0, err
+	}
+	var numEntries uint64
+	if t.bigTIFF {
+		numEntries = t.order.Uint64(buf[0:8])
+	} else {
+		numEntries = uint64(t.order.Uint16(buf[0:2]))
+	}
+	if numEntries > maxIFDLength {
+		return nil, 0, fmt.Errorf("cogtiff: image file directory too long")
+	}
+
+	img := &Image{reader: t, Compression: compressionNone, BitsPerSample: 1}
+	entries := make([]byte, int64(numEntries)*entrySize+nextSize)
+	if _, err := t.r.ReadAt(entries, pos+countSize); err != nil {
+		return nil, 0, err
+	}
+
+	for i := uint64(0); i < numEntries; i++ {
+		e := entries[int64(i)*entrySize : int64(i+1)*entrySize]
+		entryPos := pos + countSize + int64(i)*entrySize
+		tag := t.order.Uint16(e[0:2])
+		typ := t.order.Uint16(e[2:4])
+
+		var count uint64
+		var valueField []byte
+		if t.bigTIFF {
+			count = t.order.Uint64(e[4:12])
+			valueField = e[12:20]
+		} else {
+			count = uint64(t.order.Uint32(e[4:8]))
+			valueField = e[8:12]
+		}
+
+		arr, err := t.makeArray(typ, count, valueField, entryPos+(entrySize-int64(len(valueField))))
+		if err != nil {
+			continue // not an integer array; we do not need it
+		}
+
+		var value uint64
+		if count == 1 {
+			if arr.elementSize() <= int64(len(valueField)) {
+				value = t.scalar(typ, valueField)
+			} else if value, err = t.get(arr, 0); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		switch tag {
+		case 254: // NewSubfileType
+			img.NewSubfileType = uint32(value)
+		case 256: // ImageWidth
+			img.Width = uint32(value)
+		case 257: // ImageLength
+			img.Height = uint32(value)
+		case 258: // BitsPerSample
+			img.BitsPerSample = uint16(value)
+		case 259: // Compression
+			img.Compression = uint16(value)
+		case 322: // TileWidth
+			img.TileWidth = uint32(value)
+		case 323: // TileLength
+			img.TileHeight = uint32(value)
+		case 324: // TileOffsets
+			img.tileOffsets = arr
+		case 325: // TileByteCounts
+			img.tileByteCounts = arr
+		case 339: // SampleFormat
+			img.SampleFormat = uint16(value)
+		}
+	}
+
+	if img.TileWidth == 0 || img.TileHeight == 0 || img.TileWidth > maxTileSize || img.TileHeight > maxTileSize {
+		return nil, 0, fmt.Errorf("cogtiff: not a tiled image")
+	}
+	numTiles := uint64(img.TilesAcross()) * uint64(img.TilesDown())
+	if img.tileOffsets.count != numTiles || img.tileByteCounts.count != numTiles {
+		return nil, 0, fmt.Errorf("cogtiff: expected %d tiles, got %d offsets and %d byte counts",
+			numTiles, img.tileOffsets.count, img.tileByteCounts.count)
+	}
+
+	next := entries[int64(numEntries)*entrySize:]
+	if t.bigTIFF {
+		return img, t.order.Uint64(next), nil
+	} else {
+		return img, uint64(t.order.Uint32(next)), nil
+	}
+}
+
+// MakeArray returns the location of an integer array. If the array
+// fits into the value field of its directory entry, it is stored inline.
+func (t *Reader) makeArray(typ uint16, count uint64, valueField []byte, valuePos int64) (array, error) {
+	var size uint64
+	switch typ {
+	case typeShort:
+		size = 2
+	case typeLong:
+		size = 4
+	case typeLong8, typeIFD8:
+		size = 8
+	default:
+		return array{}, ErrFormat
+	}
+	if count > (1<<62)/size {
+		return array{}, ErrFormat
+	}
+
+	if count*size <= uint64(len(valueField)) {
+		return array{typ: typ, count: count, pos: valuePos}, nil
+	}
+
+	var pos uint64
+	if t.bigTIFF {
+		pos = t.order.Uint64(valueField)
+	} else {
+		pos = uint64(t.order.Uint32(valueField))
+	}
+	if pos > 1<<62 {
+		return array{}, ErrFormat
+	}
+	return array{typ: typ, count: count, pos: int64(pos)}, nil
+}
+
+func (t *Reader) scalar(typ uint16, b []byte) uint64 {
+	switch typ {
+	case typeShort:
+		return uint64(t.order.Uint16(b))
+	case typeLong:
+		return uint64(t.order.Uint32(b))
+	default:
+		return t.order.Uint64(b)
+	}
+}
+
+func (a array) elementSize() int64 {
+	switch a.typ {
+	case typeShort:
+		return 2
+	case typeLong:
+		return 4
+	default:
+		return 8
+	}
+}
+
+// Get reads the array element at index i.
+func (t *Reader) get(a array, i uint64) (uint64, error) {
+	if i >= a.count {
+		return 0, fmt.Errorf("cogtiff: index %d out of range", i)
+	}
+	var buf [8]byte
+	size := a.elementSize()
+	if _, err := t.r.ReadAt(buf[0:size], a.pos+int64(i)*size); err != nil {
+		return 0, err
+	}
+	return t.scalar(a.typ, buf[0:size]), nil
+}
+
+// ReadAll reads an entire array. To avoid allocating huge amounts
+// of memory for malformed input, the array is read in chunks.
+func (t *Reader) readAll(a array) ([]uint64, error) {
+	const chunkLen = 64 * 1024
+	size := a.elementSize()
+	result := make([]uint64, 0, min(a.count, chunkLen))
+	buf := make([]byte, chunkLen*size)
+	for i := uint64(0); i < a.count; i += chunkLen {
+		n := min(a.count-i, chunkLen)
+		chunk := buf[0 : int64(n)*size]
+		if _, err := t.r.ReadAt(chunk, a.pos+int64(i)*size); err != nil {
+			return nil, err
+		}
+		for j := int64(0); j < int64(n); j++ {
+			result = append(result, t.scalar(a.typ, chunk[j*size:(j+1)*size]))
+		}
+	}
+	return result, nil
+}
+
+// TilesAcross returns the number of tiles in horizontal direction.
+func (img *Image) TilesAcross() uint32 {
+	return uint32((uint64(img.Width) + uint64(img.TileWidth) - 1) / uint64(img.TileWidth))
+}
+
+// TilesDown returns the number of tiles in vertical direction.
+func (img *Image) TilesDown() uint32 {
+	return uint32((uint64(img.Height) + uint64(img.TileHeight) - 1) / uint64(img.TileHeight))
+}
+
+// NumTiles returns the number of tiles in the image.
+func (img *Image) NumTiles() int {
+	return int(img.tileOffsets.count)
+}
+
+// TileOffsets reads the file position of every tile. Tiles that share
+// the same offset also share the same data.
+func (img *Image) TileOffsets() ([]uint64, error) {
+	return img.reader.readAll(img.tileOffsets)
+}
+
+// TileLocation returns the file position and compressed size of a tile.
+func (img *Image) TileLocation(index int) (offset, size uint64, err error) {
+	if index < 0 {
+		return 0, 0, fmt.Errorf("cogtiff: index %d out of range", index)
+	}
+	if offset, err = img.reader.get(img.tileOffsets, uint64(index)); err != nil {
+		return 0, 0, err
+	}
+	if size, err = img.reader.get(img.tileByteCounts, uint64(index)); err != nil {
+		return 0, 0, err
+	}
+	return offset, size, nil
+}
+
+// ReadTile decodes the pixels of a tile into data, which must have
+// room for TileWidth × TileHeight samples. Tiles are numbered
+// in row-major order, starting at the top left. Besides 32-bit floats,
+// images may have 16-bit unsigned integer samples, which get converted
+// to float without any scaling.
+func (img *Image) ReadTile(index int, data []float32) error {
+	isFloat := img.BitsPerSample == 32 && img.SampleFormat == sampleFormatFloat
+	isUint16 := img.BitsPerSample == 16 && (img.SampleFormat == sampleFormatUint || img.SampleFormat == 0)
+	if !isFloat && !isUint16 {
+		return ErrFormat
+	}
+	if len(data) != int(img.TileWidth)*int(img.TileHeight) {
+		return fmt.Errorf("cogtiff: got buffer for %d samples, want %d", len(data), img.TileWidth*img.TileHeight)
+	}
+
+	offset, size, err := img.TileLocation(index)
+	if err != nil {
+		return err
+	}
+	if offset > 1<<62 || size > 1<<62 {
+		return ErrFormat
+	}
+
+	var reader io.Reader = io.NewSectionReader(img.reader.r, int64(offset), int64(size))
+	switch img.Compression {
+	case compressionNone:
+	case compressionDeflate, compressionAdobe:
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, reader); err != nil {
+			return err
+		}
+		zr, err := zlib.NewReader(&buf)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		reader = zr
+	default:
+		return ErrFormat
+	}
+
+	if isUint16 {
+		samples := make([]uint16, len(data))
+		if err := binary.Read(reader, img.reader.order, samples); err != nil {
+			return err
+		}
+		for i, s := range samples {
+			data[i] = float32(s)
+		}
+		return nil
+	}
+
+	return binary.Read(reader, img.reader.order, data)
+}
@@ -0,0 +1,283 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package cogtiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	for _, tc := range []struct {
+		bigTIFF    bool
+		order      binary.ByteOrder
+		offsetType uint16
+	}{
+		{false, binary.LittleEndian, typeLong},
+		{false, binary.BigEndian, typeLong},
+		{false, binary.LittleEndian, typeShort},
+		{true, binary.LittleEndian, typeLong8},
+		{true, binary.BigEndian, typeLong8},
+		{true, binary.LittleEndian, typeLong},
+	} {
+		name := fmt.Sprintf("bigTIFF=%v,order=%v,type=%d", tc.bigTIFF, tc.order, tc.offsetType)
+		t.Run(name, func(t *testing.T) {
+			data := makeTestTIFF(tc.bigTIFF, tc.order, tc.offsetType)
+			r, err := NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.BigTIFF() != tc.bigTIFF {
+				t.Errorf("got BigTIFF()=%v, want %v", r.BigTIFF(), tc.bigTIFF)
+			}
+			if len(r.Images) != 2 || len(r.Overviews()) != 1 {
+				t.Fatalf("got %d images, want 2", len(r.Images))
+			}
+
+			main, overview := r.Images[0], r.Images[1]
+			if main.Width != 32 || main.Height != 32 || main.TilesAcross() != 2 || main.TilesDown() != 2 {
+				t.Errorf("main image: got %+v", main)
+			}
+			if overview.Width != 16 || overview.NumTiles() != 1 || overview.NewSubfileType != 1 {
+				t.Errorf("overview: got %+v", overview)
+			}
+
+			offsets, err := main.TileOffsets()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(offsets) != 4 || offsets[1] != offsets[2] {
+				t.Errorf("got tile offsets %v, want 4 offsets with tiles 1 and 2 shared", offsets)
+			}
+
+			tile := make([]float32, 16*16)
+			for i, want := range []float32{1, 2, 2, 4} {
+				if err := main.ReadTile(i, tile); err != nil {
+					t.Fatal(err)
+				}
+				if tile[0] != want || tile[255] != want {
+					t.Errorf("tile %d: got %v, want %v", i, tile[0], want)
+				}
+			}
+			if err := overview.ReadTile(0, tile); err != nil {
+				t.Fatal(err)
+			}
+			if tile[0] != 7 {
+				t.Errorf("overview: got %v, want 7", tile[0])
+			}
+
+			if err := main.ReadTile(4, tile); err == nil {
+				t.Error("expected error for tile out of range")
+			}
+			if err := main.ReadTile(0, tile[0:10]); err == nil {
+				t.Error("expected error for short buffer")
+			}
+		})
+	}
+}
+
+func TestReader_BadInput(t *testing.T) {
+	for _, data := range [][]byte{
+		[]byte{},
+		[]byte("GIF89a"),
+		[]byte{'I', 'I', 42, 0, 0xff, 0xff, 0, 0},
+		[]byte{'I', 'I', 42, 0, 0, 0, 0, 0},
+		[]byte{'I', 'I', 43, 0, 4, 0, 0, 0, 16, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{'I', 'I', 42, 0, 8, 0, 0, 0, 0, 0, 8, 0, 0, 0},
+		makeTestTIFF(false, binary.LittleEndian, typeLong)[0:60],
+		makeTestTIFF(true, binary.BigEndian, typeLong8)[0:60],
+	} {
+		if _, err := NewReader(bytes.NewReader(data)); err == nil {
+			t.Errorf("expected error for %q", data)
+		}
+	}
+}
+
+func FuzzNewReader(f *testing.F) {
+	f.Add(makeTestTIFF(false, binary.LittleEndian, typeLong))
+	f.Add(makeTestTIFF(false, binary.BigEndian, typeShort))
+	f.Add(makeTestTIFF(true, binary.LittleEndian, typeLong8))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, err := NewReader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		for _, img := range r.Images {
+			if _, err := img.TileOffsets(); err != nil {
+				continue
+			}
+			tile := make([]float32, int(img.TileWidth)*int(img.TileHeight))
+			for i := 0; i < img.NumTiles() && i < 4; i++ {
+				_ = img.ReadTile(i, tile)
+			}
+		}
+	})
+}
+
+func TestMakeArray_Inline(t *testing.T) {
+	r := &Reader{order: binary.LittleEndian}
+	got, err := r.makeArray(typeShort, 2, []byte{1, 0, 2, 0}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := array{typ: typeShort, count: 2, pos: 100}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	got, err = r.makeArray(typeLong, 2, []byte{0x34, 0x12, 0, 0}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = array{typ: typeLong, count: 2, pos: 0x1234}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if _, err := r.makeArray(2, 1, []byte{0, 0, 0, 0}, 100); err == nil {
+		t.Error("expected error for ASCII type")
+	}
+}
+
+// MakeTestTIFF returns a small tiled TIFF with two images. The main
+// image is 32×32 pixels, split into four 16×16 tiles whose pixels
+// have values 1, 2, 2 and 4; the two tiles with value 2 share
+// the same data. The overview image is 16×16 pixels with value 7.
+// TileOffsets and TileByteCounts are stored as offsetType.
+func makeTestTIFF(bigTIFF bool, order binary.ByteOrder, offsetType uint16) []byte {
+	type entry struct {
+		tag, typ uint16
+		values   []uint64
+	}
+	type level struct {
+		width   uint64
+		subfile uint64
+		tiles   []float32
+	}
+	levels := []level{{32, 0, []float32{1, 2, 2, 4}}, {16, 1, []float32{7}}}
+
+	// Tile data goes at the start of the file, directly after the header.
+	headerSize := uint64(8)
+	if bigTIFF {
+		headerSize = 16
+	}
+	var data bytes.Buffer
+	offsets := make([][]uint64, len(levels))
+	sizes := make([][]uint64, len(levels))
+	for i, lev := range levels {
+		seen := make(map[float32]int)
+		for _, v := range lev.tiles {
+			if j, ok := seen[v]; ok {
+				offsets[i] = append(offsets[i], offsets[i][j])
+				sizes[i] = append(sizes[i], sizes[i][j])
+				continue
+			}
+			pixels := make([]float32, 16*16)
+			for k := range pixels {
+				pixels[k] = v
+			}
+			var compressed bytes.Buffer
+			w := zlib.NewWriter(&compressed)
+			binary.Write(w, order, pixels)
+			w.Close()
+			seen[v] = len(offsets[i])
+			offsets[i] = append(offsets[i], headerSize+uint64(data.Len()))
+			sizes[i] = append(sizes[i], uint64(compressed.Len()))
+			data.Write(compressed.Bytes())
+		}
+	}
+
+	var buf bytes.Buffer
+	put := func(size int, v uint64) {
+		switch size {
+		case 2:
+			binary.Write(&buf, order, uint16(v))
+		case 4:
+			binary.Write(&buf, order, uint32(v))
+		case 8:
+			binary.Write(&buf, order, v)
+		}
+	}
+	typeSize := map[uint16]int{typeShort: 2, typeLong: 4, typeLong8: 8}
+	numEntriesSize, countSize, valueSize := 2, 4, 4
+	if bigTIFF {
+		numEntriesSize, countSize, valueSize = 8, 8, 8
+	}
+
+	if order == binary.LittleEndian {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	if bigTIFF {
+		put(2, 43)
+		put(2, 8)
+		put(2, 0)
+	} else {
+		put(2, 42)
+	}
+	ifdPosField := buf.Len()
+	put(valueSize, 0) // patched below
+	buf.Write(data.Bytes())
+
+	prevNextField := ifdPosField
+	for i, lev := range levels {
+		entries := []entry{
+			{254, typeLong, []uint64{lev.subfile}},
+			{256, typeLong, []uint64{lev.width}},
+			{257, typeLong, []uint64{lev.width}},
+			{258, typeShort, []uint64{32}},
+			{259, typeShort, []uint64{8}},
+			{322, typeShort, []uint64{16}},
+			{323, typeShort, []uint64{16}},
+			{324, offsetType, offsets[i]},
+			{325, offsetType, sizes[i]},
+			{339, typeShort, []uint64{3}},
+		}
+
+		// Write out-of-line arrays before the directory.
+		arrayPos := make([]uint64, len(entries))
+		for j, e := range entries {
+			if len(e.values)*typeSize[e.typ] > valueSize {
+				arrayPos[j] = uint64(buf.Len())
+				for _, v := range e.values {
+					put(typeSize[e.typ], v)
+				}
+			}
+		}
+
+		ifdPos := uint64(buf.Len())
+		patch := buf.Bytes()[prevNextField : prevNextField+valueSize]
+		if bigTIFF {
+			order.PutUint64(patch, ifdPos)
+		} else {
+			order.PutUint32(patch, uint32(ifdPos))
+		}
+
+		put(numEntriesSize, uint64(len(entries)))
+		for j, e := range entries {
+			put(2, uint64(e.tag))
+			put(2, uint64(e.typ))
+			put(countSize, uint64(len(e.values)))
+			if arrayPos[j] != 0 {
+				put(valueSize, arrayPos[j])
+			} else {
+				n := 0
+				for _, v := range e.values {
+					put(typeSize[e.typ], v)
+					n += typeSize[e.typ]
+				}
+				buf.Write(make([]byte, valueSize-n))
+			}
+		}
+		prevNextField = buf.Len()
+		put(valueSize, 0)
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,249 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+// Package compress reads and writes the compression formats that
+// appear in our inputs and caches: gzip and bzip2 for Wikimedia dumps,
+// xz for OpenStreetMap tile logs, brotli for older caches, and zstd
+// for everything we write nowadays.
+//
+// Readers can find out the format by themselves, either from the
+// file name or from the first bytes of the data, so that callers
+// can migrate their caches to another format without breaking
+// the files that are already stored in the old one.
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Codec is a compression format.
+type Codec string
+
+const (
+	None   Codec = ""
+	Brotli Codec = "brotli"
+	Bzip2  Codec = "bzip2"
+	Gzip   Codec = "gzip"
+	Xz     Codec = "xz"
+	Zstd   Codec = "zstd"
+)
+
+var extensions = map[Codec]string{
+	None:   "",
+	Brotli: ".br",
+	Bzip2:  ".bz2",
+	Gzip:   ".gz",
+	Xz:     ".xz",
+	Zstd:   ".zst",
+}
+
+var contentTypes = map[Codec]string{
+	None:   "application/octet-stream",
+	Brotli: "application/x-brotli",
+	Bzip2:  "application/x-bzip2",
+	Gzip:   "application/gzip",
+	Xz:     "application/x-xz",
+	Zstd:   "application/zstd",
+}
+
+// Ext returns the file extension for a codec, such as ".zst" for Zstd.
+func (c Codec) Ext() string {
+	return extensions[c]
+}
+
+// ContentType returns the MIME type for a codec, for storing
+// compressed files in S3 storage or serving them over HTTP.
+func (c Codec) ContentType() string {
+	if t, ok := contentTypes[c]; ok {
+		return t
+	}
+	return contentTypes[None]
+}
+
+// CodecForName returns the codec for a file name, according to
+// its extension. The result is None for unknown extensions.
+func CodecForName(name string) Codec {
+	for codec, ext := range extensions {
+		if ext != "" && strings.HasSuffix(name, ext) {
+			return codec
+		}
+	}
+	return None
+}
+
+// Magic numbers at the start of compressed data. Brotli has none,
+// so Detect cannot recognize it.
+var magics = []struct {
+	codec Codec
+	magic []byte
+}{
+	{Gzip, []byte{0x1f, 0x8b}},
+	{Bzip2, []byte("BZh")},
+	{Xz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{Zstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// Detect returns the codec of compressed data, judging from its first
+// bytes. The result is None if the data is not compressed, or if it
+// is compressed with Brotli, whose streams have no magic number.
+func Detect(header []byte) Codec {
+	for _, m := range magics {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.codec
+		}
+	}
+	return None
+}
+
+// NewReader returns a reader that decompresses r, detecting the codec
+// from the first bytes of the data. Data that is not compressed gets
+// passed through as-is. Closing the returned reader releases the
+// resources of the decompressor, and it also closes r if r is an
+// io.Closer.
+func NewReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return newCodecReader(Detect(header), br, r)
+}
+
+// NewReaderForName returns a reader that decompresses r. The codec
+// is given by the extension of name, such as ".br" for Brotli; for
+// unknown extensions, it gets detected like in NewReader. Closing
+// the returned reader also closes r if r is an io.Closer.
+func NewReaderForName(name string, r io.Reader) (io.ReadCloser, error) {
+	codec := CodecForName(name)
+	if codec == None {
+		return NewReader(r)
+	}
+	return newCodecReader(codec, r, r)
+}
+
+// NewCodecReader returns a reader that decompresses data from r with
+// codec. Closing the result closes the decompressor and underlying,
+// which may be the same as r or a reader that r wraps around.
+func newCodecReader(codec Codec, r io.Reader, underlying io.Reader) (io.ReadCloser, error) {
+	closeUnderlying := func() error {
+		if c, ok := underlying.(io.Closer); ok {
+			return c.Close()
+		}
+		return nil
+	}
+
+	switch codec {
+	case None:
+		return &reader{r, closeUnderlying}, nil
+
+	case Brotli:
+		return &reader{brotli.NewReader(r), closeUnderlying}, nil
+
+	case Bzip2:
+		bz, err := bzip2.NewReader(r, &bzip2.ReaderConfig{})
+		if err != nil {
+			return nil, err
+		}
+		return &reader{bz, func() error {
+			bz.Close()
+			return closeUnderlying()
+		}}, nil
+
+	case Gzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return &reader{gz, func() error {
+			gz.Close()
+			return closeUnderlying()
+		}}, nil
+
+	case Xz:
+		xzReader, err := xz.NewReader(bufio.NewReader(r))
+		if err != nil {
+			return nil, err
+		}
+		return &reader{xzReader, closeUnderlying}, nil
+
+	case Zstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return &reader{decoder, func() error {
+			decoder.Close()
+			return closeUnderlying()
+		}}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported codec %q", codec)
+}
+
+type reader struct {
+	io.Reader
+	close func() error
+}
+
+func (r *reader) Close() error {
+	return r.close()
+}
+
+// Level tells how hard a writer should try to compress.
+// Each codec maps it to its own settings.
+type Level int
+
+const (
+	DefaultLevel Level = iota
+	FastestLevel
+	BestLevel
+)
+
+// NewWriter returns a writer that compresses data with codec, and
+// writes it to w. The caller must close the returned writer to flush
+// all data; this does not close w.
+func NewWriter(w io.Writer, codec Codec, level Level) (io.WriteCloser, error) {
+	switch codec {
+	case None:
+		return nopWriteCloser{w}, nil
+
+	case Brotli:
+		levels := map[Level]int{DefaultLevel: 6, FastestLevel: brotli.BestSpeed, BestLevel: brotli.BestCompression}
+		return brotli.NewWriterLevel(w, levels[level]), nil
+
+	case Bzip2:
+		levels := map[Level]int{DefaultLevel: bzip2.DefaultCompression, FastestLevel: bzip2.BestSpeed, BestLevel: bzip2.BestCompression}
+		return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: levels[level]})
+
+	case Gzip:
+		levels := map[Level]int{DefaultLevel: gzip.DefaultCompression, FastestLevel: gzip.BestSpeed, BestLevel: gzip.BestCompression}
+		return gzip.NewWriterLevel(w, levels[level])
+
+	case Xz:
+		return xz.NewWriter(w)
+
+	case Zstd:
+		levels := map[Level]zstd.EncoderLevel{DefaultLevel: zstd.SpeedDefault, FastestLevel: zstd.SpeedFastest, BestLevel: zstd.SpeedBestCompression}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(levels[level]))
+	}
+
+	return nil, fmt.Errorf("unsupported codec %q", codec)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,135 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package compress
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+var allCodecs = []Codec{None, Brotli, Bzip2, Gzip, Xz, Zstd}
+
+func compress(t *testing.T, codec Codec, level Level, data string) []byte {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, codec, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readAll(t *testing.T, r io.ReadCloser, err error) string {
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRoundTrip(t *testing.T) {
+	const data = "1/2/3 42\n4/5/6 7\n"
+	for _, codec := range allCodecs {
+		for _, level := range []Level{DefaultLevel, FastestLevel, BestLevel} {
+			compressed := compress(t, codec, level, data)
+
+			r, err := NewReaderForName("file"+codec.Ext(), bytes.NewReader(compressed))
+			if got := readAll(t, r, err); got != data {
+				t.Errorf("%q level %d: NewReaderForName got %q, want %q", codec, level, got, data)
+			}
+
+			// Brotli cannot be detected from the data.
+			if codec == Brotli {
+				continue
+			}
+			r, err = NewReader(bytes.NewReader(compressed))
+			if got := readAll(t, r, err); got != data {
+				t.Errorf("%q level %d: NewReader got %q, want %q", codec, level, got, data)
+			}
+		}
+	}
+}
+
+func TestNewReader_Empty(t *testing.T) {
+	r, err := NewReader(bytes.NewReader(nil))
+	if got := readAll(t, r, err); got != "" {
+		t.Errorf("got %q, want empty string", got)
+	}
+}
+
+// The legacy caches were named .br, but we may also encounter
+// caches in a new format whose name we do not recognize.
+func TestNewReaderForName_UnknownExtension(t *testing.T) {
+	compressed := compress(t, Zstd, DefaultLevel, "hello")
+	r, err := NewReaderForName("cache.dat", bytes.NewReader(compressed))
+	if got := readAll(t, r, err); got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestReaderClosesUnderlying(t *testing.T) {
+	for _, codec := range allCodecs {
+		underlying := &closeRecorder{Reader: bytes.NewReader(compress(t, codec, DefaultLevel, "x"))}
+		r, err := NewReaderForName("f"+codec.Ext(), underlying)
+		readAll(t, r, err)
+		if !underlying.closed {
+			t.Errorf("%q: underlying reader not closed", codec)
+		}
+	}
+}
+
+func TestCodecForName(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want Codec
+	}{
+		{"tilelogs-2024-W17.br", Brotli},
+		{"pageviews-20240101-user.bz2", Bzip2},
+		{"wikidatawiki-20240401-page.sql.gz", Gzip},
+		{"tiles-2024-01-01.txt.xz", Xz},
+		{"tilelogs-2024-W17.zst", Zstd},
+		{"stats.json", None},
+	} {
+		if got := CodecForName(tc.name); got != tc.want {
+			t.Errorf("CodecForName(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestContentType(t *testing.T) {
+	if got, want := Zstd.ContentType(), "application/zstd"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := Codec("foo").ContentType(), "application/octet-stream"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNewWriter_UnsupportedCodec(t *testing.T) {
+	if _, err := NewWriter(io.Discard, Codec("foo"), DefaultLevel); err == nil {
+		t.Error("expected error for unsupported codec")
+	}
+}
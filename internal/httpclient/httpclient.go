@@ -0,0 +1,166 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+// Package httpclient creates the HTTP clients for all outbound requests
+// of our tools. Every request carries a User-Agent that identifies
+// the project and tells how to contact us, as required by the
+// [Wikimedia User-Agent policy]; operators of other servers,
+// such as planet.openstreetmap.org, appreciate it too.
+// In addition, the clients give up on servers that stop responding,
+// follow only a limited number of redirects, and limit how many
+// requests can be in flight to the same host at the same time.
+//
+// [Wikimedia User-Agent policy]: https://foundation.wikimedia.org/wiki/Policy:User-Agent_policy
+package httpclient
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Contact tells server operators where to find out about our tools,
+// and whom to contact in case of trouble.
+const Contact = "https://github.com/brawer/wikidata-qrank; sascha@brawer.ch"
+
+// Options configure a client. Zero values get replaced by defaults.
+type Options struct {
+	// Agent names the tool, such as "QRankBuilderBot".
+	Agent string
+
+	// ConnectTimeout limits how long it may take to establish
+	// a connection, including the TLS handshake. Default: 30s.
+	ConnectTimeout time.Duration
+
+	// ResponseTimeout limits how long we wait for the response
+	// headers after sending a request. Default: 2 minutes.
+	// There is intentionally no limit on the total duration,
+	// because some of our downloads take more than an hour.
+	ResponseTimeout time.Duration
+
+	// MaxRedirects is the maximal number of redirects that get
+	// followed for a single request. Default: 5.
+	MaxRedirects int
+
+	// MaxRequestsPerHost limits how many requests can be in flight
+	// to the same host. A request counts as in flight until its
+	// response body has been closed. Default: 2.
+	MaxRequestsPerHost int
+}
+
+// UserAgent returns the User-Agent header for a tool,
+// such as "QRankBuilderBot/1.0 (https://github.com/...)".
+func UserAgent(agent string) string {
+	return fmt.Sprintf("%s/1.0 (%s)", agent, Contact)
+}
+
+// New returns a client for making outbound requests.
+func New(opts Options) *http.Client {
+	if opts.Agent == "" {
+		opts.Agent = "QRankBot"
+	}
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = 30 * time.Second
+	}
+	if opts.ResponseTimeout <= 0 {
+		opts.ResponseTimeout = 2 * time.Minute
+	}
+	if opts.MaxRedirects <= 0 {
+		opts.MaxRedirects = 5
+	}
+	if opts.MaxRequestsPerHost <= 0 {
+		opts.MaxRequestsPerHost = 2
+	}
+
+	dialer := &net.Dialer{Timeout: opts.ConnectTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   opts.ConnectTimeout,
+		ResponseHeaderTimeout: opts.ResponseTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          100,
+	}
+
+	maxRedirects := opts.MaxRedirects
+	return &http.Client{
+		Transport: &roundTripper{
+			base:      transport,
+			userAgent: UserAgent(opts.Agent),
+			maxActive: opts.MaxRequestsPerHost,
+			hosts:     make(map[string]chan struct{}),
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return nil
+		},
+	}
+}
+
+// RoundTripper sets the User-Agent header, and limits the number
+// of concurrent requests to the same host.
+type roundTripper struct {
+	base      http.RoundTripper
+	userAgent string
+	maxActive int
+
+	mutex sync.Mutex
+	hosts map[string]chan struct{} // semaphore for each host
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request, so we set
+	// the header on a copy.
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", rt.userAgent)
+	}
+
+	sem := rt.semaphore(req.URL.Host)
+	select {
+	case sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	release := func() { <-sem }
+
+	resp, err := rt.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+func (rt *roundTripper) semaphore(host string) chan struct{} {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	sem, ok := rt.hosts[host]
+	if !ok {
+		sem = make(chan struct{}, rt.maxActive)
+		rt.hosts[host] = sem
+	}
+	return sem
+}
+
+// ReleasingBody frees the slot of a request when its response body
+// gets closed. Closing a body more than once is harmless.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,339 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+// Package minisign creates and verifies detached signatures in the
+// format of [minisign], so that mirrors of our public files can check
+// their integrity with the minisign command-line tool, or with any
+// other implementation of the format.
+//
+// Signatures are always created in the pre-hashed format, where
+// the Ed25519 signature is computed over the BLAKE2b-512 hash of
+// the signed data. When verifying, the legacy format that signs
+// the data itself is accepted as well.
+//
+// Secret keys must not be encrypted with a password, because
+// our builds run as unattended cronjobs. Such keys can be created
+// with “minisign -G -W”.
+//
+// [minisign]: https://jedisct1.github.io/minisign/
+package minisign
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+var (
+	algEd25519  = [2]byte{'E', 'd'} // signs the data itself; also the key algorithm
+	algPrehash  = [2]byte{'E', 'D'} // signs the BLAKE2b-512 hash of the data
+	algBlake2b  = [2]byte{'B', '2'} // checksum algorithm of secret keys
+	untrusted   = "untrusted comment: "
+	trusted     = "trusted comment: "
+	errBadKey   = errors.New("minisign: malformed key")
+	errBadSig   = errors.New("minisign: malformed signature")
+	errMismatch = errors.New("minisign: signature does not match")
+)
+
+// KeyID identifies a key pair. Signatures carry the ID of the key
+// that made them, so verifiers can tell which key to use.
+type KeyID [8]byte
+
+// String formats a key ID like the minisign tool, such as "4A5C2E9F0B1D3E7A".
+func (id KeyID) String() string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(id[:]))
+}
+
+// PublicKey is a key for verifying signatures.
+type PublicKey struct {
+	ID  KeyID
+	key ed25519.PublicKey
+}
+
+// PrivateKey is a key for creating signatures.
+type PrivateKey struct {
+	ID  KeyID
+	key ed25519.PrivateKey
+}
+
+// GenerateKey creates a new key pair, using entropy from rand.
+// If rand is nil, crypto/rand.Reader gets used.
+func GenerateKey(rand io.Reader) (*PublicKey, *PrivateKey, error) {
+	if rand == nil {
+		rand = cryptorand.Reader
+	}
+	pub, priv, err := ed25519.GenerateKey(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	var id KeyID
+	if _, err := io.ReadFull(rand, id[:]); err != nil {
+		return nil, nil, err
+	}
+	return &PublicKey{id, pub}, &PrivateKey{id, priv}, nil
+}
+
+// Public returns the public key that belongs to a private key.
+func (k *PrivateKey) Public() *PublicKey {
+	return &PublicKey{k.ID, k.key.Public().(ed25519.PublicKey)}
+}
+
+// ParsePublicKey parses a public key, either in the format of
+// a minisign public key file, or as the bare base64 string
+// on its second line.
+func ParsePublicKey(text string) (*PublicKey, error) {
+	data, err := decodeBase64(lastNonCommentLine(text))
+	if err != nil || len(data) != 2+8+ed25519.PublicKeySize {
+		return nil, errBadKey
+	}
+	if !bytes.Equal(data[0:2], algEd25519[:]) {
+		return nil, fmt.Errorf("minisign: unsupported key algorithm %q", data[0:2])
+	}
+	k := &PublicKey{key: ed25519.PublicKey(data[10:])}
+	copy(k.ID[:], data[2:10])
+	return k, nil
+}
+
+// String returns the public key as a base64 string, as it appears
+// on the second line of a minisign public key file.
+func (k *PublicKey) String() string {
+	var buf bytes.Buffer
+	buf.Write(algEd25519[:])
+	buf.Write(k.ID[:])
+	buf.Write(k.key)
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// MarshalText returns the public key in the format of minisign
+// public key files.
+func (k *PublicKey) MarshalText() ([]byte, error) {
+	text := fmt.Sprintf("%sminisign public key %s\n%s\n", untrusted, k.ID, k)
+	return []byte(text), nil
+}
+
+// Secret keys of minisign have the following layout, in bytes:
+// signature algorithm (2), key derivation algorithm (2), checksum
+// algorithm (2), key derivation salt (32), key derivation limits
+// for CPU and memory (8 each), key ID (8), Ed25519 secret key (64),
+// and a BLAKE2b-256 checksum (32) over the signature algorithm,
+// key ID and secret key. For keys without password, the key derivation
+// algorithm is zero, and the last three fields are not encrypted.
+const secretKeySize = 2 + 2 + 2 + 32 + 8 + 8 + 8 + ed25519.PrivateKeySize + 32
+
+// ParsePrivateKey parses a secret key in the format of minisign
+// secret key files. Keys that are encrypted with a password
+// are not supported.
+func ParsePrivateKey(text string) (*PrivateKey, error) {
+	data, err := decodeBase64(lastNonCommentLine(text))
+	if err != nil || len(data) != secretKeySize {
+		return nil, errBadKey
+	}
+	if !bytes.Equal(data[0:2], algEd25519[:]) || !bytes.Equal(data[4:6], algBlake2b[:]) {
+		return nil, fmt.Errorf("minisign: unsupported key algorithm %q", data[0:2])
+	}
+	if data[2] != 0 || data[3] != 0 {
+		return nil, fmt.Errorf("minisign: secret key is encrypted with a password; create one with minisign -G -W")
+	}
+	k := &PrivateKey{key: ed25519.PrivateKey(data[62:126])}
+	copy(k.ID[:], data[54:62])
+	if !bytes.Equal(k.checksum(), data[126:]) {
+		return nil, fmt.Errorf("minisign: bad checksum of secret key")
+	}
+	return k, nil
+}
+
+// MarshalText returns the private key in the format of minisign
+// secret key files, without password protection.
+func (k *PrivateKey) MarshalText() ([]byte, error) {
+	data := make([]byte, secretKeySize)
+	copy(data[0:2], algEd25519[:])
+	copy(data[4:6], algBlake2b[:])
+	copy(data[54:62], k.ID[:])
+	copy(data[62:126], k.key)
+	copy(data[126:], k.checksum())
+	text := fmt.Sprintf("%sminisign secret key %s\n%s\n", untrusted, k.ID,
+		base64.StdEncoding.EncodeToString(data))
+	return []byte(text), nil
+}
+
+func (k *PrivateKey) checksum() []byte {
+	h, _ := blake2b.New256(nil)
+	h.Write(algEd25519[:])
+	h.Write(k.ID[:])
+	h.Write(k.key)
+	return h.Sum(nil)
+}
+
+// Signature is a detached signature. Its trusted comment is signed
+// together with the data, so verifiers can rely on it; typically,
+// it tells the file name and a timestamp.
+type Signature struct {
+	KeyID            KeyID
+	UntrustedComment string
+	TrustedComment   string
+	algorithm        [2]byte
+	signature        []byte
+	globalSignature  []byte
+}
+
+// Sign reads r until the end, and returns a signature for its data.
+func (k *PrivateKey) Sign(r io.Reader, trustedComment string) (*Signature, error) {
+	if strings.ContainsAny(trustedComment, "\r\n") {
+		return nil, fmt.Errorf("minisign: trusted comment must be a single line")
+	}
+	h, _ := blake2b.New512(nil)
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	sig := &Signature{
+		KeyID:            k.ID,
+		UntrustedComment: "signature from minisign secret key",
+		TrustedComment:   trustedComment,
+		algorithm:        algPrehash,
+		signature:        ed25519.Sign(k.key, h.Sum(nil)),
+	}
+	sig.globalSignature = ed25519.Sign(k.key, sig.globalMessage())
+	return sig, nil
+}
+
+// ParseSignature parses a signature in the format of minisign
+// signature files, which usually have the extension .minisig.
+func ParseSignature(text string) (*Signature, error) {
+	lines := strings.Split(strings.TrimRight(text, "\r\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], "\r")
+	}
+	if len(lines) != 4 ||
+		!strings.HasPrefix(lines[0], untrusted) ||
+		!strings.HasPrefix(lines[2], trusted) {
+		return nil, errBadSig
+	}
+
+	data, err := decodeBase64(lines[1])
+	if err != nil || len(data) != 2+8+ed25519.SignatureSize {
+		return nil, errBadSig
+	}
+	global, err := decodeBase64(lines[3])
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return nil, errBadSig
+	}
+
+	sig := &Signature{
+		UntrustedComment: strings.TrimPrefix(lines[0], untrusted),
+		TrustedComment:   strings.TrimPrefix(lines[2], trusted),
+		signature:        data[10:],
+		globalSignature:  global,
+	}
+	copy(sig.algorithm[:], data[0:2])
+	copy(sig.KeyID[:], data[2:10])
+	if sig.algorithm != algEd25519 && sig.algorithm != algPrehash {
+		return nil, fmt.Errorf("minisign: unsupported signature algorithm %q", data[0:2])
+	}
+	return sig, nil
+}
+
+// MarshalText returns the signature in the format of minisign
+// signature files.
+func (s *Signature) MarshalText() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(s.algorithm[:])
+	buf.Write(s.KeyID[:])
+	buf.Write(s.signature)
+	text := fmt.Sprintf("%s%s\n%s\n%s%s\n%s\n",
+		untrusted, s.UntrustedComment,
+		base64.StdEncoding.EncodeToString(buf.Bytes()),
+		trusted, s.TrustedComment,
+		base64.StdEncoding.EncodeToString(s.globalSignature))
+	return []byte(text), nil
+}
+
+func (s *Signature) globalMessage() []byte {
+	msg := make([]byte, 0, len(s.signature)+len(s.TrustedComment))
+	msg = append(msg, s.signature...)
+	return append(msg, s.TrustedComment...)
+}
+
+// Verify reads r until the end, and checks that sig is a valid
+// signature of its data made with this key. The trusted comment
+// of sig gets verified as well.
+func (k *PublicKey) Verify(r io.Reader, sig *Signature) error {
+	v, err := k.NewVerifier(sig)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(v, r); err != nil {
+		return err
+	}
+	return v.Verify()
+}
+
+// Verifier checks a signature over data that gets written to it.
+// This allows to verify a file while reading it for other purposes.
+type Verifier struct {
+	key  *PublicKey
+	sig  *Signature
+	hash hash.Hash    // for pre-hashed signatures
+	data bytes.Buffer // for legacy signatures
+}
+
+// NewVerifier returns a Verifier for checking that sig has been made
+// with this key. The error is set if the key IDs do not match.
+func (k *PublicKey) NewVerifier(sig *Signature) (*Verifier, error) {
+	if sig.KeyID != k.ID {
+		return nil, fmt.Errorf("minisign: signature was made with key %s, not with %s", sig.KeyID, k.ID)
+	}
+	v := &Verifier{key: k, sig: sig}
+	if sig.algorithm == algPrehash {
+		v.hash, _ = blake2b.New512(nil)
+	}
+	return v, nil
+}
+
+func (v *Verifier) Write(p []byte) (int, error) {
+	if v.hash != nil {
+		return v.hash.Write(p)
+	}
+	return v.data.Write(p)
+}
+
+// Verify checks the signature over all data written so far,
+// and also the signature over the trusted comment.
+func (v *Verifier) Verify() error {
+	msg := v.data.Bytes()
+	if v.hash != nil {
+		msg = v.hash.Sum(nil)
+	}
+	if !ed25519.Verify(v.key.key, msg, v.sig.signature) {
+		return errMismatch
+	}
+	if !ed25519.Verify(v.key.key, v.sig.globalMessage(), v.sig.globalSignature) {
+		return fmt.Errorf("minisign: trusted comment has been tampered with")
+	}
+	return nil
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+}
+
+// LastNonCommentLine returns the last line of text that is not
+// empty and not a comment. For key files, this is the key.
+func lastNonCommentLine(text string) string {
+	lines := strings.Split(text, "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if line != "" && !strings.HasPrefix(line, untrusted) {
+			return line
+		}
+	}
+	return ""
+}
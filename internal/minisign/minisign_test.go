@@ -0,0 +1,173 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package minisign
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// A fixed source of randomness, so our tests are reproducible.
+func testEntropy() *bytes.Reader {
+	return bytes.NewReader(bytes.Repeat([]byte("0123456789abcdef"), 10))
+}
+
+func mustGenerateKey(t *testing.T) (*PublicKey, *PrivateKey) {
+	pub, priv, err := GenerateKey(testEntropy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+func mustSign(t *testing.T, priv *PrivateKey, data, comment string) *Signature {
+	sig, err := priv.Sign(strings.NewReader(data), comment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestSignAndVerify(t *testing.T) {
+	pub, priv := mustGenerateKey(t)
+	sig := mustSign(t, priv, "Q72,1234\n", "file:qrank-20240501.csv.gz")
+
+	text, err := sig.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseSignature(string(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := parsed.TrustedComment, "file:qrank-20240501.csv.gz"; got != want {
+		t.Errorf("got trusted comment %q, want %q", got, want)
+	}
+	if err := pub.Verify(strings.NewReader("Q72,1234\n"), parsed); err != nil {
+		t.Error(err)
+	}
+	if err := pub.Verify(strings.NewReader("Q72,1235\n"), parsed); err == nil {
+		t.Error("expected error for tampered data")
+	}
+}
+
+func TestVerify_TamperedTrustedComment(t *testing.T) {
+	pub, priv := mustGenerateKey(t)
+	sig := mustSign(t, priv, "data", "file:qrank-20240501.csv.gz")
+	sig.TrustedComment = "file:qrank-20240601.csv.gz"
+	if err := pub.Verify(strings.NewReader("data"), sig); err == nil {
+		t.Error("expected error for tampered trusted comment")
+	}
+}
+
+func TestVerify_WrongKey(t *testing.T) {
+	_, priv := mustGenerateKey(t)
+	other, _, err := GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := mustSign(t, priv, "data", "")
+	if err := other.Verify(strings.NewReader("data"), sig); err == nil {
+		t.Error("expected error for signature made with another key")
+	}
+}
+
+func TestKeyRoundTrip(t *testing.T) {
+	pub, priv := mustGenerateKey(t)
+
+	pubText, err := pub.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(pubText), "untrusted comment: minisign public key "+pub.ID.String()+"\n") {
+		t.Errorf("unexpected public key file: %q", pubText)
+	}
+	for _, text := range []string{string(pubText), pub.String()} {
+		parsed, err := ParsePublicKey(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.String() != pub.String() {
+			t.Errorf("got %s, want %s", parsed, pub)
+		}
+	}
+
+	privText, err := priv.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedPriv, err := ParsePrivateKey(string(privText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parsedPriv.Public().String(); got != pub.String() {
+		t.Errorf("public key of parsed private key is %s, want %s", got, pub)
+	}
+}
+
+func TestParsePrivateKey_Bad(t *testing.T) {
+	_, priv := mustGenerateKey(t)
+	text, _ := priv.MarshalText()
+	lines := strings.Split(string(text), "\n")
+
+	// Flip one bit of the secret key, so the checksum does not match.
+	corrupt := []byte(lines[1])
+	corrupt[100] ^= 1
+	if _, err := ParsePrivateKey(string(corrupt)); err == nil {
+		t.Error("expected error for corrupt secret key")
+	}
+
+	// Mark the key as encrypted with scrypt.
+	encrypted := []byte(lines[1])
+	copy(encrypted[0:4], "RWRT")
+	if _, err := ParsePrivateKey(string(encrypted)); err == nil || !strings.Contains(err.Error(), "encrypted") {
+		t.Errorf("expected error for encrypted key, got %v", err)
+	}
+
+	if _, err := ParsePrivateKey("garbage"); err == nil {
+		t.Error("expected error for garbage")
+	}
+}
+
+func TestParseSignature_Bad(t *testing.T) {
+	_, priv := mustGenerateKey(t)
+	text, _ := mustSign(t, priv, "data", "comment").MarshalText()
+	lines := strings.Split(string(text), "\n")
+	for _, bad := range []string{
+		"",
+		lines[0] + "\n" + lines[1] + "\n",
+		lines[0] + "\n" + lines[1] + "\n" + lines[3] + "\n" + lines[2] + "\n",
+		lines[0] + "\n" + "Zm9v" + "\n" + lines[2] + "\n" + lines[3] + "\n",
+	} {
+		if _, err := ParseSignature(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestKeyIDString(t *testing.T) {
+	id := KeyID{0x7a, 0x3e, 0x1d, 0x0b, 0x9f, 0x2e, 0x5c, 0x4a}
+	if got, want := id.String(), "4A5C2E9F0B1D3E7A"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	pub, priv := mustGenerateKey(t)
+	sig := mustSign(t, priv, "Q72,1234\nQ42,99\n", "")
+	v, err := pub.NewVerifier(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Write([]byte("Q72,1234\n"))
+	v.Write([]byte("Q42,99\n"))
+	if err := v.Verify(); err != nil {
+		t.Error(err)
+	}
+	v.Write([]byte("Q1,1\n"))
+	if err := v.Verify(); err == nil {
+		t.Error("expected error after writing more data")
+	}
+}
@@ -0,0 +1,482 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+// Package objstore routes requests for S3-compatible object storage
+// to the buckets and endpoints that have been configured by operators.
+//
+// Throughout our code, all objects live in one logical bucket named
+// "qrank", with public outputs under the "public/" prefix and internal
+// artifacts under other prefixes. Operators can keep it that way, or
+// put public outputs into a separate bucket, possibly on another
+// endpoint, so they can apply different lifecycle policies and
+// permissions. In addition, a read-only mirror can be configured;
+// internal artifacts that are missing from the primary location
+// then get read from the mirror. Nothing ever gets written to the
+// mirror.
+//
+// The configuration is a JSON file such as the following. Any field
+// of "Public" or "Mirror" that is left out gets taken from the top
+// level, so the following puts public outputs into another bucket
+// on the same endpoint, and reads missing inputs from a mirror:
+//
+//	{
+//	  "Endpoint": "objects.eqiad1.wikimediacloud.org",
+//	  "Key": "...",
+//	  "Secret": "...",
+//	  "Bucket": "qrank-internal",
+//	  "Public": {"Bucket": "qrank-public"},
+//	  "Mirror": {"Endpoint": "mirror.example.org", "Bucket": "qrank"}
+//	}
+//
+// If "Bucket" is left out, it is "qrank". With only "Endpoint",
+// "Key" and "Secret", everything works like before this package
+// existed.
+//
+// A test run, which only processes a sample of the data, must not
+// overwrite production outputs. For this, Config.Prefix can move the
+// entire logical bucket under a prefix such as "testrun/", including
+// its public outputs, which then live among the internal artifacts.
+//
+// Every call to storage has a deadline, and calls that fail for a
+// reason that might go away get retried with a randomized backoff.
+// The limits can be changed with an optional "Retry" object such as
+// {"Timeout": "1m", "TransferTimeout": "6h", "MaxAttempts": 5},
+// see RetryPolicy for the other fields.
+package objstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Bucket is the name of the logical bucket used by our code.
+const Bucket = "qrank"
+
+// PublicPrefix is the prefix of the objects that get published.
+const PublicPrefix = "public/"
+
+// Location tells where objects get stored.
+type Location struct {
+	Endpoint string
+	Key      string
+	Secret   string
+	Bucket   string
+}
+
+// Config is the configuration for object storage. The embedded
+// Location is for internal artifacts, and the default for the others.
+type Config struct {
+	Location
+	Public *Location    `json:",omitempty"`
+	Mirror *Location    `json:",omitempty"`
+	Retry  *RetryPolicy `json:",omitempty"`
+
+	// If not empty, the keys of all objects in the logical bucket
+	// get stored under this prefix, such as "testrun/". Nothing then
+	// goes to the public location, and nothing gets read from the mirror.
+	Prefix string `json:",omitempty"`
+}
+
+// ReadConfig reads the storage configuration from a JSON file.
+// If path is empty, the configuration comes from the environment
+// variables S3_ENDPOINT, S3_KEY, S3_SECRET and S3_BUCKET; the
+// latter is optional. Also optional are S3_PUBLIC_BUCKET for
+// putting public outputs into another bucket on the same endpoint,
+// and S3_MIRROR_ENDPOINT and S3_MIRROR_BUCKET for a mirror that
+// can be accessed with the same credentials. S3_TIMEOUT, such as
+// "90s", and S3_MAX_ATTEMPTS change the retry policy.
+func ReadConfig(path string) (*Config, error) {
+	if path == "" {
+		return configFromEnv()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &config, nil
+}
+
+func configFromEnv() (*Config, error) {
+	config := &Config{Location: Location{
+		Endpoint: os.Getenv("S3_ENDPOINT"),
+		Key:      os.Getenv("S3_KEY"),
+		Secret:   os.Getenv("S3_SECRET"),
+		Bucket:   os.Getenv("S3_BUCKET"),
+	}}
+	if b := os.Getenv("S3_PUBLIC_BUCKET"); b != "" {
+		config.Public = &Location{Bucket: b}
+	}
+	endpoint, bucket := os.Getenv("S3_MIRROR_ENDPOINT"), os.Getenv("S3_MIRROR_BUCKET")
+	if endpoint != "" || bucket != "" {
+		config.Mirror = &Location{Endpoint: endpoint, Bucket: bucket}
+	}
+	timeout, attempts := os.Getenv("S3_TIMEOUT"), os.Getenv("S3_MAX_ATTEMPTS")
+	if timeout != "" || attempts != "" {
+		config.Retry = &RetryPolicy{}
+		if timeout != "" {
+			d, err := time.ParseDuration(timeout)
+			if err != nil {
+				return nil, fmt.Errorf("S3_TIMEOUT: %w", err)
+			}
+			config.Retry.Timeout = d
+		}
+		if attempts != "" {
+			n, err := strconv.Atoi(attempts)
+			if err != nil {
+				return nil, fmt.Errorf("S3_MAX_ATTEMPTS: %w", err)
+			}
+			config.Retry.MaxAttempts = n
+		}
+	}
+	return config, nil
+}
+
+// Internal returns the location of internal artifacts.
+func (c *Config) Internal() Location {
+	loc := c.Location
+	if loc.Bucket == "" {
+		loc.Bucket = Bucket
+	}
+	return loc
+}
+
+// PublicLocation returns the location of public outputs.
+func (c *Config) PublicLocation() Location {
+	return c.inherit(c.Public)
+}
+
+// MirrorLocation returns the location of the read-only mirror,
+// or false if no mirror has been configured.
+func (c *Config) MirrorLocation() (Location, bool) {
+	if c.Mirror == nil {
+		return Location{}, false
+	}
+	return c.inherit(c.Mirror), true
+}
+
+func (c *Config) inherit(loc *Location) Location {
+	result := c.Internal()
+	if loc != nil {
+		if loc.Endpoint != "" {
+			result.Endpoint = loc.Endpoint
+		}
+		if loc.Key != "" {
+			result.Key = loc.Key
+		}
+		if loc.Secret != "" {
+			result.Secret = loc.Secret
+		}
+		if loc.Bucket != "" {
+			result.Bucket = loc.Bucket
+		}
+	}
+	return result
+}
+
+// Client is the subset of minio.Client that gets used by Router.
+type Client interface {
+	BucketExists(ctx context.Context, bucketName string) (bool, error)
+	ListObjects(ctx context.Context, bucketName string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo
+	StatObject(ctx context.Context, bucketName, objectName string, opts minio.StatObjectOptions) (minio.ObjectInfo, error)
+	GetObject(ctx context.Context, bucketName, objectName string, opts minio.GetObjectOptions) (*minio.Object, error)
+	FGetObject(ctx context.Context, bucketName, objectName, filePath string, opts minio.GetObjectOptions) error
+	FPutObject(ctx context.Context, bucketName, objectName, filePath string, opts minio.PutObjectOptions) (minio.UploadInfo, error)
+	RemoveObject(ctx context.Context, bucketName, objectName string, opts minio.RemoveObjectOptions) error
+	CopyObject(ctx context.Context, dst minio.CopyDestOptions, src minio.CopySrcOptions) (minio.UploadInfo, error)
+}
+
+// Target is a bucket on a client.
+type target struct {
+	client Client
+	bucket string
+}
+
+// Router sends requests for objects in the logical bucket "qrank"
+// to the configured locations. It has the same methods as minio.Client,
+// so it can be used in its place. Requests for other buckets go
+// to the internal location, with the bucket name unchanged.
+type Router struct {
+	internal, public target
+	mirror           *target
+	stats            *callStats
+	prefix           string // see Config.Prefix
+}
+
+// NewRouter connects to the locations in config. The application
+// name gets sent to the storage servers as part of the User-Agent.
+func NewRouter(config *Config, appName string) (*Router, error) {
+	var policy RetryPolicy
+	if config.Retry != nil {
+		policy = *config.Retry
+	}
+	policy = policy.withDefaults()
+	stats := &callStats{}
+	clients := make(map[Location]Client, 3)
+	connect := func(loc Location) (target, error) {
+		key := Location{Endpoint: loc.Endpoint, Key: loc.Key, Secret: loc.Secret}
+		client, ok := clients[key]
+		if !ok {
+			transport, err := minio.DefaultTransport(true)
+			if err != nil {
+				return target{}, err
+			}
+			transport.ResponseHeaderTimeout = policy.Timeout
+			c, err := minio.New(loc.Endpoint, &minio.Options{
+				Creds:     credentials.NewStaticV4(loc.Key, loc.Secret, ""),
+				Secure:    true,
+				Transport: transport,
+			})
+			if err != nil {
+				return target{}, err
+			}
+			c.SetAppInfo(appName, "0.1")
+			client = newRetryingClient(c, policy, stats)
+			clients[key] = client
+		}
+		return target{client: client, bucket: loc.Bucket}, nil
+	}
+
+	internal, err := connect(config.Internal())
+	if err != nil {
+		return nil, err
+	}
+	public, err := connect(config.PublicLocation())
+	if err != nil {
+		return nil, err
+	}
+	r := &Router{internal: internal, public: public, stats: stats, prefix: config.Prefix}
+	if loc, ok := config.MirrorLocation(); ok && config.Prefix == "" {
+		mirror, err := connect(loc)
+		if err != nil {
+			return nil, err
+		}
+		r.mirror = &mirror
+	}
+	return r, nil
+}
+
+// SetLogger sets where warnings about slow or retried calls get
+// logged. By default, they go to the standard logger.
+func (r *Router) SetLogger(logger *log.Logger) {
+	if r.stats != nil {
+		r.stats.logger.Store(logger)
+	}
+}
+
+// Stats returns a snapshot of the statistics about storage calls.
+func (r *Router) Stats() Stats {
+	if r.stats == nil {
+		return Stats{}
+	}
+	return r.stats.snapshot()
+}
+
+// Route returns where an object is stored, and under which key.
+func (r *Router) route(bucket, key string) (target, string) {
+	if bucket != Bucket {
+		return target{r.internal.client, bucket}, key
+	}
+	if r.prefix != "" {
+		return r.internal, r.prefix + key
+	}
+	if strings.HasPrefix(key, PublicPrefix) {
+		return r.public, key
+	}
+	return r.internal, key
+}
+
+// HasMirror returns true if an object may be read from the mirror.
+func (r *Router) hasMirror(bucket, key string) bool {
+	return r.mirror != nil && bucket == Bucket && !strings.HasPrefix(key, PublicPrefix)
+}
+
+// BucketExists checks whether a bucket exists. For the logical bucket
+// "qrank", it checks all configured locations.
+func (r *Router) BucketExists(ctx context.Context, bucket string) (bool, error) {
+	if bucket != Bucket {
+		return r.internal.client.BucketExists(ctx, bucket)
+	}
+	targets := []target{r.internal, r.public}
+	if r.mirror != nil {
+		targets = append(targets, *r.mirror)
+	}
+	for _, t := range targets {
+		ok, err := t.client.BucketExists(ctx, t.bucket)
+		if err != nil || !ok {
+			return ok, err
+		}
+	}
+	return true, nil
+}
+
+// ListObjects lists objects. If the prefix covers objects in several
+// locations, the listings get merged. Objects in the mirror are only
+// listed if the primary location does not have the same key.
+func (r *Router) ListObjects(ctx context.Context, bucket string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	if bucket != Bucket {
+		return r.internal.client.ListObjects(ctx, bucket, opts)
+	}
+
+	if r.prefix != "" {
+		opts.Prefix = r.prefix + opts.Prefix
+		return r.trimPrefix(ctx, r.internal.client.ListObjects(ctx, r.internal.bucket, opts))
+	}
+
+	if strings.HasPrefix(opts.Prefix, PublicPrefix) {
+		return r.public.client.ListObjects(ctx, r.public.bucket, opts)
+	}
+	split := r.public != r.internal
+	wantPublic := split && strings.HasPrefix(PublicPrefix, opts.Prefix)
+	if !wantPublic && r.mirror == nil {
+		return r.internal.client.ListObjects(ctx, r.internal.bucket, opts)
+	}
+
+	out := make(chan minio.ObjectInfo, 100)
+	go func() {
+		defer close(out)
+		var result []minio.ObjectInfo
+		seen := make(map[string]bool, 1000)
+		add := func(t target, keep func(key string) bool) bool {
+			for obj := range t.client.ListObjects(ctx, t.bucket, opts) {
+				if obj.Err != nil {
+					out <- obj
+					return false
+				}
+				if keep(obj.Key) && !seen[obj.Key] {
+					seen[obj.Key] = true
+					result = append(result, obj)
+				}
+			}
+			return true
+		}
+
+		isPublic := func(key string) bool { return strings.HasPrefix(key, PublicPrefix) }
+		if !add(r.internal, func(key string) bool { return !split || !isPublic(key) }) {
+			return
+		}
+		if wantPublic && !add(r.public, isPublic) {
+			return
+		}
+		if r.mirror != nil && !add(*r.mirror, func(key string) bool { return !isPublic(key) }) {
+			return
+		}
+
+		slices.SortFunc(result, func(a, b minio.ObjectInfo) int {
+			return strings.Compare(a.Key, b.Key)
+		})
+		for _, obj := range result {
+			select {
+			case <-ctx.Done():
+				return
+			case out <- obj:
+			}
+		}
+	}()
+	return out
+}
+
+// TrimPrefix removes Config.Prefix from the keys of listed objects.
+func (r *Router) trimPrefix(ctx context.Context, in <-chan minio.ObjectInfo) <-chan minio.ObjectInfo {
+	out := make(chan minio.ObjectInfo, 100)
+	go func() {
+		defer close(out)
+		for obj := range in {
+			obj.Key = strings.TrimPrefix(obj.Key, r.prefix)
+			select {
+			case <-ctx.Done():
+				return
+			case out <- obj:
+			}
+		}
+	}()
+	return out
+}
+
+// StatObject returns information about an object, falling back
+// to the mirror if the object is missing from the primary location.
+func (r *Router) StatObject(ctx context.Context, bucket, key string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	t, k := r.route(bucket, key)
+	info, err := t.client.StatObject(ctx, t.bucket, k, opts)
+	if err != nil && isNotFound(err) && r.hasMirror(bucket, key) {
+		return r.mirror.client.StatObject(ctx, r.mirror.bucket, key, opts)
+	}
+	if err == nil {
+		info.Key = key
+	}
+	return info, err
+}
+
+// GetObject opens an object for reading. If a mirror is configured,
+// we first check whether the primary location has the object;
+// otherwise, it gets read from the mirror.
+func (r *Router) GetObject(ctx context.Context, bucket, key string, opts minio.GetObjectOptions) (*minio.Object, error) {
+	t, k := r.route(bucket, key)
+	if r.hasMirror(bucket, key) {
+		_, err := t.client.StatObject(ctx, t.bucket, k, minio.StatObjectOptions{})
+		if err != nil && isNotFound(err) {
+			t = *r.mirror
+		}
+	}
+	return t.client.GetObject(ctx, t.bucket, k, opts)
+}
+
+// FGetObject downloads an object into a local file, falling back
+// to the mirror if the object is missing from the primary location.
+func (r *Router) FGetObject(ctx context.Context, bucket, key, filePath string, opts minio.GetObjectOptions) error {
+	t, k := r.route(bucket, key)
+	err := t.client.FGetObject(ctx, t.bucket, k, filePath, opts)
+	if err != nil && isNotFound(err) && r.hasMirror(bucket, key) {
+		return r.mirror.client.FGetObject(ctx, r.mirror.bucket, key, filePath, opts)
+	}
+	return err
+}
+
+// FPutObject uploads a local file. Uploads never go to the mirror.
+func (r *Router) FPutObject(ctx context.Context, bucket, key, filePath string, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	t, k := r.route(bucket, key)
+	return t.client.FPutObject(ctx, t.bucket, k, filePath, opts)
+}
+
+// RemoveObject deletes an object. Objects in the mirror never get
+// deleted; if the mirror has a copy, it will still be found.
+func (r *Router) RemoveObject(ctx context.Context, bucket, key string, opts minio.RemoveObjectOptions) error {
+	t, k := r.route(bucket, key)
+	return t.client.RemoveObject(ctx, t.bucket, k, opts)
+}
+
+// CopyObject copies an object on the server side, which is only
+// possible within the same location.
+func (r *Router) CopyObject(ctx context.Context, dst minio.CopyDestOptions, src minio.CopySrcOptions) (minio.UploadInfo, error) {
+	d, dk := r.route(dst.Bucket, dst.Object)
+	s, sk := r.route(src.Bucket, src.Object)
+	if d.client != s.client {
+		return minio.UploadInfo{}, fmt.Errorf("cannot copy %s to %s across storage endpoints", src.Object, dst.Object)
+	}
+	dst.Bucket, src.Bucket = d.bucket, s.bucket
+	dst.Object, src.Object = dk, sk
+	return d.client.CopyObject(ctx, dst, src)
+}
+
+func isNotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NoSuchObject"
+}
+
+// Make sure that Router can stand in for minio.Client.
+var _ Client = (*Router)(nil)
+var _ Client = (*minio.Client)(nil)
@@ -0,0 +1,320 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package objstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// FakeClient is an in-memory fake for minio.Client.
+type fakeClient struct {
+	buckets map[string]map[string][]byte
+}
+
+func newFakeClient(buckets ...string) *fakeClient {
+	c := &fakeClient{buckets: make(map[string]map[string][]byte)}
+	for _, b := range buckets {
+		c.buckets[b] = make(map[string][]byte)
+	}
+	return c
+}
+
+func (c *fakeClient) BucketExists(ctx context.Context, bucket string) (bool, error) {
+	_, ok := c.buckets[bucket]
+	return ok, nil
+}
+
+func (c *fakeClient) ListObjects(ctx context.Context, bucket string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	keys := make([]string, 0)
+	for key := range c.buckets[bucket] {
+		if strings.HasPrefix(key, opts.Prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	ch := make(chan minio.ObjectInfo, len(keys))
+	for _, key := range keys {
+		ch <- minio.ObjectInfo{Key: key, Size: int64(len(c.buckets[bucket][key]))}
+	}
+	close(ch)
+	return ch
+}
+
+func (c *fakeClient) StatObject(ctx context.Context, bucket, key string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	data, ok := c.buckets[bucket][key]
+	if !ok {
+		return minio.ObjectInfo{}, minio.ErrorResponse{Code: "NoSuchKey"}
+	}
+	return minio.ObjectInfo{Key: key, Size: int64(len(data))}, nil
+}
+
+func (c *fakeClient) GetObject(ctx context.Context, bucket, key string, opts minio.GetObjectOptions) (*minio.Object, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *fakeClient) FGetObject(ctx context.Context, bucket, key, path string, opts minio.GetObjectOptions) error {
+	data, ok := c.buckets[bucket][key]
+	if !ok {
+		return minio.ErrorResponse{Code: "NoSuchKey"}
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func (c *fakeClient) FPutObject(ctx context.Context, bucket, key, path string, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	c.buckets[bucket][key] = data
+	return minio.UploadInfo{Bucket: bucket, Key: key, Size: int64(len(data))}, nil
+}
+
+func (c *fakeClient) RemoveObject(ctx context.Context, bucket, key string, opts minio.RemoveObjectOptions) error {
+	delete(c.buckets[bucket], key)
+	return nil
+}
+
+func (c *fakeClient) CopyObject(ctx context.Context, dst minio.CopyDestOptions, src minio.CopySrcOptions) (minio.UploadInfo, error) {
+	data, ok := c.buckets[src.Bucket][src.Object]
+	if !ok {
+		return minio.UploadInfo{}, minio.ErrorResponse{Code: "NoSuchKey"}
+	}
+	c.buckets[dst.Bucket][dst.Object] = data
+	return minio.UploadInfo{Bucket: dst.Bucket, Key: dst.Object}, nil
+}
+
+func listKeys(t *testing.T, r *Router, prefix string) []string {
+	keys := make([]string, 0)
+	opts := minio.ListObjectsOptions{Prefix: prefix, Recursive: true}
+	for obj := range r.ListObjects(context.Background(), Bucket, opts) {
+		if obj.Err != nil {
+			t.Fatal(obj.Err)
+		}
+		keys = append(keys, obj.Key)
+	}
+	return keys
+}
+
+func TestReadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage-key.json")
+	config := `{"Endpoint": "s3.example.org", "Key": "k", "Secret": "s",
+		"Bucket": "qrank-internal",
+		"Public": {"Bucket": "qrank-public"},
+		"Mirror": {"Endpoint": "mirror.example.org"}}`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := c.Internal(), (Location{"s3.example.org", "k", "s", "qrank-internal"}); got != want {
+		t.Errorf("got internal %v, want %v", got, want)
+	}
+	if got, want := c.PublicLocation(), (Location{"s3.example.org", "k", "s", "qrank-public"}); got != want {
+		t.Errorf("got public %v, want %v", got, want)
+	}
+	mirror, ok := c.MirrorLocation()
+	if want := (Location{"mirror.example.org", "k", "s", "qrank-internal"}); !ok || mirror != want {
+		t.Errorf("got mirror %v, %v; want %v, true", mirror, ok, want)
+	}
+}
+
+func TestReadConfig_Legacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage-key.json")
+	if err := os.WriteFile(path, []byte(`{"Endpoint": "e", "Key": "k", "Secret": "s"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Location{"e", "k", "s", "qrank"}
+	if c.Internal() != want || c.PublicLocation() != want {
+		t.Errorf("got %v and %v, want %v for both", c.Internal(), c.PublicLocation(), want)
+	}
+	if _, ok := c.MirrorLocation(); ok {
+		t.Error("legacy config should not have a mirror")
+	}
+}
+
+func TestReadConfig_Env(t *testing.T) {
+	t.Setenv("S3_ENDPOINT", "e")
+	t.Setenv("S3_KEY", "k")
+	t.Setenv("S3_SECRET", "s")
+	t.Setenv("S3_BUCKET", "")
+	t.Setenv("S3_PUBLIC_BUCKET", "qrank-public")
+	t.Setenv("S3_MIRROR_ENDPOINT", "")
+	t.Setenv("S3_MIRROR_BUCKET", "")
+	c, err := ReadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.PublicLocation(), (Location{"e", "k", "s", "qrank-public"}); got != want {
+		t.Errorf("got public %v, want %v", got, want)
+	}
+	if _, ok := c.MirrorLocation(); ok {
+		t.Error("expected no mirror")
+	}
+}
+
+func TestRouter(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeClient("internal", "public")
+	mirrorClient := newFakeClient("old")
+	r := &Router{
+		internal: target{client, "internal"},
+		public:   target{client, "public"},
+		mirror:   &target{mirrorClient, "old"},
+	}
+
+	client.buckets["internal"]["page_signals/rmwiki-20240501-page_signals.zst"] = []byte("new")
+	client.buckets["public"]["public/qrank-20240501.csv.gz"] = []byte("qrank")
+	mirrorClient.buckets["old"]["pageviews/pageviews-2023-W01.zst"] = []byte("mirrored")
+	mirrorClient.buckets["old"]["public/qrank-20230101.csv.gz"] = []byte("ignored")
+
+	file := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"public/qrank-stats-20240501.json", "pageviews/pageviews-2024-W17.zst"} {
+		if _, err := r.FPutObject(ctx, Bucket, key, file, minio.PutObjectOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := client.buckets["public"]["public/qrank-stats-20240501.json"]; !ok {
+		t.Error("public output should have gone to the public bucket")
+	}
+	if _, ok := client.buckets["internal"]["pageviews/pageviews-2024-W17.zst"]; !ok {
+		t.Error("internal artifact should have gone to the internal bucket")
+	}
+
+	want := []string{
+		"page_signals/rmwiki-20240501-page_signals.zst",
+		"pageviews/pageviews-2023-W01.zst",
+		"pageviews/pageviews-2024-W17.zst",
+		"public/qrank-20240501.csv.gz",
+		"public/qrank-stats-20240501.json",
+	}
+	if got := listKeys(t, r, ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := listKeys(t, r, "public/"); !reflect.DeepEqual(got, want[3:]) {
+		t.Errorf("got %q, want %q", got, want[3:])
+	}
+	if got := listKeys(t, r, "pageviews/"); !reflect.DeepEqual(got, want[1:3]) {
+		t.Errorf("got %q, want %q", got, want[1:3])
+	}
+
+	// Reading an internal artifact that is only in the mirror.
+	dest := filepath.Join(t.TempDir(), "download")
+	if err := r.FGetObject(ctx, Bucket, "pageviews/pageviews-2023-W01.zst", dest, minio.GetObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dest); string(got) != "mirrored" {
+		t.Errorf("got %q, want %q", got, "mirrored")
+	}
+	if info, err := r.StatObject(ctx, Bucket, "pageviews/pageviews-2023-W01.zst", minio.StatObjectOptions{}); err != nil || info.Size != 8 {
+		t.Errorf("got %v, %v; want size 8", info, err)
+	}
+
+	// Public outputs never come from the mirror.
+	err := r.FGetObject(ctx, Bucket, "public/qrank-20230101.csv.gz", dest, minio.GetObjectOptions{})
+	if !isNotFound(err) {
+		t.Errorf("expected NoSuchKey, got %v", err)
+	}
+
+	if ok, err := r.BucketExists(ctx, Bucket); !ok || err != nil {
+		t.Errorf("got %v, %v; want true, nil", ok, err)
+	}
+	delete(mirrorClient.buckets, "old")
+	if ok, _ := r.BucketExists(ctx, Bucket); ok {
+		t.Error("BucketExists should fail if the mirror bucket is missing")
+	}
+}
+
+func TestRouter_CopyObject(t *testing.T) {
+	ctx := context.Background()
+	internal, public := newFakeClient("qrank"), newFakeClient("qrank")
+	r := &Router{internal: target{internal, "qrank"}, public: target{public, "qrank"}}
+	internal.buckets["qrank"]["page_entities/rmwiki-20240501-page_entities.zst"] = []byte("x")
+
+	dst := minio.CopyDestOptions{Bucket: Bucket, Object: "page_signals/rmwiki-20240501-page_signals.zst"}
+	src := minio.CopySrcOptions{Bucket: Bucket, Object: "page_entities/rmwiki-20240501-page_entities.zst"}
+	if _, err := r.CopyObject(ctx, dst, src); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := internal.buckets["qrank"][dst.Object]; !ok {
+		t.Error("object should have been copied")
+	}
+
+	dst.Object = "public/foo"
+	if _, err := r.CopyObject(ctx, dst, src); err == nil {
+		t.Error("expected error for copying across endpoints")
+	}
+}
+
+func TestRouter_Prefix(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeClient("internal", "public")
+	r := &Router{internal: target{client, "internal"}, public: target{client, "public"}, prefix: "testrun/"}
+	client.buckets["internal"]["pageviews/pageviews-2024-W17.zst"] = []byte("production")
+
+	file := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"public/qrank-stats-20240501.json", "pageviews/pageviews-2024-W18.zst"} {
+		if _, err := r.FPutObject(ctx, Bucket, key, file, minio.PutObjectOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(client.buckets["public"]) != 0 {
+		t.Errorf("nothing should have gone to the public bucket, got %v", client.buckets["public"])
+	}
+	if _, ok := client.buckets["internal"]["testrun/public/qrank-stats-20240501.json"]; !ok {
+		t.Error("public output should have gone under the prefix")
+	}
+
+	want := []string{"pageviews/pageviews-2024-W18.zst", "public/qrank-stats-20240501.json"}
+	if got := listKeys(t, r, ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := listKeys(t, r, "public/"); !reflect.DeepEqual(got, want[1:]) {
+		t.Errorf("got %q, want %q", got, want[1:])
+	}
+
+	info, err := r.StatObject(ctx, Bucket, "public/qrank-stats-20240501.json", minio.StatObjectOptions{})
+	if err != nil || info.Key != "public/qrank-stats-20240501.json" {
+		t.Errorf("got %v, %v", info, err)
+	}
+	if _, err := r.StatObject(ctx, Bucket, "pageviews/pageviews-2024-W17.zst", minio.StatObjectOptions{}); !isNotFound(err) {
+		t.Errorf("objects outside the prefix should not be visible, got %v", err)
+	}
+
+	dst := minio.CopyDestOptions{Bucket: Bucket, Object: "public/copy.json"}
+	src := minio.CopySrcOptions{Bucket: Bucket, Object: "public/qrank-stats-20240501.json"}
+	if _, err := r.CopyObject(ctx, dst, src); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.buckets["internal"]["testrun/public/copy.json"]; !ok {
+		t.Error("copy should have gone under the prefix")
+	}
+	if err := r.RemoveObject(ctx, Bucket, "public/copy.json", minio.RemoveObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.buckets["internal"]["testrun/public/copy.json"]; ok {
+		t.Error("copy should have been removed")
+	}
+}
@@ -0,0 +1,369 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package objstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// RetryPolicy tells how long storage calls may take, and how often
+// they get retried after failing. Without time limits, a stalled
+// connection can hang a build for hours. Zero values get replaced
+// by the defaults of DefaultRetryPolicy. In the configuration file,
+// durations are strings such as "90s" or "2h".
+type RetryPolicy struct {
+	// Timeout limits each attempt of a call that does not transfer
+	// object content, such as StatObject or RemoveObject. It also
+	// limits how long we wait for the response headers of any request,
+	// including each page of a listing.
+	Timeout time.Duration
+
+	// TransferTimeout limits each attempt of FGetObject and FPutObject.
+	// Some of our files are many gigabytes in size, so this is long.
+	TransferTimeout time.Duration
+
+	// MaxAttempts is how often a call gets tried before giving up.
+	MaxAttempts int
+
+	// Between attempts, we wait for a random duration between half and
+	// all of the backoff. The backoff starts at InitialBackoff, and
+	// doubles after every attempt up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// SlowCall is the duration after which a call that does not
+	// transfer object content gets logged as slow.
+	SlowCall time.Duration
+}
+
+// DefaultRetryPolicy is used for everything that is not configured.
+var DefaultRetryPolicy = RetryPolicy{
+	Timeout:         2 * time.Minute,
+	TransferTimeout: 4 * time.Hour,
+	MaxAttempts:     4,
+	InitialBackoff:  2 * time.Second,
+	MaxBackoff:      time.Minute,
+	SlowCall:        30 * time.Second,
+}
+
+// WithDefaults returns a copy of the policy where unset fields
+// have their default values.
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	d := DefaultRetryPolicy
+	if p.Timeout <= 0 {
+		p.Timeout = d.Timeout
+	}
+	if p.TransferTimeout <= 0 {
+		p.TransferTimeout = d.TransferTimeout
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = d.MaxAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = d.InitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = d.MaxBackoff
+	}
+	if p.SlowCall <= 0 {
+		p.SlowCall = d.SlowCall
+	}
+	return p
+}
+
+// Backoff returns how long to wait before the given attempt,
+// which is at least 2 for the first retry.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	b := p.InitialBackoff
+	for i := 2; i < attempt && b < p.MaxBackoff; i++ {
+		b *= 2
+	}
+	b = min(b, p.MaxBackoff)
+	return b/2 + time.Duration(rand.Int63n(int64(b/2)+1))
+}
+
+// UnmarshalJSON parses a policy whose durations are given as strings.
+func (p *RetryPolicy) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Timeout, TransferTimeout   string
+		MaxAttempts                int
+		InitialBackoff, MaxBackoff string
+		SlowCall                   string
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	result := RetryPolicy{MaxAttempts: raw.MaxAttempts}
+	for _, f := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"Timeout", raw.Timeout, &result.Timeout},
+		{"TransferTimeout", raw.TransferTimeout, &result.TransferTimeout},
+		{"InitialBackoff", raw.InitialBackoff, &result.InitialBackoff},
+		{"MaxBackoff", raw.MaxBackoff, &result.MaxBackoff},
+		{"SlowCall", raw.SlowCall, &result.SlowCall},
+	} {
+		if f.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f.value)
+		if err != nil {
+			return fmt.Errorf("Retry.%s: %w", f.name, err)
+		}
+		*f.dest = d
+	}
+	*p = result
+	return nil
+}
+
+// Stats counts the calls to storage, so operators can see whether
+// the storage service is having trouble.
+type Stats struct {
+	Calls     int64 // calls made by our code, not counting retries
+	Retries   int64 // attempts after the first
+	Failures  int64 // calls that failed after the last attempt
+	SlowCalls int64 // attempts that took longer than RetryPolicy.SlowCall
+}
+
+// Sub returns the difference between two snapshots of the statistics.
+func (s Stats) Sub(other Stats) Stats {
+	return Stats{
+		Calls:     s.Calls - other.Calls,
+		Retries:   s.Retries - other.Retries,
+		Failures:  s.Failures - other.Failures,
+		SlowCalls: s.SlowCalls - other.SlowCalls,
+	}
+}
+
+// CallStats is shared by all clients of a Router.
+type callStats struct {
+	calls, retries, failures, slowCalls atomic.Int64
+	logger                              atomic.Pointer[log.Logger]
+}
+
+func (s *callStats) snapshot() Stats {
+	return Stats{
+		Calls:     s.calls.Load(),
+		Retries:   s.retries.Load(),
+		Failures:  s.failures.Load(),
+		SlowCalls: s.slowCalls.Load(),
+	}
+}
+
+func (s *callStats) logf(format string, args ...any) {
+	logger := s.logger.Load()
+	if logger == nil {
+		logger = log.Default()
+	}
+	logger.Printf(format, args...)
+}
+
+// RetryingClient wraps a Client, limiting the duration of every call
+// and retrying calls that failed for a reason that might go away.
+type retryingClient struct {
+	client Client
+	policy RetryPolicy
+	stats  *callStats
+	sleep  func(ctx context.Context, d time.Duration) error // replaced in tests
+}
+
+func newRetryingClient(client Client, policy RetryPolicy, stats *callStats) *retryingClient {
+	return &retryingClient{client: client, policy: policy.withDefaults(), stats: stats, sleep: sleep}
+}
+
+// Do calls f until it succeeds, it fails for good, or we run out of
+// attempts. Each attempt gets its own deadline. Calls that transfer
+// object content get the longer deadline, and never count as slow.
+func (c *retryingClient) do(ctx context.Context, op, key string, transfer bool, f func(ctx context.Context) error) error {
+	c.stats.calls.Add(1)
+	timeout := c.policy.Timeout
+	if transfer {
+		timeout = c.policy.TransferTimeout
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		callCtx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		err = f(callCtx)
+		elapsed := time.Since(start)
+		timedOut := err != nil && callCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+		cancel()
+
+		if !transfer && elapsed >= c.policy.SlowCall {
+			c.stats.slowCalls.Add(1)
+			c.stats.logf("storage: slow %s %s took %.1fs", op, key, elapsed.Seconds())
+		}
+		if err == nil {
+			return nil
+		}
+		if timedOut {
+			err = fmt.Errorf("%s %s: no response after %v: %w", op, key, timeout, err)
+		}
+		if attempt >= c.policy.MaxAttempts || ctx.Err() != nil || !(timedOut || isRetryable(err)) {
+			break
+		}
+
+		wait := c.policy.backoff(attempt + 1)
+		c.stats.logf("storage: %s %s failed, retrying in %.1fs: %v", op, key, wait.Seconds(), err)
+		if sleepErr := c.sleep(ctx, wait); sleepErr != nil {
+			break
+		}
+		c.stats.retries.Add(1)
+	}
+	c.stats.failures.Add(1)
+	return err
+}
+
+// IsRetryable returns true if a failed call might succeed when tried
+// again. Errors reported by the storage service, such as a missing
+// object or a denied access, are final unless the service said it
+// was overloaded or had an internal problem; so are problems with
+// local files. Other errors, such as a connection getting reset,
+// are worth another try.
+func isRetryable(err error) bool {
+	var pathErr *fs.PathError
+	if errors.Is(err, context.Canceled) || errors.As(err, &pathErr) {
+		return false
+	}
+	resp := minio.ToErrorResponse(err)
+	switch resp.Code {
+	case "":
+		return resp.StatusCode == 0 || resp.StatusCode >= 500 || resp.StatusCode == 429
+	case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable":
+		return true
+	default:
+		return resp.StatusCode >= 500 || resp.StatusCode == 429
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (c *retryingClient) BucketExists(ctx context.Context, bucket string) (bool, error) {
+	var result bool
+	err := c.do(ctx, "BucketExists", bucket, false, func(ctx context.Context) error {
+		var err error
+		result, err = c.client.BucketExists(ctx, bucket)
+		return err
+	})
+	return result, err
+}
+
+// ListObjects lists objects. The listing can take arbitrarily long,
+// so there is no deadline for it as a whole; a stalled listing gets
+// caught by the deadline for the response headers of each page.
+// If the listing fails midway, it gets resumed after the last object
+// that was already sent.
+func (c *retryingClient) ListObjects(ctx context.Context, bucket string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	out := make(chan minio.ObjectInfo, 100)
+	go func() {
+		defer close(out)
+		c.stats.calls.Add(1)
+		for attempt := 1; ; attempt++ {
+			var err error
+			for obj := range c.client.ListObjects(ctx, bucket, opts) {
+				if obj.Err != nil {
+					err = obj.Err
+					break
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case out <- obj:
+					opts.StartAfter = obj.Key
+				}
+			}
+			if err == nil {
+				return
+			}
+			giveUp := attempt >= c.policy.MaxAttempts || ctx.Err() != nil || !isRetryable(err)
+			if !giveUp {
+				wait := c.policy.backoff(attempt + 1)
+				c.stats.logf("storage: ListObjects %s/%s failed, retrying in %.1fs: %v", bucket, opts.Prefix, wait.Seconds(), err)
+				giveUp = c.sleep(ctx, wait) != nil
+			}
+			if giveUp {
+				c.stats.failures.Add(1)
+				select {
+				case <-ctx.Done():
+				case out <- minio.ObjectInfo{Err: err}:
+				}
+				return
+			}
+			c.stats.retries.Add(1)
+		}
+	}()
+	return out
+}
+
+func (c *retryingClient) StatObject(ctx context.Context, bucket, key string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	var result minio.ObjectInfo
+	err := c.do(ctx, "StatObject", key, false, func(ctx context.Context) error {
+		var err error
+		result, err = c.client.StatObject(ctx, bucket, key, opts)
+		return err
+	})
+	return result, err
+}
+
+// GetObject opens an object for reading. The returned object fetches
+// its content lazily, using ctx, so it can neither have a deadline
+// nor get retried here; stalled requests get caught by the deadline
+// for response headers.
+func (c *retryingClient) GetObject(ctx context.Context, bucket, key string, opts minio.GetObjectOptions) (*minio.Object, error) {
+	c.stats.calls.Add(1)
+	return c.client.GetObject(ctx, bucket, key, opts)
+}
+
+func (c *retryingClient) FGetObject(ctx context.Context, bucket, key, filePath string, opts minio.GetObjectOptions) error {
+	return c.do(ctx, "FGetObject", key, true, func(ctx context.Context) error {
+		return c.client.FGetObject(ctx, bucket, key, filePath, opts)
+	})
+}
+
+func (c *retryingClient) FPutObject(ctx context.Context, bucket, key, filePath string, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	var result minio.UploadInfo
+	err := c.do(ctx, "FPutObject", key, true, func(ctx context.Context) error {
+		var err error
+		result, err = c.client.FPutObject(ctx, bucket, key, filePath, opts)
+		return err
+	})
+	return result, err
+}
+
+func (c *retryingClient) RemoveObject(ctx context.Context, bucket, key string, opts minio.RemoveObjectOptions) error {
+	return c.do(ctx, "RemoveObject", key, false, func(ctx context.Context) error {
+		return c.client.RemoveObject(ctx, bucket, key, opts)
+	})
+}
+
+func (c *retryingClient) CopyObject(ctx context.Context, dst minio.CopyDestOptions, src minio.CopySrcOptions) (minio.UploadInfo, error) {
+	var result minio.UploadInfo
+	err := c.do(ctx, "CopyObject", dst.Object, true, func(ctx context.Context) error {
+		var err error
+		result, err = c.client.CopyObject(ctx, dst, src)
+		return err
+	})
+	return result, err
+}
@@ -0,0 +1,295 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// FlakyClient is a fakeClient whose calls fail a number of times
+// before they start to work.
+type flakyClient struct {
+	*fakeClient
+	failures int
+	err      error
+	block    bool // if true, failing calls wait for their deadline
+}
+
+func (c *flakyClient) fail(ctx context.Context) error {
+	if c.failures <= 0 {
+		return nil
+	}
+	c.failures -= 1
+	if c.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return c.err
+}
+
+func (c *flakyClient) StatObject(ctx context.Context, bucket, key string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	if err := c.fail(ctx); err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	return c.fakeClient.StatObject(ctx, bucket, key, opts)
+}
+
+// ListObjects fails after sending the first object.
+func (c *flakyClient) ListObjects(ctx context.Context, bucket string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	out := make(chan minio.ObjectInfo, 10)
+	go func() {
+		defer close(out)
+		first := true
+		for obj := range c.fakeClient.ListObjects(ctx, bucket, opts) {
+			if opts.StartAfter != "" && obj.Key <= opts.StartAfter {
+				continue
+			}
+			if !first {
+				if err := c.fail(ctx); err != nil {
+					out <- minio.ObjectInfo{Err: err}
+					return
+				}
+			}
+			out <- obj
+			first = false
+		}
+	}()
+	return out
+}
+
+func newTestRetryingClient(client Client, policy RetryPolicy) (*retryingClient, *[]time.Duration, *bytes.Buffer) {
+	var logs bytes.Buffer
+	stats := &callStats{}
+	stats.logger.Store(log.New(&logs, "", 0))
+	c := newRetryingClient(client, policy, stats)
+	var waits []time.Duration
+	c.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return ctx.Err()
+	}
+	return c, &waits, &logs
+}
+
+func TestRetryingClient(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeClient("qrank")
+	fake.buckets["qrank"]["foo"] = []byte("foo")
+	slowDown := minio.ErrorResponse{Code: "SlowDown", StatusCode: 503}
+	flaky := &flakyClient{fakeClient: fake, failures: 2, err: slowDown}
+	c, waits, logs := newTestRetryingClient(flaky, RetryPolicy{InitialBackoff: time.Second})
+
+	info, err := c.StatObject(ctx, "qrank", "foo", minio.StatObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 3 {
+		t.Errorf("got size %d, want 3", info.Size)
+	}
+	if len(*waits) != 2 {
+		t.Errorf("got %d waits, want 2", len(*waits))
+	}
+	if got, want := c.stats.snapshot(), (Stats{Calls: 1, Retries: 2}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if !strings.Contains(logs.String(), "StatObject foo failed, retrying") {
+		t.Errorf("retries should be logged, got %q", logs.String())
+	}
+
+	// Missing objects are not worth retrying.
+	if _, err := c.StatObject(ctx, "qrank", "bar", minio.StatObjectOptions{}); !isNotFound(err) {
+		t.Errorf("got %v, want NoSuchKey", err)
+	}
+	if got, want := c.stats.snapshot(), (Stats{Calls: 2, Retries: 2, Failures: 1}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestRetryingClient_GiveUp(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakyClient{fakeClient: newFakeClient("qrank"), failures: 10, err: io.ErrUnexpectedEOF}
+	c, waits, _ := newTestRetryingClient(flaky, RetryPolicy{MaxAttempts: 3})
+	if _, err := c.StatObject(ctx, "qrank", "foo", minio.StatObjectOptions{}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if len(*waits) != 2 || flaky.failures != 7 {
+		t.Errorf("got %d waits and %d attempts, want 2 and 3", len(*waits), 10-flaky.failures)
+	}
+	if got, want := c.stats.snapshot(), (Stats{Calls: 1, Retries: 2, Failures: 1}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestRetryingClient_Timeout(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeClient("qrank")
+	fake.buckets["qrank"]["foo"] = []byte("foo")
+	flaky := &flakyClient{fakeClient: fake, failures: 1, block: true}
+	policy := RetryPolicy{Timeout: 10 * time.Millisecond, SlowCall: 5 * time.Millisecond}
+	c, _, logs := newTestRetryingClient(flaky, policy)
+	if _, err := c.StatObject(ctx, "qrank", "foo", minio.StatObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.stats.snapshot(), (Stats{Calls: 1, Retries: 1, SlowCalls: 1}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	for _, want := range []string{"no response after 10ms", "storage: slow StatObject foo took"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log should contain %q, got %q", want, logs.String())
+		}
+	}
+}
+
+func TestRetryingClient_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	flaky := &flakyClient{fakeClient: newFakeClient("qrank"), failures: 10, block: true}
+	c, waits, _ := newTestRetryingClient(flaky, RetryPolicy{})
+	if _, err := c.StatObject(ctx, "qrank", "foo", minio.StatObjectOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if len(*waits) != 0 {
+		t.Errorf("canceled calls should not be retried, got %d waits", len(*waits))
+	}
+}
+
+func TestRetryingClient_ListObjects(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeClient("qrank")
+	for _, key := range []string{"a", "b", "c"} {
+		fake.buckets["qrank"][key] = []byte(key)
+	}
+	flaky := &flakyClient{fakeClient: fake, failures: 2, err: io.ErrUnexpectedEOF}
+	c, waits, _ := newTestRetryingClient(flaky, RetryPolicy{})
+	var keys []string
+	for obj := range c.ListObjects(ctx, "qrank", minio.ListObjectsOptions{}) {
+		if obj.Err != nil {
+			t.Fatal(obj.Err)
+		}
+		keys = append(keys, obj.Key)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got %v, want %v", keys, want)
+	}
+	if len(*waits) != 2 {
+		t.Errorf("got %d waits, want 2", len(*waits))
+	}
+
+	flaky.failures, flaky.err = 10, minio.ErrorResponse{Code: "AccessDenied", StatusCode: 403}
+	var gotErr error
+	for obj := range c.ListObjects(ctx, "qrank", minio.ListObjectsOptions{}) {
+		gotErr = obj.Err
+	}
+	if minio.ToErrorResponse(gotErr).Code != "AccessDenied" {
+		t.Errorf("got %v, want AccessDenied", gotErr)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{io.ErrUnexpectedEOF, true},
+		{context.Canceled, false},
+		{&fs.PathError{Op: "open", Path: "/tmp/x", Err: fs.ErrNotExist}, false},
+		{minio.ErrorResponse{Code: "NoSuchKey", StatusCode: 404}, false},
+		{minio.ErrorResponse{Code: "AccessDenied", StatusCode: 403}, false},
+		{minio.ErrorResponse{Code: "SlowDown", StatusCode: 503}, true},
+		{minio.ErrorResponse{Code: "InternalError"}, true},
+		{minio.ErrorResponse{StatusCode: 502}, true},
+		{minio.ErrorResponse{StatusCode: 429}, true},
+	} {
+		if got := isRetryable(tc.err); got != tc.want {
+			t.Errorf("isRetryable(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for _, tc := range []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{2, time.Second},
+		{3, 2 * time.Second},
+		{4, 4 * time.Second},
+		{5, 5 * time.Second},
+		{20, 5 * time.Second},
+	} {
+		for i := 0; i < 20; i++ {
+			if got := p.backoff(tc.attempt); got < tc.max/2 || got > tc.max {
+				t.Errorf("backoff(%d) = %v, want between %v and %v", tc.attempt, got, tc.max/2, tc.max)
+			}
+		}
+	}
+}
+
+func TestReadConfig_Retry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage-key.json")
+	config := `{"Endpoint": "e", "Key": "k", "Secret": "s",
+		"Retry": {"Timeout": "90s", "MaxAttempts": 7}}`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RetryPolicy{Timeout: 90 * time.Second, MaxAttempts: 7}
+	if c.Retry == nil || *c.Retry != want {
+		t.Errorf("got %+v, want %+v", c.Retry, want)
+	}
+	if got := c.Retry.withDefaults(); got.TransferTimeout != DefaultRetryPolicy.TransferTimeout || got.Timeout != want.Timeout {
+		t.Errorf("got %+v, want defaults for unset fields", got)
+	}
+
+	bad := `{"Endpoint": "e", "Retry": {"Timeout": "soon"}}`
+	if err := os.WriteFile(path, []byte(bad), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadConfig(path); err == nil || !strings.Contains(err.Error(), "Retry.Timeout") {
+		t.Errorf("got %v, want error about Retry.Timeout", err)
+	}
+}
+
+func TestReadConfig_RetryEnv(t *testing.T) {
+	t.Setenv("S3_ENDPOINT", "e")
+	t.Setenv("S3_TIMEOUT", "45s")
+	t.Setenv("S3_MAX_ATTEMPTS", "2")
+	c, err := ReadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RetryPolicy{Timeout: 45 * time.Second, MaxAttempts: 2}
+	if c.Retry == nil || *c.Retry != want {
+		t.Errorf("got %+v, want %+v", c.Retry, want)
+	}
+
+	t.Setenv("S3_MAX_ATTEMPTS", "many")
+	if _, err := ReadConfig(""); err == nil {
+		t.Error("expected error for bad S3_MAX_ATTEMPTS")
+	}
+}
+
+func TestRouter_Stats(t *testing.T) {
+	var r Router
+	if got := r.Stats(); got != (Stats{}) {
+		t.Errorf("got %+v, want zero", got)
+	}
+	r.SetLogger(log.Default()) // must not crash
+}
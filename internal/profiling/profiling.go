@@ -0,0 +1,211 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+// Package profiling gives insight into the memory use of our long-running
+// builders. Some builds run for many hours, and occasionally their
+// resident set size (RSS) balloons. To find out why, the package can
+// serve the endpoints of [net/http/pprof], periodically log memory
+// statistics, and write a heap profile when the RSS crosses a threshold.
+package profiling
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options configure Start. Zero values disable the respective feature.
+type Options struct {
+	// Name of the tool, such as "qrank-builder", used in the file
+	// names of heap profiles.
+	Name string
+
+	// Port is where the net/http/pprof endpoints get served,
+	// on the loopback interface only. Zero for not serving them.
+	Port int
+
+	// Metrics, if set, gets served at /metrics on Port, such as
+	// the handler of a Prometheus registry.
+	Metrics http.Handler
+
+	// MemStatsInterval is how often memory statistics get logged.
+	// Zero for never.
+	MemStatsInterval time.Duration
+
+	// HeapDumpRSS is the resident set size, in bytes, at which a heap
+	// profile gets written into HeapDumpDir. After a dump, the next
+	// one gets written when the RSS has grown by another half.
+	// Zero for never.
+	HeapDumpRSS uint64
+	HeapDumpDir string
+
+	// Logger receives the memory statistics, and notes about heap
+	// profiles. If nil, the standard logger is used.
+	Logger *log.Logger
+}
+
+// Start sets up profiling in the background, until ctx gets canceled.
+// It returns an error if the pprof listener cannot be opened.
+func Start(ctx context.Context, opts Options) error {
+	if opts.Logger == nil {
+		opts.Logger = log.Default()
+	}
+	if opts.Name == "" {
+		opts.Name = filepath.Base(os.Args[0])
+	}
+
+	if opts.Port != 0 {
+		addr := net.JoinHostPort("localhost", strconv.Itoa(opts.Port))
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		server := &http.Server{Handler: portHandler(opts), ReadHeaderTimeout: 10 * time.Second}
+		go server.Serve(listener)
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+		opts.Logger.Printf("serving pprof on http://%s/debug/pprof/", listener.Addr())
+	}
+
+	if opts.MemStatsInterval > 0 || opts.HeapDumpRSS > 0 {
+		interval := opts.MemStatsInterval
+		if interval <= 0 || (opts.HeapDumpRSS > 0 && interval > 10*time.Second) {
+			interval = 10 * time.Second
+		}
+		go watch(ctx, opts, interval)
+	}
+
+	return nil
+}
+
+// Handler returns a handler for the net/http/pprof endpoints. Unlike
+// importing net/http/pprof for its side effects, this does not touch
+// http.DefaultServeMux.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// PortHandler returns the handler for opts.Port, which serves the
+// net/http/pprof endpoints, and opts.Metrics if it is set.
+func portHandler(opts Options) http.Handler {
+	if opts.Metrics == nil {
+		return Handler()
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/pprof/", Handler())
+	mux.Handle("/metrics", opts.Metrics)
+	return mux
+}
+
+// Watch samples the memory use every interval, logging statistics
+// every opts.MemStatsInterval, and writing heap profiles when the RSS
+// crosses opts.HeapDumpRSS.
+func watch(ctx context.Context, opts Options, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastLog time.Time
+	nextDump := opts.HeapDumpRSS
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			rss := RSS()
+			if opts.MemStatsInterval > 0 && now.Sub(lastLog) >= opts.MemStatsInterval {
+				opts.Logger.Print(MemStats(rss))
+				lastLog = now
+			}
+			if nextDump > 0 && rss >= nextDump {
+				path, err := WriteHeapProfile(opts.HeapDumpDir, opts.Name, now)
+				if err != nil {
+					opts.Logger.Printf("cannot write heap profile: %v", err)
+				} else {
+					opts.Logger.Printf("RSS is %d MiB, wrote heap profile to %s", rss>>20, path)
+				}
+				nextDump = rss + rss/2
+			}
+		}
+	}
+}
+
+// MemStats formats the current memory statistics of the Go runtime,
+// together with the resident set size, for logging.
+func MemStats(rss uint64) string {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return fmt.Sprintf(
+		"memory: rss=%dMiB heap_alloc=%dMiB heap_inuse=%dMiB heap_idle=%dMiB heap_released=%dMiB sys=%dMiB num_gc=%d goroutines=%d",
+		rss>>20, m.HeapAlloc>>20, m.HeapInuse>>20, m.HeapIdle>>20, m.HeapReleased>>20, m.Sys>>20,
+		m.NumGC, runtime.NumGoroutine())
+}
+
+// WriteHeapProfile writes a heap profile into dir, in a file whose name
+// tells the tool and the time, such as qrank-builder-heap-20240602T101500Z.pprof.
+// It returns the path to the written file.
+func WriteHeapProfile(dir, name string, now time.Time) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	fileName := fmt.Sprintf("%s-heap-%s.pprof", name, now.UTC().Format("20060102T150405Z"))
+	path := filepath.Join(dir, fileName)
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := runtimepprof.WriteHeapProfile(f); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// RSS returns the resident set size of the current process in bytes.
+// On Linux, it is read from /proc/self/statm. Elsewhere, we fall back
+// to the memory obtained from the operating system by the Go runtime,
+// which is an upper bound.
+func RSS() uint64 {
+	if data, err := os.ReadFile("/proc/self/statm"); err == nil {
+		if rss, ok := parseStatm(string(data), os.Getpagesize()); ok {
+			return rss
+		}
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.Sys
+}
+
+// ParseStatm extracts the resident set size in bytes from the content
+// of /proc/self/statm, whose second field is the number of resident pages.
+func parseStatm(statm string, pageSize int) (uint64, bool) {
+	fields := strings.Fields(statm)
+	if len(fields) < 2 {
+		return 0, false
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return pages * uint64(pageSize), true
+}
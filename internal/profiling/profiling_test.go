@@ -0,0 +1,155 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package profiling
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseStatm(t *testing.T) {
+	for _, tc := range []struct {
+		statm string
+		want  uint64
+		ok    bool
+	}{
+		{"2497 512 384 2 0 177 0\n", 512 * 4096, true},
+		{"2497", 0, false},
+		{"2497 x 384", 0, false},
+		{"", 0, false},
+	} {
+		got, ok := parseStatm(tc.statm, 4096)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("parseStatm(%q) = %d, %v; want %d, %v", tc.statm, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestRSS(t *testing.T) {
+	if rss := RSS(); rss == 0 {
+		t.Error("RSS() should not be zero")
+	}
+}
+
+func TestMemStats(t *testing.T) {
+	got := MemStats(3 << 20)
+	for _, want := range []string{"rss=3MiB", "heap_alloc=", "num_gc=", "goroutines="} {
+		if !strings.Contains(got, want) {
+			t.Errorf("MemStats() = %q, should contain %q", got, want)
+		}
+	}
+}
+
+func TestWriteHeapProfile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "profiles")
+	now := time.Date(2024, 6, 2, 10, 15, 0, 0, time.UTC)
+	path, err := WriteHeapProfile(dir, "test-builder", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "test-builder-heap-20240602T101500Z.pprof"); path != want {
+		t.Errorf("got %q, want %q", path, want)
+	}
+	if st, err := os.Stat(path); err != nil || st.Size() == 0 {
+		t.Errorf("heap profile should be non-empty, got %v, %v", st, err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/debug/pprof/heap?debug=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestPortHandler_Metrics(t *testing.T) {
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "foo_total 7")
+	})
+	server := httptest.NewServer(portHandler(Options{Metrics: metrics}))
+	defer server.Close()
+	for _, path := range []string{"/metrics", "/debug/pprof/heap?debug=1"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: got status %d, want 200", path, resp.StatusCode)
+		}
+		if path == "/metrics" && string(body) != "foo_total 7\n" {
+			t.Errorf("%s: got %q", path, body)
+		}
+	}
+}
+
+func TestStart_HeapDump(t *testing.T) {
+	var buf syncBuffer
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := Options{
+		Name:             "test-builder",
+		MemStatsInterval: time.Millisecond,
+		HeapDumpRSS:      1, // any process crosses this
+		HeapDumpDir:      dir,
+		Logger:           log.New(&buf, "", 0),
+	}
+	if err := Start(ctx, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		files, _ := filepath.Glob(filepath.Join(dir, "test-builder-heap-*.pprof"))
+		if len(files) > 0 && strings.Contains(buf.String(), "memory: rss=") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no heap profile or memory statistics written; log: %q", buf.String())
+}
+
+func TestStart_BadPort(t *testing.T) {
+	if err := Start(context.Background(), Options{Port: -1}); err == nil {
+		t.Error("expected error for bad port")
+	}
+}
+
+// SyncBuffer is a bytes.Buffer that can be written by the watcher
+// goroutine while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
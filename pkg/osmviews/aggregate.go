@@ -0,0 +1,86 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package osmviews
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/lanrat/extsort"
+	"golang.org/x/sync/errgroup"
+)
+
+// ReadTileCounts parses the lines of an uncompressed tile log, such as
+// "12/2138/1420 17", and sends the counts to out. Malformed lines and
+// lines without impressions get skipped.
+func ReadTileCounts(ctx context.Context, r io.Reader, out chan<- extsort.SortType) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Check if our task has been canceled. Typically this can happen
+		// because of an error in another goroutine in the same x.sync.errroup.
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if tc := ParseTileCount(scanner.Text()); tc.Count > 0 {
+			out <- tc
+		}
+	}
+	return scanner.Err()
+}
+
+// AggregateTileCounts sorts the tile counts that get sent by feed,
+// sums up the counts for the same tile, and writes the result to w
+// in the format of the tile logs, such as "12/2138/1420 17", sorted
+// by TileKey. The feed function is called once; when it returns,
+// its output channel gets closed. Because the tile logs of a week
+// have billions of lines, sorting happens externally on disk.
+func AggregateTileCounts(ctx context.Context, feed func(ctx context.Context, out chan<- extsort.SortType) error, w io.Writer) error {
+	ch := make(chan extsort.SortType, 100000)
+	g, subCtx := errgroup.WithContext(ctx)
+	config := extsort.DefaultConfig()
+	config.NumWorkers = runtime.NumCPU()
+	sorter, outChan, errChan := extsort.New(ch, TileCountFromBytes, TileCountLess, config)
+	g.Go(func() error {
+		defer close(ch)
+		return feed(subCtx, ch)
+	})
+	g.Go(func() error {
+		sorter.Sort(ctx) // not subCtx, as per extsort docs
+		return nil
+	})
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	var last TileCount
+	var writeErr error
+	write := func(tc TileCount) {
+		if tc.Count > 0 && writeErr == nil {
+			zoom, x, y := tc.Key.ZoomXY()
+			_, writeErr = fmt.Fprintf(w, "%d/%d/%d %d\n", zoom, x, y, tc.Count)
+		}
+	}
+	for data := range outChan {
+		cur := data.(TileCount)
+		if cur.Key != last.Key {
+			write(last)
+			last = cur
+		} else {
+			last.Count += cur.Count
+		}
+	}
+	write(last)
+
+	// Check for errors from the external sorting library.
+	if err := <-errChan; err != nil {
+		return err
+	}
+	return writeErr
+}
@@ -0,0 +1,49 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package osmviews
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lanrat/extsort"
+)
+
+func TestAggregateTileCounts(t *testing.T) {
+	logs := []string{
+		"2/1/1 7\n0/0/0 3\nmalformed\n1/0/1 0\n",
+		"2/1/1 5\n1/1/0 2\n",
+	}
+	feed := func(ctx context.Context, out chan<- extsort.SortType) error {
+		for _, log := range logs {
+			if err := ReadTileCounts(ctx, strings.NewReader(log), out); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var buf strings.Builder
+	if err := AggregateTileCounts(context.Background(), feed, &buf); err != nil {
+		t.Fatal(err)
+	}
+	// Tiles are sorted by TileKey, so 2/1/1 comes within its parent 1/0/0.
+	want := "0/0/0 3\n2/1/1 12\n1/1/0 2\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestAggregateTileCounts_FeedError(t *testing.T) {
+	failure := errors.New("test failure")
+	feed := func(ctx context.Context, out chan<- extsort.SortType) error {
+		out <- ParseTileCount("0/0/0 1")
+		return failure
+	}
+	var buf strings.Builder
+	if err := AggregateTileCounts(context.Background(), feed, &buf); !errors.Is(err, failure) {
+		t.Errorf("got %v, want %v", err, failure)
+	}
+}
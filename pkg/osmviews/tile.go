@@ -1,14 +1,21 @@
 // SPDX-FileCopyrightText: 2022 Sascha Brawer <sascha@brawer.ch>
 // SPDX-License-Identifier: MIT
 
-package main
+// Package osmviews helps to work with the OSMViews data, which tells
+// how often the tiles of OpenStreetMap have been viewed. Tiles are
+// addressed by TileKey, which sorts containing tiles before their
+// content; helpers convert a tile to the bounding box, WKT, GeoJSON
+// or quadkey forms that are understood by other geographic software.
+package osmviews
 
 import (
 	"encoding/binary"
 	"fmt"
 	"math"
 	"math/bits"
+	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/lanrat/extsort"
 )
@@ -37,6 +44,87 @@ func TileFromLatLng(lat, lng float64, zoom uint8) (x, y uint32) {
 	return x, y
 }
 
+// MaxLatitude is the northernmost latitude covered by web mercator tiles,
+// in degrees. The southernmost latitude is -MaxLatitude.
+const MaxLatitude = 85.0511287798066
+
+// BBox is a geographic bounding box in WGS84 degrees.
+type BBox struct {
+	MinLng, MinLat, MaxLng, MaxLat float64
+}
+
+// WKT returns the bounding box as a Well-Known Text polygon.
+func (b BBox) WKT() string {
+	w, s, e, n := formatDegrees(b.MinLng), formatDegrees(b.MinLat), formatDegrees(b.MaxLng), formatDegrees(b.MaxLat)
+	return fmt.Sprintf("POLYGON((%s %s,%s %s,%s %s,%s %s,%s %s))", w, s, e, s, e, n, w, n, w, s)
+}
+
+// GeoJSON returns the bounding box as GeoJSON polygon geometry.
+// As required by RFC 7946, the ring is counterclockwise.
+func (b BBox) GeoJSON() string {
+	w, s, e, n := formatDegrees(b.MinLng), formatDegrees(b.MinLat), formatDegrees(b.MaxLng), formatDegrees(b.MaxLat)
+	return fmt.Sprintf(`{"type":"Polygon","coordinates":[[[%s,%s],[%s,%s],[%s,%s],[%s,%s],[%s,%s]]]}`, w, s, e, s, e, n, w, n, w, s)
+}
+
+func formatDegrees(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// ParseBBox parses a bounding box in the form "minLng,minLat,maxLng,maxLat",
+// for example "5.96,45.82,10.49,47.81" for Switzerland.
+func ParseBBox(s string) (BBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return BBox{}, fmt.Errorf("bad bounding box %q, want minLng,minLat,maxLng,maxLat", s)
+	}
+	var v [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(f) {
+			return BBox{}, fmt.Errorf("bad bounding box %q", s)
+		}
+		v[i] = f
+	}
+	b := BBox{MinLng: v[0], MinLat: v[1], MaxLng: v[2], MaxLat: v[3]}
+	if b.MinLng < -180 || b.MaxLng > 180 || b.MinLng > b.MaxLng ||
+		b.MinLat < -90 || b.MaxLat > 90 || b.MinLat > b.MaxLat {
+		return BBox{}, fmt.Errorf("bad bounding box %q", s)
+	}
+	return b, nil
+}
+
+// Tile returns the smallest tile that covers the entire bounding box,
+// at zoom level maxZoom or coarser. The result is always aligned
+// to the tile grid, so a regional raster pyramid rooted at this tile
+// has exactly the same extent at every zoom level.
+func (b BBox) Tile(maxZoom uint8) TileKey {
+	minLat := math.Max(b.MinLat, -MaxLatitude)
+	maxLat := math.Min(b.MaxLat, MaxLatitude)
+	for zoom := int(maxZoom); zoom > 0; zoom-- {
+		z := uint8(zoom)
+		x0, y0 := clampedTileFromLatLng(maxLat, b.MinLng, z)
+		x1, y1 := clampedTileFromLatLng(minLat, b.MaxLng, z)
+		if x0 == x1 && y0 == y1 {
+			return MakeTileKey(z, x0, y0)
+		}
+	}
+	return WorldTile
+}
+
+// ClampedTileFromLatLng is like TileFromLatLng, but it keeps the result
+// within the tile grid for coordinates at the edge of the map,
+// such as longitude 180° or latitude -90°.
+func clampedTileFromLatLng(lat, lng float64, zoom uint8) (x, y uint32) {
+	latRad := lat * (math.Pi / 180.0)
+	z := float64(uint32(1) << zoom)
+	fx := (lng + 180.0) / 360.0 * z
+	fy := (1.0 - math.Asinh(math.Tan(latRad))/math.Pi) / 2.0 * z
+	clamp := func(f float64) uint32 {
+		return uint32(math.Max(0, math.Min(f, z-1)))
+	}
+	return clamp(fx), clamp(fy)
+}
+
 // TileKey encodes a zoom/x/y tile into an uin64. Containing tiles get
 // sorted before all their content; when sorting a set of tile keys,
 // the resulting order is that of a depth-first pre-order tree traversal.
@@ -98,6 +186,72 @@ func (t TileKey) ToZoom(z uint8) TileKey {
 	return TileKey(((val >> shift) << shift) | uint64(z))
 }
 
+// Bounds returns the WGS84 bounding box of a tile, in degrees.
+// The bounding box of WorldTile reaches from -MaxLatitude
+// to MaxLatitude.
+func (t TileKey) Bounds() BBox {
+	zoom, x, y := t.ZoomXY()
+	n := float64(uint64(1) << zoom)
+	return BBox{
+		MinLng: float64(x)/n*360.0 - 180.0,
+		MinLat: TileLatitude(zoom, y+1) * (180.0 / math.Pi),
+		MaxLng: float64(x+1)/n*360.0 - 180.0,
+		MaxLat: TileLatitude(zoom, y) * (180.0 / math.Pi),
+	}
+}
+
+// WKT returns the outline of a tile as Well-Known Text,
+// such as "POLYGON((0 0,180 0,180 85.05112877980659,0 85.05112877980659,0 0))"
+// for tile 1/1/0.
+func (t TileKey) WKT() string {
+	return t.Bounds().WKT()
+}
+
+// GeoJSON returns the outline of a tile as GeoJSON polygon geometry,
+// as defined in RFC 7946.
+func (t TileKey) GeoJSON() string {
+	return t.Bounds().GeoJSON()
+}
+
+// Quadkey returns the quadkey of a tile, such as "120" for tile 3/4/2.
+// Quadkeys are used by Bing Maps and many tile caches; their length
+// is the zoom level, so WorldTile has the empty quadkey. See
+// https://learn.microsoft.com/en-us/bingmaps/articles/bing-maps-tile-system
+func (t TileKey) Quadkey() string {
+	zoom, x, y := t.ZoomXY()
+	var buf strings.Builder
+	buf.Grow(int(zoom))
+	for i := zoom; i > 0; i-- {
+		mask := uint32(1) << (i - 1)
+		digit := byte('0')
+		if x&mask != 0 {
+			digit += 1
+		}
+		if y&mask != 0 {
+			digit += 2
+		}
+		buf.WriteByte(digit)
+	}
+	return buf.String()
+}
+
+// ParseQuadkey returns the tile for a quadkey, such as "120" for 3/4/2.
+func ParseQuadkey(s string) (TileKey, error) {
+	if len(s) > 24 {
+		return NoTile, fmt.Errorf("quadkey %q too long", s)
+	}
+	var x, y uint32
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '0' || c > '3' {
+			return NoTile, fmt.Errorf("bad quadkey %q", s)
+		}
+		x = x<<1 | uint32(c-'0')&1
+		y = y<<1 | uint32(c-'0')>>1
+	}
+	return MakeTileKey(uint8(len(s)), x, y), nil
+}
+
 // String formats the tile coordinates into a string.
 func (t TileKey) String() string {
 	if t == NoTile {
@@ -137,8 +291,12 @@ type TileCount struct {
 	Count uint64
 }
 
+var tileCountRegexp = regexp.MustCompile(`^(\d+)/(\d+)/(\d+)\s+(\d+)$`)
+
+// ParseTileCount parses a line of the OpenStreetMap tile logs, such as
+// "7/42/23 98765". For malformed input, the key of the result is NoTile.
 func ParseTileCount(s string) TileCount {
-	match := tileLogRegexp.FindStringSubmatch(s)
+	match := tileCountRegexp.FindStringSubmatch(s)
 	if match == nil || len(match) != 5 {
 		return TileCount{NoTile, 0}
 	}
@@ -1,7 +1,7 @@
 // SPDX-FileCopyrightText: 2022 Sascha Brawer <sascha@brawer.ch>
 // SPDX-License-Identifier: MIT
 
-package main
+package osmviews
 
 import (
 	"fmt"
@@ -485,3 +485,87 @@ func TestTileCountLessContainment(t *testing.T) {
 			big, smallOutside)
 	}
 }
+
+func TestParseBBox(t *testing.T) {
+	got, err := ParseBBox("5.96,45.82, 10.49,47.81")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BBox{MinLng: 5.96, MinLat: 45.82, MaxLng: 10.49, MaxLat: 47.81}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	for _, s := range []string{"", "1,2,3", "a,b,c,d", "10,0,5,1", "0,10,1,5", "-181,0,0,1", "0,0,1,91", "NaN,0,1,1"} {
+		if _, err := ParseBBox(s); err == nil {
+			t.Errorf("ParseBBox(%q) should fail", s)
+		}
+	}
+}
+
+func TestBBox_Tile(t *testing.T) {
+	for _, tc := range []struct {
+		bbox    BBox
+		maxZoom uint8
+		want    string
+	}{
+		{BBox{5.96, 45.82, 10.49, 47.81}, 10, "6/33/22"}, // Switzerland
+		{BBox{5.96, 45.82, 10.49, 47.81}, 4, "4/8/5"},    // limited by maxZoom
+		{BBox{8.54, 47.37, 8.55, 47.38}, 8, "8/134/89"},  // Zürich
+		{BBox{-10, -10, 10, 10}, 10, "0/0/0"},            // crosses origin
+		{BBox{-180, -90, 180, 90}, 10, "0/0/0"},          // whole world
+		{BBox{179.9, -89.9, 180, -89.8}, 3, "3/7/7"},     // edge of map
+	} {
+		if got := tc.bbox.Tile(tc.maxZoom).String(); got != tc.want {
+			t.Errorf("%+v.Tile(%d): got %s, want %s", tc.bbox, tc.maxZoom, got, tc.want)
+		}
+	}
+}
+
+func ExampleTileKey_Bounds() {
+	fmt.Printf("%+v\n", MakeTileKey(1, 1, 0).Bounds())
+	// Output: {MinLng:0 MinLat:0 MaxLng:180 MaxLat:85.05112877980659}
+}
+
+func ExampleTileKey_WKT() {
+	fmt.Println(MakeTileKey(2, 2, 2).WKT())
+	// Output: POLYGON((0 -66.51326044311185,90 -66.51326044311185,90 0,0 0,0 -66.51326044311185))
+}
+
+func ExampleTileKey_GeoJSON() {
+	fmt.Println(MakeTileKey(2, 2, 2).GeoJSON())
+	// Output: {"type":"Polygon","coordinates":[[[0,-66.51326044311185],[90,-66.51326044311185],[90,0],[0,0],[0,-66.51326044311185]]]}
+}
+
+func ExampleTileKey_Quadkey() {
+	fmt.Printf("%q %q\n", MakeTileKey(3, 3, 5).Quadkey(), WorldTile.Quadkey())
+	// Output: "213" ""
+}
+
+func TestTileKey_Bounds(t *testing.T) {
+	// Zürich is at 47.3769° N, 8.5417° E.
+	b := MakeTileKey(13, 4290, 2868).Bounds()
+	if !(b.MinLng < 8.5417 && 8.5417 < b.MaxLng && b.MinLat < 47.3769 && 47.3769 < b.MaxLat) {
+		t.Errorf("got %+v, want a box around Zürich", b)
+	}
+	if got := WorldTile.Bounds(); got.MinLng != -180 || got.MaxLng != 180 || math.Abs(got.MaxLat-MaxLatitude) > 1e-12 || math.Abs(got.MinLat+MaxLatitude) > 1e-12 {
+		t.Errorf("got %+v for WorldTile", got)
+	}
+}
+
+func TestParseQuadkey(t *testing.T) {
+	for _, key := range makeTestTileKeys(1000) {
+		got, err := ParseQuadkey(key.Quadkey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != key {
+			t.Errorf("not round-trippable: %v, got %v", key, got)
+		}
+	}
+	for _, s := range []string{"4", "12a", "0123012301230123012301230"} {
+		if got, err := ParseQuadkey(s); err == nil {
+			t.Errorf("ParseQuadkey(%q) should fail, got %v", s, got)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package qrank
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ItemSignals contains the ranking signals for one Wikidata item.
+// Signals that are not part of a file’s schema are zero.
+type ItemSignals struct {
+	Item           string // eg. "Q72"
+	Pageviews      int64  // pageviews in the last 52 weeks
+	WikitextBytes  int64
+	Claims         int64
+	Identifiers    int64
+	Sitelinks      int64
+	Disambiguation bool  // since schema version 2
+	Outlinks       int64 // since schema version 2
+	Infoboxes      int64 // since schema version 2
+
+	// Pageviews on the single wiki where the item has most views,
+	// since schema version 3. Topics that have been translated into
+	// many languages get much higher totals than topics of regional
+	// interest; this signal lets consumers rank without that effect.
+	MaxWikiPageviews int64
+
+	// The first class (P31, “instance of”) of the item, such as
+	// "Q515" for cities, since schema version 4. Empty if the item
+	// is not an instance of any class.
+	Class string
+
+	// If the item has been merged into another item, the ID of that
+	// other item, such as "Q72", since schema version 5. The signals
+	// are then those of the other item, so references to the merged
+	// item still resolve to a rank. Empty for items that have not
+	// been merged.
+	MergedInto string
+
+	// Whether the item looks like a stub that only exists to hold
+	// external identifiers, without sitelinks or pageviews, since
+	// schema version 6. Consumers can drop such items, which are
+	// mostly noise at the bottom of the ranking.
+	Stub bool
+
+	// The number of external links and of transcluded templates,
+	// summed over all pages of the item, since schema version 7.
+	// External links are a rough proxy for references; together,
+	// they hint at how well the pages have been edited. Only filled
+	// if the build counted them, otherwise zero.
+	ExternalLinks int64
+	Templates     int64
+
+	// The number of items whose pages link to a page of this item
+	// on the same wiki, summed over all wikis, since schema version 8.
+	// Unlike PageRank, this simple in-degree is easy to explain.
+	Inlinks int64
+}
+
+// ItemSignalsReader reads item_signals files in any known schema.
+// The reader expects uncompressed CSV; published files are compressed
+// with zstd, so callers need to wrap them in a decompressor.
+type ItemSignalsReader struct {
+	scanner  *bufio.Scanner
+	schema   *ItemSignalsSchema
+	comments []string
+	line     int
+}
+
+// NewItemSignalsReader reads the comments and the header of an
+// item_signals file, and returns a reader for its rows.
+func NewItemSignalsReader(r io.Reader) (*ItemSignalsReader, error) {
+	reader := &ItemSignalsReader{
+		scanner:  bufio.NewScanner(r),
+		comments: make([]string, 0, 8),
+	}
+
+	version := 0
+	for reader.scanner.Scan() {
+		reader.line += 1
+		line := reader.scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			reader.comments = append(reader.comments, line)
+			if v, ok := strings.CutPrefix(line, "# schema: "); ok {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: bad schema %q", reader.line, v)
+				}
+				version = n
+			}
+			continue
+		}
+
+		header := strings.Split(line, ",")
+		if version == 0 {
+			version = 1
+		}
+		schema, err := LookupItemSignalsSchema(version)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Equal(header, schema.Columns) {
+			return nil, fmt.Errorf("line %d: header %q does not match schema version %d", reader.line, line, version)
+		}
+		reader.schema = schema
+		return reader, nil
+	}
+
+	if err := reader.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("missing header")
+}
+
+// Schema returns the schema of the file being read.
+func (r *ItemSignalsReader) Schema() *ItemSignalsSchema {
+	return r.schema
+}
+
+// Comments returns the comment lines before the header, such as
+// "# version: 2024-05-01".
+func (r *ItemSignalsReader) Comments() []string {
+	return r.comments
+}
+
+// Read returns the signals of the next item. At the end of the file,
+// the result is io.EOF.
+func (r *ItemSignalsReader) Read() (*ItemSignals, error) {
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	r.line += 1
+
+	line := r.scanner.Text()
+	cols := strings.Split(line, ",")
+	if len(cols) != len(r.schema.Columns) {
+		return nil, fmt.Errorf("line %d: expected %d columns, got %q", r.line, len(r.schema.Columns), line)
+	}
+
+	sig := &ItemSignals{Item: cols[0]}
+	if !strings.HasPrefix(sig.Item, "Q") {
+		return nil, fmt.Errorf("line %d: bad item %q", r.line, sig.Item)
+	}
+	for i, name := range r.schema.Columns[1:] {
+		if name == "class" || name == "merged_into" {
+			if c := cols[i+1]; c != "" && !strings.HasPrefix(c, "Q") {
+				return nil, fmt.Errorf("line %d: bad %s %q", r.line, name, c)
+			}
+			if name == "class" {
+				sig.Class = cols[i+1]
+			} else {
+				sig.MergedInto = cols[i+1]
+			}
+			continue
+		}
+		value, err := strconv.ParseInt(cols[i+1], 10, 64)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("line %d: bad %s %q", r.line, name, cols[i+1])
+		}
+		switch name {
+		case "pageviews_52w":
+			sig.Pageviews = value
+		case "wikitext_bytes":
+			sig.WikitextBytes = value
+		case "claims":
+			sig.Claims = value
+		case "identifiers":
+			sig.Identifiers = value
+		case "sitelinks":
+			sig.Sitelinks = value
+		case "disambiguation":
+			sig.Disambiguation = value != 0
+		case "is_stub":
+			sig.Stub = value != 0
+		case "outlinks":
+			sig.Outlinks = value
+		case "infoboxes":
+			sig.Infoboxes = value
+		case "pageviews_52w_max_wiki":
+			sig.MaxWikiPageviews = value
+		case "external_links":
+			sig.ExternalLinks = value
+		case "templates":
+			sig.Templates = value
+		case "inlinks":
+			sig.Inlinks = value
+		}
+	}
+	return sig, nil
+}
@@ -0,0 +1,222 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package qrank
+
+import (
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestItemSignalsReader(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		input   string
+		version int
+		want    []ItemSignals
+	}{
+		{
+			"v1",
+			"# version: 2024-04-01\n" +
+				"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks\n" +
+				"Q72,1,2,3,4,5\n" +
+				"Q99,9,8,7,6,5\n",
+			1,
+			[]ItemSignals{
+				{Item: "Q72", Pageviews: 1, WikitextBytes: 2, Claims: 3, Identifiers: 4, Sitelinks: 5},
+				{Item: "Q99", Pageviews: 9, WikitextBytes: 8, Claims: 7, Identifiers: 6, Sitelinks: 5},
+			},
+		},
+		{
+			"v1 with schema comment",
+			"# schema: 1\n" +
+				"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks\n" +
+				"Q72,1,2,3,4,5\n",
+			1,
+			[]ItemSignals{
+				{Item: "Q72", Pageviews: 1, WikitextBytes: 2, Claims: 3, Identifiers: 4, Sitelinks: 5},
+			},
+		},
+		{
+			"v2",
+			"# version: 2024-05-01\n" +
+				"# schema: 2\n" +
+				"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes\n" +
+				"Q72,1,2,3,4,5,0,6,7\n" +
+				"Q5,1,0,0,0,0,1,0,0\n",
+			2,
+			[]ItemSignals{
+				{Item: "Q72", Pageviews: 1, WikitextBytes: 2, Claims: 3, Identifiers: 4, Sitelinks: 5, Outlinks: 6, Infoboxes: 7},
+				{Item: "Q5", Pageviews: 1, Disambiguation: true},
+			},
+		},
+		{
+			"v3",
+			"# schema: 3\n" +
+				"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes,pageviews_52w_max_wiki\n" +
+				"Q72,90,2,3,4,5,0,6,7,60\n",
+			3,
+			[]ItemSignals{
+				{Item: "Q72", Pageviews: 90, WikitextBytes: 2, Claims: 3, Identifiers: 4, Sitelinks: 5, Outlinks: 6, Infoboxes: 7, MaxWikiPageviews: 60},
+			},
+		},
+		{
+			"v4",
+			"# schema: 4\n" +
+				"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes,pageviews_52w_max_wiki,class\n" +
+				"Q72,90,2,3,4,5,0,6,7,60,Q515\n" +
+				"Q5,1,0,0,0,0,0,0,0,1,\n",
+			4,
+			[]ItemSignals{
+				{Item: "Q72", Pageviews: 90, WikitextBytes: 2, Claims: 3, Identifiers: 4, Sitelinks: 5, Outlinks: 6, Infoboxes: 7, MaxWikiPageviews: 60, Class: "Q515"},
+				{Item: "Q5", Pageviews: 1, MaxWikiPageviews: 1},
+			},
+		},
+		{
+			"v5",
+			"# schema: 5\n" +
+				"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes,pageviews_52w_max_wiki,class,merged_into\n" +
+				"Q72,90,2,3,4,5,0,6,7,60,Q515,\n" +
+				"Q4115189,90,2,3,4,5,0,6,7,60,Q515,Q72\n",
+			5,
+			[]ItemSignals{
+				{Item: "Q72", Pageviews: 90, WikitextBytes: 2, Claims: 3, Identifiers: 4, Sitelinks: 5, Outlinks: 6, Infoboxes: 7, MaxWikiPageviews: 60, Class: "Q515"},
+				{Item: "Q4115189", Pageviews: 90, WikitextBytes: 2, Claims: 3, Identifiers: 4, Sitelinks: 5, Outlinks: 6, Infoboxes: 7, MaxWikiPageviews: 60, Class: "Q515", MergedInto: "Q72"},
+			},
+		},
+		{
+			"v6",
+			"# schema: 6\n" +
+				"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes,pageviews_52w_max_wiki,class,merged_into,is_stub\n" +
+				"Q72,90,2,3,4,5,0,6,7,60,Q515,,0\n" +
+				"Q123456789,0,0,4,3,0,0,0,0,0,Q13442814,,1\n",
+			6,
+			[]ItemSignals{
+				{Item: "Q72", Pageviews: 90, WikitextBytes: 2, Claims: 3, Identifiers: 4, Sitelinks: 5, Outlinks: 6, Infoboxes: 7, MaxWikiPageviews: 60, Class: "Q515"},
+				{Item: "Q123456789", Claims: 4, Identifiers: 3, Class: "Q13442814", Stub: true},
+			},
+		},
+		{
+			"v7",
+			"# schema: 7\n" +
+				"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes,pageviews_52w_max_wiki,class,merged_into,is_stub,external_links,templates\n" +
+				"Q72,90,2,3,4,5,0,6,7,60,Q515,,0,31,45\n",
+			7,
+			[]ItemSignals{
+				{Item: "Q72", Pageviews: 90, WikitextBytes: 2, Claims: 3, Identifiers: 4, Sitelinks: 5, Outlinks: 6, Infoboxes: 7, MaxWikiPageviews: 60, Class: "Q515", ExternalLinks: 31, Templates: 45},
+			},
+		},
+		{
+			"v8",
+			"# schema: 8\n" +
+				"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes,pageviews_52w_max_wiki,class,merged_into,is_stub,external_links,templates,inlinks\n" +
+				"Q72,90,2,3,4,5,0,6,7,60,Q515,,0,31,45,812\n",
+			8,
+			[]ItemSignals{
+				{Item: "Q72", Pageviews: 90, WikitextBytes: 2, Claims: 3, Identifiers: 4, Sitelinks: 5, Outlinks: 6, Infoboxes: 7, MaxWikiPageviews: 60, Class: "Q515", ExternalLinks: 31, Templates: 45, Inlinks: 812},
+			},
+		},
+	} {
+		r, err := NewItemSignalsReader(strings.NewReader(tc.input))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got := r.Schema().Version; got != tc.version {
+			t.Errorf("%s: got schema version %d, want %d", tc.name, got, tc.version)
+		}
+		got := make([]ItemSignals, 0, len(tc.want))
+		for {
+			sig, err := r.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+				break
+			}
+			got = append(got, *sig)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestItemSignalsReader_Comments(t *testing.T) {
+	input := "# version: 2024-05-01\n# schema: 2\n" +
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes\n"
+	r, err := NewItemSignalsReader(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"# version: 2024-05-01", "# schema: 2"}
+	if got := r.Comments(); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("got %v, want io.EOF", err)
+	}
+}
+
+func TestItemSignalsReader_BadHeader(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"# version: 2024-05-01\n",
+		"# schema: x\nitem,pageviews_52w\n",
+		"# schema: 999\nitem\n",
+		"item,pageviews_52w\n",
+		"# schema: 2\nitem,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks\n",
+	} {
+		if _, err := NewItemSignalsReader(strings.NewReader(input)); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestItemSignalsReader_BadRow(t *testing.T) {
+	header := "item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks\n"
+	for _, row := range []string{
+		"Q72,1,2,3,4\n",
+		"Q72,1,2,3,4,5,6\n",
+		"L72,1,2,3,4,5\n",
+		"Q72,1,2,x,4,5\n",
+		"Q72,1,2,-3,4,5\n",
+	} {
+		r, err := NewItemSignalsReader(strings.NewReader(header + row))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Read(); err == nil || err == io.EOF {
+			t.Errorf("expected error for %q, got %v", row, err)
+		}
+	}
+}
+
+func TestItemSignalsReader_BadClass(t *testing.T) {
+	input := "# schema: 4\n" +
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks,disambiguation,outlinks,infoboxes,pageviews_52w_max_wiki,class\n" +
+		"Q72,1,0,0,0,0,0,0,0,1,515\n"
+	r, err := NewItemSignalsReader(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); err == nil || err == io.EOF {
+		t.Errorf("expected error for bad class, got %v", err)
+	}
+}
+
+func TestLookupItemSignalsSchema(t *testing.T) {
+	s, err := LookupItemSignalsSchema(CurrentItemSignalsSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Version != CurrentItemSignalsSchema {
+		t.Errorf("got version %d, want %d", s.Version, CurrentItemSignalsSchema)
+	}
+	if _, err := LookupItemSignalsSchema(0); err == nil {
+		t.Error("expected error for version 0")
+	}
+}
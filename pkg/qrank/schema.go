@@ -0,0 +1,170 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+// Package qrank reads the files that get published by the QRank project.
+//
+// The item_signals files have changed their columns over time. Each
+// version of the columns is defined in ItemSignalsSchemas, and files
+// declare the version they use, so that readers can keep parsing
+// older releases.
+package qrank
+
+import "fmt"
+
+// ItemSignalsSchema defines the columns of an item_signals file.
+// Files declare their schema in a "# schema: 2" comment line before
+// the CSV header; files without such a line are version 1.
+type ItemSignalsSchema struct {
+	Version int
+	Columns []string
+}
+
+// CurrentItemSignalsSchema is the schema version that gets written
+// by default.
+const CurrentItemSignalsSchema = 2
+
+// ItemSignalsSchemas contains all known schemas, keyed by version.
+// Once a schema has been published, it must not change; new columns
+// go into a new version.
+var ItemSignalsSchemas = map[int]*ItemSignalsSchema{
+	1: {
+		Version: 1,
+		Columns: []string{
+			"item",
+			"pageviews_52w",
+			"wikitext_bytes",
+			"claims",
+			"identifiers",
+			"sitelinks",
+		},
+	},
+	2: {
+		Version: 2,
+		Columns: []string{
+			"item",
+			"pageviews_52w",
+			"wikitext_bytes",
+			"claims",
+			"identifiers",
+			"sitelinks",
+			"disambiguation",
+			"outlinks",
+			"infoboxes",
+		},
+	},
+	3: {
+		Version: 3,
+		Columns: []string{
+			"item",
+			"pageviews_52w",
+			"wikitext_bytes",
+			"claims",
+			"identifiers",
+			"sitelinks",
+			"disambiguation",
+			"outlinks",
+			"infoboxes",
+			"pageviews_52w_max_wiki",
+		},
+	},
+	4: {
+		Version: 4,
+		Columns: []string{
+			"item",
+			"pageviews_52w",
+			"wikitext_bytes",
+			"claims",
+			"identifiers",
+			"sitelinks",
+			"disambiguation",
+			"outlinks",
+			"infoboxes",
+			"pageviews_52w_max_wiki",
+			"class",
+		},
+	},
+	5: {
+		Version: 5,
+		Columns: []string{
+			"item",
+			"pageviews_52w",
+			"wikitext_bytes",
+			"claims",
+			"identifiers",
+			"sitelinks",
+			"disambiguation",
+			"outlinks",
+			"infoboxes",
+			"pageviews_52w_max_wiki",
+			"class",
+			"merged_into",
+		},
+	},
+	6: {
+		Version: 6,
+		Columns: []string{
+			"item",
+			"pageviews_52w",
+			"wikitext_bytes",
+			"claims",
+			"identifiers",
+			"sitelinks",
+			"disambiguation",
+			"outlinks",
+			"infoboxes",
+			"pageviews_52w_max_wiki",
+			"class",
+			"merged_into",
+			"is_stub",
+		},
+	},
+	7: {
+		Version: 7,
+		Columns: []string{
+			"item",
+			"pageviews_52w",
+			"wikitext_bytes",
+			"claims",
+			"identifiers",
+			"sitelinks",
+			"disambiguation",
+			"outlinks",
+			"infoboxes",
+			"pageviews_52w_max_wiki",
+			"class",
+			"merged_into",
+			"is_stub",
+			"external_links",
+			"templates",
+		},
+	},
+	8: {
+		Version: 8,
+		Columns: []string{
+			"item",
+			"pageviews_52w",
+			"wikitext_bytes",
+			"claims",
+			"identifiers",
+			"sitelinks",
+			"disambiguation",
+			"outlinks",
+			"infoboxes",
+			"pageviews_52w_max_wiki",
+			"class",
+			"merged_into",
+			"is_stub",
+			"external_links",
+			"templates",
+			"inlinks",
+		},
+	},
+}
+
+// LookupItemSignalsSchema returns the schema for a version number.
+func LookupItemSignalsSchema(version int) (*ItemSignalsSchema, error) {
+	if s, ok := ItemSignalsSchemas[version]; ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown item_signals schema version %d", version)
+}
@@ -0,0 +1,10 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+// Package qrankpb contains the Go bindings for the QRankService gRPC
+// service, which is offered by the QRank webserver. Tools written in
+// other languages can generate their own bindings from qrank.proto,
+// or discover the service through gRPC server reflection.
+package qrankpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative qrank.proto
@@ -0,0 +1,197 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+// To regenerate the Go bindings after changing this file, run
+// go generate ./pkg/qrankpb
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: qrank.proto
+
+package qrankpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	QRankService_GetRank_FullMethodName      = "/qrank.v1.QRankService/GetRank"
+	QRankService_BatchGetRank_FullMethodName = "/qrank.v1.QRankService/BatchGetRank"
+	QRankService_TopN_FullMethodName         = "/qrank.v1.QRankService/TopN"
+)
+
+// QRankServiceClient is the client API for QRankService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type QRankServiceClient interface {
+	// GetRank returns the rank of a single entity. If the entity
+	// is not ranked, the call fails with status NOT_FOUND.
+	GetRank(ctx context.Context, in *GetRankRequest, opts ...grpc.CallOption) (*GetRankResponse, error)
+	// BatchGetRank returns the ranks of up to 1000 entities.
+	BatchGetRank(ctx context.Context, in *BatchGetRankRequest, opts ...grpc.CallOption) (*BatchGetRankResponse, error)
+	// TopN returns the top-ranked entities, at most 1000 per call.
+	TopN(ctx context.Context, in *TopNRequest, opts ...grpc.CallOption) (*TopNResponse, error)
+}
+
+type qRankServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewQRankServiceClient(cc grpc.ClientConnInterface) QRankServiceClient {
+	return &qRankServiceClient{cc}
+}
+
+func (c *qRankServiceClient) GetRank(ctx context.Context, in *GetRankRequest, opts ...grpc.CallOption) (*GetRankResponse, error) {
+	out := new(GetRankResponse)
+	err := c.cc.Invoke(ctx, QRankService_GetRank_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *qRankServiceClient) BatchGetRank(ctx context.Context, in *BatchGetRankRequest, opts ...grpc.CallOption) (*BatchGetRankResponse, error) {
+	out := new(BatchGetRankResponse)
+	err := c.cc.Invoke(ctx, QRankService_BatchGetRank_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *qRankServiceClient) TopN(ctx context.Context, in *TopNRequest, opts ...grpc.CallOption) (*TopNResponse, error) {
+	out := new(TopNResponse)
+	err := c.cc.Invoke(ctx, QRankService_TopN_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// QRankServiceServer is the server API for QRankService service.
+// All implementations must embed UnimplementedQRankServiceServer
+// for forward compatibility
+type QRankServiceServer interface {
+	// GetRank returns the rank of a single entity. If the entity
+	// is not ranked, the call fails with status NOT_FOUND.
+	GetRank(context.Context, *GetRankRequest) (*GetRankResponse, error)
+	// BatchGetRank returns the ranks of up to 1000 entities.
+	BatchGetRank(context.Context, *BatchGetRankRequest) (*BatchGetRankResponse, error)
+	// TopN returns the top-ranked entities, at most 1000 per call.
+	TopN(context.Context, *TopNRequest) (*TopNResponse, error)
+	mustEmbedUnimplementedQRankServiceServer()
+}
+
+// UnimplementedQRankServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedQRankServiceServer struct {
+}
+
+func (UnimplementedQRankServiceServer) GetRank(context.Context, *GetRankRequest) (*GetRankResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRank not implemented")
+}
+func (UnimplementedQRankServiceServer) BatchGetRank(context.Context, *BatchGetRankRequest) (*BatchGetRankResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchGetRank not implemented")
+}
+func (UnimplementedQRankServiceServer) TopN(context.Context, *TopNRequest) (*TopNResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TopN not implemented")
+}
+func (UnimplementedQRankServiceServer) mustEmbedUnimplementedQRankServiceServer() {}
+
+// UnsafeQRankServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to QRankServiceServer will
+// result in compilation errors.
+type UnsafeQRankServiceServer interface {
+	mustEmbedUnimplementedQRankServiceServer()
+}
+
+func RegisterQRankServiceServer(s grpc.ServiceRegistrar, srv QRankServiceServer) {
+	s.RegisterService(&QRankService_ServiceDesc, srv)
+}
+
+func _QRankService_GetRank_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRankRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QRankServiceServer).GetRank(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: QRankService_GetRank_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QRankServiceServer).GetRank(ctx, req.(*GetRankRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _QRankService_BatchGetRank_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchGetRankRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QRankServiceServer).BatchGetRank(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: QRankService_BatchGetRank_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QRankServiceServer).BatchGetRank(ctx, req.(*BatchGetRankRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _QRankService_TopN_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TopNRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QRankServiceServer).TopN(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: QRankService_TopN_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QRankServiceServer).TopN(ctx, req.(*TopNRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// QRankService_ServiceDesc is the grpc.ServiceDesc for QRankService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var QRankService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "qrank.v1.QRankService",
+	HandlerType: (*QRankServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetRank",
+			Handler:    _QRankService_GetRank_Handler,
+		},
+		{
+			MethodName: "BatchGetRank",
+			Handler:    _QRankService_BatchGetRank_Handler,
+		},
+		{
+			MethodName: "TopN",
+			Handler:    _QRankService_TopN_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "qrank.proto",
+}